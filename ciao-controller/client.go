@@ -19,8 +19,10 @@ package main
 import (
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
 	"github.com/golang/glog"
 	"gopkg.in/yaml.v2"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,10 +30,43 @@ type ssntpClient struct {
 	context *controller
 	ssntp   ssntp.Client
 	name    string
+	// connections counts the connections to the scheduler
+	connections int32
 }
 
 func (client *ssntpClient) ConnectNotify() {
 	glog.Info(client.name, " connected")
+
+	// Catch up with the events missed while disconnected
+	if atomic.AddInt32(&client.connections, 1) > 1 {
+		go client.replayEvents()
+	}
+
+	go client.requestTopology()
+}
+
+// replayEvents asks the scheduler for the node and instance events sent
+// while the controller was disconnected.
+func (client *ssntpClient) replayEvents() {
+	var cmd payloads.ReplayEvents
+
+	payload, err := yaml.Marshal(&cmd)
+	if err != nil {
+		glog.Warningf("Unable to marshal REPLAYEVENTS: %v", err)
+		return
+	}
+
+	if _, err = client.ssntp.SendCommand(ssntp.REPLAYEVENTS, payload); err != nil {
+		glog.Warningf("Unable to send REPLAYEVENTS: %v", err)
+	}
+}
+
+// requestTopology asks the scheduler for the nodes currently connected to
+// it.
+func (client *ssntpClient) requestTopology() {
+	if _, err := client.ssntp.SendCommand(ssntp.TOPOLOGY, nil); err != nil {
+		glog.Warningf("Unable to send TOPOLOGY: %v", err)
+	}
 }
 
 func (client *ssntpClient) DisconnectNotify() {
@@ -50,12 +85,23 @@ func (client *ssntpClient) CommandNotify(command ssntp.Command, frame *ssntp.Fra
 
 	if command == ssntp.STATS {
 		stats.Init()
-		err := yaml.Unmarshal(payload, &stats)
+		err := payloads.UnmarshalTolerant(payload, &stats)
 		if err != nil {
 			glog.Warning("error unmarshalling temp stat")
 			return
 		}
 		client.context.ds.HandleStats(stats)
+	} else if command == ssntp.EVACUATE {
+		var evacuate payloads.Evacuate
+		err := payloads.Unmarshal(payload, &evacuate)
+		if err == nil {
+			err = evacuate.Validate()
+		}
+		if err != nil {
+			glog.Warningf("Error unmarshalling EVACUATE request: %v", err)
+			return
+		}
+		glog.Warningf("Node %s asks to be evacuated", evacuate.Evacuate.WorkloadAgentUUID)
 	}
 	glog.V(1).Info(string(payload))
 }
@@ -67,15 +113,110 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 	switch event {
 	case ssntp.InstanceDeleted:
 		var event payloads.EventInstanceDeleted
-		err := yaml.Unmarshal(payload, &event)
+		err := payloads.Unmarshal(payload, &event)
 		if err != nil {
 			glog.Warning("Error unmarshalling InstanceDeleted")
 			return
 		}
 		client.context.ds.DeleteInstance(event.InstanceDeleted.InstanceUUID)
+	case ssntp.InstanceStateChanged:
+		var event payloads.EventInstanceStateChanged
+		err := payloads.Unmarshal(payload, &event)
+		if err == nil {
+			err = event.Validate()
+		}
+		if err != nil {
+			glog.Warningf("Error unmarshalling InstanceStateChanged: %v", err)
+			return
+		}
+		changed := &event.StateChanged
+		err = client.context.ds.InstanceStateChanged(changed.InstanceUUID,
+			changed.NodeUUID, changed.State)
+		if err != nil {
+			glog.Warningf("Unable to record state of instance %s: %v",
+				changed.InstanceUUID, err)
+		}
+	case ssntp.InstanceReady:
+		var event payloads.EventInstanceReady
+		err := payloads.Unmarshal(payload, &event)
+		if err != nil {
+			glog.Warning("Error unmarshalling InstanceReady")
+			return
+		}
+		glog.Infof("Instance %s ready after %d ms", event.InstanceReady.InstanceUUID,
+			event.InstanceReady.BootDurationMS)
+	case ssntp.ImagePullProgress:
+		var event payloads.EventImagePullProgress
+		err := payloads.Unmarshal(payload, &event)
+		if err == nil {
+			err = event.Validate()
+		}
+		if err != nil {
+			glog.Warningf("Error unmarshalling ImagePullProgress: %v", err)
+			return
+		}
+		pull := &event.PullProgress
+		glog.Infof("Pulling image %s of instance %s: %d/%d layers, %d/%d bytes",
+			pull.Image, pull.InstanceUUID, pull.LayersDone, pull.Layers,
+			pull.DownloadedBytes, pull.TotalBytes)
+	case ssntp.InstanceUnhealthy:
+		var event payloads.EventInstanceUnhealthy
+		err := payloads.Unmarshal(payload, &event)
+		if err == nil {
+			err = event.Validate()
+		}
+		if err != nil {
+			glog.Warningf("Error unmarshalling InstanceUnhealthy: %v", err)
+			return
+		}
+		unhealthy := &event.InstanceUnhealthy
+		glog.Warningf("Instance %s unhealthy after %d failed checks: %s",
+			unhealthy.InstanceUUID, unhealthy.FailingStreak, unhealthy.Output)
+	case ssntp.InstanceDiskFull:
+		var event payloads.EventInstanceDiskFull
+		err := payloads.Unmarshal(payload, &event)
+		if err == nil {
+			err = event.Validate()
+		}
+		if err != nil {
+			glog.Warningf("Error unmarshalling InstanceDiskFull: %v", err)
+			return
+		}
+		full := &event.InstanceDiskFull
+		glog.Warningf("Instance %s disk full: %d MB used of %d MB",
+			full.InstanceUUID, full.UsageMB, full.LimitMB)
+	case ssntp.DiagnosticsData:
+		var event payloads.EventDiagnosticsData
+		err := payloads.Unmarshal(payload, &event)
+		if err != nil {
+			glog.Warning("Error unmarshalling DiagnosticsData")
+			return
+		}
+		chunk := &event.Chunk
+		if chunk.Error != "" {
+			glog.Warningf("Unable to collect diagnostics for instance %s: %s",
+				chunk.InstanceUUID, chunk.Error)
+		} else if chunk.Last {
+			glog.Infof("Diagnostics for instance %s collected", chunk.InstanceUUID)
+		}
+	case ssntp.AttestationQuote:
+		var event payloads.EventAttestationQuote
+		err := payloads.Unmarshal(payload, &event)
+		if err != nil {
+			glog.Warning("Error unmarshalling AttestationQuote")
+			return
+		}
+		quote := &event.Quote
+		if quote.Error != "" {
+			glog.Warningf("Unable to obtain attestation quote for instance %s: %s",
+				quote.InstanceUUID, quote.Error)
+		} else {
+			glog.Infof("Attestation quote for instance %s: nonce %s quote %s",
+				quote.InstanceUUID, quote.Nonce, quote.Quote)
+		}
 	case ssntp.ConcentratorInstanceAdded:
 		var event payloads.EventConcentratorInstanceAdded
-		err := yaml.Unmarshal(payload, &event)
+		err := payloads.Unmarshal(payload, &event)
 		if err != nil {
 			glog.Warning(err)
 			return
@@ -84,7 +225,7 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 		client.context.ds.AddCNCIIP(newCNCI.ConcentratorMAC, newCNCI.ConcentratorIP)
 	case ssntp.TraceReport:
 		var trace payloads.Trace
-		err := yaml.Unmarshal(payload, &trace)
+		err := payloads.Unmarshal(payload, &trace)
 		if err != nil {
 			glog.Warning("error unmarshalling TraceReport")
 			return
@@ -93,7 +234,7 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 
 	case ssntp.NodeConnected:
 		var nodeConnected payloads.NodeConnected
-		err := yaml.Unmarshal(payload, &nodeConnected)
+		err := payloads.Unmarshal(payload, &nodeConnected)
 		if err != nil {
 			glog.Warning("error unmarshalling NodeConnected")
 			return
@@ -102,7 +243,7 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 
 	case ssntp.NodeDisconnected:
 		var nodeDisconnected payloads.NodeDisconnected
-		err := yaml.Unmarshal(payload, &nodeDisconnected)
+		err := payloads.Unmarshal(payload, &nodeDisconnected)
 		if err != nil {
 			glog.Warning("error unmarshalling NodeDisconnected")
 			return
@@ -111,6 +252,50 @@ func (client *ssntpClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
 		glog.Infof("Node %s disconnected", nodeDisconnected.Disconnected.NodeUUID)
 		client.context.ds.DeleteNode(nodeDisconnected.Disconnected.NodeUUID)
 
+	case ssntp.ReservationStatus:
+		var reservation payloads.EventReservationStatus
+		err := payloads.Unmarshal(payload, &reservation)
+		if err != nil {
+			glog.Warning("error unmarshalling ReservationStatus")
+			return
+		}
+
+		status := &reservation.Status
+		switch status.State {
+		case payloads.ReservationHeld:
+			glog.Infof("Reservation %s held on node %s until %s",
+				status.ReservationID, status.NodeUUID, status.Expires)
+		case payloads.ReservationFailed:
+			glog.Warningf("Reservation %s failed: %s", status.ReservationID, status.Reason)
+		default:
+			glog.Infof("Reservation %s %s", status.ReservationID, status.State)
+		}
+
+	case ssntp.EventsReplayed:
+		var replayed payloads.EventsReplayed
+		err := payloads.Unmarshal(payload, &replayed)
+		if err != nil {
+			glog.Warning("error unmarshalling EventsReplayed")
+			return
+		}
+
+		if !replayed.Replayed.Complete {
+			glog.Warning("Events missed while disconnected could not all be replayed")
+		} else {
+			glog.Infof("%d events missed while disconnected replayed", replayed.Replayed.Replayed)
+		}
+
+	case ssntp.ClusterTopology:
+		var topology payloads.ClusterTopology
+		err := payloads.Unmarshal(payload, &topology)
+		if err != nil {
+			glog.Warning("error unmarshalling ClusterTopology")
+			return
+		}
+
+		glog.Infof("Cluster has %d compute nodes and %d network nodes",
+			len(topology.Topology.ComputeNodes), len(topology.Topology.NetworkNodes))
+
 	}
 	glog.V(1).Info(string(payload))
 }
@@ -122,7 +307,7 @@ func (client *ssntpClient) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
 	switch err {
 	case ssntp.StartFailure:
 		var failure payloads.ErrorStartFailure
-		err := yaml.Unmarshal(payload, &failure)
+		err := payloads.Unmarshal(payload, &failure)
 		if err != nil {
 			glog.Warning("Error unmarshalling StartFailure")
 			return
@@ -130,7 +315,7 @@ func (client *ssntpClient) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
 		client.context.ds.StartFailure(failure.InstanceUUID, failure.Reason)
 	case ssntp.StopFailure:
 		var failure payloads.ErrorStopFailure
-		err := yaml.Unmarshal(payload, &failure)
+		err := payloads.Unmarshal(payload, &failure)
 		if err != nil {
 			glog.Warning("Error unmarshalling StopFailure")
 			return
@@ -138,12 +323,22 @@ func (client *ssntpClient) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
 		client.context.ds.StopFailure(failure.InstanceUUID, failure.Reason)
 	case ssntp.RestartFailure:
 		var failure payloads.ErrorRestartFailure
-		err := yaml.Unmarshal(payload, &failure)
+		err := payloads.Unmarshal(payload, &failure)
 		if err != nil {
 			glog.Warning("Error unmarshalling RestartFailure")
 			return
 		}
 		client.context.ds.RestartFailure(failure.InstanceUUID, failure.Reason)
+	case ssntp.InvalidPayload:
+		var failure payloads.ErrorInvalidPayload
+		err := payloads.Unmarshal(payload, &failure)
+		if err != nil {
+			glog.Warning("Error unmarshalling InvalidPayload")
+			return
+		}
+		for _, e := range failure.Errors {
+			glog.Warningf("Invalid %s %s payload for instance %s: %s", failure.Type, failure.Operand, failure.InstanceUUID, e)
+		}
 	}
 	glog.V(1).Info(string(payload))
 }
@@ -155,14 +350,16 @@ func newSSNTPClient(context *controller, config *ssntp.Config) (*ssntpClient, er
 	return client, err
 }
 
-func (client *ssntpClient) StartTracedWorkload(config string, startTime time.Time, label string) error {
-	glog.V(1).Info("START TRACED config:")
+func (client *ssntpClient) StartTracedWorkload(config string, startTime time.Time, label string, traceID string) error {
+	glog.V(1).Infof("START TRACED config, trace %s:", traceID)
 	glog.V(1).Info(config)
 
 	traceConfig := &ssntp.TraceConfig{
 		PathTrace: true,
 		Start:     startTime,
 		Label:     []byte(label),
+		TraceID:   []byte(traceID),
+		SpanID:    []byte(uuid.Generate().String()),
 	}
 
 	_, err := client.ssntp.SendTracedCommand(ssntp.START, []byte(config), traceConfig)
@@ -270,6 +467,60 @@ func (client *ssntpClient) EvacuateNode(nodeID string) error {
 	return err
 }
 
+func (client *ssntpClient) SetSecurityGroup(instanceID string, nodeID string, version uint64, rules []payloads.SecurityRule) error {
+	groupCmd := payloads.SecurityGroupRulesCmd{
+		InstanceUUID:      instanceID,
+		WorkloadAgentUUID: nodeID,
+		Version:           version,
+		Rules:             rules,
+	}
+
+	payload := payloads.SecurityGroupRules{
+		Group: groupCmd,
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	glog.Info("SECURITYGROUP instance: ", instanceID, " version ", version)
+	glog.V(1).Info(string(y))
+
+	_, err = client.ssntp.SendCommand(ssntp.SECURITYGROUP, y)
+
+	return err
+}
+
+// ReserveResources asks the scheduler to hold resources for an instance of
+// tenantID that will be started later with a START command referencing
+// reservationID.  The node, if not given, is picked by the scheduler.
+func (client *ssntpClient) ReserveResources(reservationID string, tenantID string, nodeID string, resources []payloads.RequestedResource, ttl time.Duration) error {
+	reserveCmd := payloads.ReserveCmd{
+		ReservationID:      reservationID,
+		TenantUUID:         tenantID,
+		WorkloadAgentUUID:  nodeID,
+		RequestedResources: resources,
+		TTLSeconds:         int(ttl / time.Second),
+	}
+
+	payload := payloads.Reserve{
+		Reserve: reserveCmd,
+	}
+
+	y, err := yaml.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	glog.Info("RESERVE reservation: ", reservationID, " tenant ", tenantID)
+	glog.V(1).Info(string(y))
+
+	_, err = client.ssntp.SendCommand(ssntp.RESERVE, y)
+
+	return err
+}
+
 func (client *ssntpClient) Disconnect() {
 	client.ssntp.Close()
 }
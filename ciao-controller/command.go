@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/01org/ciao/ciao-controller/types"
+	"github.com/01org/ciao/payloads"
 	"github.com/golang/glog"
 	"time"
 )
@@ -42,7 +43,7 @@ func (c *controller) restartInstance(instanceID string) error {
 		return errors.New("Instance Not Assigned to Node")
 	}
 
-	if i.State != "exited" {
+	if i.State != payloads.Exited && i.State != payloads.Crashed {
 		return errors.New("You may only restart paused instances")
 	}
 
@@ -84,6 +85,24 @@ func (c *controller) deleteInstance(instanceID string) error {
 	return nil
 }
 
+// setSecurityGroup replaces the security group rules of an instance.  The
+// rules are versioned with the current time, so that the node running the
+// instance ignores rules sent earlier that would reach it late.
+func (c *controller) setSecurityGroup(instanceID string, rules []payloads.SecurityRule) error {
+	i, err := c.ds.GetInstance(instanceID)
+	if err != nil {
+		return err
+	}
+
+	if i.NodeID == "" {
+		return errors.New("Instance Not Assigned to Node")
+	}
+
+	version := uint64(time.Now().UnixNano())
+	go c.client.SetSecurityGroup(instanceID, i.NodeID, version, rules)
+	return nil
+}
+
 func (c *controller) confirmTenant(tenantID string) error {
 	tenant, err := c.ds.GetTenant(tenantID)
 	if err != nil {
@@ -165,7 +184,7 @@ func (c *controller) startWorkload(workloadID string, tenantID string, instances
 			if trace == false {
 				go c.client.StartWorkload(instance.newConfig.config)
 			} else {
-				go c.client.StartTracedWorkload(instance.newConfig.config, instance.startTime, label)
+				go c.client.StartTracedWorkload(instance.newConfig.config, instance.startTime, label, instance.ID)
 			}
 		} else {
 			instance.Clean()
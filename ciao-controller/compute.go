@@ -565,10 +565,15 @@ func listFlavors(w http.ResponseWriter, r *http.Request, context *controller) {
 }
 
 const (
-	instances int = 1
-	vcpu          = 2
-	memory        = 3
-	disk          = 4
+	instances      int = 1
+	vcpu               = 2
+	memory             = 3
+	disk               = 4
+	diskIOPS           = 6
+	gpus               = 7
+	dedicatedCores     = 8
+	netIngress         = 9
+	netEgress          = 10
 )
 
 func listTenantQuotas(w http.ResponseWriter, r *http.Request, context *controller) {
@@ -632,6 +637,25 @@ func listTenantQuotas(w http.ResponseWriter, r *http.Request, context *controlle
 		case disk:
 			tenantResource.DiskLimit = resource.Limit
 			tenantResource.DiskUsage = resource.Usage
+		case diskIOPS:
+			tenantResource.IOPSLimit = resource.Limit
+			tenantResource.IOPSUsage = resource.Usage
+
+		case gpus:
+			tenantResource.GPULimit = resource.Limit
+			tenantResource.GPUUsage = resource.Usage
+
+		case dedicatedCores:
+			tenantResource.CoresLimit = resource.Limit
+			tenantResource.CoresUsage = resource.Usage
+
+		case netIngress:
+			tenantResource.IngressLimit = resource.Limit
+			tenantResource.IngressUsage = resource.Usage
+
+		case netEgress:
+			tenantResource.EgressLimit = resource.Limit
+			tenantResource.EgressUsage = resource.Usage
 		}
 	}
 
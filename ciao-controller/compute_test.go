@@ -561,6 +561,25 @@ func TestListTenantQuotas(t *testing.T) {
 		case disk:
 			expected.DiskLimit = resource.Limit
 			expected.DiskUsage = resource.Usage
+		case diskIOPS:
+			expected.IOPSLimit = resource.Limit
+			expected.IOPSUsage = resource.Usage
+
+		case gpus:
+			expected.GPULimit = resource.Limit
+			expected.GPUUsage = resource.Usage
+
+		case dedicatedCores:
+			expected.CoresLimit = resource.Limit
+			expected.CoresUsage = resource.Usage
+
+		case netIngress:
+			expected.IngressLimit = resource.Limit
+			expected.IngressUsage = resource.Usage
+
+		case netEgress:
+			expected.EgressLimit = resource.Limit
+			expected.EgressUsage = resource.Usage
 		}
 	}
 
@@ -218,7 +218,7 @@ func newConfig(context *controller, wl *types.Workload, instanceID string, tenan
 		Networking:          networking,
 	}
 
-	if wl.VMType == payloads.Docker {
+	if wl.VMType == payloads.Docker || wl.VMType == payloads.KataContainer {
 		startCmd.DockerImage = wl.ImageName
 	}
 
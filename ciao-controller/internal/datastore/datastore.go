@@ -968,17 +968,62 @@ func (ds *Datastore) HandleStats(stat payloads.Stat) error {
 	return ds.addInstanceStats(stat.Instances, stat.NodeUUID)
 }
 
+// InstanceStateChanged records a state transition reported by the node an
+// instance is running on.  Crashes are also logged as user errors.
+func (ds *Datastore) InstanceStateChanged(instanceID string, nodeID string, state string) error {
+	ds.instancesLock.Lock()
+	instance, ok := ds.instances[instanceID]
+	if !ok {
+		ds.instancesLock.Unlock()
+		return errors.New("Instance Not Found")
+	}
+	instance.State = state
+	instance.NodeID = nodeID
+	tenantID := instance.TenantID
+	ds.nodesLock.Lock()
+	if n, ok := ds.nodes[nodeID]; ok {
+		n.instances[instanceID] = instance
+	}
+	ds.nodesLock.Unlock()
+	ds.instancesLock.Unlock()
+
+	ds.instanceLastStatLock.Lock()
+	if stat, ok := ds.instanceLastStat[instanceID]; ok {
+		stat.Status = state
+		ds.instanceLastStat[instanceID] = stat
+	}
+	ds.instanceLastStatLock.Unlock()
+
+	if state == payloads.Crashed {
+		msg := fmt.Sprintf("Instance %s crashed on node %s", instanceID, nodeID)
+		ds.db.logEvent(tenantID, string(userError), msg)
+	}
+
+	return nil
+}
+
 // HandleTraceReport stores the provided trace data in the datastore.
 func (ds *Datastore) HandleTraceReport(trace payloads.Trace) error {
 	for index := range trace.Frames {
 		i := trace.Frames[index]
 
+		if i.TraceID != "" {
+			glog.V(2).Infof("%s %s frame of trace %s span %s: %s to %s",
+				i.Type, i.Operand, i.TraceID, i.SpanID, i.StartTimestamp, i.EndTimestamp)
+		}
+
 		err := ds.db.addFrameStat(i)
 		if err != nil {
 			glog.Warning(err)
 		}
 	}
 
+	for _, l := range trace.Launches {
+		glog.V(1).Infof("Instance %s launched in %d ms: controller %d ms, scheduler %d ms, transit %d ms, launcher %d ms, image %d ms, boot %d ms, guest %d ms",
+			l.InstanceUUID, l.TotalMS, l.ControllerQueueMS, l.SchedulerMS, l.TransitMS,
+			l.LauncherQueueMS, l.ImagePrepMS, l.BootMS, l.GuestReadyMS)
+	}
+
 	return nil
 }
 
@@ -1372,6 +1372,44 @@ func TestStopFailure(t *testing.T) {
 	}
 }
 
+func TestInstanceStateChanged(t *testing.T) {
+	tenant, err := addTestTenant()
+	if err != nil {
+		t.Error(err)
+	}
+
+	wls, err := ds.GetWorkloads()
+	if err != nil {
+		t.Error(err)
+	}
+
+	instance, err := addTestInstance(tenant, wls[0])
+	if err != nil {
+		t.Error(err)
+	}
+
+	nodeID := uuid.Generate().String()
+
+	err = ds.InstanceStateChanged(instance.ID, nodeID, payloads.Crashed)
+	if err != nil {
+		t.Error(err)
+	}
+
+	i, err := ds.GetInstance(instance.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if i.State != payloads.Crashed || i.NodeID != nodeID {
+		t.Errorf("Instance state not updated: %s on %s", i.State, i.NodeID)
+	}
+
+	err = ds.InstanceStateChanged(uuid.Generate().String(), nodeID, payloads.Running)
+	if err == nil {
+		t.Error("State change for unknown instance accepted")
+	}
+}
+
 func TestStartFailureFullCloud(t *testing.T) {
 	tenant, err := addTestTenant()
 	if err != nil {
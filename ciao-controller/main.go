@@ -19,6 +19,7 @@ package main
 import (
 	"flag"
 	datastore "github.com/01org/ciao/ciao-controller/internal/datastore"
+	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
 	"github.com/golang/glog"
 	"os"
@@ -87,11 +88,13 @@ func main() {
 	}
 
 	config := &ssntp.Config{
-		URI:    *serverURL,
-		CAcert: *caCert,
-		Cert:   *cert,
-		Role:   ssntp.Controller,
-		Log:    ssntp.Log,
+		URI:         *serverURL,
+		CAcert:      *caCert,
+		Cert:        *cert,
+		Role:        ssntp.Controller,
+		Log:         ssntp.Log,
+		Encodings:   []payloads.Encoding{payloads.MsgPack},
+		AtLeastOnce: true,
 	}
 
 	context.client, err = newSSNTPClient(context, config)
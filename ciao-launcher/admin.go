@@ -0,0 +1,402 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+const (
+	statsHistoryLen = 120
+	maxRecentErrors = 100
+	adminTimeout    = 10 * time.Second
+)
+
+type adminInstanceUsage struct {
+	MemoryUsageMB int `json:"mem_usage_mb"`
+	DiskUsageMB   int `json:"disk_usage_mb"`
+	CPUUsage      int `json:"cpu_usage"`
+}
+
+type adminInstance struct {
+	adminInstanceUsage
+	UUID       string                         `json:"uuid"`
+	State      string                         `json:"state"`
+	BootPhase  string                         `json:"boot_phase,omitempty"`
+	MaxMemory  int                            `json:"max_mem_mb"`
+	MaxDisk    int                            `json:"max_disk_mb"`
+	MaxVCPUs   int                            `json:"max_vcpus"`
+	SSHIP      string                         `json:"ssh_ip,omitempty"`
+	SSHIPv6    string                         `json:"ssh_ipv6,omitempty"`
+	SSHPort    int                            `json:"ssh_port,omitempty"`
+	Hugepages  bool                           `json:"hugepages"`
+	PCIDevices []string                       `json:"pci_devices,omitempty"`
+	Image      string                         `json:"image,omitempty"`
+	GuestFS    []payloads.GuestFilesystemStat `json:"guest_filesystems,omitempty"`
+	Network    *payloads.InstanceNetworkStat  `json:"network,omitempty"`
+
+	SecurityGroupVersion uint64 `json:"security_group_version,omitempty"`
+	BalloonMB            int    `json:"balloon_mb,omitempty"`
+}
+
+type adminResources struct {
+	Status               string            `json:"status"`
+	Connected            bool              `json:"ssntp_connected"`
+	Draining             bool              `json:"draining"`
+	Maintenance          bool              `json:"maintenance"`
+	MaintenanceWindow    string            `json:"maintenance_window,omitempty"`
+	ClockOffsetMS        int64             `json:"clock_offset_ms"`
+	Launching            int               `json:"launching"`
+	LaunchesQueued       int               `json:"launches_queued"`
+	VCPUsAllocated       int               `json:"vcpus_allocated"`
+	VCPUsLimit           int               `json:"vcpus_limit"`
+	MemoryAllocatedMB    int               `json:"mem_allocated_mb"`
+	MemoryAvailableMB    int               `json:"mem_available_mb"`
+	HugepagesAllocatedMB int               `json:"hugepages_allocated_mb"`
+	HugepagesTotalMB     int               `json:"hugepages_total_mb"`
+	HugepagesAvailableMB int               `json:"hugepages_available_mb"`
+	DiskAllocatedMB      int               `json:"disk_allocated_mb"`
+	DiskAvailableMB      int               `json:"disk_available_mb"`
+	DiskUsedMB           int               `json:"disk_used_mb"`
+	BackingImagesMB      int               `json:"backing_images_mb"`
+	PCIDevices           map[string]string `json:"pci_devices"`
+}
+
+type adminStatsSample struct {
+	Time            time.Time                     `json:"time"`
+	MemTotalMB      int                           `json:"mem_total_mb"`
+	MemAvailableMB  int                           `json:"mem_available_mb"`
+	DiskTotalMB     int                           `json:"disk_total_mb"`
+	DiskAvailableMB int                           `json:"disk_available_mb"`
+	Load            int                           `json:"load"`
+	CPUPressure     float64                       `json:"cpu_pressure"`
+	MemPressure     float64                       `json:"mem_pressure"`
+	Instances       map[string]adminInstanceUsage `json:"instances"`
+}
+
+type adminError struct {
+	Time     time.Time `json:"time"`
+	Error    string    `json:"error"`
+	Instance string    `json:"instance,omitempty"`
+	Reason   string    `json:"reason"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// adminSnapshot is a copy of the overseer's view of the node.  It is
+// generated by the overseer in response to an ovsAdminCmd.
+type adminSnapshot struct {
+	instances []adminInstance
+	resources adminResources
+	stats     []adminStatsSample
+}
+
+// adminErrorLog records the most recent errors launcher has reported, or
+// attempted to report, to the controller.  Errors are recorded even when
+// launcher is not connected so that they can be examined locally.
+type adminErrorLog struct {
+	sync.Mutex
+	errors []adminError
+}
+
+var recentErrors = &adminErrorLog{}
+
+func (l *adminErrorLog) add(kind ssntp.Error, instance, reason string, err error) {
+	e := adminError{
+		Time:     time.Now(),
+		Error:    kind.String(),
+		Instance: instance,
+		Reason:   reason,
+	}
+	if err != nil {
+		e.Detail = err.Error()
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.errors = append(l.errors, e)
+	if len(l.errors) > maxRecentErrors {
+		l.errors = l.errors[len(l.errors)-maxRecentErrors:]
+	}
+}
+
+func (l *adminErrorLog) get() []adminError {
+	l.Lock()
+	defer l.Unlock()
+
+	errors := make([]adminError, len(l.errors))
+	copy(errors, l.errors)
+	return errors
+}
+
+// adminServer serves the admin API.  It cannot talk to the overseer directly
+// as the overseer's channel is owned, and eventually closed, by the server
+// loop.  Instead it passes overseer commands to the server loop via cmdCh.
+// Overseer replies are sent on buffered channels so that the overseer never
+// blocks if a request times out.
+type adminServer struct {
+	cmdCh      chan<- interface{}
+	startDrain func()
+}
+
+func (a *adminServer) overseerCmd(cmd interface{}) error {
+	select {
+	case a.cmdCh <- cmd:
+		return nil
+	case <-time.After(adminTimeout):
+		return fmt.Errorf("Timed out waiting for server loop")
+	}
+}
+
+func (a *adminServer) snapshot() (*adminSnapshot, error) {
+	targetCh := make(chan *adminSnapshot, 1)
+	if err := a.overseerCmd(&ovsAdminCmd{targetCh}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case s := <-targetCh:
+		return s, nil
+	case <-time.After(adminTimeout):
+		return nil, fmt.Errorf("Timed out waiting for overseer")
+	}
+}
+
+// instanceCmd sends cmd to the go routine of instance, returning the HTTP
+// status to report if it cannot be delivered.
+func (a *adminServer) instanceCmd(instance string, cmd interface{}) (int, error) {
+	targetCh := make(chan ovsGetResult, 1)
+	if err := a.overseerCmd(&ovsGetCmd{instance, targetCh}); err != nil {
+		return http.StatusServiceUnavailable, err
+	}
+
+	var target ovsGetResult
+	select {
+	case target = <-targetCh:
+	case <-time.After(adminTimeout):
+		return http.StatusServiceUnavailable, fmt.Errorf("Timed out waiting for overseer")
+	}
+
+	if target.cmdCh == nil {
+		return http.StatusNotFound, fmt.Errorf("Instance %s not found", instance)
+	}
+
+	select {
+	case target.cmdCh <- cmd:
+		return http.StatusOK, nil
+	case <-time.After(adminTimeout):
+		return http.StatusServiceUnavailable, fmt.Errorf("Timed out waiting for instance %s", instance)
+	}
+}
+
+// instanceErrorStatus returns the HTTP status to report when a virtualizer
+// operation fails with err.
+func instanceErrorStatus(err error) int {
+	if err == errConsoleNotSupported || err == errMigrationNotSupported {
+		return http.StatusNotImplemented
+	}
+	return http.StatusConflict
+}
+
+func (a *adminServer) instanceConsole(w http.ResponseWriter, instance string) {
+	targetCh := make(chan insConsoleResult, 1)
+	if status, err := a.instanceCmd(instance, &insConsoleCmd{targetCh}); err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+
+	select {
+	case res := <-targetCh:
+		if res.err != nil {
+			writeJSONError(w, instanceErrorStatus(res.err), res.err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"console": res.socket})
+	case <-time.After(adminTimeout):
+		writeJSONError(w, http.StatusServiceUnavailable,
+			fmt.Errorf("Timed out waiting for instance %s", instance))
+	}
+}
+
+func (a *adminServer) instanceMigrate(w http.ResponseWriter, r *http.Request, instance string) {
+	var req struct {
+		URI string `json:"uri"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.URI == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("Expected a migration uri"))
+		return
+	}
+
+	errCh := make(chan error, 1)
+	if status, err := a.instanceCmd(instance, &insMigrateCmd{req.URI, errCh}); err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			writeJSONError(w, instanceErrorStatus(err), err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"uri": req.URI})
+	case <-time.After(adminTimeout):
+		writeJSONError(w, http.StatusServiceUnavailable,
+			fmt.Errorf("Timed out waiting for instance %s", instance))
+	}
+}
+
+// serveInstance serves the requests for /instances/<uuid>/<operation>.
+func (a *adminServer) serveInstance(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/instances/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+
+	switch {
+	case parts[1] == "console" && r.Method == "GET":
+		a.instanceConsole(w, parts[0])
+	case parts[1] == "migrate" && r.Method == "POST":
+		a.instanceMigrate(w, r, parts[0])
+	case parts[1] == "console" || parts[1] == "migrate":
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		clog.Warningf("Unable to encode admin response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *adminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/instances/"):
+		a.serveInstance(w, r)
+		return
+	case r.URL.Path == "/errors" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, recentErrors.get())
+		return
+	case r.URL.Path == "/ssntp" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, json.RawMessage(expvar.Get(ssntpMetricsVar).String()))
+		return
+	case r.URL.Path == "/drain" && r.Method == "POST":
+		a.startDrain()
+		writeJSON(w, http.StatusAccepted, map[string]string{})
+		return
+	case r.URL.Path == "/maintenance" && (r.Method == "POST" || r.Method == "DELETE"):
+		enabled := r.Method == "POST"
+		if err := a.overseerCmd(&ovsMaintenanceCmd{enabled}); err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]bool{"maintenance": enabled})
+		return
+	case r.URL.Path == "/stats" && r.Method == "POST":
+		if err := a.overseerCmd(&ovsStatsStatusCmd{}); err != nil {
+			writeJSONError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+	case r.Method != "GET":
+		writeJSONError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+
+	var get func(s *adminSnapshot) interface{}
+	switch r.URL.Path {
+	case "/instances":
+		get = func(s *adminSnapshot) interface{} { return s.instances }
+	case "/resources":
+		get = func(s *adminSnapshot) interface{} { return s.resources }
+	case "/stats":
+		get = func(s *adminSnapshot) interface{} { return s.stats }
+	default:
+		writeJSONError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+
+	s, err := a.snapshot()
+	if err != nil {
+		writeJSONError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, get(s))
+}
+
+// startAdminService starts the admin API on a unix socket created at
+// socketPath.  Only root can connect to the socket.  The returned listener
+// should be closed to stop the service.
+func startAdminService(socketPath string, cmdCh chan<- interface{},
+	startDrain func()) (net.Listener, error) {
+	err := os.MkdirAll(path.Dir(socketPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Remove(socketPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(socketPath, 0600)
+	if err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+
+	a := &adminServer{
+		cmdCh:      cmdCh,
+		startDrain: startDrain,
+	}
+
+	go func() {
+		err := http.Serve(l, a)
+		clog.Infof("Admin service exited: %v", err)
+	}()
+
+	clog.Infof("Admin service listening on %s", socketPath)
+
+	return l, nil
+}
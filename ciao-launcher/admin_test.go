@@ -0,0 +1,169 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+func TestAdminErrorLog(t *testing.T) {
+	l := &adminErrorLog{}
+	for i := 0; i < maxRecentErrors+10; i++ {
+		l.add(ssntp.StartFailure, "instance", string(payloads.FullComputeNode), nil)
+	}
+	l.add(ssntp.DeleteFailure, "last", string(payloads.DeleteNoInstance), errors.New("gone"))
+
+	errs := l.get()
+	if len(errs) != maxRecentErrors {
+		t.Fatalf("Expected %d errors, found %d", maxRecentErrors, len(errs))
+	}
+
+	last := errs[len(errs)-1]
+	if last.Instance != "last" || last.Detail != "gone" ||
+		last.Error != ssntp.DeleteFailure.String() {
+		t.Errorf("Unexpected last error %+v", last)
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	cmdCh := make(chan interface{})
+	drained := false
+	a := &adminServer{
+		cmdCh:      cmdCh,
+		startDrain: func() { drained = true },
+	}
+
+	insCh := make(chan interface{})
+	go func() {
+		for cmd := range insCh {
+			switch cmd := cmd.(type) {
+			case *insConsoleCmd:
+				cmd.targetCh <- insConsoleResult{socket: "/tmp/instance-1/console.sock"}
+			case *insMigrateCmd:
+				cmd.errCh <- errMigrationNotSupported
+			}
+		}
+	}()
+	defer close(insCh)
+
+	go func() {
+		for cmd := range cmdCh {
+			switch cmd := cmd.(type) {
+			case *ovsAdminCmd:
+				cmd.targetCh <- &adminSnapshot{
+					instances: []adminInstance{{UUID: "instance-1"}},
+				}
+			case *ovsGetCmd:
+				var target ovsGetResult
+				if cmd.instance == "instance-1" {
+					target.cmdCh = insCh
+				}
+				cmd.targetCh <- target
+			}
+		}
+	}()
+	defer close(cmdCh)
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/instances", http.StatusOK},
+		{"GET", "/resources", http.StatusOK},
+		{"GET", "/stats", http.StatusOK},
+		{"POST", "/stats", http.StatusOK},
+		{"GET", "/errors", http.StatusOK},
+		{"GET", "/ssntp", http.StatusOK},
+		{"GET", "/wibble", http.StatusNotFound},
+		{"DELETE", "/instances", http.StatusMethodNotAllowed},
+		{"POST", "/drain", http.StatusAccepted},
+		{"POST", "/maintenance", http.StatusOK},
+		{"DELETE", "/maintenance", http.StatusOK},
+		{"GET", "/maintenance", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest(test.method, test.path, nil)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected %d got %d", test.method, test.path,
+				test.code, w.Code)
+		}
+	}
+
+	instanceTests := []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"GET", "/instances/instance-1/console", "", http.StatusOK},
+		{"GET", "/instances/instance-2/console", "", http.StatusNotFound},
+		{"POST", "/instances/instance-1/console", "", http.StatusMethodNotAllowed},
+		{"POST", "/instances/instance-1/migrate", `{"uri": "tcp:192.168.0.2:4444"}`, http.StatusNotImplemented},
+		{"POST", "/instances/instance-1/migrate", "{}", http.StatusBadRequest},
+		{"POST", "/instances/instance-1/wibble", "", http.StatusNotFound},
+	}
+
+	for _, test := range instanceTests {
+		req, err := http.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		w := httptest.NewRecorder()
+		a.ServeHTTP(w, req)
+		if w.Code != test.code {
+			t.Errorf("%s %s: expected %d got %d", test.method, test.path,
+				test.code, w.Code)
+		}
+	}
+
+	if !drained {
+		t.Errorf("Drain was not started")
+	}
+
+	req, _ := http.NewRequest("GET", "/instances", nil)
+	w := httptest.NewRecorder()
+	a.ServeHTTP(w, req)
+	var instances []adminInstance
+	err := json.Unmarshal(w.Body.Bytes(), &instances)
+	if err != nil || len(instances) != 1 || instances[0].UUID != "instance-1" {
+		t.Errorf("Unexpected instances %s: %v", w.Body.String(), err)
+	}
+
+	req, _ = http.NewRequest("GET", "/ssntp", nil)
+	w = httptest.NewRecorder()
+	a.ServeHTTP(w, req)
+	var metrics map[string]interface{}
+	err = json.Unmarshal(w.Body.Bytes(), &metrics)
+	if _, ok := metrics["frames_sent"]; err != nil || !ok {
+		t.Errorf("Unexpected SSNTP metrics %s: %v", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	attestationNonceBytes = 32
+	attestationTimeout    = 60 * time.Second
+)
+
+// attestationCmd is the path, inside the guest, of a command that prints a
+// quote from the guest's TPM over the hex encoded nonce passed as its only
+// argument.
+var attestationCmd string
+
+func sendAttestationQuote(client *ssntpConn, quote *payloads.AttestationQuoteEvent) {
+	if !client.isConnected() {
+		return
+	}
+
+	event := payloads.EventAttestationQuote{Quote: *quote}
+	payload, err := yaml.Marshal(&event)
+	if err != nil {
+		clog.Errorf("Unable to Marshall AttestationQuote %v", err)
+		return
+	}
+
+	_, err = client.SendEvent(ssntp.AttestationQuote, payload)
+	if err != nil {
+		clog.Errorf("Failed to send AttestationQuote event %v", err)
+	}
+}
+
+// collectAttestationQuote asks the guest agent of an instance with a vTPM to
+// run attestationCmd over a fresh nonce and forwards the result, or the
+// reason for the failure, to the controller.  It is run in its own go
+// routine as the guest may take a while to produce the quote.
+func collectAttestationQuote(client *ssntpConn, instance, socketPath string) {
+	quote := &payloads.AttestationQuoteEvent{InstanceUUID: instance}
+	defer sendAttestationQuote(client, quote)
+
+	nonce := make([]byte, attestationNonceBytes)
+	if _, err := rand.Read(nonce); err != nil {
+		quote.Error = err.Error()
+		return
+	}
+	quote.Nonce = hex.EncodeToString(nonce)
+
+	out, err := qgaGuestExec(socketPath, attestationCmd, []string{quote.Nonce},
+		attestationTimeout)
+	if err != nil {
+		clog.Warningf("Unable to obtain attestation quote for %s: %v", instance, err)
+		quote.Error = err.Error()
+		return
+	}
+
+	quote.Quote = base64.StdEncoding.EncodeToString(out)
+	clog.Infof("Obtained attestation quote for %s", instance)
+}
@@ -0,0 +1,165 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/01org/ciao/clog"
+)
+
+// balloonIdleCPU is the CPU usage, in percent, below which a running
+// instance is considered idle, so that memory can be reclaimed from it.
+const balloonIdleCPU = 5
+
+// insBalloonCmd asks an instance go routine to resize the balloon of its
+// VM so that the guest is left with targetMB of memory.
+type insBalloonCmd struct {
+	targetMB int
+}
+
+// ovsBalloonUpdateCmd tells the overseer that the balloon of an instance
+// could not be resized to the size it requested, and is now balloonMB.
+type ovsBalloonUpdateCmd struct {
+	instance    string
+	requestedMB int
+	balloonMB   int
+}
+
+// balloonTargets returns the new balloon sizes, in MB, of the instances
+// whose balloon needs resizing, given the memory available on the node and
+// its high watermark.  When less memory than the watermark is available,
+// memory is reclaimed from the idlest instances first, without shrinking
+// any guest below its balloon minimum or the memory it uses.  A balloon is
+// deflated as soon as its instance stops being idle, and once twice the
+// watermark would still be available without it.
+func balloonTargets(instances map[string]*ovsInstanceState, available, hwm int) map[string]int {
+	targets := make(map[string]int)
+
+	var idle []string
+	for uuid, st := range instances {
+		isIdle := st.running == ovsRunning && st.CPUUsage >= 0 && st.CPUUsage < balloonIdleCPU
+		if st.balloonMB > 0 && !isIdle {
+			targets[uuid] = 0
+			available -= st.balloonMB
+		} else if st.balloonMin > 0 && isIdle {
+			idle = append(idle, uuid)
+		}
+	}
+
+	sort.Slice(idle, func(i, j int) bool {
+		a, b := instances[idle[i]], instances[idle[j]]
+		if a.CPUUsage != b.CPUUsage {
+			return a.CPUUsage < b.CPUUsage
+		}
+		return idle[i] < idle[j]
+	})
+
+	if available < hwm {
+		shortfall := hwm - available
+		for _, uuid := range idle {
+			if shortfall <= 0 {
+				break
+			}
+
+			st := instances[uuid]
+			floor := st.balloonMin
+			if st.memoryUsageMB > floor {
+				floor = st.memoryUsageMB
+			}
+			reclaimable := st.maxMemoryMB - st.balloonMB - floor
+			if reclaimable <= 0 {
+				continue
+			}
+			if reclaimable > shortfall {
+				reclaimable = shortfall
+			}
+			targets[uuid] = st.balloonMB + reclaimable
+			shortfall -= reclaimable
+		}
+		return targets
+	}
+
+	for i := len(idle) - 1; i >= 0; i-- {
+		st := instances[idle[i]]
+		if st.balloonMB == 0 || available-st.balloonMB < 2*hwm {
+			continue
+		}
+		targets[idle[i]] = 0
+		available -= st.balloonMB
+	}
+
+	return targets
+}
+
+// adjustBalloons resizes the balloons of the instances picked by
+// balloonTargets.  The memory reclaimed is available straight away, so that
+// the node does not report FULL while memory can be reclaimed from its idle
+// instances.
+func (ovs *overseer) adjustBalloons() {
+	targets := balloonTargets(ovs.instances, ovs.memoryAvailable, getSettings().memHWM)
+	for uuid, balloonMB := range targets {
+		st := ovs.instances[uuid]
+		if balloonMB > st.balloonMB {
+			clog.Infof("Reclaiming %d MB from idle instance %s", balloonMB-st.balloonMB, uuid)
+		} else {
+			clog.Infof("Returning %d MB to instance %s", st.balloonMB-balloonMB, uuid)
+		}
+
+		ovs.memoryAvailable += balloonMB - st.balloonMB
+		st.balloonMB = balloonMB
+		go sendBalloonCmd(st.cmdCh, &insBalloonCmd{st.maxMemoryMB - balloonMB}, ovs.childDoneCh)
+	}
+}
+
+// sendBalloonCmd sends cmd to an instance go routine without blocking the
+// overseer.  The command is dropped if the instance does not take it within
+// a stats period, as its balloon is resized again at the next one if needed.
+func sendBalloonCmd(cmdCh chan<- interface{}, cmd *insBalloonCmd, doneCh <-chan struct{}) {
+	select {
+	case cmdCh <- cmd:
+	case <-doneCh:
+	case <-time.After(getSettings().statsPeriod):
+	}
+}
+
+// balloonUpdate records that the balloon of an instance could not be
+// resized, unless a newer size was requested since.
+func (ovs *overseer) balloonUpdate(cmd *ovsBalloonUpdateCmd) {
+	target := ovs.instances[cmd.instance]
+	if target == nil || target.balloonMB != cmd.requestedMB {
+		return
+	}
+
+	ovs.memoryAvailable -= target.balloonMB - cmd.balloonMB
+	target.balloonMB = cmd.balloonMB
+}
+
+func (id *instanceData) balloonCommand(cmd *insBalloonCmd) {
+	err := id.vm.setBalloon(cmd.targetMB)
+	if err == nil {
+		return
+	}
+
+	clog.Warningf("Unable to resize the balloon of instance %s: %v", id.instance, err)
+	id.ovsCh <- &ovsBalloonUpdateCmd{
+		instance:    id.instance,
+		requestedMB: id.cfg.Mem - cmd.targetMB,
+		balloonMB:   0,
+	}
+}
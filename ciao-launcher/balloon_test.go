@@ -0,0 +1,61 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBalloonTargets(t *testing.T) {
+	instances := map[string]*ovsInstanceState{
+		"a": {running: ovsRunning, CPUUsage: 1, maxMemoryMB: 4096, memoryUsageMB: 1024, balloonMin: 2048},
+		"b": {running: ovsRunning, CPUUsage: 0, maxMemoryMB: 2048, memoryUsageMB: 512, balloonMin: 256},
+		"c": {running: ovsRunning, CPUUsage: 50, maxMemoryMB: 2048, balloonMin: 512, balloonMB: 1000},
+		"d": {running: ovsRunning, CPUUsage: 0, maxMemoryMB: 8192, memoryUsageMB: 128},
+		"e": {running: ovsStopped, CPUUsage: -1, maxMemoryMB: 1024, balloonMin: 256},
+	}
+
+	// c is busy again and gets its memory back, making up for it and
+	// for the original shortfall takes 1500 MB from b, the idlest.
+	targets := balloonTargets(instances, 500, 1000)
+	expected := map[string]int{"b": 1500, "c": 0}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Fatalf("Expected balloons %v under pressure, got %v", expected, targets)
+	}
+
+	instances["a"].balloonMB = 500
+	instances["b"].balloonMB = 1500
+	instances["c"].balloonMB = 0
+
+	targets = balloonTargets(instances, 1500, 1000)
+	if len(targets) != 0 {
+		t.Errorf("Expected balloons to be left alone, got %v", targets)
+	}
+
+	targets = balloonTargets(instances, 2500, 1000)
+	expected = map[string]int{"a": 0}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("Expected balloons %v with some memory back, got %v", expected, targets)
+	}
+
+	targets = balloonTargets(instances, 5000, 1000)
+	expected = map[string]int{"a": 0, "b": 0}
+	if !reflect.DeepEqual(targets, expected) {
+		t.Errorf("Expected balloons %v without pressure, got %v", expected, targets)
+	}
+}
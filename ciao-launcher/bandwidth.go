@@ -0,0 +1,181 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+// The bandwidth limits of an instance are enforced by tc on the host side of
+// the instance's vnic.  Traffic transmitted by the host side of the vnic is
+// received by the instance, so the instance's ingress limit is implemented
+// by a token bucket filter attached to the root qdisc of the vnic, and its
+// egress limit by a policing filter attached to the vnic's ingress qdisc.
+
+const (
+	// Minimum burst size, in bytes, of the token bucket used to shape
+	// traffic.  tbf needs the burst to be at least as large as the MTU
+	// and small bursts make shaping needlessly expensive.
+	minShapingBurst = 16 * 1024
+
+	// Maximum amount of time a packet may sit in the tbf queue before
+	// being dropped.
+	shapingLatency = "50ms"
+)
+
+var sysClassNet = "/sys/class/net"
+
+// shapingBurst returns a burst size, in bytes, suitable for shaping traffic
+// to kbps.  This is the amount of data transferred in 100ms.
+func shapingBurst(kbps int) int {
+	burst := kbps * 1000 / 8 / 10
+	if burst < minShapingBurst {
+		burst = minShapingBurst
+	}
+	return burst
+}
+
+// shapingCommands returns the list of tc invocations needed to limit the
+// traffic received by the instance attached to vnic to ingressKbps and the
+// traffic it sends to egressKbps.  A limit of 0 means that traffic is not
+// limited in that direction.
+func shapingCommands(vnic string, ingressKbps, egressKbps int) [][]string {
+	var cmds [][]string
+
+	if ingressKbps > 0 {
+		cmds = append(cmds, []string{"qdisc", "replace", "dev", vnic,
+			"root", "tbf", "rate", fmt.Sprintf("%dkbit", ingressKbps),
+			"burst", strconv.Itoa(shapingBurst(ingressKbps)),
+			"latency", shapingLatency})
+	}
+
+	if egressKbps > 0 {
+		cmds = append(cmds, []string{"qdisc", "add", "dev", vnic,
+			"handle", "ffff:", "ingress"})
+		cmds = append(cmds, []string{"filter", "add", "dev", vnic,
+			"parent", "ffff:", "protocol", "all", "prio", "1",
+			"u32", "match", "u32", "0", "0",
+			"police", "rate", fmt.Sprintf("%dkbit", egressKbps),
+			"burst", strconv.Itoa(shapingBurst(egressKbps)),
+			"drop", "flowid", ":1"})
+	}
+
+	return cmds
+}
+
+func runTC(args []string) error {
+	out, err := exec.Command("tc", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tc %s failed: %v: %s", strings.Join(args, " "),
+			err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// shapeVnic applies the bandwidth limits of an instance to its vnic.  It may
+// be called on a vnic that has already been shaped, e.g., when an instance is
+// restarted, in which case the existing shaping is replaced.
+func shapeVnic(vnic string, ingressKbps, egressKbps int) error {
+	if vnic == "" || (ingressKbps == 0 && egressKbps == 0) {
+		return nil
+	}
+
+	if egressKbps > 0 {
+		// The policing filter cannot be replaced in place, so we
+		// remove any existing ingress qdisc, and with it the filter.
+		// This will fail if the vnic has never been shaped.
+		_ = exec.Command("tc", "qdisc", "del", "dev", vnic, "ingress").Run()
+	}
+
+	for _, args := range shapingCommands(vnic, ingressKbps, egressKbps) {
+		if err := runTC(args); err != nil {
+			clog.Errorf("Unable to shape vnic %s: %v", vnic, err)
+			return err
+		}
+	}
+
+	clog.Infof("Shaped vnic %s: ingress %d kbps, egress %d kbps", vnic,
+		ingressKbps, egressKbps)
+
+	return nil
+}
+
+// vnicThroughput computes the throughput of an instance's vnic from the
+// byte counters the kernel maintains for that vnic.
+type vnicThroughput struct {
+	rxBytes uint64
+	txBytes uint64
+	stamp   time.Time
+}
+
+func readVnicCounter(vnic, counter string) (uint64, error) {
+	data, err := ioutil.ReadFile(path.Join(sysClassNet, vnic, "statistics", counter))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+func rateKbps(bytes uint64, d time.Duration) int {
+	return int(bytes * 8 * uint64(time.Millisecond) / uint64(d))
+}
+
+// sample returns the average rates, in kbps, at which the instance received
+// and sent traffic since the previous call to sample.  -1 is returned for
+// both rates on the first call or if the counters cannot be read.
+func (t *vnicThroughput) sample(vnic string, now time.Time) (ingressKbps, egressKbps int) {
+	rx, err := readVnicCounter(vnic, "rx_bytes")
+	if err != nil {
+		*t = vnicThroughput{}
+		return -1, -1
+	}
+	tx, err := readVnicCounter(vnic, "tx_bytes")
+	if err != nil {
+		*t = vnicThroughput{}
+		return -1, -1
+	}
+
+	ingressKbps, egressKbps = -1, -1
+	d := now.Sub(t.stamp)
+	if !t.stamp.IsZero() && d > 0 && rx >= t.rxBytes && tx >= t.txBytes {
+		ingressKbps = rateKbps(tx-t.txBytes, d)
+		egressKbps = rateKbps(rx-t.rxBytes, d)
+	}
+
+	*t = vnicThroughput{rxBytes: rx, txBytes: tx, stamp: now}
+
+	return
+}
+
+func (id *instanceData) networkStats() *payloads.InstanceNetworkStat {
+	ingress, egress := id.netMonitor.sample(id.cfg.VnicName, time.Now())
+	return &payloads.InstanceNetworkStat{
+		IngressLimitKbps: id.cfg.IngressKbps,
+		EgressLimitKbps:  id.cfg.EgressKbps,
+		IngressKbps:      ingress,
+		EgressKbps:       egress,
+	}
+}
@@ -0,0 +1,108 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShapingCommands(t *testing.T) {
+	if cmds := shapingCommands("tap0", 0, 0); len(cmds) != 0 {
+		t.Errorf("No commands expected for unlimited vnic, got %v", cmds)
+	}
+
+	cmds := shapingCommands("tap0", 1000, 0)
+	expected := [][]string{
+		{"qdisc", "replace", "dev", "tap0", "root", "tbf", "rate", "1000kbit",
+			"burst", "16384", "latency", "50ms"},
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("Unexpected ingress commands %v", cmds)
+	}
+
+	cmds = shapingCommands("tap0", 0, 1000000)
+	expected = [][]string{
+		{"qdisc", "add", "dev", "tap0", "handle", "ffff:", "ingress"},
+		{"filter", "add", "dev", "tap0", "parent", "ffff:", "protocol", "all",
+			"prio", "1", "u32", "match", "u32", "0", "0", "police", "rate",
+			"1000000kbit", "burst", "12500000", "drop", "flowid", ":1"},
+	}
+	if !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("Unexpected egress commands %v", cmds)
+	}
+
+	if cmds = shapingCommands("tap0", 1000, 1000); len(cmds) != 3 {
+		t.Errorf("Expected 3 commands, got %v", cmds)
+	}
+}
+
+func writeVnicCounters(t *testing.T, dir string, rx, tx uint64) {
+	statsDir := path.Join(dir, "tap0", "statistics")
+	if err := os.MkdirAll(statsDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, v := range map[string]uint64{"rx_bytes": rx, "tx_bytes": tx} {
+		err := ioutil.WriteFile(path.Join(statsDir, name),
+			[]byte(strconv.FormatUint(v, 10)+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVnicThroughput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-bandwidth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	oldSysClassNet := sysClassNet
+	sysClassNet = dir
+	defer func() { sysClassNet = oldSysClassNet }()
+
+	var tp vnicThroughput
+	now := time.Now()
+
+	if in, out := tp.sample("tap0", now); in != -1 || out != -1 {
+		t.Errorf("Expected unknown throughput for missing vnic, got %d %d", in, out)
+	}
+
+	writeVnicCounters(t, dir, 1000, 2000)
+	if in, out := tp.sample("tap0", now); in != -1 || out != -1 {
+		t.Errorf("Expected unknown throughput on first sample, got %d %d", in, out)
+	}
+
+	// The host transmits what the instance receives.
+
+	writeVnicCounters(t, dir, 1000+125000, 2000+250000)
+	in, out := tp.sample("tap0", now.Add(time.Second))
+	if in != 2000 || out != 1000 {
+		t.Errorf("Expected 2000 kbps in and 1000 kbps out, got %d %d", in, out)
+	}
+
+	writeVnicCounters(t, dir, 0, 0)
+	if in, out := tp.sample("tap0", now.Add(2*time.Second)); in != -1 || out != -1 {
+		t.Errorf("Expected unknown throughput after counter reset, got %d %d", in, out)
+	}
+}
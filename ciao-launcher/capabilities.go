@@ -0,0 +1,277 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"golang.org/x/net/context"
+)
+
+// hypervisorVersionRegexp matches the first version number printed by the
+// --version option of qemu and cloud-hypervisor, e.g., "QEMU emulator
+// version 2.7.0" or "cloud-hypervisor v20.0".
+var hypervisorVersionRegexp = regexp.MustCompile(`v(?:ersion\s+)?(\d+(?:\.\d+)+)`)
+
+func parseHypervisorVersion(output string) string {
+	matches := hypervisorVersionRegexp.FindStringSubmatch(output)
+	if matches == nil {
+		return ""
+	}
+	return matches[1]
+}
+
+// binaryVersion returns the version printed by binary --version, and false
+// if binary cannot be run.
+func binaryVersion(binary string) (string, bool) {
+	out, err := exec.Command(binary, "--version").Output()
+	if err != nil {
+		return "", false
+	}
+	return parseHypervisorVersion(string(out)), true
+}
+
+// parseCPUFlags returns the features listed on the first flags line of
+// /proc/cpuinfo.
+func parseCPUFlags(r io.Reader) []string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "flags" {
+			return strings.Fields(fields[1])
+		}
+	}
+	return nil
+}
+
+// parseCPUModel returns the model named on the first model name line of
+// /proc/cpuinfo, or an empty string if there is none, as on most ARM nodes.
+func parseCPUModel(r io.Reader) string {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "model name" {
+			return strings.TrimSpace(fields[1])
+		}
+	}
+	return ""
+}
+
+func getCPUFlags() []string {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = file.Close() }()
+
+	return parseCPUFlags(file)
+}
+
+func getCPUModel() string {
+	file, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return ""
+	}
+	defer func() { _ = file.Close() }()
+
+	return parseCPUModel(file)
+}
+
+// goArchitectures maps the Go names of the architectures launcher can be
+// built for to the names uname -m reports.
+var goArchitectures = map[string]payloads.Architecture{
+	"amd64": payloads.X86_64,
+	"arm64": payloads.AArch64,
+}
+
+// nodeArchitecture returns the architecture of the node, which is the one
+// launcher was built for.
+func nodeArchitecture() payloads.Architecture {
+	if arch, ok := goArchitectures[runtime.GOARCH]; ok {
+		return arch
+	}
+	return payloads.Architecture(runtime.GOARCH)
+}
+
+// getKernelVersion returns the release of the running kernel, as uname -r
+// reports it.
+func getKernelVersion() string {
+	release, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(release))
+}
+
+func getHypervisors() []payloads.HypervisorCapability {
+	if simulate {
+		return []payloads.HypervisorCapability{
+			{Type: payloads.QEMU},
+			{Type: payloads.Docker},
+			{Type: payloads.CloudHypervisor},
+			{Type: payloads.KataContainer},
+		}
+	}
+
+	var hypervisors []payloads.HypervisorCapability
+
+	qemuVersion, haveQEMU := binaryVersion("qemu-system-x86_64")
+	if haveQEMU {
+		hypervisors = append(hypervisors, payloads.HypervisorCapability{
+			Type:    payloads.QEMU,
+			Version: qemuVersion,
+		})
+	}
+
+	haveDocker := false
+	if cli, err := getDockerClient(); err == nil {
+		if v, err := cli.ServerVersion(context.Background()); err == nil {
+			haveDocker = true
+			hypervisors = append(hypervisors, payloads.HypervisorCapability{
+				Type:    payloads.Docker,
+				Version: v.Version,
+			})
+		}
+	}
+
+	if version, ok := binaryVersion(chvBinary); ok {
+		hypervisors = append(hypervisors, payloads.HypervisorCapability{
+			Type:    payloads.CloudHypervisor,
+			Version: version,
+		})
+	}
+
+	// Kata instances are docker images booted by qemu, the version
+	// reported is the qemu one.
+	if _, err := os.Stat(kataKernel); err == nil && haveQEMU && haveDocker {
+		hypervisors = append(hypervisors, payloads.HypervisorCapability{
+			Type:    payloads.KataContainer,
+			Version: qemuVersion,
+		})
+	}
+
+	return hypervisors
+}
+
+func getHugepageSizes() []int {
+	pools, _, _ := getHugepageInfo()
+	sizes := make([]int, 0, len(pools))
+	for _, p := range pools {
+		sizes = append(sizes, p.SizeKB)
+	}
+	return sizes
+}
+
+// getFailureDomain returns the location of the node given on the command
+// line, or nil if none was given.
+func getFailureDomain() *payloads.FailureDomain {
+	if failureDomain == (payloads.FailureDomain{}) {
+		return nil
+	}
+	domain := failureDomain
+	return &domain
+}
+
+// getNodeCapabilities probes the node for the features the scheduler matches
+// against the requirements of the instances to place.
+func getNodeCapabilities(nodeUUID string) payloads.NodeCapabilities {
+	caps := payloads.NodeCapabilities{
+		NodeUUID:        nodeUUID,
+		Hypervisors:     getHypervisors(),
+		CPUFlags:        getCPUFlags(),
+		Architecture:    nodeArchitecture(),
+		CPUModel:        getCPUModel(),
+		KernelVersion:   getKernelVersion(),
+		HugepageSizesKB: getHugepageSizes(),
+		SRIOVVFs:        getSRIOVVFs(),
+		GPUs:            getGPUs(),
+		StorageBackends: []payloads.StorageBackend{payloads.LocalStorage},
+		WakeOnLANMAC:    getWakeOnLANMAC(),
+		FailureDomain:   getFailureDomain(),
+		SoftwareVersion: softwareVersion,
+		Labels:          nodeLabels,
+	}
+
+	// Rootfs encryption relies on qemu's LUKS support.
+	for _, h := range caps.Hypervisors {
+		if h.Type == payloads.QEMU {
+			caps.StorageBackends = append(caps.StorageBackends, payloads.EncryptedStorage)
+			break
+		}
+	}
+
+	return caps
+}
+
+// nodeCapabilities caches the capabilities last advertised by the node, so
+// that START commands can be checked against them without probing the node
+// again.
+var nodeCapabilities struct {
+	sync.Mutex
+	caps *payloads.NodeCapabilities
+}
+
+// cachedNodeCapabilities returns the capabilities last advertised by the
+// node, probing them if they have not been yet.
+func cachedNodeCapabilities() *payloads.NodeCapabilities {
+	nodeCapabilities.Lock()
+	defer nodeCapabilities.Unlock()
+
+	if nodeCapabilities.caps == nil {
+		caps := getNodeCapabilities("")
+		nodeCapabilities.caps = &caps
+	}
+	return nodeCapabilities.caps
+}
+
+// sendNodeCapabilities advertises the node's capabilities to the scheduler
+// each time launcher connects to it.  Schedulers that predate the
+// NodeCapabilities event do not get it.
+func sendNodeCapabilities(client *ssntpConn) {
+	if !client.isConnected() || client.PayloadVersion() < payloads.Version4 {
+		return
+	}
+
+	event := payloads.EventNodeCapabilities{
+		Capabilities: getNodeCapabilities(client.UUID()),
+	}
+
+	nodeCapabilities.Lock()
+	nodeCapabilities.caps = &event.Capabilities
+	nodeCapabilities.Unlock()
+	payload, err := payloads.MarshalVersion(client.Encoding(), &event, client.PayloadVersion())
+	if err != nil {
+		clog.Errorf("Unable to Marshall NodeCapabilities %v", err)
+		return
+	}
+
+	_, err = client.SendEvent(ssntp.NodeCapabilities, payload)
+	if err != nil {
+		clog.Errorf("Failed to send NodeCapabilities event %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testCPUInfo = `processor	: 0
+vendor_id	: GenuineIntel
+model name	: Intel(R) Core(TM) i7-4770 CPU @ 3.40GHz
+flags		: fpu vme de pse aes avx2
+bogomips	: 6784.24
+
+processor	: 1
+flags		: fpu vme
+`
+
+// Checks that the CPU flags are read from the first flags line of
+// /proc/cpuinfo.
+func TestParseCPUFlags(t *testing.T) {
+	flags := parseCPUFlags(strings.NewReader(testCPUInfo))
+	expected := []string{"fpu", "vme", "de", "pse", "aes", "avx2"}
+	if !reflect.DeepEqual(flags, expected) {
+		t.Errorf("Unexpected CPU flags %v", flags)
+	}
+
+	if flags := parseCPUFlags(strings.NewReader("processor : 0\n")); flags != nil {
+		t.Errorf("CPU flags found in cpuinfo without flags %v", flags)
+	}
+}
+
+// Checks that the CPU model is read from the first model name line of
+// /proc/cpuinfo.
+func TestParseCPUModel(t *testing.T) {
+	model := parseCPUModel(strings.NewReader(testCPUInfo))
+	if model != "Intel(R) Core(TM) i7-4770 CPU @ 3.40GHz" {
+		t.Errorf("Unexpected CPU model %s", model)
+	}
+
+	if model := parseCPUModel(strings.NewReader("processor : 0\nCPU part : 0xd08\n")); model != "" {
+		t.Errorf("CPU model found in cpuinfo without model name %s", model)
+	}
+}
+
+// Checks that the hypervisor versions are extracted from the output of the
+// qemu and cloud-hypervisor --version option.
+func TestParseHypervisorVersion(t *testing.T) {
+	tests := []struct {
+		output  string
+		version string
+	}{
+		{"QEMU emulator version 2.7.0, Copyright (c) 2003-2016 Fabrice Bellard\n", "2.7.0"},
+		{"QEMU emulator version 4.2.1 (Debian 1:4.2-3ubuntu6.7)\n", "4.2.1"},
+		{"cloud-hypervisor v20.0\n", "20.0"},
+		{"unknown\n", ""},
+	}
+
+	for _, test := range tests {
+		if v := parseHypervisorVersion(test.output); v != test.version {
+			t.Errorf("Expected version %s from %q, got %s", test.version, test.output, v)
+		}
+	}
+}
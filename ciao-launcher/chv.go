@@ -0,0 +1,359 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+const (
+	chvBinary         = "cloud-hypervisor"
+	chvFirmware       = "/usr/share/cloud-hypervisor/hypervisor-fw"
+	chvAPISocket      = "chv.sock"
+	chvConsoleLog     = "console.log"
+	chvLog            = "chv.log"
+	chvAPITimeout     = time.Second * 5
+	chvStartTimeout   = time.Second * 10
+	chvConnectTimeout = time.Second * 30
+	chvPollPeriod     = time.Second
+)
+
+// cloudHypervisor runs VM instances as Cloud Hypervisor microVMs.  The
+// instance directory layout, the qcow2 rootfs and the cloud-init ISO are the
+// same as those used by qemu, so we embed qemu and only override the methods
+// that need to talk to the VMM.  Cloud Hypervisor does not expose QMP, so
+// the statistics are always computed from the VMM process.
+type cloudHypervisor struct {
+	qemu
+}
+
+func (c *cloudHypervisor) apiSocket() string {
+	return path.Join(c.instanceDir, chvAPISocket)
+}
+
+func (c *cloudHypervisor) computeParams(vnicName string) []string {
+	vmImage := path.Join(c.instanceDir, "image.qcow2")
+
+	params := make([]string, 0, 32)
+	params = append(params, "--api-socket", "path="+c.apiSocket())
+	params = append(params, "--firmware", chvFirmware)
+	params = append(params, "--disk", fmt.Sprintf("path=%s,backing_files=on", vmImage))
+	if cloudInitMode.NeedsISO() {
+		params = append(params, fmt.Sprintf("path=%s,readonly=on", c.isoPath))
+	}
+
+	cpus := c.cfg.Cpus
+	if cpus <= 0 {
+		cpus = 1
+	}
+	params = append(params, "--cpus", fmt.Sprintf("boot=%d", cpus))
+
+	if c.cfg.Mem > 0 {
+		memoryParam := fmt.Sprintf("size=%dM", c.cfg.Mem)
+		if c.cfg.Hugepages {
+			memoryParam += ",hugepages=on"
+		}
+		params = append(params, "--memory", memoryParam)
+	}
+
+	if vnicName != "" {
+		params = append(params, "--net", fmt.Sprintf("tap=%s,mac=%s", vnicName, c.cfg.VnicMAC))
+	}
+
+	params = append(params, "--serial", "file="+path.Join(c.instanceDir, chvConsoleLog))
+	params = append(params, "--console", "off")
+
+	for _, dev := range c.cfg.pciDevices() {
+		params = append(params, "--device", fmt.Sprintf("path=/sys/bus/pci/devices/%s/", dev))
+	}
+
+	return params
+}
+
+func (c *cloudHypervisor) startVM(vnicName, ipAddress string) error {
+	clog.Info("Launching cloud-hypervisor")
+
+	if cloudInitMode.NeedsISO() {
+		err := c.updateSeedImage()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range c.cfg.pciDevices() {
+		err := vfioBind(dev)
+		if err != nil {
+			return err
+		}
+	}
+
+	// A stale socket left behind by a previous run of the instance would
+	// prevent the VMM from starting.
+
+	_ = os.Remove(c.apiSocket())
+
+	logPath := path.Join(c.instanceDir, chvLog)
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		clog.Errorf("Unable to create %s: %v", logPath, err)
+		return err
+	}
+	defer func() { _ = logFile.Close() }()
+
+	params := c.computeParams(vnicName)
+	cmd := exec.Command(chvBinary, params...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+
+	// Cloud Hypervisor does not daemonize itself.  Put it in its own
+	// session so that it survives launcher being restarted.
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	clog.Infof("launching cloud-hypervisor with: %v", params)
+	err = cmd.Start()
+	if err != nil {
+		clog.Errorf("Unable to launch cloud-hypervisor: %v", err)
+		return err
+	}
+
+	exitCh := make(chan error, 1)
+	go func() {
+		exitCh <- cmd.Wait()
+	}()
+
+	client := chvClient(c.apiSocket())
+	timeout := time.After(chvStartTimeout)
+	for {
+		select {
+		case err = <-exitCh:
+			out, _ := ioutil.ReadFile(logPath)
+			clog.Errorf("cloud-hypervisor exited: %v", err)
+			clog.Error(string(out))
+			return fmt.Errorf("cloud-hypervisor exited: %v", err)
+		case <-timeout:
+			_ = cmd.Process.Kill()
+			return fmt.Errorf("Timed out waiting for cloud-hypervisor API socket")
+		case <-time.After(100 * time.Millisecond):
+			if chvRequest(client, "GET", "vmm.ping") == nil {
+				clog.Info("Launched VM")
+				return nil
+			}
+		}
+	}
+}
+
+func chvClient(socketPath string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return net.Dial("unix", socketPath)
+			},
+		},
+		Timeout: chvAPITimeout,
+	}
+}
+
+// chvRequest issues a request to the REST API exposed by cloud-hypervisor on
+// its API socket.  The host part of the URL is ignored.
+func chvRequest(client *http.Client, method, endpoint string) error {
+	req, err := http.NewRequest(method, "http://localhost/api/v1/"+endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s failed: %s", method, endpoint, resp.Status)
+	}
+
+	return nil
+}
+
+func chvWaitForAPI(instance string, client *http.Client, monitorCh chan string) bool {
+	timeout := time.After(chvConnectTimeout)
+	for {
+		if chvRequest(client, "GET", "vmm.ping") == nil {
+			return true
+		}
+
+		select {
+		case _, ok := <-monitorCh:
+			if !ok {
+				return false
+			}
+		case <-timeout:
+			clog.Errorf("Unable to connect to cloud-hypervisor API for instance %s", instance)
+			return false
+		case <-time.After(chvPollPeriod):
+		}
+	}
+}
+
+func chvMonitor(instance, socketPath string, monitorCh chan string, closedCh chan struct{},
+	connectedCh chan struct{}, wg *sync.WaitGroup) {
+	defer func() {
+		if closedCh != nil {
+			close(closedCh)
+		}
+		clog.Infof("Monitor function for %s exitting", instance)
+		wg.Done()
+	}()
+
+	client := chvClient(socketPath)
+	if !chvWaitForAPI(instance, client, monitorCh) {
+		return
+	}
+
+	close(connectedCh)
+
+	ticker := time.NewTicker(chvPollPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case cmd, ok := <-monitorCh:
+			if !ok {
+				return
+			}
+			if cmd == virtualizerStopCmd {
+				clog.Info("Sending STOP")
+				err := chvRequest(client, "PUT", "vmm.shutdown")
+				if err != nil {
+					clog.Errorf("Unable to send shutdown command to %s: %v", instance, err)
+				}
+			}
+		case <-ticker.C:
+			if closedCh == nil {
+				continue
+			}
+			if chvRequest(client, "GET", "vmm.ping") != nil {
+				clog.Warning("Lost connection to cloud-hypervisor API socket")
+				close(closedCh)
+				closedCh = nil
+			}
+		}
+	}
+}
+
+func (c *cloudHypervisor) monitorVM(closedCh chan struct{}, connectedCh chan struct{},
+	wg *sync.WaitGroup, boot bool) chan string {
+	monitorCh := make(chan string)
+	wg.Add(1)
+	go chvMonitor(c.cfg.Instance, c.apiSocket(), monitorCh, closedCh, connectedCh, wg)
+	return monitorCh
+}
+
+func (c *cloudHypervisor) connected() {
+	c.pid = socketOwner(c.apiSocket())
+	if c.pid != 0 {
+		clog.Infof("PID of cloud-hypervisor for instance %s is %d", c.instanceDir, c.pid)
+	} else {
+		clog.Errorf("Unable to determine pid for %s", c.instanceDir)
+	}
+	c.prevCPUTime = -1
+}
+
+func (c *cloudHypervisor) lostVM() {
+	c.pid = 0
+	c.prevCPUTime = -1
+}
+
+// Cloud Hypervisor has no guest agent channel so we can only determine
+// whether an instance is ready by connecting to its ssh port.
+func (c *cloudHypervisor) readinessProbe() func() bool {
+	ip := c.cfg.VnicIP
+	if ip == "" {
+		return nil
+	}
+	return func() bool {
+		return sshProbe(ip)
+	}
+}
+
+func (c *cloudHypervisor) healthProbe() func() healthReport {
+	return nil
+}
+
+func (c *cloudHypervisor) logFollower() logFollower {
+	return followFile(path.Join(c.instanceDir, chvConsoleLog))
+}
+
+func (c *cloudHypervisor) guestFilesystems() []payloads.GuestFilesystemStat {
+	return nil
+}
+
+func (c *cloudHypervisor) setBalloon(targetMB int) error {
+	return errBalloonNotSupported
+}
+
+func (c *cloudHypervisor) console() (string, error) {
+	return "", errConsoleNotSupported
+}
+
+func (c *cloudHypervisor) migrate(uri string) error {
+	return errMigrationNotSupported
+}
+
+// Memory dumps are not supported as they require QMP.
+func (c *cloudHypervisor) diagnostics(memoryDump bool) func(dir string) error {
+	logs := []string{
+		path.Join(c.instanceDir, chvLog),
+		path.Join(c.instanceDir, chvConsoleLog),
+	}
+	return func(dir string) error {
+		if err := copyLogs(dir, logs); err != nil {
+			return err
+		}
+		if memoryDump {
+			return fmt.Errorf("Memory dumps are not supported by %s", chvBinary)
+		}
+		return nil
+	}
+}
+
+func chvKillInstance(instanceDir string) {
+	socketPath := path.Join(instanceDir, chvAPISocket)
+	if _, err := os.Stat(socketPath); err != nil {
+		return
+	}
+
+	clog.Infof("Powering Down %s", instanceDir)
+
+	err := chvRequest(chvClient(socketPath), "PUT", "vmm.shutdown")
+	if err != nil && !strings.Contains(err.Error(), "EOF") {
+		clog.Errorf("Unable to send shutdown command to %s: %v", instanceDir, err)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCloudHypervisorUnsupported(t *testing.T) {
+	c := &cloudHypervisor{}
+	c.init(&vmConfig{Instance: "67d86208-b46c-4465-9018-fe14087d415f"}, "/tmp/instance")
+
+	if _, err := c.console(); err != errConsoleNotSupported {
+		t.Errorf("Expected errConsoleNotSupported got %v", err)
+	}
+	if err := c.migrate("tcp:192.168.0.2:4444"); err != errMigrationNotSupported {
+		t.Errorf("Expected errMigrationNotSupported got %v", err)
+	}
+}
+
+func TestCloudHypervisorParams(t *testing.T) {
+	c := &cloudHypervisor{}
+	c.init(&vmConfig{
+		Cpus:      2,
+		Mem:       512,
+		Instance:  "67d86208-b46c-4465-9018-fe14087d415f",
+		VnicMAC:   "02:00:e6:f5:af:f9",
+		Hugepages: true,
+	}, "/tmp/instance")
+
+	params := c.computeParams("tap0")
+	expected := []string{
+		"--api-socket", "path=/tmp/instance/chv.sock",
+		"--firmware", chvFirmware,
+		"--disk", "path=/tmp/instance/image.qcow2,backing_files=on",
+	}
+	if cloudInitMode.NeedsISO() {
+		expected = append(expected, "path=/tmp/instance/seed.iso,readonly=on")
+	}
+	expected = append(expected,
+		"--cpus", "boot=2",
+		"--memory", "size=512M,hugepages=on",
+		"--net", "tap=tap0,mac=02:00:e6:f5:af:f9",
+		"--serial", "file=/tmp/instance/console.log",
+		"--console", "off")
+
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("Unexpected parameters.  Expected %v got %v", expected, params)
+	}
+
+	c.cfg.Mem = 0
+	c.cfg.Cpus = 0
+	params = c.computeParams("")
+	for i, p := range params {
+		switch p {
+		case "--memory", "--net":
+			t.Errorf("Unexpected parameter %s", p)
+		case "--cpus":
+			if i+1 >= len(params) || params[i+1] != "boot=1" {
+				t.Errorf("Expected a single vCPU")
+			}
+		}
+	}
+}
@@ -0,0 +1,225 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+
+	"github.com/01org/ciao/clog"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	cloudInitUserData = "user_data"
+	cloudInitMetaData = "meta_data"
+)
+
+type cloudInitFlag string
+
+const (
+	cloudInitConfigDrive     cloudInitFlag = "config-drive"
+	cloudInitNoCloud         cloudInitFlag = "nocloud"
+	cloudInitMetadataService cloudInitFlag = "metadata-service"
+)
+
+func (f *cloudInitFlag) String() string {
+	return string(*f)
+}
+
+func (f *cloudInitFlag) Set(val string) error {
+	v := cloudInitFlag(val)
+	if v != cloudInitConfigDrive && v != cloudInitNoCloud && v != cloudInitMetadataService {
+		return fmt.Errorf("config-drive, nocloud or metadata-service expected")
+	}
+	*f = v
+
+	return nil
+}
+
+// NeedsISO returns true if the cloud-init data of an instance is to be
+// delivered to the instance on an ISO image.
+func (f *cloudInitFlag) NeedsISO() bool {
+	return *f != cloudInitMetadataService
+}
+
+func instanceHostname(cfg *vmConfig) string {
+	if cfg.Hostname != "" {
+		return cfg.Hostname
+	}
+	return cfg.Instance
+}
+
+// saveCloudInitData stores the user-data and meta-data documents from the
+// START payload in the instance directory so that the seed ISO can be
+// regenerated each time the instance is booted.
+func saveCloudInitData(instanceDir string, userData, metaData []byte) error {
+	err := ioutil.WriteFile(path.Join(instanceDir, cloudInitUserData), userData, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to store user data: %v", err)
+	}
+
+	err = ioutil.WriteFile(path.Join(instanceDir, cloudInitMetaData), metaData, 0600)
+	if err != nil {
+		return fmt.Errorf("Unable to store meta data: %v", err)
+	}
+
+	return nil
+}
+
+func loadCloudInitData(instanceDir string) (userData, metaData []byte, err error) {
+	userData, err = ioutil.ReadFile(path.Join(instanceDir, cloudInitUserData))
+	if err != nil {
+		return
+	}
+
+	metaData, err = ioutil.ReadFile(path.Join(instanceDir, cloudInitMetaData))
+	return
+}
+
+// openStackMetaDataDoc returns the meta_data.json document of an OpenStack
+// config drive, i.e., the meta-data document from the START payload with
+// any of the uuid, hostname and public_keys keys that were not provided by
+// the user filled in.
+func openStackMetaDataDoc(cfg *vmConfig, metaData []byte) ([]byte, error) {
+	md := make(map[string]interface{})
+
+	if len(metaData) != 0 {
+		err := json.Unmarshal(metaData, &md)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid meta data: %v", err)
+		}
+	}
+
+	if _, ok := md["uuid"]; !ok {
+		md["uuid"] = cfg.Instance
+	}
+
+	if _, ok := md["hostname"]; !ok {
+		md["hostname"] = instanceHostname(cfg)
+	}
+
+	if _, ok := md["public_keys"]; !ok && len(cfg.SSHKeys) > 0 {
+		keys := make(map[string]string)
+		for i, key := range cfg.SSHKeys {
+			keys[fmt.Sprintf("key-%d", i)] = key
+		}
+		md["public_keys"] = keys
+	}
+
+	doc, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(doc, '\n'), nil
+}
+
+// noCloudMetaDataDoc converts the meta-data document from the START payload,
+// which is JSON and therefore also valid YAML, into a NoCloud meta-data
+// document, filling in any keys that were not provided by the user.
+func noCloudMetaDataDoc(cfg *vmConfig, metaData []byte) ([]byte, error) {
+	md := make(map[string]interface{})
+
+	if len(metaData) != 0 {
+		err := yaml.Unmarshal(metaData, &md)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid meta data: %v", err)
+		}
+	}
+
+	if _, ok := md["instance-id"]; !ok {
+		md["instance-id"] = cfg.Instance
+	}
+
+	if _, ok := md["local-hostname"]; !ok {
+		if hostname, ok := md["hostname"].(string); ok {
+			md["local-hostname"] = hostname
+		} else {
+			md["local-hostname"] = instanceHostname(cfg)
+		}
+	}
+
+	if _, ok := md["public-keys"]; !ok && len(cfg.SSHKeys) > 0 {
+		md["public-keys"] = cfg.SSHKeys
+	}
+
+	return yaml.Marshal(md)
+}
+
+func createCloudInitISO(instanceDir, isoPath string, cfg *vmConfig, userData, metaData []byte) error {
+	var volume, metaDataPath, userDataPath string
+	var doc []byte
+	var err error
+
+	configDrivePath := path.Join(instanceDir, "clr-cloud-init")
+
+	defer func() {
+		_ = os.RemoveAll(configDrivePath)
+	}()
+
+	dataDirPath := configDrivePath
+	if cloudInitMode == cloudInitNoCloud {
+		volume = "cidata"
+		metaDataPath = path.Join(dataDirPath, "meta-data")
+		userDataPath = path.Join(dataDirPath, "user-data")
+		doc, err = noCloudMetaDataDoc(cfg, metaData)
+	} else {
+		volume = "config-2"
+		dataDirPath = path.Join(configDrivePath, "openstack", "latest")
+		metaDataPath = path.Join(dataDirPath, "meta_data.json")
+		userDataPath = path.Join(dataDirPath, "user_data")
+		doc, err = openStackMetaDataDoc(cfg, metaData)
+	}
+	if err != nil {
+		clog.Errorf("Unable to create meta data: %v", err)
+		return err
+	}
+
+	err = os.MkdirAll(dataDirPath, 0755)
+	if err != nil {
+		clog.Errorf("Unable to create config drive directory %s", dataDirPath)
+		return err
+	}
+
+	err = ioutil.WriteFile(metaDataPath, doc, 0644)
+	if err != nil {
+		clog.Errorf("Unable to create %s", metaDataPath)
+		return err
+	}
+
+	err = ioutil.WriteFile(userDataPath, userData, 0644)
+	if err != nil {
+		clog.Errorf("Unable to create %s", userDataPath)
+		return err
+	}
+
+	cmd := exec.Command("xorriso", "-as", "mkisofs", "-R", "-V", volume, "-o", isoPath,
+		configDrivePath)
+	err = cmd.Run()
+	if err != nil {
+		clog.Errorf("Unable to create cloudinit iso image %v", err)
+		return err
+	}
+
+	clog.Infof("ISO image %s created", isoPath)
+
+	return nil
+}
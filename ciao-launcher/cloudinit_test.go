@@ -0,0 +1,72 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestOpenStackMetaDataDoc(t *testing.T) {
+	cfg := &vmConfig{
+		Instance: "d7d86208-b46c-4465-9018-fe14087d415f",
+		Hostname: "ciao",
+		SSHKeys:  []string{"ssh-rsa AAAA ciao@ciao"},
+	}
+
+	tests := []struct {
+		metaData string
+		expected map[string]interface{}
+	}{
+		{"", map[string]interface{}{
+			"uuid":        cfg.Instance,
+			"hostname":    "ciao",
+			"public_keys": map[string]interface{}{"key-0": "ssh-rsa AAAA ciao@ciao"},
+		}},
+		{`{"hostname": "user", "availability_zone": "az1"}`, map[string]interface{}{
+			"uuid":              cfg.Instance,
+			"hostname":          "user",
+			"availability_zone": "az1",
+			"public_keys":       map[string]interface{}{"key-0": "ssh-rsa AAAA ciao@ciao"},
+		}},
+		{`{"uuid": "user", "public_keys": {"mine": "ssh-ed25519 AAAA"}}`, map[string]interface{}{
+			"uuid":        "user",
+			"hostname":    "ciao",
+			"public_keys": map[string]interface{}{"mine": "ssh-ed25519 AAAA"},
+		}},
+	}
+
+	for _, test := range tests {
+		doc, err := openStackMetaDataDoc(cfg, []byte(test.metaData))
+		if err != nil {
+			t.Fatalf("Unable to create meta data from %q: %v", test.metaData, err)
+		}
+
+		var md map[string]interface{}
+		if err := json.Unmarshal(doc, &md); err != nil {
+			t.Fatalf("Invalid meta data %s: %v", doc, err)
+		}
+		if !reflect.DeepEqual(md, test.expected) {
+			t.Errorf("Unexpected meta data from %q: %s", test.metaData, doc)
+		}
+	}
+
+	if _, err := openStackMetaDataDoc(cfg, []byte("hostname: ciao")); err == nil {
+		t.Error("Invalid meta data accepted")
+	}
+}
@@ -19,9 +19,9 @@ package main
 import (
 	"os"
 
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
-	"github.com/golang/glog"
 )
 
 type deleteError struct {
@@ -30,38 +30,40 @@ type deleteError struct {
 }
 
 func (de *deleteError) send(client *ssntpConn, instance string) {
+	recentErrors.add(ssntp.DeleteFailure, instance, string(de.code), de.err)
+
 	if !client.isConnected() {
 		return
 	}
 
 	payload, err := generateDeleteError(instance, de)
 	if err != nil {
-		glog.Errorf("Unable to generate payload for delete_failure: %v", err)
+		clog.Errorf("Unable to generate payload for delete_failure: %v", err)
 		return
 	}
 
 	_, err = client.SendError(ssntp.DeleteFailure, payload)
 	if err != nil {
-		glog.Errorf("Unable to send delete_failure: %v", err)
+		clog.Errorf("Unable to send delete_failure: %v", err)
 	}
 }
 
 func deleteVnic(instanceDir string, client *ssntpConn) {
 	cfg, err := loadVMConfig(instanceDir)
 	if err != nil {
-		glog.Warningf("Unable to load instance state %s: %s", instanceDir, err)
+		clog.Warningf("Unable to load instance state %s: %s", instanceDir, err)
 		return
 	}
 
 	vnicCfg, err := createVnicCfg(cfg)
 	if err != nil {
-		glog.Warningf("Unable to create vnicCfg: %s", err)
+		clog.Warningf("Unable to create vnicCfg: %s", err)
 		return
 	}
 
 	err = destroyVnic(client, vnicCfg)
 	if err != nil {
-		glog.Warningf("Unable to destroy vnic: %s", err)
+		clog.Warningf("Unable to destroy vnic: %s", err)
 	}
 }
 
@@ -75,13 +77,13 @@ func processDelete(vm virtualizer, instanceDir string, client *ssntpConn, runnin
 	_ = vm.deleteImage()
 
 	if networking.Enabled() && running != ovsPending {
-		glog.Info("Deleting Vnic")
+		clog.Info("Deleting Vnic")
 		deleteVnic(instanceDir, client)
 	}
 
 	err := os.RemoveAll(instanceDir)
 	if err != nil {
-		glog.Warningf("Unable to remove instance dir: %v", err)
+		clog.Warningf("Unable to remove instance dir: %v", err)
 	}
 
 	return err
@@ -0,0 +1,364 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	defaultDiagnosticsSamples = 10
+	diagnosticsChunkSize      = 256 * 1024
+	diagnosticsUploadTimeout  = time.Minute * 30
+	diagnosticsStatsFile      = "stats.json"
+	diagnosticsErrorsFile     = "errors.txt"
+	diagnosticsBundle         = "diagnostics.tar.gz"
+	memoryDumpFile            = "memory.dump"
+)
+
+// diagnosticsDir holds the bundles while they are being assembled.  It is
+// deliberately not inside the instance directory, as a bundle may still be
+// being uploaded when its instance is deleted.
+var diagnosticsDir = "/var/lib/ciao/diagnostics"
+
+type insDiagnosticsCmd struct {
+	uploadURL  string
+	memoryDump bool
+	samples    int
+	stats      []diagnosticsSample
+}
+
+type diagnosticsSample struct {
+	adminInstanceUsage
+	Time time.Time `json:"time"`
+}
+
+// instanceSamples extracts, in chronological order, the last n samples in
+// history that contain statistics for instance.
+func instanceSamples(history []adminStatsSample, instance string, n int) []diagnosticsSample {
+	samples := make([]diagnosticsSample, 0, n)
+	for i := len(history) - 1; i >= 0 && len(samples) < n; i-- {
+		usage, ok := history[i].Instances[instance]
+		if !ok {
+			continue
+		}
+		samples = append(samples, diagnosticsSample{usage, history[i].Time})
+	}
+
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+
+	return samples
+}
+
+// copyLogs copies the log files that exist in logs into dir.  Logs that
+// have not been created, e.g., because the instance has never been started,
+// are silently ignored.
+func copyLogs(dir string, logs []string) error {
+	for _, l := range logs {
+		src, err := os.Open(l)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		dst, err := os.Create(path.Join(dir, path.Base(l)))
+		if err == nil {
+			_, err = io.Copy(dst, src)
+			if cerr := dst.Close(); err == nil {
+				err = cerr
+			}
+		}
+		_ = src.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// demuxDockerLogs strips the headers docker inserts into the log stream of
+// a container that does not have a tty.  Each frame is preceded by an
+// 8 byte header, the last 4 bytes of which contain the big endian size of
+// the frame.
+func demuxDockerLogs(r io.Reader, w io.Writer) error {
+	return demuxDockerStreams(r, w, w)
+}
+
+// demuxDockerStreams is like demuxDockerLogs but writes the frames of the
+// container's stdout and stderr, identified by the first byte of their
+// header, to separate writers.
+func demuxDockerStreams(r io.Reader, stdout, stderr io.Writer) error {
+	var hdr [8]byte
+	for {
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		w := stdout
+		if hdr[0] == 2 {
+			w = stderr
+		}
+		size := int64(binary.BigEndian.Uint32(hdr[4:]))
+		if _, err = io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+func writeTarball(dir, prefix string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, rel)
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		_ = f.Close()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func sendDiagnosticsChunk(conn *ssntpConn, chunk *payloads.DiagnosticsChunk) error {
+	if !conn.isConnected() {
+		return fmt.Errorf("Not connected to scheduler")
+	}
+
+	event := payloads.EventDiagnosticsData{Chunk: *chunk}
+	payload, err := yaml.Marshal(&event)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.SendEvent(ssntp.DiagnosticsData, payload)
+	return err
+}
+
+func sendDiagnosticsError(conn *ssntpConn, instance string, diagErr error) {
+	chunk := &payloads.DiagnosticsChunk{
+		InstanceUUID: instance,
+		Last:         true,
+		Error:        diagErr.Error(),
+	}
+	if err := sendDiagnosticsChunk(conn, chunk); err != nil {
+		clog.Errorf("Unable to send DiagnosticsData event: %v", err)
+	}
+}
+
+func streamBundle(conn *ssntpConn, instance string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, diagnosticsChunkSize)
+	remaining := fi.Size()
+	for seq := 0; ; seq++ {
+		n, err := io.ReadFull(f, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		remaining -= int64(n)
+		chunk := &payloads.DiagnosticsChunk{
+			InstanceUUID: instance,
+			Sequence:     seq,
+			Last:         remaining <= 0,
+			Data:         base64.StdEncoding.EncodeToString(buf[:n]),
+		}
+		if err = sendDiagnosticsChunk(conn, chunk); err != nil {
+			return err
+		}
+		if chunk.Last {
+			return nil
+		}
+	}
+}
+
+func uploadBundle(uploadURL string, f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", uploadURL, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/gzip")
+
+	client := &http.Client{Timeout: diagnosticsUploadTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Upload to %s failed: %s", uploadURL, resp.Status)
+	}
+
+	return nil
+}
+
+func assembleBundle(bundleDir string, cmd *insDiagnosticsCmd, collect func(dir string) error) error {
+	if err := os.MkdirAll(bundleDir, 0700); err != nil {
+		return err
+	}
+
+	stats, err := json.MarshalIndent(cmd.stats, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path.Join(bundleDir, diagnosticsStatsFile), stats, 0600)
+	if err != nil {
+		return err
+	}
+
+	if collect == nil {
+		return nil
+	}
+
+	// A failure to gather some of the data, e.g., the memory dump, should
+	// not prevent us from returning whatever we did manage to collect.
+
+	if err := collect(bundleDir); err != nil {
+		clog.Warningf("Unable to collect all diagnostics: %v", err)
+		return ioutil.WriteFile(path.Join(bundleDir, diagnosticsErrorsFile),
+			[]byte(err.Error()+"\n"), 0600)
+	}
+
+	return nil
+}
+
+// collectDiagnostics builds the diagnostics bundle for an instance and
+// either uploads it or streams it back to the scheduler.  It can take a
+// long time to complete, so it is run in its own go routine and does not
+// access the instance go routine's state.  The virtualizer specific parts
+// of the bundle are gathered by collect, which may be nil.
+func collectDiagnostics(conn *ssntpConn, instance string, cmd *insDiagnosticsCmd,
+	collect func(dir string) error) {
+
+	err := os.MkdirAll(diagnosticsDir, 0700)
+	if err != nil {
+		sendDiagnosticsError(conn, instance, err)
+		return
+	}
+
+	tmpDir, err := ioutil.TempDir(diagnosticsDir, instance)
+	if err != nil {
+		sendDiagnosticsError(conn, instance, err)
+		return
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	err = assembleBundle(path.Join(tmpDir, instance), cmd, collect)
+	if err != nil {
+		clog.Errorf("Unable to assemble diagnostics for %s: %v", instance, err)
+		sendDiagnosticsError(conn, instance, err)
+		return
+	}
+
+	f, err := os.Create(path.Join(tmpDir, diagnosticsBundle))
+	if err != nil {
+		sendDiagnosticsError(conn, instance, err)
+		return
+	}
+	defer func() { _ = f.Close() }()
+
+	err = writeTarball(path.Join(tmpDir, instance), instance, f)
+	if err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		clog.Errorf("Unable to create diagnostics bundle for %s: %v", instance, err)
+		sendDiagnosticsError(conn, instance, err)
+		return
+	}
+
+	if cmd.uploadURL == "" {
+		err = streamBundle(conn, instance, f)
+		if err != nil {
+			clog.Errorf("Unable to stream diagnostics for %s: %v", instance, err)
+			sendDiagnosticsError(conn, instance, err)
+		}
+		return
+	}
+
+	err = uploadBundle(cmd.uploadURL, f)
+	if err != nil {
+		clog.Errorf("Unable to upload diagnostics for %s: %v", instance, err)
+		sendDiagnosticsError(conn, instance, err)
+		return
+	}
+
+	clog.Infof("Diagnostics for %s uploaded to %s", instance, cmd.uploadURL)
+	chunk := &payloads.DiagnosticsChunk{InstanceUUID: instance, Last: true}
+	if err = sendDiagnosticsChunk(conn, chunk); err != nil {
+		clog.Errorf("Unable to send DiagnosticsData event: %v", err)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestInstanceSamples(t *testing.T) {
+	now := time.Now()
+	history := make([]adminStatsSample, 0, 5)
+	for i := 0; i < 5; i++ {
+		s := adminStatsSample{
+			Time:      now.Add(time.Duration(i) * time.Minute),
+			Instances: map[string]adminInstanceUsage{},
+		}
+		if i != 3 {
+			s.Instances["instance-1"] = adminInstanceUsage{MemoryUsageMB: i}
+		}
+		history = append(history, s)
+	}
+
+	samples := instanceSamples(history, "instance-1", 3)
+	expected := []int{1, 2, 4}
+	if len(samples) != len(expected) {
+		t.Fatalf("Expected %d samples, found %d", len(expected), len(samples))
+	}
+	for i, s := range samples {
+		if s.MemoryUsageMB != expected[i] {
+			t.Errorf("Sample %d: expected %d found %d", i, expected[i], s.MemoryUsageMB)
+		}
+	}
+
+	if len(instanceSamples(history, "instance-2", 3)) != 0 {
+		t.Errorf("Found samples for unknown instance")
+	}
+}
+
+func TestDemuxDockerLogs(t *testing.T) {
+	stream := []byte{1, 0, 0, 0, 0, 0, 0, 6}
+	stream = append(stream, []byte("hello\n")...)
+	stream = append(stream, 2, 0, 0, 0, 0, 0, 0, 6)
+	stream = append(stream, []byte("world\n")...)
+
+	var out bytes.Buffer
+	if err := demuxDockerLogs(bytes.NewReader(stream), &out); err != nil {
+		t.Fatalf("Unable to demux logs: %v", err)
+	}
+	if out.String() != "hello\nworld\n" {
+		t.Errorf("Unexpected logs %q", out.String())
+	}
+
+	if err := demuxDockerLogs(bytes.NewReader(stream[:12]), &out); err == nil {
+		t.Errorf("Truncated stream not detected")
+	}
+}
+
+func TestWriteTarball(t *testing.T) {
+	dir, err := ioutil.TempDir("", "diagnostics")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	files := map[string]string{
+		diagnosticsStatsFile: "[]",
+		qemuConsoleLog:       "booting",
+	}
+	for name, contents := range files {
+		err = ioutil.WriteFile(path.Join(dir, name), []byte(contents), 0600)
+		if err != nil {
+			t.Fatalf("Unable to write %s: %v", name, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = writeTarball(dir, "instance-1", &buf); err != nil {
+		t.Fatalf("Unable to write tarball: %v", err)
+	}
+
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("Unable to read tarball: %v", err)
+	}
+	tr := tar.NewReader(gz)
+	found := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Unable to read tarball: %v", err)
+		}
+		contents, _ := ioutil.ReadAll(tr)
+		if files[path.Base(hdr.Name)] != string(contents) ||
+			path.Dir(hdr.Name) != "instance-1" {
+			t.Errorf("Unexpected file %s: %s", hdr.Name, string(contents))
+		}
+		found++
+	}
+	if found != len(files) {
+		t.Errorf("Expected %d files, found %d", len(files), found)
+	}
+}
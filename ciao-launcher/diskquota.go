@@ -0,0 +1,134 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+// diskFullRearmPercent is the percentage of its disk limit below which the
+// usage of an instance must drop before a new InstanceDiskFull event can be
+// sent for it, so that an instance hovering around its limit does not flood
+// the controller with events.
+const diskFullRearmPercent = 90
+
+// rootfsQuotaUnsupported is set once docker has refused to limit the size of
+// a container rootfs, i.e., when its storage driver is not overlay2 on an
+// XFS filesystem mounted with project quotas, so that we do not ask again.
+var rootfsQuotaUnsupported int32
+
+// rootfsLimitMB returns the node disk space the rootfs of the instance may
+// use, or 0 if it is not limited.
+func (cfg *vmConfig) rootfsLimitMB() int {
+	if !getSettings().diskLimit || cfg.Disk <= 0 {
+		return 0
+	}
+	return cfg.Disk
+}
+
+// rootfsQuota returns the docker storage options limiting the rootfs of a
+// container to limitMB, or nil if it is not limited.  Docker enforces the
+// limit with an XFS project quota on the writable layer of the container.
+func rootfsQuota(limitMB int) map[string]string {
+	if limitMB <= 0 || atomic.LoadInt32(&rootfsQuotaUnsupported) != 0 {
+		return nil
+	}
+	return map[string]string{"size": fmt.Sprintf("%dM", limitMB)}
+}
+
+// isQuotaUnsupported returns true if docker failed to create a container
+// because its storage driver cannot limit the size of the rootfs.
+func isQuotaUnsupported(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "storage-opt") || strings.Contains(msg, "storage opt")
+}
+
+// disableRootfsQuota records that docker cannot limit the size of container
+// rootfs on this node.  The disk usage of containers is still checked
+// against their limits, but they are no longer prevented from exceeding
+// them.
+func disableRootfsQuota(err error) {
+	if atomic.CompareAndSwapInt32(&rootfsQuotaUnsupported, 0, 1) {
+		clog.Warningf("Docker cannot limit the size of container rootfs: %v", err)
+	}
+}
+
+// diskFullState returns whether an instance whose rootfs uses usageMB of its
+// limitMB is full, given whether it was full at the previous sample, and
+// whether it just became full.  Instances without limits or whose usage is
+// unknown keep their state.
+func diskFullState(full bool, usageMB, limitMB int) (nowFull, crossed bool) {
+	if limitMB <= 0 || usageMB < 0 {
+		return full, false
+	}
+
+	if usageMB >= limitMB {
+		return true, !full
+	}
+
+	if usageMB < limitMB*diskFullRearmPercent/100 {
+		return false, false
+	}
+
+	return full, false
+}
+
+func sendInstanceDiskFullEvent(conn *ssntpConn, instance string, usageMB, limitMB int) {
+	if !conn.isConnected() || conn.PayloadVersion() < payloads.Version34 {
+		return
+	}
+
+	event := payloads.EventInstanceDiskFull{
+		InstanceDiskFull: payloads.InstanceDiskFullEvent{
+			InstanceUUID: instance,
+			UsageMB:      usageMB,
+			LimitMB:      limitMB,
+		},
+	}
+
+	payload, err := payloads.MarshalVersion(conn.Encoding(), &event, conn.PayloadVersion())
+	if err != nil {
+		clog.Errorf("Unable to Marshall InstanceDiskFull %v", err)
+		return
+	}
+
+	_, err = conn.SendEvent(ssntp.InstanceDiskFull, payload)
+	if err != nil {
+		clog.Errorf("Failed to send InstanceDiskFull event %v", err)
+	}
+}
+
+// checkDiskUsage is called with each disk usage sample of the instance and
+// reports it when its rootfs hits its limit.
+func (id *instanceData) checkDiskUsage(usageMB int) {
+	limitMB := id.cfg.rootfsLimitMB()
+
+	var crossed bool
+	id.diskFull, crossed = diskFullState(id.diskFull, usageMB, limitMB)
+	if !crossed {
+		return
+	}
+
+	clog.Warningf("Instance %s uses %d MB of its %d MB disk", id.instance, usageMB, limitMB)
+	sendInstanceDiskFullEvent(&id.ac.ssntpConn, id.instance, usageMB, limitMB)
+}
@@ -0,0 +1,83 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDiskFullState(t *testing.T) {
+	limit := 1000
+	samples := []struct {
+		usage   int
+		full    bool
+		crossed bool
+	}{
+		{500, false, false},
+		{-1, false, false},
+		{1000, true, true},
+		{1200, true, false},
+		{950, true, false},
+		{-1, true, false},
+		{1000, true, false},
+		{899, false, false},
+		{1001, true, true},
+	}
+
+	full := false
+	for i, s := range samples {
+		var crossed bool
+		full, crossed = diskFullState(full, s.usage, limit)
+		if full != s.full || crossed != s.crossed {
+			t.Errorf("Sample %d (%d MB): got full %v crossed %v, expected %v %v",
+				i, s.usage, full, crossed, s.full, s.crossed)
+		}
+	}
+
+	full, crossed := diskFullState(false, 5000, 0)
+	if full || crossed {
+		t.Errorf("Instance without a disk limit is full")
+	}
+}
+
+func TestRootfsQuota(t *testing.T) {
+	defer atomic.StoreInt32(&rootfsQuotaUnsupported, 0)
+
+	if opts := rootfsQuota(0); opts != nil {
+		t.Errorf("Unlimited rootfs has storage options %v", opts)
+	}
+
+	opts := rootfsQuota(2048)
+	if opts["size"] != "2048M" {
+		t.Errorf("Unexpected storage options %v", opts)
+	}
+
+	err := errors.New("--storage-opt is supported only for overlay over xfs with 'pquota' mount option")
+	if !isQuotaUnsupported(err) {
+		t.Fatalf("Quota error not recognised: %v", err)
+	}
+	if isQuotaUnsupported(errors.New("No such image: busybox:latest")) {
+		t.Errorf("Unrelated error taken for a quota error")
+	}
+
+	disableRootfsQuota(err)
+	if opts := rootfsQuota(2048); opts != nil {
+		t.Errorf("Storage options %v requested after docker refused them", opts)
+	}
+}
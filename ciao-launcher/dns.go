@@ -0,0 +1,227 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/01org/ciao/clog"
+)
+
+// Launcher can publish the hostname and addresses of the instances it runs
+// to a DNS backend.  The records of an instance are registered each time it
+// becomes ready, i.e., when an InstanceReady event is sent for it, and are
+// removed when it is deleted.  Two backends are supported: a webhook, to
+// which a JSON document describing each change is posted, and a DNS server
+// accepting RFC 2136 dynamic updates, which are sent with nsupdate.  The
+// updates are sent in order by a single go routine so that a slow backend
+// does not hold up the instances.
+
+// dnsQueueLength is the number of updates waiting to be sent beyond which
+// new updates are dropped.
+const dnsQueueLength = 64
+
+// dnsTimeout is the time after which sending an update is abandoned.
+const dnsTimeout = 10 * time.Second
+
+const (
+	dnsRegister   = "register"
+	dnsDeregister = "deregister"
+)
+
+// dnsUpdate is a change to the records of an instance, and the JSON
+// document posted to the webhook backend.
+type dnsUpdate struct {
+	Action       string `json:"action"`
+	InstanceUUID string `json:"instance_uuid"`
+	TenantUUID   string `json:"tenant_uuid,omitempty"`
+	Hostname     string `json:"hostname"`
+	IPv4         string `json:"ipv4,omitempty"`
+	IPv6         string `json:"ipv6,omitempty"`
+	TTL          int    `json:"ttl"`
+}
+
+type dnsBackend interface {
+	send(u *dnsUpdate) error
+}
+
+type dnsWebhookBackend struct {
+	url    string
+	client *http.Client
+}
+
+func (w *dnsWebhookBackend) send(u *dnsUpdate) error {
+	data, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook refused update: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// dnsNSUpdate sends RFC 2136 dynamic updates to server, optionally signed
+// with the TSIG key stored in keyFile.
+type dnsNSUpdate struct {
+	server  string
+	zone    string
+	keyFile string
+}
+
+// script returns the nsupdate commands replacing the A and AAAA records of
+// an instance with its current addresses, or removing them.
+func (n *dnsNSUpdate) script(u *dnsUpdate) string {
+	var b bytes.Buffer
+
+	if host, port, err := net.SplitHostPort(n.server); err == nil {
+		fmt.Fprintf(&b, "server %s %s\n", host, port)
+	} else {
+		fmt.Fprintf(&b, "server %s\n", n.server)
+	}
+
+	name := u.Hostname
+	if n.zone != "" {
+		fmt.Fprintf(&b, "zone %s\n", n.zone)
+		if !strings.HasSuffix(name, ".") {
+			name += "." + strings.TrimSuffix(n.zone, ".")
+		}
+	}
+
+	fmt.Fprintf(&b, "update delete %s A\n", name)
+	fmt.Fprintf(&b, "update delete %s AAAA\n", name)
+	if u.Action == dnsRegister {
+		if u.IPv4 != "" {
+			fmt.Fprintf(&b, "update add %s %d A %s\n", name, u.TTL, u.IPv4)
+		}
+		if u.IPv6 != "" {
+			fmt.Fprintf(&b, "update add %s %d AAAA %s\n", name, u.TTL, u.IPv6)
+		}
+	}
+	fmt.Fprintf(&b, "send\n")
+
+	return b.String()
+}
+
+func (n *dnsNSUpdate) send(u *dnsUpdate) error {
+	args := []string{"-t", fmt.Sprintf("%d", int(dnsTimeout/time.Second))}
+	if n.keyFile != "" {
+		args = append(args, "-k", n.keyFile)
+	}
+
+	cmd := exec.Command("nsupdate", args...)
+	cmd.Stdin = strings.NewReader(n.script(u))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nsupdate failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// dnsRegistrar publishes the records of the instances to a DNS backend.  A
+// nil dnsRegistrar publishes nothing.
+type dnsRegistrar struct {
+	backend dnsBackend
+	ttl     int
+	updates chan *dnsUpdate
+}
+
+var dnsRegistry *dnsRegistrar
+
+// newDNSRegistrar returns a registrar posting the updates to webhook, if
+// set, or sending them to the RFC 2136 server, if set, or nil.
+func newDNSRegistrar(webhook, server, zone, keyFile string, ttl int) *dnsRegistrar {
+	var backend dnsBackend
+	switch {
+	case webhook != "":
+		backend = &dnsWebhookBackend{url: webhook, client: &http.Client{Timeout: dnsTimeout}}
+	case server != "":
+		backend = &dnsNSUpdate{server: server, zone: zone, keyFile: keyFile}
+	default:
+		return nil
+	}
+
+	d := &dnsRegistrar{
+		backend: backend,
+		ttl:     ttl,
+		updates: make(chan *dnsUpdate, dnsQueueLength),
+	}
+
+	go d.run()
+
+	return d
+}
+
+func (d *dnsRegistrar) run() {
+	for u := range d.updates {
+		if err := d.backend.send(u); err != nil {
+			clog.Warningf("Unable to %s DNS records of instance %s: %v", u.Action,
+				u.InstanceUUID, err)
+			continue
+		}
+		clog.Infof("DNS records of instance %s: %s %s", u.InstanceUUID, u.Action, u.Hostname)
+	}
+}
+
+func (d *dnsRegistrar) queue(action string, cfg *vmConfig) {
+	if d == nil || cfg.NetworkNode || (cfg.VnicIP == "" && cfg.VnicIPv6 == "") {
+		return
+	}
+
+	u := &dnsUpdate{
+		Action:       action,
+		InstanceUUID: cfg.Instance,
+		TenantUUID:   cfg.TennantUUID,
+		Hostname:     instanceHostname(cfg),
+		IPv4:         cfg.VnicIP,
+		IPv6:         cfg.VnicIPv6,
+		TTL:          d.ttl,
+	}
+
+	select {
+	case d.updates <- u:
+	default:
+		clog.Warningf("DNS update queue full, dropping %s of instance %s", action, cfg.Instance)
+	}
+}
+
+// register publishes the records of an instance that became ready.  CNCIs
+// and instances without a vnic address are not registered.
+func (d *dnsRegistrar) register(cfg *vmConfig) {
+	d.queue(dnsRegister, cfg)
+}
+
+// deregister removes the records of a deleted instance.
+func (d *dnsRegistrar) deregister(cfg *vmConfig) {
+	d.queue(dnsDeregister, cfg)
+}
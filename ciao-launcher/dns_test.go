@@ -0,0 +1,123 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func testDNSConfig() *vmConfig {
+	return &vmConfig{
+		Instance:    "67d86208-b46c-4465-9018-e14187d4010",
+		TennantUUID: "1b2f3d5c-86c9-4a42-9bd1-1e2e1b4cc0c3",
+		Hostname:    "web-0",
+		VnicIP:      "172.16.0.2",
+		VnicIPv6:    "fd00:1::2",
+	}
+}
+
+// Checks that the registrar posts the records of ready and deleted instances
+// to the webhook, in order, and skips CNCIs and instances without addresses.
+//
+// Test is expected to pass.
+func TestDNSWebhook(t *testing.T) {
+	updates := make(chan dnsUpdate, 4)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var u dnsUpdate
+		if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+			t.Errorf("Unable to decode DNS update: %v", err)
+		}
+		updates <- u
+	}))
+	defer server.Close()
+
+	d := newDNSRegistrar(server.URL, "", "", "", 60)
+	defer close(d.updates)
+
+	cfg := testDNSConfig()
+	d.register(&vmConfig{Instance: "cnci", VnicIP: "192.168.0.2", NetworkNode: true})
+	d.register(&vmConfig{Instance: "no-address"})
+	d.register(cfg)
+	d.deregister(cfg)
+
+	for _, action := range []string{dnsRegister, dnsDeregister} {
+		select {
+		case u := <-updates:
+			if u.Action != action || u.InstanceUUID != cfg.Instance ||
+				u.Hostname != "web-0" || u.IPv4 != cfg.VnicIP ||
+				u.IPv6 != cfg.VnicIPv6 || u.TTL != 60 {
+				t.Errorf("Unexpected DNS update %+v", u)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s update", action)
+		}
+	}
+}
+
+// Checks that the nsupdate script replaces the records of registered
+// instances and only deletes those of deregistered ones.
+//
+// Test is expected to pass.
+func TestDNSNSUpdateScript(t *testing.T) {
+	n := &dnsNSUpdate{server: "10.0.0.53:5353", zone: "ciao.example.com."}
+	u := &dnsUpdate{
+		Action:   dnsRegister,
+		Hostname: "web-0",
+		IPv4:     "172.16.0.2",
+		IPv6:     "fd00:1::2",
+		TTL:      300,
+	}
+
+	expected := "server 10.0.0.53 5353\n" +
+		"zone ciao.example.com.\n" +
+		"update delete web-0.ciao.example.com A\n" +
+		"update delete web-0.ciao.example.com AAAA\n" +
+		"update add web-0.ciao.example.com 300 A 172.16.0.2\n" +
+		"update add web-0.ciao.example.com 300 AAAA fd00:1::2\n" +
+		"send\n"
+	if s := n.script(u); s != expected {
+		t.Errorf("Unexpected register script\n[%s]\n vs\n[%s]", s, expected)
+	}
+
+	n = &dnsNSUpdate{server: "10.0.0.53"}
+	u.Action = dnsDeregister
+	expected = "server 10.0.0.53\n" +
+		"update delete web-0 A\n" +
+		"update delete web-0 AAAA\n" +
+		"send\n"
+	if s := n.script(u); s != expected {
+		t.Errorf("Unexpected deregister script\n[%s]\n vs\n[%s]", s, expected)
+	}
+}
+
+// Checks that no registrar is created when no backend is configured and
+// that a nil registrar can be used.
+//
+// Test is expected to pass.
+func TestDNSRegistrarDisabled(t *testing.T) {
+	d := newDNSRegistrar("", "", "ciao.example.com", "", 300)
+	if d != nil {
+		t.Fatalf("Registrar created without backend")
+	}
+
+	d.register(testDNSConfig())
+	d.deregister(testDNSConfig())
+}
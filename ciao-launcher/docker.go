@@ -18,24 +18,43 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"os"
 	"path"
+	"regexp"
+	"strconv"
 	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
-	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
 	"github.com/docker/engine-api/client"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/container"
 	"github.com/docker/engine-api/types/filters"
 	"github.com/docker/engine-api/types/network"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 )
 
+const (
+	seccompProfilesPath = "/etc/ciao/seccomp"
+	seccompUnconfined   = "unconfined"
+	apparmorUnconfined  = "unconfined"
+	selinuxDisable      = "disable"
+	usernsRemap         = "remap"
+	usernsHost          = "host"
+)
+
+// dockerDefaultDiskMB is the disk space allocated to the rootfs of a
+// container whose START payload does not request any.
+const dockerDefaultDiskMB = 10000
+
+var dockerRemappedRootRegexp = regexp.MustCompile(`/[0-9]+\.[0-9]+$`)
+
 var dockerClient struct {
 	sync.Mutex
 	cli *client.Client
@@ -77,7 +96,7 @@ func (d *docker) init(cfg *vmConfig, instanceDir string) {
 }
 
 func (d *docker) checkBackingImage() error {
-	glog.Infof("Checking backing docker image %s", d.cfg.Image)
+	clog.Infof("Checking backing docker image %s", d.cfg.Image)
 
 	cli, err := getDockerClient()
 	if err != nil {
@@ -93,92 +112,107 @@ func (d *docker) checkBackingImage() error {
 		})
 
 	if err != nil {
-		glog.Infof("Called to ImageList for %s failed: %v", d.cfg.Image, err)
+		clog.Infof("Called to ImageList for %s failed: %v", d.cfg.Image, err)
 		return err
 	}
 
 	if len(images) == 0 {
-		glog.Infof("Docker Image not found %s", d.cfg.Image)
+		clog.Infof("Docker Image not found %s", d.cfg.Image)
 		return errImageNotFound
 	}
 
-	glog.Infof("Docker Image %s is present on node", d.cfg.Image)
+	clog.Infof("Docker Image %s is present on node", d.cfg.Image)
 
 	return nil
 }
 
 func (d *docker) downloadBackingImage() error {
-	glog.Infof("Downloading backing docker image %s", d.cfg.Image)
+	clog.Infof("Downloading backing docker image %s", d.cfg.Image)
 
 	cli, err := getDockerClient()
 	if err != nil {
 		return err
 	}
 
-	prog, err := cli.ImagePull(context.Background(), types.ImagePullOptions{ImageID: d.cfg.Image}, nil)
-	if err != nil {
-		glog.Errorf("Unable to download image %s: %v\n", d.cfg.Image, err)
-		return err
-
-	}
-	defer func() { _ = prog.Close() }()
-
-	dec := json.NewDecoder(prog)
-	var msg jsonmessage.JSONMessage
-	err = dec.Decode(&msg)
-	for err == nil {
-		if msg.Error != nil {
-			err = msg.Error
-			break
+	progress := newPullProgress(d.cfg.Instance, d.cfg.Image)
+	defer func() {
+		if d.cfg.pullProgress != nil {
+			progress.event.Done = true
+			d.cfg.pullProgress(&progress.event)
 		}
+	}()
 
-		err = dec.Decode(&msg)
+	if mirrored := mirrorImage(registryMirror, d.cfg.Image); mirrored != "" {
+		err = pullFromMirror(cli, d.cfg.Image, mirrored, progress, d.cfg.pullProgress)
+		if err == nil {
+			return nil
+		}
+		clog.Warningf("Unable to download image %s from %s: %v", d.cfg.Image, registryMirror, err)
 	}
 
-	if err != nil && err != io.EOF {
-		glog.Errorf("Unable to download image %v\n", err)
+	auth, err := registryAuth(d.cfg, imageRegistry(d.cfg.Image))
+	if err != nil {
+		clog.Errorf("Unable to retrieve the registry credentials of image %s: %v", d.cfg.Image, err)
 		return err
 	}
 
-	return nil
-}
-
-func (d *docker) createImage(bridge string, userData, metaData []byte) error {
-	var hostname string
-	var cmd []string
-
-	cli, err := getDockerClient()
+	err = pullImage(cli, d.cfg.Image, auth, progress, d.cfg.pullProgress)
 	if err != nil {
+		clog.Errorf("Unable to download image %s: %v", d.cfg.Image, err)
 		return err
 	}
 
+	return nil
+}
+
+// containerHostname returns the hostname specified in the meta-data of the
+// START payload, or the default hostname for the instance if there is none.
+func containerHostname(cfg *vmConfig, metaData []byte) string {
 	md := &struct {
 		Hostname string `json:"hostname"`
 	}{}
-	err = json.Unmarshal(metaData, md)
+	err := json.Unmarshal(metaData, md)
 	if err != nil {
-		glog.Info("Start command does not contain hostname. Setting to instance UUID")
-		hostname = d.cfg.Instance
-	} else {
-		glog.Infof("Found hostname %s", md.Hostname)
-		hostname = md.Hostname
+		clog.Info("Start command does not contain hostname meta data")
+		return instanceHostname(cfg)
 	}
 
+	clog.Infof("Found hostname %s", md.Hostname)
+	return md.Hostname
+}
+
+// containerCommand returns the first runcmd found in the user-data of the
+// START payload.  Containers can only run a single command.
+func containerCommand(userData []byte) []string {
+	var cmd []string
+
 	ud := &struct {
 		Cmds [][]string `yaml:"runcmd"`
 	}{}
-	err = yaml.Unmarshal(userData, ud)
+	err := yaml.Unmarshal(userData, ud)
 	if err != nil {
-		glog.Info("Start command does not contain a run command")
+		clog.Info("Start command does not contain a run command")
 	} else {
 		if len(ud.Cmds) >= 1 {
 			cmd = ud.Cmds[0]
 			if len(ud.Cmds) > 1 {
-				glog.Warningf("Only one command supported.  Found %d in userdata", len(ud.Cmds))
+				clog.Warningf("Only one command supported.  Found %d in userdata", len(ud.Cmds))
 			}
 		}
 	}
 
+	return cmd
+}
+
+func (d *docker) createImage(bridge string, userData, metaData []byte) error {
+	cli, err := getDockerClient()
+	if err != nil {
+		return err
+	}
+
+	hostname := containerHostname(d.cfg, metaData)
+	cmd := containerCommand(userData)
+
 	config := &container.Config{
 		Hostname: hostname,
 		Image:    d.cfg.Image,
@@ -186,6 +220,28 @@ func (d *docker) createImage(bridge string, userData, metaData []byte) error {
 	}
 
 	hostConfig := &container.HostConfig{}
+	if len(d.cfg.Cores) > 0 {
+		cores := cpuListFlag(d.cfg.Cores)
+		hostConfig.CpusetCpus = cores.String()
+	}
+	if d.cfg.LimitSwap {
+		hostConfig.Memory = int64(d.cfg.Mem) << 20
+		hostConfig.MemorySwap = int64(d.cfg.Mem+d.cfg.SwapMax) << 20
+	}
+	if len(d.cfg.Volumes) > 0 {
+		err = d.createVolumes(cli)
+		if err != nil {
+			clog.Errorf("Unable to create volumes %v", err)
+			return err
+		}
+		hostConfig.Binds = d.volumeBinds()
+	}
+	err = d.applyIsolation(cli, hostConfig)
+	if err != nil {
+		clog.Errorf("Unable to apply isolation settings %v", err)
+		return err
+	}
+
 	networkConfig := &network.NetworkingConfig{}
 	if bridge != "" {
 		config.MacAddress = d.cfg.VnicMAC
@@ -194,30 +250,82 @@ func (d *docker) createImage(bridge string, userData, metaData []byte) error {
 			bridge: {
 				IPAMConfig: &network.EndpointIPAMConfig{
 					IPv4Address: d.cfg.VnicIP,
+					IPv6Address: d.cfg.VnicIPv6,
 				},
 			},
 		}
 	}
 
+	if d.cfg.Disk <= 0 {
+		d.cfg.Disk = dockerDefaultDiskMB
+	}
+	hostConfig.StorageOpt = rootfsQuota(d.cfg.rootfsLimitMB())
+
 	resp, err := cli.ContainerCreate(context.Background(), config, hostConfig, networkConfig,
 		d.cfg.Instance)
+	if err != nil && hostConfig.StorageOpt != nil && isQuotaUnsupported(err) {
+		disableRootfsQuota(err)
+		hostConfig.StorageOpt = nil
+		resp, err = cli.ContainerCreate(context.Background(), config, hostConfig,
+			networkConfig, d.cfg.Instance)
+	}
 	if err != nil {
-		glog.Errorf("Unable to create container %v", err)
+		clog.Errorf("Unable to create container %v", err)
+		d.removeVolumes(cli)
 		return err
 	}
 
 	idPath := path.Join(d.instanceDir, "docker-id")
 	err = ioutil.WriteFile(idPath, []byte(resp.ID), 0600)
 	if err != nil {
-		glog.Errorf("Unable to store docker container ID %v", err)
+		clog.Errorf("Unable to store docker container ID %v", err)
 		return err
 	}
 
 	d.dockerID = resp.ID
 
-	// This value is configurable.  Need to figure out how to get it from docker.
+	return nil
+}
+
+// applyIsolation translates the isolation settings from the START payload into
+// docker security options.  We use the ':' separator rather than '=' as this is
+// the only form understood by the version of docker that supports API 1.22.
+func (d *docker) applyIsolation(cli *client.Client, hostConfig *container.HostConfig) error {
+	if d.cfg.Seccomp == seccompUnconfined {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp:"+seccompUnconfined)
+	} else if d.cfg.Seccomp != "" {
+		profilePath := path.Join(seccompProfilesPath, d.cfg.Seccomp+".json")
+		profile, err := ioutil.ReadFile(profilePath)
+		if err != nil {
+			return fmt.Errorf("Unable to read seccomp profile %s: %v", profilePath, err)
+		}
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "seccomp:"+string(profile))
+	}
+
+	if d.cfg.AppArmor != "" {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "apparmor:"+d.cfg.AppArmor)
+	}
+
+	for _, label := range d.cfg.SELinux {
+		hostConfig.SecurityOpt = append(hostConfig.SecurityOpt, "label:"+label)
+	}
+
+	switch d.cfg.UsernsMode {
+	case usernsHost:
+		hostConfig.UsernsMode = container.UsernsMode(usernsHost)
+	case usernsRemap:
+		// There's no way to ask docker for a remapped user namespace on a
+		// per container basis.  All we can do is check that the daemon is
+		// remapping, in which case its root dir ends in /uid.gid.
 
-	d.cfg.Disk = 10000
+		info, err := cli.Info(context.Background())
+		if err != nil {
+			return err
+		}
+		if !dockerRemappedRootRegexp.MatchString(info.DockerRootDir) {
+			return fmt.Errorf("Docker daemon is not configured with userns-remap")
+		}
+	}
 
 	return nil
 }
@@ -237,10 +345,12 @@ func (d *docker) deleteImage() error {
 			ContainerID: d.dockerID,
 			Force:       true})
 	if err != nil {
-		glog.Warningf("Unable to delete docker instance %s:%s err %v",
+		clog.Warningf("Unable to delete docker instance %s:%s err %v",
 			d.cfg.Instance, d.dockerID, err)
 	}
 
+	d.removeVolumes(cli)
+
 	return err
 }
 
@@ -252,7 +362,7 @@ func (d *docker) startVM(vnicName, ipAddress string) error {
 
 	err = cli.ContainerStart(context.Background(), d.dockerID)
 	if err != nil {
-		glog.Errorf("Unable to start container %v", err)
+		clog.Errorf("Unable to start container %v", err)
 		return err
 	}
 	return nil
@@ -265,7 +375,7 @@ func dockerConnect(dockerChannel chan string, instance, dockerID string, closedC
 		if closedCh != nil {
 			close(closedCh)
 		}
-		glog.Infof("Monitor function for %s exitting", instance)
+		clog.Infof("Monitor function for %s exitting", instance)
 		wg.Done()
 	}()
 
@@ -278,12 +388,12 @@ func dockerConnect(dockerChannel chan string, instance, dockerID string, closedC
 
 	con, err := cli.ContainerInspect(context.Background(), dockerID)
 	if err != nil {
-		glog.Errorf("Unable to determine status of instance %s:%s: %v", instance, dockerID, err)
+		clog.Errorf("Unable to determine status of instance %s:%s: %v", instance, dockerID, err)
 		return
 	}
 
 	if !con.State.Running && !con.State.Paused && !con.State.Restarting {
-		glog.Infof("Docker Instance %s:%s is not running", instance, dockerID)
+		clog.Infof("Docker Instance %s:%s is not running", instance, dockerID)
 		return
 	}
 
@@ -297,7 +407,7 @@ func dockerConnect(dockerChannel chan string, instance, dockerID string, closedC
 			return
 		}
 		ret, err := cli.ContainerWait(ctx, dockerID)
-		glog.Infof("Instance %s:%s exitted with code %d err %v",
+		clog.Infof("Instance %s:%s exitted with code %d err %v",
 			instance, dockerID, ret, err)
 	}()
 
@@ -308,20 +418,20 @@ DONE:
 			break DONE
 		case cmd, ok := <-dockerChannel:
 			if !ok {
-				glog.Info("Cancelling Wait")
+				clog.Info("Cancelling Wait")
 				cancelFunc()
 				_ = <-lostContainerCh
 				break DONE
 			} else if cmd == virtualizerStopCmd {
 				err := cli.ContainerKill(context.Background(), dockerID, "KILL")
 				if err != nil {
-					glog.Errorf("Unable to stop instance %s:%s", instance, dockerID)
+					clog.Errorf("Unable to stop instance %s:%s", instance, dockerID)
 				}
 			}
 		}
 	}
 
-	glog.Infof("Docker Instance %s:%s shut down", instance, dockerID)
+	clog.Infof("Docker Instance %s:%s shut down", instance, dockerID)
 }
 
 func (d *docker) monitorVM(closedCh chan struct{}, connectedCh chan struct{},
@@ -332,10 +442,10 @@ func (d *docker) monitorVM(closedCh chan struct{}, connectedCh chan struct{},
 		data, err := ioutil.ReadFile(idPath)
 		if err != nil {
 			// We'll return an error later on in dockerConnect
-			glog.Errorf("Unable to read docker container ID %v", err)
+			clog.Errorf("Unable to read docker container ID %v", err)
 		} else {
 			d.dockerID = string(data)
-			glog.Infof("Instance UUID %s -> Docker UUID %s", d.cfg.Instance, d.dockerID)
+			clog.Infof("Instance UUID %s -> Docker UUID %s", d.cfg.Instance, d.dockerID)
 		}
 	}
 	dockerChannel := make(chan string)
@@ -344,6 +454,9 @@ func (d *docker) monitorVM(closedCh chan struct{}, connectedCh chan struct{},
 	return dockerChannel
 }
 
+// computeInstanceDiskspace returns the size of the writable layer of the
+// container.  The layers of its image are shared with the other containers
+// and the image cache, and are not accounted to the instance.
 func (d *docker) computeInstanceDiskspace() int {
 	if d.dockerID == "" {
 		return -1
@@ -356,16 +469,16 @@ func (d *docker) computeInstanceDiskspace() int {
 
 	con, _, err := cli.ContainerInspectWithRaw(context.Background(), d.dockerID, true)
 	if err != nil {
-		glog.Errorf("Unable to determine status of instance %s:%s: %v", d.cfg.Instance,
+		clog.Errorf("Unable to determine status of instance %s:%s: %v", d.cfg.Instance,
 			d.dockerID, err)
 		return -1
 	}
 
-	if con.SizeRootFs == nil {
+	if con.SizeRw == nil {
 		return -1
 	}
 
-	return int(*con.SizeRootFs / 1000000)
+	return int(*con.SizeRw / 1000000)
 }
 
 func (d *docker) stats() (disk, memory, cpu int) {
@@ -387,11 +500,8 @@ func (d *docker) stats() (disk, memory, cpu int) {
 	if d.prevCPUTime != -1 {
 		cpu = int((100 * (cpuTime - d.prevCPUTime) /
 			now.Sub(d.prevSampleTime).Nanoseconds()))
-		if d.cfg.Cpus > 1 {
-			cpu /= d.cfg.Cpus
-		}
-		// if glog.V(1) {
-		//     glog.Infof("cpu %d%%\n", cpu)
+		// if clog.V(1) {
+		//     clog.Infof("cpu %d%%\n", cpu)
 		// }
 	}
 	d.prevCPUTime = cpuTime
@@ -410,7 +520,7 @@ func (d *docker) connected() {
 
 		con, err := cli.ContainerInspect(context.Background(), d.dockerID)
 		if err != nil {
-			glog.Errorf("Unable to determine status of instance %s:%s: %v", d.cfg.Instance,
+			clog.Errorf("Unable to determine status of instance %s:%s: %v", d.cfg.Instance,
 				d.dockerID, err)
 			return
 		}
@@ -421,6 +531,230 @@ func (d *docker) connected() {
 	}
 }
 
+func (d *docker) readinessProbe() func() bool {
+	return nil
+}
+
+// logFollower follows the stdout and stderr of the container from the time
+// it is called.
+func (d *docker) logFollower() logFollower {
+	dockerID := d.dockerID
+	return func(emit func(source, line string), cancelCh <-chan struct{}) error {
+		cli, err := getDockerClient()
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-cancelCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		r, err := cli.ContainerLogs(ctx,
+			types.ContainerLogsOptions{
+				ContainerID: dockerID,
+				ShowStdout:  true,
+				ShowStderr:  true,
+				Since:       strconv.FormatInt(time.Now().Unix(), 10),
+				Follow:      true,
+			})
+		if err != nil {
+			return err
+		}
+		defer func() { _ = r.Close() }()
+
+		stdout := &lineWriter{emit: func(line string) { emit(logSourceStdout, line) }}
+		stderr := &lineWriter{emit: func(line string) { emit(logSourceStderr, line) }}
+		err = demuxDockerStreams(r, stdout, stderr)
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+}
+
+// healthProbe runs the command of the instance's health check inside the
+// container or, if there is none, reports the health docker determined by
+// running the HEALTHCHECK of the image.
+func (d *docker) healthProbe() func() healthReport {
+	dockerID := d.dockerID
+	_, timeout, retries := healthSettings(d.cfg.HealthCheck)
+	if d.cfg.HealthCheck != nil && len(d.cfg.HealthCheck.Command) > 0 {
+		cmd := d.cfg.HealthCheck.Command
+		return countFailures(retries, func() (bool, string) {
+			return dockerExecCheck(dockerID, cmd, timeout)
+		})
+	}
+
+	return func() healthReport {
+		return dockerHealth(dockerID, timeout)
+	}
+}
+
+// dockerExecCheck runs cmd inside the container dockerID, and returns true
+// if it exits with 0 within timeout, along with its output.
+func dockerExecCheck(dockerID string, cmd []string, timeout time.Duration) (bool, string) {
+	cli, err := getDockerClient()
+	if err != nil {
+		return false, err.Error()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	config := types.ExecConfig{
+		Container:    dockerID,
+		Cmd:          cmd,
+		Tty:          true,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	exec, err := cli.ContainerExecCreate(ctx, config)
+	if err != nil {
+		return false, err.Error()
+	}
+
+	resp, err := cli.ContainerExecAttach(ctx, exec.ID, config)
+	if err != nil {
+		return false, err.Error()
+	}
+	_ = resp.Conn.SetDeadline(time.Now().Add(timeout))
+	output, err := ioutil.ReadAll(io.LimitReader(resp.Reader, healthOutputMax))
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Reader)
+	}
+	resp.Close()
+	if err != nil {
+		return false, fmt.Sprintf("%s%v", output, err)
+	}
+
+	res, err := cli.ContainerExecInspect(ctx, exec.ID)
+	if err != nil {
+		return false, err.Error()
+	}
+	if res.Running {
+		return false, fmt.Sprintf("%sCheck timed out", output)
+	}
+
+	return res.ExitCode == 0, string(output)
+}
+
+// dockerHealth returns the health of the container dockerID, as determined
+// by docker.  The engine-api version we vendor predates health checks, so
+// the health is decoded from the raw inspect output.
+func dockerHealth(dockerID string, timeout time.Duration) healthReport {
+	cli, err := getDockerClient()
+	if err != nil {
+		return healthReport{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, raw, err := cli.ContainerInspectWithRaw(ctx, dockerID, false)
+	if err != nil {
+		clog.Warningf("Unable to inspect container %s: %v", dockerID, err)
+		return healthReport{}
+	}
+
+	return parseDockerHealth(raw)
+}
+
+func parseDockerHealth(raw []byte) healthReport {
+	var con struct {
+		State struct {
+			Health *struct {
+				Status        string
+				FailingStreak int
+				Log           []struct {
+					Output string
+				}
+			}
+		}
+	}
+
+	if err := json.Unmarshal(raw, &con); err != nil || con.State.Health == nil {
+		return healthReport{}
+	}
+
+	health := con.State.Health
+	report := healthReport{failingStreak: health.FailingStreak}
+	if n := len(health.Log); n > 0 {
+		report.output = health.Log[n-1].Output
+		if len(report.output) > healthOutputMax {
+			report.output = report.output[:healthOutputMax]
+		}
+	}
+
+	switch health.Status {
+	case "healthy":
+		report.status = healthHealthy
+	case "unhealthy":
+		report.status = healthUnhealthy
+	}
+
+	return report
+}
+
+func (d *docker) guestFilesystems() []payloads.GuestFilesystemStat {
+	return nil
+}
+
+func (d *docker) setBalloon(targetMB int) error {
+	return errBalloonNotSupported
+}
+
+func (d *docker) console() (string, error) {
+	return "", errConsoleNotSupported
+}
+
+func (d *docker) migrate(uri string) error {
+	return errMigrationNotSupported
+}
+
+// Containers have no memory of their own to dump, so memoryDump is ignored
+// and we only collect the container's logs.
+func (d *docker) diagnostics(memoryDump bool) func(dir string) error {
+	dockerID := d.dockerID
+	if dockerID == "" {
+		return nil
+	}
+
+	return func(dir string) error {
+		cli, err := getDockerClient()
+		if err != nil {
+			return err
+		}
+
+		r, err := cli.ContainerLogs(context.Background(),
+			types.ContainerLogsOptions{
+				ContainerID: dockerID,
+				ShowStdout:  true,
+				ShowStderr:  true,
+				Timestamps:  true,
+			})
+		if err != nil {
+			return err
+		}
+		defer func() { _ = r.Close() }()
+
+		f, err := os.Create(path.Join(dir, "container.log"))
+		if err != nil {
+			return err
+		}
+		err = demuxDockerLogs(r, f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+}
+
 func (d *docker) lostVM() {
 	d.pid = 0
 	d.prevCPUTime = -1
@@ -432,7 +766,7 @@ func dockerKillInstance(instanceDir string) {
 	idPath := path.Join(instanceDir, "docker-id")
 	data, err := ioutil.ReadFile(idPath)
 	if err != nil {
-		glog.Errorf("Unable to read docker container ID %v", err)
+		clog.Errorf("Unable to read docker container ID %v", err)
 		return
 	}
 
@@ -447,6 +781,6 @@ func dockerKillInstance(instanceDir string) {
 			ContainerID: dockerID,
 			Force:       true})
 	if err != nil {
-		glog.Warningf("Unable to delete docker instance %s err %v", dockerID, err)
+		clog.Warningf("Unable to delete docker instance %s err %v", dockerID, err)
 	}
 }
@@ -19,10 +19,10 @@ package main
 import (
 	"sync"
 
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/networking/libsnnet"
 	"github.com/docker/engine-api/types"
 	"github.com/docker/engine-api/types/network"
-	"github.com/golang/glog"
 	"golang.org/x/net/context"
 )
 
@@ -45,7 +45,7 @@ func createDockerVnic(vnicCfg *libsnnet.VnicConfig) (*libsnnet.Vnic, *libsnnet.S
 	state := dockerNetworkMap.networks[vnicCfg.SubnetID]
 	if state != nil {
 		dockerNetworkMap.Unlock()
-		glog.Info("Waiting for Docker network creation")
+		clog.Info("Waiting for Docker network creation")
 		<-state.done
 		if state.err != nil {
 			return nil, nil, nil, state.err
@@ -65,7 +65,7 @@ func createDockerVnic(vnicCfg *libsnnet.VnicConfig) (*libsnnet.Vnic, *libsnnet.S
 	}
 
 	if info == nil {
-		glog.Warning("VNIC information expected")
+		clog.Warning("VNIC information expected")
 		return vnic, event, info, err
 	}
 
@@ -84,7 +84,7 @@ func destroyDockerVnic(vnicCfg *libsnnet.VnicConfig) (*libsnnet.SsntpEventInfo,
 
 	event, info, err := cnNet.DestroyVnic(vnicCfg)
 	if err != nil {
-		glog.Errorf("cn.DestroyVnic failed %v", err)
+		clog.Errorf("cn.DestroyVnic failed %v", err)
 		return event, err
 	}
 
@@ -109,21 +109,32 @@ func createDockerNetwork(ctx context.Context, info *libsnnet.ContainerInfo) erro
 		return err
 	}
 
+	ipam := []network.IPAMConfig{{
+		Subnet:  info.Subnet.String(),
+		Gateway: info.Gateway.String(),
+	}}
+
+	// Dual-stack tenant networks get an IPv6 pool as well
+	if info.SubnetIPv6 != nil {
+		ipam = append(ipam, network.IPAMConfig{
+			Subnet:  info.SubnetIPv6.String(),
+			Gateway: info.GatewayIPv6.String(),
+		})
+	}
+
 	_, err = cli.NetworkCreate(ctx, types.NetworkCreate{
-		Name:   info.SubnetID,
-		Driver: "ciao",
+		Name:       info.SubnetID,
+		Driver:     "ciao",
+		EnableIPv6: info.SubnetIPv6 != nil,
 		IPAM: network.IPAM{
 			Driver: "ciao",
-			Config: []network.IPAMConfig{{
-				Subnet:  info.Subnet.String(),
-				Gateway: info.Gateway.String(),
-			}}},
+			Config: ipam},
 		Options: map[string]string{
 			"bridge": info.Bridge,
 		}})
 
 	if err != nil {
-		glog.Errorf("Unable to create docker network %s: %v", info.SubnetID, err)
+		clog.Errorf("Unable to create docker network %s: %v", info.SubnetID, err)
 	}
 
 	return err
@@ -137,7 +148,7 @@ func destroyDockerNetwork(ctx context.Context, bridge string) error {
 
 	err = cli.NetworkRemove(ctx, bridge)
 	if err != nil {
-		glog.Errorf("Unable to remove docker network %s: %v", bridge, err)
+		clog.Errorf("Unable to remove docker network %s: %v", bridge, err)
 	}
 
 	return err
@@ -151,16 +162,16 @@ func resetDockerNetworking() {
 
 	nets, err := cli.NetworkList(context.Background(), types.NetworkListOptions{})
 	if err != nil {
-		glog.Errorf("Unable to retrieve list of docker networks: %v", err)
+		clog.Errorf("Unable to retrieve list of docker networks: %v", err)
 		return
 	}
 
 	for i := range nets {
 		if nets[i].Driver == "ciao" {
-			glog.Infof("Deleting docker network %s", nets[i].Name)
+			clog.Infof("Deleting docker network %s", nets[i].Name)
 			err = cli.NetworkRemove(context.Background(), nets[i].ID)
 			if err != nil {
-				glog.Errorf("Unable to remove docker network %s: %v", nets[i].ID, err)
+				clog.Errorf("Unable to remove docker network %s: %v", nets[i].ID, err)
 			}
 		}
 	}
@@ -0,0 +1,97 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/01org/ciao/clog"
+)
+
+type drainFlag string
+
+const (
+	drainNone     drainFlag = "none"
+	drainShutdown drainFlag = "shutdown"
+)
+
+func (f *drainFlag) String() string {
+	return string(*f)
+}
+
+func (f *drainFlag) Set(val string) error {
+	if val != string(drainNone) && val != string(drainShutdown) {
+		return fmt.Errorf("none or shutdown expected")
+	}
+	*f = drainFlag(val)
+	return nil
+}
+
+const drainPollPeriod = time.Second
+
+// drainer tracks the progress of a drain.  It is owned by the server loop
+// which is the only go routine that is permitted to send commands to both the
+// overseer and to the instance go routines.
+type drainer struct {
+	ovsCh    chan<- interface{}
+	stopped  map[string]bool
+	deadline time.Time
+}
+
+func newDrainer(ovsCh chan<- interface{}) *drainer {
+	return &drainer{
+		ovsCh:    ovsCh,
+		stopped:  make(map[string]bool),
+		deadline: time.Now().Add(drainTimeout),
+	}
+}
+
+// poll asks the overseer which instances are still running, powers down any
+// it has not already asked to stop, and returns true once the drain has
+// completed or timed out.
+func (d *drainer) poll() bool {
+	targetCh := make(chan ovsDrainResult)
+	d.ovsCh <- &ovsDrainCmd{targetCh}
+	res := <-targetCh
+
+	if drainMode == drainNone {
+		return true
+	}
+
+	if len(res.running) == 0 && res.pending == 0 {
+		clog.Info("All instances have been shutdown")
+		return true
+	}
+
+	if time.Now().After(d.deadline) {
+		clog.Warningf("Drain timed out: %d instances running, %d pending",
+			len(res.running), res.pending)
+		return true
+	}
+
+	for instance, cmdCh := range res.running {
+		if d.stopped[instance] {
+			continue
+		}
+		clog.Infof("Draining: powering down %s", instance)
+		cmdCh <- &insStopCmd{}
+		d.stopped[instance] = true
+	}
+
+	return false
+}
@@ -0,0 +1,141 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/01org/ciao/clog"
+)
+
+const (
+	diskKeyFile     = "disk.key"
+	diskSecretID    = "disk0-secret"
+	maxDiskKeyBytes = 4096
+	keyFetchTimeout = time.Second * 30
+)
+
+// keyRuntimeDir holds the temporary copies of keys fetched from a KMS.  It
+// should be on a tmpfs so that the keys never hit the disk.
+var keyRuntimeDir = "/run/ciao/keys"
+
+func fetchDiskKey(url string) ([]byte, error) {
+	client := &http.Client{Timeout: keyFetchTimeout}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to retrieve key from %s: %s", url, resp.Status)
+	}
+
+	key, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDiskKeyBytes+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(key) == 0 || len(key) > maxDiskKeyBytes {
+		return nil, fmt.Errorf("Invalid key retrieved from %s", url)
+	}
+
+	return key, nil
+}
+
+// saveDiskKey stores a key delivered in the START payload in the instance
+// directory, so that the instance can be rebooted after the node restarts.
+func saveDiskKey(instanceDir string, key []byte) error {
+	return ioutil.WriteFile(path.Join(instanceDir, diskKeyFile), key, 0600)
+}
+
+// prepareDiskSecret returns the path of a file containing the key for the
+// rootfs of an encrypted instance, suitable for passing to qemu or qemu-img
+// as a secret object, together with a function that must be called once the
+// file is no longer needed.  Keys retrieved from a KMS are written to a
+// temporary file that is wiped by this function.
+func prepareDiskSecret(instanceDir string, cfg *vmConfig) (string, func(), error) {
+	if cfg.KeyURL == "" {
+		return path.Join(instanceDir, diskKeyFile), func() {}, nil
+	}
+
+	key, err := fetchDiskKey(cfg.KeyURL)
+	if err != nil {
+		clog.Errorf("Unable to retrieve disk key for %s: %v", cfg.Instance, err)
+		return "", nil, err
+	}
+
+	err = os.MkdirAll(keyRuntimeDir, 0700)
+	if err != nil {
+		return "", nil, err
+	}
+
+	f, err := ioutil.TempFile(keyRuntimeDir, cfg.Instance)
+	if err != nil {
+		return "", nil, err
+	}
+	keyPath := f.Name()
+	_, err = f.Write(key)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = wipeFile(keyPath)
+		return "", nil, err
+	}
+
+	return keyPath, func() {
+		if err := wipeFile(keyPath); err != nil {
+			clog.Warningf("Unable to wipe %s: %v", keyPath, err)
+		}
+	}, nil
+}
+
+func diskSecretParam(keyPath string) string {
+	return fmt.Sprintf("secret,id=%s,file=%s", diskSecretID, keyPath)
+}
+
+// wipeFile overwrites the contents of a file with zeros before removing it.
+// It is not an error for the file not to exist.
+func wipeFile(filePath string) error {
+	f, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err == nil {
+		_, err = f.Write(make([]byte, fi.Size()))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(filePath)
+}
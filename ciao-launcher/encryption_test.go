@@ -0,0 +1,124 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/01org/ciao/payloads"
+)
+
+func TestWipeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-wipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	keyPath := path.Join(dir, diskKeyFile)
+	err = saveDiskKey(dir, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Unable to save key: %v", err)
+	}
+
+	err = wipeFile(keyPath)
+	if err != nil {
+		t.Fatalf("Unable to wipe key: %v", err)
+	}
+
+	if _, err = os.Stat(keyPath); !os.IsNotExist(err) {
+		t.Errorf("Key file still exists")
+	}
+
+	if err = wipeFile(keyPath); err != nil {
+		t.Errorf("Wiping a non-existent file should succeed: %v", err)
+	}
+}
+
+func TestPrepareDiskSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	savedRuntimeDir := keyRuntimeDir
+	keyRuntimeDir = path.Join(dir, "run")
+	defer func() { keyRuntimeDir = savedRuntimeDir }()
+
+	cfg := &vmConfig{Instance: "67d86208-b46c-4465-9018-fe14087d415f", Encrypted: true}
+	keyPath, cleanup, err := prepareDiskSecret(dir, cfg)
+	if err != nil {
+		t.Fatalf("Unable to prepare secret: %v", err)
+	}
+	cleanup()
+	if keyPath != path.Join(dir, diskKeyFile) {
+		t.Errorf("Inline keys should be read from the instance directory")
+	}
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("kms-secret"))
+	}))
+	defer ts.Close()
+
+	cfg.KeyURL = ts.URL
+	keyPath, cleanup, err = prepareDiskSecret(dir, cfg)
+	if err != nil {
+		t.Fatalf("Unable to prepare secret: %v", err)
+	}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil || !bytes.Equal(key, []byte("kms-secret")) {
+		t.Errorf("Unexpected key %q: %v", key, err)
+	}
+
+	cleanup()
+	if _, err = os.Stat(keyPath); !os.IsNotExist(err) {
+		t.Errorf("Temporary key file was not wiped")
+	}
+}
+
+func TestCheckEncryption(t *testing.T) {
+	valid := []payloads.DiskEncryption{
+		{Key: "c2VjcmV0"},
+		{KeyURL: "https://kms.example.com/keys/1"},
+	}
+	for _, enc := range valid {
+		if _, err := checkEncryption(&enc); err != nil {
+			t.Errorf("Unexpected error for %v: %v", enc, err)
+		}
+	}
+
+	invalid := []payloads.DiskEncryption{
+		{},
+		{Key: "c2VjcmV0", KeyURL: "https://kms.example.com/keys/1"},
+		{Key: "not base64!"},
+		{KeyURL: "http://kms.example.com/keys/1"},
+		{KeyURL: "https://"},
+	}
+	for _, enc := range invalid {
+		if _, err := checkEncryption(&enc); err == nil {
+			t.Errorf("Expected error for %v", enc)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+// The security group rules of an instance are enforced by nftables on the
+// host side of the instance's vnic.  Each vnic gets its own table in the
+// bridge family, whose forward chain sends the traffic bridged to the vnic,
+// i.e., received by the instance, to an ingress chain and the traffic
+// bridged from the vnic to an egress chain.  The table is replaced
+// atomically each time new rules are applied.
+//
+// The rules are saved in the instance directory so that they are applied
+// again, before the instance is started, when the instance is restarted.
+
+const securityGroupState = "security_group"
+
+type insSecurityGroupCmd struct {
+	Version uint64
+	Rules   []payloads.SecurityRule
+}
+
+// Traffic always allowed through the vnic so that the instance can resolve
+// addresses and get its configuration from DHCP and router advertisements.
+var (
+	ingressInfraRules = []string{
+		"ether type arp accept",
+		"icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-advert } accept",
+		"udp sport 67 udp dport 68 accept",
+	}
+	egressInfraRules = []string{
+		"ether type arp accept",
+		"icmpv6 type { nd-neighbor-solicit, nd-neighbor-advert, nd-router-solicit } accept",
+		"udp sport 68 udp dport 67 accept",
+	}
+)
+
+// nftTable returns the name of the nftables table filtering the traffic of
+// vnic.  nftables identifiers cannot contain dashes.
+func nftTable(vnic string) string {
+	return "ciao_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, vnic)
+}
+
+// ruleStatement returns the nftables statement accepting the traffic
+// matched by rule.
+func ruleStatement(rule payloads.SecurityRule) string {
+	var match []string
+
+	if rule.RemoteCIDR != "" {
+		if _, subnet, err := net.ParseCIDR(rule.RemoteCIDR); err == nil {
+			family := "ip"
+			if subnet.IP.To4() == nil {
+				family = "ip6"
+			}
+			dir := "saddr"
+			if rule.Direction == payloads.EgressRule {
+				dir = "daddr"
+			}
+			match = append(match, fmt.Sprintf("%s %s %s", family, dir, subnet))
+		}
+	}
+
+	switch rule.Protocol {
+	case payloads.TCPProtocol, payloads.UDPProtocol:
+		if rule.PortMin == 0 {
+			match = append(match, "meta l4proto "+string(rule.Protocol))
+			break
+		}
+		ports := strconv.Itoa(rule.PortMin)
+		if rule.PortMax > rule.PortMin {
+			ports += "-" + strconv.Itoa(rule.PortMax)
+		}
+		match = append(match, string(rule.Protocol)+" dport "+ports)
+	case payloads.ICMPProtocol:
+		match = append(match, "meta l4proto icmp")
+	case payloads.ICMPv6Protocol:
+		match = append(match, "meta l4proto ipv6-icmp")
+	}
+
+	return strings.Join(append(match, "accept"), " ")
+}
+
+// securityGroupRuleset returns the nftables script replacing the table
+// filtering the traffic of vnic with one enforcing sg.  The traffic received
+// by the instance is dropped unless a rule allows it.  The traffic it sends
+// is only filtered if sg has egress rules.
+func securityGroupRuleset(vnic string, sg *insSecurityGroupCmd) string {
+	var ingress, egress []string
+	for _, rule := range sg.Rules {
+		if rule.Direction == payloads.EgressRule {
+			egress = append(egress, ruleStatement(rule))
+		} else {
+			ingress = append(ingress, ruleStatement(rule))
+		}
+	}
+
+	var b bytes.Buffer
+	table := "bridge " + nftTable(vnic)
+
+	// Declaring the table first creates it if needed, so that it can
+	// always be deleted.
+	fmt.Fprintf(&b, "table %s\n", table)
+	fmt.Fprintf(&b, "delete table %s\n", table)
+	fmt.Fprintf(&b, "table %s {\n", table)
+	fmt.Fprintf(&b, "\tchain forward {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook forward priority 0; policy accept;\n")
+	fmt.Fprintf(&b, "\t\toifname %q jump ingress\n", vnic)
+	if len(egress) > 0 {
+		fmt.Fprintf(&b, "\t\tiifname %q jump egress\n", vnic)
+	}
+	fmt.Fprintf(&b, "\t}\n")
+
+	chain := func(name string, infra, rules []string) {
+		fmt.Fprintf(&b, "\tchain %s {\n", name)
+		fmt.Fprintf(&b, "\t\tct state established,related accept\n")
+		for _, s := range append(infra, rules...) {
+			fmt.Fprintf(&b, "\t\t%s\n", s)
+		}
+		fmt.Fprintf(&b, "\t\tdrop\n")
+		fmt.Fprintf(&b, "\t}\n")
+	}
+
+	chain("ingress", ingressInfraRules, ingress)
+	if len(egress) > 0 {
+		chain("egress", egressInfraRules, egress)
+	}
+	fmt.Fprintf(&b, "}\n")
+
+	return b.String()
+}
+
+func runNFT(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// applySecurityGroup filters the traffic of vnic according to sg, replacing
+// any rules previously applied to it.
+func applySecurityGroup(vnic string, sg *insSecurityGroupCmd) error {
+	if err := runNFT(securityGroupRuleset(vnic, sg)); err != nil {
+		clog.Errorf("Unable to apply security group to vnic %s: %v", vnic, err)
+		return err
+	}
+
+	clog.Infof("Applied security group version %d to vnic %s: %d rules", sg.Version,
+		vnic, len(sg.Rules))
+
+	return nil
+}
+
+// removeSecurityGroup stops filtering the traffic of vnic.
+func removeSecurityGroup(vnic string) {
+	table := "bridge " + nftTable(vnic)
+	err := runNFT(fmt.Sprintf("table %s\ndelete table %s\n", table, table))
+	if err != nil {
+		clog.Warningf("Unable to remove security group of vnic %s: %v", vnic, err)
+	}
+}
+
+func saveSecurityGroup(instanceDir string, sg *insSecurityGroupCmd) error {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(sg); err != nil {
+		return err
+	}
+
+	tmp := path.Join(instanceDir, securityGroupState+".new")
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b.Bytes())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path.Join(instanceDir, securityGroupState))
+}
+
+// loadSecurityGroup returns the security group rules saved in instanceDir,
+// or nil if no rules were ever applied to the instance.
+func loadSecurityGroup(instanceDir string) *insSecurityGroupCmd {
+	f, err := os.Open(path.Join(instanceDir, securityGroupState))
+	if err != nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+
+	sg := &insSecurityGroupCmd{}
+	if err := gob.NewDecoder(f).Decode(sg); err != nil {
+		clog.Warningf("Unable to retrieve security group of %s: %v", instanceDir, err)
+		return nil
+	}
+
+	return sg
+}
+
+// applySavedSecurityGroup applies the security group rules saved in
+// instanceDir, if any, to vnic.
+func applySavedSecurityGroup(instanceDir, vnic string) error {
+	sg := loadSecurityGroup(instanceDir)
+	if sg == nil {
+		return nil
+	}
+
+	return applySecurityGroup(vnic, sg)
+}
+
+// securityGroupCommand applies new security group rules to the instance's
+// vnic, or keeps them until the vnic is created if the instance is waiting
+// to be launched.  Rules older than the current ones are ignored, as they
+// may have been delayed on their way from the controller.
+func (id *instanceData) securityGroupCommand(cmd *insSecurityGroupCmd) {
+	if !networking.Enabled() {
+		clog.Warningf("Ignoring security group of instance %s: networking is disabled", id.instance)
+		return
+	}
+
+	if id.securityGroup != nil && cmd.Version <= id.securityGroup.Version {
+		clog.Infof("Ignoring security group version %d of instance %s, version %d applied",
+			cmd.Version, id.instance, id.securityGroup.Version)
+		return
+	}
+
+	prev := id.securityGroup
+	id.securityGroup = cmd
+	if id.cfg.VnicName == "" {
+		clog.Infof("Instance %s has no vnic yet, delaying its security group", id.instance)
+		return
+	}
+
+	if err := id.applySecurityGroup(); err != nil {
+		id.securityGroup = prev
+	}
+}
+
+// applySecurityGroup applies the current security group rules of the
+// instance to its vnic and saves them.
+func (id *instanceData) applySecurityGroup() error {
+	if err := applySecurityGroup(id.cfg.VnicName, id.securityGroup); err != nil {
+		return err
+	}
+
+	if err := saveSecurityGroup(id.instanceDir, id.securityGroup); err != nil {
+		clog.Warningf("Unable to save security group of instance %s: %v", id.instance, err)
+	}
+
+	id.ovsCh <- &ovsSecurityGroupCmd{id.instance, id.securityGroup.Version}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/01org/ciao/payloads"
+)
+
+func TestRuleStatement(t *testing.T) {
+	tests := []struct {
+		rule      payloads.SecurityRule
+		statement string
+	}{
+		{payloads.SecurityRule{Direction: payloads.IngressRule}, "accept"},
+		{payloads.SecurityRule{Direction: payloads.IngressRule, Protocol: payloads.TCPProtocol, PortMin: 22},
+			"tcp dport 22 accept"},
+		{payloads.SecurityRule{Direction: payloads.IngressRule, Protocol: payloads.UDPProtocol,
+			PortMin: 5000, PortMax: 5010, RemoteCIDR: "10.1.2.3/16"},
+			"ip saddr 10.1.0.0/16 udp dport 5000-5010 accept"},
+		{payloads.SecurityRule{Direction: payloads.EgressRule, Protocol: payloads.TCPProtocol,
+			RemoteCIDR: "fd00::/64"},
+			"ip6 daddr fd00::/64 meta l4proto tcp accept"},
+		{payloads.SecurityRule{Direction: payloads.IngressRule, Protocol: payloads.ICMPv6Protocol},
+			"meta l4proto ipv6-icmp accept"},
+	}
+
+	for _, test := range tests {
+		if s := ruleStatement(test.rule); s != test.statement {
+			t.Errorf("Wrong statement for %+v: %q, expected %q", test.rule, s, test.statement)
+		}
+	}
+}
+
+func TestSecurityGroupRuleset(t *testing.T) {
+	sg := &insSecurityGroupCmd{
+		Version: 1,
+		Rules: []payloads.SecurityRule{
+			{Direction: payloads.IngressRule, Protocol: payloads.TCPProtocol, PortMin: 22},
+		},
+	}
+
+	ruleset := securityGroupRuleset("ciao-tap0", sg)
+	for _, s := range []string{
+		"table bridge ciao_ciao_tap0\ndelete table bridge ciao_ciao_tap0\n",
+		"oifname \"ciao-tap0\" jump ingress",
+		"tcp dport 22 accept\n\t\tdrop\n",
+	} {
+		if !strings.Contains(ruleset, s) {
+			t.Errorf("%q missing from ruleset:\n%s", s, ruleset)
+		}
+	}
+	if strings.Contains(ruleset, "egress") {
+		t.Errorf("Egress traffic filtered without egress rules:\n%s", ruleset)
+	}
+
+	sg.Rules = append(sg.Rules, payloads.SecurityRule{Direction: payloads.EgressRule,
+		Protocol: payloads.UDPProtocol, PortMin: 53})
+	ruleset = securityGroupRuleset("ciao-tap0", sg)
+	for _, s := range []string{
+		"iifname \"ciao-tap0\" jump egress",
+		"chain egress {",
+		"udp dport 53 accept\n\t\tdrop\n",
+	} {
+		if !strings.Contains(ruleset, s) {
+			t.Errorf("%q missing from ruleset:\n%s", s, ruleset)
+		}
+	}
+}
+
+func TestSaveSecurityGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-firewall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	if sg := loadSecurityGroup(dir); sg != nil {
+		t.Errorf("Security group loaded from empty directory: %+v", sg)
+	}
+
+	sg := &insSecurityGroupCmd{
+		Version: 7,
+		Rules: []payloads.SecurityRule{
+			{Direction: payloads.EgressRule, RemoteCIDR: "192.168.0.0/24"},
+		},
+	}
+	if err := saveSecurityGroup(dir, sg); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded := loadSecurityGroup(dir); !reflect.DeepEqual(loaded, sg) {
+		t.Errorf("Wrong security group loaded %+v, expected %+v", loaded, sg)
+	}
+}
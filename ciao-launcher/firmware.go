@@ -0,0 +1,157 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+const (
+	qemuSecureBootCode = "/usr/share/qemu/OVMF_CODE.secboot.fd"
+	qemuSecureBootVars = "/usr/share/qemu/OVMF_VARS.secboot.fd"
+	efiVarsFile        = "efivars.fd"
+	tpmStateDir        = "tpm"
+	swtpmSocket        = "swtpm.sock"
+	swtpmPidFile       = "swtpm.pid"
+	swtpmLog           = "swtpm.log"
+	swtpmTimeout       = 5 * time.Second
+)
+
+// createEFIVars gives a secure boot instance its own copy of the EFI
+// variable store template, which contains the enrolled secure boot keys.
+// The copy is kept for the lifetime of the instance as the guest is free to
+// modify its variables.
+func createEFIVars(instanceDir string) error {
+	src, err := os.Open(qemuSecureBootVars)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	dst, err := os.OpenFile(path.Join(instanceDir, efiVarsFile),
+		os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// firmwareParams returns the qemu parameters needed to boot an instance with
+// the firmware requested in its START payload.  Secure boot requires the q35
+// machine type with SMM enabled so that the guest cannot tamper with the
+// variable store.
+func firmwareParams(instanceDir string, cfg *vmConfig) []string {
+	if cfg.Legacy {
+		return nil
+	}
+
+	if cfg.Firmware != payloads.SecureBoot {
+		return []string{"-bios", qemuEfiFw}
+	}
+
+	return []string{
+		"-machine", "q35,smm=on",
+		"-global", "driver=cfi.pflash01,property=secure,value=on",
+		"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=" + qemuSecureBootCode,
+		"-drive", "if=pflash,format=raw,unit=1,file=" + path.Join(instanceDir, efiVarsFile),
+	}
+}
+
+func tpmParams(instanceDir string) []string {
+	return []string{
+		"-chardev", "socket,id=chrtpm,path=" + path.Join(instanceDir, swtpmSocket),
+		"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+		"-device", "tpm-tis,tpmdev=tpm0",
+	}
+}
+
+// startSwtpm launches the swtpm process that emulates the TPM of an instance.
+// The TPM's state is stored in the instance directory so that it survives
+// reboots of the instance.  swtpm is started with --terminate so that it
+// exits when qemu closes its connection.
+func startSwtpm(instanceDir string) error {
+	stateDir := path.Join(instanceDir, tpmStateDir)
+	err := os.MkdirAll(stateDir, 0700)
+	if err != nil {
+		return err
+	}
+
+	socketPath := path.Join(instanceDir, swtpmSocket)
+	_ = os.Remove(socketPath)
+
+	params := []string{"socket", "--tpm2",
+		"--tpmstate", "dir=" + stateDir,
+		"--ctrl", "type=unixio,path=" + socketPath,
+		"--log", "file=" + path.Join(instanceDir, swtpmLog),
+		"--pid", "file=" + path.Join(instanceDir, swtpmPidFile),
+		"--terminate", "--daemon"}
+
+	out, err := exec.Command("swtpm", params...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to start swtpm: %v: %s", err,
+			strings.TrimSpace(string(out)))
+	}
+
+	deadline := time.Now().Add(swtpmTimeout)
+	for {
+		if _, err = os.Stat(socketPath); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			stopSwtpm(instanceDir)
+			return fmt.Errorf("swtpm did not create %s", socketPath)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// stopSwtpm kills an instance's swtpm process.  It is only needed when qemu
+// fails to launch, as swtpm otherwise exits along with qemu.
+func stopSwtpm(instanceDir string) {
+	pidPath := path.Join(instanceDir, swtpmPidFile)
+	data, err := ioutil.ReadFile(pidPath)
+	if err != nil {
+		return
+	}
+	_ = os.Remove(pidPath)
+
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return
+	}
+
+	if err = syscall.Kill(pid, syscall.SIGTERM); err != nil && err != syscall.ESRCH {
+		clog.Warningf("Unable to kill swtpm %d: %v", pid, err)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/01org/ciao/payloads"
+)
+
+func TestFirmwareParams(t *testing.T) {
+	instanceDir := "/var/lib/ciao/instances/67d86208-b46c-4465-9018-fe14087d415f"
+
+	if params := firmwareParams(instanceDir, &vmConfig{Legacy: true}); len(params) != 0 {
+		t.Errorf("No firmware parameters expected for legacy instances, got %v", params)
+	}
+
+	params := firmwareParams(instanceDir, &vmConfig{Firmware: string(payloads.EFI)})
+	if !reflect.DeepEqual(params, []string{"-bios", qemuEfiFw}) {
+		t.Errorf("Unexpected EFI parameters %v", params)
+	}
+
+	params = firmwareParams(instanceDir, &vmConfig{})
+	if !reflect.DeepEqual(params, []string{"-bios", qemuEfiFw}) {
+		t.Errorf("EFI expected by default, got %v", params)
+	}
+
+	params = firmwareParams(instanceDir, &vmConfig{Firmware: payloads.SecureBoot})
+	expected := []string{
+		"-machine", "q35,smm=on",
+		"-global", "driver=cfi.pflash01,property=secure,value=on",
+		"-drive", "if=pflash,format=raw,unit=0,readonly=on,file=" + qemuSecureBootCode,
+		"-drive", "if=pflash,format=raw,unit=1,file=" + instanceDir + "/" + efiVarsFile,
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("Unexpected secure boot parameters %v", params)
+	}
+}
+
+func TestTPMParams(t *testing.T) {
+	params := tpmParams("/tmp/instance")
+	expected := []string{
+		"-chardev", "socket,id=chrtpm,path=/tmp/instance/" + swtpmSocket,
+		"-tpmdev", "emulator,id=tpm0,chardev=chrtpm",
+		"-device", "tpm-tis,tpmdev=tpm0",
+	}
+	if !reflect.DeepEqual(params, expected) {
+		t.Errorf("Unexpected TPM parameters %v", params)
+	}
+}
@@ -0,0 +1,234 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+const (
+	defaultHealthInterval = 30 * time.Second
+	defaultHealthTimeout  = 10 * time.Second
+	defaultHealthRetries  = 3
+
+	// healthOutputMax is the maximum number of bytes of the output of a
+	// failed check reported in InstanceUnhealthy events.
+	healthOutputMax = 256
+)
+
+type healthStatus int
+
+const (
+	// healthStarting indicates that the health of the instance is not
+	// known yet, e.g., because its image has no HEALTHCHECK or because
+	// docker has not run it yet.
+	healthStarting healthStatus = iota
+	healthHealthy
+	healthUnhealthy
+)
+
+// healthReport is the result of a health probe.  failingStreak is the number
+// of consecutive checks that failed and output the output of the last one.
+type healthReport struct {
+	status        healthStatus
+	failingStreak int
+	output        string
+}
+
+// ovsHealthChange tells the overseer that a running instance became
+// unhealthy, or healthy again.
+type ovsHealthChange struct {
+	instance  string
+	unhealthy bool
+}
+
+// healthSettings returns the interval between two checks, the time after
+// which a check fails and the number of consecutive failed checks after which
+// an instance is unhealthy, given the health check of its START payload.
+func healthSettings(hc *payloads.HealthCheck) (interval, timeout time.Duration, retries int) {
+	interval, timeout, retries = defaultHealthInterval, defaultHealthTimeout, defaultHealthRetries
+	if hc == nil {
+		return
+	}
+
+	if hc.IntervalS > 0 {
+		interval = time.Duration(hc.IntervalS) * time.Second
+	}
+	if hc.TimeoutS > 0 {
+		timeout = time.Duration(hc.TimeoutS) * time.Second
+	}
+	if hc.Retries > 0 {
+		retries = hc.Retries
+	}
+	return
+}
+
+// countFailures turns check, which reports whether a single check passed,
+// into a health probe, which reports an instance as unhealthy once retries
+// checks failed in a row.  The probe must not be called concurrently.
+func countFailures(retries int, check func() (bool, string)) func() healthReport {
+	streak := 0
+	return func() healthReport {
+		passed, output := check()
+		if len(output) > healthOutputMax {
+			output = output[:healthOutputMax]
+		}
+		if passed {
+			streak = 0
+			return healthReport{status: healthHealthy, output: output}
+		}
+
+		streak++
+		status := healthHealthy
+		if streak >= retries {
+			status = healthUnhealthy
+		}
+		return healthReport{status, streak, output}
+	}
+}
+
+// monitorHealth calls probe every interval until cancelCh is closed, and
+// sends its result to reportCh each time the instance goes from healthy to
+// unhealthy, or back.  Instances start healthy.
+func monitorHealth(instance string, probe func() healthReport, interval time.Duration,
+	reportCh chan<- healthReport, cancelCh <-chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		unhealthy := false
+		for {
+			select {
+			case <-cancelCh:
+				return
+			case <-time.After(interval):
+			}
+
+			report := probe()
+			if report.status == healthStarting ||
+				(report.status == healthUnhealthy) == unhealthy {
+				continue
+			}
+
+			unhealthy = !unhealthy
+			if unhealthy {
+				clog.Warningf("Instance %s is unhealthy after %d failed checks",
+					instance, report.failingStreak)
+			} else {
+				clog.Infof("Instance %s is healthy again", instance)
+			}
+
+			select {
+			case reportCh <- report:
+			case <-cancelCh:
+				return
+			}
+		}
+	}()
+}
+
+// reportedState returns the state of an instance reported to a peer agreeing
+// on version, as peers predating the unhealthy state only know of running
+// instances.
+func reportedState(state string, version payloads.Version) string {
+	if state == payloads.Unhealthy && version < payloads.Version33 {
+		return payloads.Running
+	}
+	return state
+}
+
+// sendInstanceUnhealthyEvent lets the controller owning instance know that
+// its health check is failing.  Peers that predate the InstanceUnhealthy
+// event do not get it.
+func sendInstanceUnhealthyEvent(conn *ssntpConn, instance string, report *healthReport,
+	restarting bool) {
+	if !conn.isConnected() || conn.PayloadVersion() < payloads.Version33 {
+		return
+	}
+
+	event := payloads.EventInstanceUnhealthy{
+		InstanceUnhealthy: payloads.InstanceUnhealthyEvent{
+			InstanceUUID:  instance,
+			FailingStreak: report.failingStreak,
+			Output:        report.output,
+			Restarting:    restarting,
+		},
+	}
+
+	payload, err := payloads.MarshalVersion(conn.Encoding(), &event, conn.PayloadVersion())
+	if err != nil {
+		clog.Errorf("Unable to Marshall InstanceUnhealthy %v", err)
+		return
+	}
+
+	_, err = conn.SendEvent(ssntp.InstanceUnhealthy, payload)
+	if err != nil {
+		clog.Errorf("Failed to send InstanceUnhealthy event %v", err)
+	}
+}
+
+func (id *instanceData) cancelHealthMonitor() {
+	if id.healthCancelCh != nil {
+		close(id.healthCancelCh)
+		id.healthCancelCh = nil
+	}
+	id.healthCh = nil
+}
+
+// startHealthMonitor starts checking the health of a ready instance, if its
+// virtualizer can.
+func (id *instanceData) startHealthMonitor() {
+	probe := id.vm.healthProbe()
+	if probe == nil {
+		return
+	}
+
+	interval, _, _ := healthSettings(id.cfg.HealthCheck)
+	id.healthCh = make(chan healthReport)
+	id.healthCancelCh = make(chan struct{})
+	monitorHealth(id.instance, probe, interval, id.healthCh, id.healthCancelCh,
+		&id.instanceWg)
+}
+
+// healthChanged reports the new health of the instance and, if it is
+// unhealthy and its restart policy asks for it, stops it so that it is
+// restarted once it has exited.
+func (id *instanceData) healthChanged(report *healthReport) {
+	unhealthy := report.status == healthUnhealthy
+	id.ovsCh <- &ovsHealthChange{id.instance, unhealthy}
+	if !unhealthy {
+		return
+	}
+
+	restart := id.cfg.RestartPolicy == payloads.RestartUnhealthy &&
+		id.monitorCh != nil && !id.shuttingDown
+	sendInstanceUnhealthyEvent(&id.ac.ssntpConn, id.instance, report, restart)
+	if !restart {
+		return
+	}
+
+	clog.Infof("Restarting unhealthy instance %s", id.instance)
+	id.cancelHealthMonitor()
+	id.restartPending = true
+	id.stopRequested = true
+	id.monitorCh <- virtualizerStopCmd
+}
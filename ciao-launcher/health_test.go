@@ -0,0 +1,133 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+)
+
+func TestCountFailures(t *testing.T) {
+	results := []bool{false, false, true, false, false, false, false}
+	expected := []struct {
+		status healthStatus
+		streak int
+	}{
+		{healthHealthy, 1},
+		{healthHealthy, 2},
+		{healthHealthy, 0},
+		{healthHealthy, 1},
+		{healthHealthy, 2},
+		{healthUnhealthy, 3},
+		{healthUnhealthy, 4},
+	}
+
+	i := 0
+	probe := countFailures(3, func() (bool, string) {
+		passed := results[i]
+		i++
+		return passed, "output"
+	})
+
+	for j, e := range expected {
+		report := probe()
+		if report.status != e.status || report.failingStreak != e.streak {
+			t.Errorf("Check %d: got status %d streak %d, expected %d %d", j,
+				report.status, report.failingStreak, e.status, e.streak)
+		}
+	}
+}
+
+func TestMonitorHealth(t *testing.T) {
+	statuses := []healthStatus{healthStarting, healthHealthy, healthUnhealthy,
+		healthUnhealthy, healthStarting, healthHealthy}
+	var mu sync.Mutex
+	probe := func() healthReport {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(statuses) == 0 {
+			return healthReport{status: healthHealthy}
+		}
+		status := statuses[0]
+		statuses = statuses[1:]
+		return healthReport{status: status}
+	}
+
+	var wg sync.WaitGroup
+	reportCh := make(chan healthReport)
+	cancelCh := make(chan struct{})
+	monitorHealth("instance", probe, time.Millisecond, reportCh, cancelCh, &wg)
+
+	for _, expected := range []healthStatus{healthUnhealthy, healthHealthy} {
+		select {
+		case report := <-reportCh:
+			if report.status != expected {
+				t.Errorf("Got status %d, expected %d", report.status, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Health change not reported")
+		}
+	}
+
+	select {
+	case report := <-reportCh:
+		t.Errorf("Unexpected health report %+v", report)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(cancelCh)
+	wg.Wait()
+}
+
+func TestParseDockerHealth(t *testing.T) {
+	tests := []struct {
+		raw    string
+		status healthStatus
+		streak int
+		output string
+	}{
+		{`{"State":{"Running":true}}`, healthStarting, 0, ""},
+		{`{"State":{"Health":{"Status":"starting"}}}`, healthStarting, 0, ""},
+		{`{"State":{"Health":{"Status":"healthy","FailingStreak":0,"Log":[{"Output":"ok"}]}}}`,
+			healthHealthy, 0, "ok"},
+		{`{"State":{"Health":{"Status":"unhealthy","FailingStreak":4,"Log":[{"Output":"a"},{"Output":"b"}]}}}`,
+			healthUnhealthy, 4, "b"},
+	}
+
+	for _, tt := range tests {
+		report := parseDockerHealth([]byte(tt.raw))
+		if report.status != tt.status || report.failingStreak != tt.streak ||
+			report.output != tt.output {
+			t.Errorf("%s parsed as %+v", tt.raw, report)
+		}
+	}
+}
+
+func TestReportedState(t *testing.T) {
+	if s := reportedState(payloads.Unhealthy, payloads.Version32); s != payloads.Running {
+		t.Errorf("Unhealthy reported as %s to a version 32 peer", s)
+	}
+	if s := reportedState(payloads.Unhealthy, payloads.Version33); s != payloads.Unhealthy {
+		t.Errorf("Unhealthy reported as %s to a version 33 peer", s)
+	}
+	if s := reportedState(payloads.Exited, payloads.Version32); s != payloads.Exited {
+		t.Errorf("Exited reported as %s to a version 32 peer", s)
+	}
+}
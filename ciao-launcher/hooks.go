@@ -0,0 +1,162 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+// Lifecycle hooks are executables run on the host at various points in the
+// life of an instance.  Node hooks live in the directory specified by the
+// -hooks-dir option and are run for every instance.  Instance hooks are
+// delivered in the START payload and stored in the instance's directory.
+// As they are run as root on the host, instance hooks are only accepted, and
+// run, if the -allow-instance-hooks option is set.  Node hooks are run before
+// instance hooks.
+
+const (
+	hookPreStart  = "pre-start"
+	hookPostStart = "post-start"
+	hookPreStop   = "pre-stop"
+
+	instanceHooksDir = "hooks"
+	hookTimeout      = 30 * time.Second
+)
+
+// writeInstanceHooks stores the scripts delivered in the START payload in the
+// instance's directory, so that they're available when the instance is
+// restarted.
+func writeInstanceHooks(instanceDir string, hooks *payloads.InstanceHooks) error {
+	if hooks == nil {
+		return nil
+	}
+
+	scripts := map[string]string{
+		hookPreStart:  hooks.PreStart,
+		hookPostStart: hooks.PostStart,
+		hookPreStop:   hooks.PreStop,
+	}
+
+	dir := path.Join(instanceDir, instanceHooksDir)
+	for name, script := range scripts {
+		if script == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		err := ioutil.WriteFile(path.Join(dir, name), []byte(script), 0700)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func hookEnv(hook, instanceDir string, cfg *vmConfig) []string {
+	return append(os.Environ(),
+		"CIAO_HOOK="+hook,
+		"CIAO_INSTANCE_UUID="+cfg.Instance,
+		"CIAO_INSTANCE_DIR="+instanceDir,
+		"CIAO_TENANT_UUID="+cfg.TennantUUID,
+		"CIAO_IMAGE="+cfg.Image,
+		"CIAO_HOSTNAME="+cfg.Hostname,
+		"CIAO_GROUP="+cfg.Group,
+		"CIAO_VCPUS="+strconv.Itoa(cfg.Cpus),
+		"CIAO_MEM_MB="+strconv.Itoa(cfg.Mem),
+		"CIAO_VNIC_NAME="+cfg.VnicName,
+		"CIAO_VNIC_MAC="+cfg.VnicMAC,
+		"CIAO_VNIC_IP="+cfg.VnicIP,
+		"CIAO_SUBNET="+cfg.SubnetIP,
+		"CIAO_VNIC_IPV6="+cfg.VnicIPv6,
+		"CIAO_SUBNET_IPV6="+cfg.SubnetIPv6,
+		"CIAO_CONTAINER="+strconv.FormatBool(cfg.Container))
+}
+
+// hookScripts returns the paths of the node and instance scripts to run for
+// the given hook.  Scripts that do not exist are skipped, and so are the
+// instance scripts of the instances started before -allow-instance-hooks
+// was unset.
+func hookScripts(hook, instanceDir string) []string {
+	var scripts []string
+
+	var candidates []string
+	if nodeHooksDir != "" {
+		candidates = append(candidates, path.Join(nodeHooksDir, hook))
+	}
+	if allowInstanceHooks {
+		candidates = append(candidates, path.Join(instanceDir, instanceHooksDir, hook))
+	}
+
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && fi.Mode().IsRegular() {
+			scripts = append(scripts, c)
+		}
+	}
+
+	return scripts
+}
+
+func runHook(script string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, script)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %v", hookTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("Hook %s failed: %v: %s", script, err,
+			strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
+
+// runHooks runs the node and instance scripts for the given hook.  It stops
+// at the first script that fails and returns its error.
+func runHooks(hook, instanceDir string, cfg *vmConfig) error {
+	scripts := hookScripts(hook, instanceDir)
+	if len(scripts) == 0 {
+		return nil
+	}
+
+	env := hookEnv(hook, instanceDir, cfg)
+	for _, s := range scripts {
+		clog.Infof("Running %s hook %s for instance %s", hook, s, cfg.Instance)
+		if err := runHook(s, env); err != nil {
+			clog.Errorf("%s: %v", cfg.Instance, err)
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/01org/ciao/payloads"
+)
+
+func TestRunHooks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	nodeDir := path.Join(dir, "node")
+	instanceDir := path.Join(dir, "instance")
+	logPath := path.Join(dir, "log")
+	if err = os.MkdirAll(nodeDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldNodeHooksDir := nodeHooksDir
+	nodeHooksDir = nodeDir
+	allowInstanceHooks = true
+	defer func() {
+		nodeHooksDir = oldNodeHooksDir
+		allowInstanceHooks = false
+	}()
+
+	err = ioutil.WriteFile(path.Join(nodeDir, hookPreStart),
+		[]byte("#!/bin/sh\necho node $CIAO_HOOK $CIAO_INSTANCE_UUID >> "+logPath+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := &payloads.InstanceHooks{
+		PreStart: "#!/bin/sh\necho instance $CIAO_HOOK $CIAO_VNIC_MAC >> " + logPath + "\n",
+		PreStop:  "#!/bin/sh\nexit 1\n",
+	}
+	if err = writeInstanceHooks(instanceDir, hooks); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &vmConfig{Instance: "67d86208-b46c-4465-9018-fe14087d415f",
+		VnicMAC: "02:00:e6:f5:af:f9"}
+
+	if err = runHooks(hookPreStart, instanceDir, cfg); err != nil {
+		t.Fatalf("pre-start hooks failed: %v", err)
+	}
+
+	log, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "node pre-start 67d86208-b46c-4465-9018-fe14087d415f\n" +
+		"instance pre-start 02:00:e6:f5:af:f9\n"
+	if string(log) != expected {
+		t.Errorf("Unexpected hook output %q", string(log))
+	}
+
+	if err = runHooks(hookPostStart, instanceDir, cfg); err != nil {
+		t.Errorf("Missing post-start hooks should not fail: %v", err)
+	}
+
+	if err = runHooks(hookPreStop, instanceDir, cfg); err == nil {
+		t.Errorf("Failing pre-stop hook should return an error")
+	}
+
+	allowInstanceHooks = false
+	if err = runHooks(hookPreStop, instanceDir, cfg); err != nil {
+		t.Errorf("Instance hooks run although they are not allowed: %v", err)
+	}
+}
+
+func TestCheckHooks(t *testing.T) {
+	tests := []struct {
+		hooks   payloads.InstanceHooks
+		allowed bool
+		ok      bool
+	}{
+		{payloads.InstanceHooks{}, false, true},
+		{payloads.InstanceHooks{PreStart: "#!/bin/sh\ntrue\n"}, false, false},
+		{payloads.InstanceHooks{PreStart: "#!/bin/sh\ntrue\n"}, true, true},
+		{payloads.InstanceHooks{PostStart: "true\n"}, true, false},
+		{payloads.InstanceHooks{PreStart: "#!/bin/sh\n", PreStop: "exit 0"}, true, false},
+	}
+	defer func() { allowInstanceHooks = false }()
+
+	for i, test := range tests {
+		allowInstanceHooks = test.allowed
+		err := checkHooks(&test.hooks)
+		if (err == nil) != test.ok {
+			t.Errorf("Test %d: unexpected result %v", i, err)
+		}
+	}
+}
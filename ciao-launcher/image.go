@@ -17,11 +17,24 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/golang/glog"
+	"github.com/01org/ciao/clog"
 )
 
+const imageDownloadSuffix = ".download"
+
 type imageStats struct {
 	done      chan struct{}
 	minSizeMB int
@@ -57,7 +70,7 @@ func getMinImageSize(vm *qemu, imagePath string) (minSizeMB int, err error) {
 
 		info.minSizeMB, info.err = vm.imageInfo(imagePath)
 
-		glog.Infof("Min image size of %s = %d", imagePath, info.minSizeMB)
+		clog.Infof("Min image size of %s = %d", imagePath, info.minSizeMB)
 		close(info.done)
 	} else {
 		imagesMap.Unlock()
@@ -67,3 +80,341 @@ func getMinImageSize(vm *qemu, imagePath string) (minSizeMB int, err error) {
 
 	return info.minSizeMB, info.err
 }
+
+type cachedImage struct {
+	sizeMB   int
+	lastUsed time.Time
+	checksum string
+}
+
+type imageFetch struct {
+	done chan struct{}
+	err  error
+}
+
+// imageCache keeps track of the backing images stored in imagesPath.  It is
+// accessed by the instance go routines, which use the images, by the go
+// routines that download them, and by the overseer which evicts them when
+// the node runs low on disk space.
+var imageCache struct {
+	sync.Mutex
+	images   map[string]*cachedImage
+	fetching map[string]*imageFetch
+}
+
+func init() {
+	imageCache.images = make(map[string]*cachedImage)
+	imageCache.fetching = make(map[string]*imageFetch)
+}
+
+func fileSizeMB(info os.FileInfo) int {
+	return int(info.Size() / (1000 * 1000))
+}
+
+// initImageCache populates the image cache with the images already present on
+// the node, using their modification times as an approximation of when they
+// were last used.  Any partially downloaded images are deleted.
+func initImageCache() error {
+	err := os.MkdirAll(imagesPath, 0755)
+	if err != nil {
+		return fmt.Errorf("Unable to create images directory (%s) %v", imagesPath, err)
+	}
+
+	files, err := ioutil.ReadDir(imagesPath)
+	if err != nil {
+		return fmt.Errorf("Unable to read images directory (%s) %v", imagesPath, err)
+	}
+
+	imageCache.Lock()
+	defer imageCache.Unlock()
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(f.Name(), imageDownloadSuffix) {
+			_ = os.Remove(path.Join(imagesPath, f.Name()))
+			continue
+		}
+
+		imageCache.images[f.Name()] = &cachedImage{
+			sizeMB:   fileSizeMB(f),
+			lastUsed: f.ModTime(),
+		}
+	}
+
+	clog.Infof("Found %d images in %s", len(imageCache.images), imagesPath)
+
+	return nil
+}
+
+// touchImage records that image is being used as the backing image of an
+// instance.
+func touchImage(image string) {
+	imageCache.Lock()
+	defer imageCache.Unlock()
+
+	ci := imageCache.images[image]
+	if ci == nil {
+		info, err := os.Stat(path.Join(imagesPath, image))
+		if err != nil {
+			return
+		}
+		ci = &cachedImage{sizeMB: fileSizeMB(info)}
+		imageCache.images[image] = ci
+	}
+	ci.lastUsed = time.Now()
+}
+
+func imageChecksum(imagePath string) (string, error) {
+	f, err := os.Open(imagePath)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func downloadImage(image, checksum string) (*cachedImage, error) {
+	if imageURL == "" {
+		return nil, fmt.Errorf("No image server configured")
+	}
+
+	url := strings.TrimSuffix(imageURL, "/") + "/" + image
+	clog.Infof("Downloading %s", url)
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unable to download %s: %s", url, resp.Status)
+	}
+
+	imagePath := path.Join(imagesPath, image)
+	tmpPath := imagePath + imageDownloadSuffix
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), resp.Body)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if checksum != "" && !strings.EqualFold(sum, checksum) {
+		_ = os.Remove(tmpPath)
+		return nil, fmt.Errorf("Checksum mismatch for %s: expected %s got %s",
+			image, checksum, sum)
+	}
+
+	err = os.Rename(tmpPath, imagePath)
+	if err != nil {
+		_ = os.Remove(tmpPath)
+		return nil, err
+	}
+
+	clog.Infof("Downloaded %s (%d bytes)", image, size)
+
+	return &cachedImage{
+		sizeMB:   int(size / (1000 * 1000)),
+		lastUsed: time.Now(),
+		checksum: sum,
+	}, nil
+}
+
+// verifyCachedImage checks that the cached copy of image matches checksum.
+// The result is remembered so that the image only needs to be read once.
+func verifyCachedImage(image, checksum string) (bool, error) {
+	imageCache.Lock()
+	ci := imageCache.images[image]
+	if ci == nil {
+		imageCache.Unlock()
+		return false, nil
+	}
+	known := ci.checksum
+	imageCache.Unlock()
+
+	if checksum == "" {
+		return true, nil
+	}
+
+	if known == "" {
+		sum, err := imageChecksum(path.Join(imagesPath, image))
+		if err != nil {
+			return false, err
+		}
+
+		imageCache.Lock()
+		ci.checksum = sum
+		imageCache.Unlock()
+		known = sum
+	}
+
+	return strings.EqualFold(known, checksum), nil
+}
+
+func fetchImageOnce(image, checksum string) error {
+	ok, err := verifyCachedImage(image, checksum)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		touchImage(image)
+		return nil
+	}
+
+	ci, err := downloadImage(image, checksum)
+	if err != nil {
+		return err
+	}
+
+	imageCache.Lock()
+	imageCache.images[image] = ci
+	imageCache.Unlock()
+
+	return nil
+}
+
+// fetchImage ensures that image is present in the image cache, downloading it
+// if necessary.  If checksum is not empty and the cached copy of the image
+// does not match it, the image is downloaded again.  Concurrent requests for
+// the same image result in a single download.
+func fetchImage(image, checksum string) error {
+	imageCache.Lock()
+	f := imageCache.fetching[image]
+	if f != nil {
+		imageCache.Unlock()
+		<-f.done
+		if f.err != nil || checksum == "" {
+			return f.err
+		}
+		return fetchImage(image, checksum)
+	}
+
+	f = &imageFetch{done: make(chan struct{})}
+	imageCache.fetching[image] = f
+	imageCache.Unlock()
+
+	f.err = fetchImageOnce(image, checksum)
+
+	imageCache.Lock()
+	delete(imageCache.fetching, image)
+	imageCache.Unlock()
+	close(f.done)
+
+	return f.err
+}
+
+// imageSizeMB returns the size of image in MB or 0 if the image is not present
+// in the image cache.
+func imageSizeMB(image string) int {
+	imageCache.Lock()
+	defer imageCache.Unlock()
+
+	ci := imageCache.images[image]
+	if ci == nil {
+		return 0
+	}
+	return ci.sizeMB
+}
+
+func cachedImageUUIDs() []string {
+	imageCache.Lock()
+	defer imageCache.Unlock()
+
+	images := make([]string, 0, len(imageCache.images))
+	for image := range imageCache.images {
+		images = append(images, image)
+	}
+	sort.Strings(images)
+
+	return images
+}
+
+type lruImage struct {
+	image    string
+	lastUsed time.Time
+}
+
+type lruImages []lruImage
+
+func (l lruImages) Len() int           { return len(l) }
+func (l lruImages) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l lruImages) Less(i, j int) bool { return l[i].lastUsed.Before(l[j].lastUsed) }
+
+// evictableImages must be called with the imageCache lock held.
+func evictableImages(inUse map[string]bool) (images lruImages, sizeMB int) {
+	for image, ci := range imageCache.images {
+		if inUse[image] || imageCache.fetching[image] != nil {
+			continue
+		}
+		images = append(images, lruImage{image, ci.lastUsed})
+		sizeMB += ci.sizeMB
+	}
+	sort.Sort(images)
+
+	return
+}
+
+// reclaimableImagesMB returns the amount of disk space that could be freed by
+// evicting all the images not currently used by an instance.
+func reclaimableImagesMB(inUse map[string]bool) int {
+	imageCache.Lock()
+	defer imageCache.Unlock()
+
+	_, sizeMB := evictableImages(inUse)
+	return sizeMB
+}
+
+// evictImages deletes the least recently used images not used by any
+// instance until at least neededMB of disk space has been freed or no more
+// images can be evicted.  It returns the amount of space freed.
+func evictImages(neededMB int, inUse map[string]bool) int {
+	imageCache.Lock()
+	defer imageCache.Unlock()
+
+	freedMB := 0
+	images, _ := evictableImages(inUse)
+	for _, lru := range images {
+		image := lru.image
+		if freedMB >= neededMB {
+			break
+		}
+
+		err := os.Remove(path.Join(imagesPath, image))
+		if err != nil && !os.IsNotExist(err) {
+			clog.Warningf("Unable to evict image %s: %v", image, err)
+			continue
+		}
+
+		clog.Infof("Evicted image %s", image)
+		freedMB += imageCache.images[image].sizeMB
+		delete(imageCache.images, image)
+	}
+
+	return freedMB
+}
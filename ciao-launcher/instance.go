@@ -21,10 +21,9 @@ import (
 	"sync"
 	"time"
 
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
-
-	"github.com/golang/glog"
 )
 
 type instanceData struct {
@@ -40,11 +39,27 @@ type instanceData struct {
 	connectedCh    chan struct{}
 	monitorCloseCh chan struct{}
 	statsTimer     <-chan time.Time
+	sampler        statsSampler
 	vm             virtualizer
 	instanceDir    string
 	shuttingDown   bool
+	stopRequested  bool
 	rcvStamp       time.Time
 	st             *startTimes
+	bootStamp      time.Time
+	connectedStamp time.Time
+	traceFrame     *ssntp.Frame
+	readyCh        chan struct{}
+	probeCancelCh  chan struct{}
+	healthCh       chan healthReport
+	healthCancelCh chan struct{}
+	restartPending bool
+	diskFull       bool
+	logCancelCh    chan struct{}
+	pendingLaunch  func()
+	launchSlotCh   chan struct{}
+	netMonitor     vnicThroughput
+	securityGroup  *insSecurityGroupCmd
 }
 
 type insStartCmd struct {
@@ -61,6 +76,17 @@ type insDeleteCmd struct {
 }
 type insStopCmd struct{}
 type insMonitorCmd struct{}
+type insConsoleResult struct {
+	socket string
+	err    error
+}
+type insConsoleCmd struct {
+	targetCh chan<- insConsoleResult
+}
+type insMigrateCmd struct {
+	uri   string
+	errCh chan<- error
+}
 
 /*
 This functions asks the server loop to kill the instance.  An instance
@@ -96,64 +122,101 @@ func killMe(instance string, doneCh chan struct{}, ac *agentClient, wg *sync.Wai
 	}()
 }
 
+// queueLaunch asks the overseer for permission to launch the instance.  The
+// overseer limits the number of instances that can be launched concurrently
+// so launch may not be called immediately.  The instance go routine continues
+// to process commands while it waits, so a queued instance can still be
+// deleted.
+func (id *instanceData) queueLaunch(launch func()) {
+	id.pendingLaunch = launch
+	id.launchSlotCh = make(chan struct{}, 1)
+	id.ovsCh <- &ovsLaunchSlotCmd{id.instance, id.launchSlotCh}
+}
+
 func (id *instanceData) startCommand(cmd *insStartCmd) {
-	glog.Info("Found start command")
-	if id.monitorCh != nil {
+	clog.Info("Found start command")
+	if id.monitorCh != nil || id.pendingLaunch != nil {
 		startErr := &startError{nil, payloads.AlreadyRunning}
-		glog.Errorf("Unable to start instance[%s]", string(startErr.code))
+		clog.Errorf("Unable to start instance[%s]", string(startErr.code))
 		startErr.send(&id.ac.ssntpConn, id.instance)
 		return
 	}
+	id.queueLaunch(func() { id.launchInstance(cmd) })
+}
+
+func (id *instanceData) launchInstance(cmd *insStartCmd) {
+	id.ovsCh <- &ovsBootPhaseChange{id.instance, payloads.BootLaunching}
+	launchStamp := time.Now()
 	st, startErr := processStart(cmd, id.instanceDir, id.vm, &id.ac.ssntpConn)
+	metrics.launched(time.Since(launchStamp), startErr != nil)
 	if startErr != nil {
-		glog.Errorf("Unable to start instance[%s]: %v", string(startErr.code), startErr.err)
+		clog.WithFields(id.logFields(ssntp.START, time.Since(launchStamp))).
+			Errorf("Unable to start instance[%s]: %v", string(startErr.code), startErr.err)
 		startErr.send(&id.ac.ssntpConn, id.instance)
 
 		if startErr.code == payloads.LaunchFailure {
-			id.ovsCh <- &ovsStateChange{id.instance, ovsStopped}
+			id.ovsCh <- &ovsStateChange{id.instance, ovsStopped, false}
 		} else if startErr.code != payloads.InstanceExists {
-			glog.Warningf("Unable to create VM instance: %s.  Killing it", id.instance)
+			clog.Warningf("Unable to create VM instance: %s.  Killing it", id.instance)
 			killMe(id.instance, id.doneCh, id.ac, &id.instanceWg)
 			id.shuttingDown = true
 		}
 		return
 	}
 	id.st = st
+	id.bootStamp = cmd.rcvStamp
+
+	if id.securityGroup != nil && id.cfg.VnicName != "" {
+		_ = id.applySecurityGroup()
+	}
 
 	id.connectedCh = make(chan struct{})
 	id.monitorCloseCh = make(chan struct{})
 	id.monitorCh = id.vm.monitorVM(id.monitorCloseCh, id.connectedCh, &id.instanceWg, false)
 	id.ovsCh <- &ovsStatusCmd{}
 	if cmd.frame != nil && cmd.frame.PathTrace() {
+		id.traceFrame = cmd.frame
 		id.ovsCh <- &ovsTraceFrame{cmd.frame}
 	}
 }
 
 func (id *instanceData) restartCommand(cmd *insRestartCmd) {
-	glog.Info("Found restart command")
+	clog.Info("Found restart command")
 
 	if id.shuttingDown {
 		restartErr := &restartError{nil, payloads.RestartNoInstance}
-		glog.Errorf("Unable to restart instance[%s]", string(restartErr.code))
+		clog.Errorf("Unable to restart instance[%s]", string(restartErr.code))
 		restartErr.send(&id.ac.ssntpConn, id.instance)
 		return
 	}
 
-	if id.monitorCh != nil {
+	if id.monitorCh != nil || id.pendingLaunch != nil {
 		restartErr := &restartError{nil, payloads.RestartAlreadyRunning}
-		glog.Errorf("Unable to restart instance[%s]", string(restartErr.code))
+		clog.Errorf("Unable to restart instance[%s]", string(restartErr.code))
 		restartErr.send(&id.ac.ssntpConn, id.instance)
 		return
 	}
 
+	bootStamp := time.Now()
+	id.ovsCh <- &ovsBootPhaseChange{id.instance, payloads.BootScheduled}
+	id.queueLaunch(func() { id.relaunchInstance(bootStamp) })
+}
+
+func (id *instanceData) relaunchInstance(bootStamp time.Time) {
+	id.ovsCh <- &ovsBootPhaseChange{id.instance, payloads.BootLaunching}
+	launchStamp := time.Now()
 	restartErr := processRestart(id.instanceDir, id.vm, &id.ac.ssntpConn, id.cfg)
+	metrics.launched(time.Since(launchStamp), restartErr != nil)
 
 	if restartErr != nil {
-		glog.Errorf("Unable to restart instance[%s]: %v", string(restartErr.code),
-			restartErr.err)
+		clog.WithFields(id.logFields(ssntp.RESTART, time.Since(launchStamp))).
+			Errorf("Unable to restart instance[%s]: %v", string(restartErr.code),
+				restartErr.err)
 		restartErr.send(&id.ac.ssntpConn, id.instance)
+		id.ovsCh <- &ovsBootPhaseChange{id.instance, ""}
 		return
 	}
+	id.bootStamp = bootStamp
 
 	id.connectedCh = make(chan struct{})
 	id.monitorCloseCh = make(chan struct{})
@@ -169,36 +232,51 @@ func (id *instanceData) monitorCommand(cmd *insMonitorCmd) {
 func (id *instanceData) stopCommand(cmd *insStopCmd) {
 	if id.shuttingDown {
 		stopErr := &stopError{nil, payloads.StopNoInstance}
-		glog.Errorf("Unable to stop instance[%s]", string(stopErr.code))
+		clog.Errorf("Unable to stop instance[%s]", string(stopErr.code))
 		stopErr.send(&id.ac.ssntpConn, id.instance)
 		return
 	}
 
 	if id.monitorCh == nil {
 		stopErr := &stopError{nil, payloads.StopAlreadyStopped}
-		glog.Errorf("Unable to stop instance[%s]", string(stopErr.code))
+		clog.Errorf("Unable to stop instance[%s]", string(stopErr.code))
 		stopErr.send(&id.ac.ssntpConn, id.instance)
 		return
 	}
-	glog.Infof("Powerdown %s", id.instance)
+	_ = runHooks(hookPreStop, id.instanceDir, id.cfg)
+	clog.Infof("Powerdown %s", id.instance)
+	id.stopRequested = true
+	id.restartPending = false
 	id.monitorCh <- virtualizerStopCmd
 }
 
 func (id *instanceData) deleteCommand(cmd *insDeleteCmd) bool {
 	if id.shuttingDown && !cmd.suicide {
 		deleteErr := &deleteError{nil, payloads.DeleteNoInstance}
-		glog.Errorf("Unable to delete instance[%s]", string(deleteErr.code))
+		clog.Errorf("Unable to delete instance[%s]", string(deleteErr.code))
 		deleteErr.send(&id.ac.ssntpConn, id.instance)
 		return false
 	}
 
 	if id.monitorCh != nil {
-		glog.Infof("Powerdown %s before deleting", id.instance)
+		_ = runHooks(hookPreStop, id.instanceDir, id.cfg)
+		clog.Infof("Powerdown %s before deleting", id.instance)
 		id.monitorCh <- virtualizerStopCmd
 		id.vm.lostVM()
 	}
 
-	_ = processDelete(id.vm, id.instanceDir, &id.ac.ssntpConn, cmd.running)
+	if id.securityGroup != nil && id.cfg.VnicName != "" {
+		removeSecurityGroup(id.cfg.VnicName)
+	}
+
+	deleteStamp := time.Now()
+	err := processDelete(id.vm, id.instanceDir, &id.ac.ssntpConn, cmd.running)
+	metrics.deleted(time.Since(deleteStamp), err != nil)
+	clog.WithFields(id.logFields(ssntp.DELETE, time.Since(deleteStamp))).
+		Infof("Instance %s deleted", id.instance)
+	if err == nil {
+		dnsRegistry.deregister(id.cfg)
+	}
 
 	if !cmd.suicide {
 		id.ovsCh <- &ovsStatusCmd{}
@@ -206,26 +284,146 @@ func (id *instanceData) deleteCommand(cmd *insDeleteCmd) bool {
 	return true
 }
 
+// diagnosticsCommand runs the collection in a separate go routine, so that
+// the instance go routine is not blocked while a large memory dump is taken
+// or the bundle is uploaded.  The go routine is not added to instanceWg as
+// there's no reason to delay the deletion of the instance until the upload
+// has completed.
+func (id *instanceData) diagnosticsCommand(cmd *insDiagnosticsCmd) {
+	clog.Info("Found diagnostics command")
+
+	collect := id.vm.diagnostics(cmd.memoryDump)
+	go collectDiagnostics(&id.ac.ssntpConn, id.instance, cmd, collect)
+}
+
+func (id *instanceData) consoleCommand(cmd *insConsoleCmd) {
+	socket, err := id.vm.console()
+	cmd.targetCh <- insConsoleResult{socket, err}
+}
+
+func (id *instanceData) migrateCommand(cmd *insMigrateCmd) {
+	err := id.vm.migrate(cmd.uri)
+	if err != nil {
+		clog.Warningf("Unable to migrate instance %s to %s: %v", id.instance, cmd.uri, err)
+	} else {
+		clog.Infof("Migrating instance %s to %s", id.instance, cmd.uri)
+	}
+	cmd.errCh <- err
+}
+
+// logFields returns the fields of a structured log message reporting that
+// command took elapsed to complete for the instance.
+func (id *instanceData) logFields(command ssntp.Command, elapsed time.Duration) clog.Fields {
+	return clog.Fields{
+		clog.InstanceUUID: id.instance,
+		clog.NodeUUID:     id.ac.ssntpConn.UUID(),
+		clog.Command:      command.String(),
+		clog.ElapsedMS:    elapsed.Seconds() * 1000,
+	}
+}
+
 func (id *instanceData) logStartTrace() {
 	if id.st == nil {
 		return
 	}
 
-	runningStamp := time.Now()
-	glog.Info("================ START TRACE ============")
-	glog.Infof("Total time to start instance: %d ms", (runningStamp.Sub(id.rcvStamp))/time.Millisecond)
-	glog.Infof("Launcher routing time: %d ms", (id.st.startStamp.Sub(id.rcvStamp))/time.Millisecond)
-	glog.Infof("Creating time: %d ms", (id.st.runStamp.Sub(id.st.startStamp))/time.Millisecond)
-	glog.Infof("Time to running: %d ms", (runningStamp.Sub(id.st.startStamp))/time.Millisecond)
-	glog.Infof("Running detection time: %d ms", (runningStamp.Sub(id.st.runStamp))/time.Millisecond)
-	glog.Info("")
-	glog.Info("Detailed creation times")
-	glog.Info("-----------------------")
-	glog.Infof("Backing Image Check: %d", id.st.backingImageCheck.Sub(id.st.startStamp)/time.Millisecond)
-	glog.Infof("Network creation: %d", id.st.networkStamp.Sub(id.st.backingImageCheck)/time.Millisecond)
-	glog.Infof("VM/Container creation: %d", id.st.creationStamp.Sub(id.st.networkStamp)/time.Millisecond)
-	glog.Infof("Time to start: %d", id.st.runStamp.Sub(id.st.creationStamp)/time.Millisecond)
-	glog.Info("=========================================")
+	runningStamp := id.connectedStamp
+	clog.WithFields(id.logFields(ssntp.START, runningStamp.Sub(id.rcvStamp))).
+		Infof("Instance %s running", id.instance)
+	clog.Info("================ START TRACE ============")
+	clog.Infof("Total time to start instance: %d ms", (runningStamp.Sub(id.rcvStamp))/time.Millisecond)
+	clog.Infof("Launcher routing time: %d ms", (id.st.startStamp.Sub(id.rcvStamp))/time.Millisecond)
+	clog.Infof("Creating time: %d ms", (id.st.runStamp.Sub(id.st.startStamp))/time.Millisecond)
+	clog.Infof("Time to running: %d ms", (runningStamp.Sub(id.st.startStamp))/time.Millisecond)
+	clog.Infof("Running detection time: %d ms", (runningStamp.Sub(id.st.runStamp))/time.Millisecond)
+	clog.Info("")
+	clog.Info("Detailed creation times")
+	clog.Info("-----------------------")
+	clog.Infof("Backing Image Check: %d", id.st.backingImageCheck.Sub(id.st.startStamp)/time.Millisecond)
+	clog.Infof("Network creation: %d", id.st.networkStamp.Sub(id.st.backingImageCheck)/time.Millisecond)
+	clog.Infof("VM/Container creation: %d", id.st.creationStamp.Sub(id.st.networkStamp)/time.Millisecond)
+	clog.Infof("Time to start: %d", id.st.runStamp.Sub(id.st.creationStamp)/time.Millisecond)
+	clog.Info("=========================================")
+}
+
+// launchTrace breaks the launch of an instance started by the traced
+// frame down into its phases, ready being the time its guest became ready.
+func launchTrace(instance string, frame *ssntp.Frame, rcvStamp time.Time, st *startTimes,
+	connected, ready time.Time) payloads.LaunchTrace {
+	ms := func(d time.Duration) int {
+		return int(d / time.Millisecond)
+	}
+
+	trace := payloads.LaunchTrace{
+		InstanceUUID:    instance,
+		TraceID:         frame.TraceID(),
+		LauncherQueueMS: ms(st.startStamp.Sub(rcvStamp)),
+		ImagePrepMS:     ms(st.creationStamp.Sub(st.startStamp)),
+		BootMS:          ms(connected.Sub(st.creationStamp)),
+		GuestReadyMS:    ms(ready.Sub(connected)),
+	}
+
+	queued, transit, forwarding, err := frame.PathTimes()
+	if err != nil {
+		trace.TotalMS = ms(ready.Sub(rcvStamp))
+		return trace
+	}
+
+	trace.ControllerQueueMS = ms(queued)
+	trace.TransitMS = ms(transit)
+	trace.SchedulerMS = ms(forwarding)
+	trace.TotalMS = trace.ControllerQueueMS + trace.TransitMS + trace.SchedulerMS +
+		ms(ready.Sub(rcvStamp))
+
+	return trace
+}
+
+func (id *instanceData) cancelReadinessProbe() {
+	if id.probeCancelCh != nil {
+		close(id.probeCancelCh)
+		id.probeCancelCh = nil
+	}
+	id.readyCh = nil
+}
+
+// startLogFollower starts shipping the logs of a running instance, if
+// launcher was asked to.
+func (id *instanceData) startLogFollower() {
+	if instanceLogs == nil {
+		return
+	}
+
+	id.logCancelCh = make(chan struct{})
+	instanceLogs.follow(id.cfg, id.ac.ssntpConn.UUID(), id.vm.logFollower(),
+		id.logCancelCh, &id.instanceWg)
+}
+
+func (id *instanceData) stopLogFollower() {
+	if id.logCancelCh != nil {
+		close(id.logCancelCh)
+		id.logCancelCh = nil
+	}
+}
+
+func (id *instanceData) instanceReady() {
+	bootDuration := -1
+	if !id.bootStamp.IsZero() {
+		bootDuration = int(time.Since(id.bootStamp) / time.Millisecond)
+	}
+	clog.Infof("Instance %s is ready.  Boot duration %d ms", id.instance, bootDuration)
+	if id.traceFrame != nil && id.st != nil {
+		trace := launchTrace(id.instance, id.traceFrame, id.rcvStamp, id.st,
+			id.connectedStamp, time.Now())
+		id.ovsCh <- &ovsLaunchTrace{trace}
+	}
+	id.traceFrame = nil
+	id.ovsCh <- &ovsBootPhaseChange{id.instance, payloads.BootReady}
+	sendInstanceReadyEvent(&id.ac.ssntpConn, id.instance, bootDuration)
+	dnsRegistry.register(id.cfg)
+	if id.cfg.TPM && attestationCmd != "" {
+		go collectAttestationQuote(&id.ac.ssntpConn, id.instance,
+			path.Join(id.instanceDir, qgaSocket))
+	}
 }
 
 func (id *instanceData) instanceCommand(cmd interface{}) bool {
@@ -249,8 +447,18 @@ func (id *instanceData) instanceCommand(cmd interface{}) bool {
 		if id.deleteCommand(cmd) {
 			return false
 		}
+	case *insDiagnosticsCmd:
+		id.diagnosticsCommand(cmd)
+	case *insSecurityGroupCmd:
+		id.securityGroupCommand(cmd)
+	case *insBalloonCmd:
+		id.balloonCommand(cmd)
+	case *insConsoleCmd:
+		id.consoleCommand(cmd)
+	case *insMigrateCmd:
+		id.migrateCommand(cmd)
 	default:
-		glog.Warning("Unknown command")
+		clog.Warning("Unknown command")
 	}
 
 	return true
@@ -260,8 +468,12 @@ func (id *instanceData) instanceLoop() {
 
 	id.vm.init(id.cfg, id.instanceDir)
 
+	if id.securityGroup = loadSecurityGroup(id.instanceDir); id.securityGroup != nil {
+		id.ovsCh <- &ovsSecurityGroupCmd{id.instance, id.securityGroup.Version}
+	}
+
 	d, m, c := id.vm.stats()
-	id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c}
+	id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c, time.Now()}
 
 DONE:
 	for {
@@ -269,45 +481,88 @@ DONE:
 		case <-id.doneCh:
 			break DONE
 		case <-id.statsTimer:
-			d, m, c := id.vm.stats()
-			id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c}
-			id.statsTimer = time.After(time.Second * statsPeriod)
+			id.statsTimer = id.sampleStats()
+			if fs := id.vm.guestFilesystems(); fs != nil {
+				id.ovsCh <- &ovsGuestStatsUpdateCmd{id.instance, fs}
+			}
+			if id.cfg.VnicName != "" {
+				id.ovsCh <- &ovsNetStatsUpdateCmd{id.instance, id.networkStats()}
+			}
 		case cmd := <-id.cmdCh:
 			if !id.instanceCommand(cmd) {
 				break DONE
 			}
+		case <-id.launchSlotCh:
+			launch := id.pendingLaunch
+			id.pendingLaunch = nil
+			id.launchSlotCh = nil
+			launch()
+			id.ovsCh <- &ovsLaunchDoneCmd{id.instance}
 		case <-id.monitorCloseCh:
 			// Means we've lost VM for now
 			id.vm.lostVM()
 			d, m, c := id.vm.stats()
-			id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c}
-
-			glog.Infof("Lost VM instance: %s", id.instance)
+			id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c, time.Now()}
+
+			clog.Infof("Lost VM instance: %s", id.instance)
+			id.cancelReadinessProbe()
+			id.cancelHealthMonitor()
+			id.stopLogFollower()
+			id.bootStamp = time.Time{}
+			id.traceFrame = nil
 			id.monitorCloseCh = nil
 			id.connectedCh = nil
 			close(id.monitorCh)
 			id.monitorCh = nil
 			id.statsTimer = nil
-			id.ovsCh <- &ovsStateChange{id.instance, ovsStopped}
+			id.netMonitor = vnicThroughput{}
+			// A VM that goes away without having been asked to is
+			// reported as crashed rather than exited.
+			crashed := !id.stopRequested && !id.shuttingDown
+			id.stopRequested = false
+			id.ovsCh <- &ovsStateChange{id.instance, ovsStopped, crashed}
 			id.st = nil
+			if id.restartPending {
+				id.restartPending = false
+				bootStamp := time.Now()
+				id.ovsCh <- &ovsBootPhaseChange{id.instance, payloads.BootScheduled}
+				id.queueLaunch(func() { id.relaunchInstance(bootStamp) })
+			}
 		case <-id.connectedCh:
+			id.connectedStamp = time.Now()
 			id.logStartTrace()
 			id.connectedCh = nil
 			id.vm.connected()
-			id.ovsCh <- &ovsStateChange{id.instance, ovsRunning}
-			d, m, c := id.vm.stats()
-			id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c}
-			id.statsTimer = time.After(time.Second * statsPeriod)
+			id.stopRequested = false
+			id.ovsCh <- &ovsStateChange{id.instance, ovsRunning, false}
+			id.ovsCh <- &ovsBootPhaseChange{id.instance, payloads.BootBooting}
+			id.sampler = newStatsSampler()
+			id.statsTimer = id.sampleStats()
+			id.readyCh = make(chan struct{})
+			id.probeCancelCh = make(chan struct{})
+			waitForReady(id.instance, id.vm.readinessProbe(), id.readyCh,
+				id.probeCancelCh, &id.instanceWg)
+			id.startLogFollower()
+		case <-id.readyCh:
+			id.readyCh = nil
+			id.instanceReady()
+			id.startHealthMonitor()
+		case report := <-id.healthCh:
+			id.healthChanged(&report)
 		}
 	}
 
+	id.cancelReadinessProbe()
+	id.cancelHealthMonitor()
+	id.stopLogFollower()
+
 	if id.monitorCh != nil {
 		close(id.monitorCh)
 	}
 
-	glog.Infof("Instance goroutine %s waiting for monitor to exit", id.instance)
+	clog.Infof("Instance goroutine %s waiting for monitor to exit", id.instance)
 	id.instanceWg.Wait()
-	glog.Infof("Instance goroutine %s exitted", id.instance)
+	clog.Infof("Instance goroutine %s exitted", id.instance)
 	id.wg.Done()
 }
 
@@ -319,6 +574,10 @@ func startInstance(instance string, cfg *vmConfig, wg *sync.WaitGroup, doneCh ch
 		vm = &simulation{}
 	} else if cfg.Container {
 		vm = &docker{}
+	} else if cfg.Hypervisor == payloads.CloudHypervisor {
+		vm = &cloudHypervisor{}
+	} else if cfg.Hypervisor == payloads.KataContainer {
+		vm = &kataContainer{}
 	} else {
 		vm = &qemu{}
 	}
@@ -0,0 +1,328 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+	"github.com/docker/engine-api/types/network"
+	"golang.org/x/net/context"
+)
+
+const (
+	kataKernel        = "/usr/share/ciao/kata/vmlinux"
+	kataRootfsImage   = "rootfs.img"
+	kataInit          = "/.ciao-init"
+	kataConsoleLog    = "console.log"
+	kataDefaultDiskMB = 1000
+)
+
+// kataContainer runs a docker image inside a lightweight qemu VM rather than
+// a docker container.  The image is pulled and flattened by docker, but the
+// instance itself is a VM as far as the rest of launcher is concerned.  It
+// boots the kernel stored in kataKernel directly, with the container's
+// filesystem as its root device, and is accounted for, monitored and
+// stopped in exactly the same way as any other qemu instance.
+type kataContainer struct {
+	qemu
+	image docker
+}
+
+func (k *kataContainer) init(cfg *vmConfig, instanceDir string) {
+	k.qemu.init(cfg, instanceDir)
+	k.image.init(cfg, instanceDir)
+}
+
+func (k *kataContainer) checkBackingImage() error {
+	return k.image.checkBackingImage()
+}
+
+func (k *kataContainer) downloadBackingImage() error {
+	return k.image.downloadBackingImage()
+}
+
+func (k *kataContainer) rootfsImage() string {
+	return path.Join(k.instanceDir, kataRootfsImage)
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+func shellQuoteAll(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// kataInitScript returns the script that runs as PID 1 inside the VM.  It
+// sets up the environment that the container would have seen and then
+// executes its command.  The guest kernel is configured to panic and hence
+// reboot, which causes qemu to exit, when the command exits.
+func kataInitScript(hostname, workingDir string, env, argv []string) []byte {
+	lines := []string{
+		"#!/bin/sh",
+		"mount -t proc proc /proc 2>/dev/null",
+		"mount -t sysfs sysfs /sys 2>/dev/null",
+		"mount -t devtmpfs devtmpfs /dev 2>/dev/null",
+	}
+	if hostname != "" {
+		lines = append(lines, "hostname "+shellQuote(hostname)+" 2>/dev/null")
+	}
+	for _, e := range env {
+		lines = append(lines, "export "+shellQuote(e))
+	}
+	if workingDir != "" {
+		lines = append(lines, "cd "+shellQuote(workingDir))
+	}
+	lines = append(lines, "exec "+shellQuoteAll(argv))
+
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+// exportImage flattens the docker image of the instance into rootfsDir, by
+// creating, but not starting, a temporary container from the image and
+// exporting its filesystem.  It returns the configuration of the image.
+func (k *kataContainer) exportImage(rootfsDir string) (*container.Config, error) {
+	cli, err := getDockerClient()
+	if err != nil {
+		return nil, err
+	}
+
+	img, _, err := cli.ImageInspectWithRaw(context.Background(), k.cfg.Image, false)
+	if err != nil {
+		clog.Errorf("Unable to inspect docker image %s: %v", k.cfg.Image, err)
+		return nil, err
+	}
+	if img.Config == nil {
+		img.Config = &container.Config{}
+	}
+
+	resp, err := cli.ContainerCreate(context.Background(),
+		&container.Config{Image: k.cfg.Image}, &container.HostConfig{},
+		&network.NetworkingConfig{}, "")
+	if err != nil {
+		clog.Errorf("Unable to create container %v", err)
+		return nil, err
+	}
+	defer func() {
+		_ = cli.ContainerRemove(context.Background(),
+			types.ContainerRemoveOptions{
+				ContainerID: resp.ID,
+				Force:       true})
+	}()
+
+	rc, err := cli.ContainerExport(context.Background(), resp.ID)
+	if err != nil {
+		clog.Errorf("Unable to export container %s: %v", resp.ID, err)
+		return nil, err
+	}
+	defer func() { _ = rc.Close() }()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("tar", "-x", "-C", rootfsDir)
+	cmd.Stdin = rc
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		clog.Errorf("Unable to extract container filesystem: %v %s", err, stderr.String())
+		return nil, err
+	}
+
+	return img.Config, nil
+}
+
+func (k *kataContainer) createImage(bridge string, userData, metaData []byte) error {
+	rootfsDir := path.Join(k.instanceDir, "rootfs")
+	err := os.MkdirAll(rootfsDir, 0755)
+	if err != nil {
+		clog.Errorf("Unable to create rootfs directory %s", rootfsDir)
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(rootfsDir)
+	}()
+
+	config, err := k.exportImage(rootfsDir)
+	if err != nil {
+		return err
+	}
+
+	// As with docker, a runcmd found in the user-data overrides the Cmd,
+	// but not the Entrypoint, of the image.
+
+	cmd := containerCommand(userData)
+	if len(cmd) == 0 {
+		cmd = config.Cmd
+	}
+	argv := append(append([]string{}, config.Entrypoint...), cmd...)
+	if len(argv) == 0 {
+		return fmt.Errorf("Docker image %s does not specify a command", k.cfg.Image)
+	}
+
+	script := kataInitScript(containerHostname(k.cfg, metaData), config.WorkingDir,
+		config.Env, argv)
+	err = ioutil.WriteFile(path.Join(rootfsDir, kataInit), script, 0755)
+	if err != nil {
+		clog.Errorf("Unable to create init script: %v", err)
+		return err
+	}
+
+	if k.cfg.Disk <= 0 {
+		k.cfg.Disk = kataDefaultDiskMB
+	}
+
+	f, err := os.Create(k.rootfsImage())
+	if err != nil {
+		clog.Errorf("Unable to create rootfs image: %v", err)
+		return err
+	}
+	err = f.Truncate(int64(k.cfg.Disk) * 1000 * 1000)
+	_ = f.Close()
+	if err != nil {
+		clog.Errorf("Unable to size rootfs image: %v", err)
+		return err
+	}
+
+	var stderr bytes.Buffer
+	mkfs := exec.Command("mkfs.ext4", "-q", "-F", "-d", rootfsDir, k.rootfsImage())
+	mkfs.Stderr = &stderr
+	err = mkfs.Run()
+	if err != nil {
+		clog.Errorf("Unable to create rootfs image: %v %s", err, stderr.String())
+		return err
+	}
+
+	return nil
+}
+
+func (k *kataContainer) computeParams(vnicName string) []string {
+	fileParam := fmt.Sprintf("file=%s,if=virtio,aio=threads,format=raw", k.rootfsImage())
+	qmpParam := fmt.Sprintf("unix:%s,server,nowait", path.Join(k.instanceDir, "socket"))
+	appendParam := "root=/dev/vda rw console=ttyS0 panic=1 ip=dhcp init=" + kataInit
+
+	params := make([]string, 0, 32)
+	params = append(params, "-drive", fileParam)
+	params = append(params, "-kernel", kataKernel, "-append", appendParam)
+
+	if vnicName != "" {
+		tapParam, _ := computeTapParam(vnicName, k.cfg.VnicMAC)
+		params = append(params, tapParam...)
+	} else {
+		params = append(params, "-net", "nic,model=virtio")
+		params = append(params, "-net", "user")
+	}
+
+	params = append(params, "-enable-kvm", "-cpu", "host", "-daemonize", "-no-reboot")
+	params = append(params, "-qmp", qmpParam)
+	params = append(params, "-D", path.Join(k.instanceDir, qemuLog), "-d", "guest_errors")
+	params = append(params, "-device", "virtio-balloon-pci,id=balloon0")
+	params = append(params, consoleParams(k.instanceDir, kataConsoleLog)...)
+	params = append(params, "-display", "none", "-vga", "none")
+
+	if k.cfg.Mem > 0 {
+		params = append(params, "-m", fmt.Sprintf("%d", k.cfg.Mem))
+	}
+	if k.cfg.Hugepages {
+		params = append(params, "-mem-path", hugepagesPath, "-mem-prealloc")
+	}
+	for _, dev := range k.cfg.pciDevices() {
+		params = append(params, "-device", fmt.Sprintf("vfio-pci,host=%s", dev))
+	}
+	if k.cfg.Cpus > 0 {
+		params = append(params, "-smp", fmt.Sprintf("cpus=%d", k.cfg.Cpus))
+	}
+
+	return params
+}
+
+func (k *kataContainer) startVM(vnicName, ipAddress string) error {
+	clog.Info("Launching kata instance")
+
+	if err := k.serveMetadata(vnicName); err != nil {
+		return err
+	}
+
+	for _, dev := range k.cfg.pciDevices() {
+		err := vfioBind(dev)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := launchQemu(k.computeParams(vnicName), nil)
+	if err != nil {
+		return err
+	}
+
+	clog.Info("Launched VM")
+
+	return nil
+}
+
+// stats reports the size of the rootfs image rather than that of
+// image.qcow2, which kata instances do not have.
+func (k *kataContainer) stats() (disk, memory, cpu int) {
+	_, memory, cpu = k.qemu.stats()
+
+	disk = -1
+	var blocks []qmpBlockInfo
+	if k.pid != 0 && k.qmpExecute("query-block", nil, &blocks) == nil {
+		disk = blockActualSizeMB(blocks, k.rootfsImage())
+	}
+	if disk == -1 {
+		if fi, err := os.Stat(k.rootfsImage()); err == nil {
+			disk = int(fi.Size() / 1000000)
+		}
+	}
+
+	return
+}
+
+// Kata instances are considered to be ready as soon as they're running, as
+// is the case for docker containers.
+func (k *kataContainer) readinessProbe() func() bool {
+	return nil
+}
+
+func (k *kataContainer) healthProbe() func() healthReport {
+	return nil
+}
+
+func (k *kataContainer) logFollower() logFollower {
+	return followFile(path.Join(k.instanceDir, kataConsoleLog))
+}
+
+func (k *kataContainer) guestFilesystems() []payloads.GuestFilesystemStat {
+	return nil
+}
+
+func (k *kataContainer) setBalloon(targetMB int) error {
+	return errBalloonNotSupported
+}
@@ -0,0 +1,67 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func TestKataInitScript(t *testing.T) {
+	script := kataInitScript("test", "/srv", []string{"PATH=/bin:/usr/bin", "MSG=it's"},
+		[]string{"/bin/echo", "hello world"})
+	expected := `#!/bin/sh
+mount -t proc proc /proc 2>/dev/null
+mount -t sysfs sysfs /sys 2>/dev/null
+mount -t devtmpfs devtmpfs /dev 2>/dev/null
+hostname 'test' 2>/dev/null
+export 'PATH=/bin:/usr/bin'
+export 'MSG=it'\''s'
+cd '/srv'
+exec '/bin/echo' 'hello world'
+`
+	if string(script) != expected {
+		t.Errorf("Unexpected init script.  Expected\n%s\ngot\n%s", expected, script)
+	}
+}
+
+func TestKataBackingImage(t *testing.T) {
+	cfg := &vmConfig{Image: "busybox", Hypervisor: "kata"}
+	if cfg.backingImage() != "" {
+		t.Errorf("Kata instances should not use the image cache")
+	}
+}
+
+func TestKataConsoleParams(t *testing.T) {
+	k := &kataContainer{}
+	k.init(&vmConfig{Image: "busybox", Hypervisor: "kata"}, "/tmp/instance")
+
+	params := k.computeParams("")
+	console := "socket,id=console0,path=/tmp/instance/console.sock,server,nowait,logfile=/tmp/instance/console.log"
+	found := false
+	for i := 0; i+1 < len(params); i++ {
+		if params[i] == "-chardev" && params[i+1] == console {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Console socket missing from %v", params)
+	}
+
+	if _, err := k.console(); err == nil {
+		t.Errorf("Expected console of stopped instance to be unavailable")
+	}
+}
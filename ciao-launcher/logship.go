@@ -0,0 +1,404 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/ugorji/go/codec"
+)
+
+// Launcher can ship the console logs of its VM instances, and the stdout and
+// stderr of its containers, to a central sink, either a fluentd server
+// speaking the forward protocol or a syslog daemon.  Each line is tagged with
+// the instance, tenant and node it comes from.  The lines are queued by the
+// go routines following the logs and written in batches by a single go
+// routine.  Lines are dropped rather than queued without limit when the sink
+// cannot keep up, so that a slow or unreachable sink never holds up the
+// instances or the overseer.
+
+// logQueueLength is the number of lines waiting to be shipped beyond which
+// new lines are dropped.
+const logQueueLength = 4096
+
+// logBatchSize is the maximum number of lines written at once.
+const logBatchSize = 100
+
+// logTimeout is the time after which connecting to, or writing to, the sink
+// is abandoned.
+const logTimeout = 10 * time.Second
+
+// logPollPeriod is the interval at which console logs are checked for new
+// lines.
+var logPollPeriod = time.Second
+
+// logLineMax is the length beyond which a line is split.
+const logLineMax = 16 * 1024
+
+const (
+	fluentdDefaultPort = "24224"
+	fluentdDefaultTag  = "ciao.instance"
+)
+
+// Sources of the log lines.
+const (
+	logSourceConsole = "console"
+	logSourceStdout  = "stdout"
+	logSourceStderr  = "stderr"
+)
+
+// logRecord is a line logged by an instance.
+type logRecord struct {
+	time     time.Time
+	instance string
+	tenant   string
+	node     string
+	source   string
+	line     string
+}
+
+// logFollower follows the logs of an instance, passing each new line and its
+// source to emit, until cancelCh is closed.
+type logFollower func(emit func(source, line string), cancelCh <-chan struct{}) error
+
+type logSink interface {
+	write(records []*logRecord) error
+}
+
+// fluentdHandle encodes the fluentd forward protocol messages.  Strings
+// are encoded as the str type of the current msgpack spec, rather than as
+// raw bytes, as fluentd expects.
+var fluentdHandle = &codec.MsgpackHandle{WriteExt: true}
+
+// fluentdRecord is the record of a log line in a forward mode message.
+type fluentdRecord struct {
+	Instance string `codec:"instance_uuid"`
+	Tenant   string `codec:"tenant_uuid"`
+	Node     string `codec:"node_uuid"`
+	Source   string `codec:"source"`
+	Log      string `codec:"log"`
+}
+
+// forwardMessage encodes records as a fluentd forward mode message.
+func forwardMessage(tag string, records []*logRecord) ([]byte, error) {
+	entries := make([][]interface{}, 0, len(records))
+	for _, r := range records {
+		entries = append(entries, []interface{}{
+			uint64(r.time.Unix()),
+			&fluentdRecord{
+				Instance: r.instance,
+				Tenant:   r.tenant,
+				Node:     r.node,
+				Source:   r.source,
+				Log:      r.line,
+			},
+		})
+	}
+
+	var msg []byte
+	err := codec.NewEncoderBytes(&msg, fluentdHandle).Encode([]interface{}{tag, entries})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// fluentdSink writes log records to a fluentd server over the forward
+// protocol.  It reconnects to the server at the next batch when a write
+// fails.
+type fluentdSink struct {
+	addr string
+	tag  string
+	conn net.Conn
+}
+
+func (f *fluentdSink) write(records []*logRecord) error {
+	msg, err := forwardMessage(f.tag, records)
+	if err != nil {
+		return err
+	}
+
+	if f.conn == nil {
+		conn, err := net.DialTimeout("tcp", f.addr, logTimeout)
+		if err != nil {
+			return err
+		}
+		f.conn = conn
+	}
+
+	_ = f.conn.SetWriteDeadline(time.Now().Add(logTimeout))
+	_, err = f.conn.Write(msg)
+	if err != nil {
+		_ = f.conn.Close()
+		f.conn = nil
+	}
+
+	return err
+}
+
+// syslogLogSink writes log records to syslog, stderr lines as warnings.
+type syslogLogSink struct {
+	writer *syslog.Writer
+}
+
+func (s *syslogLogSink) write(records []*logRecord) error {
+	for _, r := range records {
+		msg := fmt.Sprintf("instance=%s tenant=%s node=%s source=%s %s",
+			r.instance, r.tenant, r.node, r.source, r.line)
+
+		var err error
+		if r.source == logSourceStderr {
+			err = s.writer.Warning(msg)
+		} else {
+			err = s.writer.Info(msg)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newLogSink returns the sink described by address: fluentd://host[:port][/tag]
+// for a fluentd server, syslog for the local syslog daemon, or
+// syslog://host:port or syslog+tcp://host:port for a remote one.
+func newLogSink(address string) (logSink, error) {
+	if address == "syslog" {
+		writer, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "ciao-instance")
+		if err != nil {
+			return nil, err
+		}
+		return &syslogLogSink{writer: writer}, nil
+	}
+
+	u, err := url.Parse(address)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid log sink %s", address)
+	}
+
+	switch u.Scheme {
+	case "fluentd":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Host, fluentdDefaultPort)
+		}
+		tag := fluentdDefaultTag
+		if len(u.Path) > 1 {
+			tag = u.Path[1:]
+		}
+		return &fluentdSink{addr: addr, tag: tag}, nil
+	case "syslog", "syslog+tcp":
+		network := "udp"
+		if u.Scheme == "syslog+tcp" {
+			network = "tcp"
+		}
+		writer, err := syslog.Dial(network, u.Host, syslog.LOG_DAEMON|syslog.LOG_INFO, "ciao-instance")
+		if err != nil {
+			return nil, err
+		}
+		return &syslogLogSink{writer: writer}, nil
+	}
+
+	return nil, fmt.Errorf("invalid log sink %s, fluentd, syslog or syslog+tcp expected", address)
+}
+
+// logShipper ships the logs of the instances to a sink.  A nil logShipper
+// ships nothing.
+type logShipper struct {
+	sink    logSink
+	records chan *logRecord
+	dropped int64
+}
+
+var instanceLogs *logShipper
+
+var instanceLogSink string
+
+// newLogShipper returns a shipper writing to the sink described by address,
+// or nil if address is empty.
+func newLogShipper(address string) (*logShipper, error) {
+	if address == "" {
+		return nil, nil
+	}
+
+	sink, err := newLogSink(address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &logShipper{
+		sink:    sink,
+		records: make(chan *logRecord, logQueueLength),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func (s *logShipper) run() {
+	for r := range s.records {
+		batch := []*logRecord{r}
+	drain:
+		for len(batch) < logBatchSize {
+			select {
+			case r, ok := <-s.records:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, r)
+			default:
+				break drain
+			}
+		}
+
+		if err := s.sink.write(batch); err != nil {
+			clog.Warningf("Unable to ship %d instance log lines: %v", len(batch), err)
+		}
+
+		if dropped := atomic.SwapInt64(&s.dropped, 0); dropped > 0 {
+			clog.Warningf("Instance log queue full, dropped %d lines", dropped)
+		}
+	}
+}
+
+// ship queues r without blocking, dropping it if the queue is full.
+func (s *logShipper) ship(r *logRecord) {
+	select {
+	case s.records <- r:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// follow ships the lines follow reports for an instance until cancelCh is
+// closed.
+func (s *logShipper) follow(cfg *vmConfig, node string, follow logFollower,
+	cancelCh <-chan struct{}, wg *sync.WaitGroup) {
+	if s == nil || follow == nil {
+		return
+	}
+
+	instance, tenant := cfg.Instance, cfg.TennantUUID
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		err := follow(func(source, line string) {
+			s.ship(&logRecord{
+				time:     time.Now(),
+				instance: instance,
+				tenant:   tenant,
+				node:     node,
+				source:   source,
+				line:     line,
+			})
+		}, cancelCh)
+		if err != nil {
+			clog.Warningf("Unable to follow the logs of instance %s: %v", instance, err)
+		}
+	}()
+}
+
+// lineWriter splits what is written to it into lines, which it passes to
+// emit, splitting lines longer than logLineMax.
+type lineWriter struct {
+	emit func(line string)
+	buf  []byte
+}
+
+func (l *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			l.buf = append(l.buf, p...)
+			for len(l.buf) >= logLineMax {
+				l.emit(string(l.buf[:logLineMax]))
+				l.buf = l.buf[logLineMax:]
+			}
+			break
+		}
+
+		l.buf = append(l.buf, p[:i]...)
+		l.emit(string(bytes.TrimSuffix(l.buf, []byte("\r"))))
+		l.buf = l.buf[:0]
+		p = p[i+1:]
+	}
+
+	return n, nil
+}
+
+// followFile returns a function following the console log file of a VM
+// instance from its current end, or from its start if it does not exist yet.
+// The file is read again from its start if
+// it is truncated, e.g., when the instance is restarted.
+func followFile(file string) logFollower {
+	return func(emit func(source, line string), cancelCh <-chan struct{}) error {
+		w := &lineWriter{emit: func(line string) { emit(logSourceConsole, line) }}
+
+		var offset int64
+		if fi, err := os.Stat(file); err == nil {
+			offset = fi.Size()
+		}
+
+		buf := make([]byte, 32*1024)
+		for {
+			if fi, err := os.Stat(file); err == nil {
+				if fi.Size() < offset {
+					offset = 0
+				}
+				if fi.Size() > offset {
+					n, err := readFileAt(file, offset, buf, w)
+					offset += n
+					if err != nil {
+						return err
+					}
+				}
+			}
+
+			select {
+			case <-cancelCh:
+				return nil
+			case <-time.After(logPollPeriod):
+			}
+		}
+	}
+}
+
+// readFileAt copies the contents of file from offset to w, using buf, and
+// returns the number of bytes copied.
+func readFileAt(file string, offset int64, buf []byte, w io.Writer) (int64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = f.Close() }()
+
+	return io.CopyBuffer(w, io.NewSectionReader(f, offset, 1<<62), buf)
+}
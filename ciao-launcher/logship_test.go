@@ -0,0 +1,230 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForwardMessage(t *testing.T) {
+	r := &logRecord{
+		time:     time.Unix(1500000000, 0),
+		instance: "i",
+		tenant:   "t",
+		node:     "n",
+		source:   logSourceStdout,
+		line:     "hello",
+	}
+
+	expected := []byte{0x92, 0xa3, 't', 'a', 'g', 0x91, 0x92,
+		0xce, 0x59, 0x68, 0x2f, 0x00, 0x85,
+		0xad, 'i', 'n', 's', 't', 'a', 'n', 'c', 'e', '_', 'u', 'u', 'i', 'd', 0xa1, 'i',
+		0xa3, 'l', 'o', 'g', 0xa5, 'h', 'e', 'l', 'l', 'o',
+		0xa9, 'n', 'o', 'd', 'e', '_', 'u', 'u', 'i', 'd', 0xa1, 'n',
+		0xa6, 's', 'o', 'u', 'r', 'c', 'e', 0xa6, 's', 't', 'd', 'o', 'u', 't',
+		0xab, 't', 'e', 'n', 'a', 'n', 't', '_', 'u', 'u', 'i', 'd', 0xa1, 't'}
+
+	msg, err := forwardMessage("tag", []*logRecord{r})
+	if err != nil || !bytes.Equal(msg, expected) {
+		t.Errorf("Unexpected forward message %v\n%x\nvs\n%x", err, msg, expected)
+	}
+
+	line := strings.Repeat("x", 300)
+	r.line = line
+	msg, err = forwardMessage("tag", []*logRecord{r})
+	if err != nil || !bytes.Contains(msg, append([]byte{0xa3, 'l', 'o', 'g', 0xda, 0x01, 0x2c}, line...)) {
+		t.Errorf("Unexpected encoding of a 300 byte line %v: %x", err, msg)
+	}
+}
+
+func TestNewLogSink(t *testing.T) {
+	sink, err := newLogSink("fluentd://127.0.0.1/ciao.logs")
+	if err != nil {
+		t.Fatalf("Unable to create fluentd sink: %v", err)
+	}
+	f := sink.(*fluentdSink)
+	if f.addr != "127.0.0.1:24224" || f.tag != "ciao.logs" {
+		t.Errorf("Unexpected fluentd sink %+v", f)
+	}
+
+	for _, address := range []string{"fluentd", "kafka://127.0.0.1:9092", "syslog://"} {
+		if _, err := newLogSink(address); err == nil {
+			t.Errorf("Invalid log sink %s accepted", address)
+		}
+	}
+}
+
+func TestFluentdSink(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = l.Close() }()
+
+	records := []*logRecord{{time: time.Now(), instance: "i", line: "a"}}
+	expected, err := forwardMessage("tag", records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []byte)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(received)
+			return
+		}
+		defer func() { _ = conn.Close() }()
+		buf := make([]byte, len(expected))
+		_, _ = io.ReadFull(conn, buf)
+		received <- buf
+	}()
+
+	sink := &fluentdSink{addr: l.Addr().String(), tag: "tag"}
+	if err := sink.write(records); err != nil {
+		t.Fatalf("Unable to write records: %v", err)
+	}
+	defer func() { _ = sink.conn.Close() }()
+
+	if msg := <-received; !bytes.Equal(msg, expected) {
+		t.Errorf("fluentd received %x, expected %x", msg, expected)
+	}
+}
+
+type blockingLogSink struct {
+	unblock chan struct{}
+}
+
+func (b *blockingLogSink) write(records []*logRecord) error {
+	<-b.unblock
+	return nil
+}
+
+func TestLogShipperBackpressure(t *testing.T) {
+	sink := &blockingLogSink{make(chan struct{})}
+	s := &logShipper{sink: sink, records: make(chan *logRecord, 4)}
+	go s.run()
+	defer close(s.records)
+	defer close(sink.unblock)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			s.ship(&logRecord{line: "x"})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shipping blocked on a stalled sink")
+	}
+
+	if dropped := atomic.LoadInt64(&s.dropped); dropped < 15 {
+		t.Errorf("%d lines dropped, at least 15 expected", dropped)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := &lineWriter{emit: func(line string) { lines = append(lines, line) }}
+
+	_, _ = w.Write([]byte("a\r\nb"))
+	_, _ = w.Write([]byte("c\n\nd"))
+	_, _ = w.Write([]byte(strings.Repeat("e", logLineMax)))
+
+	expected := []string{"a", "bc", "", "d" + strings.Repeat("e", logLineMax-1)}
+	if len(lines) != len(expected) {
+		t.Fatalf("Got lines %q, expected %q", lines, expected)
+	}
+	for i := range lines {
+		if lines[i] != expected[i] {
+			t.Errorf("Line %d is %q, expected %q", i, lines[i], expected[i])
+		}
+	}
+	if string(w.buf) != "e" {
+		t.Errorf("Unexpected remainder %q", w.buf)
+	}
+}
+
+func TestFollowFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	oldLogPollPeriod := logPollPeriod
+	logPollPeriod = 10 * time.Millisecond
+	defer func() { logPollPeriod = oldLogPollPeriod }()
+
+	file := path.Join(dir, "console.log")
+	if err := ioutil.WriteFile(file, []byte("before\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 10)
+	cancelCh := make(chan struct{})
+	doneCh := make(chan error)
+	go func() {
+		doneCh <- followFile(file)(func(source, line string) {
+			if source == logSourceConsole {
+				lines <- line
+			}
+		}, cancelCh)
+	}()
+
+	expect := func(expected string) {
+		select {
+		case line := <-lines:
+			if line != expected {
+				t.Errorf("Got line %q, expected %q", line, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Line %q not followed", expected)
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString("after\n")
+	_ = f.Close()
+	expect("after")
+
+	if err := ioutil.WriteFile(file, []byte("new\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect("new")
+
+	close(cancelCh)
+	if err := <-doneCh; err != nil {
+		t.Errorf("Following failed: %v", err)
+	}
+}
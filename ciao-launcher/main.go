@@ -25,14 +25,15 @@ import (
 	"os/signal"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"golang.org/x/net/context"
 
-	"github.com/golang/glog"
-
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
 )
@@ -81,7 +82,53 @@ func (f *uiFlag) Enabled() bool {
 	return string(*f) != "none"
 }
 
+type serverListFlag []string
+
+func (f *serverListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *serverListFlag) Set(val string) error {
+	for _, server := range strings.Split(val, ",") {
+		if server != "" {
+			*f = append(*f, server)
+		}
+	}
+	return nil
+}
+
+// labelsFlag collects the key=value labels of the node.
+type labelsFlag map[string]string
+
+func (f *labelsFlag) String() string {
+	labels := make([]string, 0, len(*f))
+	for k, v := range *f {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return strings.Join(labels, ",")
+}
+
+func (f *labelsFlag) Set(val string) error {
+	for _, label := range strings.Split(val, ",") {
+		if label == "" {
+			continue
+		}
+		kv := strings.SplitN(label, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return fmt.Errorf("key=value expected")
+		}
+		if *f == nil {
+			*f = make(labelsFlag)
+		}
+		(*f)[kv[0]] = kv[1]
+	}
+	return nil
+}
+
 var serverURL string
+var standbyServers serverListFlag
+var serverSRV string
 var serverCertPath string
 var clientCertPath string
 var computeNet string
@@ -92,9 +139,56 @@ var diskLimit bool
 var memLimit bool
 var simulate bool
 var maxInstances = int(math.MaxInt32)
+var cloudInitMode = cloudInitConfigDrive
+var metadataAddr string
+var imageURL string
+var drainMode = drainNone
+var drainTimeout time.Duration
+var adminSocket string
+var metricsAddr string
+var guestFSStats bool
+var maintenanceMode bool
+var maxLaunches int
+var cpuOvercommit float64
+var dedicatedCPUs cpuListFlag
+var diskIOPSCapacity int
+var netBandwidthKbps int
+var maxCNCIs int
+var cnciBandwidthKbps int
+var publicIPPool int
+var tenantNetworksPeriod time.Duration
+var nodeHooksDir string
+var allowInstanceHooks bool
+var allowWeakIsolation bool
+var powerDownMode = powerDownNone
+var wakeOnLANInterface string
+var failureDomain payloads.FailureDomain
+var nodeLabels labelsFlag
+
+// softwareVersion is the version of the ciao software the node runs, set
+// at build time with -ldflags "-X main.softwareVersion=<version>" and
+// overridden by -software-version.
+var softwareVersion string
+var keepaliveInterval time.Duration
+var keepaliveTimeout time.Duration
+var ssntpTransport string
+var ssntpPort uint
+var ssntpRecording string
+var logFormat clog.Format
+var dnsWebhookURL string
+var dnsServer string
+var dnsZone string
+var dnsKeyFile string
+var dnsTTL int
+
+// ssntpMetrics exports launcher's SSNTP connection and frame counters, see
+// the /ssntp admin API endpoint.
+var ssntpMetrics = ssntp.NewExpvarMetrics(ssntpMetricsVar)
 
 func init() {
 	flag.StringVar(&serverURL, "server", "", "URL of SSNTP server")
+	flag.Var(&standbyServers, "standby-servers", "Comma separated list of standby SSNTP servers to fail over to")
+	flag.StringVar(&serverSRV, "server-srv", "", "DNS domain to look up the _ssntp._tcp SRV records of SSNTP servers in")
 	flag.StringVar(&serverCertPath, "cacert", "/etc/pki/ciao/CAcert-server-localhost.pem", "Client certificate")
 	flag.StringVar(&clientCertPath, "cert", "/etc/pki/ciao/cert-client-localhost.pem", "CA certificate")
 	flag.StringVar(&computeNet, "compute-net", "", "Compute Subnet")
@@ -104,8 +198,60 @@ func init() {
 	flag.BoolVar(&diskLimit, "disk-limit", true, "Use disk usage limits")
 	flag.BoolVar(&memLimit, "mem-limit", true, "Use memory usage limits")
 	flag.BoolVar(&simulate, "simulation", false, "Launcher simulation")
+	flag.Var(&cloudInitMode, "cloud-init", "Can be config-drive, nocloud or metadata-service")
+	flag.StringVar(&metadataAddr, "metadata-addr", "169.254.169.254:80", "Address instances send their metadata requests to")
+	flag.StringVar(&imageURL, "image-url", "", "URL of the server from which backing images are downloaded")
+	flag.Var(&drainMode, "drain", "Action to take on instances when draining, can be none or shutdown")
+	flag.BoolVar(&guestFSStats, "guest-fs-stats", false, "Report the filesystem usage of VM instances running the qemu guest agent")
+	flag.StringVar(&adminSocket, "admin-socket", "/var/run/ciao/launcher.sock", "Path of the admin API unix socket, empty to disable")
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "Address to serve Prometheus metrics on, e.g., 127.0.0.1:9190, empty to disable")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 2*time.Minute, "Maximum time to wait for instances to shutdown when draining")
+	flag.BoolVar(&maintenanceMode, "maintenance", false, "Put the node into maintenance mode")
+	flag.IntVar(&maxLaunches, "max-launches", 0, "Maximum number of instances launched concurrently, 0 for no limit")
+	flag.Float64Var(&cpuOvercommit, "cpu-overcommit", 0, "Maximum ratio of allocated vCPUs to online CPUs, 0 for no limit")
+	flag.Var(&dedicatedCPUs, "dedicated-cpus", "Host CPUs that can be dedicated to instances, e.g., 4-7,12")
+	flag.IntVar(&diskIOPSCapacity, "disk-iops", 0, "Disk IOPS that can be reserved by instances, 0 if unknown")
+	flag.IntVar(&netBandwidthKbps, "net-bandwidth-kbps", 0, "Network bandwidth in kbps, in each direction, that can be reserved by instances, 0 if unknown")
+	flag.IntVar(&maxCNCIs, "max-cncis", 0, "Maximum number of CNCIs a network node can run, 0 for no limit")
+	flag.IntVar(&cnciBandwidthKbps, "cnci-bandwidth-kbps", 0, "Bandwidth in kbps a network node can route for its CNCIs, 0 if unknown")
+	flag.IntVar(&publicIPPool, "public-ips", 0, "Size of the pool of public IP addresses a network node assigns to its CNCIs, 0 if not managed")
+	flag.DurationVar(&tenantNetworksPeriod, "tenant-networks-period", 5*time.Minute, "Interval between the reports of the tenant networks of a compute node to the scheduler, 0 to disable")
+	flag.StringVar(&registryAuthFile, "registry-auth", "/etc/ciao/registry-auth.yaml", "File containing the credentials used to pull docker images from private registries")
+	flag.StringVar(&registryMirror, "registry-mirror", "", "Host of a pull-through cache of docker.io images, empty to disable")
+	flag.Var(&bindMountDirs, "bind-mounts", "Comma separated list of host directories under which docker instances may bind mount directories")
+	flag.StringVar(&attestationCmd, "attestation-cmd", "", "Command run inside VM instances with a virtual TPM to obtain an attestation quote, empty to disable")
+	flag.DurationVar(&keepaliveInterval, "keepalive-interval", 10*time.Second, "Interval between SSNTP keepalives, 0 to disable")
+	flag.DurationVar(&keepaliveTimeout, "keepalive-timeout", 0, "Time after which the server is considered dead, 0 for three keepalive intervals")
+	flag.StringVar(&ssntpTransport, "transport", "tcp", "SSNTP transport, tcp or websocket")
+	flag.UintVar(&ssntpPort, "port", 0, "SSNTP port of the server, 0 for the default 8888")
+	flag.StringVar(&ssntpRecording, "record", "", "File to record the SSNTP frames exchanged with the server to, for replaying them with ciao-replay")
+	flag.StringVar(&maintenanceWindowsFile, "maintenance-windows", "/etc/ciao/maintenance-windows.yaml", "File listing the scheduled maintenance windows of the node")
+	flag.StringVar(&instanceLogSink, "instance-log-sink", "", "Sink to ship the console and container logs of instances to, fluentd://host[:port][/tag], syslog, syslog://host:port or syslog+tcp://host:port, empty to disable")
+	flag.StringVar(&nodeHooksDir, "hooks-dir", "", "Directory containing the node's instance lifecycle hooks, empty to disable")
+	flag.BoolVar(&allowInstanceHooks, "allow-instance-hooks", false, "Run the lifecycle hooks delivered in START payloads, as root, on the node")
+	flag.BoolVar(&allowWeakIsolation, "allow-weak-isolation", false, "Let START payloads disable the seccomp, AppArmor, SELinux or user namespace isolation of docker instances")
+	flag.Var(&powerDownMode, "power-down", "How to power the node down when the scheduler asks for it, can be none, suspend or hook")
+	flag.StringVar(&wakeOnLANInterface, "wol-interface", "", "Network interface the node can be woken up through once powered down")
+	flag.StringVar(&failureDomain.Zone, "zone", "", "Name of the availability zone the node is in, reported to the controllers")
+	flag.StringVar(&failureDomain.Rack, "rack", "", "Name of the rack the node is in, for the scheduler to spread instances across racks")
+	flag.StringVar(&failureDomain.Chassis, "chassis", "", "Name of the chassis the node is in, for the scheduler to spread instances across chassis")
+	flag.StringVar(&failureDomain.PDU, "pdu", "", "Name of the power distribution unit the node is fed by, for the scheduler to spread instances across PDUs")
+	flag.Var(&nodeLabels, "label", "Comma separated key=value labels of the node, reported to the controllers, may be repeated")
+	flag.StringVar(&softwareVersion, "software-version", softwareVersion, "Version of the ciao software the node runs, for the scheduler to orchestrate rolling upgrades")
+	flag.StringVar(&dnsWebhookURL, "dns-webhook", "", "URL to post the DNS records of the instances to when they become ready or are deleted, empty to disable")
+	flag.StringVar(&dnsServer, "dns-server", "", "DNS server, host[:port], to send RFC 2136 updates of the records of the instances to, empty to disable")
+	flag.StringVar(&dnsZone, "dns-zone", "", "DNS zone the instance records are updated in")
+	flag.StringVar(&dnsKeyFile, "dns-key", "", "File containing the TSIG key signing the RFC 2136 updates")
+	flag.IntVar(&dnsTTL, "dns-ttl", 300, "TTL in seconds of the instance DNS records")
+	flag.Var(&logFormat, "log-format", "Log format, glog or json, json writing one object per line to stderr (default glog)")
 }
 
+const ssntpMetricsVar = "ssntp"
+
+// maxClockOffset is the offset between the clocks of the node and the
+// scheduler above which launcher warns of a clock skew.
+const maxClockOffset = time.Second
+
 const (
 	lockDir       = "/tmp/lock/ciao"
 	instancesDir  = "/var/lib/ciao/instances"
@@ -113,6 +259,10 @@ const (
 	instanceState = "state"
 	lockFile      = "client-agent.lock"
 	statsPeriod   = 30
+
+	// statsSendTimeout bounds, in seconds, the time the overseer
+	// waits for a slow scheduler to take its STATS and status frames.
+	statsSendTimeout = 10
 )
 
 type cmdWrapper struct {
@@ -120,6 +270,18 @@ type cmdWrapper struct {
 	cmd      interface{}
 }
 type statusCmd struct{}
+type prefetchCmd struct {
+	image    string
+	checksum string
+}
+type configureCmd struct {
+	limits   map[string]tenantLimit
+	settings launcherSettings
+}
+type groupCmd struct {
+	group  string
+	delete bool
+}
 
 type ssntpConn struct {
 	sync.RWMutex
@@ -146,17 +308,43 @@ type agentClient struct {
 
 func (client *agentClient) DisconnectNotify() {
 	client.setStatus(false)
-	glog.Warning("disconnected")
+	clog.Warning("disconnected")
 }
 
 func (client *agentClient) ConnectNotify() {
 	client.setStatus(true)
 	client.cmdCh <- &cmdWrapper{"", &statusCmd{}}
-	glog.Info("connected")
+	go sendNodeCapabilities(&client.ssntpConn)
+	if config := client.ClusterConfiguration(); len(config) > 0 {
+		cmd, payloadErr := parseConfigurePayload(config)
+		if payloadErr == nil {
+			client.cmdCh <- &cmdWrapper{"", cmd}
+		}
+	}
+	clog.Info("connected")
+	checkClockOffset(&client.ssntpConn)
+}
+
+// checkClockOffset logs how far the clock of the scheduler is ahead of the
+// node one, as estimated by SSNTP when launcher connected, and warns when
+// the clocks are too far apart for the timestamps and deadlines exchanged
+// with the cluster to be trusted.
+func checkClockOffset(conn *ssntpConn) {
+	offset, rtt, ok := conn.ClockOffset()
+	if !ok {
+		return
+	}
+
+	if offset > maxClockOffset || offset < -maxClockOffset {
+		clog.Warningf("Clock of the scheduler is %v ahead of the node one (rtt %v), check NTP",
+			offset, rtt)
+		return
+	}
+	clog.Infof("Clock of the scheduler is %v ahead of the node one (rtt %v)", offset, rtt)
 }
 
 func (client *agentClient) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
-	glog.Infof("STATUS %s", status)
+	clog.Infof("STATUS %s", status)
 }
 
 func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame) {
@@ -172,7 +360,7 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 				payloads.StartFailureReason(payloadErr.code),
 			}
 			startError.send(&client.ssntpConn, "")
-			glog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
 			return
 		}
 		client.cmdCh <- &cmdWrapper{cfg.Instance, &insStartCmd{cn, md, frame, cfg, time.Now()}}
@@ -184,7 +372,7 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 				payloads.RestartFailureReason(payloadErr.code),
 			}
 			restartError.send(&client.ssntpConn, "")
-			glog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
 			return
 		}
 		client.cmdCh <- &cmdWrapper{instance, &insRestartCmd{}}
@@ -196,7 +384,7 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 				payloads.StopFailureReason(payloadErr.code),
 			}
 			stopError.send(&client.ssntpConn, "")
-			glog.Errorf("Unable to parse YAML: %s", payloadErr)
+			clog.Errorf("Unable to parse YAML: %s", payloadErr)
 			return
 		}
 		client.cmdCh <- &cmdWrapper{instance, &insStopCmd{}}
@@ -208,19 +396,74 @@ func (client *agentClient) CommandNotify(cmd ssntp.Command, frame *ssntp.Frame)
 				payloads.DeleteFailureReason(payloadErr.code),
 			}
 			deleteError.send(&client.ssntpConn, "")
-			glog.Errorf("Unable to parse YAML: %s", payloadErr.err)
+			clog.Errorf("Unable to parse YAML: %s", payloadErr.err)
 			return
 		}
 		client.cmdCh <- &cmdWrapper{instance, &insDeleteCmd{}}
+	case ssntp.PREFETCH:
+		image, checksum, payloadErr := parsePrefetchPayload(payload)
+		if payloadErr != nil {
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", &prefetchCmd{image, checksum}}
+	case ssntp.STOPGROUP:
+		group, payloadErr := parseStopGroupPayload(payload)
+		if payloadErr != nil {
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", &groupCmd{group, false}}
+	case ssntp.DELETEGROUP:
+		group, payloadErr := parseDeleteGroupPayload(payload)
+		if payloadErr != nil {
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", &groupCmd{group, true}}
+	case ssntp.COLLECTDIAGNOSTICS:
+		instance, diagCmd, payloadErr := parseCollectDiagnosticsPayload(payload)
+		if payloadErr != nil {
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{instance, diagCmd}
+	case ssntp.SECURITYGROUP:
+		instance, sgCmd, payloadErr := parseSecurityGroupPayload(payload)
+		if payloadErr != nil {
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{instance, sgCmd}
+	case ssntp.POWERDOWN:
+		if payloadErr := parsePowerDownPayload(payload); payloadErr != nil {
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", &powerDownCmd{}}
+	case ssntp.RESERVE:
+		cmd, payloadErr := parseReservePayload(payload)
+		if payloadErr != nil {
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", cmd}
+	case ssntp.CONFIGURE:
+		cmd, payloadErr := parseConfigurePayload(payload)
+		if payloadErr != nil {
+			clog.Errorf("Unable to parse YAML: %v", payloadErr.err)
+			return
+		}
+		client.cmdCh <- &cmdWrapper{"", cmd}
 	}
 }
 
 func (client *agentClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
-	glog.Infof("EVENT %s", event)
+	clog.Infof("EVENT %s", event)
 }
 
 func (client *agentClient) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
-	glog.Infof("ERROR %d", err)
+	clog.Infof("ERROR %d", err)
 }
 
 func insCmdChannel(instance string, ovsCh chan<- interface{}) chan<- interface{} {
@@ -244,14 +487,39 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 	case *statusCmd:
 		ovsCh <- &ovsStatsStatusCmd{}
 		return
+	case *prefetchCmd:
+		go func() {
+			err := fetchImage(insCmd.image, insCmd.checksum)
+			if err != nil {
+				clog.Errorf("Unable to prefetch image %s: %v", insCmd.image, err)
+			}
+		}()
+		return
+	case *configureCmd:
+		ovsCh <- &ovsConfigureCmd{insCmd.limits, insCmd.settings}
+		return
+	case *reserveCmd:
+		ovsCh <- &ovsReserveCmd{insCmd.id, insCmd.hold}
+		return
+	case *groupCmd:
+		processGroupCommand(client, insCmd, ovsCh)
+		return
+	case *powerDownCmd:
+		processPowerDown(ovsCh)
+		return
 	case *insStartCmd:
 		targetCh := make(chan ovsAddResult)
 		ovsCh <- &ovsAddCmd{cmd.instance, insCmd.cfg, targetCh}
 		addResult := <-targetCh
 		if !addResult.canAdd {
-			glog.Errorf("Instance will make node full: Disk %d Mem %d CPUs %d",
-				insCmd.cfg.Disk, insCmd.cfg.Mem, insCmd.cfg.Cpus)
-			se := startError{nil, payloads.FullComputeNode}
+			if addResult.reason == payloads.TenantLimitExceeded {
+				clog.Errorf("Instance will exceed limits of tenant %s: Mem %d",
+					insCmd.cfg.TennantUUID, insCmd.cfg.Mem)
+			} else {
+				clog.Errorf("Instance will make node full: Disk %d Mem %d CPUs %d",
+					insCmd.cfg.Disk, insCmd.cfg.Mem, insCmd.cfg.Cpus)
+			}
+			se := startError{nil, addResult.reason}
 			se.send(client, cmd.instance)
 			return
 		}
@@ -260,7 +528,7 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 		insState := insState(cmd.instance, ovsCh)
 		target = insState.cmdCh
 		if target == nil {
-			glog.Errorf("Instance %s does not exist", cmd.instance)
+			clog.Errorf("Instance %s does not exist", cmd.instance)
 			de := deleteError{nil, payloads.DeleteNoInstance}
 			de.send(client, cmd.instance)
 			return
@@ -270,7 +538,7 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 	case *insStopCmd:
 		target = insCmdChannel(cmd.instance, ovsCh)
 		if target == nil {
-			glog.Errorf("Instance %s does not exist", cmd.instance)
+			clog.Errorf("Instance %s does not exist", cmd.instance)
 			se := stopError{nil, payloads.StopNoInstance}
 			se.send(client, cmd.instance)
 			return
@@ -278,17 +546,28 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 	case *insRestartCmd:
 		target = insCmdChannel(cmd.instance, ovsCh)
 		if target == nil {
-			glog.Errorf("Instance %s does not exist", cmd.instance)
+			clog.Errorf("Instance %s does not exist", cmd.instance)
 			re := restartError{nil, payloads.RestartNoInstance}
 			re.send(client, cmd.instance)
 			return
 		}
+	case *insDiagnosticsCmd:
+		target = insCmdChannel(cmd.instance, ovsCh)
+		if target == nil {
+			clog.Errorf("Instance %s does not exist", cmd.instance)
+			sendDiagnosticsError(client, cmd.instance,
+				fmt.Errorf("Instance %s does not exist", cmd.instance))
+			return
+		}
+		samplesCh := make(chan []diagnosticsSample)
+		ovsCh <- &ovsDiagnosticsCmd{cmd.instance, insCmd.samples, samplesCh}
+		insCmd.stats = <-samplesCh
 	default:
 		target = insCmdChannel(cmd.instance, ovsCh)
 	}
 
 	if target == nil {
-		glog.Errorf("Instance %s does not exist", cmd.instance)
+		clog.Errorf("Instance %s does not exist", cmd.instance)
 		return
 	}
 
@@ -304,7 +583,38 @@ func processCommand(client *ssntpConn, cmd *cmdWrapper, ovsCh chan<- interface{}
 	}
 }
 
-func connectToServer(doneCh chan struct{}, statusCh chan struct{}) {
+// processGroupCommand asks the overseer for the members of a group and then
+// stops or deletes each one in turn, exactly as if it had received a separate
+// STOP or DELETE command for the instance.  The commands are sent to the
+// instance go routines from here rather than from the overseer, as the
+// overseer must never block on an instance go routine.
+func processGroupCommand(client *ssntpConn, cmd *groupCmd, ovsCh chan<- interface{}) {
+	targetCh := make(chan []ovsGroupMember)
+	ovsCh <- &ovsGroupCmd{cmd.group, targetCh}
+	members := <-targetCh
+
+	dispatched := 0
+	for _, m := range members {
+		if cmd.delete {
+			processCommand(client, &cmdWrapper{m.instance, &insDeleteCmd{}}, ovsCh)
+		} else if m.running == ovsRunning {
+			processCommand(client, &cmdWrapper{m.instance, &insStopCmd{}}, ovsCh)
+		} else {
+			continue
+		}
+		dispatched++
+	}
+
+	op := "STOP"
+	if cmd.delete {
+		op = "DELETE"
+	}
+	clog.Infof("Sent %s to %d of %d instances in group %s", op, dispatched, len(members),
+		cmd.group)
+}
+
+func connectToServer(doneCh, drainCh chan struct{}, adminCh chan interface{},
+	statusCh chan struct{}) {
 
 	defer func() {
 		statusCh <- struct{}{}
@@ -319,8 +629,12 @@ func connectToServer(doneCh chan struct{}, statusCh chan struct{}) {
 		role = uint32(ssntp.AGENT)
 	}
 
-	cfg := &ssntp.Config{URI: serverURL, CAcert: serverCertPath, Cert: clientCertPath,
-		Role: uint32(role), Log: ssntp.Log}
+	cfg := &ssntp.Config{URI: serverURL, URIs: standbyServers, SRV: serverSRV,
+		CAcert: serverCertPath, Cert: clientCertPath,
+		Role: uint32(role), Log: clog.SSNTPLog{}, KeepaliveInterval: keepaliveInterval,
+		KeepaliveTimeout: keepaliveTimeout, Encodings: []payloads.Encoding{payloads.MsgPack},
+		AtLeastOnce: true, Metrics: ssntpMetrics, Transport: ssntpTransport,
+		Port: uint32(ssntpPort), Recording: ssntpRecording}
 	client := &agentClient{
 		cmdCh: make(chan *cmdWrapper),
 	}
@@ -332,7 +646,7 @@ func connectToServer(doneCh chan struct{}, statusCh chan struct{}) {
 	go func() {
 		err := client.Dial(cfg, client)
 		if err != nil {
-			glog.Errorf("Unable to connect to server %v", err)
+			clog.Errorf("Unable to connect to server %v", err)
 			dialCh <- err
 			return
 		}
@@ -341,6 +655,8 @@ func connectToServer(doneCh chan struct{}, statusCh chan struct{}) {
 	}()
 
 	dialing := true
+	var drain *drainer
+	var drainTimer <-chan time.Time
 
 DONE:
 	for {
@@ -369,18 +685,34 @@ DONE:
 			}
 
 			processCommand(&client.ssntpConn, cmd, ovsCh)
+		case cmd := <-adminCh:
+			ovsCh <- cmd
+		case <-drainCh:
+			drainCh = nil
+			drain = newDrainer(ovsCh)
+			drainTimer = time.After(0)
+		case <-drainTimer:
+			if drain.poll() {
+				client.Close()
+				if !dialing {
+					break DONE
+				}
+				drainTimer = nil
+				continue
+			}
+			drainTimer = time.After(drainPollPeriod)
 		}
 	}
 
 	close(ovsCh)
 	wg.Wait()
-	glog.Info("Overseer has closed down")
+	clog.Info("Overseer has closed down")
 }
 
 func getLock() error {
 	err := os.MkdirAll(lockDir, 0777)
 	if err != nil {
-		glog.Errorf("Unable to create lockdir %s", lockDir)
+		clog.Errorf("Unable to create lockdir %s", lockDir)
 		return err
 	}
 
@@ -388,14 +720,14 @@ func getLock() error {
 	lockPath := path.Join(lockDir, lockFile)
 	fd, err := syscall.Open(lockPath, syscall.O_CREAT, syscall.S_IWUSR|syscall.S_IRUSR)
 	if err != nil {
-		glog.Errorf("Unable to open lock file %v", err)
+		clog.Errorf("Unable to open lock file %v", err)
 		return err
 	}
 
 	syscall.CloseOnExec(fd)
 
 	if syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB) != nil {
-		glog.Error("Launcher is already running.  Exitting.")
+		clog.Error("Launcher is already running.  Exitting.")
 		return fmt.Errorf("Unable to lock file %s", lockPath)
 	}
 
@@ -433,23 +765,23 @@ func createMandatoryDirs() error {
 
 func purgeLauncherState() {
 
-	glog.Info("======= HARD RESET ======")
+	clog.Info("======= HARD RESET ======")
 
-	glog.Info("Shutting down running instances")
+	clog.Info("Shutting down running instances")
 
 	toRemove := make([]string, 0, 1024)
 	networking := false
 	dockerNetworking := false
 
-	glog.Info("Init networking")
+	clog.Info("Init networking")
 
 	if err := initNetworkPhase1(); err != nil {
-		glog.Warningf("Failed to init network: %v\n", err)
+		clog.Warningf("Failed to init network: %v\n", err)
 	} else {
 		networking = true
 		defer shutdownNetwork()
 		if err := initDockerNetworking(context.Background()); err != nil {
-			glog.Info("Unable to initialise docker networking")
+			clog.Info("Unable to initialise docker networking")
 		} else {
 			dockerNetworking = true
 		}
@@ -466,10 +798,12 @@ func purgeLauncherState() {
 
 		cfg, err := loadVMConfig(path)
 		if err != nil {
-			glog.Warningf("Unable to load config for %s: %v", path, err)
+			clog.Warningf("Unable to load config for %s: %v", path, err)
 		} else {
 			if cfg.Container {
 				dockerKillInstance(path)
+			} else if cfg.Hypervisor == payloads.CloudHypervisor {
+				chvKillInstance(path)
 			} else {
 				qemuKillInstance(path)
 			}
@@ -479,14 +813,26 @@ func purgeLauncherState() {
 	})
 
 	for _, p := range toRemove {
+		if err := wipeFile(path.Join(p, diskKeyFile)); err != nil {
+			clog.Warningf("Unable to wipe disk key in %s: %v", p, err)
+		}
 		err := os.RemoveAll(p)
 		if err != nil {
-			glog.Warningf("Unable to remove instance dir for %s: %v", p, err)
+			clog.Warningf("Unable to remove instance dir for %s: %v", p, err)
 		}
 	}
 
+	if err := os.RemoveAll(diagnosticsDir); err != nil {
+		clog.Warningf("Unable to remove diagnostics dir: %v", err)
+	}
+
+	err := os.Remove(path.Join(launcherDBDir, launcherDBFile))
+	if err != nil && !os.IsNotExist(err) {
+		clog.Warningf("Unable to remove launcher db: %v", err)
+	}
+
 	if dockerNetworking {
-		glog.Info("Reset docker networking")
+		clog.Info("Reset docker networking")
 
 		resetDockerNetworking()
 	}
@@ -495,11 +841,11 @@ func purgeLauncherState() {
 		return
 	}
 
-	glog.Info("Reset networking")
+	clog.Info("Reset networking")
 
-	err := cnNet.ResetNetwork()
+	err = cnNet.ResetNetwork()
 	if err != nil {
-		glog.Warningf("Unable to reset network: %v", err)
+		clog.Warningf("Unable to reset network: %v", err)
 	}
 }
 
@@ -507,29 +853,31 @@ func setLimits() {
 	var rlim syscall.Rlimit
 	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim)
 	if err != nil {
-		glog.Warningf("Getrlimit failed %v", err)
+		clog.Warningf("Getrlimit failed %v", err)
 		return
 	}
 
-	glog.Infof("Initial nofile limits: cur %d max %d", rlim.Cur, rlim.Max)
+	clog.Infof("Initial nofile limits: cur %d max %d", rlim.Cur, rlim.Max)
 
 	if rlim.Cur < rlim.Max {
 		oldCur := rlim.Cur
 		rlim.Cur = rlim.Max
 		err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
 		if err != nil {
-			glog.Warningf("Setrlimit failed %v", err)
+			clog.Warningf("Setrlimit failed %v", err)
 			rlim.Cur = oldCur
 		}
 	}
 
-	glog.Infof("Updated nofile limits: cur %d max %d", rlim.Cur, rlim.Max)
+	clog.Infof("Updated nofile limits: cur %d max %d", rlim.Cur, rlim.Max)
 
 	maxInstances = int(rlim.Cur / 5)
 }
 
 func startLauncher() int {
 	doneCh := make(chan struct{})
+	drainCh := make(chan struct{})
+	adminCh := make(chan interface{})
 	statusCh := make(chan struct{})
 	signalCh := make(chan os.Signal, 1)
 	timeoutCh := make(chan struct{})
@@ -540,12 +888,12 @@ func startLauncher() int {
 		ch := initNetworking(ctx)
 		select {
 		case <-signalCh:
-			glog.Info("Received terminating signal.  Quitting")
+			clog.Info("Received terminating signal.  Quitting")
 			cancelFunc()
 			return 1
 		case err := <-ch:
 			if err != nil {
-				glog.Errorf("Failed to init network: %v\n", err)
+				clog.Errorf("Failed to init network: %v\n", err)
 				return 1
 			}
 		}
@@ -553,24 +901,71 @@ func startLauncher() int {
 		defer shutdownNetwork()
 	}
 
-	go connectToServer(doneCh, statusCh)
+	if !cloudInitMode.NeedsISO() {
+		err := startMetadataService(metadataAddr)
+		if err != nil {
+			clog.Errorf("Unable to start metadata service: %v", err)
+			return 1
+		}
+		defer stopMetadataService()
+	}
+
+	var drainOnce sync.Once
+	startDrain := func() {
+		drainOnce.Do(func() {
+			clog.Info("Draining node")
+			close(drainCh)
+		})
+	}
+
+	if adminSocket != "" {
+		l, err := startAdminService(adminSocket, adminCh, startDrain)
+		if err != nil {
+			clog.Errorf("Unable to start admin service: %v", err)
+			return 1
+		}
+		defer func() {
+			_ = l.Close()
+		}()
+	}
+
+	if metricsAddr != "" {
+		l, err := startMetricsService(metricsAddr, adminCh)
+		if err != nil {
+			clog.Errorf("Unable to start metrics service: %v", err)
+			return 1
+		}
+		defer func() {
+			_ = l.Close()
+		}()
+	}
+
+	go connectToServer(doneCh, drainCh, adminCh, statusCh)
+
+	draining := false
 
 DONE:
 	for {
 		select {
-		case <-signalCh:
-			glog.Info("Received terminating signal.  Waiting for server loop to quit")
+		case sig := <-signalCh:
+			if sig == syscall.SIGTERM && !draining {
+				clog.Info("Received SIGTERM")
+				startDrain()
+				draining = true
+				continue
+			}
+			clog.Info("Received terminating signal.  Waiting for server loop to quit")
 			close(doneCh)
 			go func() {
 				time.Sleep(time.Second)
 				timeoutCh <- struct{}{}
 			}()
 		case <-statusCh:
-			glog.Info("Server Loop quit cleanly")
+			clog.Info("Server Loop quit cleanly")
 			break DONE
 		case <-timeoutCh:
-			glog.Warning("Server Loop did not exit within 1 second quitting")
-			glog.Flush()
+			clog.Warning("Server Loop did not exit within 1 second quitting")
+			clog.Flush()
 
 			/* We panic here to see which naughty go routines are still running. */
 
@@ -584,6 +979,8 @@ DONE:
 func main() {
 
 	flag.Parse()
+	clog.Init("ciao-launcher", logFormat)
+	initSettings()
 
 	if simulate == false && getLock() != nil {
 		os.Exit(1)
@@ -601,11 +998,11 @@ func main() {
 	}
 
 	defer func() {
-		glog.Flush()
-		glog.Info("Exit")
+		clog.Flush()
+		clog.Info("Exit")
 	}()
 
-	glog.Info("Starting Launcher")
+	clog.Info("Starting Launcher")
 
 	if hardReset {
 		purgeLauncherState()
@@ -614,10 +1011,27 @@ func main() {
 
 	setLimits()
 
-	glog.Infof("Launcher will allow a maximum of %d instances", maxInstances)
+	dnsRegistry = newDNSRegistrar(dnsWebhookURL, dnsServer, dnsZone, dnsKeyFile, dnsTTL)
+
+	var err error
+	instanceLogs, err = newLogShipper(instanceLogSink)
+	if err != nil {
+		clog.Fatalf("Unable to ship instance logs to %s: %v", instanceLogSink, err)
+	}
+
+	maintenanceWindows, err = loadMaintenanceWindows(maintenanceWindowsFile)
+	if err != nil {
+		clog.Fatalf("Unable to load maintenance windows: %v", err)
+	}
+
+	clog.Infof("Launcher will allow a maximum of %d instances", maxInstances)
 
 	if err := createMandatoryDirs(); err != nil {
-		glog.Fatalf("Unable to create mandatory dirs: %v", err)
+		clog.Fatalf("Unable to create mandatory dirs: %v", err)
+	}
+
+	if err := initImageCache(); err != nil {
+		clog.Fatalf("Unable to initialise image cache: %v", err)
 	}
 
 	os.Exit(startLauncher())
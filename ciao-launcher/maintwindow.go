@@ -0,0 +1,330 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+// maintenanceWindowPeriod is the interval at which the overseer checks
+// whether a maintenance window has opened or closed.
+const maintenanceWindowPeriod = 30 * time.Second
+
+// maxMaintenanceWindow is the longest a maintenance window can last.
+const maxMaintenanceWindow = 7 * 24 * time.Hour
+
+// maintenanceWindowsFile is the node-local file listing the maintenance
+// windows of the node, and maintenanceWindows the windows read from it at
+// startup.
+var maintenanceWindowsFile string
+var maintenanceWindows []*maintenanceWindow
+
+// maintenanceWindowConfig is an entry of the maintenance windows file.
+// Schedule is a crontab(5) time specification, e.g., "0 2 * * 6" for 2am
+// every Saturday, in the local time of the node, and Duration how long the
+// window stays open, e.g., "4h".
+type maintenanceWindowConfig struct {
+	Schedule string `yaml:"schedule"`
+	Duration string `yaml:"duration"`
+	Evacuate bool   `yaml:"evacuate,omitempty"`
+}
+
+// maintenanceWindow is a recurring period during which the node reports
+// itself in maintenance and, if evacuate is set, asks to be evacuated.
+type maintenanceWindow struct {
+	schedule string
+	spec     *cronSpec
+	duration time.Duration
+	evacuate bool
+}
+
+// cronSpec holds the minutes, hours, days of the month, months and days of
+// the week matched by a crontab(5) time specification, one bit per value.
+type cronSpec struct {
+	minutes    uint64
+	hours      uint64
+	days       uint64
+	months     uint64
+	weekdays   uint64
+	anyDay     bool
+	anyWeekday bool
+}
+
+var cronFields = [...]struct {
+	name string
+	min  int
+	max  int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// parseCronField parses a comma separated list of values, ranges and
+// steps, e.g., "*/15" or "1-5,0", whose values lie between min and max.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = part[:i], s
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+			lo, err = strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %q", part)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				hi, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, fmt.Errorf("invalid range in %q", part)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// parseCronSpec parses the five fields of a crontab(5) time specification.
+// Names of months and days are not supported.
+func parseCronSpec(spec string) (*cronSpec, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("%d fields expected in %q", len(cronFields), spec)
+	}
+
+	var bits [len(cronFields)]uint64
+	for i, f := range fields {
+		var err error
+		bits[i], err = parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid %s: %v", cronFields[i].name, err)
+		}
+	}
+
+	// Sunday is both 0 and 7
+
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+
+	return &cronSpec{
+		minutes:    bits[0],
+		hours:      bits[1],
+		days:       bits[2],
+		months:     bits[3],
+		weekdays:   bits[4],
+		anyDay:     strings.HasPrefix(fields[2], "*"),
+		anyWeekday: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+// matches returns true if the minute of t is matched by the specification.
+// As in cron, a day matches if either its day of the month or its day of
+// the week do when both are restricted.
+func (c *cronSpec) matches(t time.Time) bool {
+	if c.minutes&(1<<uint(t.Minute())) == 0 || c.hours&(1<<uint(t.Hour())) == 0 ||
+		c.months&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+
+	day := c.days&(1<<uint(t.Day())) != 0
+	weekday := c.weekdays&(1<<uint(t.Weekday())) != 0
+	if !c.anyDay && !c.anyWeekday {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// openAt returns true if the window is open at t, i.e., if it opened less
+// than its duration before t.
+func (w *maintenanceWindow) openAt(t time.Time) bool {
+	for start := t.Truncate(time.Minute); t.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+		if w.spec.matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// openWindow returns the first of windows that is open at t, or nil if
+// none is.
+func openWindow(windows []*maintenanceWindow, t time.Time) *maintenanceWindow {
+	for _, w := range windows {
+		if w.openAt(t) {
+			return w
+		}
+	}
+	return nil
+}
+
+func newMaintenanceWindow(c *maintenanceWindowConfig) (*maintenanceWindow, error) {
+	spec, err := parseCronSpec(c.Schedule)
+	if err != nil {
+		return nil, err
+	}
+
+	duration, err := time.ParseDuration(c.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid duration of %q: %v", c.Schedule, err)
+	}
+	if duration < time.Minute || duration > maxMaintenanceWindow {
+		return nil, fmt.Errorf("Duration of %q must be between %s and %s", c.Schedule,
+			time.Minute, maxMaintenanceWindow)
+	}
+
+	return &maintenanceWindow{
+		schedule: c.Schedule,
+		spec:     spec,
+		duration: duration,
+		evacuate: c.Evacuate,
+	}, nil
+}
+
+// loadMaintenanceWindows reads the maintenance windows file.  A missing file
+// holds no windows.
+func loadMaintenanceWindows(file string) ([]*maintenanceWindow, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var configs []maintenanceWindowConfig
+	err = yaml.Unmarshal(data, &configs)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", file, err)
+	}
+
+	windows := make([]*maintenanceWindow, 0, len(configs))
+	for i := range configs {
+		w, err := newMaintenanceWindow(&configs[i])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		windows = append(windows, w)
+	}
+
+	return windows, nil
+}
+
+// sendEvacuateRequest asks the scheduler to have the controllers evacuate
+// the node.  It returns false if the request could not be sent.  Peers that
+// predate agent EVACUATE commands do not get it.
+func sendEvacuateRequest(conn *ssntpConn) bool {
+	if !conn.isConnected() {
+		return false
+	}
+
+	if conn.PayloadVersion() < payloads.Version35 {
+		clog.Warning("Scheduler does not support evacuation requests")
+		return true
+	}
+
+	cmd := payloads.Evacuate{
+		Evacuate: payloads.EvacuateCmd{WorkloadAgentUUID: conn.UUID()},
+	}
+	payload, err := payloads.MarshalVersion(conn.Encoding(), &cmd, conn.PayloadVersion())
+	if err != nil {
+		clog.Errorf("Unable to Marshall EVACUATE %v", err)
+		return true
+	}
+
+	_, err = conn.SendCommand(ssntp.EVACUATE, payload)
+	if err != nil {
+		clog.Errorf("Failed to send EVACUATE command %v", err)
+		return false
+	}
+
+	clog.Info("Asked to be evacuated")
+	return true
+}
+
+// windowSchedule returns the schedule of the open maintenance window, or ""
+// if none is open.
+func (ovs *overseer) windowSchedule() string {
+	if ovs.window == nil {
+		return ""
+	}
+	return ovs.window.schedule
+}
+
+// checkMaintenanceWindows reports the node in maintenance while one of its
+// windows is open, and READY again, resources permitting, once it closes.
+// The evacuation request of a window is sent once, when it opens, or once
+// launcher connects if it is not connected at that time.
+func (ovs *overseer) checkMaintenanceWindows(now time.Time) {
+	w := openWindow(maintenanceWindows, now)
+	if w != ovs.window {
+		if w == nil {
+			clog.Infof("Maintenance window %q closed", ovs.window.schedule)
+		} else {
+			clog.Infof("Maintenance window %q opened", w.schedule)
+		}
+
+		ovs.evacuatePending = w != nil && w.evacuate &&
+			(ovs.window == nil || !ovs.window.evacuate)
+		ovs.window = w
+		if ovs.ac.ssntpConn.isConnected() {
+			cns := getStats()
+			ovs.updateAvailableResources(cns)
+			ovs.sendStatusCommand(cns, ovs.computeStatus())
+		}
+	}
+
+	if ovs.evacuatePending && sendEvacuateRequest(&ovs.ac.ssntpConn) {
+		ovs.evacuatePending = false
+	}
+}
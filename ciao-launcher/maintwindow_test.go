@@ -0,0 +1,184 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/01org/ciao/ssntp"
+)
+
+func TestParseCronSpec(t *testing.T) {
+	valid := []struct {
+		spec    string
+		time    string
+		matches bool
+	}{
+		{"0 2 * * 6", "2017-03-04 02:00", true},
+		{"0 2 * * 6", "2017-03-04 02:01", false},
+		{"0 2 * * 6", "2017-03-05 02:00", false},
+		{"*/15 * * * *", "2017-03-05 13:45", true},
+		{"*/15 * * * *", "2017-03-05 13:50", false},
+		{"5/20 * * * *", "2017-03-05 13:45", true},
+		{"0 22 * * 1-5", "2017-03-06 22:00", true},
+		{"0 22 * * 1-5", "2017-03-05 22:00", false},
+		{"0 0 * * 7", "2017-03-05 00:00", true},
+		{"0 0 1,15 * 1", "2017-03-15 00:00", true},
+		{"0 0 1,15 * 1", "2017-03-06 00:00", true},
+		{"0 0 1,15 * 1", "2017-03-07 00:00", false},
+		{"0 0 1 1-6/2 *", "2017-05-01 00:00", true},
+		{"0 0 1 1-6/2 *", "2017-06-01 00:00", false},
+	}
+
+	for _, v := range valid {
+		spec, err := parseCronSpec(v.spec)
+		if err != nil {
+			t.Errorf("Unable to parse %q: %v", v.spec, err)
+			continue
+		}
+
+		tm, err := time.Parse("2006-01-02 15:04", v.time)
+		if err != nil {
+			t.Fatalf("Bad test time %s: %v", v.time, err)
+		}
+		if spec.matches(tm) != v.matches {
+			t.Errorf("%q matching %s should be %v", v.spec, v.time, v.matches)
+		}
+	}
+
+	invalid := []string{"", "0 2 * *", "60 * * * *", "* 24 * * *", "* * 0 * *",
+		"* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *",
+		"1-b * * * *", "* * * * * *"}
+	for _, spec := range invalid {
+		if _, err := parseCronSpec(spec); err == nil {
+			t.Errorf("Invalid specification %q accepted", spec)
+		}
+	}
+}
+
+func TestMaintenanceWindowOpen(t *testing.T) {
+	w, err := newMaintenanceWindow(&maintenanceWindowConfig{
+		Schedule: "0 23 * * 6",
+		Duration: "2h",
+	})
+	if err != nil {
+		t.Fatalf("Unable to create window: %v", err)
+	}
+
+	saturday := time.Date(2017, 3, 4, 23, 0, 0, 0, time.Local)
+	checks := []struct {
+		offset time.Duration
+		open   bool
+	}{
+		{-time.Second, false},
+		{0, true},
+		{time.Hour, true},
+		{2*time.Hour - time.Second, true},
+		{2 * time.Hour, false},
+		{7 * 24 * time.Hour, true},
+	}
+
+	for _, c := range checks {
+		if w.openAt(saturday.Add(c.offset)) != c.open {
+			t.Errorf("Window open at %s should be %v", saturday.Add(c.offset), c.open)
+		}
+	}
+
+	for _, d := range []string{"", "30s", "1000h", "forever"} {
+		_, err := newMaintenanceWindow(&maintenanceWindowConfig{Schedule: "0 23 * * 6", Duration: d})
+		if err == nil {
+			t.Errorf("Window lasting %q accepted", d)
+		}
+	}
+}
+
+func TestLoadMaintenanceWindows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maintenance-windows")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	file := path.Join(dir, "maintenance-windows.yaml")
+	windows, err := loadMaintenanceWindows(file)
+	if err != nil || windows != nil {
+		t.Fatalf("Missing file should hold no windows: %v %v", windows, err)
+	}
+
+	data := "- schedule: \"0 2 * * 6\"\n  duration: 4h\n  evacuate: true\n" +
+		"- schedule: \"30 22 1 * *\"\n  duration: 90m\n"
+	if err = ioutil.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %v", file, err)
+	}
+
+	windows, err = loadMaintenanceWindows(file)
+	if err != nil {
+		t.Fatalf("Unable to load windows: %v", err)
+	}
+	if len(windows) != 2 || !windows[0].evacuate || windows[1].evacuate ||
+		windows[1].duration != 90*time.Minute {
+		t.Errorf("Unexpected windows %+v", windows)
+	}
+
+	if err = ioutil.WriteFile(file, []byte("- schedule: \"0 2 * *\"\n  duration: 4h\n"), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %v", file, err)
+	}
+	if _, err = loadMaintenanceWindows(file); err == nil {
+		t.Errorf("Invalid windows accepted")
+	}
+}
+
+func TestCheckMaintenanceWindows(t *testing.T) {
+	w, err := newMaintenanceWindow(&maintenanceWindowConfig{
+		Schedule: "0 2 * * *",
+		Duration: "1h",
+		Evacuate: true,
+	})
+	if err != nil {
+		t.Fatalf("Unable to create window: %v", err)
+	}
+
+	saved := maintenanceWindows
+	maintenanceWindows = []*maintenanceWindow{w}
+	defer func() { maintenanceWindows = saved }()
+
+	ovs := &overseer{
+		ac:        &agentClient{},
+		instances: make(map[string]*ovsInstanceState),
+	}
+
+	night := time.Date(2017, 3, 4, 2, 30, 0, 0, time.Local)
+	ovs.checkMaintenanceWindows(night)
+	if ovs.window != w || ovs.computeStatus() != ssntp.MAINTENANCE {
+		t.Fatalf("Node not in maintenance while window is open")
+	}
+	if !ovs.evacuatePending {
+		t.Errorf("Evacuation request should wait for launcher to connect")
+	}
+	if ovs.roomAvailable(&vmConfig{}) {
+		t.Errorf("Instance accepted while window is open")
+	}
+
+	ovs.checkMaintenanceWindows(night.Add(time.Hour))
+	if ovs.window != nil || ovs.evacuatePending || ovs.computeStatus() == ssntp.MAINTENANCE {
+		t.Errorf("Node still in maintenance once window closed")
+	}
+}
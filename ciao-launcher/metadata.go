@@ -0,0 +1,383 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/01org/ciao/clog"
+)
+
+// In metadata-service mode instances send their requests to the address
+// given by the -metadata-addr option, 169.254.169.254:80 by default, which
+// nothing on the tenant networks answers.  launcher assigns the address to
+// the node's loopback interface and serves each instance from a listener of
+// its own, bound to a port picked by the kernel.  The nftables rules of the
+// instance's vnic pass the requests it receives for the address, and the ARP
+// traffic for it, to the node's IP stack rather than bridging them, mark the
+// connections and translate their destination port to that of the
+// instance's listener.  The replies are routed back through the vnic by a
+// routing table, selected by the mark, that only contains a default route
+// through the vnic.  Requests are thus attributed to instances by the vnic
+// they are received on rather than by their source address, which another
+// tenant can reuse.
+
+// metadataMarkBase is ORed with the port of an instance's listener to obtain
+// the packet mark and the routing table of the connections to the listener.
+const metadataMarkBase = 0xc1a00000
+
+type metadataInstance struct {
+	instanceDir string
+	cfg         vmConfig
+	vnic        string
+	listener    net.Listener
+}
+
+// metadataRegistry maps the vnics of the instances running on the node to
+// the information needed to serve their metadata.  It is accessed both by
+// the instance go routines and by the main go routine, hence the mutex.
+type metadataRegistry struct {
+	sync.Mutex
+	addr      *net.TCPAddr
+	instances map[string]*metadataInstance
+}
+
+var metadata = &metadataRegistry{
+	instances: make(map[string]*metadataInstance),
+}
+
+// add registers mi, returning the instance previously registered for its
+// vnic, if any.
+func (m *metadataRegistry) add(mi *metadataInstance) *metadataInstance {
+	m.Lock()
+	defer m.Unlock()
+
+	prev := m.instances[mi.vnic]
+	m.instances[mi.vnic] = mi
+	return prev
+}
+
+// remove unregisters the instance identified by instance and returns it.
+func (m *metadataRegistry) remove(instance string) *metadataInstance {
+	m.Lock()
+	defer m.Unlock()
+
+	for vnic, mi := range m.instances {
+		if mi.cfg.Instance == instance {
+			delete(m.instances, vnic)
+			return mi
+		}
+	}
+	return nil
+}
+
+func (m *metadataRegistry) lookup(vnic string) (*metadataInstance, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	mi := m.instances[vnic]
+	if mi == nil {
+		return nil, fmt.Errorf("No instance found for vnic %s", vnic)
+	}
+	return mi, nil
+}
+
+func (m *metadataRegistry) serviceAddr() *net.TCPAddr {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.addr
+}
+
+func (m *metadataRegistry) setServiceAddr(addr *net.TCPAddr) {
+	m.Lock()
+	m.addr = addr
+	m.Unlock()
+}
+
+func (mi *metadataInstance) port() int {
+	return mi.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (mi *metadataInstance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	userData, metaData, err := loadCloudInitData(mi.instanceDir)
+	if err != nil {
+		clog.Errorf("Unable to load cloud-init data for %s: %v", mi.cfg.Instance, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	body, found := mi.resource(path.Clean(r.URL.Path), userData, metaData)
+	if !found {
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	_, _ = w.Write(body)
+}
+
+// resource returns the contents of the metadata resource identified by
+// urlPath.  Both the OpenStack and the EC2 layouts are supported.
+func (mi *metadataInstance) resource(urlPath string, userData, metaData []byte) ([]byte, bool) {
+	switch urlPath {
+	case "/openstack", "/openstack/latest":
+		return []byte("meta_data.json\nuser_data\n"), true
+	case "/openstack/latest/meta_data.json":
+		doc, err := openStackMetaDataDoc(&mi.cfg, metaData)
+		return doc, err == nil
+	case "/openstack/latest/user_data", "/latest/user-data":
+		return userData, true
+	case "/latest":
+		return []byte("meta-data/\nuser-data\n"), true
+	case "/latest/meta-data":
+		items := "hostname\ninstance-id\nlocal-hostname\n"
+		if len(mi.cfg.SSHKeys) > 0 {
+			items += "public-keys/\n"
+		}
+		return []byte(items), true
+	case "/latest/meta-data/instance-id":
+		return []byte(mi.cfg.Instance), true
+	case "/latest/meta-data/hostname", "/latest/meta-data/local-hostname":
+		return []byte(instanceHostname(&mi.cfg)), true
+	case "/latest/meta-data/public-keys":
+		var keys []string
+		for i := range mi.cfg.SSHKeys {
+			keys = append(keys, fmt.Sprintf("%d=key-%d", i, i))
+		}
+		return []byte(strings.Join(keys, "\n")), len(keys) > 0
+	}
+
+	const keysPrefix = "/latest/meta-data/public-keys/"
+	if strings.HasPrefix(urlPath, keysPrefix) {
+		parts := strings.Split(strings.TrimPrefix(urlPath, keysPrefix), "/")
+		i, err := strconv.Atoi(parts[0])
+		if err != nil || i < 0 || i >= len(mi.cfg.SSHKeys) {
+			return nil, false
+		}
+		if len(parts) == 1 {
+			return []byte("openssh-key"), true
+		} else if len(parts) == 2 && parts[1] == "openssh-key" {
+			return []byte(mi.cfg.SSHKeys[i]), true
+		}
+	}
+
+	return nil, false
+}
+
+// metadataTable returns the name of the nftables tables intercepting the
+// metadata requests received on vnic.
+func metadataTable(vnic string) string {
+	return nftTable(vnic) + "_metadata"
+}
+
+// metadataRuleset returns the nftables script replacing the tables that
+// pass the requests sent by the instance behind vnic to addr to the node's
+// IP stack, and redirect them to port, with ones that do so.
+func metadataRuleset(vnic string, addr *net.TCPAddr, port int) string {
+	var b bytes.Buffer
+	mark := metadataMarkBase | uint32(port)
+
+	for _, family := range []string{"bridge", "ip"} {
+		table := family + " " + metadataTable(vnic)
+		fmt.Fprintf(&b, "table %s\n", table)
+		fmt.Fprintf(&b, "delete table %s\n", table)
+	}
+
+	fmt.Fprintf(&b, "table bridge %s {\n", metadataTable(vnic))
+	fmt.Fprintf(&b, "\tchain prerouting {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook prerouting priority -300; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q ip daddr %s tcp dport %d meta pkttype set host meta broute set 1\n",
+		vnic, addr.IP, addr.Port)
+	fmt.Fprintf(&b, "\t\tiifname %q arp daddr ip %s meta pkttype set host meta broute set 1\n",
+		vnic, addr.IP)
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "}\n")
+
+	fmt.Fprintf(&b, "table ip %s {\n", metadataTable(vnic))
+	fmt.Fprintf(&b, "\tchain prerouting {\n")
+	fmt.Fprintf(&b, "\t\ttype filter hook prerouting priority -150; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q ip daddr %s tcp dport %d meta mark set 0x%x ct mark set 0x%x\n",
+		vnic, addr.IP, addr.Port, mark, mark)
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "\tchain dnat {\n")
+	fmt.Fprintf(&b, "\t\ttype nat hook prerouting priority -100; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tiifname %q meta mark 0x%x dnat to %s:%d\n", vnic, mark, addr.IP, port)
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "\tchain output {\n")
+	fmt.Fprintf(&b, "\t\ttype route hook output priority -150; policy accept;\n")
+	fmt.Fprintf(&b, "\t\tct mark 0x%x meta mark set 0x%x\n", mark, mark)
+	fmt.Fprintf(&b, "\t}\n")
+	fmt.Fprintf(&b, "}\n")
+
+	return b.String()
+}
+
+// metadataRouteCommands returns the arguments of the ip commands that route
+// the connections to port through vnic.
+func metadataRouteCommands(vnic string, port int) [][]string {
+	mark := strconv.FormatUint(uint64(metadataMarkBase|uint32(port)), 10)
+	return [][]string{
+		{"route", "replace", "default", "dev", vnic, "table", mark},
+		{"rule", "add", "fwmark", mark, "table", mark},
+	}
+}
+
+func runIP(args []string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("ip %s failed: %v: %s", strings.Join(args, " "),
+			err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// unrouteMetadata removes the routing of the connections to port.  The rule
+// is deleted first as it may exist more than once.
+func unrouteMetadata(port int) {
+	mark := strconv.FormatUint(uint64(metadataMarkBase|uint32(port)), 10)
+	for {
+		if err := runIP([]string{"rule", "del", "fwmark", mark, "table", mark}); err != nil {
+			break
+		}
+	}
+	_ = runIP([]string{"route", "flush", "table", mark})
+}
+
+// plumbMetadata intercepts the metadata requests received on the vnic of mi
+// and redirects them to its listener.
+func plumbMetadata(mi *metadataInstance, addr *net.TCPAddr) error {
+	port := mi.port()
+	unrouteMetadata(port)
+	for _, args := range metadataRouteCommands(mi.vnic, port) {
+		if err := runIP(args); err != nil {
+			return err
+		}
+	}
+
+	// The source address of the requests is checked against the routing
+	// table of their mark rather than the main one, through which the
+	// instance's subnet may not be reachable.
+	srcValidMark := path.Join("/proc/sys/net/ipv4/conf", mi.vnic, "src_valid_mark")
+	if err := ioutil.WriteFile(srcValidMark, []byte("1"), 0644); err != nil {
+		return err
+	}
+
+	return runNFT(metadataRuleset(mi.vnic, addr, port))
+}
+
+// unplumbMetadata stops intercepting the metadata requests received on the
+// vnic of mi.
+func unplumbMetadata(mi *metadataInstance) {
+	table := metadataTable(mi.vnic)
+	err := runNFT(fmt.Sprintf("table bridge %s\ndelete table bridge %s\ntable ip %s\ndelete table ip %s\n",
+		table, table, table, table))
+	if err != nil {
+		clog.Warningf("Unable to remove metadata rules of vnic %s: %v", mi.vnic, err)
+	}
+	unrouteMetadata(mi.port())
+}
+
+// serveMetadata starts serving the metadata of the instance described by
+// cfg to the requests received on vnic, replacing the instance previously
+// served on vnic, e.g., when an instance is restarted.
+func serveMetadata(vnic string, cfg *vmConfig, instanceDir string) error {
+	addr := metadata.serviceAddr()
+	if addr == nil {
+		return fmt.Errorf("Metadata service is not running")
+	}
+
+	l, err := net.Listen("tcp", net.JoinHostPort(addr.IP.String(), "0"))
+	if err != nil {
+		return err
+	}
+
+	mi := &metadataInstance{instanceDir: instanceDir, cfg: *cfg, vnic: vnic, listener: l}
+	if err := plumbMetadata(mi, addr); err != nil {
+		_ = l.Close()
+		unrouteMetadata(mi.port())
+		clog.Errorf("Unable to serve metadata on vnic %s: %v", vnic, err)
+		return err
+	}
+
+	if prev := metadata.add(mi); prev != nil {
+		_ = prev.listener.Close()
+		unrouteMetadata(prev.port())
+	}
+
+	go func() {
+		err := http.Serve(l, mi)
+		clog.Infof("Metadata service of instance %s exited: %v", cfg.Instance, err)
+	}()
+
+	clog.Infof("Serving metadata of instance %s on vnic %s, port %d", cfg.Instance, vnic, mi.port())
+
+	return nil
+}
+
+// stopServingMetadata stops serving the metadata of the instance identified
+// by cfg.
+func stopServingMetadata(cfg *vmConfig) {
+	if mi := metadata.remove(cfg.Instance); mi != nil {
+		_ = mi.listener.Close()
+		unplumbMetadata(mi)
+	}
+}
+
+// startMetadataService assigns the address of the metadata service, addr, to
+// the loopback interface so that the requests redirected to the listeners of
+// the instances are delivered locally.  The address is left in place when
+// launcher exits, as are the rules of the instances, which keep running.
+// They are replaced when launcher restarts.
+func startMetadataService(addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp4", addr)
+	if err != nil {
+		return err
+	}
+	if tcpAddr.IP.To4() == nil || tcpAddr.IP.IsUnspecified() || tcpAddr.Port == 0 {
+		return fmt.Errorf("Metadata service address %s must be an IPv4 address and port", addr)
+	}
+
+	err = runIP([]string{"addr", "replace", tcpAddr.IP.String() + "/32", "dev", "lo"})
+	if err != nil {
+		return err
+	}
+
+	metadata.setServiceAddr(tcpAddr)
+
+	clog.Infof("Metadata service available on %s", addr)
+
+	return nil
+}
+
+// stopMetadataService closes the listeners of all the instances.
+func stopMetadataService() {
+	metadata.Lock()
+	defer metadata.Unlock()
+
+	for _, mi := range metadata.instances {
+		_ = mi.listener.Close()
+	}
+}
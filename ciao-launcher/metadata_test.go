@@ -0,0 +1,126 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMetadataResource(t *testing.T) {
+	mi := &metadataInstance{
+		cfg: vmConfig{
+			Instance: "d7d86208-b46c-4465-9018-fe14087d415f",
+			Hostname: "ciao",
+			SSHKeys:  []string{"ssh-rsa AAAA ciao@ciao"},
+		},
+	}
+	userData := []byte("#cloud-config\n")
+
+	tests := []struct {
+		path  string
+		body  string
+		found bool
+	}{
+		{"/latest/meta-data/instance-id", mi.cfg.Instance, true},
+		{"/latest/meta-data/local-hostname", "ciao", true},
+		{"/latest/meta-data/public-keys", "0=key-0", true},
+		{"/latest/meta-data/public-keys/0/openssh-key", "ssh-rsa AAAA ciao@ciao", true},
+		{"/latest/meta-data/public-keys/1/openssh-key", "", false},
+		{"/latest/user-data", "#cloud-config\n", true},
+		{"/openstack/latest/user_data", "#cloud-config\n", true},
+		{"/latest/meta-data/wibble", "", false},
+	}
+
+	for _, test := range tests {
+		body, found := mi.resource(test.path, userData, nil)
+		if found != test.found || string(body) != test.body {
+			t.Errorf("Unexpected result for %s: %q %v", test.path, body, found)
+		}
+	}
+}
+
+func TestMetadataRegistry(t *testing.T) {
+	m := &metadataRegistry{instances: make(map[string]*metadataInstance)}
+	mi1 := &metadataInstance{cfg: vmConfig{Instance: "instance-1", VnicIP: "192.168.0.2"}, vnic: "tap-1"}
+	mi2 := &metadataInstance{cfg: vmConfig{Instance: "instance-2", VnicIP: "192.168.0.2"}, vnic: "tap-2"}
+
+	if prev := m.add(mi1); prev != nil {
+		t.Fatalf("Unexpected previous instance %s", prev.cfg.Instance)
+	}
+	if prev := m.add(mi2); prev != nil {
+		t.Fatalf("Unexpected previous instance %s", prev.cfg.Instance)
+	}
+
+	// Instances sharing an address are told apart by their vnic.
+	for _, mi := range []*metadataInstance{mi1, mi2} {
+		found, err := m.lookup(mi.vnic)
+		if err != nil || found != mi {
+			t.Fatalf("Unable to find %s: %v", mi.cfg.Instance, err)
+		}
+	}
+
+	restarted := &metadataInstance{cfg: mi1.cfg, vnic: "tap-1"}
+	if prev := m.add(restarted); prev != mi1 {
+		t.Fatalf("Expected instance-1 to be replaced")
+	}
+
+	if mi := m.remove("instance-1"); mi != restarted {
+		t.Fatalf("Expected instance-1 to be removed")
+	}
+	if _, err := m.lookup("tap-1"); err == nil {
+		t.Fatal("Expected lookup of removed instance to fail")
+	}
+	if mi := m.remove("instance-1"); mi != nil {
+		t.Fatal("Expected instance-1 to be removed only once")
+	}
+
+	if found, err := m.lookup("tap-2"); err != nil || found != mi2 {
+		t.Fatalf("Unable to find instance-2: %v", err)
+	}
+}
+
+func TestMetadataRuleset(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.ParseIP("169.254.169.254"), Port: 80}
+	script := metadataRuleset("tap-1", addr, 40000)
+
+	for _, s := range []string{
+		"table bridge ciao_tap_1_metadata\ndelete table bridge ciao_tap_1_metadata\n",
+		"table ip ciao_tap_1_metadata\ndelete table ip ciao_tap_1_metadata\n",
+		`iifname "tap-1" ip daddr 169.254.169.254 tcp dport 80 meta pkttype set host meta broute set 1`,
+		`iifname "tap-1" arp daddr ip 169.254.169.254 meta pkttype set host meta broute set 1`,
+		`iifname "tap-1" ip daddr 169.254.169.254 tcp dport 80 meta mark set 0xc1a09c40 ct mark set 0xc1a09c40`,
+		`iifname "tap-1" meta mark 0xc1a09c40 dnat to 169.254.169.254:40000`,
+		"ct mark 0xc1a09c40 meta mark set 0xc1a09c40",
+	} {
+		if !strings.Contains(script, s) {
+			t.Errorf("%q missing from ruleset:\n%s", s, script)
+		}
+	}
+}
+
+func TestMetadataRouteCommands(t *testing.T) {
+	expected := [][]string{
+		{"route", "replace", "default", "dev", "tap-1", "table", "3248528448"},
+		{"rule", "add", "fwmark", "3248528448", "table", "3248528448"},
+	}
+	if cmds := metadataRouteCommands("tap-1", 40000); !reflect.DeepEqual(cmds, expected) {
+		t.Errorf("Unexpected commands %v", cmds)
+	}
+}
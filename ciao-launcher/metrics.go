@@ -0,0 +1,280 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the launch and delete
+// duration histogram buckets.  Launches that download a backing image can
+// take minutes.
+var durationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// durationHistogram is a cumulative histogram of operation durations, in
+// the Prometheus sense.
+type durationHistogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// launcherMetrics counts the instance launches and deletions and how long
+// they took, by result.
+type launcherMetrics struct {
+	sync.Mutex
+	launches       map[string]uint64
+	launchDuration durationHistogram
+	deletes        map[string]uint64
+	deleteDuration durationHistogram
+}
+
+var metrics = newLauncherMetrics()
+
+func newLauncherMetrics() *launcherMetrics {
+	return &launcherMetrics{
+		launches: make(map[string]uint64),
+		deletes:  make(map[string]uint64),
+	}
+}
+
+func metricsResult(failed bool) string {
+	if failed {
+		return "failure"
+	}
+	return "success"
+}
+
+// launched records an instance launch or restart that took d.  The time
+// spent waiting for a launch slot is not included.
+func (m *launcherMetrics) launched(d time.Duration, failed bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.launches[metricsResult(failed)]++
+	m.launchDuration.observe(d)
+}
+
+// deleted records an instance deletion that took d.
+func (m *launcherMetrics) deleted(d time.Duration, failed bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.deletes[metricsResult(failed)]++
+	m.deleteDuration.observe(d)
+}
+
+// promWriter writes metrics in the Prometheus text exposition format.
+type promWriter struct {
+	w *bufio.Writer
+}
+
+func (p *promWriter) header(name, kind, help string) {
+	fmt.Fprintf(p.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (p *promWriter) value(name, labels string, v float64) {
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(p.w, "%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (p *promWriter) gauge(name, help string, v float64) {
+	p.header(name, "gauge", help)
+	p.value(name, "", v)
+}
+
+func (p *promWriter) boolGauge(name, help string, v bool) {
+	if v {
+		p.gauge(name, help, 1)
+	} else {
+		p.gauge(name, help, 0)
+	}
+}
+
+func (p *promWriter) counters(name, help string, byResult map[string]uint64) {
+	p.header(name, "counter", help)
+	for _, result := range []string{"success", "failure"} {
+		p.value(name, fmt.Sprintf("result=%q", result), float64(byResult[result]))
+	}
+}
+
+func (p *promWriter) histogram(name, help string, h *durationHistogram) {
+	p.header(name, "histogram", help)
+	for i, bound := range durationBuckets {
+		var count uint64
+		if h.counts != nil {
+			count = h.counts[i]
+		}
+		p.value(name+"_bucket", fmt.Sprintf("le=%q", strconv.FormatFloat(bound, 'g', -1, 64)), float64(count))
+	}
+	p.value(name+"_bucket", `le="+Inf"`, float64(h.count))
+	p.value(name+"_sum", "", h.sum)
+	p.value(name+"_count", "", float64(h.count))
+}
+
+// writeMetrics writes the node resources, the instances usage, the launch
+// and delete metrics and the SSNTP connection state to w in the Prometheus
+// text exposition format.
+func writeMetrics(w io.Writer, s *adminSnapshot, m *launcherMetrics) error {
+	p := &promWriter{w: bufio.NewWriter(w)}
+	r := &s.resources
+
+	p.boolGauge("ciao_launcher_ssntp_connected", "Whether launcher is connected to its SSNTP server.", r.Connected)
+	p.header("ciao_launcher_node_status", "gauge", "Status launcher reports for the node.")
+	p.value("ciao_launcher_node_status", fmt.Sprintf("status=%q", r.Status), 1)
+	p.boolGauge("ciao_launcher_draining", "Whether the node is being drained.", r.Draining)
+	p.boolGauge("ciao_launcher_maintenance", "Whether the node is in maintenance mode.", r.Maintenance)
+	p.boolGauge("ciao_launcher_maintenance_window", "Whether a maintenance window of the node is open.", r.MaintenanceWindow != "")
+	p.gauge("ciao_launcher_clock_offset_seconds", "How far the clock of the scheduler is ahead of the node one.", float64(r.ClockOffsetMS)/1000)
+
+	p.gauge("ciao_launcher_vcpus_allocated", "VCPUs allocated to instances.", float64(r.VCPUsAllocated))
+	p.gauge("ciao_launcher_vcpus_limit", "VCPUs that can be allocated to instances.", float64(r.VCPUsLimit))
+	p.gauge("ciao_launcher_memory_allocated_mb", "Memory allocated to instances, in MB.", float64(r.MemoryAllocatedMB))
+	p.gauge("ciao_launcher_memory_available_mb", "Memory available on the node, in MB.", float64(r.MemoryAvailableMB))
+	p.gauge("ciao_launcher_hugepages_allocated_mb", "Hugepages allocated to instances, in MB.", float64(r.HugepagesAllocatedMB))
+	p.gauge("ciao_launcher_hugepages_total_mb", "Hugepages of the node, in MB.", float64(r.HugepagesTotalMB))
+	p.gauge("ciao_launcher_disk_allocated_mb", "Disk space allocated to instances, in MB.", float64(r.DiskAllocatedMB))
+	p.gauge("ciao_launcher_disk_available_mb", "Disk space available on the node, in MB.", float64(r.DiskAvailableMB))
+	p.gauge("ciao_launcher_disk_used_mb", "Disk space used by instances, in MB.", float64(r.DiskUsedMB))
+	p.gauge("ciao_launcher_backing_images_mb", "Disk space used by backing images, in MB.", float64(r.BackingImagesMB))
+	p.gauge("ciao_launcher_launches_in_progress", "Instances being launched.", float64(r.Launching))
+	p.gauge("ciao_launcher_launches_queued", "Instances queued by the overseer, waiting for a launch slot.", float64(r.LaunchesQueued))
+
+	instances := make([]adminInstance, len(s.instances))
+	copy(instances, s.instances)
+	sort.Slice(instances, func(i, j int) bool { return instances[i].UUID < instances[j].UUID })
+
+	states := make(map[string]int)
+	for _, i := range instances {
+		states[i.State]++
+	}
+	stateNames := make([]string, 0, len(states))
+	for state := range states {
+		stateNames = append(stateNames, state)
+	}
+	sort.Strings(stateNames)
+
+	p.header("ciao_launcher_instances", "gauge", "Instances on the node, by state.")
+	for _, state := range stateNames {
+		p.value("ciao_launcher_instances", fmt.Sprintf("state=%q", state), float64(states[state]))
+	}
+
+	for _, usage := range []struct {
+		name string
+		help string
+		get  func(i *adminInstance) int
+	}{
+		{"ciao_launcher_instance_cpu_usage", "CPU usage of an instance, in percent of its VCPUs.",
+			func(i *adminInstance) int { return i.CPUUsage }},
+		{"ciao_launcher_instance_memory_usage_mb", "Memory used by an instance, in MB.",
+			func(i *adminInstance) int { return i.MemoryUsageMB }},
+		{"ciao_launcher_instance_disk_usage_mb", "Disk space used by an instance, in MB.",
+			func(i *adminInstance) int { return i.DiskUsageMB }},
+	} {
+		p.header(usage.name, "gauge", usage.help)
+		for i := range instances {
+			if v := usage.get(&instances[i]); v >= 0 {
+				p.value(usage.name, fmt.Sprintf("instance=%q", instances[i].UUID), float64(v))
+			}
+		}
+	}
+
+	m.Lock()
+	p.counters("ciao_launcher_launches_total", "Instance launches, by result.", m.launches)
+	p.histogram("ciao_launcher_launch_duration_seconds", "Time taken to launch instances.", &m.launchDuration)
+	p.counters("ciao_launcher_deletes_total", "Instance deletions, by result.", m.deletes)
+	p.histogram("ciao_launcher_delete_duration_seconds", "Time taken to delete instances.", &m.deleteDuration)
+	m.Unlock()
+
+	return p.w.Flush()
+}
+
+// metricsServer serves the launcher metrics to Prometheus.  It gets the
+// overseer's view of the node through the server loop, as adminServer does.
+type metricsServer struct {
+	admin *adminServer
+}
+
+func (ms *metricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/metrics" {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("%s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	s, err := ms.admin.snapshot()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := writeMetrics(w, s, metrics); err != nil {
+		clog.Warningf("Unable to write metrics: %v", err)
+	}
+}
+
+// startMetricsService serves the launcher metrics at /metrics on addr.  The
+// returned listener should be closed to stop the service.
+func startMetricsService(addr string, cmdCh chan<- interface{}) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ms := &metricsServer{admin: &adminServer{cmdCh: cmdCh}}
+
+	go func() {
+		err := http.Serve(l, ms)
+		clog.Infof("Metrics service exited: %v", err)
+	}()
+
+	clog.Infof("Metrics service listening on %s", addr)
+
+	return l, nil
+}
@@ -0,0 +1,133 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	m := newLauncherMetrics()
+	m.launched(200*time.Millisecond, false)
+	m.launched(45*time.Second, true)
+	m.deleted(time.Second, false)
+
+	s := &adminSnapshot{
+		instances: []adminInstance{
+			{
+				adminInstanceUsage: adminInstanceUsage{
+					MemoryUsageMB: 256,
+					DiskUsageMB:   -1,
+					CPUUsage:      10,
+				},
+				UUID:  "instance-2",
+				State: "running",
+			},
+			{
+				adminInstanceUsage: adminInstanceUsage{-1, -1, -1},
+				UUID:               "instance-1",
+				State:              "pending",
+			},
+		},
+		resources: adminResources{
+			Status:         "READY",
+			Connected:      true,
+			LaunchesQueued: 3,
+			VCPUsAllocated: 2,
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := writeMetrics(&buf, s, m); err != nil {
+		t.Fatalf("Unable to write metrics: %v", err)
+	}
+	out := buf.String()
+
+	for _, line := range []string{
+		"# TYPE ciao_launcher_ssntp_connected gauge",
+		"ciao_launcher_ssntp_connected 1",
+		`ciao_launcher_node_status{status="READY"} 1`,
+		"ciao_launcher_vcpus_allocated 2",
+		"ciao_launcher_launches_queued 3",
+		`ciao_launcher_instances{state="pending"} 1`,
+		`ciao_launcher_instances{state="running"} 1`,
+		`ciao_launcher_instance_memory_usage_mb{instance="instance-2"} 256`,
+		`ciao_launcher_instance_cpu_usage{instance="instance-2"} 10`,
+		`ciao_launcher_launches_total{result="success"} 1`,
+		`ciao_launcher_launches_total{result="failure"} 1`,
+		`ciao_launcher_launch_duration_seconds_bucket{le="0.25"} 1`,
+		`ciao_launcher_launch_duration_seconds_bucket{le="30"} 1`,
+		`ciao_launcher_launch_duration_seconds_bucket{le="60"} 2`,
+		`ciao_launcher_launch_duration_seconds_bucket{le="+Inf"} 2`,
+		"ciao_launcher_launch_duration_seconds_sum 45.2",
+		"ciao_launcher_launch_duration_seconds_count 2",
+		`ciao_launcher_deletes_total{result="success"} 1`,
+		"ciao_launcher_delete_duration_seconds_count 1",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("Metric %q not found in\n%s", line, out)
+		}
+	}
+
+	for _, metric := range []string{
+		`ciao_launcher_instance_disk_usage_mb{instance="instance-2"}`,
+		`{instance="instance-1"}`,
+	} {
+		if strings.Contains(out, metric) {
+			t.Errorf("Unknown usage %q reported", metric)
+		}
+	}
+}
+
+func TestMetricsServer(t *testing.T) {
+	cmdCh := make(chan interface{})
+	ms := &metricsServer{admin: &adminServer{cmdCh: cmdCh}}
+
+	go func() {
+		for cmd := range cmdCh {
+			if cmd, ok := cmd.(*ovsAdminCmd); ok {
+				cmd.targetCh <- &adminSnapshot{}
+			}
+		}
+	}()
+	defer close(cmdCh)
+
+	tests := []struct {
+		method string
+		path   string
+		code   int
+	}{
+		{"GET", "/metrics", http.StatusOK},
+		{"POST", "/metrics", http.StatusMethodNotAllowed},
+		{"GET", "/wibble", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		rec := httptest.NewRecorder()
+		ms.ServeHTTP(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.path,
+				test.code, rec.Code)
+		}
+	}
+}
@@ -24,8 +24,7 @@ import (
 
 	"golang.org/x/net/context"
 
-	"github.com/golang/glog"
-
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/networking/libsnnet"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
@@ -77,15 +76,15 @@ func initNetworkPhase1() error {
 func initDockerNetworking(ctx context.Context) error {
 	dockerPlugin := libsnnet.NewDockerPlugin()
 	if err := dockerPlugin.Init(); err != nil {
-		glog.Warningf("Docker Init failed: %v", err)
+		clog.Warningf("Docker Init failed: %v", err)
 		return err
 	}
 
 	if err := dockerPlugin.Start(); err != nil {
 		if err := dockerPlugin.Close(); err != nil {
-			glog.Warningf("Failed to close docker plugin: %v ", err)
+			clog.Warningf("Failed to close docker plugin: %v ", err)
 		}
-		glog.Warningf("Docker start failed: %v ", err)
+		clog.Warningf("Docker start failed: %v ", err)
 		return err
 	}
 
@@ -100,14 +99,37 @@ func shutdownNetwork() {
 	}
 
 	if err := dockerNet.Stop(); err != nil {
-		glog.Warningf("Docker stop failed: %v", err)
+		clog.Warningf("Docker stop failed: %v", err)
 	}
 
 	if err := dockerNet.Close(); err != nil {
-		glog.Warningf("Docker close failed: %v", err)
+		clog.Warningf("Docker close failed: %v", err)
 	}
 
-	glog.Infof("Docker networking shutdown successfully")
+	clog.Infof("Docker networking shutdown successfully")
+}
+
+// getGlobalIPv6 returns the first global unicast IPv6 address of the
+// interface, or an empty string if it has none.
+func getGlobalIPv6(name string) string {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return ""
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return ""
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() {
+			return ipNet.IP.String()
+		}
+	}
+
+	return ""
 }
 
 func initNetwork(ctx context.Context) error {
@@ -117,7 +139,7 @@ func initNetwork(ctx context.Context) error {
 	}
 
 	if err := initDockerNetworking(ctx); err != nil {
-		glog.Warning("Unable to initialise docker networking")
+		clog.Warning("Unable to initialise docker networking")
 	}
 
 	if err := cnNet.DbRebuild(nil); err != nil {
@@ -131,24 +153,28 @@ func initNetwork(ctx context.Context) error {
 
 	for i := 0; i < limit; i++ {
 		nicInfo = append(nicInfo, &payloads.NetworkStat{
-			NodeIP:  cnNet.ComputeAddr[i].IP.String(),
-			NodeMAC: cnNet.ComputeLink[i].Attrs().HardwareAddr.String(),
+			NodeIP:   cnNet.ComputeAddr[i].IP.String(),
+			NodeMAC:  cnNet.ComputeLink[i].Attrs().HardwareAddr.String(),
+			NodeIPv6: getGlobalIPv6(cnNet.ComputeLink[i].Attrs().Name),
 		})
-		glog.Infof("Network card %d Info", i)
-		glog.Infof("  IP address of node is %s", nicInfo[i].NodeIP)
-		glog.Infof("  MAC address of node is %s", nicInfo[i].NodeMAC)
+		clog.Infof("Network card %d Info", i)
+		clog.Infof("  IP address of node is %s", nicInfo[i].NodeIP)
+		clog.Infof("  MAC address of node is %s", nicInfo[i].NodeMAC)
+		if nicInfo[i].NodeIPv6 != "" {
+			clog.Infof("  IPv6 address of node is %s", nicInfo[i].NodeIPv6)
+		}
 	}
 
 	if len(nicInfo) == 0 {
-		glog.Warning("Unable to determine IP address. Should not happen")
+		clog.Warning("Unable to determine IP address. Should not happen")
 	}
 
 	var err error
 	hostname, err = os.Hostname()
 	if err == nil {
-		glog.Infof("Hostname of node is %s", hostname)
+		clog.Infof("Hostname of node is %s", hostname)
 	} else {
-		glog.Warning("Unable to determine hostname %s", err)
+		clog.Warning("Unable to determine hostname %s", err)
 	}
 
 	return nil
@@ -165,7 +191,7 @@ func initNetworking(ctx context.Context) chan error {
 
 func createCNVnicCfg(cfg *vmConfig) (*libsnnet.VnicConfig, error) {
 
-	glog.Info("Creating CN Vnic CFG")
+	clog.Info("Creating CN Vnic CFG")
 
 	mac, err := net.ParseMAC(cfg.VnicMAC)
 	if err != nil {
@@ -187,6 +213,20 @@ func createCNVnicCfg(cfg *vmConfig) (*libsnnet.VnicConfig, error) {
 		return nil, fmt.Errorf("Invalid vnicIP ip %s", cfg.VnicIP)
 	}
 
+	var vnicIPv6 net.IP
+	var vnet6 *net.IPNet
+	if cfg.SubnetIPv6 != "" {
+		_, vnet6, err = net.ParseCIDR(cfg.SubnetIPv6)
+		if err != nil || vnet6.IP.To4() != nil {
+			return nil, fmt.Errorf("Invalid vnic IPv6 subnet %s", cfg.SubnetIPv6)
+		}
+
+		vnicIPv6 = net.ParseIP(cfg.VnicIPv6)
+		if vnicIPv6 == nil || !vnet6.Contains(vnicIPv6) {
+			return nil, fmt.Errorf("Invalid vnic IPv6 ip %s", cfg.VnicIPv6)
+		}
+	}
+
 	subnetKey := binary.LittleEndian.Uint32(vnet.IP)
 	var role libsnnet.VnicRole
 	if cfg.Container {
@@ -206,12 +246,14 @@ func createCNVnicCfg(cfg *vmConfig) (*libsnnet.VnicConfig, error) {
 		InstanceID: cfg.Instance,
 		TenantID:   cfg.TennantUUID,
 		SubnetID:   cfg.SubnetIP,
-		ConcID:     cfg.ConcUUID}, nil
+		ConcID:     cfg.ConcUUID,
+		VnicIPv6:   vnicIPv6,
+		SubnetIPv6: vnet6}, nil
 }
 
 func createCNCIVnicCfg(cfg *vmConfig) (*libsnnet.VnicConfig, error) {
 
-	glog.Info("Creating CNCI Vnic CFG")
+	clog.Info("Creating CNCI Vnic CFG")
 
 	mac, err := net.ParseMAC(cfg.VnicMAC)
 	if err != nil {
@@ -243,13 +285,46 @@ func sendNetworkEvent(client *ssntpConn, eventType ssntp.Event,
 
 	payload, err := generateNetEventPayload(event, client.UUID())
 	if err != nil {
-		glog.Warningf("Unable parse ssntpEvent %s", err)
+		clog.Warningf("Unable parse ssntpEvent %s", err)
 		return
 	}
 
 	_, err = client.SendEvent(eventType, payload)
 	if err != nil {
-		glog.Warningf("Unable to send %s", event)
+		clog.Warningf("Unable to send %s", event)
+	}
+}
+
+// sendTenantNetworksReport reports the tenant bridges of the compute node,
+// and whether their tunnel is present, to the scheduler.  Schedulers that
+// predate the TenantNetworksReport event do not get it.
+func sendTenantNetworksReport(client *ssntpConn) {
+	if cnNet == nil || !client.isConnected() || client.PayloadVersion() < payloads.Version16 {
+		return
+	}
+
+	event := payloads.EventTenantNetworksReport{
+		Report: payloads.TenantNetworksReport{AgentUUID: client.UUID()},
+	}
+	for _, b := range cnNet.TenantBridges() {
+		event.Report.Networks = append(event.Report.Networks, payloads.TenantNetwork{
+			TenantUUID:       b.TenantID,
+			TenantSubnet:     b.SubnetID,
+			ConcentratorUUID: b.ConcID,
+			ConcentratorIP:   b.ConcIP,
+			Tunnel:           b.Tunnel,
+		})
+	}
+
+	payload, err := payloads.MarshalVersion(client.Encoding(), &event, client.PayloadVersion())
+	if err != nil {
+		clog.Errorf("Unable to Marshall TenantNetworksReport %v", err)
+		return
+	}
+
+	_, err = client.SendEvent(ssntp.TenantNetworksReport, payload)
+	if err != nil {
+		clog.Errorf("Failed to send TenantNetworksReport event %v", err)
 	}
 }
 
@@ -267,28 +342,28 @@ func createVnic(client *ssntpConn, vnicCfg *libsnnet.VnicConfig) (string, string
 		if vnicCfg.VnicRole == libsnnet.TenantContainer {
 			vnic, event, info, err = createDockerVnic(vnicCfg)
 			if err != nil {
-				glog.Errorf("cn.CreateVnic failed %v", err)
+				clog.Errorf("cn.CreateVnic failed %v", err)
 				return "", "", err
 			}
 			bridge = info.SubnetID
 		} else {
 			vnic, event, info, err = cnNet.CreateVnic(vnicCfg)
 			if err != nil {
-				glog.Errorf("cn.CreateVnic failed %v", err)
+				clog.Errorf("cn.CreateVnic failed %v", err)
 				return "", "", err
 			}
 		}
 		sendNetworkEvent(client, ssntp.TenantAdded, event)
 		name = vnic.LinkName
-		glog.Infoln("CN VNIC created =", name, info, event)
+		clog.Infoln("CN VNIC created =", name, info, event)
 	} else {
 		vnic, err := cnNet.CreateCnciVnic(vnicCfg)
 		if err != nil {
-			glog.Errorf("cn.CreateCnciVnic failed %v", err)
+			clog.Errorf("cn.CreateCnciVnic failed %v", err)
 			return "", "", err
 		}
 		name = vnic.LinkName
-		glog.Infoln("CNCI VNIC created =", name)
+		clog.Infoln("CNCI VNIC created =", name)
 	}
 
 	return name, bridge, nil
@@ -305,21 +380,21 @@ func destroyVnic(client *ssntpConn, vnicCfg *libsnnet.VnicConfig) error {
 			event, _, err = cnNet.DestroyVnic(vnicCfg)
 		}
 		if err != nil {
-			glog.Errorf("cn.DestroyVnic failed %v", err)
+			clog.Errorf("cn.DestroyVnic failed %v", err)
 			return err
 		}
 
 		sendNetworkEvent(client, ssntp.TenantRemoved, event)
 
-		glog.Infoln("CN VNIC Destroyed =", vnicCfg.VnicIP, event)
+		clog.Infoln("CN VNIC Destroyed =", vnicCfg.VnicIP, event)
 	} else {
 		err := cnNet.DestroyCnciVnic(vnicCfg)
 		if err != nil {
-			glog.Errorf("cn.DestroyCnciVnic failed %v", err)
+			clog.Errorf("cn.DestroyCnciVnic failed %v", err)
 			return err
 		}
 
-		glog.Infoln("CNCI VNIC Destroyed =", vnicCfg.VnicIP)
+		clog.Infoln("CNCI VNIC Destroyed =", vnicCfg.VnicIP)
 	}
 
 	return nil
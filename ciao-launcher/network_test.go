@@ -0,0 +1,71 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+)
+
+func testCNVmConfig() *vmConfig {
+	return &vmConfig{
+		Instance:    "67d86208-b46c-4465-9018-fe14087d415f",
+		VnicMAC:     "02:00:e6:f5:af:f9",
+		VnicIP:      "192.168.8.2",
+		ConcIP:      "10.0.0.1",
+		SubnetIP:    "192.168.8.0/24",
+		TennantUUID: "8a497cb2-7b23-4e1c-8d41-cd4b2b4f2e5b",
+		ConcUUID:    "c7d5c1b3-6f06-4dd2-9e4b-ff4cdcf1a7b9",
+		VnicUUID:    "2a3b1c58-2a0d-4ea8-b64c-0cd8e0c2bc8f",
+	}
+}
+
+func TestCreateCNVnicCfgIPv6(t *testing.T) {
+	cfg := testCNVmConfig()
+	vnicCfg, err := createCNVnicCfg(cfg)
+	if err != nil {
+		t.Fatalf("Unable to create IPv4 vnic config: %v", err)
+	}
+	if vnicCfg.VnicIPv6 != nil || vnicCfg.SubnetIPv6 != nil {
+		t.Errorf("IPv4 vnic config has IPv6 addresses: %+v", vnicCfg)
+	}
+
+	cfg.SubnetIPv6 = "fd00:8::/64"
+	cfg.VnicIPv6 = "fd00:8::2"
+	vnicCfg, err = createCNVnicCfg(cfg)
+	if err != nil {
+		t.Fatalf("Unable to create dual-stack vnic config: %v", err)
+	}
+	if vnicCfg.VnicIPv6.String() != "fd00:8::2" || vnicCfg.SubnetIPv6.String() != "fd00:8::/64" ||
+		vnicCfg.VnicIP.String() != "192.168.8.2" {
+		t.Errorf("Wrong dual-stack vnic config: %+v", vnicCfg)
+	}
+
+	for _, bad := range []struct {
+		subnet string
+		ip     string
+	}{
+		{"fd00:8::/64", "fd00:9::2"},
+		{"fd00:8::/64", ""},
+		{"192.168.9.0/24", "192.168.9.2"},
+	} {
+		cfg.SubnetIPv6 = bad.subnet
+		cfg.VnicIPv6 = bad.ip
+		if _, err := createCNVnicCfg(cfg); err == nil {
+			t.Errorf("IPv6 address %s in subnet %s accepted", bad.ip, bad.subnet)
+		}
+	}
+}
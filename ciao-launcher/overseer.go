@@ -20,15 +20,20 @@ import (
 	"bufio"
 	"container/list"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/01org/ciao/clog"
+	"golang.org/x/net/context"
 
 	"gopkg.in/yaml.v2"
 
@@ -39,6 +44,7 @@ import (
 type ovsAddResult struct {
 	cmdCh  chan<- interface{}
 	canAdd bool
+	reason payloads.StartFailureReason
 }
 
 type ovsAddCmd struct {
@@ -66,6 +72,27 @@ type ovsRemoveCmd struct {
 type ovsStateChange struct {
 	instance string
 	state    ovsRunningState
+	crashed  bool
+}
+
+type ovsBootPhaseChange struct {
+	instance string
+	phase    string
+}
+
+type ovsGuestStatsUpdateCmd struct {
+	instance    string
+	filesystems []payloads.GuestFilesystemStat
+}
+
+type ovsNetStatsUpdateCmd struct {
+	instance string
+	network  *payloads.InstanceNetworkStat
+}
+
+type ovsSecurityGroupCmd struct {
+	instance string
+	version  uint64
 }
 
 type ovsStatsUpdateCmd struct {
@@ -73,12 +100,71 @@ type ovsStatsUpdateCmd struct {
 	memoryUsageMB int
 	diskUsageMB   int
 	CPUUsage      int
+	sampled       time.Time
 }
 
 type ovsTraceFrame struct {
 	frame *ssntp.Frame
 }
 
+type ovsLaunchTrace struct {
+	trace payloads.LaunchTrace
+}
+
+type ovsDrainResult struct {
+	running map[string]chan<- interface{}
+	pending int
+}
+
+type ovsDrainCmd struct {
+	targetCh chan<- ovsDrainResult
+}
+
+type ovsAdminCmd struct {
+	targetCh chan<- *adminSnapshot
+}
+
+type ovsGroupMember struct {
+	instance string
+	running  ovsRunningState
+}
+
+type ovsActiveCmd struct {
+	targetCh chan<- int
+}
+
+type ovsGroupCmd struct {
+	group    string
+	targetCh chan<- []ovsGroupMember
+}
+
+// ovsLaunchSlotCmd is sent by an instance go routine that wants to launch
+// its instance.  The overseer sends a single value on grantCh, which must be
+// buffered, when the launch may proceed.
+type ovsLaunchSlotCmd struct {
+	instance string
+	grantCh  chan<- struct{}
+}
+
+type ovsLaunchDoneCmd struct {
+	instance string
+}
+
+type ovsDiagnosticsCmd struct {
+	instance string
+	samples  int
+	targetCh chan<- []diagnosticsSample
+}
+
+type ovsMaintenanceCmd struct {
+	enabled bool
+}
+
+type ovsConfigureCmd struct {
+	limits   map[string]tenantLimit
+	settings launcherSettings
+}
+
 type ovsStatusCmd struct{}
 type ovsStatsStatusCmd struct{}
 
@@ -97,6 +183,8 @@ const (
 	memLWM       = 512
 )
 
+const hugepagesSysfsDir = "/sys/kernel/mm/hugepages"
+
 type ovsInstanceState struct {
 	cmdCh          chan<- interface{}
 	running        ovsRunningState
@@ -107,7 +195,27 @@ type ovsInstanceState struct {
 	maxVCPUs       int
 	maxMemoryMB    int
 	sshIP          string
+	sshIPv6        string
 	sshPort        int
+	hugepages      bool
+	hugepagesInUse bool
+	pciDevs        []string
+	cores          []int
+	diskIOPS       int
+	ingressKbps    int
+	egressKbps     int
+	image          string
+	tenant         string
+	group          string
+	bootPhase      string
+	reportedState  string
+	guestFS        []payloads.GuestFilesystemStat
+	network        *payloads.InstanceNetworkStat
+	securityGroup  uint64
+	balloonMin     int
+	balloonMB      int
+	sampledAt      time.Time
+	unhealthy      bool
 }
 
 type overseer struct {
@@ -121,8 +229,28 @@ type overseer struct {
 	diskSpaceAllocated int
 	memoryAllocated    int
 	diskSpaceAvailable int
+	diskSpaceUsed      int
+	backingImagesMB    int
 	memoryAvailable    int
+	hugepagesAllocated int
+	hugepagesTotalMB   int
+	hugepagesFreeMB    int
+	pciDevsAllocated   map[string]string
+	reservations       nodeReservations
+	holds              map[string]*resourceHold
 	traceFrames        *list.List
+	launchTraces       []payloads.LaunchTrace
+	draining           bool
+	maintenance        bool
+	window             *maintenanceWindow
+	evacuatePending    bool
+	statsHistory       []adminStatsSample
+	db                 *launcherDB
+	tenantLimits       map[string]tenantLimit
+	maxLaunches        int
+	launching          map[string]struct{}
+	launchQueue        []*ovsLaunchSlotCmd
+	cpusOnline         int
 }
 
 type cnStats struct {
@@ -131,7 +259,16 @@ type cnStats struct {
 	totalDiskMB     int
 	availableDiskMB int
 	load            int
+	cpuPressure     float64
+	memPressure     float64
 	cpusOnline      int
+	powerWatts      int
+	cpuTemperature  int
+	hugepages       []payloads.HugepageStat
+	hugepagesMB     int
+	hugepagesFreeMB int
+	vfs             []string
+	gpuGroups       [][]string
 }
 
 var memTotalRegexp *regexp.Regexp
@@ -139,6 +276,8 @@ var memFreeRegexp *regexp.Regexp
 var memActiveFileRegexp *regexp.Regexp
 var memInactiveFileRegexp *regexp.Regexp
 var cpuStatsRegexp *regexp.Regexp
+var hugepageSizeRegexp *regexp.Regexp
+var hugepagesDirRegexp *regexp.Regexp
 
 func init() {
 	memTotalRegexp = regexp.MustCompile(`MemTotal:\s+(\d+)`)
@@ -146,6 +285,8 @@ func init() {
 	memActiveFileRegexp = regexp.MustCompile(`Active\(file\):\s+(\d+)`)
 	memInactiveFileRegexp = regexp.MustCompile(`Inactive\(file\):\s+(\d+)`)
 	cpuStatsRegexp = regexp.MustCompile(`^cpu[0-9]+.*$`)
+	hugepageSizeRegexp = regexp.MustCompile(`Hugepagesize:\s+(\d+)`)
+	hugepagesDirRegexp = regexp.MustCompile(`^hugepages-(\d+)kB$`)
 }
 
 func grabInt(re *regexp.Regexp, line string, val *int) bool {
@@ -235,6 +376,75 @@ func getOnlineCPUs() int {
 	return cpusOnline
 }
 
+func readSysfsInt(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+
+	val, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+
+	return val
+}
+
+func getDefaultHugepageSizeKB() int {
+	size := -1
+
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return size
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if grabInt(hugepageSizeRegexp, scanner.Text(), &size) {
+			break
+		}
+	}
+
+	return size
+}
+
+// getHugepageInfo returns the state of each of the hugepage pools configured
+// on the node together with the size, in MB, of the pool of default sized
+// hugepages and of its free pages.  This is the pool used by qemu when it is
+// passed -mem-path.
+func getHugepageInfo() (pools []payloads.HugepageStat, defaultPoolMB, defaultFreeMB int) {
+	dirs, err := ioutil.ReadDir(hugepagesSysfsDir)
+	if err != nil {
+		return
+	}
+
+	defaultSize := getDefaultHugepageSizeKB()
+	for _, d := range dirs {
+		var size int
+		if !grabInt(hugepagesDirRegexp, d.Name(), &size) {
+			continue
+		}
+
+		poolDir := filepath.Join(hugepagesSysfsDir, d.Name())
+		pool := payloads.HugepageStat{
+			SizeKB: size,
+			Total:  readSysfsInt(filepath.Join(poolDir, "nr_hugepages")),
+			Free:   readSysfsInt(filepath.Join(poolDir, "free_hugepages")),
+		}
+		pools = append(pools, pool)
+
+		if size == defaultSize && pool.Total > 0 {
+			defaultPoolMB = (pool.Total * size) / 1024
+			defaultFreeMB = (pool.Free * size) / 1024
+		}
+	}
+
+	return
+}
+
 func getFSInfo() (total, available int) {
 
 	total = -1
@@ -278,26 +488,180 @@ func getLoadAvg() int {
 	return int(loadFloat)
 }
 
+// getCPUPressure returns the some avg60 value from /proc/pressure/cpu, or -1
+// if the kernel does not support pressure stall information.
+func getCPUPressure() float64 {
+	return getPressure("/proc/pressure/cpu")
+}
+
+// getMemoryPressure returns the some avg60 value from /proc/pressure/memory,
+// i.e., the percentage of time some tasks were stalled reclaiming memory or
+// waiting for it to be swapped in, or -1 if the kernel does not support
+// pressure stall information.
+func getMemoryPressure() float64 {
+	return getPressure("/proc/pressure/memory")
+}
+
+func getPressure(p string) float64 {
+	file, err := os.Open(p)
+	if err != nil {
+		return -1
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	return parsePressure(file)
+}
+
+func parsePressure(r io.Reader) float64 {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "some" {
+			continue
+		}
+		for _, f := range fields[1:] {
+			if !strings.HasPrefix(f, "avg60=") {
+				continue
+			}
+			pressure, err := strconv.ParseFloat(strings.TrimPrefix(f, "avg60="), 64)
+			if err != nil {
+				return -1
+			}
+			return pressure
+		}
+	}
+
+	return -1
+}
+
+// vcpuLimit returns the maximum number of vCPUs that can be allocated to
+// instances on the node, or -1 if the number of vCPUs is not limited.
+func (ovs *overseer) vcpuLimit() int {
+	if cpuOvercommit <= 0 || ovs.cpusOnline <= 0 {
+		return -1
+	}
+
+	return int(cpuOvercommit * float64(ovs.cpusOnline))
+}
+
+// normalizeCPUUsage converts usage, a percentage of a single host CPU, into
+// a percentage of the vCPUs allocated to an instance.  The result is capped
+// at 100 as instances started without an explicit number of vCPUs, and
+// docker containers in particular, may use more than one host CPU.
+func normalizeCPUUsage(usage, vcpus int) int {
+	if usage < 0 {
+		return -1
+	}
+
+	if vcpus > 1 {
+		usage /= vcpus
+	}
+	if usage > 100 {
+		usage = 100
+	}
+
+	return usage
+}
+
+// hugepagesAvailable returns the amount of default sized hugepages, in MB,
+// that can be allocated to a new instance.  The kernel's free count already
+// accounts for the pages used by running instances and by processes other
+// than launcher, so we only need to subtract the pages allocated to instances
+// that were not running when it was last sampled.
+func (ovs *overseer) hugepagesAvailable() int {
+	available := ovs.hugepagesFreeMB
+	for _, target := range ovs.instances {
+		if target.hugepages && !target.hugepagesInUse {
+			available -= target.maxMemoryMB
+		}
+	}
+	return available
+}
+
 func (ovs *overseer) roomAvailable(cfg *vmConfig) bool {
 
+	if ovs.draining {
+		clog.Warning("Node is draining.  Refusing new instance")
+		return false
+	}
+
+	if ovs.maintenance {
+		clog.Warning("Node is in maintenance.  Refusing new instance")
+		return false
+	}
+
+	if ovs.window != nil {
+		clog.Warningf("Node is in maintenance window %q.  Refusing new instance",
+			ovs.window.schedule)
+		return false
+	}
+
 	if len(ovs.instances) >= maxInstances {
-		glog.Warningf("We're FULL.  Too many instances %d", len(ovs.instances))
+		clog.Warningf("We're FULL.  Too many instances %d", len(ovs.instances))
 		return false
 	}
 
-	diskSpaceAvailable := ovs.diskSpaceAvailable - cfg.Disk
-	memoryAvailable := ovs.memoryAvailable - cfg.Mem
+	held := ovs.heldResources()
+	vcpusAllocated := ovs.vcpusAllocated + held.vcpus
 
-	glog.Infof("disk Avail %d MemAvail %d", diskSpaceAvailable, memoryAvailable)
+	if limit := ovs.vcpuLimit(); limit >= 0 && vcpusAllocated+cfg.Cpus > limit {
+		clog.Warningf("Insufficient vCPUs.  Need %d have %d", cfg.Cpus,
+			limit-vcpusAllocated)
+		return false
+	}
 
-	if diskSpaceAvailable < diskSpaceLWM {
-		if diskLimit == true {
+	diskSpaceAvailable := ovs.diskSpaceAvailable - held.diskMB - cfg.allocatedDiskMB()
+	memoryAvailable := ovs.memoryAvailable - held.memMB
+
+	// qemu preallocates the entire memory of hugepage backed instances
+	// so we cannot overcommit here, regardless of the value of memLimit.
+
+	if cfg.Hugepages {
+		hugepagesAvailable := ovs.hugepagesAvailable()
+		if hugepagesAvailable < cfg.Mem {
+			clog.Warningf("Insufficient hugepages.  Need %d MB have %d MB",
+				cfg.Mem, hugepagesAvailable)
 			return false
 		}
+	} else {
+		memoryAvailable -= cfg.Mem
 	}
 
-	if memoryAvailable < memLWM {
-		if memLimit == true {
+	if cfg.SRIOVVFs > 0 {
+		vfsAvailable := len(ovs.freePCIDevices(getSRIOVVFs()))
+		if vfsAvailable < cfg.SRIOVVFs {
+			clog.Warningf("Insufficient SR-IOV VFs.  Need %d have %d",
+				cfg.SRIOVVFs, vfsAvailable)
+			return false
+		}
+	}
+
+	if cfg.GPUs > 0 {
+		gpusAvailable := len(ovs.freeGPUGroups(getGPUGroups()))
+		if gpusAvailable < cfg.GPUs {
+			clog.Warningf("Insufficient GPUs.  Need %d have %d",
+				cfg.GPUs, gpusAvailable)
+			return false
+		}
+	}
+
+	if !ovs.reservations.fits(cfg) {
+		return false
+	}
+
+	clog.Infof("disk Avail %d MemAvail %d", diskSpaceAvailable, memoryAvailable)
+
+	s := getSettings()
+	if diskSpaceAvailable < s.diskSpaceLWM {
+		if s.diskLimit == true {
+			return false
+		}
+	}
+
+	if memoryAvailable < s.memLWM {
+		if s.memLimit == true {
 			return false
 		}
 	}
@@ -305,49 +669,243 @@ func (ovs *overseer) roomAvailable(cfg *vmConfig) bool {
 	return true
 }
 
+// tenantLimitExceeded returns true if adding an instance with the
+// configuration cfg would take its tenant over the limits pushed to us in a
+// CONFIGURE command.  These limits apply regardless of whether the node has
+// room for the instance.
+func (ovs *overseer) tenantLimitExceeded(cfg *vmConfig) bool {
+	limit, ok := ovs.tenantLimits[cfg.TennantUUID]
+	if !ok {
+		return false
+	}
+
+	instances := 1
+	memMB := cfg.Mem
+	for _, target := range ovs.instances {
+		if target.tenant == cfg.TennantUUID {
+			instances++
+			memMB += target.maxMemoryMB
+		}
+	}
+
+	if limit.maxInstances > 0 && instances > limit.maxInstances {
+		clog.Warningf("Tenant %s would exceed its instance limit of %d",
+			cfg.TennantUUID, limit.maxInstances)
+		return true
+	}
+
+	if limit.maxMemMB > 0 && memMB > limit.maxMemMB {
+		clog.Warningf("Tenant %s would exceed its memory limit of %d MB",
+			cfg.TennantUUID, limit.maxMemMB)
+		return true
+	}
+
+	return false
+}
+
+// requestLaunchSlot grants cmd's request immediately if fewer than
+// maxLaunches instances are being launched and queues it otherwise.
+func (ovs *overseer) requestLaunchSlot(cmd *ovsLaunchSlotCmd) {
+	if ovs.maxLaunches > 0 && len(ovs.launching) >= ovs.maxLaunches {
+		clog.Infof("Overseer: %d launches in progress, queuing %s",
+			len(ovs.launching), cmd.instance)
+		ovs.launchQueue = append(ovs.launchQueue, cmd)
+		return
+	}
+
+	ovs.launching[cmd.instance] = struct{}{}
+	cmd.grantCh <- struct{}{}
+}
+
+// releaseLaunchSlot is called when an instance has finished launching or
+// has been deleted.  A deleted instance may still be queued, in which case
+// it is simply dropped from the queue.  Otherwise its slot is handed to the
+// next queued instance.
+func (ovs *overseer) releaseLaunchSlot(instance string) {
+	if _, ok := ovs.launching[instance]; !ok {
+		for i, cmd := range ovs.launchQueue {
+			if cmd.instance == instance {
+				ovs.launchQueue = append(ovs.launchQueue[:i], ovs.launchQueue[i+1:]...)
+				break
+			}
+		}
+		return
+	}
+
+	delete(ovs.launching, instance)
+	for len(ovs.launchQueue) > 0 &&
+		(ovs.maxLaunches <= 0 || len(ovs.launching) < ovs.maxLaunches) {
+		next := ovs.launchQueue[0]
+		ovs.launchQueue = ovs.launchQueue[1:]
+		ovs.launching[next.instance] = struct{}{}
+		next.grantCh <- struct{}{}
+	}
+}
+
+// groupMembers returns the instances that belong to group, sorted by UUID so
+// that bulk operations are applied in a predictable order.
+func (ovs *overseer) groupMembers(group string) []ovsGroupMember {
+	members := make([]ovsGroupMember, 0, len(ovs.instances))
+	for instance, target := range ovs.instances {
+		if target.group == group {
+			members = append(members, ovsGroupMember{instance, target.running})
+		}
+	}
+	sort.Sort(ovsGroupMembers(members))
+	return members
+}
+
+type ovsGroupMembers []ovsGroupMember
+
+func (m ovsGroupMembers) Len() int           { return len(m) }
+func (m ovsGroupMembers) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m ovsGroupMembers) Less(i, j int) bool { return m[i].instance < m[j].instance }
+
+func (ovs *overseer) freePCIDevices(devs []string) []string {
+	free := make([]string, 0, len(devs))
+	for _, dev := range devs {
+		if _, ok := ovs.pciDevsAllocated[dev]; !ok {
+			free = append(free, dev)
+		}
+	}
+	return free
+}
+
+// allocatePCIDevices assigns needed devices from devs to instance.  The caller
+// must already have checked, via roomAvailable, that enough devices are free.
+func (ovs *overseer) allocatePCIDevices(instance string, devs []string, needed int) []string {
+	if needed <= 0 {
+		return nil
+	}
+
+	allocated := make([]string, 0, needed)
+	for _, dev := range ovs.freePCIDevices(devs)[:needed] {
+		ovs.pciDevsAllocated[dev] = instance
+		allocated = append(allocated, dev)
+	}
+	return allocated
+}
+
+// freeGPUGroups returns the IOMMU groups of GPUs none of whose GPUs are
+// assigned to an instance.
+func (ovs *overseer) freeGPUGroups(groups [][]string) [][]string {
+	free := make([][]string, 0, len(groups))
+	for _, group := range groups {
+		if len(ovs.freePCIDevices(group)) == len(group) {
+			free = append(free, group)
+		}
+	}
+	return free
+}
+
+// allocateGPUs assigns all the GPUs of needed free IOMMU groups from groups to
+// instance.  The caller must already have checked, via roomAvailable, that
+// enough groups are free.
+func (ovs *overseer) allocateGPUs(instance string, groups [][]string, needed int) []string {
+	if needed <= 0 {
+		return nil
+	}
+
+	var allocated []string
+	for _, group := range ovs.freeGPUGroups(groups)[:needed] {
+		allocated = append(allocated, ovs.allocatePCIDevices(instance, group, len(group))...)
+	}
+	return allocated
+}
+
+func (ovs *overseer) imagesInUse() map[string]bool {
+	inUse := make(map[string]bool)
+	for _, target := range ovs.instances {
+		if target.image != "" {
+			inUse[target.image] = true
+		}
+	}
+	return inUse
+}
+
 func (ovs *overseer) updateAvailableResources(cns *cnStats) {
 	diskSpaceConsumed := 0
 	memConsumed := 0
+	memReclaimed := 0
 	for _, target := range ovs.instances {
 		if target.diskUsageMB != -1 {
 			diskSpaceConsumed += target.diskUsageMB
 		}
 
-		if target.memoryUsageMB != -1 {
-			if target.memoryUsageMB < target.maxMemoryMB {
+		target.hugepagesInUse = target.hugepages && target.running == ovsRunning
+
+		// Ballooned guests cannot use the memory reclaimed from them.
+		maxMemoryMB := target.maxMemoryMB - target.balloonMB
+		memReclaimed += target.balloonMB
+
+		if target.memoryUsageMB != -1 && !target.hugepages {
+			if target.memoryUsageMB < maxMemoryMB {
 				memConsumed += target.memoryUsageMB
 			} else {
-				memConsumed += target.maxMemoryMB
+				memConsumed += maxMemoryMB
 			}
 		}
 	}
 
 	ovs.diskSpaceAvailable = (cns.availableDiskMB + diskSpaceConsumed) -
 		ovs.diskSpaceAllocated
+	ovs.diskSpaceUsed = diskSpaceConsumed
+
+	// Images that are not used by any instance can be evicted from the
+	// image cache so the space they occupy is considered to be available.
+	// If we're actually running low on disk space we evict some now.
+
+	inUse := ovs.imagesInUse()
+	ovs.backingImagesMB = 0
+	for image := range inUse {
+		ovs.backingImagesMB += imageSizeMB(image)
+	}
 
-	ovs.memoryAvailable = (cns.availableMemMB + memConsumed) -
+	if hwm := getSettings().diskSpaceHWM; ovs.diskSpaceAvailable < hwm {
+		ovs.diskSpaceAvailable += evictImages(hwm-ovs.diskSpaceAvailable, inUse)
+	}
+	ovs.diskSpaceAvailable += reclaimableImagesMB(inUse)
+
+	ovs.memoryAvailable = (cns.availableMemMB + memConsumed + memReclaimed) -
 		ovs.memoryAllocated
+	ovs.adjustBalloons()
+
+	ovs.hugepagesTotalMB = cns.hugepagesMB
+	ovs.hugepagesFreeMB = cns.hugepagesFreeMB
+	if cns.cpusOnline > 0 {
+		ovs.cpusOnline = cns.cpusOnline
+	}
 
-	if glog.V(1) {
-		glog.Infof("Memory Available: %d Disk space Available %d",
-			ovs.memoryAvailable, ovs.diskSpaceAvailable)
+	if clog.V(1) {
+		clog.Infof("Memory Available: %d Disk space Available %d Hugepages Available %d",
+			ovs.memoryAvailable, ovs.diskSpaceAvailable,
+			ovs.hugepagesAvailable())
 	}
 }
 
 func (ovs *overseer) computeStatus() ssntp.Status {
 
+	if ovs.draining || ovs.maintenance || ovs.window != nil {
+		return ssntp.MAINTENANCE
+	}
+
 	if len(ovs.instances) >= maxInstances {
 		return ssntp.FULL
 	}
 
-	if ovs.diskSpaceAvailable < diskSpaceHWM {
-		if diskLimit == true {
+	if limit := ovs.vcpuLimit(); limit >= 0 && ovs.vcpusAllocated >= limit {
+		return ssntp.FULL
+	}
+
+	s := getSettings()
+	if ovs.diskSpaceAvailable < s.diskSpaceHWM {
+		if s.diskLimit == true {
 			return ssntp.FULL
 		}
 	}
 
-	if ovs.memoryAvailable < memHWM {
-		if memLimit == true {
+	if ovs.memoryAvailable < s.memHWM {
+		if s.memLimit == true {
 			return ssntp.FULL
 		}
 	}
@@ -360,21 +918,45 @@ func (ovs *overseer) sendStatusCommand(cns *cnStats, status ssntp.Status) {
 
 	s.Init()
 
+	// The resources held for reservations are not available to the
+	// scheduler for other instances.
+	held := ovs.heldResources()
+
 	s.NodeUUID = ovs.ac.ssntpConn.UUID()
-	s.MemTotalMB, s.MemAvailableMB = cns.totalMemMB, cns.availableMemMB
+	s.MemTotalMB, s.MemAvailableMB = cns.totalMemMB, unheld(cns.availableMemMB, held.memMB)
 	s.Load = cns.load
 	s.CpusOnline = cns.cpusOnline
-	s.DiskTotalMB, s.DiskAvailableMB = cns.totalDiskMB, cns.availableDiskMB
+	s.MemPressure = cns.memPressure
+	s.PowerWatts = cns.powerWatts
+	s.CPUTemperatureC = cns.cpuTemperature
+	s.DiskTotalMB, s.DiskAvailableMB = cns.totalDiskMB, unheld(cns.availableDiskMB, held.diskMB)
+	s.Hugepages = cns.hugepages
+	s.SRIOVVFsTotal = len(cns.vfs)
+	s.SRIOVVFsAvailable = len(ovs.freePCIDevices(cns.vfs))
+	s.GPUsTotal = len(cns.gpuGroups)
+	s.GPUsAvailable = len(ovs.freeGPUGroups(cns.gpuGroups))
+	s.DedicatedCoresTotal = len(dedicatedCPUs)
+	s.DedicatedCoresAvailable = len(ovs.reservations.freeCores())
+	s.DiskIOPSTotal, s.DiskIOPSAvailable = available(diskIOPSCapacity, ovs.reservations.diskIOPS)
+	s.NetBandwidthKbps, s.NetIngressKbpsAvailable = available(netBandwidthKbps, ovs.reservations.ingressKbps)
+	_, s.NetEgressKbpsAvailable = available(netBandwidthKbps, ovs.reservations.egressKbps)
+	if networking.NetworkNode() {
+		s.CNCIsTotal, s.CNCIsAvailable = available(maxCNCIs, len(ovs.instances))
+		s.CNCIBandwidthKbps, s.CNCIBandwidthKbpsAvailable = available(cnciBandwidthKbps, ovs.reservations.cnciKbps())
+		s.PublicIPsTotal, s.PublicIPsAvailable = available(publicIPPool, len(ovs.instances))
+	}
 
-	payload, err := yaml.Marshal(&s)
+	payload, err := payloads.MarshalVersion(ovs.ac.ssntpConn.Encoding(), &s, ovs.ac.ssntpConn.PayloadVersion())
 	if err != nil {
-		glog.Errorf("Unable to Marshall Status %v", err)
+		clog.Errorf("Unable to Marshall Status %v", err)
 		return
 	}
 
-	_, err = ovs.ac.ssntpConn.SendStatus(status, payload)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*statsSendTimeout)
+	defer cancel()
+	_, err = ovs.ac.ssntpConn.SendStatusContext(ctx, status, payload)
 	if err != nil {
-		glog.Errorf("Failed to send status command %v", err)
+		clog.Errorf("Failed to send status command %v", err)
 		return
 	}
 }
@@ -389,7 +971,22 @@ func (ovs *overseer) sendStats(cns *cnStats, status ssntp.Status) {
 	s.MemTotalMB, s.MemAvailableMB = cns.totalMemMB, cns.availableMemMB
 	s.Load = cns.load
 	s.CpusOnline = cns.cpusOnline
+	s.VCPUsAllocated = ovs.vcpusAllocated
+	s.CPUPressure = cns.cpuPressure
+	s.MemPressure = cns.memPressure
+	s.PowerWatts = cns.powerWatts
+	s.CPUTemperatureC = cns.cpuTemperature
 	s.DiskTotalMB, s.DiskAvailableMB = cns.totalDiskMB, cns.availableDiskMB
+	s.DiskAllocatedMB = ovs.diskSpaceAllocated
+	s.DiskUsedMB = ovs.diskSpaceUsed
+	s.BackingImagesMB = ovs.backingImagesMB
+	s.GPUsTotal = len(cns.gpuGroups)
+	s.GPUsAvailable = len(ovs.freeGPUGroups(cns.gpuGroups))
+	s.DedicatedCoresTotal = len(dedicatedCPUs)
+	s.DedicatedCoresAvailable = len(ovs.reservations.freeCores())
+	s.DiskIOPSTotal, s.DiskIOPSAvailable = available(diskIOPSCapacity, ovs.reservations.diskIOPS)
+	s.NetBandwidthKbps, s.NetIngressKbpsAvailable = available(netBandwidthKbps, ovs.reservations.ingressKbps)
+	_, s.NetEgressKbpsAvailable = available(netBandwidthKbps, ovs.reservations.egressKbps)
 	s.NodeHostName = hostname // global from network.go
 	s.Networks = make([]payloads.NetworkStat, len(nicInfo))
 	for i, nic := range nicInfo {
@@ -399,38 +996,160 @@ func (ovs *overseer) sendStats(cns *cnStats, status ssntp.Status) {
 	i := 0
 	for uuid, state := range ovs.instances {
 		s.Instances[i].InstanceUUID = uuid
-		if state.running == ovsRunning {
-			s.Instances[i].State = payloads.Running
-		} else if state.running == ovsStopped {
-			s.Instances[i].State = payloads.Exited
-		} else {
-			s.Instances[i].State = payloads.Pending
-		}
+		s.Instances[i].State = reportedState(state.payloadState(), ovs.ac.ssntpConn.PayloadVersion())
+		s.Instances[i].BootPhase = state.bootPhase
+		s.Instances[i].GuestFilesystems = state.guestFS
+		s.Instances[i].Network = state.network
 		s.Instances[i].MemoryUsageMB = state.memoryUsageMB
 		s.Instances[i].DiskUsageMB = state.diskUsageMB
 		s.Instances[i].CPUUsage = state.CPUUsage
 		s.Instances[i].SSHIP = state.sshIP
+		s.Instances[i].SSHIPv6 = state.sshIPv6
 		s.Instances[i].SSHPort = state.sshPort
+		s.Instances[i].SecurityGroupVersion = state.securityGroup
+		s.Instances[i].BalloonMB = state.balloonMB
+		if !state.sampledAt.IsZero() {
+			s.Instances[i].SampledAt = state.sampledAt.Format(time.RFC3339Nano)
+		}
 		i++
 	}
+	s.CachedImages = cachedImageUUIDs()
 
-	payload, err := yaml.Marshal(&s)
+	payload, err := payloads.MarshalVersion(ovs.ac.ssntpConn.Encoding(), &s, ovs.ac.ssntpConn.PayloadVersion())
 	if err != nil {
-		glog.Errorf("Unable to Marshall STATS %v", err)
+		clog.Errorf("Unable to Marshall STATS %v", err)
 		return
 	}
 
-	_, err = ovs.ac.ssntpConn.SendCommand(ssntp.STATS, payload)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*statsSendTimeout)
+	defer cancel()
+	_, err = ovs.ac.ssntpConn.SendCommandContext(ctx, ssntp.STATS, payload)
 	if err != nil {
-		glog.Errorf("Failed to send stats command %v", err)
+		clog.Errorf("Failed to send stats command %v", err)
 		return
 	}
 }
 
+func (state *ovsInstanceState) payloadState() string {
+	if state.running == ovsRunning {
+		if state.unhealthy {
+			return payloads.Unhealthy
+		}
+		return payloads.Running
+	} else if state.running == ovsStopped {
+		return payloads.Exited
+	}
+	return payloads.Pending
+}
+
+// recordStats appends the latest node and instance statistics to the stats
+// history, discarding the oldest sample if the history is full.
+func (ovs *overseer) recordStats(cns *cnStats) {
+	sample := adminStatsSample{
+		Time:            time.Now(),
+		MemTotalMB:      cns.totalMemMB,
+		MemAvailableMB:  cns.availableMemMB,
+		DiskTotalMB:     cns.totalDiskMB,
+		DiskAvailableMB: cns.availableDiskMB,
+		Load:            cns.load,
+		CPUPressure:     cns.cpuPressure,
+		MemPressure:     cns.memPressure,
+		Instances:       make(map[string]adminInstanceUsage),
+	}
+	for uuid, state := range ovs.instances {
+		sample.Instances[uuid] = adminInstanceUsage{
+			MemoryUsageMB: state.memoryUsageMB,
+			DiskUsageMB:   state.diskUsageMB,
+			CPUUsage:      state.CPUUsage,
+		}
+	}
+
+	ovs.statsHistory = append(ovs.statsHistory, sample)
+	if len(ovs.statsHistory) > statsHistoryLen {
+		ovs.statsHistory = ovs.statsHistory[len(ovs.statsHistory)-statsHistoryLen:]
+	}
+
+	if err := ovs.db.addSample(&sample); err != nil {
+		clog.Warningf("Unable to persist stats sample: %v", err)
+	}
+}
+
+func (ovs *overseer) adminSnapshot() *adminSnapshot {
+	s := &adminSnapshot{
+		instances: make([]adminInstance, 0, len(ovs.instances)),
+		resources: adminResources{
+			Status:               ovs.computeStatus().String(),
+			Draining:             ovs.draining,
+			Maintenance:          ovs.maintenance,
+			MaintenanceWindow:    ovs.windowSchedule(),
+			Launching:            len(ovs.launching),
+			LaunchesQueued:       len(ovs.launchQueue),
+			VCPUsAllocated:       ovs.vcpusAllocated,
+			VCPUsLimit:           ovs.vcpuLimit(),
+			MemoryAllocatedMB:    ovs.memoryAllocated,
+			MemoryAvailableMB:    ovs.memoryAvailable,
+			HugepagesAllocatedMB: ovs.hugepagesAllocated,
+			HugepagesTotalMB:     ovs.hugepagesTotalMB,
+			HugepagesAvailableMB: ovs.hugepagesAvailable(),
+			DiskAllocatedMB:      ovs.diskSpaceAllocated,
+			DiskAvailableMB:      ovs.diskSpaceAvailable,
+			DiskUsedMB:           ovs.diskSpaceUsed,
+			BackingImagesMB:      ovs.backingImagesMB,
+			PCIDevices:           make(map[string]string),
+		},
+		stats: make([]adminStatsSample, len(ovs.statsHistory)),
+	}
+
+	if ovs.ac != nil {
+		s.resources.Connected = ovs.ac.ssntpConn.isConnected()
+		if offset, _, ok := ovs.ac.ssntpConn.ClockOffset(); ok {
+			s.resources.ClockOffsetMS = int64(offset / time.Millisecond)
+		}
+	}
+
+	for uuid, state := range ovs.instances {
+		s.instances = append(s.instances, adminInstance{
+			adminInstanceUsage: adminInstanceUsage{
+				MemoryUsageMB: state.memoryUsageMB,
+				DiskUsageMB:   state.diskUsageMB,
+				CPUUsage:      state.CPUUsage,
+			},
+			UUID:       uuid,
+			State:      state.payloadState(),
+			BootPhase:  state.bootPhase,
+			GuestFS:    state.guestFS,
+			Network:    state.network,
+			MaxMemory:  state.maxMemoryMB,
+			MaxDisk:    state.maxDiskUsageMB,
+			MaxVCPUs:   state.maxVCPUs,
+			SSHIP:      state.sshIP,
+			SSHIPv6:    state.sshIPv6,
+			SSHPort:    state.sshPort,
+			Hugepages:  state.hugepages,
+			PCIDevices: state.pciDevs,
+			Image:      state.image,
+
+			SecurityGroupVersion: state.securityGroup,
+			BalloonMB:            state.balloonMB,
+		})
+	}
+
+	for dev, instance := range ovs.pciDevsAllocated {
+		s.resources.PCIDevices[dev] = instance
+	}
+
+	// The samples are never modified once recorded so it's safe to share
+	// their instance maps with the admin service.
+
+	copy(s.stats, ovs.statsHistory)
+
+	return s
+}
+
 func (ovs *overseer) sendTraceReport() {
 	var s payloads.Trace
 
-	if ovs.traceFrames.Len() == 0 {
+	if ovs.traceFrames.Len() == 0 && len(ovs.launchTraces) == 0 {
 		return
 	}
 
@@ -438,7 +1157,7 @@ func (ovs *overseer) sendTraceReport() {
 		f := e.Value.(*ssntp.Frame)
 		frameTrace, err := f.DumpTrace()
 		if err != nil {
-			glog.Errorf("Unable to dump traced frame %v", err)
+			clog.Errorf("Unable to dump traced frame %v", err)
 			continue
 		}
 
@@ -446,16 +1165,19 @@ func (ovs *overseer) sendTraceReport() {
 	}
 
 	ovs.traceFrames = list.New()
+	s.Launches = ovs.launchTraces
+	ovs.launchTraces = nil
 
-	payload, err := yaml.Marshal(&s)
+	conn := &ovs.ac.ssntpConn
+	payload, err := payloads.MarshalVersion(conn.Encoding(), &s, conn.PayloadVersion())
 	if err != nil {
-		glog.Errorf("Unable to Marshall TraceReport %v", err)
+		clog.Errorf("Unable to Marshall TraceReport %v", err)
 		return
 	}
 
-	_, err = ovs.ac.ssntpConn.SendEvent(ssntp.TraceReport, payload)
+	_, err = conn.SendEvent(ssntp.TraceReport, payload)
 	if err != nil {
-		glog.Errorf("Failed to send TraceReport event %v", err)
+		clog.Errorf("Failed to send TraceReport event %v", err)
 		return
 	}
 }
@@ -465,8 +1187,15 @@ func getStats() *cnStats {
 
 	s.totalMemMB, s.availableMemMB = getMemoryInfo()
 	s.load = getLoadAvg()
+	s.cpuPressure = getCPUPressure()
+	s.memPressure = getMemoryPressure()
 	s.cpusOnline = getOnlineCPUs()
+	s.powerWatts = cpuPower.sample(time.Now())
+	s.cpuTemperature = getCPUTemperature()
 	s.totalDiskMB, s.availableDiskMB = getFSInfo()
+	s.hugepages, s.hugepagesMB, s.hugepagesFreeMB = getHugepageInfo()
+	s.vfs = getSRIOVVFs()
+	s.gpuGroups = getGPUGroups()
 
 	return &s
 }
@@ -478,21 +1207,57 @@ func (ovs *overseer) sendInstanceDeletedEvent(instance string) {
 
 	payload, err := yaml.Marshal(&event)
 	if err != nil {
-		glog.Errorf("Unable to Marshall STATS %v", err)
+		clog.Errorf("Unable to Marshall STATS %v", err)
 		return
 	}
 
 	_, err = ovs.ac.ssntpConn.SendEvent(ssntp.InstanceDeleted, payload)
 	if err != nil {
-		glog.Errorf("Failed to send event command %v", err)
+		clog.Errorf("Failed to send event command %v", err)
+		return
+	}
+}
+
+// sendInstanceStateChangedEvent lets the controllers know that instance went
+// from the previous to the new state.  Schedulers that predate the
+// InstanceStateChanged event do not get it.
+func (ovs *overseer) sendInstanceStateChangedEvent(instance, previous, state string) {
+	conn := &ovs.ac.ssntpConn
+	if !conn.isConnected() || conn.PayloadVersion() < payloads.Version5 {
+		return
+	}
+
+	previous = reportedState(previous, conn.PayloadVersion())
+	state = reportedState(state, conn.PayloadVersion())
+	if previous == state {
+		return
+	}
+
+	event := payloads.EventInstanceStateChanged{
+		StateChanged: payloads.InstanceStateChangedEvent{
+			InstanceUUID:  instance,
+			NodeUUID:      conn.UUID(),
+			PreviousState: previous,
+			State:         state,
+		},
+	}
+
+	payload, err := payloads.MarshalVersion(conn.Encoding(), &event, conn.PayloadVersion())
+	if err != nil {
+		clog.Errorf("Unable to Marshall InstanceStateChanged %v", err)
 		return
 	}
+
+	_, err = conn.SendEvent(ssntp.InstanceStateChanged, payload)
+	if err != nil {
+		clog.Errorf("Failed to send InstanceStateChanged event %v", err)
+	}
 }
 
 func (ovs *overseer) processCommand(cmd interface{}) {
 	switch cmd := cmd.(type) {
 	case *ovsGetCmd:
-		glog.Infof("Overseer: looking for instance %s", cmd.instance)
+		clog.Infof("Overseer: looking for instance %s", cmd.instance)
 		var insState ovsGetResult
 		target := ovs.instances[cmd.instance]
 		if target != nil {
@@ -501,17 +1266,32 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 		}
 		cmd.targetCh <- insState
 	case *ovsAddCmd:
-		glog.Infof("Overseer: adding %s", cmd.instance)
+		clog.Infof("Overseer: adding %s", cmd.instance)
 		var targetCh chan<- interface{}
 		target := ovs.instances[cmd.instance]
 		canAdd := true
+		var reason payloads.StartFailureReason
 		cfg := cmd.cfg
+		if target == nil && cfg.reservation != "" {
+			ovs.useHold(cfg.reservation, cfg.TennantUUID)
+		}
 		if target != nil {
 			targetCh = target.cmdCh
+		} else if ovs.tenantLimitExceeded(cfg) {
+			canAdd = false
+			reason = payloads.TenantLimitExceeded
 		} else if ovs.roomAvailable(cfg) {
 			ovs.vcpusAllocated += cfg.Cpus
-			ovs.diskSpaceAllocated += cfg.Disk
-			ovs.memoryAllocated += cfg.Mem
+			ovs.diskSpaceAllocated += cfg.allocatedDiskMB()
+			if cfg.Hugepages {
+				ovs.hugepagesAllocated += cfg.Mem
+			} else {
+				ovs.memoryAllocated += cfg.Mem
+			}
+			cfg.VFs = ovs.allocatePCIDevices(cmd.instance, getSRIOVVFs(), cfg.SRIOVVFs)
+			cfg.GPUDevs = ovs.allocateGPUs(cmd.instance, getGPUGroups(), cfg.GPUs)
+			cfg.Cores = ovs.reservations.allocateCores(cfg.PinnedCores)
+			ovs.reservations.reserve(cmd.instance, cfg)
 			targetCh = startInstance(cmd.instance, cfg, ovs.childWg, ovs.childDoneCh,
 				ovs.ac, ovs.ovsCh)
 			ovs.instances[cmd.instance] = &ovsInstanceState{
@@ -520,18 +1300,37 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 				diskUsageMB:    -1,
 				CPUUsage:       -1,
 				memoryUsageMB:  -1,
-				maxDiskUsageMB: cfg.Disk,
+				maxDiskUsageMB: cfg.allocatedDiskMB(),
 				maxVCPUs:       cfg.Cpus,
 				maxMemoryMB:    cfg.Mem,
 				sshIP:          cfg.ConcIP,
+				sshIPv6:        cfg.ConcIPv6,
 				sshPort:        cfg.SSHPort,
+				hugepages:      cfg.Hugepages,
+				pciDevs:        cfg.pciDevices(),
+				cores:          cfg.Cores,
+				diskIOPS:       cfg.DiskIOPS,
+				ingressKbps:    cfg.IngressKbps,
+				egressKbps:     cfg.EgressKbps,
+				image:          cfg.backingImage(),
+				tenant:         cfg.TennantUUID,
+				group:          cfg.Group,
+				balloonMin:     cfg.BalloonMin,
+				bootPhase:      payloads.BootScheduled,
+				reportedState:  payloads.Pending,
+			}
+			ovs.sendInstanceStateChangedEvent(cmd.instance, "", payloads.Pending)
+			err := ovs.db.putAllocation(cmd.instance, newInstanceAllocation(cfg))
+			if err != nil {
+				clog.Warningf("Unable to persist allocation for %s: %v", cmd.instance, err)
 			}
 		} else {
 			canAdd = false
+			reason = payloads.FullComputeNode
 		}
-		cmd.targetCh <- ovsAddResult{targetCh, canAdd}
+		cmd.targetCh <- ovsAddResult{targetCh, canAdd, reason}
 	case *ovsRemoveCmd:
-		glog.Infof("Overseer: removing %s", cmd.instance)
+		clog.Infof("Overseer: removing %s", cmd.instance)
 		target := ovs.instances[cmd.instance]
 		if target == nil {
 			cmd.errCh <- fmt.Errorf("Instance does not exist")
@@ -548,18 +1347,34 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 			ovs.vcpusAllocated = 0
 		}
 
-		ovs.memoryAllocated -= target.maxMemoryMB
-		if ovs.memoryAllocated < 0 {
-			ovs.memoryAllocated = 0
+		if target.hugepages {
+			ovs.hugepagesAllocated -= target.maxMemoryMB
+			if ovs.hugepagesAllocated < 0 {
+				ovs.hugepagesAllocated = 0
+			}
+		} else {
+			ovs.memoryAllocated -= target.maxMemoryMB
+			if ovs.memoryAllocated < 0 {
+				ovs.memoryAllocated = 0
+			}
+		}
+
+		for _, dev := range target.pciDevs {
+			delete(ovs.pciDevsAllocated, dev)
 		}
+		ovs.reservations.release(target)
 
 		delete(ovs.instances, cmd.instance)
+		ovs.releaseLaunchSlot(cmd.instance)
+		if err := ovs.db.deleteAllocation(cmd.instance); err != nil {
+			clog.Warningf("Unable to remove allocation for %s: %v", cmd.instance, err)
+		}
 		if !cmd.suicide {
 			ovs.sendInstanceDeletedEvent(cmd.instance)
 		}
 		cmd.errCh <- nil
 	case *ovsStatusCmd:
-		glog.Info("Overseer: Recieved Status Command")
+		clog.Info("Overseer: Recieved Status Command")
 		if !ovs.ac.ssntpConn.isConnected() {
 			break
 		}
@@ -567,24 +1382,57 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 		ovs.updateAvailableResources(cns)
 		ovs.sendStatusCommand(cns, ovs.computeStatus())
 	case *ovsStatsStatusCmd:
-		glog.Info("Overseer: Recieved StatsStatus Command")
+		clog.Info("Overseer: Recieved StatsStatus Command")
+		cns := getStats()
+		ovs.updateAvailableResources(cns)
+		ovs.recordStats(cns)
 		if !ovs.ac.ssntpConn.isConnected() {
 			break
 		}
-		cns := getStats()
-		ovs.updateAvailableResources(cns)
 		status := ovs.computeStatus()
 		ovs.sendStatusCommand(cns, status)
 		ovs.sendStats(cns, status)
 	case *ovsStateChange:
-		glog.Infof("Overseer: Recieved State Change %v", *cmd)
+		clog.Infof("Overseer: Recieved State Change %v", *cmd)
 		target := ovs.instances[cmd.instance]
 		if target != nil {
 			target.running = cmd.state
+			if cmd.state == ovsStopped {
+				target.bootPhase = ""
+				target.guestFS = nil
+				target.network = nil
+				target.balloonMB = 0
+				target.unhealthy = false
+			}
+			state := target.payloadState()
+			if cmd.crashed {
+				state = payloads.Crashed
+			}
+			if state != target.reportedState {
+				ovs.sendInstanceStateChangedEvent(cmd.instance, target.reportedState, state)
+				target.reportedState = state
+			}
+		}
+	case *ovsHealthChange:
+		clog.Infof("Overseer: Recieved Health Change %v", *cmd)
+		target := ovs.instances[cmd.instance]
+		if target != nil && target.running == ovsRunning {
+			target.unhealthy = cmd.unhealthy
+			state := target.payloadState()
+			if state != target.reportedState {
+				ovs.sendInstanceStateChangedEvent(cmd.instance, target.reportedState, state)
+				target.reportedState = state
+			}
+		}
+	case *ovsBootPhaseChange:
+		clog.Infof("Overseer: Recieved Boot Phase Change %v", *cmd)
+		target := ovs.instances[cmd.instance]
+		if target != nil {
+			target.bootPhase = cmd.phase
 		}
 	case *ovsStatsUpdateCmd:
-		if glog.V(1) {
-			glog.Infof("STATS Update for %s: Mem %d Disk %d Cpu %d",
+		if clog.V(1) {
+			clog.Infof("STATS Update for %s: Mem %d Disk %d Cpu %d",
 				cmd.instance, cmd.memoryUsageMB,
 				cmd.diskUsageMB, cmd.CPUUsage)
 		}
@@ -592,11 +1440,100 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 		if target != nil {
 			target.memoryUsageMB = cmd.memoryUsageMB
 			target.diskUsageMB = cmd.diskUsageMB
-			target.CPUUsage = cmd.CPUUsage
+			target.CPUUsage = normalizeCPUUsage(cmd.CPUUsage, target.maxVCPUs)
+			target.sampledAt = cmd.sampled
+		}
+	case *ovsDrainCmd:
+		if !ovs.draining {
+			clog.Info("Overseer: Draining node")
+			ovs.draining = true
+			if ovs.ac.ssntpConn.isConnected() {
+				cns := getStats()
+				ovs.updateAvailableResources(cns)
+				ovs.sendStatusCommand(cns, ovs.computeStatus())
+			}
+		}
+		res := ovsDrainResult{running: make(map[string]chan<- interface{})}
+		for uuid, state := range ovs.instances {
+			if state.running == ovsRunning {
+				res.running[uuid] = state.cmdCh
+			} else if state.running == ovsPending {
+				res.pending++
+			}
+		}
+		cmd.targetCh <- res
+	case *ovsActiveCmd:
+		ovs.expireHolds(time.Now())
+		active := len(ovs.holds)
+		for _, state := range ovs.instances {
+			if state.running == ovsRunning || state.running == ovsPending {
+				active++
+			}
+		}
+		cmd.targetCh <- active
+	case *ovsGroupCmd:
+		clog.Infof("Overseer: looking for instances of group %s", cmd.group)
+		cmd.targetCh <- ovs.groupMembers(cmd.group)
+	case *ovsLaunchSlotCmd:
+		ovs.requestLaunchSlot(cmd)
+	case *ovsLaunchDoneCmd:
+		ovs.releaseLaunchSlot(cmd.instance)
+	case *ovsDiagnosticsCmd:
+		cmd.targetCh <- instanceSamples(ovs.statsHistory, cmd.instance, cmd.samples)
+	case *ovsMaintenanceCmd:
+		if ovs.maintenance == cmd.enabled {
+			break
+		}
+		clog.Infof("Overseer: maintenance mode %v", cmd.enabled)
+		ovs.maintenance = cmd.enabled
+		if err := ovs.db.putMaintenance(cmd.enabled); err != nil {
+			clog.Warningf("Unable to persist maintenance mode: %v", err)
+		}
+		if ovs.ac.ssntpConn.isConnected() {
+			cns := getStats()
+			ovs.updateAvailableResources(cns)
+			ovs.sendStatusCommand(cns, ovs.computeStatus())
+		}
+	case *ovsConfigureCmd:
+		clog.Infof("Overseer: limits set for %d tenants", len(cmd.limits))
+		ovs.tenantLimits = cmd.limits
+		applySettings(cmd.settings)
+		if ovs.ac.ssntpConn.isConnected() {
+			// The new watermarks may change the node status
+			cns := getStats()
+			ovs.updateAvailableResources(cns)
+			ovs.sendStatusCommand(cns, ovs.computeStatus())
+		}
+	case *ovsReserveCmd:
+		ovs.holdResources(cmd)
+	case *ovsAdminCmd:
+		cmd.targetCh <- ovs.adminSnapshot()
+	case *ovsGuestStatsUpdateCmd:
+		target := ovs.instances[cmd.instance]
+		if target != nil {
+			target.guestFS = cmd.filesystems
+		}
+	case *ovsNetStatsUpdateCmd:
+		target := ovs.instances[cmd.instance]
+		if target != nil {
+			target.network = cmd.network
+		}
+	case *ovsBalloonUpdateCmd:
+		ovs.balloonUpdate(cmd)
+	case *ovsSecurityGroupCmd:
+		target := ovs.instances[cmd.instance]
+		if target != nil {
+			target.securityGroup = cmd.version
 		}
 	case *ovsTraceFrame:
+		if traceID := cmd.frame.TraceID(); traceID != "" {
+			clog.V(1).Infof("Recording %s frame of trace %s", cmd.frame.Type, traceID)
+		}
 		cmd.frame.SetEndStamp()
 		ovs.traceFrames.PushBack(cmd.frame)
+	case *ovsLaunchTrace:
+		clog.V(1).Infof("Instance %s launched in %d ms", cmd.trace.InstanceUUID, cmd.trace.TotalMS)
+		ovs.launchTraces = append(ovs.launchTraces, cmd.trace)
 	default:
 		panic("Unknown Overseer Command")
 	}
@@ -604,7 +1541,18 @@ func (ovs *overseer) processCommand(cmd interface{}) {
 
 func (ovs *overseer) runOverseer() {
 
-	statsTimer := time.After(time.Second * statsPeriod)
+	statsTimer := time.After(getSettings().statsPeriod)
+
+	// Only compute nodes have tenant networks to report
+	var networksTimer <-chan time.Time
+	if networking.Enabled() && !networking.NetworkNode() && tenantNetworksPeriod > 0 {
+		networksTimer = time.After(tenantNetworksPeriod)
+	}
+
+	var windowTimer <-chan time.Time
+	if len(maintenanceWindows) > 0 {
+		windowTimer = time.After(0)
+	}
 DONE:
 	for {
 		select {
@@ -614,31 +1562,41 @@ DONE:
 			}
 			ovs.processCommand(cmd)
 		case <-statsTimer:
+			cns := getStats()
+			ovs.updateAvailableResources(cns)
+			ovs.recordStats(cns)
+
 			if !ovs.ac.ssntpConn.isConnected() {
-				statsTimer = time.After(time.Second * statsPeriod)
+				statsTimer = time.After(getSettings().statsPeriod)
 				continue
 			}
 
-			cns := getStats()
-			ovs.updateAvailableResources(cns)
 			status := ovs.computeStatus()
 			ovs.sendStatusCommand(cns, status)
 			ovs.sendStats(cns, status)
 			ovs.sendTraceReport()
-			statsTimer = time.After(time.Second * statsPeriod)
-			if glog.V(1) {
-				glog.Infof("Consumed: Disk %d Mem %d CPUs %d",
-					ovs.diskSpaceAllocated, ovs.memoryAllocated, ovs.vcpusAllocated)
+			statsTimer = time.After(getSettings().statsPeriod)
+			if clog.V(1) {
+				clog.Infof("Consumed: Disk %d Mem %d Hugepages %d CPUs %d",
+					ovs.diskSpaceAllocated, ovs.memoryAllocated,
+					ovs.hugepagesAllocated, ovs.vcpusAllocated)
 			}
+		case <-networksTimer:
+			sendTenantNetworksReport(&ovs.ac.ssntpConn)
+			networksTimer = time.After(tenantNetworksPeriod)
+		case <-windowTimer:
+			ovs.checkMaintenanceWindows(time.Now())
+			windowTimer = time.After(maintenanceWindowPeriod)
 		}
 	}
 
 	close(ovs.childDoneCh)
 	ovs.childWg.Wait()
-	glog.Info("All instance go routines have exitted")
+	clog.Info("All instance go routines have exitted")
+	ovs.db.close()
 	ovs.parentWg.Done()
 
-	glog.Info("Overseer exitting")
+	clog.Info("Overseer exitting")
 }
 
 func startOverseer(wg *sync.WaitGroup, ac *agentClient) chan<- interface{} {
@@ -652,6 +1610,54 @@ func startOverseer(wg *sync.WaitGroup, ac *agentClient) chan<- interface{} {
 	vcpusAllocated := 0
 	diskSpaceAllocated := 0
 	memoryAllocated := 0
+	hugepagesAllocated := 0
+	pciDevsAllocated := make(map[string]string)
+	reservations := newNodeReservations()
+
+	db, err := openLauncherDB(launcherDBDir)
+	if err != nil {
+		clog.Warningf("Unable to open launcher db.  Accounting will not be persisted: %v", err)
+		db = nil
+	}
+
+	allocs, err := db.allocations()
+	if err != nil {
+		clog.Warningf("Unable to load persisted allocations: %v", err)
+	}
+
+	history, err := db.samples(statsHistoryLen)
+	if err != nil {
+		clog.Warningf("Unable to load stats history: %v", err)
+	}
+
+	// Maintenance mode survives launcher restarts, as the node is
+	// likely to be rebooted while it's being maintained.
+
+	maintenance, err := db.maintenance()
+	if err != nil {
+		clog.Warningf("Unable to load maintenance mode: %v", err)
+	}
+	if maintenanceMode && !maintenance {
+		maintenance = true
+		if err := db.putMaintenance(true); err != nil {
+			clog.Warningf("Unable to persist maintenance mode: %v", err)
+		}
+	}
+	if maintenance {
+		clog.Info("Node is in maintenance mode")
+	}
+
+	// Until we reconnect to an instance we don't know how much disk
+	// space and memory it's using.  Rather than assuming it's using none,
+	// which would lead us to overestimate the resources available on the
+	// node, we use the values from the last persisted sample.
+
+	var lastUsage map[string]adminInstanceUsage
+	if len(history) > 0 {
+		lastUsage = history[len(history)-1].Instances
+	}
+
+	accounted := make(map[string]bool)
 
 	_ = filepath.Walk(instancesDir, func(path string, info os.FileInfo, err error) error {
 		if path == instancesDir {
@@ -662,20 +1668,44 @@ func startOverseer(wg *sync.WaitGroup, ac *agentClient) chan<- interface{} {
 			return nil
 		}
 
-		glog.Infof("Reconnecting to existing instance %s", path)
+		clog.Infof("Reconnecting to existing instance %s", path)
 		instance := filepath.Base(path)
 
 		// BUG(markus): We should garbage collect corrupt instances
 
 		cfg, err := loadVMConfig(path)
 		if err != nil {
-			glog.Warning("Unable to load state of running instance %s: %v", instance, err)
+			clog.Warning("Unable to load state of running instance %s: %v", instance, err)
+
+			// The instance still exists and is consuming resources,
+			// even though we can't manage it.
+
+			if a := allocs[instance]; a != nil {
+				clog.Warningf("Accounting for resources allocated to %s", instance)
+				vcpusAllocated += a.Cpus
+				diskSpaceAllocated += a.DiskMB
+				if a.Hugepages {
+					hugepagesAllocated += a.MemMB
+				} else {
+					memoryAllocated += a.MemMB
+				}
+				for _, dev := range a.PCIDevs {
+					pciDevsAllocated[dev] = instance
+				}
+				reservations.reserveAllocation(instance, a)
+				accounted[instance] = true
+			}
 			return nil
 		}
 
 		vcpusAllocated += cfg.Cpus
-		diskSpaceAllocated += cfg.Disk
-		memoryAllocated += cfg.Mem
+		diskSpaceAllocated += cfg.allocatedDiskMB()
+		if cfg.Hugepages {
+			hugepagesAllocated += cfg.Mem
+		} else {
+			memoryAllocated += cfg.Mem
+		}
+		reservations.reserve(instance, cfg)
 
 		target := startInstance(instance, cfg, childWg, childDoneCh, ac, ovsCh)
 		instances[instance] = &ovsInstanceState{
@@ -684,12 +1714,39 @@ func startOverseer(wg *sync.WaitGroup, ac *agentClient) chan<- interface{} {
 			diskUsageMB:    -1,
 			CPUUsage:       -1,
 			memoryUsageMB:  -1,
-			maxDiskUsageMB: cfg.Disk,
+			maxDiskUsageMB: cfg.allocatedDiskMB(),
 			maxVCPUs:       cfg.Cpus,
 			maxMemoryMB:    cfg.Mem,
 			sshIP:          cfg.ConcIP,
+			sshIPv6:        cfg.ConcIPv6,
 			sshPort:        cfg.SSHPort,
+			hugepages:      cfg.Hugepages,
+			pciDevs:        cfg.pciDevices(),
+			cores:          cfg.Cores,
+			diskIOPS:       cfg.DiskIOPS,
+			ingressKbps:    cfg.IngressKbps,
+			egressKbps:     cfg.EgressKbps,
+			image:          cfg.backingImage(),
+			tenant:         cfg.TennantUUID,
+			group:          cfg.Group,
+			balloonMin:     cfg.BalloonMin,
+			reportedState:  payloads.Pending,
+		}
+		if usage, ok := lastUsage[instance]; ok {
+			instances[instance].memoryUsageMB = usage.MemoryUsageMB
+			instances[instance].diskUsageMB = usage.DiskUsageMB
+			instances[instance].CPUUsage = usage.CPUUsage
+		}
+		for _, dev := range instances[instance].pciDevs {
+			pciDevsAllocated[dev] = instance
+		}
+		if allocs[instance] == nil {
+			err = db.putAllocation(instance, newInstanceAllocation(cfg))
+			if err != nil {
+				clog.Warningf("Unable to persist allocation for %s: %v", instance, err)
+			}
 		}
+		accounted[instance] = true
 		toMonitor = append(toMonitor, target)
 
 		return filepath.SkipDir
@@ -705,12 +1762,33 @@ func startOverseer(wg *sync.WaitGroup, ac *agentClient) chan<- interface{} {
 		vcpusAllocated:     vcpusAllocated,
 		diskSpaceAllocated: diskSpaceAllocated,
 		memoryAllocated:    memoryAllocated,
+		hugepagesAllocated: hugepagesAllocated,
+		pciDevsAllocated:   pciDevsAllocated,
+		reservations:       reservations,
+		holds:              make(map[string]*resourceHold),
 		traceFrames:        list.New(),
+		statsHistory:       history,
+		db:                 db,
+		maintenance:        maintenance,
+		maxLaunches:        maxLaunches,
+		launching:          make(map[string]struct{}),
+		cpusOnline:         getOnlineCPUs(),
+	}
+
+	for instance := range allocs {
+		if accounted[instance] {
+			continue
+		}
+		clog.Infof("Removing stale allocation for %s", instance)
+		if err := db.deleteAllocation(instance); err != nil {
+			clog.Warningf("Unable to remove allocation for %s: %v", instance, err)
+		}
 	}
+	_, ovs.hugepagesTotalMB, ovs.hugepagesFreeMB = getHugepageInfo()
 	ovs.parentWg.Add(1)
-	glog.Info("Starting Overseer")
-	glog.Infof("Allocated: Disk %d Mem %d CPUs %d",
-		diskSpaceAllocated, memoryAllocated, vcpusAllocated)
+	clog.Info("Starting Overseer")
+	clog.Infof("Allocated: Disk %d Mem %d Hugepages %d CPUs %d",
+		diskSpaceAllocated, memoryAllocated, hugepagesAllocated, vcpusAllocated)
 	go ovs.runOverseer()
 	ovs = nil
 	instances = nil
@@ -0,0 +1,244 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/01org/ciao/ssntp"
+)
+
+func TestTenantLimitExceeded(t *testing.T) {
+	const tenant = "67d86208-b46c-4465-9018-fe14087d415f"
+	const other = "83679162-1378-4288-a2d4-70e13ec132aa"
+
+	ovs := &overseer{
+		instances: map[string]*ovsInstanceState{
+			"a": {tenant: tenant, maxMemoryMB: 512},
+			"b": {tenant: other, maxMemoryMB: 4096},
+		},
+	}
+
+	cfg := &vmConfig{TennantUUID: tenant, Mem: 1024}
+	if ovs.tenantLimitExceeded(cfg) {
+		t.Errorf("Tenants without limits should not be limited")
+	}
+
+	ovs.tenantLimits = map[string]tenantLimit{tenant: {maxInstances: 2}}
+	if ovs.tenantLimitExceeded(cfg) {
+		t.Errorf("Second instance should be within instance limit")
+	}
+
+	ovs.instances["c"] = &ovsInstanceState{tenant: tenant, maxMemoryMB: 512}
+	if !ovs.tenantLimitExceeded(cfg) {
+		t.Errorf("Third instance should exceed instance limit")
+	}
+
+	ovs.tenantLimits = map[string]tenantLimit{tenant: {maxMemMB: 2048}}
+	if ovs.tenantLimitExceeded(cfg) {
+		t.Errorf("2048MB should be within memory limit")
+	}
+
+	cfg.Mem = 1025
+	if !ovs.tenantLimitExceeded(cfg) {
+		t.Errorf("2049MB should exceed memory limit")
+	}
+
+	cfg.TennantUUID = other
+	if ovs.tenantLimitExceeded(cfg) {
+		t.Errorf("Limits of one tenant should not apply to another")
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	ovs := &overseer{
+		instances: map[string]*ovsInstanceState{
+			"c": {group: "web", running: ovsRunning},
+			"a": {group: "web", running: ovsStopped},
+			"b": {group: "db", running: ovsRunning},
+			"d": {running: ovsRunning},
+		},
+	}
+
+	members := ovs.groupMembers("web")
+	expected := []ovsGroupMember{{"a", ovsStopped}, {"c", ovsRunning}}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("Unexpected group members.  Expected %v got %v", expected, members)
+	}
+
+	if len(ovs.groupMembers("wibble")) != 0 {
+		t.Errorf("Unknown group should have no members")
+	}
+}
+
+func TestLaunchSlots(t *testing.T) {
+	ovs := &overseer{
+		maxLaunches: 2,
+		launching:   make(map[string]struct{}),
+	}
+
+	grants := make(map[string]chan struct{})
+	for _, instance := range []string{"a", "b", "c", "d"} {
+		grants[instance] = make(chan struct{}, 1)
+		ovs.requestLaunchSlot(&ovsLaunchSlotCmd{instance, grants[instance]})
+	}
+
+	granted := func(instance string) bool {
+		select {
+		case <-grants[instance]:
+			return true
+		default:
+			return false
+		}
+	}
+
+	if !granted("a") || !granted("b") || granted("c") || granted("d") {
+		t.Fatalf("Only the first two launches should be granted")
+	}
+
+	// Deleting a queued instance should remove it from the queue
+	// without freeing a slot.
+
+	ovs.releaseLaunchSlot("c")
+	if granted("d") || len(ovs.launchQueue) != 1 {
+		t.Fatalf("Queued instance not removed correctly")
+	}
+
+	ovs.releaseLaunchSlot("a")
+	if !granted("d") || len(ovs.launchQueue) != 0 || len(ovs.launching) != 2 {
+		t.Fatalf("Queued instance not granted when slot freed")
+	}
+
+	ovs.releaseLaunchSlot("b")
+	ovs.releaseLaunchSlot("d")
+	if len(ovs.launching) != 0 {
+		t.Errorf("Launch slots not released")
+	}
+
+	ovs.maxLaunches = 0
+	ovs.requestLaunchSlot(&ovsLaunchSlotCmd{"a", grants["a"]})
+	if !granted("a") {
+		t.Errorf("Launch should not be limited when maxLaunches is 0")
+	}
+}
+
+func TestNormalizeCPUUsage(t *testing.T) {
+	tests := []struct {
+		usage    int
+		vcpus    int
+		expected int
+	}{
+		{-1, 2, -1},
+		{50, 0, 50},
+		{150, 2, 75},
+		{400, 4, 100},
+		{350, 1, 100},
+	}
+
+	for _, test := range tests {
+		got := normalizeCPUUsage(test.usage, test.vcpus)
+		if got != test.expected {
+			t.Errorf("normalizeCPUUsage(%d, %d): expected %d got %d",
+				test.usage, test.vcpus, test.expected, got)
+		}
+	}
+}
+
+func TestParsePressure(t *testing.T) {
+	psi := "some avg10=1.53 avg60=0.87 avg300=0.22 total=1234567\n" +
+		"full avg10=0.00 avg60=0.00 avg300=0.00 total=0\n"
+	if p := parsePressure(strings.NewReader(psi)); p != 0.87 {
+		t.Errorf("Expected pressure 0.87 got %f", p)
+	}
+
+	if p := parsePressure(strings.NewReader("")); p != -1 {
+		t.Errorf("Expected pressure -1 got %f", p)
+	}
+}
+
+func TestVCPULimit(t *testing.T) {
+	defer func(overcommit float64) { cpuOvercommit = overcommit }(cpuOvercommit)
+
+	ovs := &overseer{
+		cpusOnline:         4,
+		vcpusAllocated:     6,
+		memoryAvailable:    1 << 20,
+		diskSpaceAvailable: 1 << 20,
+	}
+	cpuOvercommit = 0
+	if ovs.vcpuLimit() != -1 {
+		t.Errorf("vCPUs should not be limited by default")
+	}
+
+	cpuOvercommit = 2
+	if ovs.vcpuLimit() != 8 {
+		t.Fatalf("Expected a limit of 8 vCPUs got %d", ovs.vcpuLimit())
+	}
+	if ovs.computeStatus() == ssntp.FULL {
+		t.Errorf("Node should not be full with 6 of 8 vCPUs allocated")
+	}
+
+	ovs.vcpusAllocated = 8
+	if ovs.computeStatus() != ssntp.FULL {
+		t.Errorf("Node should be full with 8 of 8 vCPUs allocated")
+	}
+}
+
+func TestHugepagesAvailable(t *testing.T) {
+	ovs := &overseer{
+		memoryAvailable:    1 << 20,
+		diskSpaceAvailable: 1 << 20,
+		hugepagesFreeMB:    4096,
+		instances: map[string]*ovsInstanceState{
+			"running": {running: ovsRunning, hugepages: true, maxMemoryMB: 1024, diskUsageMB: -1},
+			"pending": {running: ovsPending, hugepages: true, maxMemoryMB: 1024, diskUsageMB: -1},
+			"regular": {running: ovsRunning, maxMemoryMB: 2048, diskUsageMB: -1},
+		},
+	}
+
+	// Until the free count has been sampled with an instance running, its
+	// pages are assumed to be yet to be allocated.
+	if available := ovs.hugepagesAvailable(); available != 2048 {
+		t.Errorf("Expected 2048 MB of hugepages got %d", available)
+	}
+
+	cns := &cnStats{
+		availableMemMB:  1 << 20,
+		availableDiskMB: 1 << 20,
+		hugepagesMB:     4096,
+		hugepagesFreeMB: 3072,
+	}
+	ovs.updateAvailableResources(cns)
+	if available := ovs.hugepagesAvailable(); available != 2048 {
+		t.Errorf("Expected 2048 MB of hugepages got %d", available)
+	}
+	if !ovs.roomAvailable(&vmConfig{Mem: 2048, Hugepages: true}) {
+		t.Errorf("Instance should fit in the free hugepages")
+	}
+
+	// Hugepages used outside of launcher must not be handed out.
+	cns.hugepagesFreeMB = 1024
+	ovs.updateAvailableResources(cns)
+	if available := ovs.hugepagesAvailable(); available != 0 {
+		t.Errorf("Expected no hugepages got %d", available)
+	}
+	if ovs.roomAvailable(&vmConfig{Mem: 1024, Hugepages: true}) {
+		t.Errorf("Instance should not fit in the free hugepages")
+	}
+}
@@ -19,16 +19,18 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/base64"
 	"encoding/gob"
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"path"
 	"regexp"
 	"strings"
+	"time"
 
-	"github.com/golang/glog"
-
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/networking/libsnnet"
 	"github.com/01org/ciao/payloads"
 
@@ -53,10 +55,92 @@ type vmConfig struct {
 	VnicIP      string
 	ConcIP      string
 	SubnetIP    string
+	VnicIPv6    string
+	ConcIPv6    string
+	SubnetIPv6  string
 	TennantUUID string
 	ConcUUID    string
 	VnicUUID    string
 	SSHPort     int
+	Hugepages   bool
+	SRIOVVFs    int
+	VFs         []string
+	GPUs        int
+	GPUDevs     []string
+	Hostname    string
+	SSHKeys     []string
+	Seccomp     string
+	AppArmor    string
+	SELinux     []string
+	UsernsMode  string
+	Hypervisor  string
+	Group       string
+	Encrypted   bool
+	KeyURL      string
+	IngressKbps int
+	EgressKbps  int
+	DiskIOPS    int
+	PinnedCores int
+	Cores       []int
+	VnicName    string
+	Firmware    string
+	TPM         bool
+
+	// BalloonMin is the memory, in MB, below which the balloon of the
+	// instance may not shrink its guest, 0 if it is not ballooned.
+	BalloonMin int
+
+	// SwapMax is the host swap, in MB, the instance may use when
+	// LimitSwap is set.  Instances created before swap limits existed
+	// have no limit.
+	SwapMax   int
+	LimitSwap bool
+
+	// Volumes are the named volumes and bind mounts of docker instances.
+	Volumes []payloads.ContainerVolume
+
+	// HealthCheck overrides the HEALTHCHECK of the image of a docker
+	// instance, and RestartPolicy says whether launcher restarts the
+	// instance when it becomes unhealthy.
+	HealthCheck   *payloads.HealthCheck
+	RestartPolicy payloads.RestartPolicy
+
+	// diskKey is only used when creating an instance and is deliberately
+	// not exported, so that it is not stored in the instance's state file.
+	diskKey []byte
+
+	// hooks are written to the instance directory when the instance is
+	// created, so, like diskKey, they are not stored in the state file.
+	hooks *payloads.InstanceHooks
+
+	// reservation identifies the resources held for the instance by a
+	// RESERVE command.  It is only used when the instance is created.
+	reservation string
+
+	// registryAuth contains the credentials used to pull the image of a
+	// container.  Like diskKey, it is never stored.
+	registryAuth *payloads.RegistryAuth
+
+	// pullProgress, if not nil, is called as the image of a container
+	// is pulled.
+	pullProgress func(*payloads.ImagePullProgressEvent)
+}
+
+// pciDevices returns the addresses of all the host PCI devices, VFs and GPUs,
+// that are passed through to the instance.
+func (cfg *vmConfig) pciDevices() []string {
+	devs := make([]string, 0, len(cfg.VFs)+len(cfg.GPUDevs))
+	devs = append(devs, cfg.VFs...)
+	return append(devs, cfg.GPUDevs...)
+}
+
+// backingImage returns the UUID of the image in the launcher's image cache used
+// by the instance, or "" for containers whose images are managed by docker.
+func (cfg *vmConfig) backingImage() string {
+	if cfg.Container || cfg.Hypervisor == payloads.KataContainer {
+		return ""
+	}
+	return cfg.Image
 }
 
 type extractedDoc struct {
@@ -68,33 +152,40 @@ type extractedDoc struct {
 var indentedRegexp *regexp.Regexp
 var startRegexp *regexp.Regexp
 var uuidRegexp *regexp.Regexp
+var profileRegexp *regexp.Regexp
+var selinuxOptionRegexp *regexp.Regexp
 
 func init() {
 	indentedRegexp = regexp.MustCompile("\\s+.*")
 	startRegexp = regexp.MustCompile("^start\\s*:\\s*$")
 	uuidRegexp = regexp.MustCompile("^[0-9a-fA-F]+(-[0-9a-fA-F]+)*$")
+	profileRegexp = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+	selinuxOptionRegexp = regexp.MustCompile("^(user|role|type|level):[a-zA-Z0-9_.:,-]+$")
 }
 
 func printCloudinit(data *payloads.Start) {
 	start := &data.Start
-	glog.Info("cloud-init file content")
-	glog.Info("-----------------------")
-	glog.Infof("Instance UUID:        %v", start.InstanceUUID)
-	glog.Infof("Disk image UUID:      %v", start.ImageUUID)
-	glog.Infof("FW Type:              %v", start.FWType)
-	glog.Infof("VM Type:              %v", start.VMType)
-	glog.Infof("TennantUUID:          %v", start.TenantUUID)
+	clog.Info("cloud-init file content")
+	clog.Info("-----------------------")
+	clog.Infof("Instance UUID:        %v", start.InstanceUUID)
+	clog.Infof("Disk image UUID:      %v", start.ImageUUID)
+	clog.Infof("FW Type:              %v", start.FWType)
+	clog.Infof("VM Type:              %v", start.VMType)
+	clog.Infof("TennantUUID:          %v", start.TenantUUID)
 	net := &start.Networking
-	glog.Infof("VnicMAC:              %v", net.VnicMAC)
-	glog.Infof("VnicIP:               %v", net.PrivateIP)
-	glog.Infof("ConcIP:               %v", net.ConcentratorIP)
-	glog.Infof("SubnetIP:             %v", net.Subnet)
-	glog.Infof("ConcUUID:             %v", net.ConcentratorUUID)
-	glog.Infof("VnicUUID:             %v", net.VnicUUID)
-
-	glog.Info("Requested resources:")
+	clog.Infof("VnicMAC:              %v", net.VnicMAC)
+	clog.Infof("VnicIP:               %v", net.PrivateIP)
+	clog.Infof("ConcIP:               %v", net.ConcentratorIP)
+	clog.Infof("SubnetIP:             %v", net.Subnet)
+	clog.Infof("VnicIPv6:             %v", net.PrivateIPv6)
+	clog.Infof("ConcIPv6:             %v", net.ConcentratorIPv6)
+	clog.Infof("SubnetIPv6:           %v", net.SubnetIPv6)
+	clog.Infof("ConcUUID:             %v", net.ConcentratorUUID)
+	clog.Infof("VnicUUID:             %v", net.VnicUUID)
+
+	clog.Info("Requested resources:")
 	for i := range start.RequestedResources {
-		glog.Infof("%8s:     %v", start.RequestedResources[i].Type,
+		clog.Infof("%8s:     %v", start.RequestedResources[i].Type,
 			start.RequestedResources[i].Value)
 	}
 }
@@ -122,10 +213,52 @@ func computeSSHPort(networkNode bool, vnicIP string) int {
 	return port
 }
 
+// checkIsolation validates the isolation settings of a docker instance.  The
+// settings that disable a form of isolation the docker daemon would otherwise
+// apply are only accepted if the node allows them.
+func checkIsolation(isolation *payloads.ContainerIsolation) error {
+	for _, p := range []string{isolation.SeccompProfile, isolation.AppArmorProfile} {
+		if p != "" && !profileRegexp.MatchString(p) {
+			return fmt.Errorf("Invalid security profile name: %s", p)
+		}
+	}
+
+	var weak []string
+	if isolation.SeccompProfile == seccompUnconfined {
+		weak = append(weak, "seccomp_profile "+seccompUnconfined)
+	}
+	if isolation.AppArmorProfile == apparmorUnconfined {
+		weak = append(weak, "apparmor_profile "+apparmorUnconfined)
+	}
+
+	for _, label := range isolation.SELinuxLabel {
+		if label == selinuxDisable {
+			weak = append(weak, "selinux_label "+selinuxDisable)
+		} else if !selinuxOptionRegexp.MatchString(label) {
+			return fmt.Errorf("Invalid SELinux label option: %s", label)
+		}
+	}
+
+	switch isolation.UsernsMode {
+	case "", usernsRemap:
+	case usernsHost:
+		weak = append(weak, "userns_mode "+usernsHost)
+	default:
+		return fmt.Errorf("Invalid userns mode: %s", isolation.UsernsMode)
+	}
+
+	if len(weak) > 0 && !allowWeakIsolation {
+		return fmt.Errorf("Isolation settings not allowed on this node: %s",
+			strings.Join(weak, ", "))
+	}
+
+	return nil
+}
+
 func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 	var clouddata payloads.Start
 
-	err := yaml.Unmarshal(data, &clouddata)
+	err := payloads.Unmarshal(data, &clouddata)
 	if err != nil {
 		return nil, &payloadError{err, payloads.InvalidPayload}
 	}
@@ -140,24 +273,43 @@ func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 	}
 
 	fwType := start.FWType
-	if fwType != "" && fwType != payloads.Legacy && fwType != payloads.EFI {
+	if fwType != "" && fwType != payloads.Legacy && fwType != payloads.EFI &&
+		fwType != payloads.SecureBoot {
 		err = fmt.Errorf("Invalid fwtype received: %s", fwType)
 		return nil, &payloadError{err, payloads.InvalidData}
 	}
 	legacy := fwType == payloads.Legacy
 
 	vmType := start.VMType
-	if vmType != "" && vmType != payloads.QEMU && vmType != payloads.Docker {
+	if vmType != "" && vmType != payloads.QEMU && vmType != payloads.Docker &&
+		vmType != payloads.CloudHypervisor && vmType != payloads.KataContainer {
 		err = fmt.Errorf("Invalid vmtype received: %s", vmType)
 		return nil, &payloadError{err, payloads.InvalidData}
 	}
 
+	// The scheduler may have placed the instance without knowing the
+	// node's capabilities, e.g., when it predates them.
+	if arch, req := start.ImageArchitecture, start.Requirements; arch != "" || req != nil {
+		caps := cachedNodeCapabilities()
+		if missing := caps.MissingPlatform(vmType, arch, req); missing != "" {
+			err = fmt.Errorf("Node lacks %s", missing)
+			return nil, &payloadError{err, payloads.UnmetRequirements}
+		}
+	}
+
 	var disk, cpus, mem int
 	var networkNode bool
+	var hugepages bool
+	var sriovVFs int
+	var gpus int
+	var ingressKbps, egressKbps int
+	var diskIOPS, pinnedCores int
+	var balloonMin int
+	swapMax := -1
 	var image string
 
 	container := vmType == payloads.Docker
-	if container {
+	if container || vmType == payloads.KataContainer {
 		image = start.DockerImage
 	} else {
 		image = start.ImageUUID
@@ -173,6 +325,155 @@ func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 			disk = start.RequestedResources[i].Value
 		case payloads.NetworkNode:
 			networkNode = start.RequestedResources[i].Value != 0
+		case payloads.Hugepages:
+			hugepages = start.RequestedResources[i].Value != 0
+		case payloads.SRIOVVFs:
+			sriovVFs = start.RequestedResources[i].Value
+		case payloads.GPUs:
+			gpus = start.RequestedResources[i].Value
+		case payloads.NetIngressKbps:
+			ingressKbps = start.RequestedResources[i].Value
+		case payloads.NetEgressKbps:
+			egressKbps = start.RequestedResources[i].Value
+		case payloads.DiskIOPS:
+			diskIOPS = start.RequestedResources[i].Value
+		case payloads.DedicatedCores:
+			pinnedCores = start.RequestedResources[i].Value
+		case payloads.BalloonMinMB:
+			balloonMin = start.RequestedResources[i].Value
+		case payloads.SwapMaxMB:
+			swapMax = start.RequestedResources[i].Value
+		}
+	}
+
+	if hugepages && container {
+		err = fmt.Errorf("Hugepages are not supported for docker instances")
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if sriovVFs < 0 || (sriovVFs > 0 && container) {
+		err = fmt.Errorf("Invalid number of SR-IOV VFs requested: %d", sriovVFs)
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if gpus < 0 || (gpus > 0 && container) {
+		err = fmt.Errorf("Invalid number of GPUs requested: %d", gpus)
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if ingressKbps < 0 || egressKbps < 0 {
+		err = fmt.Errorf("Invalid bandwidth limits requested: ingress %d kbps, egress %d kbps",
+			ingressKbps, egressKbps)
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if diskIOPS < 0 || (diskIOPS > 0 && (container || vmType == payloads.CloudHypervisor ||
+		vmType == payloads.KataContainer)) {
+		err = fmt.Errorf("Invalid disk IOPS requested: %d", diskIOPS)
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if pinnedCores < 0 || (pinnedCores > 0 && (vmType == payloads.CloudHypervisor ||
+		vmType == payloads.KataContainer)) {
+		err = fmt.Errorf("Invalid number of dedicated cores requested: %d", pinnedCores)
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if balloonMin < 0 || balloonMin > mem || (balloonMin > 0 && (hugepages || container ||
+		vmType == payloads.CloudHypervisor || vmType == payloads.KataContainer)) {
+		err = fmt.Errorf("Invalid balloon minimum requested: %d MB", balloonMin)
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if swapMax < -1 || (swapMax >= 0 && (hugepages || vmType == payloads.CloudHypervisor ||
+		vmType == payloads.KataContainer)) {
+		err = fmt.Errorf("Invalid swap limit requested: %d MB", swapMax)
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if vmType == payloads.KataContainer && networkNode {
+		err = fmt.Errorf("Network nodes are not supported for kata instances")
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if vmType == payloads.CloudHypervisor {
+		if legacy || fwType == payloads.SecureBoot {
+			err = fmt.Errorf("Firmware %s is not supported for cloud-hypervisor instances", fwType)
+			return nil, &payloadError{err, payloads.InvalidData}
+		}
+		if networkNode {
+			err = fmt.Errorf("Network nodes are not supported for cloud-hypervisor instances")
+			return nil, &payloadError{err, payloads.InvalidData}
+		}
+	}
+
+	var hypervisor string
+	if vmType == payloads.CloudHypervisor || vmType == payloads.KataContainer {
+		hypervisor = string(vmType)
+	}
+
+	isolation := start.Isolation
+	if isolation == nil {
+		isolation = &payloads.ContainerIsolation{}
+	} else if !container {
+		err = fmt.Errorf("Isolation settings are only supported for docker instances")
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	err = checkIsolation(isolation)
+	if err != nil {
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	var diskKey []byte
+	var keyURL string
+	enc := start.Encryption
+	if enc != nil {
+		if container || hypervisor != "" {
+			err = fmt.Errorf("Disk encryption is only supported for qemu instances")
+			return nil, &payloadError{err, payloads.InvalidData}
+		}
+		diskKey, err = checkEncryption(enc)
+		if err != nil {
+			return nil, &payloadError{err, payloads.InvalidData}
+		}
+		keyURL = enc.KeyURL
+	}
+
+	if start.TPM && (container || hypervisor != "") {
+		err = fmt.Errorf("Virtual TPMs are only supported for qemu instances")
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if len(start.Volumes) > 0 && !container {
+		err = fmt.Errorf("Volumes are only supported for docker instances")
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	err = checkVolumes(start.Volumes)
+	if err != nil {
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if start.HealthCheck != nil && !container {
+		err = fmt.Errorf("Health checks are only supported for docker instances")
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if start.RestartPolicy == payloads.RestartUnhealthy && !container {
+		err = fmt.Errorf("Only docker instances can be restarted when unhealthy")
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if start.RegistryAuth != nil && !container && vmType != payloads.KataContainer {
+		err = fmt.Errorf("Registry credentials are only supported for docker and kata instances")
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if start.Hooks != nil {
+		err = checkHooks(start.Hooks)
+		if err != nil {
+			return nil, &payloadError{err, payloads.InvalidData}
 		}
 	}
 
@@ -192,10 +493,43 @@ func parseStartPayload(data []byte) (*vmConfig, *payloadError) {
 		VnicIP:      vnicIP,
 		ConcIP:      strings.TrimSpace(net.ConcentratorIP),
 		SubnetIP:    strings.TrimSpace(net.Subnet),
+		VnicIPv6:    strings.TrimSpace(net.PrivateIPv6),
+		ConcIPv6:    strings.TrimSpace(net.ConcentratorIPv6),
+		SubnetIPv6:  strings.TrimSpace(net.SubnetIPv6),
 		TennantUUID: strings.TrimSpace(start.TenantUUID),
 		ConcUUID:    strings.TrimSpace(net.ConcentratorUUID),
 		VnicUUID:    strings.TrimSpace(net.VnicUUID),
 		SSHPort:     sshPort,
+		Hugepages:   hugepages,
+		SRIOVVFs:    sriovVFs,
+		GPUs:        gpus,
+		Hostname:    strings.TrimSpace(start.Hostname),
+		SSHKeys:     start.SSHKeys,
+		Seccomp:     isolation.SeccompProfile,
+		AppArmor:    isolation.AppArmorProfile,
+		SELinux:     isolation.SELinuxLabel,
+		UsernsMode:  isolation.UsernsMode,
+		Hypervisor:  hypervisor,
+		Group:       strings.TrimSpace(start.GroupID),
+		Encrypted:   enc != nil,
+		KeyURL:      keyURL,
+		IngressKbps: ingressKbps,
+		EgressKbps:  egressKbps,
+		DiskIOPS:    diskIOPS,
+		PinnedCores: pinnedCores,
+		BalloonMin:  balloonMin,
+		SwapMax:     swapMax,
+		LimitSwap:   swapMax >= 0,
+		Firmware:    string(fwType),
+		TPM:         start.TPM,
+		Volumes:     start.Volumes,
+		HealthCheck: start.HealthCheck,
+		diskKey:     diskKey,
+		hooks:       start.Hooks,
+		reservation: strings.TrimSpace(start.ReservationID),
+
+		RestartPolicy: start.RestartPolicy,
+		registryAuth:  start.RegistryAuth,
 	}, nil
 }
 
@@ -263,7 +597,7 @@ func generateNetEventPayload(ssntpEvent *libsnnet.SsntpEventInfo, agentUUID stri
 func parseRestartPayload(data []byte) (string, *payloadError) {
 	var clouddata payloads.Restart
 
-	err := yaml.Unmarshal(data, &clouddata)
+	err := payloads.Unmarshal(data, &clouddata)
 	if err != nil {
 		return "", &payloadError{err, payloads.RestartInvalidPayload}
 	}
@@ -279,7 +613,7 @@ func parseRestartPayload(data []byte) (string, *payloadError) {
 func parseDeletePayload(data []byte) (string, *payloadError) {
 	var clouddata payloads.Delete
 
-	err := yaml.Unmarshal(data, &clouddata)
+	err := payloads.Unmarshal(data, &clouddata)
 	if err != nil {
 		return "", &payloadError{err, payloads.DeleteInvalidPayload}
 	}
@@ -295,9 +629,9 @@ func parseDeletePayload(data []byte) (string, *payloadError) {
 func parseStopPayload(data []byte) (string, *payloadError) {
 	var clouddata payloads.Stop
 
-	err := yaml.Unmarshal(data, &clouddata)
+	err := payloads.Unmarshal(data, &clouddata)
 	if err != nil {
-		glog.Errorf("YAML error: %v", err)
+		clog.Errorf("YAML error: %v", err)
 		return "", &payloadError{err, payloads.StopInvalidPayload}
 	}
 
@@ -309,11 +643,251 @@ func parseStopPayload(data []byte) (string, *payloadError) {
 	return instance, nil
 }
 
+func parseStopGroupPayload(data []byte) (string, *payloadError) {
+	var clouddata payloads.StopGroup
+
+	err := payloads.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", &payloadError{err, payloads.InvalidPayload}
+	}
+
+	group := strings.TrimSpace(clouddata.StopGroup.GroupID)
+	if group == "" {
+		err = fmt.Errorf("No group id received")
+		return "", &payloadError{err, payloads.InvalidData}
+	}
+	return group, nil
+}
+
+func parseDeleteGroupPayload(data []byte) (string, *payloadError) {
+	var clouddata payloads.DeleteGroup
+
+	err := payloads.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", &payloadError{err, payloads.InvalidPayload}
+	}
+
+	group := strings.TrimSpace(clouddata.DeleteGroup.GroupID)
+	if group == "" {
+		err = fmt.Errorf("No group id received")
+		return "", &payloadError{err, payloads.InvalidData}
+	}
+	return group, nil
+}
+
+func parsePowerDownPayload(data []byte) *payloadError {
+	var clouddata payloads.PowerDown
+
+	err := payloads.Unmarshal(data, &clouddata)
+	if err != nil {
+		return &payloadError{err, payloads.InvalidPayload}
+	}
+	return nil
+}
+
+func parseCollectDiagnosticsPayload(data []byte) (string, *insDiagnosticsCmd, *payloadError) {
+	var clouddata payloads.CollectDiagnostics
+
+	err := payloads.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", nil, &payloadError{err, payloads.InvalidPayload}
+	}
+
+	collect := &clouddata.Collect
+	instance := strings.TrimSpace(collect.InstanceUUID)
+	if instance == "" {
+		err = fmt.Errorf("No instance id received")
+		return "", nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	if collect.UploadURL != "" {
+		u, err := url.Parse(collect.UploadURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			err = fmt.Errorf("Invalid upload URL %s", collect.UploadURL)
+			return "", nil, &payloadError{err, payloads.InvalidData}
+		}
+	}
+
+	samples := collect.StatsSamples
+	if samples <= 0 {
+		samples = defaultDiagnosticsSamples
+	} else if samples > statsHistoryLen {
+		samples = statsHistoryLen
+	}
+
+	return instance, &insDiagnosticsCmd{
+		uploadURL:  collect.UploadURL,
+		memoryDump: collect.MemoryDump,
+		samples:    samples,
+	}, nil
+}
+
+func parseSecurityGroupPayload(data []byte) (string, *insSecurityGroupCmd, *payloadError) {
+	var clouddata payloads.SecurityGroupRules
+
+	err := payloads.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", nil, &payloadError{err, payloads.InvalidPayload}
+	}
+
+	err = payloads.Validate(&clouddata)
+	if err != nil {
+		return "", nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	group := &clouddata.Group
+	return strings.TrimSpace(group.InstanceUUID), &insSecurityGroupCmd{
+		Version: group.Version,
+		Rules:   group.Rules,
+	}, nil
+}
+
+func parsePrefetchPayload(data []byte) (string, string, *payloadError) {
+	var clouddata payloads.Prefetch
+
+	err := payloads.Unmarshal(data, &clouddata)
+	if err != nil {
+		return "", "", &payloadError{err, payloads.InvalidPayload}
+	}
+
+	image := strings.TrimSpace(clouddata.Prefetch.ImageUUID)
+	if !uuidRegexp.MatchString(image) {
+		err = fmt.Errorf("Invalid image id received: %s", image)
+		return "", "", &payloadError{err, payloads.InvalidData}
+	}
+	return image, strings.TrimSpace(clouddata.Prefetch.Checksum), nil
+}
+
+func parseReservePayload(data []byte) (*reserveCmd, *payloadError) {
+	var clouddata payloads.Reserve
+
+	err := payloads.Unmarshal(data, &clouddata)
+	if err == nil {
+		err = payloads.Validate(&clouddata)
+	}
+	if err != nil {
+		return nil, &payloadError{err, payloads.InvalidPayload}
+	}
+
+	reserve := &clouddata.Reserve
+	expires, ok := reserve.ExpiryTime()
+	if !ok {
+		expires = time.Now().Add(time.Duration(reserve.TTLSeconds) * time.Second)
+	}
+
+	cmd := &reserveCmd{
+		id: strings.TrimSpace(reserve.ReservationID),
+		hold: resourceHold{
+			tenant:  strings.TrimSpace(reserve.TenantUUID),
+			expires: expires,
+		},
+	}
+
+	for _, r := range reserve.RequestedResources {
+		switch r.Type {
+		case payloads.MemMB:
+			cmd.hold.memMB = r.Value
+		case payloads.VCPUs:
+			cmd.hold.vcpus = r.Value
+		case payloads.DiskMB:
+			cmd.hold.diskMB = r.Value
+		}
+	}
+
+	return cmd, nil
+}
+
+// tenantLimit holds the maximum number of instances and amount of memory that
+// a tenant may use on this node.  A value of 0 indicates no limit.
+type tenantLimit struct {
+	maxInstances int
+	maxMemMB     int
+}
+
+// checkEncryption validates the encryption section of the START payload and
+// returns the decoded key, if the key was delivered in the payload.
+func checkEncryption(enc *payloads.DiskEncryption) ([]byte, error) {
+	if (enc.Key == "") == (enc.KeyURL == "") {
+		return nil, fmt.Errorf("Exactly one of key or key_url must be specified")
+	}
+
+	if enc.KeyURL != "" {
+		u, err := url.Parse(enc.KeyURL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("Invalid key_url %s", enc.KeyURL)
+		}
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(enc.Key)
+	if err != nil || len(key) == 0 || len(key) > maxDiskKeyBytes {
+		return nil, fmt.Errorf("Invalid disk encryption key")
+	}
+
+	return key, nil
+}
+
+// checkHooks verifies that the node accepts the hook scripts in the START
+// payload, and that each of them can be executed directly.
+func checkHooks(hooks *payloads.InstanceHooks) error {
+	scripts := map[string]string{
+		hookPreStart:  hooks.PreStart,
+		hookPostStart: hooks.PostStart,
+		hookPreStop:   hooks.PreStop,
+	}
+	for name, script := range scripts {
+		if script == "" {
+			continue
+		}
+		if !allowInstanceHooks {
+			return fmt.Errorf("Instance hooks are not allowed on this node")
+		}
+		if !strings.HasPrefix(script, "#!") {
+			return fmt.Errorf("The %s hook does not begin with #!", name)
+		}
+	}
+
+	return nil
+}
+
+func parseConfigurePayload(data []byte) (*configureCmd, *payloadError) {
+	var clouddata payloads.Configure
+
+	err := payloads.Unmarshal(data, &clouddata)
+	if err != nil {
+		return nil, &payloadError{err, payloads.InvalidPayload}
+	}
+
+	err = payloads.Validate(&clouddata)
+	if err != nil {
+		return nil, &payloadError{err, payloads.InvalidData}
+	}
+
+	limits := make(map[string]tenantLimit)
+	for _, l := range clouddata.Configure.Launcher.TenantLimits {
+		tenant := strings.TrimSpace(l.TenantUUID)
+		if !uuidRegexp.MatchString(tenant) {
+			err = fmt.Errorf("Invalid tenant id received: %s", tenant)
+			return nil, &payloadError{err, payloads.InvalidData}
+		}
+		if l.MaxInstances < 0 || l.MaxMemMB < 0 {
+			err = fmt.Errorf("Invalid limits received for tenant %s", tenant)
+			return nil, &payloadError{err, payloads.InvalidData}
+		}
+		limits[tenant] = tenantLimit{l.MaxInstances, l.MaxMemMB}
+	}
+
+	return &configureCmd{
+		limits:   limits,
+		settings: newLauncherSettings(&clouddata.Configure.Cluster),
+	}, nil
+}
+
 func loadVMConfig(instanceDir string) (*vmConfig, error) {
 	cfgFilePath := path.Join(instanceDir, instanceState)
 	cfgFile, err := os.Open(cfgFilePath)
 	if err != nil {
-		glog.Errorf("Unable to open instance file %s", cfgFilePath)
+		clog.Errorf("Unable to open instance file %s", cfgFilePath)
 		return nil, err
 	}
 
@@ -323,7 +897,7 @@ func loadVMConfig(instanceDir string) (*vmConfig, error) {
 	_ = cfgFile.Close()
 
 	if err != nil {
-		glog.Error("Unable to retrieve state info")
+		clog.Error("Unable to retrieve state info")
 		return nil, err
 	}
 
@@ -490,7 +1064,7 @@ func splitYaml(data []byte) ([]byte, []byte, []byte) {
 		extractDocument(notStart[0], &ci)
 		extractDocument(notStart[1], &md)
 	} else {
-		glog.Warning("Unable to split payload into documents")
+		clog.Warning("Unable to split payload into documents")
 	}
 
 	return s.Bytes(), ci.Bytes(), md.Bytes()
@@ -0,0 +1,210 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/01org/ciao/clog"
+)
+
+var pciDevicesPath = "/sys/bus/pci/devices"
+
+const (
+	pciDriversProbe   = "/sys/bus/pci/drivers_probe"
+	vfioPCIDriver     = "vfio-pci"
+	pciDriverLink     = "driver"
+	pciDriverUnbind   = "unbind"
+	pciDriverOverride = "driver_override"
+	pciIOMMUGroup     = "iommu_group"
+	pciBootVGA        = "boot_vga"
+	pciClassVGA       = "0x0300"
+	pciClass3D        = "0x0302"
+)
+
+func writeSysfs(path, value string) error {
+	return ioutil.WriteFile(path, []byte(value), 0200)
+}
+
+func pciDeviceDriver(addr string) string {
+	driver, err := os.Readlink(filepath.Join(pciDevicesPath, addr, pciDriverLink))
+	if err != nil {
+		return ""
+	}
+	return filepath.Base(driver)
+}
+
+// getSRIOVVFs returns the PCI addresses of all the SR-IOV virtual functions
+// present on the node.  Any PCI device that has a physfn link is a VF.
+func getSRIOVVFs() []string {
+	matches, err := filepath.Glob(filepath.Join(pciDevicesPath, "*", "physfn"))
+	if err != nil {
+		return nil
+	}
+
+	vfs := make([]string, 0, len(matches))
+	for _, m := range matches {
+		vfs = append(vfs, filepath.Base(filepath.Dir(m)))
+	}
+	return vfs
+}
+
+// pciDisplayController returns true if the PCI device identified by addr is
+// a display controller, i.e., a GPU function.
+func pciDisplayController(addr string) bool {
+	class, err := ioutil.ReadFile(filepath.Join(pciDevicesPath, addr, "class"))
+	if err != nil {
+		return false
+	}
+
+	classStr := strings.TrimSpace(string(class))
+	return strings.HasPrefix(classStr, pciClassVGA) || strings.HasPrefix(classStr, pciClass3D)
+}
+
+// pciBootVGADevice returns true if the PCI device identified by addr is the
+// boot VGA device, typically the host's console.
+func pciBootVGADevice(addr string) bool {
+	bootVGA, err := ioutil.ReadFile(filepath.Join(pciDevicesPath, addr, pciBootVGA))
+	return err == nil && strings.TrimSpace(string(bootVGA)) == "1"
+}
+
+// iommuGroupGPUs returns the GPUs of the IOMMU group of the PCI device
+// identified by addr if they can be assigned to a VM instance, together,
+// without taking any device away from the host.  The group must not contain
+// the boot VGA device and its members other than its GPUs must already be
+// bound to vfio-pci.
+func iommuGroupGPUs(addr string) []string {
+	members, err := ioutil.ReadDir(filepath.Join(pciDevicesPath, addr, pciIOMMUGroup, "devices"))
+	if err != nil || len(members) == 0 {
+		return nil
+	}
+
+	var gpus []string
+	for _, m := range members {
+		switch {
+		case pciBootVGADevice(m.Name()):
+			return nil
+		case pciDisplayController(m.Name()):
+			gpus = append(gpus, m.Name())
+		case pciDeviceDriver(m.Name()) != vfioPCIDriver:
+			return nil
+		}
+	}
+	return gpus
+}
+
+// getGPUGroups returns the PCI addresses of all the display controllers
+// present on the node that can be assigned to VM instances using VFIO,
+// grouped by IOMMU group.  VFIO cannot split an IOMMU group between two
+// instances, so the GPUs of a group are always assigned together and count
+// as a single GPU.
+func getGPUGroups() [][]string {
+	devs, err := ioutil.ReadDir(pciDevicesPath)
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	groups := make([][]string, 0, len(devs))
+	for _, d := range devs {
+		if seen[d.Name()] || !pciDisplayController(d.Name()) {
+			continue
+		}
+
+		gpus := iommuGroupGPUs(d.Name())
+		for _, gpu := range gpus {
+			seen[gpu] = true
+		}
+		if len(gpus) > 0 {
+			groups = append(groups, gpus)
+		}
+	}
+	return groups
+}
+
+// getGPUs returns the PCI addresses of all the GPUs that can be assigned to
+// VM instances.
+func getGPUs() []string {
+	var gpus []string
+	for _, group := range getGPUGroups() {
+		gpus = append(gpus, group...)
+	}
+	return gpus
+}
+
+// vfioBind detaches the PCI device identified by addr from its current
+// host driver and binds it to vfio-pci so that it can be passed through to
+// a qemu instance.  Calling vfioBind on a device already bound to vfio-pci
+// is a no-op.
+func vfioBind(addr string) error {
+	driver := pciDeviceDriver(addr)
+	if driver == vfioPCIDriver {
+		return nil
+	}
+
+	devPath := filepath.Join(pciDevicesPath, addr)
+	err := writeSysfs(filepath.Join(devPath, pciDriverOverride), vfioPCIDriver)
+	if err != nil {
+		return fmt.Errorf("Unable to set driver override for %s: %v", addr, err)
+	}
+
+	if driver != "" {
+		err = writeSysfs(filepath.Join(devPath, pciDriverLink, pciDriverUnbind), addr)
+		if err != nil {
+			return fmt.Errorf("Unable to unbind %s from %s: %v", addr, driver, err)
+		}
+	}
+
+	err = writeSysfs(pciDriversProbe, addr)
+	if err != nil {
+		return fmt.Errorf("Unable to probe driver for %s: %v", addr, err)
+	}
+
+	if pciDeviceDriver(addr) != vfioPCIDriver {
+		return fmt.Errorf("Unable to bind %s to %s", addr, vfioPCIDriver)
+	}
+
+	return nil
+}
+
+// vfioUnbind returns a PCI device previously bound to vfio-pci to its
+// default host driver.
+func vfioUnbind(addr string) {
+	devPath := filepath.Join(pciDevicesPath, addr)
+
+	err := writeSysfs(filepath.Join(devPath, pciDriverOverride), "\n")
+	if err != nil {
+		clog.Warningf("Unable to clear driver override for %s: %v", addr, err)
+	}
+
+	if pciDeviceDriver(addr) == vfioPCIDriver {
+		err = writeSysfs(filepath.Join(devPath, pciDriverLink, pciDriverUnbind), addr)
+		if err != nil {
+			clog.Warningf("Unable to unbind %s from %s: %v", addr, vfioPCIDriver, err)
+			return
+		}
+	}
+
+	err = writeSysfs(pciDriversProbe, addr)
+	if err != nil {
+		clog.Warningf("Unable to probe driver for %s: %v", addr, err)
+	}
+}
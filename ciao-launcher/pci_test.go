@@ -0,0 +1,126 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+)
+
+type fakePCIDevice struct {
+	addr    string
+	class   string
+	bootVGA string
+	driver  string
+	group   string
+}
+
+func writeFakePCIDevices(t *testing.T, dir string, devs []fakePCIDevice) {
+	devicesDir := path.Join(dir, "devices")
+	for _, d := range devs {
+		devPath := path.Join(devicesDir, d.addr)
+		if err := os.MkdirAll(devPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		err := ioutil.WriteFile(path.Join(devPath, "class"), []byte(d.class+"\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.bootVGA != "" {
+			err = ioutil.WriteFile(path.Join(devPath, pciBootVGA), []byte(d.bootVGA+"\n"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if d.driver != "" {
+			driverPath := path.Join(dir, "drivers", d.driver)
+			if err := os.MkdirAll(driverPath, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(driverPath, path.Join(devPath, pciDriverLink)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if d.group != "" {
+			groupPath := path.Join(dir, "iommu_groups", d.group)
+			if err := os.MkdirAll(path.Join(groupPath, "devices", d.addr), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Symlink(groupPath, path.Join(devPath, pciIOMMUGroup)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestGetGPUs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-pci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	writeFakePCIDevices(t, dir, []fakePCIDevice{
+		// The boot VGA device.
+		{addr: "0000:00:02.0", class: "0x030000", bootVGA: "1", group: "0"},
+		// A GPU whose audio function is bound to vfio-pci.
+		{addr: "0000:01:00.0", class: "0x030000", bootVGA: "0", group: "1"},
+		{addr: "0000:01:00.1", class: "0x040300", driver: vfioPCIDriver, group: "1"},
+		// A GPU whose audio function is used by the host.
+		{addr: "0000:02:00.0", class: "0x030200", group: "2"},
+		{addr: "0000:02:00.1", class: "0x040300", driver: "snd_hda_intel", group: "2"},
+		// A GPU outside any IOMMU group.
+		{addr: "0000:03:00.0", class: "0x030000"},
+		// A 3D controller alone in its group.
+		{addr: "0000:04:00.0", class: "0x030200", group: "4"},
+		// A network controller.
+		{addr: "0000:05:00.0", class: "0x020000", group: "5"},
+		// A GPU sharing its group with the boot VGA device.
+		{addr: "0000:06:00.0", class: "0x030000", group: "0"},
+		// Two GPUs sharing a group, with a function bound to vfio-pci.
+		{addr: "0000:07:00.0", class: "0x030000", group: "7"},
+		{addr: "0000:07:00.1", class: "0x040300", driver: vfioPCIDriver, group: "7"},
+		{addr: "0000:08:00.0", class: "0x030200", group: "7"},
+	})
+
+	oldPCIDevicesPath := pciDevicesPath
+	pciDevicesPath = path.Join(dir, "devices")
+	defer func() { pciDevicesPath = oldPCIDevicesPath }()
+
+	expected := [][]string{{"0000:01:00.0"}, {"0000:04:00.0"}, {"0000:07:00.0", "0000:08:00.0"}}
+	groups := getGPUGroups()
+	if !reflect.DeepEqual(groups, expected) {
+		t.Fatalf("Unexpected GPU groups %v, expected %v", groups, expected)
+	}
+
+	// The GPUs of a group are allocated, and counted, together.
+	ovs := &overseer{pciDevsAllocated: make(map[string]string)}
+	ovs.pciDevsAllocated["0000:01:00.0"] = "instance-1"
+	if free := ovs.freeGPUGroups(groups); len(free) != 2 {
+		t.Fatalf("Expected 2 free GPU groups, got %v", free)
+	}
+	gpus := ovs.allocateGPUs("instance-2", groups, 2)
+	if !reflect.DeepEqual(gpus, []string{"0000:04:00.0", "0000:07:00.0", "0000:08:00.0"}) {
+		t.Errorf("Unexpected GPUs allocated %v", gpus)
+	}
+	if free := ovs.freeGPUGroups(groups); len(free) != 0 {
+		t.Errorf("Expected no free GPU group, got %v", free)
+	}
+}
@@ -19,7 +19,7 @@ package main
 import (
 	"sync"
 
-	"github.com/golang/glog"
+	"github.com/01org/ciao/clog"
 )
 
 const (
@@ -59,7 +59,7 @@ func (pg *portGrabber) grabPort() int {
 	port := 0
 
 	pg.Lock()
-	glog.Infof("Ports available %d", len(pg.free))
+	clog.Infof("Ports available %d", len(pg.free))
 	for key := range pg.free {
 		port = key
 		break
@@ -67,7 +67,7 @@ func (pg *portGrabber) grabPort() int {
 
 	if port != 0 {
 		delete(pg.free, port)
-		glog.Infof("Grabbing port: %d", port)
+		clog.Infof("Grabbing port: %d", port)
 	}
 	pg.Unlock()
 
@@ -75,15 +75,15 @@ func (pg *portGrabber) grabPort() int {
 }
 
 func (pg *portGrabber) releasePort(port int) {
-	glog.Infof("Releasing port: %d", port)
+	clog.Infof("Releasing port: %d", port)
 
 	if port < portGrabberStart || port >= portGrabberMax {
-		glog.Warningf("Unable to release invalid port number %d", port)
+		clog.Warningf("Unable to release invalid port number %d", port)
 		return
 	}
 
 	pg.Lock()
 	pg.free[port] = struct{}{}
-	glog.Infof("Ports available %d", len(pg.free))
+	clog.Infof("Ports available %d", len(pg.free))
 	pg.Unlock()
 }
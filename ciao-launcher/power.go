@@ -0,0 +1,122 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/01org/ciao/clog"
+)
+
+type powerDownFlag string
+
+const (
+	powerDownNone    powerDownFlag = "none"
+	powerDownSuspend powerDownFlag = "suspend"
+	powerDownHook    powerDownFlag = "hook"
+)
+
+func (f *powerDownFlag) String() string {
+	return string(*f)
+}
+
+func (f *powerDownFlag) Set(val string) error {
+	switch powerDownFlag(val) {
+	case powerDownNone, powerDownSuspend, powerDownHook:
+	default:
+		return fmt.Errorf("none, suspend or hook expected")
+	}
+	*f = powerDownFlag(val)
+	return nil
+}
+
+// hookPowerDown is the node hook run in hook power down mode, typically a
+// script powering the node off through its BMC with ipmitool.
+const hookPowerDown = "power-down"
+
+type powerDownCmd struct{}
+
+// getWakeOnLANMAC returns the MAC address of the interface the node can be
+// woken up through, or an empty string if the node does not accept
+// POWERDOWN commands.
+func getWakeOnLANMAC() string {
+	if powerDownMode == powerDownNone || wakeOnLANInterface == "" {
+		return ""
+	}
+
+	iface, err := net.InterfaceByName(wakeOnLANInterface)
+	if err != nil {
+		clog.Warningf("Unable to find wake-on-LAN interface %s: %v", wakeOnLANInterface, err)
+		return ""
+	}
+
+	return iface.HardwareAddr.String()
+}
+
+// processPowerDown powers the node down, unless instances are running or
+// being started on it, or resources are held for instances to come.  The
+// scheduler does not place instances on the nodes it powers down, but
+// instances started before the command was sent may still be there.
+func processPowerDown(ovsCh chan<- interface{}) {
+	targetCh := make(chan int)
+	ovsCh <- &ovsActiveCmd{targetCh}
+	if active := <-targetCh; active > 0 {
+		clog.Warningf("Ignoring POWERDOWN: %d instances running or starting, or reservations held", active)
+		return
+	}
+
+	if powerDownMode == powerDownNone {
+		clog.Warning("Ignoring POWERDOWN: power down is disabled")
+		return
+	}
+
+	if simulate {
+		clog.Infof("Simulating %s power down", powerDownMode)
+		return
+	}
+
+	go func() {
+		if err := powerDown(); err != nil {
+			clog.Errorf("Unable to power down: %v", err)
+		}
+	}()
+}
+
+func powerDown() error {
+	clog.Infof("Powering down: %s", powerDownMode)
+
+	if powerDownMode == powerDownHook {
+		if nodeHooksDir == "" {
+			return fmt.Errorf("No hooks directory")
+		}
+		return runHook(path.Join(nodeHooksDir, hookPowerDown),
+			append(os.Environ(), "CIAO_HOOK="+hookPowerDown))
+	}
+
+	out, err := exec.Command("systemctl", "suspend").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("systemctl suspend failed: %v: %s", err,
+			strings.TrimSpace(string(out)))
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestPowerDownFlag(t *testing.T) {
+	var f powerDownFlag
+
+	for _, val := range []string{"none", "suspend", "hook"} {
+		if err := f.Set(val); err != nil || f.String() != val {
+			t.Errorf("Valid power down mode %s rejected: %v", val, err)
+		}
+	}
+
+	if err := f.Set("off"); err == nil {
+		t.Errorf("Invalid power down mode accepted")
+	}
+}
+
+// Checks that a node with instances running ignores POWERDOWN commands.
+func TestProcessPowerDownBusy(t *testing.T) {
+	oldMode := powerDownMode
+	powerDownMode = powerDownSuspend
+	defer func() { powerDownMode = oldMode }()
+
+	ovsCh := make(chan interface{})
+	go func() {
+		cmd := (<-ovsCh).(*ovsActiveCmd)
+		cmd.targetCh <- 1
+		close(ovsCh)
+	}()
+
+	processPowerDown(ovsCh)
+
+	if _, ok := <-ovsCh; ok {
+		t.Errorf("Unexpected overseer command")
+	}
+}
+
+func TestPowerDownHook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-power")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	oldMode := powerDownMode
+	oldNodeHooksDir := nodeHooksDir
+	powerDownMode = powerDownHook
+	nodeHooksDir = dir
+	defer func() {
+		powerDownMode = oldMode
+		nodeHooksDir = oldNodeHooksDir
+	}()
+
+	logPath := path.Join(dir, "log")
+	err = ioutil.WriteFile(path.Join(dir, hookPowerDown),
+		[]byte("#!/bin/sh\necho $CIAO_HOOK > "+logPath+"\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = powerDown(); err != nil {
+		t.Fatalf("power-down hook failed: %v", err)
+	}
+
+	log, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(log) != "power-down\n" {
+		t.Errorf("Unexpected hook output %q", string(log))
+	}
+}
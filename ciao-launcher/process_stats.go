@@ -23,15 +23,15 @@ import (
 	"path"
 	"strconv"
 
-	"github.com/golang/glog"
+	"github.com/01org/ciao/clog"
 )
 
 func computeProcessMemUsage(pid int) int {
 	smapsPath := path.Join("/proc", fmt.Sprintf("%d", pid), "smaps")
 	smaps, err := os.Open(smapsPath)
 	if err != nil {
-		if glog.V(1) {
-			glog.Warning("Unable to open %s: %v", smapsPath, err)
+		if clog.V(1) {
+			clog.Warning("Unable to open %s: %v", smapsPath, err)
 		}
 		return -1
 	}
@@ -56,11 +56,19 @@ func computeProcessMemUsage(pid int) int {
 }
 
 func computeProcessCPUTime(pid int) int64 {
-	statPath := path.Join("/proc", fmt.Sprintf("%d", pid), "stat")
+	return computeCPUTime(path.Join("/proc", fmt.Sprintf("%d", pid), "stat"))
+}
+
+func computeThreadCPUTime(pid, tid int) int64 {
+	return computeCPUTime(path.Join("/proc", fmt.Sprintf("%d", pid), "task",
+		fmt.Sprintf("%d", tid), "stat"))
+}
+
+func computeCPUTime(statPath string) int64 {
 	stat, err := os.Open(statPath)
 	if err != nil {
-		if glog.V(1) {
-			glog.Warning("Unable to open %s: %v", statPath, err)
+		if clog.V(1) {
+			clog.Warning("Unable to open %s: %v", statPath, err)
 		}
 		return -1
 	}
@@ -83,8 +91,8 @@ func computeProcessCPUTime(pid int) int64 {
 	}
 
 	if userTime == -1 || sysTime == -1 {
-		if glog.V(1) {
-			glog.Warningf("Invalid user or systime %d %d",
+		if clog.V(1) {
+			clog.Warningf("Invalid user or systime %d %d",
 				userTime, sysTime)
 		}
 		return -1
@@ -93,8 +101,8 @@ func computeProcessCPUTime(pid int) int64 {
 	cpuTime := (1000 * 1000 * 1000 * (userTime + sysTime)) /
 		clockTicksPerSecond
 
-		//	if glog.V(1) {
-		//		glog.Infof("PID %d: cpuTime %d userTime %d sysTime %d",
+		//	if clog.V(1) {
+		//		clog.Infof("PID %d: cpuTime %d userTime %d sysTime %d",
 		//			q.pid, cpuTime, userTime, sysTime)
 		//	}
 
@@ -21,7 +21,7 @@ import (
 	"os"
 	"runtime/pprof"
 
-	"github.com/golang/glog"
+	"github.com/01org/ciao/clog"
 )
 
 var cpuProfile string
@@ -35,7 +35,7 @@ func init() {
 
 		f, err := os.Create(cpuProfile)
 		if err != nil {
-			glog.Warning("Unable to create profile file %s: %v",
+			clog.Warning("Unable to create profile file %s: %v",
 				cpuProfile, err)
 			return nil
 		}
@@ -19,6 +19,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -31,18 +32,22 @@ import (
 	"sync"
 	"time"
 
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/payloads"
 	"gopkg.in/yaml.v2"
-
-	"github.com/golang/glog"
 )
 
 const (
-	qemuEfiFw  = "/usr/share/qemu/OVMF.fd"
-	seedImage  = "seed.iso"
-	ciaoImage  = "ciao.iso"
-	imagesPath = "/var/lib/ciao/images"
-	vcTries    = 10
+	qemuEfiFw      = "/usr/share/qemu/OVMF.fd"
+	seedImage      = "seed.iso"
+	qgaSocket      = "qga"
+	ciaoImage      = "ciao.iso"
+	imagesPath     = "/var/lib/ciao/images"
+	hugepagesPath  = "/dev/hugepages"
+	vcTries        = 10
+	qemuLog        = "qemu.log"
+	qemuConsoleLog = "console.log"
+	qemuConsole    = "console.sock"
 )
 
 var virtualSizeRegexp *regexp.Regexp
@@ -62,6 +67,11 @@ type qemu struct {
 	prevSampleTime time.Time
 	isoPath        string
 	ciaoISOPath    string
+	qmpQueryCh     chan *qmpQuery
+	qmpDoneCh      chan struct{}
+	balloonPolling bool
+	vcpuThreads    []int
+	vcpuCPUStats   bool
 }
 
 func (q *qemu) init(cfg *vmConfig, instanceDir string) {
@@ -69,6 +79,46 @@ func (q *qemu) init(cfg *vmConfig, instanceDir string) {
 	q.instanceDir = instanceDir
 	q.isoPath = path.Join(instanceDir, seedImage)
 	q.ciaoISOPath = path.Join(instanceDir, ciaoImage)
+
+	// Instances that were running when launcher was restarted need to be
+	// served again.
+	if !cloudInitMode.NeedsISO() && cfg.VnicName != "" {
+		_ = serveMetadata(cfg.VnicName, cfg, instanceDir)
+	}
+}
+
+// serveMetadata serves the metadata of the instance to the requests received
+// on vnicName, in metadata-service mode.
+func (q *qemu) serveMetadata(vnicName string) error {
+	if cloudInitMode.NeedsISO() || vnicName == "" {
+		return nil
+	}
+
+	return serveMetadata(vnicName, q.cfg, q.instanceDir)
+}
+
+// consoleParams returns the qemu parameters connecting the serial port of an
+// instance to a unix socket in instanceDir, on which its console can be
+// accessed, while logging the console output to logFile.
+func consoleParams(instanceDir, logFile string) []string {
+	chardev := fmt.Sprintf("socket,id=console0,path=%s,server,nowait,logfile=%s",
+		path.Join(instanceDir, qemuConsole), path.Join(instanceDir, logFile))
+	return []string{"-chardev", chardev, "-serial", "chardev:console0"}
+}
+
+// console returns the socket of the serial console of the instance.  The
+// socket does not exist if the instance was launched with a virtual console.
+func (q *qemu) console() (string, error) {
+	if q.pid == 0 {
+		return "", fmt.Errorf("Instance is not running")
+	}
+
+	socket := path.Join(q.instanceDir, qemuConsole)
+	if _, err := os.Stat(socket); err != nil {
+		return "", fmt.Errorf("Console unavailable: %v", err)
+	}
+
+	return socket, nil
 }
 
 func (q *qemu) imageInfo(imagePath string) (imageSizeMB int, err error) {
@@ -81,14 +131,14 @@ func (q *qemu) imageInfo(imagePath string) (imageSizeMB int, err error) {
 	cmd := exec.Command("qemu-img", params...)
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		glog.Errorf("Unable to read output from qemu-img: %v", err)
+		clog.Errorf("Unable to read output from qemu-img: %v", err)
 		return -1, err
 	}
 
 	err = cmd.Start()
 	if err != nil {
 		_ = stdout.Close()
-		glog.Errorf("Unable start qemu-img: %v", err)
+		clog.Errorf("Unable start qemu-img: %v", err)
 		return -1, err
 	}
 
@@ -101,21 +151,21 @@ func (q *qemu) imageInfo(imagePath string) (imageSizeMB int, err error) {
 		}
 
 		if len(matches) < 2 {
-			glog.Warningf("Unable to find image size from: %s",
+			clog.Warningf("Unable to find image size from: %s",
 				line)
 			break
 		}
 
 		sizeInBytes, err := strconv.ParseInt(matches[1], 10, 64)
 		if err != nil {
-			glog.Warningf("Unable to parse image size from: %s",
+			clog.Warningf("Unable to parse image size from: %s",
 				matches[1])
 			break
 		}
 
 		size := sizeInBytes / (1000 * 1000)
 		if size > int64((^uint(0))>>1) {
-			glog.Warningf("Unexpectedly large disk size found: %d MB",
+			clog.Warningf("Unexpectedly large disk size found: %d MB",
 				size)
 			break
 		}
@@ -128,9 +178,9 @@ func (q *qemu) imageInfo(imagePath string) (imageSizeMB int, err error) {
 
 	err = cmd.Wait()
 	if err != nil {
-		glog.Warningf("qemu-img returned an error: %v", err)
+		clog.Warningf("qemu-img returned an error: %v", err)
 		if imageSizeMB != -1 {
-			glog.Warning("But we already parsed the image size, so we don't care")
+			clog.Warning("But we already parsed the image size, so we don't care")
 			err = nil
 		}
 	}
@@ -138,53 +188,6 @@ func (q *qemu) imageInfo(imagePath string) (imageSizeMB int, err error) {
 	return imageSizeMB, err
 }
 
-func createCloudInitISO(instanceDir, isoPath string, cfg *vmConfig, userData, metaData []byte) error {
-
-	configDrivePath := path.Join(instanceDir, "clr-cloud-init")
-	dataDirPath := path.Join(configDrivePath, "openstack", "latest")
-	metaDataPath := path.Join(dataDirPath, "meta_data.json")
-	userDataPath := path.Join(dataDirPath, "user_data")
-
-	defer func() {
-		_ = os.RemoveAll(configDrivePath)
-	}()
-
-	err := os.MkdirAll(dataDirPath, 0755)
-	if err != nil {
-		glog.Errorf("Unable to create config drive directory %s", dataDirPath)
-		return err
-	}
-
-	if len(metaData) == 0 {
-		defaultMeta := fmt.Sprintf("{\n  \"uuid\": %q,\n  \"hostname\": %[1]q\n}\n", cfg.Instance)
-		metaData = []byte(defaultMeta)
-	}
-
-	err = ioutil.WriteFile(metaDataPath, metaData, 0644)
-	if err != nil {
-		glog.Errorf("Unable to create %s", metaDataPath)
-		return err
-	}
-
-	err = ioutil.WriteFile(userDataPath, userData, 0644)
-	if err != nil {
-		glog.Errorf("Unable to create %s", userDataPath)
-		return err
-	}
-
-	cmd := exec.Command("xorriso", "-as", "mkisofs", "-R", "-V", "config-2", "-o", isoPath,
-		configDrivePath)
-	err = cmd.Run()
-	if err != nil {
-		glog.Errorf("Unable to create cloudinit iso image %v", err)
-		return err
-	}
-
-	glog.Infof("ISO image %s created", isoPath)
-
-	return nil
-}
-
 func createCiaoISO(instanceDir, isoPath string) error {
 	ciaoDrivePath := path.Join(instanceDir, "ciao")
 	ciaoPath := path.Join(ciaoDrivePath, "ciao.yaml")
@@ -195,20 +198,20 @@ func createCiaoISO(instanceDir, isoPath string) error {
 
 	err := os.MkdirAll(ciaoDrivePath, 0755)
 	if err != nil {
-		glog.Errorf("Unable to create ciao drive directory %s", ciaoDrivePath)
+		clog.Errorf("Unable to create ciao drive directory %s", ciaoDrivePath)
 		return err
 	}
 
 	config := payloads.CNCIInstanceConfig{SchedulerAddr: serverURL}
 	y, err := yaml.Marshal(&config)
 	if err != nil {
-		glog.Errorf("Unable to create yaml ciao file %s", err)
+		clog.Errorf("Unable to create yaml ciao file %s", err)
 		return err
 	}
 
 	err = ioutil.WriteFile(ciaoPath, y, 0644)
 	if err != nil {
-		glog.Errorf("Unable to create %s", ciaoPath)
+		clog.Errorf("Unable to create %s", ciaoPath)
 		return err
 	}
 
@@ -216,23 +219,36 @@ func createCiaoISO(instanceDir, isoPath string) error {
 		ciaoPath)
 	err = cmd.Run()
 	if err != nil {
-		glog.Errorf("Unable to create ciao iso image %v", err)
+		clog.Errorf("Unable to create ciao iso image %v", err)
 		return err
 	}
 
-	glog.Infof("Ciao ISO image %s created", isoPath)
+	clog.Infof("Ciao ISO image %s created", isoPath)
 
 	return nil
 }
 
+// createRootfs creates the qcow2 overlay of the instance.  Its virtual size is
+// the disk size of the instance, or the size of the backing image if none was
+// requested, so the guest can never grow it beyond that size.
 func (q *qemu) createRootfs() error {
 	vmImage := path.Join(q.instanceDir, "image.qcow2")
 	backingImage := path.Join(imagesPath, q.cfg.Image)
-	glog.Infof("Creating qcow image from %s backing %s", vmImage, backingImage)
+	clog.Infof("Creating qcow image from %s backing %s", vmImage, backingImage)
 
+	options := "backing_file=" + backingImage
 	params := make([]string, 0, 32)
-	params = append(params, "create", "-f", "qcow2", "-o", "backing_file="+backingImage,
-		vmImage)
+	params = append(params, "create", "-f", "qcow2")
+	if q.cfg.Encrypted {
+		keyPath, cleanup, err := prepareDiskSecret(q.instanceDir, q.cfg)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		params = append(params, "--object", diskSecretParam(keyPath))
+		options += ",encrypt.format=luks,encrypt.key-secret=" + diskSecretID
+	}
+	params = append(params, "-o", options, vmImage)
 	if q.cfg.Disk > 0 {
 		diskSize := fmt.Sprintf("%dM", q.cfg.Disk)
 		params = append(params, diskSize)
@@ -246,9 +262,11 @@ func (q *qemu) checkBackingImage() error {
 	backingImage := path.Join(imagesPath, q.cfg.Image)
 	_, err := os.Stat(backingImage)
 	if err != nil {
-		return fmt.Errorf("Backing Image does not exist: %v", err)
+		return errImageNotFound
 	}
 
+	touchImage(q.cfg.Image)
+
 	if q.cfg.Disk != 0 {
 		minSizeMB, err := getMinImageSize(q, backingImage)
 		if err != nil {
@@ -256,7 +274,7 @@ func (q *qemu) checkBackingImage() error {
 		}
 
 		if minSizeMB != -1 && minSizeMB > q.cfg.Disk {
-			glog.Warningf("Requested disk size (%dM) is smaller than minimum image size (%dM).  Defaulting to min size", q.cfg.Disk, minSizeMB)
+			clog.Warningf("Requested disk size (%dM) is smaller than minimum image size (%dM).  Defaulting to min size", q.cfg.Disk, minSizeMB)
 			q.cfg.Disk = minSizeMB
 		}
 	}
@@ -265,13 +283,37 @@ func (q *qemu) checkBackingImage() error {
 }
 
 func (q *qemu) downloadBackingImage() error {
-	return fmt.Errorf("Not supported yet!")
+	return fetchImage(q.cfg.Image, "")
+}
+
+// updateSeedImage regenerates the cloud-init ISO from the data stored in the
+// instance directory when the instance was created.  Instances created by older
+// versions of ciao-launcher do not have this data, so we continue to use their
+// existing ISO.
+func (q *qemu) updateSeedImage() error {
+	userData, metaData, err := loadCloudInitData(q.instanceDir)
+	if os.IsNotExist(err) {
+		if _, statErr := os.Stat(q.isoPath); statErr == nil {
+			return nil
+		}
+	}
+	if err != nil {
+		clog.Errorf("Unable to load cloud-init data %v", err)
+		return err
+	}
+
+	err = createCloudInitISO(q.instanceDir, q.isoPath, q.cfg, userData, metaData)
+	if err != nil {
+		clog.Errorf("Unable to create iso image %v", err)
+		return err
+	}
+
+	return nil
 }
 
 func (q *qemu) createImage(bridge string, userData, metaData []byte) error {
-	err := createCloudInitISO(q.instanceDir, q.isoPath, q.cfg, userData, metaData)
+	err := saveCloudInitData(q.instanceDir, userData, metaData)
 	if err != nil {
-		glog.Errorf("Unable to create iso image %v", err)
 		return err
 	}
 
@@ -282,10 +324,40 @@ func (q *qemu) createImage(bridge string, userData, metaData []byte) error {
 		}
 	}
 
+	if q.cfg.Firmware == payloads.SecureBoot {
+		err = createEFIVars(q.instanceDir)
+		if err != nil {
+			clog.Errorf("Unable to create EFI variable store: %v", err)
+			return err
+		}
+	}
+
+	if q.cfg.diskKey != nil {
+		err = saveDiskKey(q.instanceDir, q.cfg.diskKey)
+		if err != nil {
+			clog.Errorf("Unable to store disk key: %v", err)
+			return err
+		}
+	}
+
 	return q.createRootfs()
 }
 
 func (q *qemu) deleteImage() error {
+	if !cloudInitMode.NeedsISO() {
+		stopServingMetadata(q.cfg)
+	}
+
+	for _, dev := range q.cfg.pciDevices() {
+		vfioUnbind(dev)
+	}
+
+	if q.cfg.Encrypted {
+		err := wipeFile(path.Join(q.instanceDir, diskKeyFile))
+		if err != nil {
+			clog.Warningf("Unable to wipe disk key of %s: %v", q.cfg.Instance, err)
+		}
+	}
 	return nil
 }
 
@@ -310,20 +382,20 @@ func computeMacvtapParam(vnicName string, mac string, queues int) ([]string, []*
 	ifIndexPath := path.Join("/sys/class/net", vnicName, "ifindex")
 	fip, err := os.Open(ifIndexPath)
 	if err != nil {
-		glog.Errorf("Failed to determine tap ifname: %s", err)
+		clog.Errorf("Failed to determine tap ifname: %s", err)
 		return nil, nil, err
 	}
 	defer func() { _ = fip.Close() }()
 
 	scan := bufio.NewScanner(fip)
 	if !scan.Scan() {
-		glog.Error("Unable to read tap index")
+		clog.Error("Unable to read tap index")
 		return nil, nil, fmt.Errorf("Unable to read tap index")
 	}
 
 	i, err := strconv.Atoi(scan.Text())
 	if err != nil {
-		glog.Errorf("Failed to determine tap ifname: %s", err)
+		clog.Errorf("Failed to determine tap ifname: %s", err)
 		return nil, nil, err
 	}
 
@@ -336,7 +408,7 @@ func computeMacvtapParam(vnicName string, mac string, queues int) ([]string, []*
 
 		f, err := os.OpenFile(tapDev, os.O_RDWR, 0666)
 		if err != nil {
-			glog.Errorf("Failed to open tap device %s: %s", tapDev, err)
+			clog.Errorf("Failed to open tap device %s: %s", tapDev, err)
 			cleanupFds(fds, q)
 			return nil, nil, err
 		}
@@ -373,19 +445,19 @@ func launchQemu(params []string, fds []*os.File) (string, error) {
 	errStr := ""
 	cmd := exec.Command("qemu-system-x86_64", params...)
 	if fds != nil {
-		glog.Infof("Adding extra file %v", fds)
+		clog.Infof("Adding extra file %v", fds)
 		cmd.ExtraFiles = fds
 	}
 
 	var stderr bytes.Buffer
 	cmd.Stderr = &stderr
-	glog.Infof("launching qemu with: %v", params)
+	clog.Infof("launching qemu with: %v", params)
 
 	err := cmd.Run()
 	if err != nil {
-		glog.Errorf("Unable to launch qemu: %v", err)
+		clog.Errorf("Unable to launch qemu: %v", err)
 		errStr = stderr.String()
-		glog.Error(errStr)
+		clog.Error(errStr)
 	}
 	return errStr, err
 }
@@ -407,9 +479,9 @@ func launchQemuWithNC(params []string, fds []*os.File, ipAddress string) (int, e
 		var errStr string
 		errStr, err = launchQemu(params, fds)
 		if err == nil {
-			glog.Info("============================================")
-			glog.Infof("Connect to vm with netcat %s %d", ipAddress, port)
-			glog.Info("============================================")
+			clog.Info("============================================")
+			clog.Infof("Connect to vm with netcat %s %d", ipAddress, port)
+			clog.Info("============================================")
 			break
 		}
 
@@ -421,7 +493,7 @@ func launchQemuWithNC(params []string, fds []*os.File, ipAddress string) (int, e
 	}
 
 	if port == 0 || (err != nil && tries == vcTries) {
-		glog.Warning("Failed to launch qemu due to chardev error.  Relaunching without virtual console")
+		clog.Warning("Failed to launch qemu due to chardev error.  Relaunching without virtual console")
 		_, err = launchQemu(params[:len(params)-4], fds)
 	}
 
@@ -443,9 +515,9 @@ func launchQemuWithSpice(params []string, fds []*os.File, ipAddress string) (int
 		var errStr string
 		errStr, err = launchQemu(params, fds)
 		if err == nil {
-			glog.Info("============================================")
-			glog.Infof("Connect to vm with spicec -h %s -p %d", ipAddress, port)
-			glog.Info("============================================")
+			clog.Info("============================================")
+			clog.Infof("Connect to vm with spicec -h %s -p %d", ipAddress, port)
+			clog.Info("============================================")
 			break
 		}
 
@@ -458,7 +530,7 @@ func launchQemuWithSpice(params []string, fds []*os.File, ipAddress string) (int
 	}
 
 	if port == 0 || (err != nil && tries == vcTries) {
-		glog.Warning("Failed to launch qemu due to spice error.  Relaunching without virtual console")
+		clog.Warning("Failed to launch qemu due to spice error.  Relaunching without virtual console")
 		params = append(params[:len(params)-2], "-display", "none", "-vga", "none")
 		_, err = launchQemu(params, fds)
 	}
@@ -470,18 +542,49 @@ func (q *qemu) startVM(vnicName, ipAddress string) error {
 
 	var fds []*os.File
 
-	glog.Info("Launching qemu")
+	clog.Info("Launching qemu")
+
+	if err := q.serveMetadata(vnicName); err != nil {
+		return err
+	}
 
 	vmImage := path.Join(q.instanceDir, "image.qcow2")
 	qmpSocket := path.Join(q.instanceDir, "socket")
 	fileParam := fmt.Sprintf("file=%s,if=virtio,aio=threads,format=qcow2", vmImage)
+	if q.cfg.DiskIOPS > 0 {
+		fileParam += fmt.Sprintf(",iops=%d", q.cfg.DiskIOPS)
+	}
+	if q.cfg.rootfsLimitMB() > 0 {
+		// Give back the clusters the guest discards or zeroes, so
+		// that they no longer count towards its disk limit.
+		fileParam += ",discard=unmap,detect-zeroes=unmap"
+	}
 	//BUG(markus): Should specify media type here
 	isoParam := fmt.Sprintf("file=%s,if=virtio", q.isoPath)
 	qmpParam := fmt.Sprintf("unix:%s,server,nowait", qmpSocket)
 
 	params := make([]string, 0, 32)
+	if q.cfg.Encrypted {
+		keyPath, cleanup, err := prepareDiskSecret(q.instanceDir, q.cfg)
+		if err != nil {
+			return err
+		}
+
+		// qemu reads the secret before it daemonizes, so we can safely
+		// wipe any temporary copy of the key once it has been launched.
+
+		defer cleanup()
+		params = append(params, "-object", diskSecretParam(keyPath))
+		fileParam += ",encrypt.key-secret=" + diskSecretID
+	}
 	params = append(params, "-drive", fileParam)
-	params = append(params, "-drive", isoParam)
+	if cloudInitMode.NeedsISO() {
+		err := q.updateSeedImage()
+		if err != nil {
+			return err
+		}
+		params = append(params, "-drive", isoParam)
+	}
 	if q.cfg.NetworkNode {
 		ciaoParam := fmt.Sprintf("file=%s,if=virtio", q.ciaoISOPath)
 		params = append(params, "-drive", ciaoParam)
@@ -515,23 +618,51 @@ func (q *qemu) startVM(vnicName, ipAddress string) error {
 	params = append(params, "-cpu", "host")
 	params = append(params, "-daemonize")
 	params = append(params, "-qmp", qmpParam)
+	params = append(params, "-D", path.Join(q.instanceDir, qemuLog), "-d", "guest_errors")
+
+	// The guest agent channel is used to determine when the instance is
+	// ready.  It's harmless if the image does not run the guest agent.
+
+	qgaParam := fmt.Sprintf("socket,path=%s,server,nowait,id=qga0",
+		path.Join(q.instanceDir, qgaSocket))
+	params = append(params, "-chardev", qgaParam, "-device", "virtio-serial")
+	params = append(params, "-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0")
+	params = append(params, "-device", "virtio-balloon-pci,id=balloon0")
 
 	if q.cfg.Mem > 0 {
 		memoryParam := fmt.Sprintf("%d", q.cfg.Mem)
 		params = append(params, "-m", memoryParam)
 	}
+	if q.cfg.Hugepages {
+		params = append(params, "-mem-path", hugepagesPath, "-mem-prealloc")
+	}
+
+	for _, dev := range q.cfg.pciDevices() {
+		err := vfioBind(dev)
+		if err != nil {
+			return err
+		}
+		params = append(params, "-device", fmt.Sprintf("vfio-pci,host=%s", dev))
+	}
 	if q.cfg.Cpus > 0 {
 		cpusParam := fmt.Sprintf("cpus=%d", q.cfg.Cpus)
 		params = append(params, "-smp", cpusParam)
 	}
 
-	if !q.cfg.Legacy {
-		params = append(params, "-bios", qemuEfiFw)
-	}
+	params = append(params, firmwareParams(q.instanceDir, q.cfg)...)
 
 	var err error
 
+	if q.cfg.TPM {
+		err = startSwtpm(q.instanceDir)
+		if err != nil {
+			return err
+		}
+		params = append(params, tpmParams(q.instanceDir)...)
+	}
+
 	if !launchWithUI.Enabled() {
+		params = append(params, consoleParams(q.instanceDir, qemuConsoleLog)...)
 		params = append(params, "-display", "none", "-vga", "none")
 		_, err = launchQemu(params, fds)
 	} else if launchWithUI.String() == "spice" {
@@ -549,33 +680,87 @@ func (q *qemu) startVM(vnicName, ipAddress string) error {
 	}
 
 	if err != nil {
+		if q.cfg.TPM {
+			stopSwtpm(q.instanceDir)
+		}
 		return err
 	}
 
-	glog.Info("Launched VM")
+	clog.Info("Launched VM")
+
+	return nil
+}
+
+func (q *qemu) readinessProbe() func() bool {
+	socketPath := path.Join(q.instanceDir, qgaSocket)
+	ip := q.cfg.VnicIP
+	return func() bool {
+		return qgaProbe(socketPath) || (ip != "" && sshProbe(ip))
+	}
+}
 
+func (q *qemu) healthProbe() func() healthReport {
 	return nil
 }
 
+func (q *qemu) logFollower() logFollower {
+	return followFile(path.Join(q.instanceDir, qemuConsoleLog))
+}
+
+func (q *qemu) guestFilesystems() []payloads.GuestFilesystemStat {
+	if !getSettings().guestFSStats {
+		return nil
+	}
+	return qgaFilesystems(path.Join(q.instanceDir, qgaSocket))
+}
+
+func (q *qemu) diagnostics(memoryDump bool) func(dir string) error {
+	logs := []string{
+		path.Join(q.instanceDir, qemuLog),
+		path.Join(q.instanceDir, qemuConsoleLog),
+	}
+
+	queryCh, doneCh := q.qmpQueryCh, q.qmpDoneCh
+	return func(dir string) error {
+		if err := copyLogs(dir, logs); err != nil {
+			return err
+		}
+		if !memoryDump {
+			return nil
+		}
+		if queryCh == nil {
+			return fmt.Errorf("Unable to dump memory: instance is not running")
+		}
+		return qmpDumpGuestMemory(queryCh, doneCh, path.Join(dir, memoryDumpFile))
+	}
+}
+
 func (q *qemu) lostVM() {
 	if launchWithUI.Enabled() {
-		glog.Infof("Releasing VC Port %d", q.vcPort)
+		clog.Infof("Releasing VC Port %d", q.vcPort)
 		uiPortGrabber.releasePort(q.vcPort)
 		q.vcPort = 0
 	}
 	q.pid = 0
 	q.prevCPUTime = -1
+	q.qmpQueryCh = nil
+	q.qmpDoneCh = nil
+	q.balloonPolling = false
+	if q.cfg != nil && q.cfg.LimitSwap {
+		removeSwapLimit(q.cfg.Instance)
+	}
+	q.vcpuThreads = nil
 }
 
 func readLoop(instance string, eventCh chan string, scanner *bufio.Scanner) {
 	for scanner.Scan() {
 		text := scanner.Text()
-		if glog.V(1) {
-			glog.Info(text)
+		if clog.V(1) {
+			clog.Info(text)
 		}
 		eventCh <- scanner.Text()
 	}
-	glog.Infof("Quitting %s read Loop", instance)
+	clog.Infof("Quitting %s read Loop", instance)
 	close(eventCh)
 }
 
@@ -583,7 +768,7 @@ func connectToVM(instance, instanceDir string, eventCh chan string, connectedCh
 	qmpSocket := path.Join(instanceDir, "socket")
 	conn, err := net.DialTimeout("unix", qmpSocket, time.Second*30)
 	if err != nil {
-		glog.Errorf("Unable to open qmp socket for instance %s: %v", instance, err)
+		clog.Errorf("Unable to open qmp socket for instance %s: %v", instance, err)
 		return nil, err
 	}
 
@@ -596,7 +781,7 @@ func connectToVM(instance, instanceDir string, eventCh chan string, connectedCh
 	scanner := bufio.NewScanner(conn)
 	_, err = fmt.Fprintln(conn, "{ \"execute\": \"qmp_capabilities\" }")
 	if err != nil {
-		glog.Errorf("Unable to send qmp_capabilities to instance %s: %v", instance, err)
+		clog.Errorf("Unable to send qmp_capabilities to instance %s: %v", instance, err)
 		return nil, err
 	}
 
@@ -604,7 +789,7 @@ func connectToVM(instance, instanceDir string, eventCh chan string, connectedCh
 
 	if !scanner.Scan() {
 		err := fmt.Errorf("qmp_capabilities failed on instance %s", instance)
-		glog.Errorf("%v", err)
+		clog.Errorf("%v", err)
 		return nil, err
 	}
 
@@ -616,13 +801,38 @@ func connectToVM(instance, instanceDir string, eventCh chan string, connectedCh
 	return retval, nil
 }
 
-func qmpLoop(instance string, conn net.Conn, qmpChannel chan string, eventCh chan string, closedCh chan struct{}) (chan string, chan struct{}) {
+func qmpLoop(instance string, conn net.Conn, qmpChannel chan string, queryCh chan *qmpQuery,
+	eventCh chan string, closedCh chan struct{}) (chan string, chan struct{}) {
 	waitForShutdown := false
 	quitting := false
+	pending := make(map[string]*qmpQuery)
+	nextID := 0
+
+	defer func() {
+		for _, query := range pending {
+			query.respCh <- qmpResponse{err: fmt.Errorf("Lost connection to qemu")}
+		}
+	}()
 
 DONE:
 	for {
 		select {
+		case query := <-queryCh:
+			if eventCh == nil {
+				query.respCh <- qmpResponse{err: fmt.Errorf("Lost connection to qemu")}
+				continue
+			}
+			nextID++
+			id := fmt.Sprintf("ciao-%d", nextID)
+			cmd, err := qmpCommand(query.execute, query.args, id)
+			if err == nil {
+				_, err = fmt.Fprintln(conn, string(cmd))
+			}
+			if err != nil {
+				query.respCh <- qmpResponse{err: err}
+				continue
+			}
+			pending[id] = query
 		case cmd, ok := <-qmpChannel:
 			if !ok {
 				qmpChannel = nil
@@ -633,10 +843,10 @@ DONE:
 				}
 			}
 			if cmd == virtualizerStopCmd {
-				glog.Info("Sending STOP")
+				clog.Info("Sending STOP")
 				_, err := fmt.Fprintln(conn, "{ \"execute\": \"quit\" }")
 				if err != nil {
-					glog.Errorf("Unable to send power down command to %s: %v\n", instance, err)
+					clog.Errorf("Unable to send power down command to %s: %v\n", instance, err)
 				} else {
 					waitForShutdown = true
 				}
@@ -648,11 +858,21 @@ DONE:
 				eventCh = nil
 				waitForShutdown = false
 				if quitting {
-					glog.Info("Lost connection to qemu domain socket")
+					clog.Info("Lost connection to qemu domain socket")
 					break DONE
 				} else {
-					glog.Warning("Lost connection to qemu domain socket")
+					clog.Warning("Lost connection to qemu domain socket")
+				}
+				continue
+			}
+			var msg qmpMessage
+			if json.Unmarshal([]byte(event), &msg) == nil && pending[msg.ID] != nil {
+				resp := qmpResponse{ret: msg.Return}
+				if msg.Error != nil {
+					resp.err = fmt.Errorf("%s: %s", msg.Error.Class, msg.Error.Desc)
 				}
+				pending[msg.ID].respCh <- resp
+				delete(pending, msg.ID)
 				continue
 			}
 			if waitForShutdown == true && strings.Contains(event, "return") {
@@ -667,26 +887,28 @@ DONE:
 	return eventCh, closedCh
 }
 
-func qmpConnect(qmpChannel chan string, instance, instanceDir string, closedCh chan struct{},
+func qmpConnect(qmpChannel chan string, queryCh chan *qmpQuery, doneCh chan struct{},
+	instance, instanceDir string, closedCh chan struct{},
 	connectedCh chan struct{}, wg *sync.WaitGroup, boot bool) {
 	var conn net.Conn
 
 	defer func() {
+		close(doneCh)
 		if closedCh != nil {
 			close(closedCh)
 		}
-		glog.Infof("Monitor function for %s exitting", instance)
+		clog.Infof("Monitor function for %s exitting", instance)
 		wg.Done()
 	}()
 
 	eventCh := make(chan string)
 	conn, err := connectToVM(instance, instanceDir, eventCh, connectedCh)
 	if err != nil {
-		glog.Infof("Monitor function for %s exitting with err: %v", instance, err)
+		clog.Infof("Monitor function for %s exitting with err: %v", instance, err)
 		return
 	}
 
-	eventCh, closedCh = qmpLoop(instance, conn, qmpChannel, eventCh, closedCh)
+	eventCh, closedCh = qmpLoop(instance, conn, qmpChannel, queryCh, eventCh, closedCh)
 
 	_ = conn.Close()
 
@@ -697,7 +919,7 @@ func qmpConnect(qmpChannel chan string, instance, instanceDir string, closedCh c
 		}
 	}
 
-	glog.Infof("Quitting Monitor Loop for %s\n", instance)
+	clog.Infof("Quitting Monitor Loop for %s\n", instance)
 }
 
 /* closedCh is closed by the monitor go routine when it loses connection to the domain socket, basically,
@@ -711,8 +933,11 @@ func qmpConnect(qmpChannel chan string, instance, instanceDir string, closedCh c
 func (q *qemu) monitorVM(closedCh chan struct{}, connectedCh chan struct{},
 	wg *sync.WaitGroup, boot bool) chan string {
 	qmpChannel := make(chan string)
+	q.qmpQueryCh = make(chan *qmpQuery)
+	q.qmpDoneCh = make(chan struct{})
 	wg.Add(1)
-	go qmpConnect(qmpChannel, q.cfg.Instance, q.instanceDir, closedCh, connectedCh, wg, boot)
+	go qmpConnect(qmpChannel, q.qmpQueryCh, q.qmpDoneCh, q.cfg.Instance, q.instanceDir,
+		closedCh, connectedCh, wg, boot)
 	return qmpChannel
 }
 
@@ -725,8 +950,18 @@ func computeInstanceDiskspace(instanceDir string) int {
 	return int(fi.Size() / 1000000)
 }
 
+// stats prefers the statistics reported by qemu and the guest over those we
+// can compute from the qemu process.  The latter include qemu's own overhead,
+// e.g., the memory and CPU time used by its emulation and I/O threads, and the
+// apparent rather than the allocated size of the rootfs.
 func (q *qemu) stats() (disk, memory, cpu int) {
-	disk = computeInstanceDiskspace(q.instanceDir)
+	disk = -1
+	if q.pid != 0 {
+		disk = q.diskUsage()
+	}
+	if disk == -1 {
+		disk = computeInstanceDiskspace(q.instanceDir)
+	}
 	memory = -1
 	cpu = -1
 
@@ -734,21 +969,33 @@ func (q *qemu) stats() (disk, memory, cpu int) {
 		return
 	}
 
-	memory = computeProcessMemUsage(q.pid)
+	memory = q.guestMemoryUsage()
+	if memory == -1 {
+		memory = computeProcessMemUsage(q.pid)
+	}
 	if q.cfg == nil {
 		return
 	}
 
-	cpuTime := computeProcessCPUTime(q.pid)
+	// If we switch between vCPU and process accounting, the previous
+	// sample is useless.
+
+	cpuTime := q.vcpuCPUTime()
+	vcpuCPUStats := cpuTime != -1
+	if !vcpuCPUStats {
+		cpuTime = computeProcessCPUTime(q.pid)
+	}
+	if vcpuCPUStats != q.vcpuCPUStats {
+		q.prevCPUTime = -1
+		q.vcpuCPUStats = vcpuCPUStats
+	}
+
 	now := time.Now()
-	if q.prevCPUTime != -1 {
+	if q.prevCPUTime != -1 && cpuTime != -1 {
 		cpu = int((100 * (cpuTime - q.prevCPUTime) /
 			now.Sub(q.prevSampleTime).Nanoseconds()))
-		if q.cfg.Cpus > 1 {
-			cpu /= q.cfg.Cpus
-		}
-		// if glog.V(1) {
-		//     glog.Infof("cpu %d%%\n", cpu)
+		// if clog.V(1) {
+		//     clog.Infof("cpu %d%%\n", cpu)
 		// }
 	}
 	q.prevCPUTime = cpuTime
@@ -757,15 +1004,16 @@ func (q *qemu) stats() (disk, memory, cpu int) {
 	return
 }
 
-func (q *qemu) connected() {
-	qmpSocket := path.Join(q.instanceDir, "socket")
+// socketOwner returns the pid of the process, other than launcher, that has
+// the unix socket at socketPath open, or 0 if there is no such process.
+func socketOwner(socketPath string) int {
 	var buf bytes.Buffer
-	cmd := exec.Command("fuser", qmpSocket)
+	cmd := exec.Command("fuser", socketPath)
 	cmd.Stdout = &buf
 	err := cmd.Run()
 	if err != nil {
-		glog.Errorf("Failed to run fuser: %v", err)
-		return
+		clog.Errorf("Failed to run fuser: %v", err)
+		return 0
 	}
 
 	scanner := bufio.NewScanner(&buf)
@@ -777,16 +1025,55 @@ func (q *qemu) connected() {
 		}
 
 		if pid != 0 && pid != os.Getpid() {
-			glog.Infof("PID of qemu for instance %s is %d", q.instanceDir, pid)
-			q.pid = pid
-			break
+			return pid
 		}
 	}
 
-	if q.pid == 0 {
-		glog.Errorf("Unable to determine pid for %s", q.instanceDir)
+	return 0
+}
+
+func (q *qemu) connected() {
+	q.pid = socketOwner(path.Join(q.instanceDir, "socket"))
+	if q.pid != 0 {
+		clog.Infof("PID of qemu for instance %s is %d", q.instanceDir, q.pid)
+	} else {
+		clog.Errorf("Unable to determine pid for %s", q.instanceDir)
 	}
 	q.prevCPUTime = -1
+	q.pinVCPUs()
+	if q.cfg == nil {
+		return
+	}
+
+	// The overseer does not know about the balloons of the instances it
+	// did not start, so they are deflated.
+	if q.cfg.BalloonMin > 0 {
+		if err := q.setBalloon(q.cfg.Mem); err != nil {
+			clog.Warningf("Unable to deflate the balloon of %s: %v", q.cfg.Instance, err)
+		}
+	}
+
+	if q.cfg.LimitSwap && q.pid != 0 {
+		if err := limitSwap(q.cfg.Instance, q.pid, q.cfg.SwapMax); err != nil {
+			clog.Warningf("Unable to limit the swap of %s: %v", q.cfg.Instance, err)
+		}
+	}
+}
+
+// pinVCPUs pins each of the instance's vCPU threads to one of its dedicated
+// cores, if it has any.  Instances with more vCPUs than dedicated cores get
+// several vCPUs pinned to the same cores.
+func (q *qemu) pinVCPUs() {
+	if q.cfg == nil || len(q.cfg.Cores) == 0 {
+		return
+	}
+
+	for i, tid := range q.vcpuThreadIDs() {
+		core := q.cfg.Cores[i%len(q.cfg.Cores)]
+		if err := pinThread(tid, []int{core}); err != nil {
+			clog.Warningf("Unable to dedicate core %d to %s: %v", core, q.cfg.Instance, err)
+		}
+	}
 }
 
 func qemuKillInstance(instanceDir string) {
@@ -802,15 +1089,15 @@ func qemuKillInstance(instanceDir string) {
 
 	_, err = fmt.Fprintln(conn, "{ \"execute\": \"qmp_capabilities\" }")
 	if err != nil {
-		glog.Errorf("Unable to send qmp_capabilities to instance %s: %v", instanceDir, err)
+		clog.Errorf("Unable to send qmp_capabilities to instance %s: %v", instanceDir, err)
 		return
 	}
 
-	glog.Infof("Powering Down %s", instanceDir)
+	clog.Infof("Powering Down %s", instanceDir)
 
 	_, err = fmt.Fprintln(conn, "{ \"execute\": \"quit\" }")
 	if err != nil {
-		glog.Errorf("Unable to send power down command to %s: %v\n", instanceDir, err)
+		clog.Errorf("Unable to send power down command to %s: %v\n", instanceDir, err)
 	}
 
 	// Keep reading until the socket fails.  If we close the socket straight away, qemu does not
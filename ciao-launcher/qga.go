@@ -0,0 +1,204 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+)
+
+const qgaTimeout = 2 * time.Second
+
+type qgaResponse struct {
+	Return json.RawMessage `json:"return"`
+	Error  *qmpError       `json:"error"`
+}
+
+type qgaCommand struct {
+	Execute   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// qgaExecute executes a command, with optional arguments, on the qemu guest
+// agent listening on the virtio serial port backed by socketPath, decoding
+// its return value into result.  The guest agent may have unread responses
+// queued from previous connections, so we first issue a guest-sync,
+// discarding everything up to and including its response.  If execute is ""
+// only the guest-sync is performed.
+func qgaExecute(socketPath, execute string, args, result interface{}) error {
+	conn, err := net.DialTimeout("unix", socketPath, qgaTimeout)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(qgaTimeout))
+
+	id := rand.Int31()
+	_, err = fmt.Fprintf(conn, "{\"execute\":\"guest-sync\",\"arguments\":{\"id\":%d}}\n", id)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(conn)
+	synced := false
+	for !synced && scanner.Scan() {
+		var resp qgaResponse
+		if json.Unmarshal(scanner.Bytes(), &resp) != nil {
+			continue
+		}
+		synced = string(resp.Return) == fmt.Sprintf("%d", id)
+	}
+	if !synced {
+		return fmt.Errorf("Unable to sync with guest agent")
+	}
+
+	if execute == "" {
+		return nil
+	}
+
+	cmd, err := json.Marshal(&qgaCommand{execute, args})
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(conn, "%s\n", cmd)
+	if err != nil {
+		return err
+	}
+
+	if !scanner.Scan() {
+		return fmt.Errorf("No response to %s from guest agent", execute)
+	}
+
+	var resp qgaResponse
+	if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+		return err
+	}
+	if resp.Error != nil {
+		return fmt.Errorf("%s: %s", resp.Error.Class, resp.Error.Desc)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.Return, result)
+}
+
+// qgaProbe returns true if the guest agent is answering.
+func qgaProbe(socketPath string) bool {
+	return qgaExecute(socketPath, "", nil, nil) == nil
+}
+
+type qgaFSInfo struct {
+	Mountpoint string `json:"mountpoint"`
+	Type       string `json:"type"`
+	UsedBytes  *int64 `json:"used-bytes"`
+	TotalBytes *int64 `json:"total-bytes"`
+}
+
+// guestFilesystemStats converts the output of guest-get-fsinfo into
+// GuestFilesystemStats.  Guest agents older than qemu 3.0 do not report
+// filesystem usage, in which case the filesystem is omitted.
+func guestFilesystemStats(info []qgaFSInfo) []payloads.GuestFilesystemStat {
+	var stats []payloads.GuestFilesystemStat
+	for _, fs := range info {
+		if fs.UsedBytes == nil || fs.TotalBytes == nil {
+			continue
+		}
+		stats = append(stats, payloads.GuestFilesystemStat{
+			Mountpoint: fs.Mountpoint,
+			Type:       fs.Type,
+			UsedMB:     int(*fs.UsedBytes / 1000000),
+			TotalMB:    int(*fs.TotalBytes / 1000000),
+		})
+	}
+	return stats
+}
+
+// qgaFilesystems returns the usage of the filesystems mounted inside the
+// guest, or nil if the guest agent is not running or does not report
+// filesystem usage.
+func qgaFilesystems(socketPath string) []payloads.GuestFilesystemStat {
+	var info []qgaFSInfo
+	if qgaExecute(socketPath, "guest-get-fsinfo", nil, &info) != nil {
+		return nil
+	}
+	return guestFilesystemStats(info)
+}
+
+type qgaExecArgs struct {
+	Path          string   `json:"path"`
+	Arg           []string `json:"arg,omitempty"`
+	CaptureOutput bool     `json:"capture-output"`
+}
+
+type qgaExecPid struct {
+	Pid int `json:"pid"`
+}
+
+type qgaExecStatus struct {
+	Exited   bool   `json:"exited"`
+	ExitCode int    `json:"exitcode"`
+	OutData  string `json:"out-data"`
+	ErrData  string `json:"err-data"`
+}
+
+// qgaGuestExec runs a command inside the guest using the guest-exec command
+// of the guest agent and returns its standard output.  The command is
+// considered to have failed if it exits with a non zero exit code or if it
+// does not complete within timeout.
+func qgaGuestExec(socketPath, cmd string, args []string, timeout time.Duration) ([]byte, error) {
+	var pid qgaExecPid
+	err := qgaExecute(socketPath, "guest-exec",
+		&qgaExecArgs{Path: cmd, Arg: args, CaptureOutput: true}, &pid)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var status qgaExecStatus
+		err = qgaExecute(socketPath, "guest-exec-status", &pid, &status)
+		if err != nil {
+			return nil, err
+		}
+
+		if status.Exited {
+			if status.ExitCode != 0 {
+				stderr, _ := base64.StdEncoding.DecodeString(status.ErrData)
+				return nil, fmt.Errorf("%s exited with %d: %s", cmd,
+					status.ExitCode, strings.TrimSpace(string(stderr)))
+			}
+			return base64.StdEncoding.DecodeString(status.OutData)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s did not complete within %v", cmd, timeout)
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
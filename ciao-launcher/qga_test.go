@@ -0,0 +1,132 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeGuestAgent answers guest-sync, guest-get-fsinfo, guest-exec and
+// guest-exec-status requests, sending a stale response before each
+// guest-sync response to check that qgaExecute discards it.  Commands run
+// with guest-exec echo their arguments, except for /bin/false which fails.
+func fakeGuestAgent(l net.Listener) {
+	var execArgs []string
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			var cmd struct {
+				Execute   string `json:"execute"`
+				Arguments struct {
+					ID   int32    `json:"id"`
+					Pid  int      `json:"pid"`
+					Path string   `json:"path"`
+					Arg  []string `json:"arg"`
+				} `json:"arguments"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &cmd) != nil {
+				continue
+			}
+
+			switch cmd.Execute {
+			case "guest-sync":
+				fmt.Fprintf(conn, "{\"return\": {}}\n{\"return\": %d}\n", cmd.Arguments.ID)
+			case "guest-get-fsinfo":
+				fmt.Fprintln(conn, `{"return": [`+
+					`{"name": "vda1", "mountpoint": "/", "type": "ext4", `+
+					`"used-bytes": 1000000000, "total-bytes": 4000000000, "disk": []}, `+
+					`{"name": "vda2", "mountpoint": "/boot", "type": "vfat", "disk": []}]}`)
+			case "guest-exec":
+				pid := 1
+				if cmd.Arguments.Path == "/bin/false" {
+					pid = 2
+				}
+				execArgs = cmd.Arguments.Arg
+				fmt.Fprintf(conn, "{\"return\": {\"pid\": %d}}\n", pid)
+			case "guest-exec-status":
+				if cmd.Arguments.Pid == 2 {
+					fmt.Fprintf(conn, "{\"return\": {\"exited\": true, \"exitcode\": 1, \"err-data\": \"%s\"}}\n",
+						base64.StdEncoding.EncodeToString([]byte("failed")))
+					break
+				}
+				out := base64.StdEncoding.EncodeToString([]byte(strings.Join(execArgs, " ")))
+				fmt.Fprintf(conn, "{\"return\": {\"exited\": true, \"exitcode\": 0, \"out-data\": \"%s\"}}\n", out)
+			default:
+				fmt.Fprintln(conn, `{"error": {"class": "CommandNotFound", "desc": "unknown"}}`)
+			}
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestQGAExecute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-qga")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	socketPath := path.Join(dir, qgaSocket)
+	if qgaProbe(socketPath) {
+		t.Errorf("Probe succeeded with no guest agent")
+	}
+
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Unable to create socket: %v", err)
+	}
+	defer func() { _ = l.Close() }()
+	go fakeGuestAgent(l)
+
+	if !qgaProbe(socketPath) {
+		t.Errorf("Probe failed")
+	}
+
+	fs := qgaFilesystems(socketPath)
+	if len(fs) != 1 || fs[0].Mountpoint != "/" || fs[0].Type != "ext4" ||
+		fs[0].UsedMB != 1000 || fs[0].TotalMB != 4000 {
+		t.Errorf("Unexpected filesystems %+v", fs)
+	}
+
+	if err = qgaExecute(socketPath, "guest-wibble", nil, nil); err == nil {
+		t.Errorf("Expected guest-wibble to fail")
+	}
+
+	out, err := qgaGuestExec(socketPath, "/usr/bin/attest", []string{"0badc0de"}, time.Second)
+	if err != nil || string(out) != "0badc0de" {
+		t.Errorf("Unexpected guest-exec result %q %v", string(out), err)
+	}
+
+	if _, err = qgaGuestExec(socketPath, "/bin/false", nil, time.Second); err == nil {
+		t.Errorf("Expected /bin/false to fail")
+	}
+}
@@ -0,0 +1,327 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"time"
+)
+
+const (
+	qmpQueryTimeout   = time.Second
+	balloonPath       = "/machine/peripheral/balloon0"
+	memoryDumpTimeout = time.Minute * 10
+	memoryDumpPoll    = time.Second
+)
+
+// qmpQuery is sent by the instance go routine to the monitor go routine,
+// which owns the QMP connection, to execute a QMP command.  The response is
+// returned on respCh, which must be buffered so that the monitor go routine
+// never blocks if the requester has given up waiting.
+type qmpQuery struct {
+	execute string
+	args    interface{}
+	respCh  chan qmpResponse
+}
+
+type qmpResponse struct {
+	ret json.RawMessage
+	err error
+}
+
+type qmpError struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+// qmpMessage can hold any message sent by qemu on the QMP socket, i.e., a
+// command response or an asynchronous event.
+type qmpMessage struct {
+	ID     string          `json:"id"`
+	Return json.RawMessage `json:"return"`
+	Error  *qmpError       `json:"error"`
+	Event  string          `json:"event"`
+}
+
+func qmpCommand(execute string, args interface{}, id string) ([]byte, error) {
+	cmd := map[string]interface{}{
+		"execute": execute,
+		"id":      id,
+	}
+	if args != nil {
+		cmd["arguments"] = args
+	}
+	return json.Marshal(cmd)
+}
+
+// qmpExecute executes a QMP command via the monitor go routine and decodes
+// its return value into result, if result is not nil.
+func (q *qemu) qmpExecute(execute string, args interface{}, result interface{}) error {
+	if q.qmpQueryCh == nil {
+		return fmt.Errorf("Not connected to QMP socket")
+	}
+
+	return qmpExec(q.qmpQueryCh, q.qmpDoneCh, execute, args, result)
+}
+
+// qmpExec is the implementation of qmpExecute.  Unlike qmpExecute, it does not
+// access the qemu object and so can be called from any go routine that holds
+// a copy of the monitor's channels.
+func qmpExec(queryCh chan<- *qmpQuery, doneCh <-chan struct{}, execute string,
+	args interface{}, result interface{}) error {
+	query := &qmpQuery{execute, args, make(chan qmpResponse, 1)}
+	timeout := time.After(qmpQueryTimeout)
+
+	select {
+	case queryCh <- query:
+	case <-doneCh:
+		return fmt.Errorf("Monitor has exited")
+	case <-timeout:
+		return fmt.Errorf("Timed out sending %s", execute)
+	}
+
+	var resp qmpResponse
+	select {
+	case resp = <-query.respCh:
+	case <-doneCh:
+		return fmt.Errorf("Monitor has exited")
+	case <-timeout:
+		return fmt.Errorf("Timed out waiting for %s", execute)
+	}
+
+	if resp.err != nil {
+		return resp.err
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(resp.ret, result)
+}
+
+type dumpStatus struct {
+	Status string `json:"status"`
+}
+
+// qmpDumpGuestMemory writes the guest's memory to dumpPath in ELF format.  The
+// dump is performed in the background by qemu, so that the monitor is not
+// blocked while a large guest is being dumped, and we poll for its
+// completion.
+func qmpDumpGuestMemory(queryCh chan<- *qmpQuery, doneCh <-chan struct{},
+	dumpPath string) error {
+	args := map[string]interface{}{
+		"paging":   false,
+		"protocol": "file:" + dumpPath,
+		"detach":   true,
+	}
+	err := qmpExec(queryCh, doneCh, "dump-guest-memory", args, nil)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.After(memoryDumpTimeout)
+	for {
+		var status dumpStatus
+		err = qmpExec(queryCh, doneCh, "query-dump", nil, &status)
+		if err != nil {
+			return err
+		}
+		switch status.Status {
+		case "completed":
+			return nil
+		case "failed":
+			return fmt.Errorf("Memory dump failed")
+		}
+
+		select {
+		case <-time.After(memoryDumpPoll):
+		case <-doneCh:
+			return fmt.Errorf("Monitor has exited")
+		case <-timeout:
+			return fmt.Errorf("Timed out waiting for memory dump")
+		}
+	}
+}
+
+type balloonStats struct {
+	Stats      map[string]int64 `json:"stats"`
+	LastUpdate int64            `json:"last-update"`
+}
+
+// guestMemoryUsageMB computes the amount of memory used by the guest from the
+// statistics reported by the balloon driver.  Older guests do not report
+// stat-available-memory, in which case we fall back to stat-free-memory,
+// which doesn't take the page cache into account.  Returns -1 if the guest
+// has not yet reported its statistics.
+func guestMemoryUsageMB(bs *balloonStats) int {
+	if bs.LastUpdate == 0 {
+		return -1
+	}
+
+	total, ok := bs.Stats["stat-total-memory"]
+	if !ok || total < 0 {
+		return -1
+	}
+
+	avail, ok := bs.Stats["stat-available-memory"]
+	if !ok || avail < 0 {
+		avail, ok = bs.Stats["stat-free-memory"]
+		if !ok || avail < 0 {
+			return -1
+		}
+	}
+
+	return int((total - avail) / (1024 * 1024))
+}
+
+// guestMemoryUsage returns the memory used by the guest as reported by the
+// balloon driver, or -1 if this information is not available, e.g., because
+// the guest has no balloon driver.  Balloon statistics polling needs to be
+// enabled before the guest reports any statistics so the first call always
+// returns -1.
+func (q *qemu) guestMemoryUsage() int {
+	if !q.balloonPolling {
+		args := map[string]interface{}{
+			"path":     balloonPath,
+			"property": "guest-stats-polling-interval",
+			"value":    int(getSettings().statsPeriod / time.Second),
+		}
+		if q.qmpExecute("qom-set", args, nil) == nil {
+			q.balloonPolling = true
+		}
+		return -1
+	}
+
+	var bs balloonStats
+	args := map[string]interface{}{
+		"path":     balloonPath,
+		"property": "guest-stats",
+	}
+	if q.qmpExecute("qom-get", args, &bs) != nil {
+		return -1
+	}
+
+	return guestMemoryUsageMB(&bs)
+}
+
+// setBalloon asks the balloon driver of the guest to leave it with targetMB
+// of memory.  The driver inflates or deflates the balloon in the background.
+func (q *qemu) setBalloon(targetMB int) error {
+	args := map[string]interface{}{
+		"value": int64(targetMB) << 20,
+	}
+	return q.qmpExecute("balloon", args, nil)
+}
+
+// migrate starts migrating the instance to the qemu listening on uri.  qemu
+// migrates the instance in the background and pauses it once done.
+func (q *qemu) migrate(uri string) error {
+	args := map[string]interface{}{
+		"uri": uri,
+	}
+	return q.qmpExecute("migrate", args, nil)
+}
+
+// vcpuThreadIDs returns the host thread IDs of the instance's vCPUs.  They
+// do not change while the instance is running so we only query them once.
+// query-cpus-fast was introduced in qemu 2.12 and query-cpus removed in 6.0
+// so we try both.
+func (q *qemu) vcpuThreadIDs() []int {
+	if q.vcpuThreads != nil {
+		return q.vcpuThreads
+	}
+
+	var fast []struct {
+		ThreadID int `json:"thread-id"`
+	}
+	if q.qmpExecute("query-cpus-fast", nil, &fast) == nil {
+		for _, cpu := range fast {
+			q.vcpuThreads = append(q.vcpuThreads, cpu.ThreadID)
+		}
+		return q.vcpuThreads
+	}
+
+	var slow []struct {
+		ThreadID int `json:"thread_id"`
+	}
+	if q.qmpExecute("query-cpus", nil, &slow) == nil {
+		for _, cpu := range slow {
+			q.vcpuThreads = append(q.vcpuThreads, cpu.ThreadID)
+		}
+	}
+
+	return q.vcpuThreads
+}
+
+// vcpuCPUTime returns the CPU time, in nanoseconds, consumed by the
+// instance's vCPU threads, or -1 if it cannot be determined.  Unlike the CPU
+// time of the qemu process, this does not include time spent by qemu's I/O
+// and emulation threads.
+func (q *qemu) vcpuCPUTime() int64 {
+	threads := q.vcpuThreadIDs()
+	if len(threads) == 0 {
+		return -1
+	}
+
+	var total int64
+	for _, tid := range threads {
+		t := computeThreadCPUTime(q.pid, tid)
+		if t == -1 {
+			return -1
+		}
+		total += t
+	}
+
+	return total
+}
+
+type qmpBlockInfo struct {
+	Device   string `json:"device"`
+	Inserted *struct {
+		File  string `json:"file"`
+		Image struct {
+			Filename   string `json:"filename"`
+			ActualSize int64  `json:"actual-size"`
+		} `json:"image"`
+	} `json:"inserted"`
+}
+
+func blockActualSizeMB(blocks []qmpBlockInfo, image string) int {
+	for _, b := range blocks {
+		if b.Inserted == nil {
+			continue
+		}
+		if b.Inserted.File == image || b.Inserted.Image.Filename == image {
+			return int(b.Inserted.Image.ActualSize / 1000000)
+		}
+	}
+	return -1
+}
+
+// diskUsage returns the amount of host disk space allocated to the
+// instance's rootfs, as reported by qemu, or -1 if it cannot be determined.
+func (q *qemu) diskUsage() int {
+	var blocks []qmpBlockInfo
+	if q.qmpExecute("query-block", nil, &blocks) != nil {
+		return -1
+	}
+
+	return blockActualSizeMB(blocks, path.Join(q.instanceDir, "image.qcow2"))
+}
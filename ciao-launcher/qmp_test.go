@@ -0,0 +1,134 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestGuestMemoryUsageMB(t *testing.T) {
+	tests := []struct {
+		bs    balloonStats
+		usage int
+	}{
+		{balloonStats{}, -1},
+		{balloonStats{
+			Stats: map[string]int64{
+				"stat-total-memory":     1024 * 1024 * 1024,
+				"stat-available-memory": 768 * 1024 * 1024,
+				"stat-free-memory":      512 * 1024 * 1024,
+			},
+			LastUpdate: 1,
+		}, 256},
+		{balloonStats{
+			Stats: map[string]int64{
+				"stat-total-memory": 1024 * 1024 * 1024,
+				"stat-free-memory":  512 * 1024 * 1024,
+			},
+			LastUpdate: 1,
+		}, 512},
+		{balloonStats{
+			Stats: map[string]int64{
+				"stat-total-memory":     -1,
+				"stat-available-memory": -1,
+			},
+			LastUpdate: 1,
+		}, -1},
+	}
+
+	for i, test := range tests {
+		if usage := guestMemoryUsageMB(&test.bs); usage != test.usage {
+			t.Errorf("Test %d: expected %d got %d", i, test.usage, usage)
+		}
+	}
+}
+
+func TestBlockActualSizeMB(t *testing.T) {
+	blockJSON := `[
+	{"device": "cd0"},
+	{"device": "virtio0", "inserted": {"file": "/var/lib/ciao/instances/1/image.qcow2",
+		"image": {"filename": "/var/lib/ciao/instances/1/image.qcow2", "actual-size": 200000000}}}
+	]`
+
+	var blocks []qmpBlockInfo
+	if err := json.Unmarshal([]byte(blockJSON), &blocks); err != nil {
+		t.Fatalf("Unable to unmarshal block info: %v", err)
+	}
+
+	if size := blockActualSizeMB(blocks, "/var/lib/ciao/instances/1/image.qcow2"); size != 200 {
+		t.Errorf("Expected 200 got %d", size)
+	}
+
+	if size := blockActualSizeMB(blocks, "/var/lib/ciao/instances/2/image.qcow2"); size != -1 {
+		t.Errorf("Expected -1 got %d", size)
+	}
+}
+
+// Checks that qmpLoop routes responses to the queries that requested them,
+// and that errors reported by qemu are returned to the requester.
+func TestQMPLoopQuery(t *testing.T) {
+	client, server := net.Pipe()
+	defer func() { _ = server.Close() }()
+
+	qmpChannel := make(chan string)
+	queryCh := make(chan *qmpQuery)
+	eventCh := make(chan string)
+	closedCh := make(chan struct{})
+	doneCh := make(chan struct{})
+
+	go func() {
+		_, _ = qmpLoop("instance", client, qmpChannel, queryCh, eventCh, closedCh)
+		close(doneCh)
+	}()
+
+	go func() {
+		scanner := bufio.NewScanner(server)
+		for scanner.Scan() {
+			var cmd struct {
+				Execute string `json:"execute"`
+				ID      string `json:"id"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &cmd) != nil {
+				continue
+			}
+			eventCh <- `{"event": "RESUME"}`
+			if cmd.Execute == "query-cpus-fast" {
+				eventCh <- fmt.Sprintf(`{"return": [{"thread-id": 42}], "id": "%s"}`, cmd.ID)
+			} else {
+				eventCh <- fmt.Sprintf(`{"error": {"class": "CommandNotFound", "desc": "unknown"}, "id": "%s"}`, cmd.ID)
+			}
+		}
+	}()
+
+	q := &qemu{qmpQueryCh: queryCh, qmpDoneCh: doneCh}
+
+	threads := q.vcpuThreadIDs()
+	if len(threads) != 1 || threads[0] != 42 {
+		t.Errorf("Unexpected vCPU threads %v", threads)
+	}
+
+	if err := q.qmpExecute("query-wibble", nil, nil); err == nil {
+		t.Errorf("Expected query-wibble to fail")
+	}
+
+	close(qmpChannel)
+	<-doneCh
+}
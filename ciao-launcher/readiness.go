@@ -0,0 +1,100 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	readinessPollPeriod = 2 * time.Second
+	readinessTimeout    = 10 * time.Minute
+	probeTimeout        = time.Second
+	sshPort             = 22
+)
+
+// sshProbe returns true if an SSH server is listening on port 22 of ip.
+func sshProbe(ip string) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ip, fmt.Sprintf("%d", sshPort)),
+		probeTimeout)
+	if err != nil {
+		return false
+	}
+	defer func() { _ = conn.Close() }()
+
+	_ = conn.SetDeadline(time.Now().Add(probeTimeout))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	return err == nil && strings.HasPrefix(banner, "SSH-")
+}
+
+// waitForReady periodically calls probe until it succeeds, in which case
+// readyCh is closed, cancelCh is closed or readinessTimeout expires.  A nil
+// probe indicates that the instance is ready as soon as it's running.
+func waitForReady(instance string, probe func() bool, readyCh chan<- struct{},
+	cancelCh <-chan struct{}, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		timeout := time.After(readinessTimeout)
+		for probe != nil && !probe() {
+			select {
+			case <-cancelCh:
+				return
+			case <-timeout:
+				clog.Warningf("Instance %s not ready after %v", instance, readinessTimeout)
+				return
+			case <-time.After(readinessPollPeriod):
+			}
+		}
+
+		close(readyCh)
+	}()
+}
+
+func sendInstanceReadyEvent(client *ssntpConn, instance string, bootDurationMS int) {
+	if !client.isConnected() {
+		return
+	}
+
+	var event payloads.EventInstanceReady
+
+	event.InstanceReady.InstanceUUID = instance
+	event.InstanceReady.BootDurationMS = bootDurationMS
+
+	payload, err := yaml.Marshal(&event)
+	if err != nil {
+		clog.Errorf("Unable to Marshall InstanceReady %v", err)
+		return
+	}
+
+	_, err = client.SendEvent(ssntp.InstanceReady, payload)
+	if err != nil {
+		clog.Errorf("Failed to send InstanceReady event %v", err)
+	}
+}
@@ -0,0 +1,368 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"golang.org/x/net/context"
+)
+
+// defaultRegistry is the registry of docker images whose name does not
+// start with a registry host.
+const defaultRegistry = "docker.io"
+
+// pullProgressPeriod is the minimum interval between two ImagePullProgress
+// events sent for the same pull.
+const pullProgressPeriod = 5 * time.Second
+
+// registryAuthFile is the node-local file containing the credentials used
+// to pull docker images from private registries, and registryMirror the
+// host of a pull-through cache of docker.io.
+var registryAuthFile string
+var registryMirror string
+
+// registryCredentials is an entry of the registry credentials file.
+// Entries with a tenant are only used for the instances of that tenant.
+type registryCredentials struct {
+	Registry   string `yaml:"registry"`
+	TenantUUID string `yaml:"tenant_uuid,omitempty"`
+	Username   string `yaml:"username"`
+	Password   string `yaml:"password"`
+}
+
+// imageRegistry returns the registry from which image is pulled.  As in
+// docker, the first component of the image name is a registry host if it
+// contains a dot or a port, or is localhost.
+func imageRegistry(image string) string {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return defaultRegistry
+	}
+
+	host := image[:i]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return defaultRegistry
+}
+
+// splitImageTag splits image into its repository and tag, which defaults to
+// latest.
+func splitImageTag(image string) (repo, tag string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, "latest"
+	}
+	return image[:i], image[i+1:]
+}
+
+// mirrorImage returns the name of image in the pull-through cache mirror, or
+// "" if the image is not cached by it.  Only images of docker.io referenced
+// by tag are.
+func mirrorImage(mirror, image string) string {
+	if mirror == "" || imageRegistry(image) != defaultRegistry ||
+		strings.Contains(image, "@") {
+		return ""
+	}
+
+	if strings.HasPrefix(image, defaultRegistry+"/") {
+		image = image[len(defaultRegistry)+1:]
+	}
+	if !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+	return mirror + "/" + image
+}
+
+// loadRegistryCredentials reads the registry credentials file.  A missing
+// file holds no credentials, and the file is not trusted if anyone but its
+// owner can access it.
+func loadRegistryCredentials(file string) ([]registryCredentials, error) {
+	if file == "" {
+		return nil, nil
+	}
+
+	fi, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if fi.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s can be accessed by users other than its owner", file)
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var creds []registryCredentials
+	err = yaml.Unmarshal(data, &creds)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse %s: %v", file, err)
+	}
+
+	return creds, nil
+}
+
+// registryAuth returns the credentials with which the image of an instance
+// is pulled from registry, or nil if there are none.  The credentials of the
+// START command come first, then those the node holds for the tenant of the
+// instance, and then those it holds for every tenant.  The credentials file
+// is read at each pull, so that it can be updated without restarting
+// launcher.
+func registryAuth(cfg *vmConfig, registry string) (*types.AuthConfig, error) {
+	if a := cfg.registryAuth; a != nil && (a.Registry == "" || a.Registry == registry) {
+		return &types.AuthConfig{
+			Username:      a.Username,
+			Password:      a.Password,
+			ServerAddress: registry,
+		}, nil
+	}
+
+	creds, err := loadRegistryCredentials(registryAuthFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *registryCredentials
+	for i := range creds {
+		c := &creds[i]
+		if c.Registry != registry {
+			continue
+		}
+		if c.TenantUUID == cfg.TennantUUID {
+			found = c
+			break
+		}
+		if c.TenantUUID == "" && found == nil {
+			found = c
+		}
+	}
+
+	if found == nil {
+		return nil, nil
+	}
+
+	return &types.AuthConfig{
+		Username:      found.Username,
+		Password:      found.Password,
+		ServerAddress: registry,
+	}, nil
+}
+
+// encodeRegistryAuth encodes auth as expected by the docker API.
+func encodeRegistryAuth(auth *types.AuthConfig) (string, error) {
+	if auth == nil {
+		return "", nil
+	}
+
+	buf, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(buf), nil
+}
+
+// pullProgress aggregates the per layer progress messages docker reports
+// while it pulls an image.
+type pullProgress struct {
+	event  payloads.ImagePullProgressEvent
+	layers map[string]*layerProgress
+}
+
+type layerProgress struct {
+	current int64
+	total   int64
+	done    bool
+}
+
+func newPullProgress(instance, image string) *pullProgress {
+	return &pullProgress{
+		event: payloads.ImagePullProgressEvent{
+			InstanceUUID: instance,
+			Image:        image,
+		},
+		layers: make(map[string]*layerProgress),
+	}
+}
+
+// update accounts for msg, and returns true if it changed the progress of
+// the pull.  Messages that are not about a layer, such as the digest of the
+// image, are ignored.
+func (p *pullProgress) update(msg *jsonmessage.JSONMessage) bool {
+	if msg.ID == "" {
+		return false
+	}
+
+	layer := p.layers[msg.ID]
+	switch msg.Status {
+	case "Pulling fs layer", "Waiting", "Downloading", "Verifying Checksum",
+		"Download complete", "Extracting", "Pull complete", "Already exists":
+	default:
+		return false
+	}
+
+	if layer == nil {
+		layer = &layerProgress{}
+		p.layers[msg.ID] = layer
+	}
+
+	switch msg.Status {
+	case "Downloading":
+		if msg.Progress != nil {
+			layer.current = msg.Progress.Current
+			if msg.Progress.Total > 0 {
+				layer.total = msg.Progress.Total
+			}
+		}
+	case "Verifying Checksum", "Download complete", "Extracting":
+		layer.current = layer.total
+	case "Pull complete", "Already exists":
+		layer.current = layer.total
+		layer.done = true
+	}
+
+	p.event.Layers = len(p.layers)
+	p.event.LayersDone = 0
+	p.event.DownloadedBytes = 0
+	p.event.TotalBytes = 0
+	for _, l := range p.layers {
+		if l.done {
+			p.event.LayersDone++
+		}
+		p.event.DownloadedBytes += l.current
+		p.event.TotalBytes += l.total
+	}
+
+	return true
+}
+
+// sendImagePullProgress reports the progress of a pull to the scheduler,
+// which forwards it to the controller owning the instance.  Peers that
+// predate the ImagePullProgress event do not get it.
+func sendImagePullProgress(conn *ssntpConn, ev *payloads.ImagePullProgressEvent) {
+	if !conn.isConnected() || conn.PayloadVersion() < payloads.Version32 {
+		return
+	}
+
+	event := payloads.EventImagePullProgress{PullProgress: *ev}
+	payload, err := payloads.MarshalVersion(conn.Encoding(), &event, conn.PayloadVersion())
+	if err != nil {
+		clog.Errorf("Unable to Marshall ImagePullProgress %v", err)
+		return
+	}
+
+	_, err = conn.SendEvent(ssntp.ImagePullProgress, payload)
+	if err != nil {
+		clog.Errorf("Failed to send ImagePullProgress event %v", err)
+	}
+}
+
+// denyPrivilege is called by the docker client when a registry rejects our
+// credentials.  There is no one to ask for others.
+func denyPrivilege() (string, error) {
+	return "", fmt.Errorf("Registry refused the credentials")
+}
+
+// pullImage pulls image, reporting its progress through report if it is
+// not nil.
+func pullImage(cli *client.Client, image string, auth *types.AuthConfig,
+	progress *pullProgress, report func(*payloads.ImagePullProgressEvent)) error {
+	encoded, err := encodeRegistryAuth(auth)
+	if err != nil {
+		return err
+	}
+
+	prog, err := cli.ImagePull(context.Background(),
+		types.ImagePullOptions{ImageID: image, RegistryAuth: encoded}, denyPrivilege)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = prog.Close() }()
+
+	var reported time.Time
+	dec := json.NewDecoder(prog)
+	for {
+		var msg jsonmessage.JSONMessage
+		err = dec.Decode(&msg)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if msg.Error != nil {
+			return msg.Error
+		}
+
+		if progress.update(&msg) && report != nil &&
+			time.Since(reported) >= pullProgressPeriod {
+			reported = time.Now()
+			ev := progress.event
+			report(&ev)
+		}
+	}
+}
+
+// pullFromMirror pulls image from the pull-through cache and tags it with
+// its upstream name, so that instances find it under that name.
+func pullFromMirror(cli *client.Client, image, mirrored string,
+	progress *pullProgress, report func(*payloads.ImagePullProgressEvent)) error {
+	auth, err := registryAuthForMirror(imageRegistry(mirrored))
+	if err != nil {
+		return err
+	}
+
+	err = pullImage(cli, mirrored, auth, progress, report)
+	if err != nil {
+		return err
+	}
+
+	repo, tag := splitImageTag(image)
+	return cli.ImageTag(context.Background(), types.ImageTagOptions{
+		ImageID:        mirrored,
+		RepositoryName: repo,
+		Tag:            tag,
+		Force:          true,
+	})
+}
+
+// registryAuthForMirror returns the credentials the node holds for every
+// tenant for the pull-through cache.  Tenant credentials are never sent to
+// it, as it is shared by all tenants.
+func registryAuthForMirror(mirror string) (*types.AuthConfig, error) {
+	return registryAuth(&vmConfig{}, mirror)
+}
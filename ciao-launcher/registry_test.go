@@ -0,0 +1,171 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+func TestImageRegistry(t *testing.T) {
+	tests := []struct {
+		image    string
+		registry string
+		mirrored string
+	}{
+		{"ubuntu", "docker.io", "mirror:5000/library/ubuntu"},
+		{"ubuntu:16.04", "docker.io", "mirror:5000/library/ubuntu:16.04"},
+		{"ciao/app:1.0", "docker.io", "mirror:5000/ciao/app:1.0"},
+		{"docker.io/ciao/app", "docker.io", "mirror:5000/ciao/app"},
+		{"ubuntu@sha256:0123", "docker.io", ""},
+		{"localhost/app", "localhost", ""},
+		{"registry.example.com/app:1.0", "registry.example.com", ""},
+		{"registry:5000/ciao/app", "registry:5000", ""},
+	}
+
+	for _, tt := range tests {
+		if r := imageRegistry(tt.image); r != tt.registry {
+			t.Errorf("Registry of %s is %s, expected %s", tt.image, r, tt.registry)
+		}
+		if m := mirrorImage("mirror:5000", tt.image); m != tt.mirrored {
+			t.Errorf("Mirror image of %s is %q, expected %q", tt.image, m, tt.mirrored)
+		}
+	}
+
+	if m := mirrorImage("", "ubuntu"); m != "" {
+		t.Errorf("Image mirrored without a mirror: %s", m)
+	}
+}
+
+func TestSplitImageTag(t *testing.T) {
+	tests := []struct {
+		image string
+		repo  string
+		tag   string
+	}{
+		{"ubuntu", "ubuntu", "latest"},
+		{"ubuntu:16.04", "ubuntu", "16.04"},
+		{"registry:5000/app", "registry:5000/app", "latest"},
+		{"registry:5000/app:1.0", "registry:5000/app", "1.0"},
+	}
+
+	for _, tt := range tests {
+		repo, tag := splitImageTag(tt.image)
+		if repo != tt.repo || tag != tt.tag {
+			t.Errorf("%s split into %s %s, expected %s %s", tt.image, repo, tag, tt.repo, tt.tag)
+		}
+	}
+}
+
+func TestRegistryAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	const tenant = "67d86208-b46c-4465-9018-fe14087d415f"
+	creds := []byte(`
+- registry: registry.example.com
+  username: node
+  password: node-secret
+- registry: registry.example.com
+  tenant_uuid: ` + tenant + `
+  username: tenant
+  password: tenant-secret
+`)
+	file := path.Join(dir, "registry-auth.yaml")
+	if err := ioutil.WriteFile(file, creds, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldRegistryAuthFile := registryAuthFile
+	registryAuthFile = file
+	defer func() { registryAuthFile = oldRegistryAuthFile }()
+
+	cfg := &vmConfig{TennantUUID: tenant}
+	auth, err := registryAuth(cfg, "registry.example.com")
+	if err != nil || auth == nil || auth.Username != "tenant" {
+		t.Errorf("Tenant credentials not used: %+v %v", auth, err)
+	}
+
+	cfg.TennantUUID = "other"
+	auth, err = registryAuth(cfg, "registry.example.com")
+	if err != nil || auth == nil || auth.Username != "node" {
+		t.Errorf("Node credentials not used: %+v %v", auth, err)
+	}
+
+	auth, err = registryAuth(cfg, "docker.io")
+	if err != nil || auth != nil {
+		t.Errorf("Unexpected credentials for docker.io: %+v %v", auth, err)
+	}
+
+	cfg.registryAuth = &payloads.RegistryAuth{Username: "start", Password: "start-secret"}
+	auth, err = registryAuth(cfg, "registry.example.com")
+	if err != nil || auth == nil || auth.Username != "start" {
+		t.Errorf("START credentials not used: %+v %v", auth, err)
+	}
+
+	cfg.registryAuth.Registry = "other.example.com"
+	if err := os.Chmod(file, 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = registryAuth(cfg, "registry.example.com")
+	if err == nil {
+		t.Errorf("Credentials file readable by others accepted")
+	}
+
+	registryAuthFile = path.Join(dir, "missing.yaml")
+	auth, err = registryAuth(cfg, "registry.example.com")
+	if err != nil || auth != nil {
+		t.Errorf("Missing credentials file not ignored: %+v %v", auth, err)
+	}
+}
+
+func TestPullProgress(t *testing.T) {
+	p := newPullProgress("instance", "ubuntu")
+
+	msgs := []jsonmessage.JSONMessage{
+		{Status: "Pulling from library/ubuntu", ID: "latest"},
+		{Status: "Already exists", ID: "a"},
+		{Status: "Pulling fs layer", ID: "b"},
+		{Status: "Pulling fs layer", ID: "c"},
+		{Status: "Downloading", ID: "b", Progress: &jsonmessage.JSONProgress{Current: 100, Total: 1000}},
+		{Status: "Downloading", ID: "c", Progress: &jsonmessage.JSONProgress{Current: 50, Total: 500}},
+		{Status: "Download complete", ID: "c"},
+		{Status: "Extracting", ID: "c", Progress: &jsonmessage.JSONProgress{Current: 10, Total: 2000}},
+		{Status: "Pull complete", ID: "c"},
+		{Status: "Digest: sha256:0123"},
+	}
+
+	for i := range msgs {
+		p.update(&msgs[i])
+	}
+
+	ev := p.event
+	if ev.Layers != 3 || ev.LayersDone != 2 {
+		t.Errorf("%d/%d layers done, expected 2/3", ev.LayersDone, ev.Layers)
+	}
+	if ev.DownloadedBytes != 600 || ev.TotalBytes != 1500 {
+		t.Errorf("%d/%d bytes downloaded, expected 600/1500", ev.DownloadedBytes, ev.TotalBytes)
+	}
+}
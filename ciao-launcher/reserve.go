@@ -0,0 +1,104 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	"github.com/01org/ciao/clog"
+)
+
+// resourceHold is the memory, vCPUs and disk space held on the node by a
+// RESERVE command for an instance that has not been started yet.  The
+// scheduler has already accounted for these resources, so the node does
+// not report them as available and does not give them to other instances.
+type resourceHold struct {
+	tenant  string
+	memMB   int
+	vcpus   int
+	diskMB  int
+	expires time.Time
+}
+
+type reserveCmd struct {
+	id   string
+	hold resourceHold
+}
+
+type ovsReserveCmd struct {
+	id   string
+	hold resourceHold
+}
+
+// holdResources records a reservation.  The scheduler placed it against
+// the resources the node last reported, so it is held without checking
+// whether the node still has room for it.
+func (ovs *overseer) holdResources(cmd *ovsReserveCmd) {
+	clog.Infof("Overseer: holding reservation %s until %v", cmd.id, cmd.hold.expires)
+	hold := cmd.hold
+	ovs.holds[cmd.id] = &hold
+}
+
+// expireHolds forgets the reservations that expired by now.
+func (ovs *overseer) expireHolds(now time.Time) {
+	for id, hold := range ovs.holds {
+		if !now.Before(hold.expires) {
+			clog.Infof("Overseer: reservation %s expired", id)
+			delete(ovs.holds, id)
+		}
+	}
+}
+
+// heldResources forgets the reservations that expired and returns the
+// total of the resources held by the others.
+func (ovs *overseer) heldResources() (held resourceHold) {
+	ovs.expireHolds(time.Now())
+	for _, hold := range ovs.holds {
+		held.memMB += hold.memMB
+		held.vcpus += hold.vcpus
+		held.diskMB += hold.diskMB
+	}
+
+	return held
+}
+
+// useHold releases the resources of the reservation a START command of the
+// given tenant references, so that they can be allocated to its instance.
+func (ovs *overseer) useHold(id, tenant string) {
+	hold, ok := ovs.holds[id]
+	if !ok {
+		clog.Warningf("Reservation %s is not held, starting instance without it", id)
+		return
+	}
+
+	if hold.tenant != tenant {
+		clog.Warningf("Reservation %s is not held for tenant %s", id, tenant)
+		return
+	}
+
+	clog.Infof("Overseer: using reservation %s", id)
+	delete(ovs.holds, id)
+}
+
+// unheld returns the amount of a resource available once held units of it
+// are set aside, which is never negative.
+func unheld(available, held int) int {
+	if available < held {
+		return 0
+	}
+	return available - held
+}
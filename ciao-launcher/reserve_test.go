@@ -0,0 +1,122 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"gopkg.in/yaml.v2"
+)
+
+func TestParseReservePayload(t *testing.T) {
+	const tenant = "67d86208-b46c-4465-9018-fe14087d415f"
+
+	reserve := payloads.Reserve{
+		Reserve: payloads.ReserveCmd{
+			ReservationID: "volume-prep",
+			TenantUUID:    tenant,
+			RequestedResources: []payloads.RequestedResource{
+				{Type: payloads.MemMB, Value: 1024},
+				{Type: payloads.VCPUs, Value: 2},
+				{Type: payloads.DiskMB, Value: 4096},
+			},
+			TTLSeconds: 60,
+			Expires:    "2017-07-14T02:40:00Z",
+		},
+	}
+	data, err := yaml.Marshal(&reserve)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, payloadErr := parseReservePayload(data)
+	if payloadErr != nil {
+		t.Fatalf("Unable to parse RESERVE: %v", payloadErr.err)
+	}
+	hold := cmd.hold
+	if cmd.id != "volume-prep" || hold.tenant != tenant || hold.memMB != 1024 ||
+		hold.vcpus != 2 || hold.diskMB != 4096 || hold.expires.Unix() != 1500000000 {
+		t.Errorf("Wrong reservation %s %+v", cmd.id, hold)
+	}
+
+	reserve.Reserve.TTLSeconds = 0
+	data, err = yaml.Marshal(&reserve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, payloadErr = parseReservePayload(data); payloadErr == nil {
+		t.Errorf("RESERVE without TTL accepted")
+	}
+}
+
+func TestResourceHolds(t *testing.T) {
+	const tenant = "67d86208-b46c-4465-9018-fe14087d415f"
+	const other = "83679162-1378-4288-a2d4-70e13ec132aa"
+
+	defer func(overcommit float64) { cpuOvercommit = overcommit }(cpuOvercommit)
+	cpuOvercommit = 1
+
+	ovs := &overseer{
+		instances:          make(map[string]*ovsInstanceState),
+		holds:              make(map[string]*resourceHold),
+		reservations:       newNodeReservations(),
+		cpusOnline:         4,
+		memoryAvailable:    4096,
+		diskSpaceAvailable: 1 << 20,
+	}
+
+	ovs.holdResources(&ovsReserveCmd{"r", resourceHold{
+		tenant:  tenant,
+		memMB:   2048,
+		vcpus:   2,
+		expires: time.Now().Add(time.Hour),
+	}})
+	ovs.holdResources(&ovsReserveCmd{"expired", resourceHold{
+		tenant:  tenant,
+		memMB:   1024,
+		expires: time.Now().Add(-time.Second),
+	}})
+
+	if held := ovs.heldResources(); held.memMB != 2048 || held.vcpus != 2 || len(ovs.holds) != 1 {
+		t.Fatalf("Unexpected held resources %+v", held)
+	}
+
+	if ovs.roomAvailable(&vmConfig{Cpus: 3, Mem: 512}) {
+		t.Errorf("Instance given held vCPUs")
+	}
+	if ovs.roomAvailable(&vmConfig{Cpus: 1, Mem: 2048}) {
+		t.Errorf("Instance given held memory")
+	}
+	if !ovs.roomAvailable(&vmConfig{Cpus: 2, Mem: 1024}) {
+		t.Errorf("Instance refused resources that are not held")
+	}
+
+	ovs.useHold("r", other)
+	if len(ovs.holds) != 1 {
+		t.Fatalf("Reservation used by another tenant")
+	}
+
+	ovs.useHold("r", tenant)
+	if len(ovs.holds) != 0 {
+		t.Fatalf("Reservation not released when used")
+	}
+	if !ovs.roomAvailable(&vmConfig{Cpus: 3, Mem: 2048}) {
+		t.Errorf("Instance refused the resources of its reservation")
+	}
+}
@@ -0,0 +1,226 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/01org/ciao/clog"
+)
+
+// Dedicated CPU cores, disk IOPS and network bandwidth are only accounted
+// for when the node is configured with their capacity, using the
+// -dedicated-cpus, -disk-iops and -net-bandwidth-kbps options.  Instances
+// requesting them are otherwise refused, or in the case of disk IOPS and
+// bandwidth, which launcher cannot measure, started without any guarantee.
+//
+// Network nodes additionally report the resources their CNCIs consume, given
+// with the -max-cncis, -cnci-bandwidth-kbps and -public-ips options, so that
+// the scheduler does not place CNCIs on the generic memory fit.  Each CNCI
+// takes one public IP address and reserves the larger of its ingress and
+// egress bandwidth.
+
+// cpuListFlag is a list of host CPUs given in the format used by taskset and
+// cpusets, e.g., 2-5,8.
+type cpuListFlag []int
+
+func (f *cpuListFlag) String() string {
+	if f == nil {
+		return ""
+	}
+
+	cpus := make([]string, len(*f))
+	for i, cpu := range *f {
+		cpus[i] = strconv.Itoa(cpu)
+	}
+	return strings.Join(cpus, ",")
+}
+
+func (f *cpuListFlag) Set(val string) error {
+	seen := make(map[int]bool)
+	for _, r := range strings.Split(val, ",") {
+		if r == "" {
+			continue
+		}
+
+		bounds := strings.SplitN(r, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return fmt.Errorf("Invalid CPU %s", bounds[0])
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return fmt.Errorf("Invalid CPU range %s", r)
+			}
+		}
+
+		for cpu := first; cpu <= last; cpu++ {
+			if !seen[cpu] {
+				seen[cpu] = true
+				*f = append(*f, cpu)
+			}
+		}
+	}
+
+	sort.Ints(*f)
+	return nil
+}
+
+// nodeReservations tracks the dedicated CPU cores, disk IOPS and network
+// bandwidth reserved by the instances running on the node.  It is only
+// accessed from the overseer go routine.
+type nodeReservations struct {
+	cores       map[int]string
+	diskIOPS    int
+	ingressKbps int
+	egressKbps  int
+}
+
+func newNodeReservations() nodeReservations {
+	return nodeReservations{cores: make(map[int]string)}
+}
+
+func (r *nodeReservations) reserve(instance string, cfg *vmConfig) {
+	for _, core := range cfg.Cores {
+		r.cores[core] = instance
+	}
+	r.diskIOPS += cfg.DiskIOPS
+	r.ingressKbps += cfg.IngressKbps
+	r.egressKbps += cfg.EgressKbps
+}
+
+func (r *nodeReservations) reserveAllocation(instance string, a *instanceAllocation) {
+	r.reserve(instance, &vmConfig{
+		Cores:       a.Cores,
+		DiskIOPS:    a.DiskIOPS,
+		IngressKbps: a.IngressKbps,
+		EgressKbps:  a.EgressKbps,
+	})
+}
+
+func (r *nodeReservations) release(target *ovsInstanceState) {
+	for _, core := range target.cores {
+		delete(r.cores, core)
+	}
+
+	r.diskIOPS -= target.diskIOPS
+	if r.diskIOPS < 0 {
+		r.diskIOPS = 0
+	}
+
+	r.ingressKbps -= target.ingressKbps
+	if r.ingressKbps < 0 {
+		r.ingressKbps = 0
+	}
+
+	r.egressKbps -= target.egressKbps
+	if r.egressKbps < 0 {
+		r.egressKbps = 0
+	}
+}
+
+// cnciKbps returns the CNCI bandwidth reserved on a network node.
+func (r *nodeReservations) cnciKbps() int {
+	if r.egressKbps > r.ingressKbps {
+		return r.egressKbps
+	}
+	return r.ingressKbps
+}
+
+func (r *nodeReservations) freeCores() []int {
+	free := make([]int, 0, len(dedicatedCPUs))
+	for _, core := range dedicatedCPUs {
+		if _, ok := r.cores[core]; !ok {
+			free = append(free, core)
+		}
+	}
+	return free
+}
+
+// allocateCores picks needed free dedicated cores for an instance.  The
+// caller must already have checked, via roomAvailable, that enough cores
+// are free.  The cores are only reserved by a subsequent call to reserve.
+func (r *nodeReservations) allocateCores(needed int) []int {
+	if needed <= 0 {
+		return nil
+	}
+
+	return r.freeCores()[:needed]
+}
+
+// available returns the capacity of a node resource and the amount of it
+// not reserved by any instance, or -1 for both if the capacity of the node
+// is not known.
+func available(capacity, reserved int) (int, int) {
+	if capacity <= 0 {
+		return -1, -1
+	}
+
+	if reserved > capacity {
+		return capacity, 0
+	}
+
+	return capacity, capacity - reserved
+}
+
+// fits returns true if the dedicated cores, disk IOPS and bandwidth
+// requested by cfg can be reserved on the node.
+func (r *nodeReservations) fits(cfg *vmConfig) bool {
+	if cfg.PinnedCores > 0 {
+		coresAvailable := len(r.freeCores())
+		if coresAvailable < cfg.PinnedCores {
+			clog.Warningf("Insufficient dedicated cores.  Need %d have %d",
+				cfg.PinnedCores, coresAvailable)
+			return false
+		}
+	}
+
+	if _, iopsAvailable := available(diskIOPSCapacity, r.diskIOPS); iopsAvailable >= 0 &&
+		iopsAvailable < cfg.DiskIOPS {
+		clog.Warningf("Insufficient disk IOPS.  Need %d have %d",
+			cfg.DiskIOPS, iopsAvailable)
+		return false
+	}
+
+	_, ingressAvailable := available(netBandwidthKbps, r.ingressKbps)
+	_, egressAvailable := available(netBandwidthKbps, r.egressKbps)
+	if ingressAvailable >= 0 &&
+		(ingressAvailable < cfg.IngressKbps || egressAvailable < cfg.EgressKbps) {
+		clog.Warningf("Insufficient bandwidth.  Need %d/%d kbps have %d/%d kbps",
+			cfg.IngressKbps, cfg.EgressKbps, ingressAvailable, egressAvailable)
+		return false
+	}
+
+	return true
+}
+
+// pinThread restricts the host thread tid to the given CPUs.
+func pinThread(tid int, cpus []int) error {
+	list := cpuListFlag(cpus)
+	out, err := exec.Command("taskset", "-p", "-c", list.String(), strconv.Itoa(tid)).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Unable to pin thread %d to CPUs %s: %v: %s", tid, list.String(), err, out)
+	}
+	return nil
+}
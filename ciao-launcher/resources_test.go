@@ -0,0 +1,99 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCPUListFlag(t *testing.T) {
+	var cpus cpuListFlag
+	if err := cpus.Set("8,2-4,3"); err != nil {
+		t.Fatalf("Unable to parse CPU list: %v", err)
+	}
+
+	if !reflect.DeepEqual([]int(cpus), []int{2, 3, 4, 8}) {
+		t.Errorf("Wrong CPUs %v", cpus)
+	}
+
+	if cpus.String() != "2,3,4,8" {
+		t.Errorf("Wrong CPU list %s", cpus.String())
+	}
+
+	for _, invalid := range []string{"a", "4-2", "-1", "1-b"} {
+		var c cpuListFlag
+		if err := c.Set(invalid); err == nil {
+			t.Errorf("Invalid CPU list %s accepted", invalid)
+		}
+	}
+}
+
+func TestNodeReservations(t *testing.T) {
+	defer func(cpus cpuListFlag, iops, kbps int) {
+		dedicatedCPUs, diskIOPSCapacity, netBandwidthKbps = cpus, iops, kbps
+	}(dedicatedCPUs, diskIOPSCapacity, netBandwidthKbps)
+
+	dedicatedCPUs = cpuListFlag{4, 5, 6}
+	diskIOPSCapacity = 0
+	netBandwidthKbps = 100000
+
+	r := newNodeReservations()
+	cfg := &vmConfig{PinnedCores: 2, DiskIOPS: 5000, IngressKbps: 60000}
+	if !r.fits(cfg) {
+		t.Fatalf("Instance should fit on an empty node")
+	}
+
+	cfg.Cores = r.allocateCores(cfg.PinnedCores)
+	if !reflect.DeepEqual(cfg.Cores, []int{4, 5}) {
+		t.Fatalf("Wrong cores allocated %v", cfg.Cores)
+	}
+	r.reserve("a", cfg)
+
+	if r.fits(cfg) {
+		t.Errorf("Second instance should not fit, only one core is free")
+	}
+
+	small := &vmConfig{PinnedCores: 1, DiskIOPS: 100000, IngressKbps: 40000}
+	if !r.fits(small) {
+		t.Errorf("Instance should fit, disk IOPS are not limited and 40000 kbps are free")
+	}
+
+	small.EgressKbps = 100001
+	if r.fits(small) {
+		t.Errorf("Instance should not fit, the egress bandwidth is 100000 kbps")
+	}
+
+	if total, free := available(netBandwidthKbps, r.ingressKbps); total != 100000 || free != 40000 {
+		t.Errorf("Wrong ingress bandwidth %d/%d", free, total)
+	}
+
+	if total, free := available(diskIOPSCapacity, r.diskIOPS); total != -1 || free != -1 {
+		t.Errorf("Unknown disk IOPS reported as %d/%d", free, total)
+	}
+
+	r.reserve("b", &vmConfig{EgressKbps: 80000})
+	if r.cnciKbps() != 80000 {
+		t.Errorf("Wrong CNCI bandwidth %d, expected the egress one", r.cnciKbps())
+	}
+	r.release(&ovsInstanceState{egressKbps: 80000})
+
+	r.release(&ovsInstanceState{cores: cfg.Cores, diskIOPS: cfg.DiskIOPS, ingressKbps: cfg.IngressKbps})
+	if len(r.freeCores()) != 3 || r.diskIOPS != 0 || r.ingressKbps != 0 {
+		t.Errorf("Resources not released: %+v", r)
+	}
+}
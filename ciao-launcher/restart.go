@@ -17,11 +17,10 @@
 package main
 
 import (
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/networking/libsnnet"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
-
-	"github.com/golang/glog"
 )
 
 type restartError struct {
@@ -30,19 +29,21 @@ type restartError struct {
 }
 
 func (re *restartError) send(client *ssntpConn, instance string) {
+	recentErrors.add(ssntp.RestartFailure, instance, string(re.code), re.err)
+
 	if !client.isConnected() {
 		return
 	}
 
 	payload, err := generateRestartError(instance, re)
 	if err != nil {
-		glog.Errorf("Unable to generate payload for restart_failure: %v", err)
+		clog.Errorf("Unable to generate payload for restart_failure: %v", err)
 		return
 	}
 
 	_, err = client.SendError(ssntp.RestartFailure, payload)
 	if err != nil {
-		glog.Errorf("Unable to send restart_failure: %v", err)
+		clog.Errorf("Unable to send restart_failure: %v", err)
 	}
 }
 
@@ -54,13 +55,27 @@ func processRestart(instanceDir string, vm virtualizer, client *ssntpConn, cfg *
 	if networking.Enabled() {
 		vnicCfg, err = createVnicCfg(cfg)
 		if err != nil {
-			glog.Errorf("Could not create VnicCFG: %s", err)
+			clog.Errorf("Could not create VnicCFG: %s", err)
 			return &restartError{err, payloads.RestartInstanceCorrupt}
 		}
 		vnicName, _, err = createVnic(client, vnicCfg)
 		if err != nil {
 			return &restartError{err, payloads.RestartNetworkFailure}
 		}
+		err = shapeVnic(vnicName, cfg.IngressKbps, cfg.EgressKbps)
+		if err != nil {
+			return &restartError{err, payloads.RestartNetworkFailure}
+		}
+		err = applySavedSecurityGroup(instanceDir, vnicName)
+		if err != nil {
+			return &restartError{err, payloads.RestartNetworkFailure}
+		}
+		cfg.VnicName = vnicName
+	}
+
+	err = runHooks(hookPreStart, instanceDir, cfg)
+	if err != nil {
+		return &restartError{err, payloads.RestartLaunchFailure}
 	}
 
 	err = vm.startVM(vnicName, getNodeIPAddress())
@@ -68,5 +83,7 @@ func processRestart(instanceDir string, vm virtualizer, client *ssntpConn, cfg *
 		return &restartError{err, payloads.RestartLaunchFailure}
 	}
 
+	_ = runHooks(hookPostStart, instanceDir, cfg)
+
 	return nil
 }
@@ -0,0 +1,123 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// statsBusyCPU is the CPU usage, in percent, from which an instance
+	// is considered busy and sampled more often.
+	statsBusyCPU = 50
+
+	// statsChurnCPU and statsChurnMemPct are the changes in CPU usage,
+	// in percent, and in memory usage, in percent of the previous
+	// sample, from which the usage of an instance is considered to be
+	// changing.
+	statsChurnCPU    = 10
+	statsChurnMemPct = 10
+
+	// Busy instances are sampled statsBusyDivisor times per stats
+	// period, and the sampling interval of idle instances grows up to
+	// statsIdleMultiplier stats periods.
+	statsBusyDivisor    = 4
+	statsIdleMultiplier = 4
+
+	// statsJitterPct is the maximum jitter, in percent, added to or
+	// removed from each sampling interval, so that the instances of a
+	// node are not all sampled at once.
+	statsJitterPct = 10
+)
+
+// statsSampler picks the interval after which the usage of an instance is
+// sampled next.  Busy instances, and those whose usage is changing, are
+// sampled more often than once per stats period, and the interval of idle
+// instances is doubled at each sample in which their usage stays steady, so
+// that dense nodes do not spend their time sampling instances doing nothing.
+type statsSampler struct {
+	interval time.Duration
+	cpu      int
+	memory   int
+}
+
+func newStatsSampler() statsSampler {
+	return statsSampler{cpu: -1, memory: -1}
+}
+
+func churned(prev, cur, threshold int) bool {
+	if prev < 0 || cur < 0 {
+		return false
+	}
+
+	diff := cur - prev
+	if diff < 0 {
+		diff = -diff
+	}
+
+	return diff > 0 && diff >= threshold
+}
+
+// next records the normalised CPU usage, in percent, and the memory usage,
+// in MB, of the last sample and returns the interval until the next one,
+// without jitter.
+func (s *statsSampler) next(cpu, memory int, period time.Duration) time.Duration {
+	changing := churned(s.cpu, cpu, statsChurnCPU) ||
+		churned(s.memory, memory, s.memory*statsChurnMemPct/100)
+	idle := !changing && cpu >= 0 && cpu < balloonIdleCPU && s.cpu >= 0
+	s.cpu, s.memory = cpu, memory
+
+	switch {
+	case changing || cpu >= statsBusyCPU:
+		s.interval = period / statsBusyDivisor
+	case idle:
+		if s.interval < period {
+			s.interval = period
+		}
+		s.interval *= 2
+		if s.interval > statsIdleMultiplier*period {
+			s.interval = statsIdleMultiplier * period
+		}
+	default:
+		s.interval = period
+	}
+
+	return s.interval
+}
+
+// jitter adds up to statsJitterPct percent to, or removes it from, interval.
+func jitter(interval time.Duration) time.Duration {
+	max := int64(interval) * statsJitterPct / 100
+	if max <= 0 {
+		return interval
+	}
+
+	return interval + time.Duration(rand.Int63n(2*max+1)-max)
+}
+
+// sampleStats samples the usage of the instance, sends it to the overseer,
+// checks it against the disk limit of the instance and returns the timer of
+// the next sample.
+func (id *instanceData) sampleStats() <-chan time.Time {
+	stamp := time.Now()
+	d, m, c := id.vm.stats()
+	id.ovsCh <- &ovsStatsUpdateCmd{id.instance, m, d, c, stamp}
+	id.checkDiskUsage(d)
+	interval := id.sampler.next(normalizeCPUUsage(c, id.cfg.Cpus), m, getSettings().statsPeriod)
+	return time.After(jitter(interval))
+}
@@ -0,0 +1,71 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatsSampler(t *testing.T) {
+	period := 30 * time.Second
+	tests := []struct {
+		cpu      int
+		memory   int
+		expected time.Duration
+	}{
+		{-1, -1, period},
+		{2, 512, period},
+		{1, 520, 2 * period},
+		{3, 510, 4 * period},
+		{2, 512, 4 * period},
+		{30, 512, period / statsBusyDivisor},
+		{32, 515, period},
+		{80, 515, period / statsBusyDivisor},
+		{79, 515, period / statsBusyDivisor},
+		{20, 515, period / statsBusyDivisor},
+		{20, 700, period / statsBusyDivisor},
+		{20, 710, period},
+		{2, 710, period / statsBusyDivisor},
+		{2, 710, 2 * period},
+		{2, 710, 4 * period},
+	}
+
+	s := newStatsSampler()
+	for i, test := range tests {
+		got := s.next(test.cpu, test.memory, period)
+		if got != test.expected {
+			t.Errorf("Sample %d (%d%%, %d MB): expected %v got %v",
+				i, test.cpu, test.memory, test.expected, got)
+		}
+	}
+}
+
+func TestStatsJitter(t *testing.T) {
+	interval := 30 * time.Second
+	max := interval * statsJitterPct / 100
+	for i := 0; i < 100; i++ {
+		got := jitter(interval)
+		if got < interval-max || got > interval+max {
+			t.Fatalf("Jittered interval %v out of %v +/- %v", got, interval, max)
+		}
+	}
+
+	if got := jitter(0); got != 0 {
+		t.Errorf("Expected no jitter on empty interval, got %v", got)
+	}
+}
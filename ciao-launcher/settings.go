@@ -0,0 +1,154 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+// launcherSettings contains the settings that can be changed by the
+// cluster configuration while launcher is running.
+type launcherSettings struct {
+	statsPeriod  time.Duration
+	diskSpaceHWM int
+	diskSpaceLWM int
+	memHWM       int
+	memLWM       int
+	diskLimit    bool
+	memLimit     bool
+	guestFSStats bool
+	logVerbosity string
+}
+
+func builtinSettings() launcherSettings {
+	return launcherSettings{
+		statsPeriod:  time.Second * statsPeriod,
+		diskSpaceHWM: diskSpaceHWM,
+		diskSpaceLWM: diskSpaceLWM,
+		memHWM:       memHWM,
+		memLWM:       memLWM,
+		diskLimit:    true,
+		memLimit:     true,
+	}
+}
+
+var settings = struct {
+	sync.RWMutex
+	current  launcherSettings
+	defaults launcherSettings
+}{
+	current:  builtinSettings(),
+	defaults: builtinSettings(),
+}
+
+// initSettings records the settings given on the command line, which are
+// used for the settings that the cluster configuration leaves out.  It must
+// be called after flag.Parse().
+func initSettings() {
+	settings.Lock()
+	defer settings.Unlock()
+
+	settings.current.diskLimit = diskLimit
+	settings.current.memLimit = memLimit
+	settings.current.guestFSStats = guestFSStats
+	if v := flag.Lookup("v"); v != nil {
+		settings.current.logVerbosity = v.Value.String()
+	}
+	settings.defaults = settings.current
+}
+
+func getSettings() launcherSettings {
+	settings.RLock()
+	defer settings.RUnlock()
+	return settings.current
+}
+
+// newLauncherSettings returns the command line settings overridden by those
+// given in cluster.
+func newLauncherSettings(cluster *payloads.ConfigureCluster) launcherSettings {
+	settings.RLock()
+	s := settings.defaults
+	settings.RUnlock()
+
+	if cluster.StatsPeriod > 0 {
+		s.statsPeriod = time.Second * time.Duration(cluster.StatsPeriod)
+	}
+
+	for _, w := range []struct {
+		value   int
+		setting *int
+	}{
+		{cluster.Watermarks.DiskHighMB, &s.diskSpaceHWM},
+		{cluster.Watermarks.DiskLowMB, &s.diskSpaceLWM},
+		{cluster.Watermarks.MemHighMB, &s.memHWM},
+		{cluster.Watermarks.MemLowMB, &s.memLWM},
+	} {
+		if w.value > 0 {
+			*w.setting = w.value
+		}
+	}
+
+	// A high watermark lowered below the default low one would leave a
+	// READY node refusing instances.
+	if s.diskSpaceLWM > s.diskSpaceHWM {
+		s.diskSpaceLWM = s.diskSpaceHWM
+	}
+	if s.memLWM > s.memHWM {
+		s.memLWM = s.memHWM
+	}
+
+	if cluster.LogVerbosity != nil {
+		s.logVerbosity = strconv.Itoa(*cluster.LogVerbosity)
+	}
+
+	for feature, enabled := range cluster.Features {
+		switch feature {
+		case payloads.DiskLimitFeature:
+			s.diskLimit = enabled
+		case payloads.MemLimitFeature:
+			s.memLimit = enabled
+		case payloads.GuestFSStatsFeature:
+			s.guestFSStats = enabled
+		default:
+			clog.Warningf("Ignoring unknown feature %s", feature)
+		}
+	}
+
+	return s
+}
+
+// applySettings makes s the current settings.
+func applySettings(s launcherSettings) {
+	settings.Lock()
+	settings.current = s
+	settings.Unlock()
+
+	if s.logVerbosity != "" {
+		if err := flag.Set("v", s.logVerbosity); err != nil {
+			clog.Warningf("Unable to set log verbosity to %s: %v", s.logVerbosity, err)
+		}
+	}
+
+	clog.Infof("Settings: stats period %v, disk watermarks %d/%d MB, memory watermarks %d/%d MB",
+		s.statsPeriod, s.diskSpaceHWM, s.diskSpaceLWM, s.memHWM, s.memLWM)
+}
@@ -0,0 +1,62 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+)
+
+func TestNewLauncherSettings(t *testing.T) {
+	defaults := builtinSettings()
+
+	s := newLauncherSettings(&payloads.ConfigureCluster{})
+	if s != defaults {
+		t.Errorf("Empty cluster configuration changed the settings: %+v", s)
+	}
+
+	verbosity := 2
+	s = newLauncherSettings(&payloads.ConfigureCluster{
+		StatsPeriod: 10,
+		Watermarks: payloads.Watermarks{
+			DiskHighMB: 20 * 1000,
+			MemLowMB:   256,
+		},
+		LogVerbosity: &verbosity,
+		Features: map[string]bool{
+			payloads.MemLimitFeature:     false,
+			payloads.GuestFSStatsFeature: true,
+			"wibble":                     true,
+		},
+	})
+
+	if s.statsPeriod != 10*time.Second || s.logVerbosity != "2" {
+		t.Errorf("Unexpected stats period %v or log verbosity %s", s.statsPeriod, s.logVerbosity)
+	}
+
+	// The default low disk watermark exceeds the new high one
+	if s.diskSpaceHWM != 20*1000 || s.diskSpaceLWM != 20*1000 ||
+		s.memHWM != defaults.memHWM || s.memLWM != 256 {
+		t.Errorf("Unexpected watermarks %+v", s)
+	}
+
+	if !s.diskLimit || s.memLimit || !s.guestFSStats {
+		t.Errorf("Unexpected features %+v", s)
+	}
+}
@@ -21,7 +21,8 @@ import (
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
 )
 
 type simulation struct {
@@ -63,13 +64,13 @@ func (s *simulation) deleteImage() error {
 }
 
 func fakeVM(s *simulation) {
-	glog.Infof("fakeVM started")
+	clog.Infof("fakeVM started")
 	source := rand.NewSource(time.Now().UnixNano())
 	r := rand.New(source)
 
 	delay := r.Int63n(1000)
 	delay++
-	glog.Infof("Will start in %d milliseconds", delay)
+	clog.Infof("Will start in %d milliseconds", delay)
 
 	ticker := time.NewTicker(time.Duration(delay) * time.Millisecond)
 VM:
@@ -99,7 +100,7 @@ VM:
 }
 
 func (s *simulation) startVM(vnicName, ipAddress string) error {
-	glog.Infof("startVM\n")
+	clog.Infof("startVM\n")
 
 	s.killCh = make(chan struct{})
 
@@ -107,7 +108,7 @@ func (s *simulation) startVM(vnicName, ipAddress string) error {
 }
 
 func (s *simulation) monitorVM(closedCh chan struct{}, connectedCh chan struct{}, wg *sync.WaitGroup, boot bool) chan string {
-	glog.Infof("monitorVM\n")
+	clog.Infof("monitorVM\n")
 	s.closedCh = closedCh
 	s.connectedCh = connectedCh
 	s.wg = wg
@@ -124,9 +125,41 @@ func (s *simulation) stats() (disk, memory, cpu int) {
 }
 
 func (s *simulation) connected() {
-	glog.Infof("connected\n")
+	clog.Infof("connected\n")
+}
+
+func (s *simulation) readinessProbe() func() bool {
+	return nil
+}
+
+func (s *simulation) healthProbe() func() healthReport {
+	return nil
+}
+
+func (s *simulation) logFollower() logFollower {
+	return nil
+}
+
+func (s *simulation) guestFilesystems() []payloads.GuestFilesystemStat {
+	return nil
+}
+
+func (s *simulation) setBalloon(targetMB int) error {
+	return nil
+}
+
+func (s *simulation) console() (string, error) {
+	return "", errConsoleNotSupported
+}
+
+func (s *simulation) migrate(uri string) error {
+	return errMigrationNotSupported
+}
+
+func (s *simulation) diagnostics(memoryDump bool) func(dir string) error {
+	return nil
 }
 
 func (s *simulation) lostVM() {
-	glog.Infof("simulation: lostVM\n")
+	clog.Infof("simulation: lostVM\n")
 }
@@ -23,11 +23,10 @@ import (
 	"path"
 	"time"
 
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/networking/libsnnet"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
-
-	"github.com/golang/glog"
 )
 
 type startError struct {
@@ -44,19 +43,21 @@ type startTimes struct {
 }
 
 func (se *startError) send(client *ssntpConn, instance string) {
+	recentErrors.add(ssntp.StartFailure, instance, string(se.code), se.err)
+
 	if !client.isConnected() {
 		return
 	}
 
 	payload, err := generateStartError(instance, se)
 	if err != nil {
-		glog.Errorf("Unable to generate payload for start_failure: %v", err)
+		clog.Errorf("Unable to generate payload for start_failure: %v", err)
 		return
 	}
 
 	_, err = client.SendError(ssntp.StartFailure, payload)
 	if err != nil {
-		glog.Errorf("Unable to send start_failure: %v", err)
+		clog.Errorf("Unable to send start_failure: %v", err)
 	}
 }
 
@@ -64,15 +65,15 @@ func ensureBackingImage(vm virtualizer) error {
 
 	err := vm.checkBackingImage()
 	if err == errImageNotFound {
-		glog.Infof("Backing image not found.  Trying to download")
+		clog.Infof("Backing image not found.  Trying to download")
 		err = vm.downloadBackingImage()
 		if err != nil {
 			//BUG(markus): Need to change overseer state here to Downloading
-			glog.Errorf("Unable to download backing image: %v", err)
+			clog.Errorf("Unable to download backing image: %v", err)
 			return err
 		}
 	} else if err != nil {
-		glog.Errorf("Backing image check failed")
+		clog.Errorf("Backing image check failed")
 		return err
 	}
 
@@ -82,7 +83,7 @@ func ensureBackingImage(vm virtualizer) error {
 func createInstance(vm virtualizer, instanceDir string, cfg *vmConfig, bridge string, userData, metaData []byte) (err error) {
 	err = os.MkdirAll(instanceDir, 0755)
 	if err != nil {
-		glog.Errorf("Cannot create instance directory for VM: %v", err)
+		clog.Errorf("Cannot create instance directory for VM: %v", err)
 		return
 	}
 
@@ -90,6 +91,7 @@ func createInstance(vm virtualizer, instanceDir string, cfg *vmConfig, bridge st
 	defer func() {
 		if r := recover(); r != nil {
 			err = r.(error)
+			_ = wipeFile(path.Join(instanceDir, diskKeyFile))
 			_ = os.RemoveAll(instanceDir)
 			if cfgFile != nil {
 				_ = cfgFile.Close()
@@ -99,28 +101,34 @@ func createInstance(vm virtualizer, instanceDir string, cfg *vmConfig, bridge st
 
 	err = vm.createImage(bridge, userData, metaData)
 	if err != nil {
-		glog.Errorf("Unable to create image %v", err)
+		clog.Errorf("Unable to create image %v", err)
+		panic(err)
+	}
+
+	err = writeInstanceHooks(instanceDir, cfg.hooks)
+	if err != nil {
+		clog.Errorf("Unable to write hooks %v", err)
 		panic(err)
 	}
 
 	cfgFilePath := path.Join(instanceDir, instanceState)
 	cfgFile, err = os.OpenFile(cfgFilePath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		glog.Errorf("Unable to create state file %v", err)
+		clog.Errorf("Unable to create state file %v", err)
 		panic(err)
 	}
 
 	enc := gob.NewEncoder(cfgFile)
 	err = enc.Encode(cfg)
 	if err != nil {
-		glog.Errorf("Failed to store state information %v", err)
+		clog.Errorf("Failed to store state information %v", err)
 		panic(err)
 	}
 
 	err = cfgFile.Close()
 	cfgFile = nil
 	if err != nil {
-		glog.Errorf("Failed to store state information %v", err)
+		clog.Errorf("Failed to store state information %v", err)
 		panic(err)
 	}
 
@@ -158,12 +166,16 @@ func processStart(cmd *insStartCmd, instanceDir string, vm virtualizer, client *
 	if networking.Enabled() {
 		vnicCfg, err = createVnicCfg(cfg)
 		if err != nil {
-			glog.Errorf("Could not create VnicCFG: %s", err)
+			clog.Errorf("Could not create VnicCFG: %s", err)
 			return nil, &startError{err, payloads.InvalidData}
 		}
 	}
 
+	cfg.pullProgress = func(ev *payloads.ImagePullProgressEvent) {
+		sendImagePullProgress(client, ev)
+	}
 	err = ensureBackingImage(vm)
+	cfg.pullProgress = nil
 	if err != nil {
 		return nil, &startError{err, payloads.ImageFailure}
 	}
@@ -175,6 +187,11 @@ func processStart(cmd *insStartCmd, instanceDir string, vm virtualizer, client *
 		if err != nil {
 			return nil, &startError{err, payloads.NetworkFailure}
 		}
+		err = shapeVnic(vnicName, cfg.IngressKbps, cfg.EgressKbps)
+		if err != nil {
+			return nil, &startError{err, payloads.NetworkFailure}
+		}
+		cfg.VnicName = vnicName
 	}
 
 	st.networkStamp = time.Now()
@@ -186,11 +203,18 @@ func processStart(cmd *insStartCmd, instanceDir string, vm virtualizer, client *
 
 	st.creationStamp = time.Now()
 
+	err = runHooks(hookPreStart, instanceDir, cfg)
+	if err != nil {
+		return nil, &startError{err, payloads.LaunchFailure}
+	}
+
 	err = vm.startVM(vnicName, getNodeIPAddress())
 	if err != nil {
 		return nil, &startError{err, payloads.LaunchFailure}
 	}
 
+	_ = runHooks(hookPostStart, instanceDir, cfg)
+
 	st.runStamp = time.Now()
 
 	return &st, nil
@@ -16,7 +16,13 @@
 
 package main
 
-import "testing"
+import (
+	"testing"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
 
 const (
 	commentString   = "# Here's a comment\n"
@@ -129,3 +135,194 @@ func TestSplitYaml(t *testing.T) {
 	}
 
 }
+
+// Test isolation settings validation
+//
+// Checks that checkIsolation accepts well formed profile names, SELinux
+// label options and userns modes and rejects names that could be used to
+// escape the seccomp profile directory along with unknown userns modes and
+// SELinux options.  Settings that disable a form of isolation are only
+// accepted when the node allows them.
+//
+// Test should pass okay.
+func TestCheckIsolation(t *testing.T) {
+	defer func(allowed bool) { allowWeakIsolation = allowed }(allowWeakIsolation)
+
+	tests := []struct {
+		isolation payloads.ContainerIsolation
+		ok        bool
+		weak      bool
+	}{
+		{payloads.ContainerIsolation{}, true, false},
+		{payloads.ContainerIsolation{SeccompProfile: "strict"}, true, false},
+		{payloads.ContainerIsolation{SeccompProfile: "unconfined"}, true, true},
+		{payloads.ContainerIsolation{SeccompProfile: "../../etc/passwd"}, false, false},
+		{payloads.ContainerIsolation{AppArmorProfile: "docker-default"}, true, false},
+		{payloads.ContainerIsolation{AppArmorProfile: "unconfined"}, true, true},
+		{payloads.ContainerIsolation{AppArmorProfile: "a b"}, false, false},
+		{payloads.ContainerIsolation{SELinuxLabel: []string{"type:svirt_lxc_net_t",
+			"level:s0:c100,c200"}}, true, false},
+		{payloads.ContainerIsolation{SELinuxLabel: []string{"disable"}}, true, true},
+		{payloads.ContainerIsolation{SELinuxLabel: []string{"range:s0"}}, false, false},
+		{payloads.ContainerIsolation{SELinuxLabel: []string{"type:"}}, false, false},
+		{payloads.ContainerIsolation{SELinuxLabel: []string{"level:s0 label:disable"}}, false, false},
+		{payloads.ContainerIsolation{UsernsMode: "remap"}, true, false},
+		{payloads.ContainerIsolation{UsernsMode: "host"}, true, true},
+		{payloads.ContainerIsolation{UsernsMode: "private"}, false, false},
+	}
+
+	for _, allowed := range []bool{false, true} {
+		allowWeakIsolation = allowed
+		for i, test := range tests {
+			err := checkIsolation(&test.isolation)
+			ok := test.ok && (allowed || !test.weak)
+			if (err == nil) != ok {
+				t.Errorf("Test %d, allowed %v: unexpected result %v", i, allowed, err)
+			}
+		}
+	}
+}
+
+func TestCheckVolumes(t *testing.T) {
+	defer func(dirs pathListFlag) { bindMountDirs = dirs }(bindMountDirs)
+	bindMountDirs = pathListFlag{"/srv/ciao"}
+
+	tests := []struct {
+		volumes []payloads.ContainerVolume
+		ok      bool
+	}{
+		{nil, true},
+		{[]payloads.ContainerVolume{{Name: "data", MountPoint: "/data"}}, true},
+		{[]payloads.ContainerVolume{{Name: "../data", MountPoint: "/data"}}, false},
+		{[]payloads.ContainerVolume{{HostPath: "/srv/ciao", MountPoint: "/data"}}, true},
+		{[]payloads.ContainerVolume{{HostPath: "/srv/ciao/db", MountPoint: "/data"}}, true},
+		{[]payloads.ContainerVolume{{HostPath: "/srv/ciaodb", MountPoint: "/data"}}, false},
+		{[]payloads.ContainerVolume{{HostPath: "/srv/ciao/../../etc", MountPoint: "/data"}}, false},
+		{[]payloads.ContainerVolume{{Name: "data", MountPoint: "/"}}, false},
+		{[]payloads.ContainerVolume{
+			{Name: "data", MountPoint: "/data"},
+			{HostPath: "/srv/ciao/db", MountPoint: "/data/"},
+		}, false},
+	}
+
+	for i, test := range tests {
+		err := checkVolumes(test.volumes)
+		if (err == nil) != test.ok {
+			t.Errorf("Test %d: unexpected result %v", i, err)
+		}
+	}
+
+	cfg := vmConfig{
+		Disk: 100,
+		Volumes: []payloads.ContainerVolume{
+			{Name: "data", MountPoint: "/data", SizeMB: 1024},
+			{HostPath: "/srv/ciao", MountPoint: "/srv"},
+		},
+	}
+	if disk := cfg.allocatedDiskMB(); disk != 1124 {
+		t.Errorf("Expected 1124 MB of allocated disk space, got %d", disk)
+	}
+}
+
+func TestParseConfigurePayload(t *testing.T) {
+	configure := `configure:
+  launcher:
+    tenant_limits:
+    - tenant_uuid: 67d86208-b46c-4465-9018-fe14087d415f
+      max_instances: 2
+    - tenant_uuid: 83679162-1378-4288-a2d4-70e13ec132aa
+      max_mem_mb: 1024
+`
+	cmd, err := parseConfigurePayload([]byte(configure))
+	if err != nil {
+		t.Fatalf("Unable to parse CONFIGURE payload: %v", err.err)
+	}
+	limits := cmd.limits
+
+	if len(limits) != 2 {
+		t.Fatalf("Expected 2 tenant limits, found %d", len(limits))
+	}
+
+	if limits["67d86208-b46c-4465-9018-fe14087d415f"] != (tenantLimit{2, 0}) ||
+		limits["83679162-1378-4288-a2d4-70e13ec132aa"] != (tenantLimit{0, 1024}) {
+		t.Errorf("Unexpected tenant limits %v", limits)
+	}
+
+	invalid := []string{
+		"configure:\n  launcher:\n    tenant_limits:\n    - tenant_uuid: wibble\n",
+		"configure:\n  launcher:\n    tenant_limits:\n" +
+			"    - tenant_uuid: 67d86208-b46c-4465-9018-fe14087d415f\n      max_mem_mb: -1\n",
+	}
+	for _, c := range invalid {
+		_, err = parseConfigurePayload([]byte(c))
+		if err == nil || err.code != payloads.InvalidData {
+			t.Errorf("Expected invalid data for %s", c)
+		}
+	}
+}
+
+func TestParseCollectDiagnosticsPayload(t *testing.T) {
+	collect := `collect_diagnostics:
+  instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+  workload_agent_uuid: 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64
+  upload_url: https://diagnostics.example.com/bundles/1
+  memory_dump: true
+`
+	instance, cmd, err := parseCollectDiagnosticsPayload([]byte(collect))
+	if err != nil {
+		t.Fatalf("Unable to parse COLLECTDIAGNOSTICS payload: %v", err.err)
+	}
+
+	if instance != "3390740c-dce9-48d6-b83a-a717417072ce" {
+		t.Errorf("Unexpected instance %s", instance)
+	}
+
+	if cmd.uploadURL != "https://diagnostics.example.com/bundles/1" || !cmd.memoryDump ||
+		cmd.samples != defaultDiagnosticsSamples {
+		t.Errorf("Unexpected diagnostics command %+v", cmd)
+	}
+
+	invalid := []string{
+		"collect_diagnostics:\n  workload_agent_uuid: 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64\n",
+		"collect_diagnostics:\n  instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce\n" +
+			"  upload_url: ftp://diagnostics.example.com/bundles/1\n",
+	}
+	for _, c := range invalid {
+		_, _, err = parseCollectDiagnosticsPayload([]byte(c))
+		if err == nil || err.code != payloads.InvalidData {
+			t.Errorf("Expected invalid data for %s", c)
+		}
+	}
+}
+
+// Checks the launch phase breakdown of a traced instance
+//
+// Computes the breakdown of a launch from the launcher timestamps and
+// checks each phase.  The START frame carries no path, so the phases
+// before the launcher received it are left at 0.
+//
+// Test should pass okay.
+func TestLaunchTrace(t *testing.T) {
+	rcv := time.Now()
+	st := &startTimes{
+		startStamp:    rcv.Add(5 * time.Millisecond),
+		creationStamp: rcv.Add(105 * time.Millisecond),
+	}
+	connected := rcv.Add(1105 * time.Millisecond)
+	ready := rcv.Add(3105 * time.Millisecond)
+
+	trace := launchTrace("3390740c-dce9-48d6-b83a-a717417072ce", &ssntp.Frame{},
+		rcv, st, connected, ready)
+
+	expected := payloads.LaunchTrace{
+		InstanceUUID:    "3390740c-dce9-48d6-b83a-a717417072ce",
+		LauncherQueueMS: 5,
+		ImagePrepMS:     100,
+		BootMS:          1000,
+		GuestReadyMS:    2000,
+		TotalMS:         3105,
+	}
+	if trace != expected {
+		t.Errorf("Unexpected launch trace %+v", trace)
+	}
+}
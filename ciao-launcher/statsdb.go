@@ -0,0 +1,265 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/boltdb/bolt"
+)
+
+const (
+	launcherDBDir     = "/var/lib/ciao/launcher"
+	launcherDBFile    = "launcher.db"
+	allocationsBucket = "allocations"
+	statsBucket       = "stats"
+	settingsBucket    = "settings"
+	maintenanceKey    = "maintenance"
+
+	// statsRetention is the amount of time for which stats samples are
+	// kept in the database.  This is a good deal longer than the in memory
+	// history exposed by the admin API.
+	statsRetention = 24 * time.Hour
+)
+
+// instanceAllocation records the resources the overseer has reserved for an
+// instance.
+type instanceAllocation struct {
+	Cpus        int
+	DiskMB      int
+	MemMB       int
+	Hugepages   bool
+	PCIDevs     []string
+	Cores       []int
+	DiskIOPS    int
+	IngressKbps int
+	EgressKbps  int
+}
+
+// launcherDB persists the overseer's resource accounting and a rolling
+// history of stats samples so that they survive launcher restarts.  It is
+// only accessed from the overseer go routine.  All methods can safely be
+// called on a nil *launcherDB, in which case nothing is persisted.
+type launcherDB struct {
+	db *bolt.DB
+}
+
+func openLauncherDB(dbDir string) (*launcherDB, error) {
+	if err := os.MkdirAll(dbDir, 0755); err != nil {
+		return nil, fmt.Errorf("Unable to create db directory (%s) %v", dbDir, err)
+	}
+
+	db, err := bolt.Open(path.Join(dbDir, launcherDBFile), 0600,
+		&bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range []string{allocationsBucket, statsBucket, settingsBucket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return fmt.Errorf("Bucket creation error: %v %v", b, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &launcherDB{db: db}, nil
+}
+
+func (l *launcherDB) close() {
+	if l == nil {
+		return
+	}
+
+	if err := l.db.Close(); err != nil {
+		clog.Warningf("Unable to close launcher db: %v", err)
+	}
+}
+
+func (l *launcherDB) put(bucket string, key []byte, value interface{}) error {
+	var v bytes.Buffer
+	if err := gob.NewEncoder(&v).Encode(value); err != nil {
+		return err
+	}
+
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put(key, v.Bytes())
+	})
+}
+
+func newInstanceAllocation(cfg *vmConfig) *instanceAllocation {
+	return &instanceAllocation{
+		Cpus:        cfg.Cpus,
+		DiskMB:      cfg.Disk,
+		MemMB:       cfg.Mem,
+		Hugepages:   cfg.Hugepages,
+		PCIDevs:     cfg.pciDevices(),
+		Cores:       cfg.Cores,
+		DiskIOPS:    cfg.DiskIOPS,
+		IngressKbps: cfg.IngressKbps,
+		EgressKbps:  cfg.EgressKbps,
+	}
+}
+
+func (l *launcherDB) putAllocation(instance string, a *instanceAllocation) error {
+	if l == nil {
+		return nil
+	}
+
+	return l.put(allocationsBucket, []byte(instance), a)
+}
+
+func (l *launcherDB) deleteAllocation(instance string) error {
+	if l == nil {
+		return nil
+	}
+
+	return l.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(allocationsBucket)).Delete([]byte(instance))
+	})
+}
+
+func (l *launcherDB) allocations() (map[string]*instanceAllocation, error) {
+	allocs := make(map[string]*instanceAllocation)
+	if l == nil {
+		return allocs, nil
+	}
+
+	err := l.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(allocationsBucket)).ForEach(func(k, v []byte) error {
+			a := &instanceAllocation{}
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(a); err != nil {
+				return fmt.Errorf("Unable to decode allocation for %s: %v", string(k), err)
+			}
+			allocs[string(k)] = a
+			return nil
+		})
+	})
+
+	return allocs, err
+}
+
+// putMaintenance records whether the node is in maintenance mode.
+func (l *launcherDB) putMaintenance(enabled bool) error {
+	if l == nil {
+		return nil
+	}
+
+	return l.put(settingsBucket, []byte(maintenanceKey), enabled)
+}
+
+// maintenance returns true if the node was left in maintenance mode by a
+// previous instance of launcher.
+func (l *launcherDB) maintenance() (bool, error) {
+	if l == nil {
+		return false, nil
+	}
+
+	var enabled bool
+	err := l.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(settingsBucket)).Get([]byte(maintenanceKey))
+		if v == nil {
+			return nil
+		}
+		return gob.NewDecoder(bytes.NewReader(v)).Decode(&enabled)
+	})
+
+	return enabled, err
+}
+
+func sampleKey(t time.Time) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(t.UnixNano()))
+	return key
+}
+
+// addSample stores a stats sample and discards any samples older than
+// statsRetention.  Samples are keyed by their big endian timestamps so that
+// bolt keeps them in chronological order.
+func (l *launcherDB) addSample(s *adminStatsSample) error {
+	if l == nil {
+		return nil
+	}
+
+	var v bytes.Buffer
+	if err := gob.NewEncoder(&v).Encode(s); err != nil {
+		return err
+	}
+
+	oldest := sampleKey(s.Time.Add(-statsRetention))
+
+	return l.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(statsBucket))
+
+		// Deleting keys while iterating over them with a cursor can cause
+		// keys to be skipped, so we collect the expired keys first.
+
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, oldest) < 0; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return b.Put(sampleKey(s.Time), v.Bytes())
+	})
+}
+
+// samples returns, in chronological order, at most the last n stats samples
+// stored in the database.
+func (l *launcherDB) samples(n int) ([]adminStatsSample, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	var samples []adminStatsSample
+	err := l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(statsBucket)).Cursor()
+		for k, v := c.Last(); k != nil && len(samples) < n; k, v = c.Prev() {
+			var s adminStatsSample
+			if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&s); err != nil {
+				return fmt.Errorf("Unable to decode stats sample: %v", err)
+			}
+			samples = append(samples, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := 0, len(samples)-1; i < j; i, j = i+1, j-1 {
+		samples[i], samples[j] = samples[j], samples[i]
+	}
+
+	return samples, nil
+}
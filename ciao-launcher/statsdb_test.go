@@ -0,0 +1,156 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLauncherDBAllocations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-db")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, err := openLauncherDB(dir)
+	if err != nil {
+		t.Fatalf("Unable to open db: %v", err)
+	}
+
+	a := &instanceAllocation{Cpus: 2, DiskMB: 1000, MemMB: 512, PCIDevs: []string{"0000:01:00.1"}}
+	if err = db.putAllocation("instance-1", a); err != nil {
+		t.Fatalf("Unable to put allocation: %v", err)
+	}
+	if err = db.putAllocation("instance-2", a); err != nil {
+		t.Fatalf("Unable to put allocation: %v", err)
+	}
+	if err = db.deleteAllocation("instance-2"); err != nil {
+		t.Fatalf("Unable to delete allocation: %v", err)
+	}
+	db.close()
+
+	db, err = openLauncherDB(dir)
+	if err != nil {
+		t.Fatalf("Unable to reopen db: %v", err)
+	}
+	defer db.close()
+
+	allocs, err := db.allocations()
+	if err != nil {
+		t.Fatalf("Unable to retrieve allocations: %v", err)
+	}
+	if len(allocs) != 1 || allocs["instance-1"] == nil {
+		t.Fatalf("Unexpected allocations %v", allocs)
+	}
+	got := allocs["instance-1"]
+	if got.Cpus != 2 || got.DiskMB != 1000 || got.MemMB != 512 ||
+		len(got.PCIDevs) != 1 || got.PCIDevs[0] != a.PCIDevs[0] {
+		t.Errorf("Unexpected allocation %+v", got)
+	}
+}
+
+func TestLauncherDBSamples(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-db")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, err := openLauncherDB(dir)
+	if err != nil {
+		t.Fatalf("Unable to open db: %v", err)
+	}
+	defer db.close()
+
+	now := time.Now()
+	times := []time.Time{
+		now.Add(-2 * statsRetention),
+		now.Add(-2 * time.Minute),
+		now.Add(-time.Minute),
+		now,
+	}
+	for i, tm := range times {
+		s := &adminStatsSample{
+			Time: tm,
+			Load: i,
+			Instances: map[string]adminInstanceUsage{
+				"instance-1": {MemoryUsageMB: i},
+			},
+		}
+		if err = db.addSample(s); err != nil {
+			t.Fatalf("Unable to add sample: %v", err)
+		}
+	}
+
+	samples, err := db.samples(10)
+	if err != nil {
+		t.Fatalf("Unable to retrieve samples: %v", err)
+	}
+	if len(samples) != 3 {
+		t.Fatalf("Expected 3 samples, found %d", len(samples))
+	}
+	for i, s := range samples {
+		if s.Load != i+1 || s.Instances["instance-1"].MemoryUsageMB != i+1 {
+			t.Errorf("Unexpected sample %d: %+v", i, s)
+		}
+	}
+
+	samples, err = db.samples(2)
+	if err != nil || len(samples) != 2 || samples[1].Load != 3 {
+		t.Errorf("Unexpected samples %+v: %v", samples, err)
+	}
+
+	var nilDB *launcherDB
+	if err = nilDB.addSample(&adminStatsSample{}); err != nil {
+		t.Errorf("addSample failed on nil db: %v", err)
+	}
+}
+
+func TestLauncherDBMaintenance(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-db")
+	if err != nil {
+		t.Fatalf("Unable to create temp dir: %v", err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	db, err := openLauncherDB(dir)
+	if err != nil {
+		t.Fatalf("Unable to open db: %v", err)
+	}
+
+	if enabled, err := db.maintenance(); err != nil || enabled {
+		t.Fatalf("Unexpected initial maintenance mode %v: %v", enabled, err)
+	}
+	if err = db.putMaintenance(true); err != nil {
+		t.Fatalf("Unable to put maintenance mode: %v", err)
+	}
+	db.close()
+
+	db, err = openLauncherDB(dir)
+	if err != nil {
+		t.Fatalf("Unable to reopen db: %v", err)
+	}
+	defer db.close()
+
+	if enabled, err := db.maintenance(); err != nil || !enabled {
+		t.Errorf("Maintenance mode not persisted %v: %v", enabled, err)
+	}
+}
@@ -17,9 +17,9 @@
 package main
 
 import (
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
-	"github.com/golang/glog"
 )
 
 type stopError struct {
@@ -28,18 +28,20 @@ type stopError struct {
 }
 
 func (se *stopError) send(client *ssntpConn, instance string) {
+	recentErrors.add(ssntp.StopFailure, instance, string(se.code), se.err)
+
 	if !client.isConnected() {
 		return
 	}
 
 	payload, err := generateStopError(instance, se)
 	if err != nil {
-		glog.Errorf("Unable to generate payload for stop_failure: %v", err)
+		clog.Errorf("Unable to generate payload for stop_failure: %v", err)
 		return
 	}
 
 	_, err = client.SendError(ssntp.StopFailure, payload)
 	if err != nil {
-		glog.Errorf("Unable to send stop_failure: %v", err)
+		clog.Errorf("Unable to send stop_failure: %v", err)
 	}
 }
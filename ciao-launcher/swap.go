@@ -0,0 +1,73 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+)
+
+var sysFsCgroup = "/sys/fs/cgroup"
+
+// instanceCgroups is the cgroup v2 group under which launcher creates a
+// group for each VM whose host swap is limited.  Docker limits the swap of
+// containers itself.
+const instanceCgroups = "ciao"
+
+func instanceCgroup(instance string) string {
+	return path.Join(sysFsCgroup, instanceCgroups, instance)
+}
+
+// limitSwap moves the process pid running instance to a cgroup of its own,
+// which may use at most swapMaxMB of host swap.
+func limitSwap(instance string, pid, swapMaxMB int) error {
+	parent := path.Join(sysFsCgroup, instanceCgroups)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("Unable to create cgroup %s: %v", parent, err)
+	}
+
+	for _, dir := range []string{sysFsCgroup, parent} {
+		control := path.Join(dir, "cgroup.subtree_control")
+		if err := ioutil.WriteFile(control, []byte("+memory"), 0644); err != nil {
+			return fmt.Errorf("Unable to enable the memory controller in %s: %v", dir, err)
+		}
+	}
+
+	group := instanceCgroup(instance)
+	if err := os.MkdirAll(group, 0755); err != nil {
+		return fmt.Errorf("Unable to create cgroup %s: %v", group, err)
+	}
+
+	swapMax := strconv.FormatInt(int64(swapMaxMB)<<20, 10)
+	if err := ioutil.WriteFile(path.Join(group, "memory.swap.max"), []byte(swapMax), 0644); err != nil {
+		return fmt.Errorf("Unable to limit the swap of %s: %v", instance, err)
+	}
+
+	if err := ioutil.WriteFile(path.Join(group, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644); err != nil {
+		return fmt.Errorf("Unable to move %d to cgroup %s: %v", pid, group, err)
+	}
+
+	return nil
+}
+
+// removeSwapLimit removes the cgroup of an instance whose VM exited.
+func removeSwapLimit(instance string) {
+	_ = os.Remove(instanceCgroup(instance))
+}
@@ -0,0 +1,57 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestLimitSwap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	oldSysFsCgroup := sysFsCgroup
+	sysFsCgroup = dir
+	defer func() { sysFsCgroup = oldSysFsCgroup }()
+
+	const instance = "67d86208-b46c-4465-9018-fe14087d415f"
+	if err := limitSwap(instance, 4242, 256); err != nil {
+		t.Fatalf("Unable to limit swap: %v", err)
+	}
+
+	for file, expected := range map[string]string{
+		"cgroup.subtree_control":                       "+memory",
+		"ciao/cgroup.subtree_control":                  "+memory",
+		path.Join("ciao", instance, "memory.swap.max"): "268435456",
+		path.Join("ciao", instance, "cgroup.procs"):    "4242",
+	} {
+		b, err := ioutil.ReadFile(path.Join(dir, file))
+		if err != nil {
+			t.Errorf("Unable to read %s: %v", file, err)
+			continue
+		}
+		if string(b) != expected {
+			t.Errorf("Expected %s in %s, got %s", expected, file, b)
+		}
+	}
+}
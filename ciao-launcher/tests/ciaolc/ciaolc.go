@@ -263,6 +263,9 @@ func stats(host string) error {
 	fmt.Fprintf(w, "DiskAvailable:\t %d MB\n", stats.DiskAvailableMB)
 	fmt.Fprintf(w, "Load:\t %d\n", stats.Load)
 	fmt.Fprintf(w, "CpusOnline:\t %d\n", stats.CpusOnline)
+	fmt.Fprintf(w, "VCPUsAllocated:\t %d\n", stats.VCPUsAllocated)
+	fmt.Fprintf(w, "CPUPressure:\t %.2f\n", stats.CPUPressure)
+	fmt.Fprintf(w, "MemPressure:\t %.2f\n", stats.MemPressure)
 	fmt.Fprintf(w, "NodeHostName:\t %s\n", stats.NodeHostName)
 	if len(stats.Networks) == 1 {
 		fmt.Fprintf(w, "NodeIP:\t %s\n", stats.Networks[0].NodeIP)
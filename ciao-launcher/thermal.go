@@ -0,0 +1,136 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sysClassPowercap = "/sys/class/powercap"
+var sysClassHwmon = "/sys/class/hwmon"
+
+// raplPackageRegexp matches the RAPL zones of the CPU packages, and not
+// their core, uncore and dram subzones.
+var raplPackageRegexp = regexp.MustCompile(`^intel-rapl:\d+$`)
+
+// cpuSensorDrivers are the hwmon drivers reporting CPU temperatures.
+var cpuSensorDrivers = map[string]bool{
+	"coretemp":    true,
+	"k10temp":     true,
+	"zenpower":    true,
+	"cpu_thermal": true,
+}
+
+// powerMeter derives the power drawn by the CPU packages from the
+// increase of their RAPL energy counters between two samples.
+type powerMeter struct {
+	sync.Mutex
+	energyUJ map[string]uint64
+	stamp    time.Time
+}
+
+var cpuPower powerMeter
+
+func readSysfsUint(p string) (uint64, error) {
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// sample returns the power drawn, in watts, since the previous sample, or -1
+// if it is not known, e.g. on the first sample or without RAPL support.
+func (m *powerMeter) sample(now time.Time) int {
+	m.Lock()
+	defer m.Unlock()
+
+	zones, _ := ioutil.ReadDir(sysClassPowercap)
+	energy := make(map[string]uint64)
+	var consumed uint64
+	for _, z := range zones {
+		if !raplPackageRegexp.MatchString(z.Name()) {
+			continue
+		}
+
+		uj, err := readSysfsUint(path.Join(sysClassPowercap, z.Name(), "energy_uj"))
+		if err != nil {
+			continue
+		}
+		energy[z.Name()] = uj
+
+		last, ok := m.energyUJ[z.Name()]
+		if !ok {
+			continue
+		}
+		if uj < last {
+			// The counter wrapped around
+			max, err := readSysfsUint(path.Join(sysClassPowercap, z.Name(), "max_energy_range_uj"))
+			if err != nil {
+				continue
+			}
+			uj += max
+		}
+		consumed += uj - last
+	}
+
+	elapsed := now.Sub(m.stamp)
+	known := len(energy) > 0 && len(energy) == len(m.energyUJ) && elapsed > 0
+	m.energyUJ = energy
+	m.stamp = now
+	if !known {
+		return -1
+	}
+
+	return int(float64(consumed) / 1e6 / elapsed.Seconds())
+}
+
+// getCPUTemperature returns the temperature of the hottest CPU sensor in
+// degrees Celsius, or -1 if no CPU sensor is found.
+func getCPUTemperature() int {
+	temperature := -1
+
+	sensors, _ := ioutil.ReadDir(sysClassHwmon)
+	for _, s := range sensors {
+		dir := path.Join(sysClassHwmon, s.Name())
+		name, err := ioutil.ReadFile(path.Join(dir, "name"))
+		if err != nil || !cpuSensorDrivers[strings.TrimSpace(string(name))] {
+			continue
+		}
+
+		inputs, _ := filepath.Glob(path.Join(dir, "temp*_input"))
+		for _, input := range inputs {
+			milli, err := readSysfsUint(input)
+			if err != nil {
+				continue
+			}
+			if t := int(milli / 1000); t > temperature {
+				temperature = t
+			}
+		}
+	}
+
+	return temperature
+}
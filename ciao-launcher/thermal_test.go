@@ -0,0 +1,106 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func writeSysfsFiles(t *testing.T, dir string, files map[string]string) {
+	for name, v := range files {
+		p := path.Join(dir, name)
+		if err := os.MkdirAll(path.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(v+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPowerMeter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-powercap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	oldSysClassPowercap := sysClassPowercap
+	sysClassPowercap = dir
+	defer func() { sysClassPowercap = oldSysClassPowercap }()
+
+	var m powerMeter
+	now := time.Now()
+
+	if w := m.sample(now); w != -1 {
+		t.Errorf("Expected unknown power without RAPL, got %d", w)
+	}
+
+	writeSysfsFiles(t, dir, map[string]string{
+		"intel-rapl:0/energy_uj":             "1000000",
+		"intel-rapl:0/max_energy_range_uj":   "10000000",
+		"intel-rapl:1/energy_uj":             "5000000",
+		"intel-rapl:0:0/energy_uj":           "999999999",
+		"intel-rapl:1/max_energy_range_uj":   "10000000",
+		"intel-rapl:0:0/max_energy_range_uj": "999999999",
+	})
+	if w := m.sample(now); w != -1 {
+		t.Errorf("Expected unknown power on first sample, got %d", w)
+	}
+
+	// 40 J drawn by the first package and, with a wrap around, 6 J by
+	// the second one, the core subzone being ignored
+	writeSysfsFiles(t, dir, map[string]string{
+		"intel-rapl:0/energy_uj":   "41000000",
+		"intel-rapl:1/energy_uj":   "1000000",
+		"intel-rapl:0:0/energy_uj": "0",
+	})
+	if w := m.sample(now.Add(2 * time.Second)); w != 23 {
+		t.Errorf("Expected 23 W, got %d", w)
+	}
+}
+
+func TestCPUTemperature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "launcher-hwmon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	oldSysClassHwmon := sysClassHwmon
+	sysClassHwmon = dir
+	defer func() { sysClassHwmon = oldSysClassHwmon }()
+
+	if c := getCPUTemperature(); c != -1 {
+		t.Errorf("Expected unknown temperature without sensors, got %d", c)
+	}
+
+	writeSysfsFiles(t, dir, map[string]string{
+		"hwmon0/name":        "acpitz",
+		"hwmon0/temp1_input": "95000",
+		"hwmon1/name":        "coretemp",
+		"hwmon1/temp1_input": "64000",
+		"hwmon1/temp2_input": "71500",
+	})
+	if c := getCPUTemperature(); c != 71 {
+		t.Errorf("Expected 71 C, got %d", c)
+	}
+}
@@ -19,6 +19,8 @@ package main
 import (
 	"errors"
 	"sync"
+
+	"github.com/01org/ciao/payloads"
 )
 
 const (
@@ -27,6 +29,9 @@ const (
 )
 
 var errImageNotFound = errors.New("Image Not Found")
+var errBalloonNotSupported = errors.New("Memory ballooning not supported")
+var errConsoleNotSupported = errors.New("Interactive consoles not supported")
+var errMigrationNotSupported = errors.New("Live migration not supported")
 
 //BUG(markus): These methods need to be cancellable
 //BUG(markus): How do we deal with locally cached images getting stale?
@@ -101,7 +106,10 @@ type virtualizer interface {
 	// Returns current statistics for the instance.
 	// disk: Size of the VM/container rootfs in GB or -1 if not known.
 	// memory: Amount of memory used by the VM or container process, in MB
-	// cpu: Normalized CPU time of VM or container process
+	// cpu: CPU time consumed by the VM or container since the previous call
+	//      to stats, as a percentage of a single host CPU.  Values greater
+	//      than 100 are possible for instances with more than one vCPU.  The
+	//      overseer normalizes this value for the instance's vCPUs.
 	stats() (disk, memory, cpu int)
 
 	// connected is called by the instance go routine to inform the virtualizer that
@@ -123,4 +131,54 @@ type virtualizer interface {
 	// The instance go routine then calls lostVM so that the virtualizer can update
 	// its internal state.
 	lostVM()
+
+	// Returns a function that can be called from any go routine to determine
+	// whether a running instance is ready to be used, e.g., whether its guest
+	// agent is answering.  The function should not block for more than a
+	// second or so.  A nil return value indicates that the instance is ready
+	// as soon as it's running.
+	readinessProbe() func() bool
+
+	// Returns a function that can be called from any go routine to check
+	// the health of a ready instance.  The function is called periodically
+	// by a single go routine and may block for as long as the timeout of
+	// the instance's health check.  A nil return value indicates that the
+	// virtualizer does not check the health of its instances.
+	healthProbe() func() healthReport
+
+	// Returns a function that can be called from any go routine to follow
+	// the console log of a running VM, or the output of a running
+	// container.  A nil return value indicates that the instance has no
+	// logs to follow.
+	logFollower() logFollower
+
+	// Returns the usage of the filesystems mounted inside a running instance,
+	// or nil if this information is not available.
+	guestFilesystems() []payloads.GuestFilesystemStat
+
+	// Inflates or deflates the memory balloon of a running instance so that
+	// its guest is left with targetMB of memory.  Virtualizers that cannot
+	// balloon their instances return errBalloonNotSupported.
+	setBalloon(targetMB int) error
+
+	// Returns the path of a unix socket connected to the serial console of a
+	// running instance.  Virtualizers that do not provide interactive
+	// consoles return errConsoleNotSupported.
+	console() (string, error)
+
+	// Starts migrating a running instance to the hypervisor listening on
+	// uri, e.g., tcp:host:port.  The migration continues in the background
+	// and the instance is left paused once it completes.  The instance's
+	// disks are not copied and so must be reachable from the destination.
+	// Virtualizers that cannot migrate their instances return
+	// errMigrationNotSupported.
+	migrate(uri string) error
+
+	// Returns a function that can be called from any go routine to copy
+	// virtualizer specific debugging information, e.g., the hypervisor and
+	// console logs and, if memoryDump is true, a dump of the guest's
+	// memory, into the directory dir.  The function may take a long time
+	// to complete.  A nil return value indicates that the virtualizer has
+	// nothing to contribute.
+	diagnostics(memoryDump bool) func(dir string) error
 }
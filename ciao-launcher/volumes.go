@@ -0,0 +1,175 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"golang.org/x/net/context"
+)
+
+const (
+	volumeTenantLabel     = "ciao.tenant"
+	volumePersistentLabel = "ciao.persistent"
+)
+
+var volumeNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// pathListFlag collects a comma separated list of absolute paths.
+type pathListFlag []string
+
+func (f *pathListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *pathListFlag) Set(val string) error {
+	for _, p := range strings.Split(val, ",") {
+		if p == "" {
+			continue
+		}
+		if !path.IsAbs(p) {
+			return fmt.Errorf("%s is not an absolute path", p)
+		}
+		*f = append(*f, path.Clean(p))
+	}
+	return nil
+}
+
+// bindMountDirs are the host directories under which docker instances may
+// bind mount directories.  No bind mounts are allowed if it is empty.
+var bindMountDirs pathListFlag
+
+func bindMountAllowed(hostPath string) bool {
+	hostPath = path.Clean(hostPath)
+	for _, dir := range bindMountDirs {
+		if hostPath == dir || strings.HasPrefix(hostPath, dir+"/") || dir == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkVolumes checks that the named volumes have valid names, that the bind
+// mounts are of allowed host directories, and that no two volumes are
+// mounted at the same place.
+func checkVolumes(volumes []payloads.ContainerVolume) error {
+	mountPoints := make(map[string]bool)
+	for _, v := range volumes {
+		if v.Name != "" && !volumeNameRegexp.MatchString(v.Name) {
+			return fmt.Errorf("Invalid volume name: %s", v.Name)
+		}
+
+		if v.HostPath != "" && !bindMountAllowed(v.HostPath) {
+			return fmt.Errorf("Bind mounts of %s are not allowed", v.HostPath)
+		}
+
+		mountPoint := path.Clean(v.MountPoint)
+		if mountPoint == "/" || mountPoints[mountPoint] {
+			return fmt.Errorf("Invalid mount point: %s", v.MountPoint)
+		}
+		mountPoints[mountPoint] = true
+	}
+
+	return nil
+}
+
+// volumesSizeMB returns the disk space, in MB, used by the named volumes.
+func volumesSizeMB(volumes []payloads.ContainerVolume) int {
+	size := 0
+	for _, v := range volumes {
+		size += v.SizeMB
+	}
+	return size
+}
+
+// allocatedDiskMB returns the disk space, in MB, allocated to the instance,
+// including the space of its named volumes.
+func (cfg *vmConfig) allocatedDiskMB() int {
+	return cfg.Disk + volumesSizeMB(cfg.Volumes)
+}
+
+// dockerVolumeName returns the name of the docker volume backing a named
+// volume of a tenant.  Tenants cannot mount each other's volumes as their
+// UUIDs are part of the names.
+func dockerVolumeName(tenant, name string) string {
+	return "ciao-" + tenant + "-" + name
+}
+
+// volumeBinds returns the docker bindings of the volumes of the instance.
+func (d *docker) volumeBinds() []string {
+	binds := make([]string, 0, len(d.cfg.Volumes))
+	for _, v := range d.cfg.Volumes {
+		src := v.HostPath
+		if v.Name != "" {
+			src = dockerVolumeName(d.cfg.TennantUUID, v.Name)
+		}
+		bind := src + ":" + path.Clean(v.MountPoint)
+		if v.ReadOnly {
+			bind += ":ro"
+		}
+		binds = append(binds, bind)
+	}
+	return binds
+}
+
+// createVolumes creates the named volumes of the instance that do not
+// already exist, e.g., persistent volumes kept from an earlier instance.
+func (d *docker) createVolumes(cli *client.Client) error {
+	for _, v := range d.cfg.Volumes {
+		if v.Name == "" {
+			continue
+		}
+
+		_, err := cli.VolumeCreate(context.Background(), types.VolumeCreateRequest{
+			Name: dockerVolumeName(d.cfg.TennantUUID, v.Name),
+			Labels: map[string]string{
+				volumeTenantLabel:     d.cfg.TennantUUID,
+				volumePersistentLabel: strconv.FormatBool(v.Persistent),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("Unable to create volume %s: %v", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// removeVolumes removes the named volumes of the instance that are not
+// persistent.  Volumes still mounted by other instances of the tenant are
+// left alone.
+func (d *docker) removeVolumes(cli *client.Client) {
+	for _, v := range d.cfg.Volumes {
+		if v.Name == "" || v.Persistent {
+			continue
+		}
+
+		name := dockerVolumeName(d.cfg.TennantUUID, v.Name)
+		if err := cli.VolumeRemove(context.Background(), name); err != nil {
+			clog.Warningf("Unable to remove volume %s of instance %s: %v",
+				name, d.cfg.Instance, err)
+		}
+	}
+}
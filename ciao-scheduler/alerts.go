@@ -0,0 +1,290 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+// The critical conditions the scheduler sends alerts for.
+const (
+	alertClusterFull    = "cluster_full"
+	alertNodeLost       = "node_lost"
+	alertControllerLost = "controller_lost"
+	alertStartFailures  = "start_failures"
+	alertLatency        = "command_latency"
+	alertPublicIPPool   = "public_ip_pool_exhausted"
+	alertClockSkew      = "clock_skew"
+)
+
+// alertQueueLength is the number of alerts waiting to be posted beyond
+// which new alerts are dropped, so that an unreachable webhook does not
+// hold up the scheduler.
+const alertQueueLength = 64
+
+// alertTimeout is the time after which posting an alert is abandoned.
+const alertTimeout = 10 * time.Second
+
+// alert is the JSON document posted to the webhook.
+type alert struct {
+	Time           string `json:"time"`
+	Scheduler      string `json:"scheduler"`
+	Event          string `json:"event"`
+	Severity       string `json:"severity"`
+	Message        string `json:"message"`
+	NodeUUID       string `json:"node_uuid,omitempty"`
+	ControllerUUID string `json:"controller_uuid,omitempty"`
+	InstanceUUID   string `json:"instance_uuid,omitempty"`
+	Reason         string `json:"reason,omitempty"`
+	Count          int    `json:"count,omitempty"`
+	Command        string `json:"command,omitempty"`
+	Concentrator   string `json:"concentrator_uuid,omitempty"`
+	OffsetMS       int64  `json:"offset_ms,omitempty"`
+}
+
+// alertNotifier posts alerts for the critical conditions of the cluster to
+// a webhook.  The same alert is not posted again until cooldown has
+// elapsed.  A nil alertNotifier sends no alert.
+type alertNotifier struct {
+	url              string
+	client           *http.Client
+	hostname         string
+	cooldown         time.Duration
+	failureThreshold int
+	failureWindow    time.Duration
+	alerts           chan *alert
+
+	mutex    sync.Mutex
+	lastSent map[string]time.Time
+	failures map[string][]time.Time
+}
+
+// newAlertNotifier returns a notifier posting to url.  A start failures
+// alert is sent when a node reports failureThreshold start failures within
+// failureWindow.
+func newAlertNotifier(url string, cooldown time.Duration, failureThreshold int, failureWindow time.Duration) *alertNotifier {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	n := &alertNotifier{
+		url:              url,
+		client:           &http.Client{Timeout: alertTimeout},
+		hostname:         hostname,
+		cooldown:         cooldown,
+		failureThreshold: failureThreshold,
+		failureWindow:    failureWindow,
+		alerts:           make(chan *alert, alertQueueLength),
+		lastSent:         make(map[string]time.Time),
+		failures:         make(map[string][]time.Time),
+	}
+
+	go n.post()
+
+	return n
+}
+
+func (n *alertNotifier) post() {
+	for a := range n.alerts {
+		data, err := json.Marshal(a)
+		if err != nil {
+			clog.Errorf("Unable to marshal %s alert: %v", a.Event, err)
+			continue
+		}
+
+		resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			clog.Warningf("Unable to post %s alert: %v", a.Event, err)
+			continue
+		}
+		_ = resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			clog.Warningf("Webhook refused %s alert: %s", a.Event, resp.Status)
+		}
+	}
+}
+
+// notify queues a for posting unless an alert with the same key was
+// posted less than cooldown ago.
+func (n *alertNotifier) notify(key string, a *alert) {
+	now := time.Now()
+
+	n.mutex.Lock()
+	if last, ok := n.lastSent[key]; ok && now.Sub(last) < n.cooldown {
+		n.mutex.Unlock()
+		return
+	}
+	n.lastSent[key] = now
+	n.mutex.Unlock()
+
+	a.Time = now.UTC().Format(time.RFC3339)
+	a.Scheduler = n.hostname
+	if a.Severity == "" {
+		a.Severity = "critical"
+	}
+
+	clog.WithFields(clog.Fields{
+		clog.NodeUUID:     a.NodeUUID,
+		clog.InstanceUUID: a.InstanceUUID,
+		"alert":           a.Event,
+	}).Warningf("Alert: %s", a.Message)
+
+	select {
+	case n.alerts <- a:
+	default:
+		clog.Warningf("Too many pending alerts, dropping %s alert", a.Event)
+	}
+}
+
+// clusterFull alerts that an instance could not be placed because no node
+// has the resources it needs.
+func (n *alertNotifier) clusterFull(instanceUUID string) {
+	if n == nil {
+		return
+	}
+
+	n.notify(alertClusterFull, &alert{
+		Event:        alertClusterFull,
+		Message:      fmt.Sprintf("Cluster full, unable to place instance %s", instanceUUID),
+		InstanceUUID: instanceUUID,
+		Reason:       string(payloads.FullCloud),
+	})
+}
+
+// nodeLost alerts that a compute or network node disconnected.
+func (n *alertNotifier) nodeLost(nodeUUID string, nodeType payloads.Resource) {
+	if n == nil {
+		return
+	}
+
+	n.mutex.Lock()
+	delete(n.failures, nodeUUID)
+	n.mutex.Unlock()
+
+	n.notify(alertNodeLost+nodeUUID, &alert{
+		Event:    alertNodeLost,
+		Message:  fmt.Sprintf("Lost node %s (%s)", nodeUUID, nodeType),
+		NodeUUID: nodeUUID,
+	})
+}
+
+// controllerLost alerts that a controller disconnected.
+func (n *alertNotifier) controllerLost(controllerUUID string, status controllerStatus) {
+	if n == nil {
+		return
+	}
+
+	n.notify(alertControllerLost+controllerUUID, &alert{
+		Event:          alertControllerLost,
+		Message:        fmt.Sprintf("Lost %s controller %s", status, controllerUUID),
+		ControllerUUID: controllerUUID,
+	})
+}
+
+// startFailure records a start failure reported by a node and alerts when
+// the node has reported failureThreshold of them within failureWindow.
+func (n *alertNotifier) startFailure(nodeUUID string, failure *payloads.ErrorStartFailure) {
+	if n == nil || n.failureThreshold <= 0 {
+		return
+	}
+
+	now := time.Now()
+
+	n.mutex.Lock()
+	failures := n.failures[nodeUUID]
+	for len(failures) > 0 && now.Sub(failures[0]) > n.failureWindow {
+		failures = failures[1:]
+	}
+	failures = append(failures, now)
+	n.failures[nodeUUID] = failures
+	count := len(failures)
+	n.mutex.Unlock()
+
+	if count < n.failureThreshold {
+		return
+	}
+
+	n.notify(alertStartFailures+nodeUUID, &alert{
+		Event: alertStartFailures,
+		Message: fmt.Sprintf("Node %s failed to start %d instances in %s", nodeUUID,
+			count, n.failureWindow),
+		NodeUUID:     nodeUUID,
+		InstanceUUID: failure.InstanceUUID,
+		Reason:       string(failure.Reason),
+		Count:        count,
+	})
+}
+
+// commandLatency warns that the 99th percentile of the processing times of
+// a command type exceeds the SLO.
+func (n *alertNotifier) commandLatency(command string, p99, slo time.Duration) {
+	if n == nil {
+		return
+	}
+
+	n.notify(alertLatency+command, &alert{
+		Event:    alertLatency,
+		Severity: "warning",
+		Message:  fmt.Sprintf("%s commands p99 latency %s exceeds SLO %s", command, p99, slo),
+		Command:  command,
+	})
+}
+
+// publicIPPoolExhausted alerts that a public IP could not be assigned to an
+// instance because the pool of its concentrator is exhausted.
+func (n *alertNotifier) publicIPPoolExhausted(concentratorUUID, instanceUUID string, size int) {
+	if n == nil {
+		return
+	}
+
+	n.notify(alertPublicIPPool+concentratorUUID, &alert{
+		Event: alertPublicIPPool,
+		Message: fmt.Sprintf("Public IP pool of concentrator %s exhausted, all %d addresses assigned",
+			concentratorUUID, size),
+		InstanceUUID: instanceUUID,
+		Concentrator: concentratorUUID,
+		Count:        size,
+	})
+}
+
+// clockSkew warns that the clock of a node is off the scheduler one by more
+// than threshold.
+func (n *alertNotifier) clockSkew(nodeUUID string, offset, threshold time.Duration) {
+	if n == nil {
+		return
+	}
+
+	n.notify(alertClockSkew+nodeUUID, &alert{
+		Event:    alertClockSkew,
+		Severity: "warning",
+		Message: fmt.Sprintf("Clock of node %s is off by %s, more than %s", nodeUUID,
+			offset, threshold),
+		NodeUUID: nodeUUID,
+		OffsetMS: int64(offset / time.Millisecond),
+	})
+}
@@ -0,0 +1,349 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/ssntp"
+)
+
+// The security relevant actions the scheduler audits.
+const (
+	auditConnect    = "connect"
+	auditDisconnect = "disconnect"
+	auditCommand    = "command"
+	auditPlacement  = "placement"
+	auditDenial     = "denial"
+)
+
+// auditQueueLength is the number of audit records waiting to be written
+// beyond which new records are dropped, so that an unreachable sink does
+// not hold up the scheduler.
+const auditQueueLength = 1024
+
+// auditBatchSize is the maximum number of records written at once.
+const auditBatchSize = 100
+
+// auditTimeout is the time after which writing records to Kafka is
+// abandoned.
+const auditTimeout = 10 * time.Second
+
+// auditRecord is a structured audit record.  The actor is the SSNTP client
+// that connected, sent the command or was denied.
+type auditRecord struct {
+	Time         time.Time `json:"time"`
+	Scheduler    string    `json:"scheduler"`
+	Action       string    `json:"action"`
+	ActorUUID    string    `json:"actor_uuid"`
+	ActorRole    string    `json:"actor_role,omitempty"`
+	Command      string    `json:"command,omitempty"`
+	InstanceUUID string    `json:"instance_uuid,omitempty"`
+	TenantUUID   string    `json:"tenant_uuid,omitempty"`
+	NodeUUID     string    `json:"node_uuid,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+}
+
+// auditSink writes audit records to an external system.
+type auditSink interface {
+	write(records []*auditRecord) error
+}
+
+// cefEscaper escapes the values of CEF extensions.
+var cefEscaper = strings.NewReplacer(`\`, `\\`, "=", `\=`, "\n", `\n`, "\r", `\r`)
+
+// cef formats r as a Common Event Format message.  Denials have a high
+// severity, the other actions a low one.
+func (r *auditRecord) cef() string {
+	severity := 3
+	if r.Action == auditDenial {
+		severity = 8
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "CEF:0|Intel|ciao-scheduler|1|%s|%s|%d|", r.Action, r.Action, severity)
+
+	ext := []struct {
+		key   string
+		value string
+	}{
+		{"rt", fmt.Sprintf("%d", r.Time.UnixNano()/int64(time.Millisecond))},
+		{"dvchost", r.Scheduler},
+		{"suser", r.ActorUUID},
+		{"spriv", r.ActorRole},
+		{"act", r.Command},
+		{"cs1Label", "instanceUUID"},
+		{"cs1", r.InstanceUUID},
+		{"cs2Label", "tenantUUID"},
+		{"cs2", r.TenantUUID},
+		{"cs3Label", "nodeUUID"},
+		{"cs3", r.NodeUUID},
+		{"reason", r.Reason},
+	}
+
+	sep := ""
+	for i, e := range ext {
+		if e.value == "" || (strings.HasSuffix(e.key, "Label") && ext[i+1].value == "") {
+			continue
+		}
+		fmt.Fprintf(&b, "%s%s=%s", sep, e.key, cefEscaper.Replace(e.value))
+		sep = " "
+	}
+
+	return b.String()
+}
+
+// syslogSink writes audit records to syslog in CEF.
+type syslogSink struct {
+	writer *syslog.Writer
+}
+
+// newSyslogSink connects to the local syslog daemon if address is "local",
+// or to the remote one at address, e.g., udp://siem.example.com:514.
+func newSyslogSink(address string) (*syslogSink, error) {
+	var network, raddr string
+	if address != "local" {
+		u, err := url.Parse(address)
+		if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid syslog address %s, local, udp://host:port or tcp://host:port expected", address)
+		}
+		network, raddr = u.Scheme, u.Host
+	}
+
+	writer, err := syslog.Dial(network, raddr, syslog.LOG_AUTH|syslog.LOG_INFO, "ciao-scheduler")
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogSink{writer: writer}, nil
+}
+
+func (s *syslogSink) write(records []*auditRecord) error {
+	for _, r := range records {
+		var err error
+		if r.Action == auditDenial {
+			err = s.writer.Warning(r.cef())
+		} else {
+			err = s.writer.Info(r.cef())
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// kafkaSink produces audit records, as JSON, to a Kafka topic through a
+// Kafka REST proxy.  The records are keyed by actor, so that the records of
+// an actor stay in order.
+type kafkaSink struct {
+	url    string
+	client *http.Client
+}
+
+func newKafkaSink(proxy, topic string) *kafkaSink {
+	return &kafkaSink{
+		url:    strings.TrimSuffix(proxy, "/") + "/topics/" + url.PathEscape(topic),
+		client: &http.Client{Timeout: auditTimeout},
+	}
+}
+
+type kafkaRecord struct {
+	Key   string       `json:"key"`
+	Value *auditRecord `json:"value"`
+}
+
+func (k *kafkaSink) write(records []*auditRecord) error {
+	batch := struct {
+		Records []kafkaRecord `json:"records"`
+	}{make([]kafkaRecord, len(records))}
+	for i, r := range records {
+		batch.Records[i] = kafkaRecord{Key: r.ActorUUID, Value: r}
+	}
+
+	data, err := json.Marshal(&batch)
+	if err != nil {
+		return err
+	}
+
+	resp, err := k.client.Post(k.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Kafka REST proxy refused records: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// auditLogger emits audit records of the connections, the controller
+// commands, the placements and the authorization denials to its sinks.
+// Records are written in order by a single go routine.  A nil auditLogger
+// audits nothing.
+type auditLogger struct {
+	hostname string
+	sinks    []auditSink
+	records  chan *auditRecord
+}
+
+func newAuditLogger(sinks ...auditSink) *auditLogger {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+
+	a := &auditLogger{
+		hostname: hostname,
+		sinks:    sinks,
+		records:  make(chan *auditRecord, auditQueueLength),
+	}
+
+	go a.run()
+
+	return a
+}
+
+func (a *auditLogger) run() {
+	for r := range a.records {
+		batch := []*auditRecord{r}
+	drain:
+		for len(batch) < auditBatchSize {
+			select {
+			case r, ok := <-a.records:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, r)
+			default:
+				break drain
+			}
+		}
+
+		for _, sink := range a.sinks {
+			if err := sink.write(batch); err != nil {
+				clog.Warningf("Unable to write %d audit records: %v\n", len(batch), err)
+			}
+		}
+	}
+}
+
+func (a *auditLogger) emit(r *auditRecord) {
+	if a == nil {
+		return
+	}
+
+	r.Time = time.Now().UTC()
+	r.Scheduler = a.hostname
+
+	select {
+	case a.records <- r:
+	default:
+		clog.Errorf("Audit queue full, dropping %s record of %s\n", r.Action, r.ActorUUID)
+	}
+}
+
+// errFrameNotAuthorized is the reason of the denial of the frames a client
+// is not authorized to send given its role.
+var errFrameNotAuthorized = errors.New("frame not authorized")
+
+// frameOperand describes the type and operand of a frame, e.g., COMMAND START.
+func frameOperand(frame *ssntp.Frame) string {
+	var op string
+
+	switch frame.Type {
+	case ssntp.COMMAND:
+		op = ssntp.Command(frame.Operand).String()
+	case ssntp.STATUS:
+		op = ssntp.Status(frame.Operand).String()
+	case ssntp.EVENT:
+		op = ssntp.Event(frame.Operand).String()
+	case ssntp.ERROR:
+		op = ssntp.Error(frame.Operand).String()
+	}
+
+	if op == "" {
+		op = fmt.Sprintf("%d", frame.Operand)
+	}
+
+	return frame.Type.String() + " " + op
+}
+
+func roleName(role uint32) string {
+	r := ssntp.Role(role)
+	return r.String()
+}
+
+// connection audits the connection or disconnection of a client.
+func (a *auditLogger) connection(uuid string, role uint32, connected bool) {
+	action := auditDisconnect
+	if connected {
+		action = auditConnect
+	}
+
+	a.emit(&auditRecord{Action: action, ActorUUID: uuid, ActorRole: roleName(role)})
+}
+
+// command audits a command the controller sent for tenant.
+func (a *auditLogger) command(controller string, command ssntp.Command, instance, tenant string) {
+	a.emit(&auditRecord{
+		Action:       auditCommand,
+		ActorUUID:    controller,
+		ActorRole:    roleName(ssntp.Controller),
+		Command:      command.String(),
+		InstanceUUID: instance,
+		TenantUUID:   tenant,
+	})
+}
+
+// placement audits the placement of an instance started by controller.
+func (a *auditLogger) placement(controller, instance, tenant, node string) {
+	a.emit(&auditRecord{
+		Action:       auditPlacement,
+		ActorUUID:    controller,
+		ActorRole:    roleName(ssntp.Controller),
+		Command:      ssntp.START.String(),
+		InstanceUUID: instance,
+		TenantUUID:   tenant,
+		NodeUUID:     node,
+	})
+}
+
+// denial audits a frame the client was not allowed to send.
+func (a *auditLogger) denial(uuid string, role uint32, operand, tenant string, reason error) {
+	a.emit(&auditRecord{
+		Action:     auditDenial,
+		ActorUUID:  uuid,
+		ActorRole:  roleName(role),
+		Command:    operand,
+		TenantUUID: tenant,
+		Reason:     reason.Error(),
+	})
+}
@@ -0,0 +1,351 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultBackfillHeadroom is the percentage of the memory of a compute node
+// that must stay free after placing a backfill instance on it.
+const defaultBackfillHeadroom = 50
+
+// backfillInstance is a backfill instance running on a compute node, or
+// preempted and waiting to be placed again.
+type backfillInstance struct {
+	controller string
+	work       *payloads.Start
+	workload   workResources
+	// node the instance runs on, empty while it is queued
+	node   string
+	placed time.Time
+	// node the instance was preempted from, until that node reports
+	// it deleted
+	evicted string
+}
+
+// backfillFits returns false if the workload is a backfill instance that
+// would leave less than the backfill headroom free on the referenced,
+// locked nodeStat object.
+func (sched *ssntpSchedulerServer) backfillFits(node *nodeStat, workload *workResources) bool {
+	if workload.start == nil || !workload.start.Backfill {
+		return true
+	}
+
+	free := node.memAvailMB - workload.memReqMB
+	return free*100 >= node.memTotalMB*sched.backfillHeadroom
+}
+
+// recordBackfill remembers the backfill instance placed on node, so that it
+// can be preempted and placed again later.
+func (sched *ssntpSchedulerServer) recordBackfill(controllerUUID string, work *payloads.Start, workload workResources, node string) {
+	sched.backfillMutex.Lock()
+	defer sched.backfillMutex.Unlock()
+
+	sched.backfill[workload.instanceUUID] = &backfillInstance{
+		controller: controllerUUID,
+		work:       work,
+		workload:   workload,
+		node:       node,
+		placed:     time.Now(),
+	}
+}
+
+// preemptBackfill looks for a compute node the workload fits on once some
+// of its backfill instances are preempted, the most recently placed first.
+// It returns a referenced, locked nodeStat object, with the resources of the
+// preempted instances released, or nil if there is none.  The caller must
+// hold cnMutex.
+func (sched *ssntpSchedulerServer) preemptBackfill(workload *workResources) *nodeStat {
+	if workload.start == nil || workload.start.Backfill {
+		return nil
+	}
+
+	for _, node := range sched.cnList {
+		node.mutex.Lock()
+		victims := sched.pickBackfillVictims(node, workload)
+		if victims == nil {
+			node.mutex.Unlock()
+			continue
+		}
+
+		go sched.evictBackfill(node.uuid, victims)
+		return node
+	}
+
+	return nil
+}
+
+// pickBackfillVictims returns the backfill instances to preempt from the
+// referenced, locked nodeStat object for the workload to fit on it, marked
+// as queued and with their resources released, or nil if preempting them
+// all would not be enough.
+func (sched *ssntpSchedulerServer) pickBackfillVictims(node *nodeStat, workload *workResources) []string {
+	sched.backfillMutex.Lock()
+	defer sched.backfillMutex.Unlock()
+
+	var running []*backfillInstance
+	for _, b := range sched.backfill {
+		if b.node == node.uuid {
+			running = append(running, b)
+		}
+	}
+	if len(running) == 0 {
+		return nil
+	}
+	sort.Slice(running, func(i, j int) bool {
+		return running[i].placed.After(running[j].placed)
+	})
+
+	for i, b := range running {
+		sched.releaseResourceUsage(node, &b.workload)
+		if !sched.workloadFits(node, workload) {
+			continue
+		}
+
+		victims := make([]string, 0, i+1)
+		for _, v := range running[:i+1] {
+			v.node = ""
+			v.evicted = node.uuid
+			victims = append(victims, v.workload.instanceUUID)
+		}
+		return victims
+	}
+
+	for _, b := range running {
+		sched.decrementResourceUsage(node, &b.workload)
+	}
+	return nil
+}
+
+// evictBackfill deletes the preempted backfill instances from node, and
+// tells the controllers that started them that they are pending again.
+func (sched *ssntpSchedulerServer) evictBackfill(node string, victims []string) {
+	for _, instance := range victims {
+		clog.Infof("Preempting backfill instance %s on node %s\n", instance, node)
+		sched.forgetPlacement(instance)
+
+		payload, err := yaml.Marshal(&payloads.Delete{
+			Delete: payloads.StopCmd{
+				InstanceUUID:      instance,
+				WorkloadAgentUUID: node,
+			},
+		})
+		if err != nil {
+			clog.Errorf("Unable to marshal DELETE of instance %s: %v\n", instance, err)
+			continue
+		}
+
+		ctx, cancel := sched.sendContext()
+		_, err = sched.ssntp.SendCommandContext(ctx, node, ssntp.DELETE, payload)
+		cancel()
+		if err != nil {
+			clog.Errorf("Unable to send DELETE of instance %s to node %s: %v\n", instance, node, err)
+		}
+
+		sched.sendOwnerEvent(instance, ssntp.InstanceStateChanged, &payloads.EventInstanceStateChanged{
+			StateChanged: payloads.InstanceStateChangedEvent{
+				InstanceUUID:  instance,
+				NodeUUID:      node,
+				PreviousState: payloads.Running,
+				State:         payloads.Pending,
+			},
+		})
+	}
+}
+
+// sendOwnerEvent sends an event about instance to the controller that
+// started it.
+func (sched *ssntpSchedulerServer) sendOwnerEvent(instance string, event ssntp.Event, payload interface{}) {
+	b, err := yaml.Marshal(payload)
+	if err != nil {
+		clog.Errorf("Unable to marshal %s event of instance %s: %v\n", event, instance, err)
+		return
+	}
+
+	sched.ownerMutex.Lock()
+	owner := sched.owners[instance]
+	sched.ownerMutex.Unlock()
+	if owner == "" {
+		return
+	}
+
+	ctx, cancel := sched.sendContext()
+	defer cancel()
+	if _, err = sched.ssntp.SendEventContext(ctx, owner, event, b); err != nil {
+		clog.Errorf("Unable to send %s of instance %s to controller %s: %v\n", event, instance, owner, err)
+	}
+}
+
+// filterBackfillEvent returns true if the instance event node sent is about
+// a backfill instance preempted from that node, which the controller must
+// not see.  It forgets the backfill instances their node reports deleted.
+func (sched *ssntpSchedulerServer) filterBackfillEvent(node string, event ssntp.Event, payload []byte) bool {
+	instance, err := getEventInstanceUUID(event, payload)
+	if err != nil {
+		return false
+	}
+
+	sched.backfillMutex.Lock()
+	defer sched.backfillMutex.Unlock()
+
+	b := sched.backfill[instance]
+	if b == nil {
+		return false
+	}
+
+	if b.evicted == node {
+		if event == ssntp.InstanceDeleted {
+			b.evicted = ""
+			go sched.placeQueuedBackfill()
+		}
+		return true
+	}
+
+	if event == ssntp.InstanceDeleted && b.node == node {
+		delete(sched.backfill, instance)
+	}
+
+	return false
+}
+
+// deleteBackfill returns the node a DELETE command for a backfill instance
+// must be sent to, which may not be the one the controller knows about if
+// the instance was preempted.  It returns false if the DELETE command must
+// not be sent at all, the instance waiting to be placed again, in which
+// case the instance is forgotten.
+func (sched *ssntpSchedulerServer) deleteBackfill(instance, node string) (string, bool) {
+	sched.backfillMutex.Lock()
+	b := sched.backfill[instance]
+	if b == nil || b.node != "" {
+		sched.backfillMutex.Unlock()
+		if b != nil {
+			node = b.node
+		}
+		return node, true
+	}
+
+	delete(sched.backfill, instance)
+	evicted := b.evicted
+	sched.backfillMutex.Unlock()
+
+	// The InstanceDeleted event of a node still deleting the instance
+	// is no longer filtered, and is the one the controller gets.
+	if evicted == "" {
+		sched.sendOwnerEvent(instance, ssntp.InstanceDeleted, &payloads.EventInstanceDeleted{
+			InstanceDeleted: payloads.InstanceDeletedEvent{InstanceUUID: instance},
+		})
+		sched.forgetOwner(instance)
+	}
+
+	return "", false
+}
+
+// forgetBackfillNode forgets the backfill instances of a departed compute
+// node, and stops waiting for it to delete the ones preempted from it.
+func (sched *ssntpSchedulerServer) forgetBackfillNode(node string) {
+	sched.backfillMutex.Lock()
+	defer sched.backfillMutex.Unlock()
+
+	for instance, b := range sched.backfill {
+		if b.node == node {
+			delete(sched.backfill, instance)
+		} else if b.evicted == node {
+			b.evicted = ""
+		}
+	}
+}
+
+// queuedBackfill returns the preempted backfill instances that are no longer
+// running anywhere, the first preempted first.
+func (sched *ssntpSchedulerServer) queuedBackfill() []*backfillInstance {
+	sched.backfillMutex.Lock()
+	defer sched.backfillMutex.Unlock()
+
+	var queued []*backfillInstance
+	for _, b := range sched.backfill {
+		if b.node == "" && b.evicted == "" {
+			queued = append(queued, b)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		return queued[i].placed.Before(queued[j].placed)
+	})
+
+	return queued
+}
+
+// placeQueuedBackfill places the preempted backfill instances again on the
+// compute nodes that have enough headroom left, and sends them their START
+// commands.
+func (sched *ssntpSchedulerServer) placeQueuedBackfill() {
+	for _, b := range sched.queuedBackfill() {
+		workload := b.workload
+
+		sched.cnMutex.RLock()
+		node := sched.pickListNode(&workload, false)
+		if node == nil {
+			sched.cnMutex.RUnlock()
+			continue
+		}
+
+		sched.backfillMutex.Lock()
+		queued := sched.backfill[workload.instanceUUID] == b && b.node == "" && b.evicted == ""
+		if queued {
+			b.node = node.uuid
+			b.placed = time.Now()
+			sched.decrementResourceUsage(node, &workload)
+		}
+		sched.backfillMutex.Unlock()
+		node.mutex.Unlock()
+		sched.cnMutex.RUnlock()
+
+		if !queued {
+			continue
+		}
+
+		instanceUUID := workload.instanceUUID
+		sched.recordPlacement(instanceUUID, node.uuid, &workload)
+		sched.audit.placement(b.controller, instanceUUID, b.work.Start.TenantUUID, node.uuid)
+		sched.capacity.launched()
+		sched.setOwner(instanceUUID, b.controller)
+		clog.V(2).WithFields(clog.Fields{
+			clog.Command:      ssntp.START.String(),
+			clog.InstanceUUID: instanceUUID,
+			clog.NodeUUID:     node.uuid,
+		}).Infof("Placing preempted backfill instance %s on node %s\n", instanceUUID, node.uuid)
+
+		payload, err := yaml.Marshal(b.work)
+		if err != nil {
+			clog.Errorf("Unable to marshal START of instance %s: %v\n", instanceUUID, err)
+			continue
+		}
+
+		ctx, cancel := sched.sendContext()
+		_, err = sched.ssntp.SendCommandContext(ctx, node.uuid, ssntp.START, payload)
+		cancel()
+		if err != nil {
+			clog.Errorf("Unable to send START of instance %s to node %s: %v\n", instanceUUID, node.uuid, err)
+		}
+	}
+}
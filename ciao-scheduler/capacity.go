@@ -0,0 +1,270 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+// capacitySampleInterval is the interval at which the capacity of the
+// cluster, as reported by the nodes in their READY frames, is sampled.
+const capacitySampleInterval = time.Minute
+
+// capacityHistoryLength is the number of capacity samples kept, a day's
+// worth.
+const capacityHistoryLength = 24 * 60
+
+// defaultForecastWindow is the period over which the launch rate is
+// measured when the capacity request does not give one.
+const defaultForecastWindow = time.Hour
+
+// capacitySample is the state of the compute nodes at a point in time.
+type capacitySample struct {
+	time       time.Time
+	launches   uint64
+	memAvailMB int
+}
+
+// capacityHistory records the number of instances placed and the samples
+// of the cluster capacity the forecasts are based on.
+type capacityHistory struct {
+	sync.Mutex
+	launches uint64
+	samples  []capacitySample
+}
+
+func (h *capacityHistory) launched() {
+	h.Lock()
+	h.launches++
+	h.Unlock()
+}
+
+// nodeCapacity is the number of instances of the requested flavor a node
+// can still take.
+type nodeCapacity struct {
+	UUID string `json:"uuid"`
+	Fits int    `json:"fits"`
+}
+
+// capacityForecast answers a capacity request.  The launch and memory
+// consumption rates are measured over the window, or over the history
+// available if it is shorter.  TimeToFullSeconds is null when no instance
+// was launched during the window.
+type capacityForecast struct {
+	Fits                    int            `json:"fits"`
+	Nodes                   []nodeCapacity `json:"nodes"`
+	Window                  string         `json:"window"`
+	Samples                 int            `json:"samples"`
+	LaunchesPerHour         float64        `json:"launches_per_hour"`
+	MemConsumptionMBPerHour float64        `json:"mem_consumption_mb_per_hour"`
+	TimeToFullSeconds       *float64       `json:"time_to_full_seconds"`
+}
+
+// sampleCapacity records the current capacity of the compute nodes.
+func (sched *ssntpSchedulerServer) sampleCapacity(now time.Time) {
+	sample := capacitySample{time: now}
+
+	sched.cnMutex.RLock()
+	for _, node := range sched.cnList {
+		node.mutex.Lock()
+		if node.status == ssntp.READY {
+			sample.memAvailMB += node.memAvailMB
+		}
+		node.mutex.Unlock()
+	}
+	sched.cnMutex.RUnlock()
+
+	h := &sched.capacity
+	h.Lock()
+	defer h.Unlock()
+
+	sample.launches = h.launches
+	h.samples = append(h.samples, sample)
+	if len(h.samples) > capacityHistoryLength {
+		h.samples = h.samples[len(h.samples)-capacityHistoryLength:]
+	}
+}
+
+// sampleCapacityLoop samples the capacity of the cluster every interval.
+func sampleCapacityLoop(sched *ssntpSchedulerServer, interval time.Duration) {
+	for now := range time.Tick(interval) {
+		sched.sampleCapacity(now)
+	}
+}
+
+// nodeFits returns the number of instances of workload the referenced,
+// locked nodeStat object can still take.
+func (sched *ssntpSchedulerServer) nodeFits(node *nodeStat, workload *workResources) int {
+	if node.status != ssntp.READY || !sched.capabilitiesMatch(node, workload) {
+		return 0
+	}
+
+	fits := node.memAvailMB / workload.memReqMB
+	if workload.networkNode != 0 {
+		if cncis := networkNodeCNCIs(node, workload); cncis >= 0 {
+			fits = cncis
+		}
+	}
+
+	for _, r := range []struct {
+		available int
+		needed    int
+	}{
+		{node.gpusAvail, workload.gpus},
+		{node.coresAvail, workload.cores},
+		{node.diskIOPSAvail, workload.diskIOPS},
+		{node.ingressKbpsAvail, workload.ingressKbps},
+		{node.egressKbpsAvail, workload.egressKbps},
+	} {
+		if r.needed > 0 && r.available >= 0 && r.available/r.needed < fits {
+			fits = r.available / r.needed
+		}
+	}
+
+	if fits < 0 {
+		return 0
+	}
+	return fits
+}
+
+// forecast returns the number of instances of workload the cluster can
+// still take and when it will be full if instances keep being launched at
+// the rate they were during window.
+func (sched *ssntpSchedulerServer) forecast(workload *workResources, window time.Duration, now time.Time) *capacityForecast {
+	f := &capacityForecast{
+		Nodes:  []nodeCapacity{},
+		Window: window.String(),
+	}
+
+	nodes, mutex := sched.cnMap, &sched.cnMutex
+	if workload.networkNode != 0 {
+		nodes, mutex = sched.nnMap, &sched.nnMutex
+	}
+
+	mutex.RLock()
+	for _, node := range nodes {
+		node.mutex.Lock()
+		fits := sched.nodeFits(node, workload)
+		node.mutex.Unlock()
+
+		f.Fits += fits
+		f.Nodes = append(f.Nodes, nodeCapacity{UUID: node.uuid, Fits: fits})
+	}
+	mutex.RUnlock()
+
+	sort.Slice(f.Nodes, func(i, j int) bool { return f.Nodes[i].UUID < f.Nodes[j].UUID })
+
+	h := &sched.capacity
+	h.Lock()
+	var first *capacitySample
+	for i := range h.samples {
+		if now.Sub(h.samples[i].time) <= window {
+			first = &h.samples[i]
+			f.Samples = len(h.samples) - i
+			break
+		}
+	}
+	var last capacitySample
+	if first != nil {
+		last = h.samples[len(h.samples)-1]
+	}
+	launches := h.launches
+	h.Unlock()
+
+	if first == nil {
+		return f
+	}
+
+	if elapsed := now.Sub(first.time).Hours(); elapsed > 0 {
+		f.LaunchesPerHour = float64(launches-first.launches) / elapsed
+	}
+	if elapsed := last.time.Sub(first.time).Hours(); elapsed > 0 {
+		f.MemConsumptionMBPerHour = float64(first.memAvailMB-last.memAvailMB) / elapsed
+	}
+
+	if f.LaunchesPerHour > 0 {
+		seconds := float64(f.Fits) / f.LaunchesPerHour * 3600
+		f.TimeToFullSeconds = &seconds
+	}
+
+	return f
+}
+
+// parseCapacityRequest builds the workload whose capacity is requested from
+// the query parameters of a capacity request.  Each parameter other than
+// vm_type and window is a requested resource, e.g., mem_mb=2048&vcpus=2.
+func (sched *ssntpSchedulerServer) parseCapacityRequest(r *http.Request) (*workResources, time.Duration, error) {
+	var start payloads.Start
+	window := defaultForecastWindow
+
+	for name, values := range r.URL.Query() {
+		value := values[len(values)-1]
+		switch name {
+		case "vm_type":
+			start.Start.VMType = payloads.Hypervisor(value)
+		case "window":
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return nil, 0, fmt.Errorf("Invalid window %s", value)
+			}
+			window = d
+		default:
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 {
+				return nil, 0, fmt.Errorf("Invalid %s %s", name, value)
+			}
+			start.Start.RequestedResources = append(start.Start.RequestedResources,
+				payloads.RequestedResource{Type: payloads.Resource(name), Value: v})
+		}
+	}
+
+	workload := sched.getWorkloadResources(&start)
+	if workload.memReqMB <= 0 {
+		return nil, 0, fmt.Errorf("mem_mb must be given")
+	}
+
+	return &workload, window, nil
+}
+
+// capacityHandler serves the capacity forecasts at /capacity.
+func (sched *ssntpSchedulerServer) capacityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, fmt.Sprintf("%s not allowed", r.Method), http.StatusMethodNotAllowed)
+		return
+	}
+
+	workload, window, err := sched.parseCapacityRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sched.forecast(workload, window, time.Now())); err != nil {
+		clog.Warningf("Unable to encode capacity forecast: %v", err)
+	}
+}
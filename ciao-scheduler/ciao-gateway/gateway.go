@@ -0,0 +1,439 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+// maxRequestSize is the maximum size of the body of a REST request.
+const maxRequestSize = 1 << 20
+
+// tenantTokenHeader is the header carrying the tenant token of the stop and
+// delete requests.
+const tenantTokenHeader = "X-Tenant-Token"
+
+// commandSender sends SSNTP commands to the scheduler.
+type commandSender interface {
+	SendCommand(cmd ssntp.Command, payload []byte) (int, error)
+}
+
+// gatewayNode is a node as reported by GET /nodes.
+type gatewayNode struct {
+	UUID           string            `json:"node_uuid"`
+	Type           payloads.Resource `json:"node_type,omitempty"`
+	Hostname       string            `json:"hostname,omitempty"`
+	Status         string            `json:"status,omitempty"`
+	MemTotalMB     int               `json:"mem_total_mb"`
+	MemAvailableMB int               `json:"mem_available_mb"`
+	CpusOnline     int               `json:"cpus_online"`
+	Load           int               `json:"load"`
+	Instances      int               `json:"instances"`
+}
+
+// gatewayInstance is an instance as reported by GET /instances.
+type gatewayInstance struct {
+	UUID     string `json:"instance_uuid"`
+	NodeUUID string `json:"node_uuid,omitempty"`
+	State    string `json:"state"`
+	Failure  string `json:"failure,omitempty"`
+}
+
+// gateway translates REST calls into the SSNTP commands a controller sends
+// to the scheduler.  It connects to the scheduler with the controller role
+// and learns the nodes and instances of the cluster from the STATS commands
+// and node and instance events forwarded to the controllers, so that it can
+// list the nodes and find the node an instance to stop or delete runs on.
+type gateway struct {
+	scheduler commandSender
+	token     string
+	// connections counts the connections to the scheduler
+	connections int32
+
+	mutex     sync.Mutex
+	nodes     map[string]*gatewayNode
+	instances map[string]*gatewayInstance
+}
+
+func newGateway(scheduler commandSender, token string) *gateway {
+	return &gateway{
+		scheduler: scheduler,
+		token:     token,
+		nodes:     make(map[string]*gatewayNode),
+		instances: make(map[string]*gatewayInstance),
+	}
+}
+
+// ConnectNotify asks the scheduler for the events missed while the
+// gateway was disconnected.
+func (g *gateway) ConnectNotify() {
+	clog.Info("Connected to scheduler")
+
+	if atomic.AddInt32(&g.connections, 1) == 1 {
+		return
+	}
+
+	payload, err := yaml.Marshal(&payloads.ReplayEvents{})
+	if err != nil {
+		clog.Warningf("Unable to marshal REPLAYEVENTS: %v", err)
+		return
+	}
+
+	go func() {
+		if _, err := g.scheduler.SendCommand(ssntp.REPLAYEVENTS, payload); err != nil {
+			clog.Warningf("Unable to send REPLAYEVENTS: %v", err)
+		}
+	}()
+}
+
+func (g *gateway) DisconnectNotify() {
+	clog.Warning("Disconnected from scheduler")
+}
+
+func (g *gateway) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+}
+
+func (g *gateway) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+	if command != ssntp.STATS {
+		return
+	}
+
+	var stats payloads.Stat
+	stats.Init()
+	if err := payloads.UnmarshalTolerant(frame.Payload, &stats); err != nil {
+		clog.Warningf("Unable to unmarshal STATS: %v", err)
+		return
+	}
+
+	g.updateStats(&stats)
+}
+
+func (g *gateway) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+	switch event {
+	case ssntp.NodeConnected:
+		var connected payloads.NodeConnected
+		if err := payloads.Unmarshal(frame.Payload, &connected); err != nil {
+			clog.Warningf("Unable to unmarshal NodeConnected: %v", err)
+			return
+		}
+		g.nodeConnected(connected.Connected.NodeUUID, connected.Connected.NodeType)
+	case ssntp.NodeDisconnected:
+		var disconnected payloads.NodeDisconnected
+		if err := payloads.Unmarshal(frame.Payload, &disconnected); err != nil {
+			clog.Warningf("Unable to unmarshal NodeDisconnected: %v", err)
+			return
+		}
+		g.nodeDisconnected(disconnected.Disconnected.NodeUUID)
+	case ssntp.InstanceDeleted:
+		var deleted payloads.EventInstanceDeleted
+		if err := payloads.Unmarshal(frame.Payload, &deleted); err != nil {
+			clog.Warningf("Unable to unmarshal InstanceDeleted: %v", err)
+			return
+		}
+		g.instanceDeleted(deleted.InstanceDeleted.InstanceUUID)
+	}
+}
+
+func (g *gateway) ErrorNotify(err ssntp.Error, frame *ssntp.Frame) {
+	if err != ssntp.StartFailure {
+		return
+	}
+
+	var failure payloads.ErrorStartFailure
+	if e := payloads.Unmarshal(frame.Payload, &failure); e != nil {
+		clog.Warningf("Unable to unmarshal StartFailure: %v", e)
+		return
+	}
+
+	clog.Warningf("Instance %s could not be started: %s", failure.InstanceUUID, failure.Reason)
+	g.startFailed(failure.InstanceUUID, string(failure.Reason))
+}
+
+func (g *gateway) nodeConnected(uuid string, nodeType payloads.Resource) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	node := g.nodes[uuid]
+	if node == nil {
+		node = &gatewayNode{UUID: uuid}
+		g.nodes[uuid] = node
+	}
+	node.Type = nodeType
+}
+
+func (g *gateway) nodeDisconnected(uuid string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.nodes, uuid)
+}
+
+func (g *gateway) instanceDeleted(uuid string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	delete(g.instances, uuid)
+}
+
+func (g *gateway) startFailed(uuid, reason string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	instance := g.instances[uuid]
+	if instance == nil {
+		return
+	}
+	instance.State = "failed"
+	instance.Failure = reason
+}
+
+// updateStats records the resources and the instances a node reports.
+func (g *gateway) updateStats(stats *payloads.Stat) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	node := g.nodes[stats.NodeUUID]
+	if node == nil {
+		node = &gatewayNode{UUID: stats.NodeUUID}
+		g.nodes[stats.NodeUUID] = node
+	}
+
+	node.Hostname = stats.NodeHostName
+	node.Status = stats.Status
+	node.MemTotalMB = stats.MemTotalMB
+	node.MemAvailableMB = stats.MemAvailableMB
+	node.CpusOnline = stats.CpusOnline
+	node.Load = stats.Load
+	node.Instances = len(stats.Instances)
+
+	for _, i := range stats.Instances {
+		g.instances[i.InstanceUUID] = &gatewayInstance{
+			UUID:     i.InstanceUUID,
+			NodeUUID: stats.NodeUUID,
+			State:    i.State,
+		}
+	}
+}
+
+// handler returns the HTTP handler serving the REST API:
+//
+//	GET    /nodes                 lists the nodes
+//	GET    /instances             lists the instances
+//	POST   /instances             launches an instance
+//	POST   /instances/{uuid}/stop stops an instance
+//	DELETE /instances/{uuid}      deletes an instance
+func (g *gateway) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/nodes", g.handleNodes)
+	mux.HandleFunc("/instances", g.handleInstances)
+	mux.HandleFunc("/instances/", g.handleInstance)
+
+	return g.authorize(mux)
+}
+
+// authorize rejects the requests without the gateway's bearer token, if
+// the gateway has one.
+func (g *gateway) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g.token != "" {
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(g.token)) != 1 {
+				writeError(w, http.StatusUnauthorized, fmt.Errorf("invalid or missing token"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		clog.Warningf("Unable to write response: %v", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (g *gateway) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+		return
+	}
+
+	g.mutex.Lock()
+	nodes := make([]gatewayNode, 0, len(g.nodes))
+	for _, node := range g.nodes {
+		nodes = append(nodes, *node)
+	}
+	g.mutex.Unlock()
+
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].UUID < nodes[j].UUID })
+	writeJSON(w, http.StatusOK, nodes)
+}
+
+func (g *gateway) handleInstances(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		g.listInstances(w)
+	case http.MethodPost:
+		g.launch(w, r)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s not allowed", r.Method))
+	}
+}
+
+func (g *gateway) listInstances(w http.ResponseWriter) {
+	g.mutex.Lock()
+	instances := make([]gatewayInstance, 0, len(g.instances))
+	for _, instance := range g.instances {
+		instances = append(instances, *instance)
+	}
+	g.mutex.Unlock()
+
+	sort.Slice(instances, func(i, j int) bool { return instances[i].UUID < instances[j].UUID })
+	writeJSON(w, http.StatusOK, instances)
+}
+
+// launch sends a START command for the instance described by the request
+// body, the JSON form of the start section of the START payload.  A UUID
+// is generated for instances that do not have one.
+func (g *gateway) launch(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestSize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	body = bytes.TrimSpace(body)
+
+	var cmd payloads.Start
+	if payloads.PayloadEncoding(body) != payloads.JSON {
+		err = fmt.Errorf("JSON object expected")
+	} else {
+		err = payloads.Unmarshal(body, &cmd.Start)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid start command: %v", err))
+		return
+	}
+
+	if cmd.Start.InstanceUUID == "" {
+		cmd.Start.InstanceUUID = uuid.Generate().String()
+	}
+
+	if err = payloads.Validate(&cmd); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	payload, err := yaml.Marshal(&cmd)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err = g.scheduler.SendCommand(ssntp.START, payload); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	instance := cmd.Start.InstanceUUID
+	g.mutex.Lock()
+	g.instances[instance] = &gatewayInstance{UUID: instance, State: payloads.Pending}
+	g.mutex.Unlock()
+
+	clog.Infof("START instance %s of tenant %s", instance, cmd.Start.TenantUUID)
+	writeJSON(w, http.StatusAccepted, map[string]string{"instance_uuid": instance})
+}
+
+// handleInstance stops or deletes an instance.  The node the instance runs
+// on can be given with the node query parameter, e.g., for instances the
+// gateway has not yet seen in the STATS of their node, and the tenant token
+// with the X-Tenant-Token header.
+func (g *gateway) handleInstance(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, "/instances/"), "/")
+
+	var command ssntp.Command
+	switch {
+	case len(path) == 1 && r.Method == http.MethodDelete:
+		command = ssntp.DELETE
+	case len(path) == 2 && path[1] == "stop" && r.Method == http.MethodPost:
+		command = ssntp.STOP
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such resource %s %s", r.Method, r.URL.Path))
+		return
+	}
+
+	instance := path[0]
+	node := r.URL.Query().Get("node")
+	if node == "" {
+		g.mutex.Lock()
+		if i := g.instances[instance]; i != nil {
+			node = i.NodeUUID
+		}
+		g.mutex.Unlock()
+	}
+	if node == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("node of instance %s unknown", instance))
+		return
+	}
+
+	stop := payloads.StopCmd{
+		InstanceUUID:      instance,
+		WorkloadAgentUUID: node,
+		TenantToken:       r.Header.Get(tenantTokenHeader),
+	}
+
+	var payload []byte
+	var err error
+	if command == ssntp.DELETE {
+		payload, err = yaml.Marshal(&payloads.Delete{Delete: stop})
+	} else {
+		payload, err = yaml.Marshal(&payloads.Stop{Stop: stop})
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err = g.scheduler.SendCommand(command, payload); err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	clog.Infof("%s instance %s on node %s", command, instance, node)
+	writeJSON(w, http.StatusAccepted, map[string]string{"instance_uuid": instance})
+}
@@ -0,0 +1,233 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	testTenant   = "2491851d-dce9-48d6-b83a-a717417072ce"
+	testInstance = "3390740c-dce9-48d6-b83a-a717417072ce"
+	testNode     = "4cb19522-1e18-439a-883a-f9b2a3a95f5e"
+	testWorkload = "ab68111c-03a6-11e6-87de-001320fb6e31"
+	testImage    = "b286cd45-7d0c-4525-a140-4db6c95e41fa"
+)
+
+type testCommand struct {
+	command ssntp.Command
+	payload []byte
+}
+
+type testScheduler struct {
+	commands []testCommand
+	err      error
+}
+
+func (s *testScheduler) SendCommand(cmd ssntp.Command, payload []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	s.commands = append(s.commands, testCommand{cmd, payload})
+	return len(payload), nil
+}
+
+func testRequest(t *testing.T, h http.Handler, method, url, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func testStartBody(instance string) string {
+	return fmt.Sprintf(`{"tenant_uuid": "%s", "instance_uuid": "%s", "workload_uuid": "%s", "image_uuid": "%s",
+		"fw_type": "efi", "persistence": "host", "vm_type": "qemu",
+		"requested_resources": [{"type": "vcpus", "value": 2}, {"type": "mem_mb", "value": 512}]}`,
+		testTenant, instance, testWorkload, testImage)
+}
+
+// Checks that a launch request is sent to the scheduler as a valid START
+// command, and that a UUID is generated for instances without one.
+//
+// Test is expected to pass.
+func TestLaunch(t *testing.T) {
+	s := &testScheduler{}
+	h := newGateway(s, "secret").handler()
+
+	for _, instance := range []string{testInstance, ""} {
+		w := testRequest(t, h, http.MethodPost, "/instances", testStartBody(instance))
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Launch failed: %d %s", w.Code, w.Body.String())
+		}
+
+		var resp map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp["instance_uuid"] == "" || (instance != "" && resp["instance_uuid"] != instance) {
+			t.Errorf("Unexpected instance UUID %s", resp["instance_uuid"])
+		}
+
+		cmd := s.commands[len(s.commands)-1]
+		var start payloads.Start
+		if err := yaml.Unmarshal(cmd.payload, &start); err != nil {
+			t.Fatal(err)
+		}
+		if cmd.command != ssntp.START || start.Start.InstanceUUID != resp["instance_uuid"] ||
+			start.Start.TenantUUID != testTenant || len(start.Start.RequestedResources) != 2 {
+			t.Errorf("Unexpected %s command %+v", cmd.command, start)
+		}
+	}
+}
+
+// Checks that invalid launch requests, unauthorized requests and requests
+// the scheduler could not be sent are rejected.
+//
+// Test is expected to pass.
+func TestLaunchRejected(t *testing.T) {
+	s := &testScheduler{}
+	g := newGateway(s, "secret")
+	h := g.handler()
+
+	if w := testRequest(t, h, http.MethodPost, "/instances", "tenant_uuid: "+testTenant); w.Code != http.StatusBadRequest {
+		t.Errorf("YAML launch request not rejected: %d", w.Code)
+	}
+
+	if w := testRequest(t, h, http.MethodPost, "/instances", `{"tenant_uuid": "`+testTenant+`"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("Invalid start command not rejected: %d", w.Code)
+	}
+
+	g.token = "other"
+	if w := testRequest(t, h, http.MethodPost, "/instances", testStartBody(testInstance)); w.Code != http.StatusUnauthorized {
+		t.Errorf("Request with invalid token not rejected: %d", w.Code)
+	}
+	g.token = "secret"
+
+	s.err = fmt.Errorf("not connected")
+	if w := testRequest(t, h, http.MethodPost, "/instances", testStartBody(testInstance)); w.Code != http.StatusBadGateway {
+		t.Errorf("Unexpected status when scheduler unreachable: %d", w.Code)
+	}
+
+	if len(s.commands) != 0 {
+		t.Errorf("Commands sent for rejected requests: %v", s.commands)
+	}
+}
+
+// Checks that the nodes and instances reported in STATS are listed, and
+// that stop and delete requests are sent to the node the instance runs on.
+//
+// Test is expected to pass.
+func TestStopDelete(t *testing.T) {
+	s := &testScheduler{}
+	g := newGateway(s, "secret")
+	h := g.handler()
+
+	g.nodeConnected(testNode, payloads.ComputeNode)
+	g.updateStats(&payloads.Stat{
+		NodeUUID:     testNode,
+		NodeHostName: "cn-1",
+		Status:       "READY",
+		MemTotalMB:   4096,
+		Instances:    []payloads.InstanceStat{{InstanceUUID: testInstance, State: payloads.Running}},
+	})
+
+	w := testRequest(t, h, http.MethodGet, "/nodes", "")
+	var nodes []gatewayNode
+	if err := json.Unmarshal(w.Body.Bytes(), &nodes); err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 || nodes[0].UUID != testNode || nodes[0].Type != payloads.ComputeNode ||
+		nodes[0].Hostname != "cn-1" || nodes[0].Instances != 1 {
+		t.Errorf("Unexpected nodes %+v", nodes)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/instances/"+testInstance+"/stop", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set(tenantTokenHeader, "token")
+	w = httptest.NewRecorder()
+	if h.ServeHTTP(w, req); w.Code != http.StatusAccepted {
+		t.Fatalf("Stop failed: %d %s", w.Code, w.Body.String())
+	}
+	var stop payloads.Stop
+	if err := yaml.Unmarshal(s.commands[0].payload, &stop); err != nil {
+		t.Fatal(err)
+	}
+	if s.commands[0].command != ssntp.STOP || stop.Stop.InstanceUUID != testInstance ||
+		stop.Stop.WorkloadAgentUUID != testNode || stop.Stop.TenantToken != "token" {
+		t.Errorf("Unexpected %s command %+v", s.commands[0].command, stop)
+	}
+
+	if w = testRequest(t, h, http.MethodDelete, "/instances/"+testInstance, ""); w.Code != http.StatusAccepted {
+		t.Fatalf("Delete failed: %d %s", w.Code, w.Body.String())
+	}
+	if s.commands[1].command != ssntp.DELETE {
+		t.Errorf("Unexpected %s command", s.commands[1].command)
+	}
+
+	g.instanceDeleted(testInstance)
+	if w = testRequest(t, h, http.MethodDelete, "/instances/"+testInstance, ""); w.Code != http.StatusNotFound {
+		t.Errorf("Delete of unknown instance not rejected: %d", w.Code)
+	}
+	if w = testRequest(t, h, http.MethodDelete, "/instances/"+testInstance+"?node="+testNode, ""); w.Code != http.StatusAccepted {
+		t.Errorf("Delete with explicit node failed: %d", w.Code)
+	}
+
+	g.nodeDisconnected(testNode)
+	w = testRequest(t, h, http.MethodGet, "/nodes", "")
+	if strings.TrimSpace(w.Body.String()) != "[]" {
+		t.Errorf("Disconnected node still listed: %s", w.Body.String())
+	}
+}
+
+// Checks that the gateway is only served without TLS or a token when
+// -insecure is set, and then only on a loopback address.
+//
+// Test is expected to pass.
+func TestCheckExposure(t *testing.T) {
+	tests := []struct {
+		listen, cert, key, token string
+		insecure                 bool
+		ok                       bool
+	}{
+		{":8443", "gw.pem", "gw-key.pem", "token", false, true},
+		{":8443", "", "", "token", false, false},
+		{":8443", "gw.pem", "gw-key.pem", "", false, false},
+		{":8443", "gw.pem", "", "token", false, false},
+		{":8443", "", "", "", true, false},
+		{"10.0.0.1:8443", "", "", "", true, false},
+		{"localhost:8443", "", "", "", true, true},
+		{"127.0.0.1:8443", "gw.pem", "gw-key.pem", "", true, true},
+		{"[::1]:8443", "", "", "token", true, true},
+	}
+
+	for i, test := range tests {
+		err := checkExposure(test.listen, test.cert, test.key, test.token, test.insecure)
+		if (err == nil) != test.ok {
+			t.Errorf("Test %d: unexpected result %v", i, err)
+		}
+	}
+}
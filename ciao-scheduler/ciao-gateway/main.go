@@ -0,0 +1,144 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+var (
+	server            = flag.String("server", "localhost", "URI of the scheduler")
+	port              = flag.Uint("port", 0, "SSNTP port of the scheduler, 0 for the default 8888")
+	caCert            = flag.String("cacert", "/etc/pki/ciao/CAcert-server-localhost.pem", "CA certificate")
+	cert              = flag.String("cert", "/etc/pki/ciao/cert-client-localhost.pem", "Gateway certificate, with the controller role")
+	keepaliveInterval = flag.Duration("keepalive-interval", 10*time.Second, "Interval between SSNTP keepalives, 0 to disable")
+	listen            = flag.String("listen", ":8443", "Address to serve the REST API on")
+	httpsCert         = flag.String("https-cert", "", "HTTPS certificate, empty to serve plain HTTP with -insecure")
+	httpsKey          = flag.String("https-key", "", "HTTPS certificate key")
+	tokenFile         = flag.String("token-file", "", "File containing the bearer token REST clients must present, empty to accept all clients with -insecure")
+	insecure          = flag.Bool("insecure", false, "Allow serving plain HTTP, or accepting all clients, on a loopback address")
+	logFormat         clog.Format
+)
+
+func init() {
+	flag.Var(&logFormat, "log-format", "Log format, glog or json, json writing one object per line to stderr (default glog)")
+}
+
+// checkExposure verifies that the gateway, which can start and delete any
+// instance, is only served without TLS or without authenticating its
+// clients when asked to, and then only on a loopback address.
+func checkExposure(listen, httpsCert, httpsKey, tokenFile string, insecure bool) error {
+	if (httpsCert == "") != (httpsKey == "") {
+		return fmt.Errorf("-https-cert and -https-key must be given together")
+	}
+
+	if httpsCert != "" && tokenFile != "" {
+		return nil
+	}
+
+	if !insecure {
+		return fmt.Errorf("-https-cert, -https-key and -token-file are required without -insecure")
+	}
+
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("Invalid listen address %s: %v", listen, err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("-insecure requires a loopback listen address, not %s", listen)
+	}
+
+	return nil
+}
+
+func main() {
+	flag.Parse()
+	clog.Init("ciao-gateway", logFormat)
+	defer clog.Flush()
+
+	if err := checkExposure(*listen, *httpsCert, *httpsKey, *tokenFile, *insecure); err != nil {
+		clog.Fatalf("Refusing to serve the REST API: %v", err)
+	}
+
+	var token string
+	if *tokenFile != "" {
+		data, err := ioutil.ReadFile(*tokenFile)
+		if err != nil {
+			clog.Fatalf("Unable to read token: %v", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	config := &ssntp.Config{
+		URI:               *server,
+		Port:              uint32(*port),
+		CAcert:            *caCert,
+		Cert:              *cert,
+		Role:              ssntp.Controller,
+		Log:               clog.SSNTPLog{},
+		KeepaliveInterval: *keepaliveInterval,
+		Encodings:         []payloads.Encoding{payloads.MsgPack},
+		AtLeastOnce:       true,
+	}
+
+	var client ssntp.Client
+	g := newGateway(&client, token)
+	if err := client.Dial(config, g); err != nil {
+		clog.Fatalf("Unable to connect to scheduler: %v", err)
+	}
+	defer client.Close()
+
+	httpServer := &http.Server{
+		Addr:    *listen,
+		Handler: g.handler(),
+	}
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalCh
+		clog.Info("Stopping gateway")
+		_ = httpServer.Close()
+	}()
+
+	var err error
+	if *httpsCert != "" {
+		clog.Infof("Serving HTTPS on %s", *listen)
+		err = httpServer.ListenAndServeTLS(*httpsCert, *httpsKey)
+	} else {
+		clog.Warningf("Serving plain HTTP on %s", *listen)
+		err = httpServer.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		clog.Errorf("Gateway failed: %v", err)
+		clog.Flush()
+		os.Exit(1)
+	}
+}
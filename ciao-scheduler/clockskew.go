@@ -0,0 +1,137 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+)
+
+// nodeClockOffset is the clock offset of a node, as exported by the metrics
+// service.
+type nodeClockOffset struct {
+	NodeUUID string  `json:"node_uuid"`
+	OffsetMS float64 `json:"offset_ms"`
+	Skewed   bool    `json:"skewed"`
+}
+
+// clockSkewStats summarizes the clock offsets of the connected nodes.
+type clockSkewStats struct {
+	ThresholdMS float64           `json:"threshold_ms"`
+	Skewed      int               `json:"skewed"`
+	Nodes       []nodeClockOffset `json:"nodes"`
+}
+
+// clockSkewTracker keeps how far the clock of each connected node is ahead
+// of the scheduler one, as estimated by SSNTP when the node connects, and
+// warns about the nodes whose clock is off by more than threshold.  Nodes
+// that predate the SSNTP clock check are not tracked.  A nil
+// clockSkewTracker tracks nothing.
+type clockSkewTracker struct {
+	threshold time.Duration
+	alerts    *alertNotifier
+
+	mutex   sync.Mutex
+	offsets map[string]time.Duration
+}
+
+func newClockSkewTracker(threshold time.Duration, alerts *alertNotifier) *clockSkewTracker {
+	return &clockSkewTracker{
+		threshold: threshold,
+		alerts:    alerts,
+		offsets:   make(map[string]time.Duration),
+	}
+}
+
+func (c *clockSkewTracker) skewed(offset time.Duration) bool {
+	return offset > c.threshold || offset < -c.threshold
+}
+
+// connected records the clock offset of a node that just connected.
+func (c *clockSkewTracker) connected(nodeUUID string, offset time.Duration, ok bool) {
+	if c == nil || !ok {
+		return
+	}
+
+	c.mutex.Lock()
+	c.offsets[nodeUUID] = offset
+	c.mutex.Unlock()
+
+	if !c.skewed(offset) {
+		clog.V(2).Infof("Clock of node %s is off by %s\n", nodeUUID, offset)
+		return
+	}
+
+	clog.WithFields(clog.Fields{
+		clog.NodeUUID: nodeUUID,
+		"offset_ms":   durationMS(offset),
+	}).Warningf("Clock of node %s is off by %s, trace times and deadlines will be wrong\n",
+		nodeUUID, offset)
+	c.alerts.clockSkew(nodeUUID, offset, c.threshold)
+}
+
+// disconnected forgets the clock offset of a node.
+func (c *clockSkewTracker) disconnected(nodeUUID string) {
+	if c == nil {
+		return
+	}
+
+	c.mutex.Lock()
+	delete(c.offsets, nodeUUID)
+	c.mutex.Unlock()
+}
+
+// stats returns the clock offsets of the connected nodes, the most skewed
+// first.
+func (c *clockSkewTracker) stats() clockSkewStats {
+	var stats clockSkewStats
+	if c == nil {
+		return stats
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats.ThresholdMS = durationMS(c.threshold)
+	stats.Nodes = make([]nodeClockOffset, 0, len(c.offsets))
+	for uuid, offset := range c.offsets {
+		skewed := c.skewed(offset)
+		if skewed {
+			stats.Skewed++
+		}
+		stats.Nodes = append(stats.Nodes, nodeClockOffset{
+			NodeUUID: uuid,
+			OffsetMS: durationMS(offset),
+			Skewed:   skewed,
+		})
+	}
+
+	abs := func(ms float64) float64 {
+		if ms < 0 {
+			return -ms
+		}
+		return ms
+	}
+	sort.Slice(stats.Nodes, func(i, j int) bool {
+		return abs(stats.Nodes[i].OffsetMS) > abs(stats.Nodes[j].OffsetMS)
+	})
+
+	return stats
+}
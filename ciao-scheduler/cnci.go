@@ -0,0 +1,92 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"github.com/01org/ciao/ssntp"
+)
+
+// The CNCIs network nodes run are limited by the number of CNCIs the node
+// can route for, its bandwidth and its pool of public IP addresses rather
+// than by its memory.  Network nodes reporting any of these resources in
+// their READY payloads have CNCIs placed on them according to them, others
+// on the generic memory fit.
+
+// reportsCNCIResources returns true if the referenced, locked nodeStat
+// object reports the resources its CNCIs consume.
+func (node *nodeStat) reportsCNCIResources() bool {
+	return node.cncisAvail >= 0 || node.cnciKbpsAvail >= 0 || node.publicIPsAvail >= 0
+}
+
+// cnciKbps returns the CNCI bandwidth a workload reserves on a network
+// node, the larger of its ingress and egress bandwidth.
+func (workload *workResources) cnciKbps() int {
+	if workload.egressKbps > workload.ingressKbps {
+		return workload.egressKbps
+	}
+	return workload.ingressKbps
+}
+
+// cncis returns the number of CNCIs, and thus of public IP addresses, a
+// workload takes.
+func (workload *workResources) cncis() int {
+	if workload.networkNode == 0 {
+		return 0
+	}
+	return 1
+}
+
+// networkNodeFits checks that a CNCI fits on the referenced, locked
+// network nodeStat object.
+func (sched *ssntpSchedulerServer) networkNodeFits(node *nodeStat, workload *workResources) bool {
+	if !node.reportsCNCIResources() {
+		return sched.workloadFits(node, workload)
+	}
+
+	return resourceFits(node.cncisAvail, workload.cncis()) &&
+		resourceFits(node.publicIPsAvail, workload.cncis()) &&
+		resourceFits(node.cnciKbpsAvail, workload.cnciKbps()) &&
+		resourceFits(node.ingressKbpsAvail, workload.ingressKbps) &&
+		resourceFits(node.egressKbpsAvail, workload.egressKbps) &&
+		node.status == ssntp.READY && !node.draining &&
+		sched.capabilitiesMatch(node, workload)
+}
+
+// networkNodeCNCIs returns the number of CNCIs like workload the
+// referenced, locked network nodeStat object can still take, or -1 if none
+// of the resources the node reports limits them.
+func networkNodeCNCIs(node *nodeStat, workload *workResources) int {
+	if !node.reportsCNCIResources() {
+		return -1
+	}
+
+	fits := -1
+	for _, r := range []struct {
+		available int
+		needed    int
+	}{
+		{node.cncisAvail, workload.cncis()},
+		{node.publicIPsAvail, workload.cncis()},
+		{node.cnciKbpsAvail, workload.cnciKbps()},
+	} {
+		if r.needed > 0 && r.available >= 0 && (fits < 0 || r.available/r.needed < fits) {
+			fits = r.available / r.needed
+		}
+	}
+
+	return fits
+}
@@ -0,0 +1,133 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// failureDomainLevel is the level of the failure domains the scheduler
+// spreads the instances of a tenant across in domains placement mode.
+type failureDomainLevel string
+
+const (
+	domainRack    failureDomainLevel = "rack"
+	domainChassis failureDomainLevel = "chassis"
+	domainPDU     failureDomainLevel = "pdu"
+)
+
+func (l *failureDomainLevel) String() string {
+	return string(*l)
+}
+
+func (l *failureDomainLevel) Set(val string) error {
+	switch failureDomainLevel(val) {
+	case domainRack, domainChassis, domainPDU:
+	default:
+		return fmt.Errorf("rack, chassis or pdu expected")
+	}
+	*l = failureDomainLevel(val)
+	return nil
+}
+
+// nodeDomain returns the failure domain of the referenced, locked nodeStat
+// object.  A node that does not report its domain is a domain of its own.
+func (sched *ssntpSchedulerServer) nodeDomain(node *nodeStat) string {
+	var name string
+	if node.capabilities != nil && node.capabilities.FailureDomain != nil {
+		d := node.capabilities.FailureDomain
+		switch sched.domainLevel {
+		case domainRack:
+			name = d.Rack
+		case domainChassis:
+			name = d.Chassis
+		case domainPDU:
+			name = d.PDU
+		}
+	}
+
+	if name == "" {
+		return "node " + node.uuid
+	}
+	return name
+}
+
+// tenantNodes returns the number of instances of tenant placed on each
+// node.
+func (sched *ssntpSchedulerServer) tenantNodes(tenant string) map[string]int {
+	sched.placementMutex.Lock()
+	defer sched.placementMutex.Unlock()
+
+	nodes := make(map[string]int)
+	for _, p := range sched.placements {
+		if p.tenant == tenant {
+			nodes[p.node]++
+		}
+	}
+
+	return nodes
+}
+
+// pickDomainNode returns a referenced, locked nodeStat object the workload
+// fits on, in the failure domain hosting the fewest instances of its tenant,
+// given the number of instances of the tenant on each node.  Within equally
+// loaded domains, the nodes that are not outdated by a rolling upgrade, then
+// the nodes hosting the fewest instances of the tenant are tried first,
+// starting after the MRU so that the domains take turns.  It
+// returns nil if the workload fits nowhere.  cnMutex must be held.
+func (sched *ssntpSchedulerServer) pickDomainNode(workload *workResources, tenantNodes map[string]int) *nodeStat {
+	n := len(sched.cnList)
+	domains := make([]string, n)
+	outdated := make([]bool, n)
+	load := make(map[string]int)
+	for i, node := range sched.cnList {
+		node.mutex.Lock()
+		domains[i] = sched.nodeDomain(node)
+		outdated[i] = node.outdated
+		node.mutex.Unlock()
+		load[domains[i]] += tenantNodes[node.uuid]
+	}
+
+	order := make([]int, n)
+	for i := range order {
+		order[i] = (sched.cnMRUIndex + 1 + i) % n
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := order[i], order[j]
+		if load[domains[a]] != load[domains[b]] {
+			return load[domains[a]] < load[domains[b]]
+		}
+		if outdated[a] != outdated[b] {
+			return !outdated[a]
+		}
+		return tenantNodes[sched.cnList[a].uuid] < tenantNodes[sched.cnList[b].uuid]
+	})
+
+	for _, i := range order {
+		node := sched.cnList[i]
+		node.mutex.Lock()
+		if sched.workloadFits(node, workload) {
+			sched.cnMRUIndex = i
+			sched.cnMRU = node
+			return node
+		}
+		node.mutex.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,290 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+// defaultExtenderTimeout is the time after which the placement extender
+// is considered to have failed.
+const defaultExtenderTimeout = time.Second
+
+// extenderFailurePolicy is what the scheduler does when the placement
+// extender cannot be reached or gives an invalid answer.
+type extenderFailurePolicy string
+
+const (
+	// extenderFailOpen places the instance as if there was no extender.
+	extenderFailOpen extenderFailurePolicy = "open"
+
+	// extenderFailClosed refuses to place the instance.
+	extenderFailClosed extenderFailurePolicy = "closed"
+)
+
+func (p *extenderFailurePolicy) String() string {
+	return string(*p)
+}
+
+func (p *extenderFailurePolicy) Set(val string) error {
+	switch extenderFailurePolicy(val) {
+	case extenderFailOpen, extenderFailClosed:
+	default:
+		return fmt.Errorf("open or closed expected")
+	}
+	*p = extenderFailurePolicy(val)
+	return nil
+}
+
+// extenderWorkload describes the instance being placed to the extender.
+type extenderWorkload struct {
+	InstanceUUID string                    `json:"instance_uuid"`
+	TenantUUID   string                    `json:"tenant_uuid"`
+	ImageUUID    string                    `json:"image_uuid,omitempty"`
+	DockerImage  string                    `json:"docker_image,omitempty"`
+	FlavorUUID   string                    `json:"flavor_uuid,omitempty"`
+	VMType       payloads.Hypervisor       `json:"vm_type,omitempty"`
+	Resources    map[payloads.Resource]int `json:"resources"`
+}
+
+// extenderNode describes a compute node the instance fits on to the
+// extender, with the resources it has left.
+type extenderNode struct {
+	UUID          string `json:"uuid"`
+	MemTotalMB    int    `json:"mem_total_mb"`
+	MemAvailMB    int    `json:"mem_avail_mb"`
+	Load          int    `json:"load"`
+	CPUs          int    `json:"cpus"`
+	FailureDomain string `json:"failure_domain"`
+	Outdated      bool   `json:"outdated,omitempty"`
+}
+
+// extenderRequest is the JSON document posted to the extender.
+type extenderRequest struct {
+	Workload extenderWorkload `json:"workload"`
+	Nodes    []extenderNode   `json:"nodes"`
+}
+
+// extenderResponse is the JSON document the extender answers with: the
+// UUIDs of the nodes the instance may be placed on, preferred ones first.
+type extenderResponse struct {
+	Nodes []string `json:"nodes"`
+}
+
+// placementExtender lets an external HTTP service filter and reorder the
+// compute nodes an instance fits on, for site policies the scheduler does
+// not implement.  A nil placementExtender is not consulted.
+type placementExtender struct {
+	url     string
+	client  *http.Client
+	failure extenderFailurePolicy
+}
+
+// newPlacementExtender returns an extender posting to url, which must
+// answer within timeout.
+func newPlacementExtender(url string, timeout time.Duration, failure extenderFailurePolicy) *placementExtender {
+	return &placementExtender{
+		url:     url,
+		client:  &http.Client{Timeout: timeout},
+		failure: failure,
+	}
+}
+
+// filter posts the workload and its candidate nodes to the extender and
+// returns the UUIDs of the candidates it kept, in the order it returned
+// them.  UUIDs that are not candidates are ignored.
+func (e *placementExtender) filter(workload *workResources, candidates []extenderNode) ([]string, error) {
+	start := workload.start
+	req := extenderRequest{
+		Workload: extenderWorkload{
+			InstanceUUID: start.InstanceUUID,
+			TenantUUID:   start.TenantUUID,
+			ImageUUID:    start.ImageUUID,
+			DockerImage:  start.DockerImage,
+			FlavorUUID:   start.FlavorUUID,
+			VMType:       start.VMType,
+			Resources:    make(map[payloads.Resource]int),
+		},
+		Nodes: candidates,
+	}
+	for _, r := range start.RequestedResources {
+		req.Workload.Resources[r.Type] = r.Value
+	}
+
+	data, err := json.Marshal(&req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("extender answered %s", resp.Status)
+	}
+
+	var answer extenderResponse
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		return nil, fmt.Errorf("invalid extender answer: %v", err)
+	}
+
+	known := make(map[string]bool)
+	for _, c := range candidates {
+		known[c.UUID] = true
+	}
+
+	var nodes []string
+	for _, uuid := range answer.Nodes {
+		if known[uuid] {
+			nodes = append(nodes, uuid)
+			delete(known, uuid)
+		}
+	}
+
+	return nodes, nil
+}
+
+// extenderCandidates returns the compute nodes the workload fits on, in
+// the order the placement policy tries them, and the reason the workload
+// cannot be placed when there is none.
+func (sched *ssntpSchedulerServer) extenderCandidates(workload *workResources) ([]extenderNode, payloads.StartFailureReason) {
+	var tenantNodes map[string]int
+	if sched.placement == placeDomains {
+		tenantNodes = sched.tenantNodes(workload.start.TenantUUID)
+	}
+
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
+
+	n := len(sched.cnList)
+	if n == 0 {
+		return nil, payloads.NoComputeNodes
+	}
+
+	/* Start after the MRU, unless packing */
+	first := 0
+	if sched.placement != placePack {
+		first = sched.cnMRUIndex + 1
+	}
+
+	var candidates []extenderNode
+	load := make(map[string]int)
+	for i := 0; i < n; i++ {
+		node := sched.cnList[(first+i)%n]
+		node.mutex.Lock()
+		domain := sched.nodeDomain(node)
+		load[domain] += tenantNodes[node.uuid]
+		if sched.workloadFits(node, workload) {
+			candidates = append(candidates, extenderNode{
+				UUID:          node.uuid,
+				MemTotalMB:    node.memTotalMB,
+				MemAvailMB:    node.memAvailMB,
+				Load:          node.load,
+				CPUs:          node.cpus,
+				FailureDomain: domain,
+				Outdated:      node.outdated,
+			})
+		}
+		node.mutex.Unlock()
+	}
+
+	if len(candidates) == 0 {
+		return nil, payloads.FullCloud
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := &candidates[i], &candidates[j]
+		if sched.placement == placeDomains && load[a.FailureDomain] != load[b.FailureDomain] {
+			return load[a.FailureDomain] < load[b.FailureDomain]
+		}
+		if a.Outdated != b.Outdated {
+			return !a.Outdated
+		}
+		return tenantNodes[a.UUID] < tenantNodes[b.UUID]
+	})
+
+	return candidates, ""
+}
+
+// pickExtendedNode returns a referenced, locked nodeStat object the
+// workload fits on, trying the nodes the placement extender kept in the
+// order it returned them.  When the extender fails, the nodes are tried in
+// the placement policy order if it fails open, and the workload is refused
+// if it fails closed.  The workload is also refused when the extender
+// keeps no node.
+func (sched *ssntpSchedulerServer) pickExtendedNode(controllerUUID string, workload *workResources) *nodeStat {
+	candidates, reason := sched.extenderCandidates(workload)
+	if candidates == nil {
+		sched.sendStartFailureError(controllerUUID, workload.instanceUUID, reason)
+		return nil
+	}
+
+	nodes, err := sched.extender.filter(workload, candidates)
+	if err != nil {
+		if sched.extender.failure == extenderFailClosed {
+			clog.Warningf("Placement extender failed, refusing instance %s: %v\n", workload.instanceUUID, err)
+			sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.PlacementRefused)
+			return nil
+		}
+
+		clog.Warningf("Placement extender failed, placing instance %s without it: %v\n", workload.instanceUUID, err)
+		nodes = nil
+		for _, c := range candidates {
+			nodes = append(nodes, c.UUID)
+		}
+	} else if len(nodes) == 0 {
+		sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.PlacementRefused)
+		return nil
+	}
+
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
+
+	/* Nodes may have been taken or lost while the extender was busy */
+	for _, uuid := range nodes {
+		node := sched.cnMap[uuid]
+		if node == nil {
+			continue
+		}
+
+		node.mutex.Lock()
+		if sched.workloadFits(node, workload) {
+			for i := range sched.cnList {
+				if sched.cnList[i] == node {
+					sched.cnMRUIndex = i
+				}
+			}
+			sched.cnMRU = node
+			return node
+		}
+		node.mutex.Unlock()
+	}
+
+	sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.FullCloud)
+	return nil
+}
@@ -0,0 +1,98 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+// flavor is a workload definition registered by a controller, with the
+// resource demands of its instances computed once.
+type flavor struct {
+	resources []payloads.RequestedResource
+	workload  workResources
+}
+
+// registerFlavor stores the workload definition a controller sent, so that
+// the START commands can reference it.  A flavor registered again is
+// replaced.
+func (sched *ssntpSchedulerServer) registerFlavor(uuid string, payload []byte) {
+	var event payloads.EventWorkloadDefinition
+	err := payloads.Unmarshal(payload, &event)
+	if err == nil {
+		err = payloads.Validate(&event)
+	}
+	if err != nil {
+		clog.Errorf("Bad WorkloadDefinition yaml from Controller %s: %s\n", uuid, err)
+		sched.sendInvalidPayloadError(uuid, ssntp.EVENT, ssntp.WorkloadDefinition, "", err)
+		return
+	}
+
+	def := &event.Definition
+	start := payloads.Start{
+		Start: payloads.StartCmd{RequestedResources: def.RequestedResources},
+	}
+	f := &flavor{
+		resources: def.RequestedResources,
+		workload:  sched.getWorkloadResources(&start),
+	}
+	f.workload.start = nil
+
+	sched.flavorMutex.Lock()
+	sched.flavors[def.FlavorUUID] = f
+	sched.flavorMutex.Unlock()
+
+	clog.V(2).Infof("Flavor %s registered by Controller %s\n", def.FlavorUUID, uuid)
+}
+
+// getFlavor returns the flavor registered as uuid, nil if there is none.
+func (sched *ssntpSchedulerServer) getFlavor(uuid string) *flavor {
+	sched.flavorMutex.RLock()
+	defer sched.flavorMutex.RUnlock()
+
+	return sched.flavors[uuid]
+}
+
+// applyFlavor fills in the requested resources of a START command that
+// references a flavor instead of listing them, and returns the flavor
+// resource demands for the instance.  It returns nil workload resources if
+// the command lists its own resources.
+func (sched *ssntpSchedulerServer) applyFlavor(work *payloads.Start) (*workResources, error) {
+	if work.Start.FlavorUUID == "" || len(work.Start.RequestedResources) > 0 {
+		return nil, nil
+	}
+
+	f := sched.getFlavor(work.Start.FlavorUUID)
+	if f == nil {
+		return nil, payloads.ValidationError{{
+			Field:  "start.flavor_uuid",
+			Reason: fmt.Sprintf("unknown flavor %s", work.Start.FlavorUUID),
+		}}
+	}
+
+	work.Start.RequestedResources = f.resources
+
+	workload := f.workload
+	workload.instanceUUID = work.Start.InstanceUUID
+	workload.start = &work.Start
+
+	return &workload, nil
+}
@@ -0,0 +1,235 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultGangTimeout is the time the scheduler waits for the START commands
+// of all the members of a gang.
+const defaultGangTimeout = 30 * time.Second
+
+// gangMember is an instance of a gang waiting for the other members.
+type gangMember struct {
+	work     *payloads.Start
+	workload workResources
+}
+
+// gang is a set of instances placed all at once or not at all.
+type gang struct {
+	id         string
+	controller string
+	size       int
+	members    []*gangMember
+	timer      *time.Timer
+	// time at which the timer fails the gang, the gang timeout or the
+	// earliest deadline of its members
+	expiry time.Time
+}
+
+// addGangMember holds the START command of a gang member until the whole
+// gang has been received, and then places the gang.
+func (sched *ssntpSchedulerServer) addGangMember(controllerUUID string, work *payloads.Start, workload workResources) {
+	id := work.Start.Gang.ID
+	instanceUUID := work.Start.InstanceUUID
+
+	sched.gangMutex.Lock()
+	g := sched.gangs[id]
+	if g == nil {
+		g = &gang{
+			id:         id,
+			controller: controllerUUID,
+			size:       work.Start.Gang.Size,
+		}
+		g.expiry = time.Now().Add(sched.gangTimeout)
+		g.timer = time.AfterFunc(sched.gangTimeout, func() { sched.expireGang(g) })
+		sched.gangs[id] = g
+	}
+
+	if g.controller != controllerUUID || g.size != work.Start.Gang.Size {
+		sched.gangMutex.Unlock()
+		clog.Errorf("START of instance %s does not match gang %s\n", instanceUUID, id)
+		sched.sendStartFailureError(controllerUUID, instanceUUID, payloads.InvalidData)
+		return
+	}
+
+	g.members = append(g.members, &gangMember{work: work, workload: workload})
+	if deadline, ok := work.Start.DeadlineTime(); ok && deadline.Before(g.expiry) {
+		g.expiry = deadline
+		g.timer.Reset(time.Until(deadline))
+	}
+	if received := len(g.members); received < g.size {
+		sched.gangMutex.Unlock()
+		clog.V(2).Infof("Instance %s waiting for gang %s, %d/%d members\n", instanceUUID, id, received, g.size)
+		return
+	}
+
+	g.timer.Stop()
+	delete(sched.gangs, id)
+	sched.gangMutex.Unlock()
+
+	sched.placeGang(g)
+}
+
+// expireGang fails a gang whose members did not all arrive in time, or
+// before the deadline of one of them.
+func (sched *ssntpSchedulerServer) expireGang(g *gang) {
+	sched.gangMutex.Lock()
+	if sched.gangs[g.id] != g {
+		sched.gangMutex.Unlock()
+		return
+	}
+	delete(sched.gangs, g.id)
+	sched.gangMutex.Unlock()
+
+	clog.Warningf("Gang %s timed out with %d/%d members\n", g.id, len(g.members), g.size)
+	sched.failGang(g)
+}
+
+// failGang fails all the members of g, those whose deadline is past with a
+// DeadlineExceeded StartFailure.
+func (sched *ssntpSchedulerServer) failGang(g *gang) {
+	now := time.Now()
+	for _, m := range g.members {
+		var reason payloads.StartFailureReason = payloads.GangFailure
+		if deadlinePassed(&m.work.Start, now) {
+			reason = payloads.DeadlineExceeded
+		}
+		sched.sendStartFailureError(g.controller, m.workload.instanceUUID, reason)
+	}
+}
+
+// Release resource claims on the referenced locked nodeStat object, undoing
+// decrementResourceUsage
+func (sched *ssntpSchedulerServer) releaseResourceUsage(node *nodeStat, workload *workResources) {
+	node.memAvailMB += workload.memReqMB
+
+	for _, r := range []struct {
+		available *int
+		needed    int
+	}{
+		{&node.gpusAvail, workload.gpus},
+		{&node.coresAvail, workload.cores},
+		{&node.diskIOPSAvail, workload.diskIOPS},
+		{&node.ingressKbpsAvail, workload.ingressKbps},
+		{&node.egressKbpsAvail, workload.egressKbps},
+	} {
+		if *r.available >= 0 {
+			*r.available += r.needed
+		}
+	}
+}
+
+// pickGangNodes claims resources for all the members of g on the compute
+// nodes, the largest members first.  It returns the node of each member,
+// or nil, without claiming anything, if one member does not fit.
+func (sched *ssntpSchedulerServer) pickGangNodes(g *gang) []*nodeStat {
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
+
+	// All the nodes are locked, in list order, so that the gang is placed
+	// against a consistent view of the cluster.
+	for _, node := range sched.cnList {
+		node.mutex.Lock()
+		defer node.mutex.Unlock()
+	}
+
+	members := make([]int, len(g.members))
+	for i := range members {
+		members[i] = i
+	}
+	sort.SliceStable(members, func(i, j int) bool {
+		return g.members[members[i]].workload.memReqMB > g.members[members[j]].workload.memReqMB
+	})
+
+	antiAffinity := g.members[0].work.Start.Gang.AntiAffinity
+	nodes := make([]*nodeStat, len(g.members))
+	used := make(map[*nodeStat]bool)
+
+	for _, i := range members {
+		workload := &g.members[i].workload
+		for _, node := range sched.cnList {
+			if antiAffinity && used[node] {
+				continue
+			}
+
+			if sched.workloadFits(node, workload) {
+				sched.decrementResourceUsage(node, workload)
+				nodes[i] = node
+				used[node] = true
+				break
+			}
+		}
+
+		if nodes[i] == nil {
+			for j, node := range nodes {
+				if node != nil {
+					sched.releaseResourceUsage(node, &g.members[j].workload)
+				}
+			}
+			return nil
+		}
+	}
+
+	return nodes
+}
+
+// placeGang places all the members of g and sends them to their nodes, or
+// fails them all if the gang does not fit in the cluster.
+func (sched *ssntpSchedulerServer) placeGang(g *gang) {
+	nodes := sched.pickGangNodes(g)
+	if nodes == nil {
+		clog.Warningf("Unable to place the %d instances of gang %s\n", g.size, g.id)
+		sched.failGang(g)
+		return
+	}
+
+	for i, m := range g.members {
+		instanceUUID := m.workload.instanceUUID
+		node := nodes[i]
+
+		sched.recordPlacement(instanceUUID, node.uuid, &m.workload)
+		sched.audit.placement(g.controller, instanceUUID, m.work.Start.TenantUUID, node.uuid)
+		sched.capacity.launched()
+		sched.setOwner(instanceUUID, g.controller)
+		clog.V(2).WithFields(clog.Fields{
+			clog.Command:      ssntp.START.String(),
+			clog.InstanceUUID: instanceUUID,
+			clog.NodeUUID:     node.uuid,
+		}).Infof("Placing instance %s of gang %s on node %s\n", instanceUUID, g.id, node.uuid)
+
+		payload, err := yaml.Marshal(m.work)
+		if err != nil {
+			clog.Errorf("Unable to marshal START of instance %s: %v\n", instanceUUID, err)
+			continue
+		}
+
+		ctx, cancel := sched.sendContext()
+		_, err = sched.ssntp.SendCommandContext(ctx, node.uuid, ssntp.START, payload)
+		cancel()
+		if err != nil {
+			clog.Errorf("Unable to send START of instance %s to node %s: %v\n", instanceUUID, node.uuid, err)
+		}
+	}
+}
@@ -0,0 +1,875 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
+)
+
+// The test harness runs a scheduler, fake controllers and fake compute and
+// network nodes in the test process, all talking SSNTP over the loopback
+// interface with freshly generated certificates.  Tests connect the nodes
+// they need, send START commands from a controller and assert where the
+// scheduler placed each instance, e.g.:
+//
+//	cluster := newTestCluster(t)
+//	defer cluster.shutdown()
+//
+//	controller := cluster.addController()
+//	node := cluster.addComputeNode(testReady(4096))
+//
+//	instance := controller.start(testWorkload(1024))
+//	cluster.expectPlacement(instance, node)
+
+// testTimeout is the time the harness waits for the scheduler to act.
+const testTimeout = 5 * time.Second
+
+// testResult is the outcome of a START command: either the node the
+// instance was sent to and the command it got, or the reason the scheduler
+// could not place it and the controller that reason was sent to.  Nodes
+// asked to power down report a result without instance, nodes sent the
+// security group rules of an instance report them, nodes sent a
+// reservation report it as the outcome of its ID and nodes asked to delete
+// an instance report it as deleted.
+type testResult struct {
+	instance      string
+	node          string
+	start         *payloads.StartCmd
+	failure       payloads.StartFailureReason
+	controller    string
+	powerDown     bool
+	securityGroup *payloads.SecurityGroupRulesCmd
+	reservation   *payloads.ReserveCmd
+	deleted       bool
+}
+
+// testCluster is an in-process scheduler and the fake controllers and
+// nodes connected to it.
+type testCluster struct {
+	t       *testing.T
+	dir     string
+	caCert  string
+	certs   map[uint32]string
+	port    uint32
+	sched   *ssntpSchedulerServer
+	results chan testResult
+	clients []*ssntp.Client
+}
+
+// testController is a fake ciao-controller.  It keeps the last events the
+// scheduler sent it in events, and the nodes asking to be evacuated in
+// evacuations.
+type testController struct {
+	cluster     *testCluster
+	ssntp       ssntp.Client
+	uuid        string
+	events      chan testEvent
+	evacuations chan string
+	invalid     chan payloads.ErrorInvalidPayload
+}
+
+// testEvent is an event a controller received.
+type testEvent struct {
+	event   ssntp.Event
+	payload []byte
+}
+
+// testConcentrator is a fake CNCI agent.  It keeps the events the
+// scheduler forwarded to it in events.
+type testConcentrator struct {
+	cluster *testCluster
+	ssntp   ssntp.Client
+	uuid    string
+	events  chan testEvent
+}
+
+// testNode is a fake ciao-launcher, running on a compute or network node.
+type testNode struct {
+	cluster *testCluster
+	ssntp   ssntp.Client
+	uuid    string
+	role    uint32
+}
+
+var certRoles = []struct {
+	role uint32
+	name string
+	oid  asn1.ObjectIdentifier
+}{
+	{ssntp.SCHEDULER, "Scheduler", ssntp.RoleSchedulerOID},
+	{ssntp.Controller, "Controller", ssntp.RoleControllerOID},
+	{ssntp.AGENT, "CNAgent", ssntp.RoleAgentOID},
+	{ssntp.NETAGENT, "NetAgent", ssntp.RoleNetAgentOID},
+	{ssntp.CNCIAGENT, "CNCIAgent", ssntp.RoleCNCIAgentOID},
+}
+
+// generateCerts creates a self signed scheduler certificate, also used as
+// the CA certificate, and a controller, agent, network agent and CNCI agent
+// certificate signed by it, in dir.  It returns the CA certificate path and the
+// certificate path of each role.
+func generateCerts(dir string) (string, map[uint32]string, error) {
+	var caCert *x509.Certificate
+	var caKey *ecdsa.PrivateKey
+
+	certs := make(map[uint32]string)
+	caPath := path.Join(dir, "CAcert-localhost.pem")
+
+	for _, r := range certRoles {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return "", nil, err
+		}
+
+		serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return "", nil, err
+		}
+
+		template := x509.Certificate{
+			SerialNumber:          serialNumber,
+			Subject:               pkix.Name{Organization: []string{"ciao-scheduler tests"}},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(24 * time.Hour),
+			KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			UnknownExtKeyUsage:    []asn1.ObjectIdentifier{r.oid},
+			DNSNames:              []string{"localhost"},
+			IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+			BasicConstraintsValid: true,
+		}
+
+		parent, signer := caCert, caKey
+		if caCert == nil {
+			template.IsCA = true
+			parent, signer = &template, key
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, signer)
+		if err != nil {
+			return "", nil, err
+		}
+
+		keyDer, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return "", nil, err
+		}
+
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+		keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+		if caCert == nil {
+			if caCert, err = x509.ParseCertificate(der); err != nil {
+				return "", nil, err
+			}
+			caKey = key
+
+			if err = ioutil.WriteFile(caPath, certPEM, 0600); err != nil {
+				return "", nil, err
+			}
+		}
+
+		certs[r.role] = path.Join(dir, fmt.Sprintf("cert-%s-localhost.pem", r.name))
+		if err = ioutil.WriteFile(certs[r.role], append(certPEM, keyPEM...), 0600); err != nil {
+			return "", nil, err
+		}
+	}
+
+	return caPath, certs, nil
+}
+
+// freePort returns a TCP port nothing listens on.
+func freePort() (uint32, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+
+	return uint32(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// newTestCluster starts a scheduler with the forwarding rules and frame
+// authorizations of a production one, and waits for it to accept
+// connections.
+func newTestCluster(t *testing.T) *testCluster {
+	dir, err := ioutil.TempDir("", "ciao-scheduler-tests")
+	if err != nil {
+		t.Fatalf("Unable to create temporary directory: %v", err)
+	}
+
+	cluster := &testCluster{
+		t:       t,
+		dir:     dir,
+		sched:   newSsntpSchedulerServer(),
+		results: make(chan testResult, 64),
+	}
+
+	cluster.caCert, cluster.certs, err = generateCerts(dir)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("Unable to generate certificates: %v", err)
+	}
+
+	cluster.port, err = freePort()
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("Unable to find a free port: %v", err)
+	}
+
+	cluster.sched.sendTimeout = testTimeout
+
+	config := &ssntp.Config{
+		CAcert:         cluster.caCert,
+		Cert:           cluster.certs[ssntp.SCHEDULER],
+		Role:           ssntp.SCHEDULER,
+		Port:           cluster.port,
+		ForwardTimeout: testTimeout,
+		Encodings:      []payloads.Encoding{payloads.MsgPack, payloads.JSON},
+		AtLeastOnce:    true,
+		Authorizations: frameAuthorizations,
+		ForwardRules:   cluster.sched.forwardRules(),
+	}
+
+	go cluster.sched.ssntp.Serve(config, cluster.sched)
+
+	address := fmt.Sprintf("localhost:%d", cluster.port)
+	deadline := time.Now().Add(testTimeout)
+	for {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			conn.Close()
+			break
+		}
+
+		if time.Now().After(deadline) {
+			cluster.shutdown()
+			t.Fatalf("Scheduler is not listening on %s: %v", address, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return cluster
+}
+
+// shutdown disconnects all the controllers and nodes, stops the scheduler
+// and removes the certificates.
+func (cluster *testCluster) shutdown() {
+	for _, client := range cluster.clients {
+		client.Close()
+	}
+	cluster.sched.ssntp.Stop()
+	_ = os.RemoveAll(cluster.dir)
+}
+
+func (cluster *testCluster) dial(client *ssntp.Client, role uint32, clientUUID string, ntf ssntp.ClientNotifier) {
+	config := &ssntp.Config{
+		URI:         "localhost",
+		Port:        cluster.port,
+		CAcert:      cluster.caCert,
+		Cert:        cluster.certs[role],
+		Role:        role,
+		UUID:        clientUUID,
+		Encodings:   []payloads.Encoding{payloads.MsgPack},
+		AtLeastOnce: true,
+	}
+
+	if err := client.Dial(config, ntf); err != nil {
+		cluster.t.Fatalf("Unable to connect %s: %v", clientUUID, err)
+	}
+	cluster.clients = append(cluster.clients, client)
+}
+
+// waitFor polls the scheduler state until cond holds, failing the test if
+// it does not within testTimeout.
+func (cluster *testCluster) waitFor(what string, cond func() bool) {
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			cluster.t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// addController connects a controller.  The first controller connected is
+// the master one, the only one the scheduler takes commands from.
+func (cluster *testCluster) addController() *testController {
+	return cluster.connectController(uuid.Generate().String())
+}
+
+// connectController connects a controller with the given UUID, e.g., one
+// that disconnected before.
+func (cluster *testCluster) connectController(controllerUUID string) *testController {
+	controller := &testController{
+		cluster:     cluster,
+		uuid:        controllerUUID,
+		events:      make(chan testEvent, 64),
+		evacuations: make(chan string, 8),
+		invalid:     make(chan payloads.ErrorInvalidPayload, 8),
+	}
+
+	cluster.dial(&controller.ssntp, ssntp.Controller, controller.uuid, controller)
+	cluster.waitFor("controller "+controller.uuid, func() bool {
+		cluster.sched.controllerMutex.RLock()
+		defer cluster.sched.controllerMutex.RUnlock()
+		return cluster.sched.controllerMap[controller.uuid] != nil
+	})
+
+	return controller
+}
+
+// addConcentrator connects a CNCI agent.
+func (cluster *testCluster) addConcentrator() *testConcentrator {
+	cnci := &testConcentrator{
+		cluster: cluster,
+		uuid:    uuid.Generate().String(),
+		events:  make(chan testEvent, 64),
+	}
+
+	cluster.dial(&cnci.ssntp, ssntp.CNCIAGENT, cnci.uuid, cnci)
+
+	return cnci
+}
+
+func (cluster *testCluster) addNode(role uint32, ready payloads.Ready) *testNode {
+	node := &testNode{
+		cluster: cluster,
+		uuid:    uuid.Generate().String(),
+		role:    role,
+	}
+
+	cluster.dial(&node.ssntp, role, node.uuid, node)
+	node.sendReady(ready)
+
+	return node
+}
+
+// addComputeNode connects a compute node and waits for the scheduler to
+// take its READY status, with the resources in ready, into account.
+func (cluster *testCluster) addComputeNode(ready payloads.Ready) *testNode {
+	return cluster.addNode(ssntp.AGENT, ready)
+}
+
+// addNetworkNode connects a network node and waits for the scheduler to
+// take its READY status, with the resources in ready, into account.
+func (cluster *testCluster) addNetworkNode(ready payloads.Ready) *testNode {
+	return cluster.addNode(ssntp.NETAGENT, ready)
+}
+
+// nodeStat returns the scheduler view of node, nil if it is not connected.
+func (cluster *testCluster) nodeStat(node *testNode) *nodeStat {
+	if node.role == ssntp.NETAGENT {
+		cluster.sched.nnMutex.RLock()
+		defer cluster.sched.nnMutex.RUnlock()
+		return cluster.sched.nnMap[node.uuid]
+	}
+
+	cluster.sched.cnMutex.RLock()
+	defer cluster.sched.cnMutex.RUnlock()
+	return cluster.sched.cnMap[node.uuid]
+}
+
+// nextResult returns the outcome of the next START command.
+func (cluster *testCluster) nextResult(instance string) testResult {
+	select {
+	case result := <-cluster.results:
+		if result.instance != instance {
+			cluster.t.Fatalf("Expected the outcome of instance %s, got instance %s", instance, result.instance)
+		}
+		return result
+	case <-time.After(testTimeout):
+		cluster.t.Fatalf("Instance %s was neither placed nor refused", instance)
+	}
+
+	return testResult{}
+}
+
+// expectNoResult asserts that no START command was placed or refused, e.g.
+// because the scheduler discarded it.
+func (cluster *testCluster) expectNoResult() {
+	select {
+	case result := <-cluster.results:
+		cluster.t.Fatalf("Unexpected outcome for instance %s: %+v", result.instance, result)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// expectPlacement asserts that the scheduler sent instance to node.
+func (cluster *testCluster) expectPlacement(instance string, node *testNode) {
+	result := cluster.nextResult(instance)
+	if result.failure != "" {
+		cluster.t.Fatalf("Instance %s was not placed: %s", instance, result.failure)
+	}
+
+	if result.node != node.uuid {
+		cluster.t.Fatalf("Instance %s placed on %s instead of %s", instance, result.node, node.uuid)
+	}
+}
+
+// expectStartFailure asserts that the scheduler refused to place instance
+// for the given reason.
+func (cluster *testCluster) expectStartFailure(instance string, reason payloads.StartFailureReason) {
+	result := cluster.nextResult(instance)
+	if result.failure == "" {
+		cluster.t.Fatalf("Instance %s placed on %s, expected %s", instance, result.node, reason)
+	}
+
+	if result.failure != reason {
+		cluster.t.Fatalf("Instance %s refused with %s instead of %s", instance, result.failure, reason)
+	}
+}
+
+// testReady returns the READY payload of a node with memMB of available
+// memory and no other resource reported.
+func testReady(memMB int) payloads.Ready {
+	var ready payloads.Ready
+
+	ready.Init()
+	ready.MemTotalMB = memMB
+	ready.MemAvailableMB = memMB
+	ready.Load = 0
+	ready.CpusOnline = 4
+
+	return ready
+}
+
+// testWorkload returns the START payload of an instance needing memMB of
+// memory, with a new instance UUID.
+func testWorkload(memMB int) payloads.Start {
+	return payloads.Start{
+		Start: payloads.StartCmd{
+			TenantUUID:          uuid.Generate().String(),
+			InstanceUUID:        uuid.Generate().String(),
+			ImageUUID:           uuid.Generate().String(),
+			FWType:              payloads.Legacy,
+			InstancePersistence: payloads.Host,
+			VMType:              payloads.QEMU,
+			RequestedResources: []payloads.RequestedResource{
+				{Type: payloads.VCPUs, Value: 1},
+				{Type: payloads.MemMB, Value: memMB},
+			},
+		},
+	}
+}
+
+// start sends a START command for workload and returns its instance UUID.
+func (controller *testController) start(workload payloads.Start) string {
+	t := controller.cluster.t
+
+	payload, err := payloads.MarshalVersion(controller.ssntp.Encoding(), &workload,
+		controller.ssntp.PayloadVersion())
+	if err != nil {
+		t.Fatalf("Unable to marshal START: %v", err)
+	}
+
+	if _, err = controller.ssntp.SendCommand(ssntp.START, payload); err != nil {
+		t.Fatalf("Unable to send START: %v", err)
+	}
+
+	return workload.Start.InstanceUUID
+}
+
+func (controller *testController) ConnectNotify() {
+}
+
+func (controller *testController) DisconnectNotify() {
+}
+
+func (controller *testController) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+}
+
+func (controller *testController) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+	if command != ssntp.EVACUATE {
+		return
+	}
+
+	var evacuate payloads.Evacuate
+	if err := payloads.Unmarshal(frame.Payload, &evacuate); err != nil {
+		controller.cluster.t.Errorf("Unable to unmarshal EVACUATE: %v", err)
+		return
+	}
+
+	select {
+	case controller.evacuations <- evacuate.Evacuate.WorkloadAgentUUID:
+	default:
+	}
+}
+
+func (controller *testController) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+	select {
+	case controller.events <- testEvent{event: event, payload: frame.Payload}:
+	default:
+	}
+}
+
+// replayEvents sends a REPLAYEVENTS command.
+func (controller *testController) replayEvents(cmd payloads.ReplayEventsCmd) {
+	t := controller.cluster.t
+
+	payload, err := payloads.MarshalVersion(controller.ssntp.Encoding(),
+		&payloads.ReplayEvents{ReplayEvents: cmd}, controller.ssntp.PayloadVersion())
+	if err != nil {
+		t.Fatalf("Unable to marshal REPLAYEVENTS: %v", err)
+	}
+
+	if _, err = controller.ssntp.SendCommand(ssntp.REPLAYEVENTS, payload); err != nil {
+		t.Fatalf("Unable to send REPLAYEVENTS: %v", err)
+	}
+}
+
+// setSecurityGroup sends a SECURITYGROUP command.
+func (controller *testController) setSecurityGroup(cmd payloads.SecurityGroupRulesCmd) {
+	t := controller.cluster.t
+
+	payload, err := payloads.MarshalVersion(controller.ssntp.Encoding(),
+		&payloads.SecurityGroupRules{Group: cmd}, controller.ssntp.PayloadVersion())
+	if err != nil {
+		t.Fatalf("Unable to marshal SECURITYGROUP: %v", err)
+	}
+
+	if _, err = controller.ssntp.SendCommand(ssntp.SECURITYGROUP, payload); err != nil {
+		t.Fatalf("Unable to send SECURITYGROUP: %v", err)
+	}
+}
+
+// reserve sends a RESERVE command.
+func (controller *testController) reserve(cmd payloads.ReserveCmd) {
+	t := controller.cluster.t
+
+	payload, err := payloads.MarshalVersion(controller.ssntp.Encoding(),
+		&payloads.Reserve{Reserve: cmd}, controller.ssntp.PayloadVersion())
+	if err != nil {
+		t.Fatalf("Unable to marshal RESERVE: %v", err)
+	}
+
+	if _, err = controller.ssntp.SendCommand(ssntp.RESERVE, payload); err != nil {
+		t.Fatalf("Unable to send RESERVE: %v", err)
+	}
+}
+
+// nextReplayed returns the next event the controller received, which must
+// be an EventsReplayed one.
+func (controller *testController) nextReplayed() payloads.EventsReplayedEvent {
+	t := controller.cluster.t
+
+	e := controller.nextEvent()
+	if e.event != ssntp.EventsReplayed {
+		t.Fatalf("Expected EventsReplayed, got %s", e.event)
+	}
+
+	var replayed payloads.EventsReplayed
+	if err := payloads.Unmarshal(e.payload, &replayed); err != nil {
+		t.Fatalf("Unable to unmarshal EventsReplayed: %v", err)
+	}
+	return replayed.Replayed
+}
+
+// nextEvent returns the next event the controller received, failing the
+// test if none arrives within testTimeout.
+func (controller *testController) nextEvent() testEvent {
+	select {
+	case e := <-controller.events:
+		return e
+	case <-time.After(testTimeout):
+		controller.cluster.t.Fatalf("Timed out waiting for an event")
+	}
+	return testEvent{}
+}
+
+func (controller *testController) ErrorNotify(error ssntp.Error, frame *ssntp.Frame) {
+	if error == ssntp.InvalidPayload {
+		var invalid payloads.ErrorInvalidPayload
+		if err := payloads.Unmarshal(frame.Payload, &invalid); err != nil {
+			controller.cluster.t.Errorf("Unable to unmarshal InvalidPayload: %v", err)
+			return
+		}
+		controller.invalid <- invalid
+		return
+	}
+
+	if error != ssntp.StartFailure {
+		return
+	}
+
+	var failure payloads.ErrorStartFailure
+	if err := payloads.Unmarshal(frame.Payload, &failure); err != nil {
+		controller.cluster.t.Errorf("Unable to unmarshal StartFailure: %v", err)
+		return
+	}
+
+	controller.cluster.results <- testResult{
+		instance:   failure.InstanceUUID,
+		failure:    failure.Reason,
+		controller: controller.uuid,
+	}
+}
+
+// sendReady sends a READY status and waits for the scheduler to record
+// the memory it reports.
+func (node *testNode) sendReady(ready payloads.Ready) {
+	cluster := node.cluster
+
+	ready.NodeUUID = node.uuid
+	payload, err := payloads.MarshalVersion(node.ssntp.Encoding(), &ready, node.ssntp.PayloadVersion())
+	if err != nil {
+		cluster.t.Fatalf("Unable to marshal READY: %v", err)
+	}
+
+	if _, err = node.ssntp.SendStatus(ssntp.READY, payload); err != nil {
+		cluster.t.Fatalf("Unable to send READY: %v", err)
+	}
+
+	cluster.waitFor("node "+node.uuid+" to be READY", func() bool {
+		stat := cluster.nodeStat(node)
+		if stat == nil {
+			return false
+		}
+
+		stat.mutex.Lock()
+		defer stat.mutex.Unlock()
+		return stat.status == ssntp.READY && stat.memAvailMB == ready.MemAvailableMB
+	})
+}
+
+// sendCapabilities sends a NodeCapabilities event and waits for the
+// scheduler to record it.
+func (node *testNode) sendCapabilities(capabilities payloads.NodeCapabilities) {
+	cluster := node.cluster
+
+	capabilities.NodeUUID = node.uuid
+	event := payloads.EventNodeCapabilities{Capabilities: capabilities}
+	payload, err := payloads.MarshalVersion(node.ssntp.Encoding(), &event, node.ssntp.PayloadVersion())
+	if err != nil {
+		cluster.t.Fatalf("Unable to marshal NodeCapabilities: %v", err)
+	}
+
+	if _, err = node.ssntp.SendEvent(ssntp.NodeCapabilities, payload); err != nil {
+		cluster.t.Fatalf("Unable to send NodeCapabilities: %v", err)
+	}
+
+	cluster.waitFor("node "+node.uuid+" capabilities", func() bool {
+		stat := cluster.nodeStat(node)
+		if stat == nil {
+			return false
+		}
+
+		stat.mutex.Lock()
+		defer stat.mutex.Unlock()
+		return stat.capabilities != nil
+	})
+}
+
+// sendStartFailure sends a StartFailure error for instance, as a launcher
+// that failed to start it would.
+func (node *testNode) sendStartFailure(instance string, reason payloads.StartFailureReason) {
+	failure := payloads.ErrorStartFailure{
+		InstanceUUID: instance,
+		Reason:       reason,
+	}
+	payload, err := payloads.MarshalVersion(node.ssntp.Encoding(), &failure, node.ssntp.PayloadVersion())
+	if err != nil {
+		node.cluster.t.Fatalf("Unable to marshal StartFailure: %v", err)
+	}
+
+	if _, err = node.ssntp.SendError(ssntp.StartFailure, payload); err != nil {
+		node.cluster.t.Fatalf("Unable to send StartFailure: %v", err)
+	}
+}
+
+// sendEvacuate sends an EVACUATE command asking for the evacuation of
+// agent, as a launcher whose maintenance window opens would for itself.
+func (node *testNode) sendEvacuate(agent string) {
+	cmd := payloads.Evacuate{Evacuate: payloads.EvacuateCmd{WorkloadAgentUUID: agent}}
+	payload, err := payloads.MarshalVersion(node.ssntp.Encoding(), &cmd, node.ssntp.PayloadVersion())
+	if err != nil {
+		node.cluster.t.Fatalf("Unable to marshal EVACUATE: %v", err)
+	}
+
+	if _, err = node.ssntp.SendCommand(ssntp.EVACUATE, payload); err != nil {
+		node.cluster.t.Fatalf("Unable to send EVACUATE: %v", err)
+	}
+}
+
+// sendEvent marshals and sends an event.
+func (node *testNode) sendEvent(event ssntp.Event, payload interface{}) {
+	t := node.cluster.t
+
+	data, err := payloads.MarshalVersion(node.ssntp.Encoding(), payload, node.ssntp.PayloadVersion())
+	if err != nil {
+		t.Fatalf("Unable to marshal %s: %v", event, err)
+	}
+
+	if _, err = node.ssntp.SendEvent(event, data); err != nil {
+		t.Fatalf("Unable to send %s: %v", event, err)
+	}
+}
+
+func (node *testNode) ConnectNotify() {
+}
+
+func (node *testNode) DisconnectNotify() {
+}
+
+func (node *testNode) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+}
+
+func (node *testNode) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+	if command == ssntp.POWERDOWN {
+		node.cluster.results <- testResult{node: node.uuid, powerDown: true}
+		return
+	}
+
+	if command == ssntp.SECURITYGROUP {
+		var rules payloads.SecurityGroupRules
+		if err := payloads.Unmarshal(frame.Payload, &rules); err != nil {
+			node.cluster.t.Errorf("Unable to unmarshal SECURITYGROUP: %v", err)
+			return
+		}
+		node.cluster.results <- testResult{
+			instance:      rules.Group.InstanceUUID,
+			node:          node.uuid,
+			securityGroup: &rules.Group,
+		}
+		return
+	}
+
+	if command == ssntp.RESERVE {
+		var reserve payloads.Reserve
+		if err := payloads.Unmarshal(frame.Payload, &reserve); err != nil {
+			node.cluster.t.Errorf("Unable to unmarshal RESERVE: %v", err)
+			return
+		}
+		node.cluster.results <- testResult{
+			instance:    reserve.Reserve.ReservationID,
+			node:        node.uuid,
+			reservation: &reserve.Reserve,
+		}
+		return
+	}
+
+	if command == ssntp.DELETE {
+		var del payloads.Delete
+		if err := payloads.Unmarshal(frame.Payload, &del); err != nil {
+			node.cluster.t.Errorf("Unable to unmarshal DELETE: %v", err)
+			return
+		}
+		node.cluster.results <- testResult{
+			instance: del.Delete.InstanceUUID,
+			node:     node.uuid,
+			deleted:  true,
+		}
+		return
+	}
+
+	if command != ssntp.START {
+		return
+	}
+
+	var start payloads.Start
+	if err := payloads.Unmarshal(frame.Payload, &start); err != nil {
+		node.cluster.t.Errorf("Unable to unmarshal START: %v", err)
+		return
+	}
+
+	node.cluster.results <- testResult{
+		instance: start.Start.InstanceUUID,
+		node:     node.uuid,
+		start:    &start.Start,
+	}
+}
+
+func (node *testNode) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+}
+
+func (node *testNode) ErrorNotify(error ssntp.Error, frame *ssntp.Frame) {
+}
+
+// sendEvent marshals and sends an event.
+func (cnci *testConcentrator) sendEvent(event ssntp.Event, payload interface{}) {
+	t := cnci.cluster.t
+
+	data, err := payloads.MarshalVersion(cnci.ssntp.Encoding(), payload, cnci.ssntp.PayloadVersion())
+	if err != nil {
+		t.Fatalf("Unable to marshal %s: %v", event, err)
+	}
+
+	if _, err = cnci.ssntp.SendEvent(event, data); err != nil {
+		t.Fatalf("Unable to send %s: %v", event, err)
+	}
+}
+
+// nextEvent returns the next event the concentrator received, failing the
+// test if none arrives within testTimeout.
+func (cnci *testConcentrator) nextEvent() testEvent {
+	select {
+	case e := <-cnci.events:
+		return e
+	case <-time.After(testTimeout):
+		cnci.cluster.t.Fatalf("Timed out waiting for an event")
+	}
+	return testEvent{}
+}
+
+// expectNoEvent checks that the concentrator does not receive any event
+// for a while.
+func (cnci *testConcentrator) expectNoEvent() {
+	select {
+	case e := <-cnci.events:
+		cnci.cluster.t.Fatalf("Unexpected %s event", e.event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func (cnci *testConcentrator) ConnectNotify() {
+}
+
+func (cnci *testConcentrator) DisconnectNotify() {
+}
+
+func (cnci *testConcentrator) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+}
+
+func (cnci *testConcentrator) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+}
+
+func (cnci *testConcentrator) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+	select {
+	case cnci.events <- testEvent{event: event, payload: frame.Payload}:
+	default:
+	}
+}
+
+func (cnci *testConcentrator) ErrorNotify(error ssntp.Error, frame *ssntp.Frame) {
+}
@@ -0,0 +1,178 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultJournalSize is the number of events the scheduler keeps for the
+// controllers to replay.
+const defaultJournalSize = 4096
+
+// journalEntry is an event sent to the controllers.
+type journalEntry struct {
+	sequence uint64
+	event    ssntp.Event
+	payload  []byte
+	// controller the event was sent to, empty if it was sent to all
+	controller string
+}
+
+// eventJournal keeps the last size events sent to the controllers,
+// numbered in sending order, so that reconnecting controllers can replay
+// those they missed.  A nil eventJournal keeps nothing.
+type eventJournal struct {
+	id   int64
+	size int
+
+	mutex   sync.Mutex
+	entries []journalEntry
+	last    uint64
+	// sequence number of the last event dropped from the journal
+	dropped uint64
+	// sequence number of the last event sent before each controller
+	// disconnected, by UUID
+	cursors map[string]uint64
+}
+
+func newEventJournal(size int) *eventJournal {
+	return &eventJournal{
+		id:      time.Now().UnixNano(),
+		size:    size,
+		cursors: make(map[string]uint64),
+	}
+}
+
+// record adds an event sent to controller, or to all the controllers if
+// controller is empty, to the journal.
+func (j *eventJournal) record(event ssntp.Event, payload []byte, controller string) {
+	if j == nil {
+		return
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	j.last++
+	if len(j.entries) == j.size {
+		j.dropped = j.entries[0].sequence
+		copy(j.entries, j.entries[1:])
+		j.entries = j.entries[:j.size-1]
+	}
+	j.entries = append(j.entries, journalEntry{
+		sequence:   j.last,
+		event:      event,
+		payload:    payload,
+		controller: controller,
+	})
+}
+
+// controllerLeft remembers the last event sent before controller
+// disconnected.
+func (j *eventJournal) controllerLeft(controller string) {
+	if j == nil {
+		return
+	}
+
+	j.mutex.Lock()
+	j.cursors[controller] = j.last
+	j.mutex.Unlock()
+}
+
+// replay returns the events for controller the REPLAYEVENTS command cmd
+// asks for, and the EventsReplayed event to send after them.
+func (j *eventJournal) replay(controller string, cmd *payloads.ReplayEventsCmd) ([]journalEntry, payloads.EventsReplayedEvent) {
+	if j == nil {
+		return nil, payloads.EventsReplayedEvent{}
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	done := payloads.EventsReplayedEvent{
+		JournalID:    j.id,
+		LastSequence: j.last,
+	}
+
+	after, known := cmd.AfterSequence, true
+	if after == 0 {
+		after, known = j.cursors[controller]
+	} else if cmd.JournalID != j.id || after > j.last {
+		known = false
+	}
+	if !known || after < j.dropped {
+		return nil, done
+	}
+
+	var entries []journalEntry
+	for _, e := range j.entries {
+		if e.sequence > after && (e.controller == "" || e.controller == controller) {
+			entries = append(entries, e)
+		}
+	}
+
+	done.Replayed = len(entries)
+	done.Complete = true
+	return entries, done
+}
+
+// replayEvents sends a controller the events of the journal it asks for in
+// a REPLAYEVENTS command, followed by an EventsReplayed event.
+func (sched *ssntpSchedulerServer) replayEvents(controllerUUID string, payload []byte) {
+	var cmd payloads.ReplayEvents
+	err := payloads.Unmarshal(payload, &cmd)
+	if err == nil {
+		err = payloads.Validate(&cmd)
+	}
+	if err != nil {
+		clog.Errorf("Bad REPLAYEVENTS yaml from controller %s: %s\n", controllerUUID, err)
+		sched.sendInvalidPayloadError(controllerUUID, ssntp.COMMAND, ssntp.REPLAYEVENTS, "", err)
+		return
+	}
+
+	entries, done := sched.journal.replay(controllerUUID, &cmd.ReplayEvents)
+	clog.Infof("Replaying %d events to controller %s, complete: %v\n", len(entries), controllerUUID, done.Complete)
+
+	for _, e := range entries {
+		ctx, cancel := sched.sendContext()
+		_, err = sched.ssntp.SendEventContext(ctx, controllerUUID, e.event, e.payload)
+		cancel()
+		if err != nil {
+			clog.Errorf("Unable to replay %s event %d to controller %s: %v\n", e.event, e.sequence, controllerUUID, err)
+			return
+		}
+	}
+
+	b, err := yaml.Marshal(&payloads.EventsReplayed{Replayed: done})
+	if err != nil {
+		clog.Errorf("Unable to marshal EventsReplayed: %v\n", err)
+		return
+	}
+
+	ctx, cancel := sched.sendContext()
+	defer cancel()
+	if _, err = sched.ssntp.SendEventContext(ctx, controllerUUID, ssntp.EventsReplayed, b); err != nil {
+		clog.Errorf("Unable to send EventsReplayed to controller %s: %v\n", controllerUUID, err)
+	}
+}
@@ -0,0 +1,188 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/ssntp"
+)
+
+// latencyWindow is the number of latest processing times kept for each
+// command type.
+const latencyWindow = 1024
+
+// latencyMinSamples is the number of processing times a command type needs
+// before its 99th percentile is checked against the SLO.
+const latencyMinSamples = 100
+
+// latencyCheckInterval is the number of commands processed between two
+// checks of the 99th percentile of their type.
+const latencyCheckInterval = 10
+
+// latencyBucketsMS are the upper bounds, in milliseconds, of the latency
+// histogram buckets.
+var latencyBucketsMS = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000}
+
+// commandLatency holds the latest processing times of a command type.
+type commandLatency struct {
+	samples  []time.Duration
+	next     int
+	count    uint64
+	breached bool
+}
+
+// latencyBucket is a histogram bucket, counting the processing times up to
+// LeMS milliseconds.  The last bucket, without bound, counts them all.
+type latencyBucket struct {
+	LeMS  float64 `json:"le_ms,omitempty"`
+	Count int     `json:"count"`
+}
+
+// latencyStats summarizes the latest processing times of a command type.
+type latencyStats struct {
+	Count       uint64          `json:"count"`
+	Samples     int             `json:"samples"`
+	P50MS       float64         `json:"p50_ms"`
+	P90MS       float64         `json:"p90_ms"`
+	P99MS       float64         `json:"p99_ms"`
+	Buckets     []latencyBucket `json:"buckets"`
+	SLOBreached bool            `json:"slo_breached"`
+}
+
+// latencyTracker keeps the latest processing times of each command type
+// CommandForward handles, and warns when their 99th percentile exceeds the
+// SLO.  A zero SLO is never exceeded.  A nil latencyTracker tracks nothing.
+type latencyTracker struct {
+	slo    time.Duration
+	alerts *alertNotifier
+
+	mutex    sync.Mutex
+	commands map[string]*commandLatency
+}
+
+func newLatencyTracker(slo time.Duration, alerts *alertNotifier) *latencyTracker {
+	return &latencyTracker{
+		slo:      slo,
+		alerts:   alerts,
+		commands: make(map[string]*commandLatency),
+	}
+}
+
+// sortedSamples returns a sorted copy of the processing times of c.
+func (c *commandLatency) sortedSamples() []time.Duration {
+	sorted := make([]time.Duration, len(c.samples))
+	copy(sorted, c.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// percentile returns the p quantile of sorted processing times.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[int(float64(len(sorted)-1)*p)]
+}
+
+func durationMS(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+// record adds the processing time of a command, and checks the 99th
+// percentile of its type against the SLO every latencyCheckInterval
+// commands.
+func (l *latencyTracker) record(command ssntp.Command, elapsed time.Duration) {
+	if l == nil {
+		return
+	}
+
+	name := command.String()
+
+	l.mutex.Lock()
+	c := l.commands[name]
+	if c == nil {
+		c = &commandLatency{}
+		l.commands[name] = c
+	}
+
+	if len(c.samples) < latencyWindow {
+		c.samples = append(c.samples, elapsed)
+	} else {
+		c.samples[c.next] = elapsed
+		c.next = (c.next + 1) % latencyWindow
+	}
+	c.count++
+
+	if l.slo <= 0 || len(c.samples) < latencyMinSamples || c.count%latencyCheckInterval != 0 {
+		l.mutex.Unlock()
+		return
+	}
+
+	p99 := percentile(c.sortedSamples(), 0.99)
+	breached := p99 > l.slo
+	changed := breached != c.breached
+	c.breached = breached
+	l.mutex.Unlock()
+
+	switch {
+	case changed && breached:
+		clog.Warningf("%s commands p99 latency %s exceeds SLO %s\n", name, p99, l.slo)
+		l.alerts.commandLatency(name, p99, l.slo)
+	case changed:
+		clog.Infof("%s commands p99 latency %s back within SLO %s\n", name, p99, l.slo)
+	}
+}
+
+// stats summarizes the latest processing times of each command type.
+func (l *latencyTracker) stats() map[string]latencyStats {
+	stats := make(map[string]latencyStats)
+	if l == nil {
+		return stats
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	for name, c := range l.commands {
+		sorted := c.sortedSamples()
+		s := latencyStats{
+			Count:       c.count,
+			Samples:     len(sorted),
+			P50MS:       durationMS(percentile(sorted, 0.5)),
+			P90MS:       durationMS(percentile(sorted, 0.9)),
+			P99MS:       durationMS(percentile(sorted, 0.99)),
+			SLOBreached: c.breached,
+		}
+
+		i := 0
+		for _, le := range latencyBucketsMS {
+			for i < len(sorted) && durationMS(sorted[i]) <= le {
+				i++
+			}
+			s.Buckets = append(s.Buckets, latencyBucket{LeMS: le, Count: i})
+		}
+		s.Buckets = append(s.Buckets, latencyBucket{Count: len(sorted)})
+
+		stats[name] = s
+	}
+
+	return stats
+}
@@ -0,0 +1,176 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+// setOwner records that controller issued the START command of instance.
+func (sched *ssntpSchedulerServer) setOwner(instance, controller string) {
+	sched.ownerMutex.Lock()
+	sched.owners[instance] = controller
+	sched.replicator.log(replicationEntry{Op: replicateOwn, InstanceUUID: instance, Controller: controller})
+	sched.ownerMutex.Unlock()
+}
+
+// forgetOwner forgets the controller of an instance that failed to start
+// or was deleted.
+func (sched *ssntpSchedulerServer) forgetOwner(instance string) {
+	sched.ownerMutex.Lock()
+	delete(sched.owners, instance)
+	sched.replicator.log(replicationEntry{Op: replicateDisown, InstanceUUID: instance})
+	sched.ownerMutex.Unlock()
+}
+
+// forgetController forgets the instances started by a departed controller,
+// whose errors and events are then sent to all controllers.
+func (sched *ssntpSchedulerServer) forgetController(controller string) {
+	sched.ownerMutex.Lock()
+	defer sched.ownerMutex.Unlock()
+
+	for instance, owner := range sched.owners {
+		if owner == controller {
+			delete(sched.owners, instance)
+			sched.replicator.log(replicationEntry{Op: replicateDisown, InstanceUUID: instance})
+		}
+	}
+}
+
+// ownerDestination returns the controller that started instance, if it is
+// still connected, or all the controllers otherwise.
+func (sched *ssntpSchedulerServer) ownerDestination(instance string) (dest ssntp.ForwardDestination) {
+	sched.ownerMutex.Lock()
+	owner := sched.owners[instance]
+	sched.ownerMutex.Unlock()
+
+	sched.controllerMutex.RLock()
+	connected := owner != "" && sched.controllerMap[owner] != nil
+	sched.controllerMutex.RUnlock()
+
+	if connected {
+		dest.AddRecipient(owner)
+	} else {
+		dest.Broadcast(ssntp.Controller)
+	}
+
+	return dest
+}
+
+func getErrorInstanceUUID(error ssntp.Error, payload []byte) (string, error) {
+	switch error {
+	case ssntp.StopFailure:
+		var failure payloads.ErrorStopFailure
+		err := payloads.Unmarshal(payload, &failure)
+		return failure.InstanceUUID, err
+	case ssntp.RestartFailure:
+		var failure payloads.ErrorRestartFailure
+		err := payloads.Unmarshal(payload, &failure)
+		return failure.InstanceUUID, err
+	}
+
+	return "", nil
+}
+
+func getEventInstanceUUID(event ssntp.Event, payload []byte) (string, error) {
+	switch event {
+	case ssntp.InstanceDeleted:
+		var ev payloads.EventInstanceDeleted
+		err := payloads.Unmarshal(payload, &ev)
+		return ev.InstanceDeleted.InstanceUUID, err
+	case ssntp.InstanceReady:
+		var ev payloads.EventInstanceReady
+		err := payloads.Unmarshal(payload, &ev)
+		return ev.InstanceReady.InstanceUUID, err
+	case ssntp.InstanceStateChanged:
+		var ev payloads.EventInstanceStateChanged
+		err := payloads.Unmarshal(payload, &ev)
+		return ev.StateChanged.InstanceUUID, err
+	case ssntp.ImagePullProgress:
+		var ev payloads.EventImagePullProgress
+		err := payloads.Unmarshal(payload, &ev)
+		return ev.PullProgress.InstanceUUID, err
+	case ssntp.InstanceUnhealthy:
+		var ev payloads.EventInstanceUnhealthy
+		err := payloads.Unmarshal(payload, &ev)
+		return ev.InstanceUnhealthy.InstanceUUID, err
+	case ssntp.InstanceDiskFull:
+		var ev payloads.EventInstanceDiskFull
+		err := payloads.Unmarshal(payload, &ev)
+		return ev.InstanceDiskFull.InstanceUUID, err
+	}
+
+	return "", nil
+}
+
+// ErrorForward routes the StartFailure, StopFailure and RestartFailure
+// errors nodes send to the controller that started the instance.
+func (sched *ssntpSchedulerServer) ErrorForward(uuid string, error ssntp.Error, frame *ssntp.Frame) ssntp.ForwardDestination {
+	if error == ssntp.StartFailure {
+		return sched.fwdStartFailure(uuid, frame.Payload)
+	}
+
+	instanceUUID, err := getErrorInstanceUUID(error, frame.Payload)
+	if err != nil {
+		clog.Errorf("Bad %s yaml from node %s: %s\n", error, uuid, err)
+		return sched.ownerDestination("")
+	}
+
+	return sched.ownerDestination(instanceUUID)
+}
+
+// fwdStartFailure routes a StartFailure error to the controller that
+// started the instance, which it then forgets, and counts it for the start
+// failures alert.
+func (sched *ssntpSchedulerServer) fwdStartFailure(uuid string, payload []byte) ssntp.ForwardDestination {
+	var failure payloads.ErrorStartFailure
+	if err := payloads.Unmarshal(payload, &failure); err != nil {
+		clog.Errorf("Bad StartFailure yaml from node %s: %s\n", uuid, err)
+		return sched.ownerDestination("")
+	}
+
+	dest := sched.ownerDestination(failure.InstanceUUID)
+	sched.forgetOwner(failure.InstanceUUID)
+	sched.alerts.startFailure(uuid, &failure)
+
+	return dest
+}
+
+// fwdEventToOwner routes the instance events nodes send to the controller
+// that started the instance.
+func (sched *ssntpSchedulerServer) fwdEventToOwner(uuid string, event ssntp.Event, payload []byte) ssntp.ForwardDestination {
+	instanceUUID, err := getEventInstanceUUID(event, payload)
+	if err != nil {
+		clog.Errorf("Bad %s event yaml from node %s: %s\n", event, uuid, err)
+		return sched.ownerDestination("")
+	}
+
+	dest := sched.ownerDestination(instanceUUID)
+
+	if event == ssntp.InstanceDeleted {
+		sched.ownerMutex.Lock()
+		owner := sched.owners[instanceUUID]
+		sched.ownerMutex.Unlock()
+
+		sched.journal.record(event, payload, owner)
+		sched.forgetOwner(instanceUUID)
+	}
+
+	return dest
+}
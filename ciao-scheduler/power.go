@@ -0,0 +1,327 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// placementPolicy is the way scheduler picks the compute node of an
+// instance among those it fits on.
+type placementPolicy string
+
+const (
+	// placeSpread tries the nodes after the most recently used one
+	// first, so that instances are spread over the cluster.
+	placeSpread placementPolicy = "spread"
+
+	// placePack always tries the nodes in connection order, so that
+	// instances are packed on as few nodes as possible.
+	placePack placementPolicy = "pack"
+
+	// placeDomains spreads the instances of each tenant across the
+	// failure domains of the cluster.
+	placeDomains placementPolicy = "domains"
+)
+
+func (p *placementPolicy) String() string {
+	return string(*p)
+}
+
+func (p *placementPolicy) Set(val string) error {
+	switch placementPolicy(val) {
+	case placeSpread, placePack, placeDomains:
+	default:
+		return fmt.Errorf("spread, pack or domains expected")
+	}
+	*p = placementPolicy(val)
+	return nil
+}
+
+// defaultWakeOnLANAddr is the address wake-on-LAN packets are broadcast to.
+const defaultWakeOnLANAddr = "255.255.255.255:9"
+
+// powerManager powers down the compute nodes that stay without instances
+// for idleTime, and wakes one of them up each time wakeBacklog START
+// commands could not be placed.  A nil powerManager manages nothing.
+type powerManager struct {
+	idleTime    time.Duration
+	wakeBacklog int
+	wolAddr     string
+	wake        chan struct{}
+
+	mutex     sync.Mutex
+	idleSince map[string]time.Time
+	// wake-on-LAN MAC of the nodes sent a POWERDOWN command, by UUID
+	asleep   map[string]string
+	unplaced int
+}
+
+func newPowerManager(idleTime time.Duration, wakeBacklog int, wolAddr string) *powerManager {
+	return &powerManager{
+		idleTime:    idleTime,
+		wakeBacklog: wakeBacklog,
+		wolAddr:     wolAddr,
+		wake:        make(chan struct{}, 1),
+		idleSince:   make(map[string]time.Time),
+		asleep:      make(map[string]string),
+	}
+}
+
+// nodeAwake forgets that a node that reconnects, or that is no longer
+// draining, was idle or powered down.
+func (p *powerManager) nodeAwake(uuid string) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	delete(p.asleep, uuid)
+	delete(p.idleSince, uuid)
+	p.mutex.Unlock()
+}
+
+// startUnplaced counts a START command that could not be placed for lack
+// of compute nodes, and asks for a node to be woken up once the backlog is
+// reached.
+func (p *powerManager) startUnplaced() {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	p.unplaced++
+	if p.unplaced < p.wakeBacklog {
+		p.mutex.Unlock()
+		return
+	}
+	p.unplaced = 0
+	p.mutex.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// wakeOnLAN broadcasts a magic packet waking up the node with the given
+// MAC address to addr.
+func wakeOnLAN(addr, mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+
+	packet := bytes.Repeat([]byte{0xff}, 6)
+	for i := 0; i < 16; i++ {
+		packet = append(packet, hw...)
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, err = conn.Write(packet)
+	return err
+}
+
+// busyNodes returns the number of instances placed, and of reservations
+// held, on each node.
+func (sched *ssntpSchedulerServer) busyNodes() map[string]int {
+	busy := make(map[string]int)
+
+	sched.placementMutex.Lock()
+	for _, p := range sched.placements {
+		busy[p.node]++
+	}
+	sched.placementMutex.Unlock()
+
+	sched.reservationMutex.Lock()
+	for _, r := range sched.reservations {
+		busy[r.node]++
+	}
+	sched.reservationMutex.Unlock()
+
+	return busy
+}
+
+// canPowerDown returns the wake-on-LAN MAC of the referenced, locked
+// nodeStat object, or an empty string if the node could not be woken up
+// once powered down.
+func (sched *ssntpSchedulerServer) canPowerDown(node *nodeStat) string {
+	if node.capabilities == nil || sched.ssntp.PayloadVersion(node.uuid) < payloads.Version9 {
+		return ""
+	}
+
+	return node.capabilities.WakeOnLANMAC
+}
+
+// managePower drains the compute nodes that have been idle for too long,
+// and powers down those that have been drained since the last check without
+// an instance being placed on them.  The last compute node placing instances
+// is never drained.  The nodes are checked from the last connected one,
+// which gets instances last in pack mode.
+func (sched *ssntpSchedulerServer) managePower(now time.Time) {
+	p := sched.power
+	busy := sched.busyNodes()
+	var powerDown []string
+
+	sched.cnMutex.RLock()
+
+	active := 0
+	for _, node := range sched.cnList {
+		node.mutex.Lock()
+		if !node.draining {
+			active++
+		}
+		node.mutex.Unlock()
+	}
+
+	p.mutex.Lock()
+	for i := len(sched.cnList) - 1; i >= 0; i-- {
+		node := sched.cnList[i]
+		node.mutex.Lock()
+
+		_, asleep := p.asleep[node.uuid]
+		since, idle := p.idleSince[node.uuid]
+
+		switch {
+		case busy[node.uuid] > 0:
+			if node.draining {
+				clog.Infof("Node %s got instances while draining, keeping it up\n", node.uuid)
+				node.draining = false
+				active++
+			}
+			delete(p.idleSince, node.uuid)
+		case asleep:
+		case node.draining:
+			if mac := sched.canPowerDown(node); mac != "" {
+				p.asleep[node.uuid] = mac
+				powerDown = append(powerDown, node.uuid)
+			}
+		case !idle:
+			p.idleSince[node.uuid] = now
+		case now.Sub(since) >= p.idleTime && active > 1 && sched.canPowerDown(node) != "":
+			clog.Infof("Node %s idle since %v, draining it\n", node.uuid, since)
+			node.draining = true
+			active--
+		}
+
+		node.mutex.Unlock()
+	}
+	p.mutex.Unlock()
+
+	sched.cnMutex.RUnlock()
+
+	for _, uuid := range powerDown {
+		sched.sendPowerDown(uuid)
+	}
+}
+
+func (sched *ssntpSchedulerServer) sendPowerDown(uuid string) {
+	cmd := payloads.PowerDown{
+		PowerDown: payloads.PowerDownCmd{WorkloadAgentUUID: uuid},
+	}
+
+	payload, err := yaml.Marshal(&cmd)
+	if err != nil {
+		clog.Errorf("Unable to marshal POWERDOWN: %v\n", err)
+		return
+	}
+
+	clog.Infof("Powering down node %s\n", uuid)
+
+	ctx, cancel := sched.sendContext()
+	defer cancel()
+	if _, err = sched.ssntp.SendCommandContext(ctx, uuid, ssntp.POWERDOWN, payload); err != nil {
+		clog.Errorf("Unable to send POWERDOWN to node %s: %v\n", uuid, err)
+	}
+}
+
+// wakeNode brings back a compute node: one that is draining or that
+// ignored its POWERDOWN command if there is any, a powered down one
+// otherwise.
+func (sched *ssntpSchedulerServer) wakeNode() {
+	p := sched.power
+
+	sched.cnMutex.RLock()
+	for i := range sched.cnList {
+		node := sched.cnList[i]
+		node.mutex.Lock()
+		draining := node.draining
+		node.draining = false
+		node.mutex.Unlock()
+
+		if draining {
+			p.nodeAwake(node.uuid)
+			sched.cnMutex.RUnlock()
+			clog.Infof("Instances could not be placed, no longer draining node %s\n", node.uuid)
+			return
+		}
+	}
+
+	var uuid, mac string
+	p.mutex.Lock()
+	for u, m := range p.asleep {
+		if sched.cnMap[u] == nil {
+			uuid, mac = u, m
+			delete(p.asleep, u)
+			break
+		}
+	}
+	p.mutex.Unlock()
+	sched.cnMutex.RUnlock()
+
+	if uuid == "" {
+		clog.Warningf("Instances could not be placed and no node is powered down\n")
+		return
+	}
+
+	clog.Infof("Instances could not be placed, waking up node %s\n", uuid)
+	if err := wakeOnLAN(p.wolAddr, mac); err != nil {
+		clog.Errorf("Unable to wake up node %s: %v\n", uuid, err)
+	}
+}
+
+// managePowerLoop checks the idle nodes four times every idle time, and
+// wakes a node up each time the backlog of START commands that could not be
+// placed is reached.
+func managePowerLoop(sched *ssntpSchedulerServer) {
+	p := sched.power
+	ticker := time.NewTicker(p.idleTime / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			sched.managePower(now)
+		case <-p.wake:
+			sched.wakeNode()
+		}
+	}
+}
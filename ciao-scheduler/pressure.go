@@ -0,0 +1,47 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+// pressureScorer scores the compute nodes on their memory pressure,
+// relative to a limit above which nodes are considered pressured, so that
+// they stop getting instances before they are actually full.
+type pressureScorer struct {
+	// Percentage of time tasks stalled on memory over the last minute
+	limit float64
+}
+
+func newPressureScorer(limit float64) *pressureScorer {
+	return &pressureScorer{
+		limit: limit,
+	}
+}
+
+// score returns how pressured the referenced, locked nodeStat object is, 1
+// being the limit.  Nodes that do not report their memory pressure score 0.
+func (p *pressureScorer) score(node *nodeStat) float64 {
+	if p == nil || node.memPressure < 0 {
+		return 0
+	}
+
+	return node.memPressure / p.limit
+}
+
+// pressured returns true if the referenced, locked nodeStat object reached
+// the limit.
+func (p *pressureScorer) pressured(node *nodeStat) bool {
+	return p != nil && p.score(node) >= 1
+}
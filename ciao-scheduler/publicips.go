@@ -0,0 +1,117 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+// publicIPPool is the utilization of the pool of public IP addresses of a
+// concentrator.  Concentrators without a registered pool are not tracked.
+type publicIPPool struct {
+	size     int
+	assigned int
+}
+
+// registerPublicIPPool stores the size and utilization of the pool of
+// public IP addresses of a concentrator, or forgets the pool when its size
+// is 0.
+func (sched *ssntpSchedulerServer) registerPublicIPPool(uuid string, payload []byte) {
+	var event payloads.EventPublicIPPoolRegistered
+	err := payloads.Unmarshal(payload, &event)
+	if err == nil {
+		err = payloads.Validate(&event)
+	}
+	if err != nil {
+		clog.Errorf("Bad PublicIPPoolRegistered yaml from %s: %s\n", uuid, err)
+		sched.sendInvalidPayloadError(uuid, ssntp.EVENT, ssntp.PublicIPPoolRegistered, "", err)
+		return
+	}
+
+	pool := event.Pool
+
+	sched.ipPoolMutex.Lock()
+	defer sched.ipPoolMutex.Unlock()
+
+	if pool.Size == 0 {
+		delete(sched.ipPools, pool.ConcentratorUUID)
+		clog.Infof("Public IP pool of concentrator %s unregistered\n", pool.ConcentratorUUID)
+		return
+	}
+
+	sched.ipPools[pool.ConcentratorUUID] = &publicIPPool{
+		size:     pool.Size,
+		assigned: pool.Assigned,
+	}
+	clog.Infof("Public IP pool of concentrator %s registered, %d/%d addresses assigned\n",
+		pool.ConcentratorUUID, pool.Assigned, pool.Size)
+}
+
+// assignPublicIP accounts for a PublicIPAssigned event, returning false if
+// the pool of the concentrator it is for is exhausted.
+func (sched *ssntpSchedulerServer) assignPublicIP(payload []byte) bool {
+	var event payloads.EventPublicIPAssigned
+	if err := payloads.Unmarshal(payload, &event); err != nil {
+		// left for fwdEventToCNCI to report
+		return true
+	}
+
+	concentrator := event.AssignedIP.ConcentratorUUID
+
+	sched.ipPoolMutex.Lock()
+	pool := sched.ipPools[concentrator]
+	if pool == nil {
+		sched.ipPoolMutex.Unlock()
+		return true
+	}
+
+	if pool.assigned >= pool.size {
+		size := pool.size
+		sched.ipPoolMutex.Unlock()
+
+		address := event.AssignedIP.PublicIP
+		if address == "" {
+			address = event.AssignedIP.PublicIPv6
+		}
+		clog.Warningf("Public IP pool of concentrator %s exhausted, dropping %s assignment to instance %s\n",
+			concentrator, address, event.AssignedIP.InstanceUUID)
+		sched.alerts.publicIPPoolExhausted(concentrator, event.AssignedIP.InstanceUUID, size)
+		return false
+	}
+
+	pool.assigned++
+	sched.ipPoolMutex.Unlock()
+
+	return true
+}
+
+// releasePublicIP accounts for a PublicIPReleased event.
+func (sched *ssntpSchedulerServer) releasePublicIP(payload []byte) {
+	var event payloads.EventPublicIPReleased
+	if err := payloads.Unmarshal(payload, &event); err != nil {
+		return
+	}
+
+	sched.ipPoolMutex.Lock()
+	defer sched.ipPoolMutex.Unlock()
+
+	if pool := sched.ipPools[event.ReleasedIP.ConcentratorUUID]; pool != nil && pool.assigned > 0 {
+		pool.assigned--
+	}
+}
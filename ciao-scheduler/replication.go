@@ -0,0 +1,544 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+)
+
+// defaultReplicationInterval is the interval between two shipments of
+// placement log entries to the standby scheduler.
+const defaultReplicationInterval = time.Second
+
+// defaultReplicationSnapshotInterval is the interval between two full state
+// snapshots shipped to the standby scheduler.
+const defaultReplicationSnapshotInterval = 5 * time.Minute
+
+// maxReplicationBacklog is the number of log entries kept while the standby
+// cannot be reached, after which it is sent a full snapshot instead.
+const maxReplicationBacklog = 10000
+
+// replicationChecksumHeader carries the checksum of the replication
+// messages, an HMAC-SHA256 of their body keyed with the replication key.
+const replicationChecksumHeader = "X-Ciao-Replication-Checksum"
+
+// maxReplicationMessage is the largest replication message a standby reads.
+const maxReplicationMessage = 64 << 20
+
+// errReplicaOutOfSync is returned when the standby missed some log entries
+// and needs a full snapshot.
+var errReplicaOutOfSync = errors.New("standby scheduler out of sync")
+
+// replicationOp is the change a replication log entry makes to the state.
+type replicationOp string
+
+const (
+	// replicatePlace records that an instance was sent to a node.
+	replicatePlace replicationOp = "place"
+
+	// replicateForget forgets the placement of a deleted instance.
+	replicateForget replicationOp = "forget"
+
+	// replicateOwn records the controller that started an instance.
+	replicateOwn replicationOp = "own"
+
+	// replicateDisown forgets the controller of an instance.
+	replicateDisown replicationOp = "disown"
+)
+
+// replicationEntry is a change to the placements or the instance owners,
+// numbered in the order the active scheduler made it.
+type replicationEntry struct {
+	Sequence     uint64        `json:"sequence"`
+	Op           replicationOp `json:"op"`
+	InstanceUUID string        `json:"instance_uuid"`
+	NodeUUID     string        `json:"node_uuid,omitempty"`
+	TenantUUID   string        `json:"tenant_uuid,omitempty"`
+	MemMB        int           `json:"mem_mb,omitempty"`
+	Controller   string        `json:"controller,omitempty"`
+	Time         time.Time     `json:"time,omitempty"`
+}
+
+// replicaPlacement is a placement in a replicated snapshot.
+type replicaPlacement struct {
+	InstanceUUID string    `json:"instance_uuid"`
+	NodeUUID     string    `json:"node_uuid"`
+	TenantUUID   string    `json:"tenant_uuid"`
+	MemMB        int       `json:"mem_mb"`
+	Time         time.Time `json:"time"`
+}
+
+// replicaSnapshot is the complete replicated state, as of the log entry
+// numbered Sequence.  Digest lets the standby check it rebuilt that state.
+type replicaSnapshot struct {
+	Sequence   uint64             `json:"sequence"`
+	Placements []replicaPlacement `json:"placements"`
+	Owners     map[string]string  `json:"owners"`
+	Digest     string             `json:"digest"`
+}
+
+// replicationMessage is the JSON document posted to the standby: an
+// optional snapshot, followed by the log entries made since.
+type replicationMessage struct {
+	Snapshot *replicaSnapshot   `json:"snapshot,omitempty"`
+	Entries  []replicationEntry `json:"entries,omitempty"`
+}
+
+// replicationChecksum returns the checksum of a replication message body.
+func replicationChecksum(key, body []byte) string {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write(body)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// stateDigest returns a digest of the placements and instance owners that
+// does not depend on the order they are stored in.
+func stateDigest(placements map[string]placement, owners map[string]string) string {
+	h := sha256.New()
+
+	instances := make([]string, 0, len(placements))
+	for instance := range placements {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	for _, instance := range instances {
+		p := placements[instance]
+		fmt.Fprintf(h, "place %s %s %s %d\n", instance, p.node, p.tenant, p.memMB)
+	}
+
+	instances = instances[:0]
+	for instance := range owners {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	for _, instance := range instances {
+		fmt.Fprintf(h, "own %s %s\n", instance, owners[instance])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// replicator ships the placements and the instance owners of the active
+// scheduler to a standby one, so that the standby knows where instances
+// run and which controller started them when it takes over.  A nil
+// replicator does not replicate anything.
+type replicator struct {
+	url    string
+	key    []byte
+	client *http.Client
+
+	mutex    sync.Mutex
+	sequence uint64
+	// entries not acknowledged by the standby yet
+	backlog []replicationEntry
+	// set when the standby needs a snapshot before any further entry
+	resync       bool
+	lastSnapshot time.Time
+	// last shipment error, to only log changes
+	lastErr string
+}
+
+// newReplicator returns a replicator posting to the standby scheduler at
+// url, authenticating its messages with key.
+func newReplicator(url string, key []byte) *replicator {
+	return &replicator{
+		url:    url,
+		key:    key,
+		client: &http.Client{Timeout: 10 * time.Second},
+		resync: true,
+	}
+}
+
+// log numbers and queues a change for the standby.  Callers hold the mutex
+// of the state they changed, so that entries are numbered in the order the
+// changes were made.
+func (r *replicator) log(entry replicationEntry) {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.sequence++
+	entry.Sequence = r.sequence
+	if len(r.backlog) >= maxReplicationBacklog {
+		r.backlog = nil
+		r.resync = true
+	}
+	r.backlog = append(r.backlog, entry)
+}
+
+// ship posts msg to the standby.
+func (r *replicator) ship(msg *replicationMessage) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(replicationChecksumHeader, replicationChecksum(r.key, body))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		return errReplicaOutOfSync
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("standby scheduler answered %s", resp.Status)
+	}
+
+	return nil
+}
+
+// replicaSnapshot returns the replicated state, and the sequence number of
+// the last log entry it reflects.
+func (sched *ssntpSchedulerServer) replicaSnapshot() *replicaSnapshot {
+	sched.placementMutex.Lock()
+	defer sched.placementMutex.Unlock()
+	sched.ownerMutex.Lock()
+	defer sched.ownerMutex.Unlock()
+
+	snap := &replicaSnapshot{
+		Placements: make([]replicaPlacement, 0, len(sched.placements)),
+		Owners:     make(map[string]string, len(sched.owners)),
+		Digest:     stateDigest(sched.placements, sched.owners),
+	}
+
+	for instance, p := range sched.placements {
+		snap.Placements = append(snap.Placements, replicaPlacement{
+			InstanceUUID: instance,
+			NodeUUID:     p.node,
+			TenantUUID:   p.tenant,
+			MemMB:        p.memMB,
+			Time:         p.time,
+		})
+	}
+	for instance, owner := range sched.owners {
+		snap.Owners[instance] = owner
+	}
+
+	sched.replicator.mutex.Lock()
+	snap.Sequence = sched.replicator.sequence
+	sched.replicator.mutex.Unlock()
+
+	return snap
+}
+
+// replicate ships the log entries the standby has not acknowledged yet,
+// preceded by a snapshot if the standby needs one or if the last one is
+// older than snapshotInterval.
+func (sched *ssntpSchedulerServer) replicate(snapshotInterval time.Duration) {
+	r := sched.replicator
+	if !sched.replica.tookOver() {
+		return
+	}
+
+	r.mutex.Lock()
+	snapshotDue := r.resync || time.Since(r.lastSnapshot) >= snapshotInterval
+	r.mutex.Unlock()
+
+	var msg replicationMessage
+	if snapshotDue {
+		msg.Snapshot = sched.replicaSnapshot()
+	}
+
+	r.mutex.Lock()
+	for _, e := range r.backlog {
+		if msg.Snapshot == nil || e.Sequence > msg.Snapshot.Sequence {
+			msg.Entries = append(msg.Entries, e)
+		}
+	}
+	r.mutex.Unlock()
+
+	if msg.Snapshot == nil && len(msg.Entries) == 0 {
+		return
+	}
+
+	err := r.ship(&msg)
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch err {
+	case nil:
+		shipped := msg.Snapshot.lastSequence(msg.Entries)
+		i := 0
+		for i < len(r.backlog) && r.backlog[i].Sequence <= shipped {
+			i++
+		}
+		r.backlog = r.backlog[i:]
+		if msg.Snapshot != nil {
+			r.resync = false
+			r.lastSnapshot = time.Now()
+		}
+	case errReplicaOutOfSync:
+		r.resync = true
+	}
+
+	errStr := ""
+	if err != nil {
+		errStr = err.Error()
+	}
+	if errStr != r.lastErr {
+		if err != nil {
+			clog.Errorf("Unable to replicate to standby scheduler %s: %v", r.url, err)
+		} else {
+			clog.Infof("Replicating to standby scheduler %s", r.url)
+		}
+		r.lastErr = errStr
+	}
+}
+
+// lastSequence returns the sequence number of the last change shipped with
+// snap, which may be nil, and entries.
+func (snap *replicaSnapshot) lastSequence(entries []replicationEntry) uint64 {
+	if len(entries) > 0 {
+		return entries[len(entries)-1].Sequence
+	}
+	if snap != nil {
+		return snap.Sequence
+	}
+	return 0
+}
+
+// replicateLoop ships the replicated state to the standby every interval.
+func replicateLoop(sched *ssntpSchedulerServer, interval, snapshotInterval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sched.replicate(snapshotInterval)
+	}
+}
+
+// replica receives the state the active scheduler replicates, until the
+// standby scheduler it belongs to takes over, i.e. when its first SSNTP
+// client connects.  A nil replica is a scheduler that was not started as a
+// standby, and is always active.
+type replica struct {
+	sched *ssntpSchedulerServer
+	key   []byte
+
+	mutex sync.Mutex
+	// sequence number of the last change applied, valid when synced
+	sequence uint64
+	synced   bool
+	active   bool
+}
+
+func newReplica(sched *ssntpSchedulerServer, key []byte) *replica {
+	return &replica{
+		sched: sched,
+		key:   key,
+	}
+}
+
+// takeOver makes the standby scheduler active, after which it no longer
+// accepts the state of the previous active scheduler.
+func (r *replica) takeOver() {
+	if r == nil {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.active {
+		return
+	}
+	r.active = true
+
+	if r.synced {
+		clog.Infof("Standby scheduler taking over, at replication sequence %d", r.sequence)
+	} else {
+		clog.Warningf("Standby scheduler taking over without any replicated state")
+	}
+}
+
+// tookOver returns true if the scheduler is active.
+func (r *replica) tookOver() bool {
+	if r == nil {
+		return true
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.active
+}
+
+// applySnapshot replaces the placements and instance owners with those of
+// snap, after checking them against its digest.
+func (r *replica) applySnapshot(snap *replicaSnapshot) error {
+	placements := make(map[string]placement, len(snap.Placements))
+	for _, p := range snap.Placements {
+		placements[p.InstanceUUID] = placement{
+			node:   p.NodeUUID,
+			tenant: p.TenantUUID,
+			memMB:  p.MemMB,
+			time:   p.Time,
+		}
+	}
+	owners := snap.Owners
+	if owners == nil {
+		owners = make(map[string]string)
+	}
+
+	if stateDigest(placements, owners) != snap.Digest {
+		return fmt.Errorf("snapshot %d does not match its digest", snap.Sequence)
+	}
+
+	sched := r.sched
+	sched.placementMutex.Lock()
+	sched.ownerMutex.Lock()
+	if r.synced && r.sequence == snap.Sequence && stateDigest(sched.placements, sched.owners) != snap.Digest {
+		clog.Warningf("Replicated state diverged from the active scheduler at sequence %d, resynchronizing", snap.Sequence)
+	}
+	sched.placements = placements
+	sched.owners = owners
+	sched.ownerMutex.Unlock()
+	sched.placementMutex.Unlock()
+
+	if !r.synced {
+		clog.Infof("Standby scheduler synchronized at replication sequence %d", snap.Sequence)
+	}
+	r.sequence = snap.Sequence
+	r.synced = true
+
+	return nil
+}
+
+// applyEntry applies a log entry to the placements and instance owners.
+func (r *replica) applyEntry(e *replicationEntry) {
+	sched := r.sched
+
+	switch e.Op {
+	case replicatePlace:
+		sched.placementMutex.Lock()
+		sched.placements[e.InstanceUUID] = placement{
+			node:   e.NodeUUID,
+			tenant: e.TenantUUID,
+			memMB:  e.MemMB,
+			time:   e.Time,
+		}
+		sched.placementMutex.Unlock()
+	case replicateForget:
+		sched.placementMutex.Lock()
+		delete(sched.placements, e.InstanceUUID)
+		sched.placementMutex.Unlock()
+	case replicateOwn:
+		sched.ownerMutex.Lock()
+		sched.owners[e.InstanceUUID] = e.Controller
+		sched.ownerMutex.Unlock()
+	case replicateDisown:
+		sched.ownerMutex.Lock()
+		delete(sched.owners, e.InstanceUUID)
+		sched.ownerMutex.Unlock()
+	}
+
+	r.sequence = e.Sequence
+}
+
+// ServeHTTP applies the replication messages the active scheduler posts.
+// It answers 409 Conflict when it needs a snapshot to resynchronize, and
+// 403 Forbidden once the standby took over.
+func (r *replica) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxReplicationMessage))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	checksum := req.Header.Get(replicationChecksumHeader)
+	if !hmac.Equal([]byte(checksum), []byte(replicationChecksum(r.key, body))) {
+		clog.Errorf("Rejecting replication message with an invalid checksum from %s", req.RemoteAddr)
+		http.Error(w, "invalid checksum", http.StatusBadRequest)
+		return
+	}
+
+	var msg replicationMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.active {
+		http.Error(w, "scheduler is active", http.StatusForbidden)
+		return
+	}
+
+	if msg.Snapshot != nil {
+		if err := r.applySnapshot(msg.Snapshot); err != nil {
+			clog.Errorf("Rejecting replication message: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !r.synced {
+		http.Error(w, "snapshot needed", http.StatusConflict)
+		return
+	}
+
+	for i := range msg.Entries {
+		e := &msg.Entries[i]
+		if e.Sequence > r.sequence+1 {
+			clog.Warningf("Missed replication entries %d to %d, resynchronizing", r.sequence+1, e.Sequence-1)
+			r.synced = false
+			http.Error(w, "snapshot needed", http.StatusConflict)
+			return
+		}
+		if e.Sequence <= r.sequence {
+			// Already applied, the acknowledgement was lost
+			continue
+		}
+		r.applyEntry(e)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,250 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// reservation holds resources on a compute node, claimed by a RESERVE
+// command, for an instance a controller will start later.
+type reservation struct {
+	id         string
+	controller string
+	tenant     string
+	node       string
+	workload   workResources
+	timer      *time.Timer
+}
+
+// pickReserveNode returns a referenced, locked nodeStat object the
+// resources of a reservation fit on, only considering the node with the
+// given UUID if it is not empty, or nil if there is none.  Reservations
+// are packed on the first nodes they fit on, which must understand RESERVE
+// commands.
+func (sched *ssntpSchedulerServer) pickReserveNode(uuid string, workload *workResources) *nodeStat {
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
+
+	for _, node := range sched.cnList {
+		if uuid != "" && node.uuid != uuid {
+			continue
+		}
+		if sched.ssntp.PayloadVersion(node.uuid) < payloads.Version22 {
+			continue
+		}
+
+		node.mutex.Lock()
+		if sched.workloadFits(node, workload) {
+			return node
+		}
+		node.mutex.Unlock()
+	}
+
+	return nil
+}
+
+// reserveResources claims the resources of a RESERVE command on a compute
+// node and forwards the command to that node, with the node and the expiry
+// time of the reservation filled in.  The reservation is released if no
+// START command uses it before it expires.
+func (sched *ssntpSchedulerServer) reserveResources(controllerUUID string, payload []byte) (dest ssntp.ForwardDestination) {
+	var cmd payloads.Reserve
+	err := unmarshalCommand(payload, &cmd)
+	if err != nil {
+		clog.Errorf("Bad RESERVE yaml from Controller %s: %s\n", controllerUUID, err)
+		sched.sendInvalidPayloadError(controllerUUID, ssntp.COMMAND, ssntp.RESERVE, "", err)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	reserve := &cmd.Reserve
+	reserve.TenantToken = ""
+
+	status := payloads.ReservationStatus{
+		ReservationID: reserve.ReservationID,
+		State:         payloads.ReservationFailed,
+	}
+
+	start := payloads.Start{
+		Start: payloads.StartCmd{
+			InstanceUUID:       reserve.ReservationID,
+			TenantUUID:         reserve.TenantUUID,
+			RequestedResources: reserve.RequestedResources,
+		},
+	}
+	workload := sched.getWorkloadResources(&start)
+
+	node := sched.pickReserveNode(reserve.WorkloadAgentUUID, &workload)
+	if node == nil {
+		clog.Warningf("No room for reservation %s\n", reserve.ReservationID)
+		status.Reason = "no compute node has room for the reservation"
+		sched.sendReservationStatus(controllerUUID, status)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+	sched.decrementResourceUsage(node, &workload)
+	node.mutex.Unlock()
+
+	ttl := time.Duration(reserve.TTLSeconds) * time.Second
+	r := &reservation{
+		id:         reserve.ReservationID,
+		controller: controllerUUID,
+		tenant:     reserve.TenantUUID,
+		node:       node.uuid,
+		workload:   workload,
+	}
+	sched.reservationMutex.Lock()
+	if sched.reservations[r.id] != nil {
+		sched.reservationMutex.Unlock()
+		sched.releaseReservation(r)
+		status.Reason = "reservation already exists"
+		sched.sendReservationStatus(controllerUUID, status)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+	sched.reservations[r.id] = r
+	r.timer = time.AfterFunc(ttl, func() { sched.expireReservation(r) })
+	sched.reservationMutex.Unlock()
+
+	reserve.WorkloadAgentUUID = node.uuid
+	reserve.Expires = time.Now().Add(ttl).UTC().Format(time.RFC3339)
+	expanded, err := payloads.Marshal(payloads.PayloadEncoding(payload), &cmd)
+	if err != nil {
+		clog.Errorf("Unable to marshal RESERVE of reservation %s: %v\n", r.id, err)
+	} else {
+		dest.SetPayload(expanded)
+	}
+	dest.AddRecipient(node.uuid)
+
+	clog.V(2).Infof("Holding reservation %s on node %s until %s\n", r.id, r.node, reserve.Expires)
+
+	status.State = payloads.ReservationHeld
+	status.NodeUUID = node.uuid
+	status.Expires = reserve.Expires
+	sched.sendReservationStatus(controllerUUID, status)
+
+	return
+}
+
+// takeReservation removes the reservation with the given ID and returns
+// it, or returns nil if it does not exist or belongs to another tenant.
+func (sched *ssntpSchedulerServer) takeReservation(id, tenant string) *reservation {
+	sched.reservationMutex.Lock()
+	defer sched.reservationMutex.Unlock()
+
+	r := sched.reservations[id]
+	if r == nil || r.tenant != tenant {
+		return nil
+	}
+
+	r.timer.Stop()
+	delete(sched.reservations, id)
+	return r
+}
+
+// releaseReservation gives the resources claimed by r back to its node, if
+// it is still connected.
+func (sched *ssntpSchedulerServer) releaseReservation(r *reservation) {
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
+
+	if node := sched.cnMap[r.node]; node != nil {
+		node.mutex.Lock()
+		sched.releaseResourceUsage(node, &r.workload)
+		node.mutex.Unlock()
+	}
+}
+
+// expireReservation releases a reservation no START command used in time.
+func (sched *ssntpSchedulerServer) expireReservation(r *reservation) {
+	sched.reservationMutex.Lock()
+	if sched.reservations[r.id] != r {
+		sched.reservationMutex.Unlock()
+		return
+	}
+	delete(sched.reservations, r.id)
+	sched.reservationMutex.Unlock()
+
+	clog.Infof("Reservation %s on node %s expired\n", r.id, r.node)
+	sched.releaseReservation(r)
+
+	sched.sendReservationStatus(r.controller, payloads.ReservationStatus{
+		ReservationID: r.id,
+		State:         payloads.ReservationExpired,
+		NodeUUID:      r.node,
+	})
+}
+
+// pickReservedNode consumes the reservation a START command references and
+// returns a referenced, locked nodeStat object for the node it was held
+// on, with the resources of the reservation released, if the instance fits
+// there.  Otherwise it sends a StartFailure error to the controller and
+// returns nil.  Once referenced by a START command of its tenant, the
+// reservation is consumed whether the instance fits or not.
+func (sched *ssntpSchedulerServer) pickReservedNode(controllerUUID string, start *payloads.StartCmd, workload *workResources) *nodeStat {
+	r := sched.takeReservation(start.ReservationID, start.TenantUUID)
+	if r == nil {
+		clog.Warningf("Instance %s references unknown reservation %s\n", workload.instanceUUID, start.ReservationID)
+		sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.InvalidReservation)
+		return nil
+	}
+
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
+
+	node := sched.cnMap[r.node]
+	if node == nil {
+		clog.Warningf("Node %s of reservation %s disconnected\n", r.node, r.id)
+		sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.InvalidReservation)
+		return nil
+	}
+
+	// The node is not required to be READY, as it may report being full
+	// because of the reservation itself.
+	node.mutex.Lock()
+	sched.releaseResourceUsage(node, &r.workload)
+	if resourcesAvailable(node, workload) && sched.capabilitiesMatch(node, workload) {
+		return node
+	}
+	node.mutex.Unlock()
+
+	sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.FullComputeNode)
+	return nil
+}
+
+// sendReservationStatus reports the state of a reservation to the
+// controller that made it.
+func (sched *ssntpSchedulerServer) sendReservationStatus(controllerUUID string, status payloads.ReservationStatus) {
+	event := payloads.EventReservationStatus{Status: status}
+	payload, err := yaml.Marshal(&event)
+	if err != nil {
+		clog.Errorf("Unable to marshal ReservationStatus: %v\n", err)
+		return
+	}
+
+	ctx, cancel := sched.sendContext()
+	defer cancel()
+	if _, err = sched.ssntp.SendEventContext(ctx, controllerUUID, ssntp.ReservationStatus, payload); err != nil {
+		clog.Errorf("Unable to send ReservationStatus to Controller %s: %v\n", controllerUUID, err)
+	}
+}
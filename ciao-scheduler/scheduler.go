@@ -17,14 +17,20 @@
 package main
 
 import (
+	"bytes"
+	"expvar"
 	"flag"
 	"fmt"
+	"github.com/01org/ciao/clog"
 	"github.com/01org/ciao/payloads"
 	"github.com/01org/ciao/ssntp"
-	"github.com/golang/glog"
+	"golang.org/x/net/context"
 	"gopkg.in/yaml.v2"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"runtime/pprof"
 	"sync"
 	"syscall"
@@ -48,15 +54,103 @@ type ssntpSchedulerServer struct {
 	nnMap   map[string]*nodeStat
 	nnMutex sync.RWMutex // Rlock traversal of map, Lock modification of map
 	nnMRU   string
+	// Time after which frames a slow node could not take are dropped
+	sendTimeout time.Duration
+	// Log verbosity given on the command line, restored when the
+	// cluster configuration does not set one
+	logVerbosity string
+	// Instances sent to nodes and not deleted since
+	placements     map[string]placement
+	placementMutex sync.Mutex
+	// Controller that started each instance, the only one its errors
+	// and events are sent to
+	owners     map[string]string
+	ownerMutex sync.Mutex
+	// Webhook notifier, nil when alerts are disabled
+	alerts *alertNotifier
+	// Launches and capacity samples the capacity forecasts are based on
+	capacity capacityHistory
+	// Tenants each controller may send commands for, nil when only the
+	// master controller may send commands
+	tenants controllerTenants
+	// Verifier of the tenant tokens of the commands, nil when tenants
+	// are not authenticated
+	tenantTokens *tenantTokenVerifier
+	// Security audit trail, nil when auditing is disabled
+	audit *auditLogger
+	// Rolling upgrade of the compute nodes
+	upgrade *upgradeManager
+	// Workload definitions registered by the controllers, by flavor UUID
+	flavors     map[string]*flavor
+	flavorMutex sync.RWMutex
+	// Gangs waiting for the START commands of some of their members
+	gangs       map[string]*gang
+	gangMutex   sync.Mutex
+	gangTimeout time.Duration
+	// Way the compute node of an instance is picked
+	placement placementPolicy
+	// Level of the failure domains instances are spread across in
+	// domains placement mode
+	domainLevel failureDomainLevel
+	// Power manager, nil when idle nodes are not powered down
+	power *powerManager
+	// Events sent to the controllers, nil when not kept for replay
+	journal *eventJournal
+	// Processing times of the controller commands, nil when not tracked
+	latency *latencyTracker
+	// Clock offsets of the nodes, nil when not checked
+	clockSkew *clockSkewTracker
+	// Public IP pools registered for the concentrators, by CNCI UUID
+	ipPools     map[string]*publicIPPool
+	ipPoolMutex sync.Mutex
+	// Tenant networks announced and reported by each node, by node UUID
+	tenantNets     map[string]*tenantNets
+	tenantNetMutex sync.Mutex
+	// Resources held for instances not started yet, by reservation ID
+	reservations     map[string]*reservation
+	reservationMutex sync.Mutex
+	// External service filtering the compute nodes, nil when not used
+	extender *placementExtender
+	// Backfill instances, running or preempted, by instance UUID, and
+	// percentage of the memory of a node that must stay free after
+	// placing one
+	backfill         map[string]*backfillInstance
+	backfillMutex    sync.Mutex
+	backfillHeadroom int
+	// Thermal scoring of the compute nodes, nil when instances are not
+	// steered away from thermally stressed nodes
+	thermal *thermalScorer
+	// Memory pressure scoring of the compute nodes, nil when instances
+	// are not steered away from memory pressured nodes
+	pressure *pressureScorer
+	// Shipper of the placements and instance owners to the standby
+	// scheduler, nil when there is none
+	replicator *replicator
+	// Receiver of the state of the active scheduler, nil when not
+	// started as a standby
+	replica *replica
 }
 
 func newSsntpSchedulerServer() *ssntpSchedulerServer {
 	return &ssntpSchedulerServer{
-		name:          "Ciao Scheduler Server",
-		controllerMap: make(map[string]*controllerStat),
-		cnMap:         make(map[string]*nodeStat),
-		cnMRUIndex:    -1,
-		nnMap:         make(map[string]*nodeStat),
+		name:             "Ciao Scheduler Server",
+		controllerMap:    make(map[string]*controllerStat),
+		cnMap:            make(map[string]*nodeStat),
+		cnMRUIndex:       -1,
+		nnMap:            make(map[string]*nodeStat),
+		placements:       make(map[string]placement),
+		owners:           make(map[string]string),
+		flavors:          make(map[string]*flavor),
+		gangs:            make(map[string]*gang),
+		ipPools:          make(map[string]*publicIPPool),
+		tenantNets:       make(map[string]*tenantNets),
+		reservations:     make(map[string]*reservation),
+		backfill:         make(map[string]*backfillInstance),
+		upgrade:          newUpgradeManager(),
+		gangTimeout:      defaultGangTimeout,
+		placement:        placeSpread,
+		domainLevel:      domainRack,
+		backfillHeadroom: defaultBackfillHeadroom,
 	}
 }
 
@@ -68,6 +162,44 @@ type nodeStat struct {
 	memAvailMB int
 	load       int
 	cpus       int
+
+	// The following resources are -1 when the node does not know or
+	// does not report them, in which case they are not checked.
+	gpusAvail        int
+	coresAvail       int
+	diskIOPSAvail    int
+	ingressKbpsAvail int
+	egressKbpsAvail  int
+
+	// Resources consumed by the CNCIs of network nodes, see cnci.go.
+	cncisAvail     int
+	cnciKbpsAvail  int
+	publicIPsAvail int
+
+	// capabilities is nil until the node sends a NodeCapabilities
+	// event, in which case it is not filtered on capabilities.
+	capabilities *payloads.NodeCapabilities
+
+	// draining is set when the power manager is about to power the
+	// node down.  No instance is placed on a draining node.
+	draining bool
+
+	// outdated is set during a rolling upgrade when the node does not
+	// run the target software version, and upgrading when it is also
+	// drained for its upgrade.  No instance is placed on an upgrading
+	// node, and outdated nodes only get instances that do not fit on the
+	// upgraded ones.
+	outdated  bool
+	upgrading bool
+
+	// Power drawn, in watts, and CPU temperature, in degrees Celsius,
+	// -1 when the node does not report them.
+	powerWatts     int
+	cpuTemperature int
+
+	// Percentage of time tasks stalled on memory over the last minute,
+	// -1 when the node does not report it.
+	memPressure float64
 }
 
 type controllerStatus uint8
@@ -94,56 +226,61 @@ type controllerStat struct {
 	uuid   string
 }
 
-func (sched *ssntpSchedulerServer) sendNodeConnectionEvent(nodeUUID, controllerUUID string, nodeType payloads.Resource, connected bool) (int, error) {
-	/* connect */
-	if connected == true {
-		payload := payloads.NodeConnected{
-			Connected: payloads.NodeConnectedEvent{
-				NodeUUID: nodeUUID,
-				NodeType: nodeType,
-			},
-		}
+// sendContext returns the context the frames scheduler sends are bounded by.
+func (sched *ssntpSchedulerServer) sendContext() (context.Context, context.CancelFunc) {
+	if sched.sendTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
 
-		b, err := yaml.Marshal(&payload)
-		if err != nil {
-			return 0, err
-		}
+	return context.WithTimeout(context.Background(), sched.sendTimeout)
+}
 
-		return sched.ssntp.SendEvent(controllerUUID, ssntp.NodeConnected, b)
+// nodeConnectionEvent returns the NodeConnected or NodeDisconnected event
+// telling the controllers about a node.
+func nodeConnectionEvent(nodeUUID string, nodeType payloads.Resource, connected bool) (ssntp.Event, []byte, error) {
+	node := payloads.NodeConnectedEvent{
+		NodeUUID: nodeUUID,
+		NodeType: nodeType,
 	}
 
-	/* disconnect */
-	payload := payloads.NodeDisconnected{
-		Disconnected: payloads.NodeConnectedEvent{
-			NodeUUID: nodeUUID,
-			NodeType: nodeType,
-		},
+	/* connect */
+	if connected == true {
+		b, err := yaml.Marshal(&payloads.NodeConnected{Connected: node})
+		return ssntp.NodeConnected, b, err
 	}
 
-	b, err := yaml.Marshal(&payload)
+	/* disconnect */
+	b, err := yaml.Marshal(&payloads.NodeDisconnected{Disconnected: node})
+	return ssntp.NodeDisconnected, b, err
+}
+
+// sendNodeConnectionEvents tells all the controllers about a node, and
+// records the event in the journal.
+func (sched *ssntpSchedulerServer) sendNodeConnectionEvents(nodeUUID string, nodeType payloads.Resource, connected bool) {
+	event, b, err := nodeConnectionEvent(nodeUUID, nodeType, connected)
 	if err != nil {
-		return 0, err
+		clog.Errorf("Unable to marshal %s event: %v\n", event, err)
+		return
 	}
 
-	return sched.ssntp.SendEvent(controllerUUID, ssntp.NodeDisconnected, b)
-}
-
-func (sched *ssntpSchedulerServer) sendNodeConnectedEvents(nodeUUID string, nodeType payloads.Resource) {
 	sched.controllerMutex.RLock()
 	defer sched.controllerMutex.RUnlock()
 
+	sched.journal.record(event, b, "")
+
 	for _, c := range sched.controllerMap {
-		sched.sendNodeConnectionEvent(nodeUUID, c.uuid, nodeType, true)
+		ctx, cancel := sched.sendContext()
+		sched.ssntp.SendEventContext(ctx, c.uuid, event, b)
+		cancel()
 	}
 }
 
-func (sched *ssntpSchedulerServer) sendNodeDisconnectedEvents(nodeUUID string, nodeType payloads.Resource) {
-	sched.controllerMutex.RLock()
-	defer sched.controllerMutex.RUnlock()
+func (sched *ssntpSchedulerServer) sendNodeConnectedEvents(nodeUUID string, nodeType payloads.Resource) {
+	sched.sendNodeConnectionEvents(nodeUUID, nodeType, true)
+}
 
-	for _, c := range sched.controllerMap {
-		sched.sendNodeConnectionEvent(nodeUUID, c.uuid, nodeType, false)
-	}
+func (sched *ssntpSchedulerServer) sendNodeDisconnectedEvents(nodeUUID string, nodeType payloads.Resource) {
+	sched.sendNodeConnectionEvents(nodeUUID, nodeType, false)
 }
 
 // Add state for newly connected Controller
@@ -153,7 +290,7 @@ func (sched *ssntpSchedulerServer) connectController(uuid string) {
 	defer sched.controllerMutex.Unlock()
 
 	if sched.controllerMap[uuid] != nil {
-		glog.Warningf("Unexpected reconnect from controller %s\n", uuid)
+		clog.Warningf("Unexpected reconnect from controller %s\n", uuid)
 		return
 	}
 
@@ -183,10 +320,17 @@ func (sched *ssntpSchedulerServer) disconnectController(uuid string) {
 
 	controller := sched.controllerMap[uuid]
 	if controller == nil {
-		glog.Warningf("Unexpected disconnect from controller %s\n", uuid)
+		clog.Warningf("Unexpected disconnect from controller %s\n", uuid)
 		return
 	}
 	delete(sched.controllerMap, uuid)
+	sched.journal.controllerLeft(uuid)
+
+	controller.mutex.Lock()
+	sched.alerts.controllerLost(uuid, controller.status)
+	controller.mutex.Unlock()
+
+	sched.forgetController(uuid)
 
 	if controller.status == controllerBackup {
 		return
@@ -210,15 +354,18 @@ func (sched *ssntpSchedulerServer) connectComputeNode(uuid string) {
 	defer sched.cnMutex.Unlock()
 
 	if sched.cnMap[uuid] != nil {
-		glog.Warningf("Unexpected reconnect from compute node %s\n", uuid)
+		clog.Warningf("Unexpected reconnect from compute node %s\n", uuid)
 		return
 	}
 
 	var node nodeStat
 	node.status = ssntp.CONNECTED
 	node.uuid = uuid
+	node.upgrading = sched.upgrade.isDraining(uuid)
+	node.outdated = node.upgrading
 	sched.cnList = append(sched.cnList, &node)
 	sched.cnMap[uuid] = &node
+	sched.power.nodeAwake(uuid)
 
 	sched.sendNodeConnectedEvents(uuid, payloads.ComputeNode)
 }
@@ -231,7 +378,7 @@ func (sched *ssntpSchedulerServer) disconnectComputeNode(uuid string) {
 
 	node := sched.cnMap[uuid]
 	if node == nil {
-		glog.Warningf("Unexpected disconnect from compute node %s\n", uuid)
+		clog.Warningf("Unexpected disconnect from compute node %s\n", uuid)
 		return
 	}
 
@@ -251,7 +398,9 @@ func (sched *ssntpSchedulerServer) disconnectComputeNode(uuid string) {
 		sched.cnMRUIndex = -1
 	}
 
+	sched.forgetBackfillNode(uuid)
 	sched.sendNodeDisconnectedEvents(uuid, payloads.ComputeNode)
+	sched.alerts.nodeLost(uuid, payloads.ComputeNode)
 }
 
 // Add state for newly connected Network Node
@@ -261,7 +410,7 @@ func (sched *ssntpSchedulerServer) connectNetworkNode(uuid string) {
 	defer sched.nnMutex.Unlock()
 
 	if sched.nnMap[uuid] != nil {
-		glog.Warningf("Unexpected reconnect from network compute node %s\n", uuid)
+		clog.Warningf("Unexpected reconnect from network compute node %s\n", uuid)
 		return
 	}
 
@@ -280,7 +429,7 @@ func (sched *ssntpSchedulerServer) disconnectNetworkNode(uuid string) {
 	defer sched.nnMutex.Unlock()
 
 	if sched.nnMap[uuid] == nil {
-		glog.Warningf("Unexpected disconnect from network compute node %s\n", uuid)
+		clog.Warningf("Unexpected disconnect from network compute node %s\n", uuid)
 		return
 	}
 
@@ -288,8 +437,11 @@ func (sched *ssntpSchedulerServer) disconnectNetworkNode(uuid string) {
 	delete(sched.nnMap, uuid)
 
 	sched.sendNodeDisconnectedEvents(uuid, payloads.NetworkNode)
+	sched.alerts.nodeLost(uuid, payloads.NetworkNode)
 }
 func (sched *ssntpSchedulerServer) ConnectNotify(uuid string, role uint32) {
+	sched.replica.takeOver()
+
 	switch role {
 	case ssntp.Controller:
 		sched.connectController(uuid)
@@ -299,7 +451,13 @@ func (sched *ssntpSchedulerServer) ConnectNotify(uuid string, role uint32) {
 		sched.connectNetworkNode(uuid)
 	}
 
-	glog.V(2).Infof("Connect (role 0x%x, uuid=%s)\n", role, uuid)
+	if role == ssntp.AGENT || role == ssntp.NETAGENT {
+		offset, ok := sched.ssntp.ClockOffset(uuid)
+		sched.clockSkew.connected(uuid, offset, ok)
+	}
+
+	sched.audit.connection(uuid, role, true)
+	clog.V(2).Infof("Connect (role 0x%x, uuid=%s)\n", role, uuid)
 }
 
 func (sched *ssntpSchedulerServer) DisconnectNotify(uuid string, role uint32) {
@@ -312,7 +470,10 @@ func (sched *ssntpSchedulerServer) DisconnectNotify(uuid string, role uint32) {
 		sched.disconnectNetworkNode(uuid)
 	}
 
-	glog.V(2).Infof("Connect (role 0x%x, uuid=%s)\n", role, uuid)
+	sched.clockSkew.disconnected(uuid)
+
+	sched.audit.connection(uuid, role, false)
+	clog.V(2).Infof("Connect (role 0x%x, uuid=%s)\n", role, uuid)
 }
 
 func (sched *ssntpSchedulerServer) StatusNotify(uuid string, status ssntp.Status, frame *ssntp.Frame) {
@@ -320,12 +481,12 @@ func (sched *ssntpSchedulerServer) StatusNotify(uuid string, status ssntp.Status
 
 	// for now only pay attention to READY status
 
-	glog.V(2).Infof("STATUS %v from %s\n", status, uuid)
+	clog.V(2).Infof("STATUS %v from %s\n", status, uuid)
 
 	sched.controllerMutex.RLock()
 	defer sched.controllerMutex.RUnlock()
 	if sched.controllerMap[uuid] != nil {
-		glog.Warningf("Ignoring STATUS change from Controller uuid=%s\n", uuid)
+		clog.Warningf("Ignoring STATUS change from Controller uuid=%s\n", uuid)
 		return
 	}
 
@@ -341,7 +502,7 @@ func (sched *ssntpSchedulerServer) StatusNotify(uuid string, status ssntp.Status
 	} else if sched.nnMap[uuid] != nil {
 		node = sched.nnMap[uuid]
 	} else {
-		glog.Warningf("STATUS error: no connected ssntp client with uuid=%s\n", uuid)
+		clog.Warningf("STATUS error: no connected ssntp client with uuid=%s\n", uuid)
 		return
 	}
 
@@ -353,16 +514,36 @@ func (sched *ssntpSchedulerServer) StatusNotify(uuid string, status ssntp.Status
 	case ssntp.READY:
 		//pull in client's READY status frame transmitted statistics
 		var stats payloads.Ready
-		err := yaml.Unmarshal(payload, &stats)
+		stats.Init()
+		err := payloads.UnmarshalTolerant(payload, &stats)
+		if err == nil {
+			err = payloads.Validate(&stats)
+		}
 		if err != nil {
-			glog.Errorf("Bad READY yaml for node %s\n", uuid)
+			clog.Errorf("Bad READY yaml for node %s: %s\n", uuid, err)
+			sched.sendInvalidPayloadError(uuid, ssntp.STATUS, status, "", err)
 			return
 		}
 		node.memTotalMB = stats.MemTotalMB
 		node.memAvailMB = stats.MemAvailableMB
 		node.load = stats.Load
 		node.cpus = stats.CpusOnline
+		node.gpusAvail = stats.GPUsAvailable
+		node.coresAvail = stats.DedicatedCoresAvailable
+		node.diskIOPSAvail = stats.DiskIOPSAvailable
+		node.ingressKbpsAvail = stats.NetIngressKbpsAvailable
+		node.egressKbpsAvail = stats.NetEgressKbpsAvailable
+		node.cncisAvail = stats.CNCIsAvailable
+		node.cnciKbpsAvail = stats.CNCIBandwidthKbpsAvailable
+		node.publicIPsAvail = stats.PublicIPsAvailable
+		node.powerWatts = stats.PowerWatts
+		node.cpuTemperature = stats.CPUTemperatureC
+		node.memPressure = stats.MemPressure
 		//TODO pull in other types of payloads.Ready struct data
+
+		if sched.cnMap[uuid] != nil {
+			go sched.placeQueuedBackfill()
+		}
 	}
 }
 
@@ -370,9 +551,20 @@ type workResources struct {
 	instanceUUID string
 	memReqMB     int
 	networkNode  int
+	gpus         int
+	cores        int
+	diskIOPS     int
+	ingressKbps  int
+	egressKbps   int
+	start        *payloads.StartCmd
 }
 
-func (sched *ssntpSchedulerServer) getWorkloadResources(work *payloads.Start) (workload workResources, err error) {
+// getWorkloadResources extracts the resources the scheduler cares about from
+// a START payload that has already been validated.
+func (sched *ssntpSchedulerServer) getWorkloadResources(work *payloads.Start) (workload workResources) {
+	workload.instanceUUID = work.Start.InstanceUUID
+	workload.start = &work.Start
+
 	// loop the array to find resources
 	for idx := range work.Start.RequestedResources {
 		// memory:
@@ -385,30 +577,71 @@ func (sched *ssntpSchedulerServer) getWorkloadResources(work *payloads.Start) (w
 			workload.networkNode = work.Start.RequestedResources[idx].Value
 		}
 
+		switch work.Start.RequestedResources[idx].Type {
+		case payloads.GPUs:
+			workload.gpus = work.Start.RequestedResources[idx].Value
+		case payloads.DedicatedCores:
+			workload.cores = work.Start.RequestedResources[idx].Value
+		case payloads.DiskIOPS:
+			workload.diskIOPS = work.Start.RequestedResources[idx].Value
+		case payloads.NetIngressKbps:
+			workload.ingressKbps = work.Start.RequestedResources[idx].Value
+		case payloads.NetEgressKbps:
+			workload.egressKbps = work.Start.RequestedResources[idx].Value
+		}
+
 		// etc...
 	}
 
-	// validate the found resources
-	if workload.memReqMB <= 0 {
-		return workload, fmt.Errorf("invalid start payload resource demand: mem_mb (%d) <= 0, must be > 0", workload.memReqMB)
-	}
-	if workload.networkNode != 0 && workload.networkNode != 1 {
-		return workload, fmt.Errorf("invalid start payload resource demand: network_node (%d) is not 0 or 1", workload.networkNode)
-	}
+	return workload
+}
 
-	return workload, nil
+// resourceFits returns true if needed units of a resource, of which the
+// node has available units left, can be allocated.  Resources the node does
+// not report are assumed to fit.
+func resourceFits(available, needed int) bool {
+	return needed <= 0 || available < 0 || available >= needed
 }
 
 // Check resource demands are satisfiable by the referenced, locked nodeStat object
 func (sched *ssntpSchedulerServer) workloadFits(node *nodeStat, workload *workResources) bool {
 	// simple scheduling policy == first memory fit
-	if node.memAvailMB >= workload.memReqMB &&
-		node.status == ssntp.READY {
+	if resourcesAvailable(node, workload) && sched.backfillFits(node, workload) &&
+		node.status == ssntp.READY && !node.draining && !node.upgrading &&
+		sched.capabilitiesMatch(node, workload) {
 		return true
 	}
 	return false
 }
 
+// resourcesAvailable returns true if the referenced, locked nodeStat object
+// has the resources the workload needs left, whatever its status.
+func resourcesAvailable(node *nodeStat, workload *workResources) bool {
+	return node.memAvailMB >= workload.memReqMB &&
+		resourceFits(node.gpusAvail, workload.gpus) &&
+		resourceFits(node.coresAvail, workload.cores) &&
+		resourceFits(node.diskIOPSAvail, workload.diskIOPS) &&
+		resourceFits(node.ingressKbpsAvail, workload.ingressKbps) &&
+		resourceFits(node.egressKbpsAvail, workload.egressKbps)
+}
+
+// capabilitiesMatch returns false if the referenced, locked nodeStat object
+// has advertised capabilities that do not satisfy the workload.
+func (sched *ssntpSchedulerServer) capabilitiesMatch(node *nodeStat, workload *workResources) bool {
+	if node.capabilities == nil || workload.start == nil {
+		return true
+	}
+
+	missing := node.capabilities.Missing(workload.start.VMType, workload.start.ImageArchitecture,
+		workload.start.RequestedResources, workload.start.Requirements)
+	if missing != "" {
+		clog.V(2).Infof("Node %s lacks %s for instance %s\n", node.uuid, missing, workload.instanceUUID)
+		return false
+	}
+
+	return true
+}
+
 func (sched *ssntpSchedulerServer) sendStartFailureError(clientUUID string, instanceUUID string, reason payloads.StartFailureReason) {
 	error := payloads.ErrorStartFailure{
 		InstanceUUID: instanceUUID,
@@ -417,12 +650,54 @@ func (sched *ssntpSchedulerServer) sendStartFailureError(clientUUID string, inst
 
 	payload, err := yaml.Marshal(&error)
 	if err != nil {
-		glog.Errorf("Unable to Marshall Status %v", err)
+		clog.Errorf("Unable to Marshall Status %v", err)
+		return
+	}
+
+	clog.Errorf("Unable to dispatch: %v\n", reason)
+
+	if reason == payloads.FullCloud {
+		sched.alerts.clusterFull(instanceUUID)
+	}
+	if reason == payloads.FullCloud || reason == payloads.NoComputeNodes {
+		sched.power.startUnplaced()
+	}
+
+	ctx, cancel := sched.sendContext()
+	defer cancel()
+	sched.ssntp.SendErrorContext(ctx, clientUUID, ssntp.StartFailure, payload)
+}
+
+// sendInvalidPayloadError tells clientUUID that the payload of the frame it
+// sent could not be unmarshalled or is invalid, and that the frame has been
+// dropped.
+func (sched *ssntpSchedulerServer) sendInvalidPayloadError(clientUUID string, frameType ssntp.Type, operand fmt.Stringer, instanceUUID string, reason error) {
+	error := payloads.ErrorInvalidPayload{
+		Type:         frameType.String(),
+		Operand:      operand.String(),
+		InstanceUUID: instanceUUID,
+		Errors:       payloads.FieldErrors(reason),
+	}
+
+	payload, err := yaml.Marshal(&error)
+	if err != nil {
+		clog.Errorf("Unable to Marshall InvalidPayload %v", err)
 		return
 	}
 
-	glog.Errorf("Unable to dispatch: %v\n", reason)
-	sched.ssntp.SendError(clientUUID, ssntp.StartFailure, payload)
+	ctx, cancel := sched.sendContext()
+	defer cancel()
+	sched.ssntp.SendErrorContext(ctx, clientUUID, ssntp.InvalidPayload, payload)
+}
+
+// unmarshalCommand unmarshals and validates a command payload.
+func unmarshalCommand(payload []byte, cmd interface{}) error {
+	err := payloads.Unmarshal(payload, cmd)
+	if err != nil {
+		return err
+	}
+
+	return payloads.Validate(cmd)
 }
 func (sched *ssntpSchedulerServer) getConcentratorUUID(event ssntp.Event, payload []byte) (string, error) {
 	switch event {
@@ -430,16 +705,20 @@ func (sched *ssntpSchedulerServer) getConcentratorUUID(event ssntp.Event, payloa
 		return "", fmt.Errorf("unsupported ssntp.Event type \"%s\"", event)
 	case ssntp.TenantAdded:
 		var ev payloads.EventTenantAdded
-		err := yaml.Unmarshal(payload, &ev)
+		err := payloads.Unmarshal(payload, &ev)
 		return ev.TenantAdded.ConcentratorUUID, err
 	case ssntp.TenantRemoved:
 		var ev payloads.EventTenantRemoved
-		err := yaml.Unmarshal(payload, &ev)
+		err := payloads.Unmarshal(payload, &ev)
 		return ev.TenantRemoved.ConcentratorUUID, err
 	case ssntp.PublicIPAssigned:
 		var ev payloads.EventPublicIPAssigned
-		err := yaml.Unmarshal(payload, &ev)
+		err := payloads.Unmarshal(payload, &ev)
 		return ev.AssignedIP.ConcentratorUUID, err
+	case ssntp.PublicIPReleased:
+		var ev payloads.EventPublicIPReleased
+		err := payloads.Unmarshal(payload, &ev)
+		return ev.ReleasedIP.ConcentratorUUID, err
 	}
 }
 
@@ -449,12 +728,12 @@ func (sched *ssntpSchedulerServer) fwdEventToCNCI(event ssntp.Event, payload []b
 
 	concentratorUUID, err := sched.getConcentratorUUID(event, payload)
 	if err != nil || concentratorUUID == "" {
-		glog.Errorf("Bad %s event yaml from, concentratorUUID == %s\n", event, concentratorUUID)
+		clog.Errorf("Bad %s event yaml from, concentratorUUID == %s\n", event, concentratorUUID)
 		dest.SetDecision(ssntp.Discard)
 		return
 	}
 
-	glog.V(2).Infof("Forwarding %s to %s\n", event.String(), concentratorUUID)
+	clog.V(2).Infof("Forwarding %s to %s\n", event.String(), concentratorUUID)
 	dest.AddRecipient(concentratorUUID)
 
 	return dest
@@ -466,46 +745,122 @@ func (sched *ssntpSchedulerServer) getWorkloadAgentUUID(command ssntp.Command, p
 		return "", "", fmt.Errorf("unsupported ssntp.Command type \"%s\"", command)
 	case ssntp.RESTART:
 		var cmd payloads.Restart
-		err := yaml.Unmarshal(payload, &cmd)
+		err := unmarshalCommand(payload, &cmd)
 		return cmd.Restart.InstanceUUID, cmd.Restart.WorkloadAgentUUID, err
 	case ssntp.STOP:
 		var cmd payloads.Stop
-		err := yaml.Unmarshal(payload, &cmd)
+		err := unmarshalCommand(payload, &cmd)
 		return cmd.Stop.InstanceUUID, cmd.Stop.WorkloadAgentUUID, err
 	case ssntp.DELETE:
 		var cmd payloads.Delete
-		err := yaml.Unmarshal(payload, &cmd)
+		err := unmarshalCommand(payload, &cmd)
 		return cmd.Delete.InstanceUUID, cmd.Delete.WorkloadAgentUUID, err
 	case ssntp.EVACUATE:
 		var cmd payloads.Evacuate
-		err := yaml.Unmarshal(payload, &cmd)
+		err := unmarshalCommand(payload, &cmd)
 		return "", cmd.Evacuate.WorkloadAgentUUID, err
+	case ssntp.PREFETCH:
+		var cmd payloads.Prefetch
+		err := unmarshalCommand(payload, &cmd)
+		return "", cmd.Prefetch.WorkloadAgentUUID, err
+	case ssntp.STOPGROUP:
+		var cmd payloads.StopGroup
+		err := unmarshalCommand(payload, &cmd)
+		return "", cmd.StopGroup.WorkloadAgentUUID, err
+	case ssntp.DELETEGROUP:
+		var cmd payloads.DeleteGroup
+		err := unmarshalCommand(payload, &cmd)
+		return "", cmd.DeleteGroup.WorkloadAgentUUID, err
+	case ssntp.COLLECTDIAGNOSTICS:
+		var cmd payloads.CollectDiagnostics
+		err := unmarshalCommand(payload, &cmd)
+		return cmd.Collect.InstanceUUID, cmd.Collect.WorkloadAgentUUID, err
+	case ssntp.SECURITYGROUP:
+		var cmd payloads.SecurityGroupRules
+		err := unmarshalCommand(payload, &cmd)
+		return cmd.Group.InstanceUUID, cmd.Group.WorkloadAgentUUID, err
 	}
 }
 
-func (sched *ssntpSchedulerServer) fwdCmdToComputeNode(command ssntp.Command, payload []byte) (dest ssntp.ForwardDestination, instanceUUID string) {
+func (sched *ssntpSchedulerServer) fwdCmdToComputeNode(controllerUUID string, command ssntp.Command, payload []byte) (dest ssntp.ForwardDestination, instanceUUID string) {
 	// some commands require no scheduling choice, rather the specified
 	// agent/launcher needs the command instead of the scheduler
 	instanceUUID, cnDestUUID, err := sched.getWorkloadAgentUUID(command, payload)
-	if err != nil || cnDestUUID == "" {
-		glog.Errorf("Bad %s command yaml from Controller, WorkloadAgentUUID == %s\n", command.String(), cnDestUUID)
+	if err != nil {
+		clog.Errorf("Bad %s command yaml from Controller %s: %s\n", command.String(), controllerUUID, err)
+		sched.sendInvalidPayloadError(controllerUUID, ssntp.COMMAND, command, instanceUUID, err)
 		dest.SetDecision(ssntp.Discard)
 		return
 	}
 
-	glog.V(2).Infof("Forwarding controller %s command to %s\n", command.String(), cnDestUUID)
+	if command == ssntp.DELETE {
+		var send bool
+		if cnDestUUID, send = sched.deleteBackfill(instanceUUID, cnDestUUID); !send {
+			clog.V(2).Infof("Deleting preempted backfill instance %s\n", instanceUUID)
+			dest.SetDecision(ssntp.Discard)
+			return
+		}
+	}
+
+	if command == ssntp.SECURITYGROUP && sched.ssntp.PayloadVersion(cnDestUUID) < payloads.Version18 {
+		clog.Warningf("Node %s does not support security groups, dropping the rules of instance %s\n",
+			cnDestUUID, instanceUUID)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	clog.V(2).WithFields(clog.Fields{
+		clog.Command:      command.String(),
+		clog.InstanceUUID: instanceUUID,
+		clog.NodeUUID:     cnDestUUID,
+	}).Infof("Forwarding controller %s command to %s\n", command.String(), cnDestUUID)
 	dest.AddRecipient(cnDestUUID)
 
+	if stripped := withoutTenantToken(command, payload); stripped != nil {
+		dest.SetPayload(stripped)
+	}
+
+	if command == ssntp.DELETE {
+		sched.forgetPlacement(instanceUUID)
+	}
+
 	return
 }
 
 // Decrement resource claims for the referenced locked nodeStat object
 func (sched *ssntpSchedulerServer) decrementResourceUsage(node *nodeStat, workload *workResources) {
 	node.memAvailMB -= workload.memReqMB
+
+	for _, r := range []struct {
+		available *int
+		needed    int
+	}{
+		{&node.gpusAvail, workload.gpus},
+		{&node.coresAvail, workload.cores},
+		{&node.diskIOPSAvail, workload.diskIOPS},
+		{&node.ingressKbpsAvail, workload.ingressKbps},
+		{&node.egressKbpsAvail, workload.egressKbps},
+		{&node.cncisAvail, workload.cncis()},
+		{&node.cnciKbpsAvail, workload.cnciKbps()},
+		{&node.publicIPsAvail, workload.cncis()},
+	} {
+		if *r.available >= 0 {
+			*r.available -= r.needed
+		}
+	}
 }
 
 // Find suitable compute node, returning referenced to a locked nodeStat if found
 func (sched *ssntpSchedulerServer) pickComputeNode(controllerUUID string, workload *workResources) (node *nodeStat) {
+	if sched.extender != nil && workload.start != nil {
+		return sched.pickExtendedNode(controllerUUID, workload)
+	}
+
+	var tenantNodes map[string]int
+	if sched.placement == placeDomains && workload.start != nil {
+		tenantNodes = sched.tenantNodes(workload.start.TenantUUID)
+	}
+
 	sched.cnMutex.RLock()
 	defer sched.cnMutex.RUnlock()
 
@@ -519,15 +874,66 @@ func (sched *ssntpSchedulerServer) pickComputeNode(controllerUUID string, worklo
 		node := sched.cnList[0]
 		node.mutex.Lock()
 		if sched.workloadFits(sched.cnList[0], workload) == true {
-			node.mutex.Unlock()
 			return node
 		}
 		node.mutex.Unlock()
+		if node := sched.preemptBackfill(workload); node != nil {
+			return node
+		}
+		sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.FullCloud)
+		return nil
+	}
+
+	if sched.placement == placeDomains {
+		if node := sched.pickDomainNode(workload, tenantNodes); node != nil {
+			return node
+		}
+		if node := sched.preemptBackfill(workload); node != nil {
+			return node
+		}
+		sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.FullCloud)
 		return nil
 	}
 
-	/* First try nodes after the MRU */
-	if sched.cnMRUIndex != -1 && sched.cnMRUIndex < len(sched.cnList)-1 {
+	/* During a rolling upgrade, first try the upgraded nodes only */
+	if sched.upgrade.inProgress() {
+		if node := sched.pickListNode(workload, true); node != nil {
+			return node
+		}
+	}
+
+	if node := sched.pickListNode(workload, false); node != nil {
+		return node
+	}
+
+	/* Then fall back to the least stressed node */
+	if sched.thermal != nil || sched.pressure != nil {
+		if node := sched.pickCoolestNode(workload); node != nil {
+			return node
+		}
+	}
+
+	/* Then make room by preempting backfill instances */
+	if node := sched.preemptBackfill(workload); node != nil {
+		return node
+	}
+
+	sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.FullCloud)
+	return nil
+}
+
+// pickListNode returns a referenced, locked nodeStat object the workload
+// fits on, only considering the nodes that are not outdated if upgraded is
+// set, or nil if there is none.  Thermally stressed and memory pressured
+// nodes are skipped.  The caller must hold cnMutex.
+func (sched *ssntpSchedulerServer) pickListNode(workload *workResources, upgraded bool) *nodeStat {
+	fits := func(node *nodeStat) bool {
+		return (!upgraded || !node.outdated) && !sched.thermal.stressed(node) &&
+			!sched.pressure.pressured(node) && sched.workloadFits(node, workload)
+	}
+
+	/* First try nodes after the MRU, unless packing */
+	if sched.placement != placePack && sched.cnMRUIndex != -1 && sched.cnMRUIndex < len(sched.cnList)-1 {
 		for i, node := range sched.cnList[sched.cnMRUIndex+1:] {
 			node.mutex.Lock()
 			if node == sched.cnMRU {
@@ -535,10 +941,9 @@ func (sched *ssntpSchedulerServer) pickComputeNode(controllerUUID string, worklo
 				continue
 			}
 
-			if sched.workloadFits(node, workload) == true {
+			if fits(node) {
 				sched.cnMRUIndex = sched.cnMRUIndex + 1 + i
 				sched.cnMRU = node
-				node.mutex.Unlock()
 				return node
 			}
 			node.mutex.Unlock()
@@ -548,16 +953,14 @@ func (sched *ssntpSchedulerServer) pickComputeNode(controllerUUID string, worklo
 	/* Then try the whole list, including the MRU */
 	for i, node := range sched.cnList {
 		node.mutex.Lock()
-		if sched.workloadFits(node, workload) == true {
+		if fits(node) {
 			sched.cnMRUIndex = i
 			sched.cnMRU = node
-			node.mutex.Unlock()
 			return node
 		}
 		node.mutex.Unlock()
 	}
 
-	sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.FullCloud)
 	return nil
 }
 
@@ -575,38 +978,73 @@ func (sched *ssntpSchedulerServer) pickNetworkNode(controllerUUID string, worklo
 	for _, node := range sched.nnMap {
 		node.mutex.Lock()
 		if (len(sched.nnMap) <= 1 || ((len(sched.nnMap) > 1) && (node.uuid != sched.nnMRU))) &&
-			sched.workloadFits(node, workload) {
+			sched.networkNodeFits(node, workload) {
 			sched.nnMRU = node.uuid
-			node.mutex.Unlock()
 			return node
 		}
+		node.mutex.Unlock()
 	}
 
 	sched.sendStartFailureError(controllerUUID, workload.instanceUUID, payloads.NoNetworkNodes)
 	return nil
 }
 
+// deadlinePassed returns true if the START command has a deadline and it
+// is past.
+func deadlinePassed(start *payloads.StartCmd, now time.Time) bool {
+	deadline, ok := start.DeadlineTime()
+	return ok && !now.Before(deadline)
+}
+
 func (sched *ssntpSchedulerServer) startWorkload(controllerUUID string, payload []byte) (dest ssntp.ForwardDestination, instanceUUID string) {
 	var work payloads.Start
-	err := yaml.Unmarshal(payload, &work)
+	err := unmarshalCommand(payload, &work)
 	if err != nil {
-		glog.Errorf("Bad START workload yaml from Controller %s: %s\n", controllerUUID, err)
+		clog.Errorf("Bad START workload yaml from Controller %s: %s\n", controllerUUID, err)
+		sched.sendInvalidPayloadError(controllerUUID, ssntp.COMMAND, ssntp.START, work.Start.InstanceUUID, err)
 		dest.SetDecision(ssntp.Discard)
 		return dest, ""
 	}
 
-	workload, err := sched.getWorkloadResources(&work)
+	// the token only authenticates the tenant to the scheduler
+	tokened := work.Start.TenantToken != ""
+	work.Start.TenantToken = ""
+
+	flavored, err := sched.applyFlavor(&work)
 	if err != nil {
-		glog.Errorf("Bad START workload resource list from Controller %s: %s\n", controllerUUID, err)
+		clog.Errorf("Bad START workload from Controller %s: %s\n", controllerUUID, err)
+		sched.sendInvalidPayloadError(controllerUUID, ssntp.COMMAND, ssntp.START, work.Start.InstanceUUID, err)
 		dest.SetDecision(ssntp.Discard)
 		return dest, ""
 	}
 
+	var workload workResources
+	if flavored != nil {
+		workload = *flavored
+	} else {
+		workload = sched.getWorkloadResources(&work)
+	}
+
 	instanceUUID = workload.instanceUUID
 
+	if deadlinePassed(&work.Start, time.Now()) {
+		clog.Warningf("Instance %s missed its deadline %s\n", instanceUUID, work.Start.Deadline)
+		sched.sendStartFailureError(controllerUUID, instanceUUID, payloads.DeadlineExceeded)
+		dest.SetDecision(ssntp.Discard)
+		return dest, instanceUUID
+	}
+
+	if work.Start.Gang != nil {
+		sched.addGangMember(controllerUUID, &work, workload)
+		dest.SetDecision(ssntp.Discard)
+		return dest, instanceUUID
+	}
+
 	var targetNode *nodeStat
 
-	if workload.networkNode == 0 {
+	if work.Start.ReservationID != "" {
+		targetNode = sched.pickReservedNode(controllerUUID, &work.Start, &workload)
+	} else if workload.networkNode == 0 {
 		targetNode = sched.pickComputeNode(controllerUUID, &workload)
 	} else { //workload.network_node == 1
 		targetNode = sched.pickNetworkNode(controllerUUID, &workload)
@@ -622,6 +1060,30 @@ func (sched *ssntpSchedulerServer) startWorkload(controllerUUID string, payload
 
 		dest.AddRecipient(targetNode.uuid)
 		targetNode.mutex.Unlock()
+
+		if flavored != nil || tokened {
+			// the node needs the resources the controller left out,
+			// and must not receive the tenant token
+			expanded, err := payloads.Marshal(payloads.PayloadEncoding(payload), &work)
+			if err != nil {
+				clog.Errorf("Unable to marshal START workload of instance %s: %v\n", instanceUUID, err)
+			} else {
+				dest.SetPayload(expanded)
+			}
+		}
+
+		sched.recordPlacement(instanceUUID, targetNode.uuid, &workload)
+		if work.Start.Backfill {
+			sched.recordBackfill(controllerUUID, &work, workload, targetNode.uuid)
+		}
+		sched.audit.placement(controllerUUID, instanceUUID, work.Start.TenantUUID, targetNode.uuid)
+		sched.capacity.launched()
+		sched.setOwner(instanceUUID, controllerUUID)
+		clog.V(2).WithFields(clog.Fields{
+			clog.Command:      ssntp.START.String(),
+			clog.InstanceUUID: instanceUUID,
+			clog.NodeUUID:     targetNode.uuid,
+		}).Infof("Placing instance %s on node %s\n", instanceUUID, targetNode.uuid)
 	} else {
 		// TODO Queue the frame ?
 		dest.SetDecision(ssntp.Discard)
@@ -630,30 +1092,77 @@ func (sched *ssntpSchedulerServer) startWorkload(controllerUUID string, payload
 	return dest, instanceUUID
 }
 
+// isComputeNode returns true if uuid is a connected compute node.
+func (sched *ssntpSchedulerServer) isComputeNode(uuid string) bool {
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
+	return sched.cnMap[uuid] != nil
+}
+
+// fwdEvacuateRequest forwards the EVACUATE command a compute node sends to
+// ask to be evacuated, e.g., when one of its maintenance windows opens, to
+// all controllers.  A node may only ask for its own evacuation.
+func (sched *ssntpSchedulerServer) fwdEvacuateRequest(nodeUUID string, payload []byte) (dest ssntp.ForwardDestination) {
+	var cmd payloads.Evacuate
+	err := unmarshalCommand(payload, &cmd)
+	if err == nil && cmd.Evacuate.WorkloadAgentUUID != nodeUUID {
+		err = fmt.Errorf("node %s cannot ask for the evacuation of %s", nodeUUID,
+			cmd.Evacuate.WorkloadAgentUUID)
+	}
+	if err != nil {
+		clog.Warningf("Ignoring EVACUATE request: %v\n", err)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	clog.Infof("Node %s asks to be evacuated\n", nodeUUID)
+	dest.Broadcast(ssntp.Controller)
+	return
+}
+
 func (sched *ssntpSchedulerServer) CommandForward(controllerUUID string, command ssntp.Command, frame *ssntp.Frame) (dest ssntp.ForwardDestination) {
 	payload := frame.Payload
 	instanceUUID := ""
 
+	if command == ssntp.EVACUATE && sched.isComputeNode(controllerUUID) {
+		return sched.fwdEvacuateRequest(controllerUUID, payload)
+	}
+
 	sched.controllerMutex.RLock()
 	defer sched.controllerMutex.RUnlock()
 	if sched.controllerMap[controllerUUID] == nil {
-		glog.Warningf("Ignoring %s command from unknown Controller %s\n", command, controllerUUID)
+		clog.Warningf("Ignoring %s command from unknown Controller %s\n", command, controllerUUID)
 		dest.SetDecision(ssntp.Discard)
 		return
 	}
 	controller := sched.controllerMap[controllerUUID]
 	controller.mutex.Lock()
-	if controller.status != controllerMaster {
-		glog.Warningf("Ignoring %s command from non-master Controller %s\n", command, controllerUUID)
+	status := controller.status
+	controller.mutex.Unlock()
+
+	tenant := ""
+	if sched.audit != nil {
+		tenant = sched.commandTenant(command, payload)
+	}
+
+	if err := sched.mayCommand(controllerUUID, status, command, payload); err != nil {
+		clog.Warningf("Ignoring %s command: %v\n", command, err)
+		sched.audit.denial(controllerUUID, ssntp.Controller, command.String(), tenant, err)
+		dest.SetDecision(ssntp.Discard)
+		return
+	}
+
+	if err := sched.authenticateTenant(command, payload); err != nil {
+		clog.Warningf("Ignoring %s command: %v\n", command, err)
+		sched.audit.denial(controllerUUID, ssntp.Controller, command.String(), tenant, err)
+		sched.rejectUnauthenticated(controllerUUID, command, payload, err)
 		dest.SetDecision(ssntp.Discard)
-		controller.mutex.Unlock()
 		return
 	}
-	controller.mutex.Unlock()
 
 	start := time.Now()
 
-	glog.V(2).Infof("Command %s from %s\n", command, controllerUUID)
+	clog.V(2).Infof("Command %s from %s\n", command, controllerUUID)
 
 	switch command {
 	// the main command with scheduler processing
@@ -666,21 +1175,92 @@ func (sched *ssntpSchedulerServer) CommandForward(controllerUUID string, command
 	case ssntp.DELETE:
 		fallthrough
 	case ssntp.EVACUATE:
-		dest, instanceUUID = sched.fwdCmdToComputeNode(command, payload)
+		fallthrough
+	case ssntp.PREFETCH:
+		fallthrough
+	case ssntp.STOPGROUP:
+		fallthrough
+	case ssntp.DELETEGROUP:
+		fallthrough
+	case ssntp.COLLECTDIAGNOSTICS:
+		fallthrough
+	case ssntp.SECURITYGROUP:
+		dest, instanceUUID = sched.fwdCmdToComputeNode(controllerUUID, command, payload)
+	case ssntp.CONFIGURE:
+		dest = sched.configureCluster(controllerUUID, payload)
+	case ssntp.RESERVE:
+		dest = sched.reserveResources(controllerUUID, payload)
 	default:
 		dest.SetDecision(ssntp.Discard)
 	}
 
+	sched.audit.command(controllerUUID, command, instanceUUID, tenant)
+
 	elapsed := time.Since(start)
-	glog.V(2).Infof("%s command processed for instance %s in %s\n", command, instanceUUID, elapsed)
+	sched.latency.record(command, elapsed)
+	fields := clog.Fields{
+		clog.Command:      command.String(),
+		clog.InstanceUUID: instanceUUID,
+		clog.ElapsedMS:    elapsed.Seconds() * 1000,
+	}
+	if traceID := frame.TraceID(); traceID != "" {
+		fields["trace_id"] = traceID
+		clog.V(2).WithFields(fields).Infof("%s command processed for instance %s in %s, trace %s\n", command, instanceUUID, elapsed, traceID)
+	} else {
+		clog.V(2).WithFields(fields).Infof("%s command processed for instance %s in %s\n", command, instanceUUID, elapsed)
+	}
 
 	return
 }
 
+// configureCluster applies the settings of a new cluster configuration that
+// concern the scheduler, and broadcasts the configuration to every compute
+// and network node.
+func (sched *ssntpSchedulerServer) configureCluster(controllerUUID string, payload []byte) (dest ssntp.ForwardDestination) {
+	var configure payloads.Configure
+	err := unmarshalCommand(payload, &configure)
+	if err != nil {
+		clog.Errorf("Bad CONFIGURE yaml from Controller %s: %s\n", controllerUUID, err)
+		sched.sendInvalidPayloadError(controllerUUID, ssntp.COMMAND, ssntp.CONFIGURE, "", err)
+		dest.SetDecision(ssntp.Discard)
+		return dest
+	}
+
+	verbosity := sched.logVerbosity
+	if v := configure.Configure.Cluster.LogVerbosity; v != nil {
+		verbosity = fmt.Sprintf("%d", *v)
+	}
+	if verbosity != "" {
+		if err := flag.Set("v", verbosity); err != nil {
+			clog.Warningf("Unable to set log verbosity to %s: %v\n", verbosity, err)
+		}
+	}
+
+	if sched.upgrade.configure(configure.Configure.Cluster.Upgrade) {
+		sched.manageUpgrade()
+	}
+
+	dest.Broadcast(ssntp.AGENT | ssntp.NETAGENT)
+	return dest
+}
+
+// RejectNotify audits the frames the clients are not authorized to send.
+func (sched *ssntpSchedulerServer) RejectNotify(uuid string, role uint32, frame *ssntp.Frame) {
+	sched.audit.denial(uuid, role, frameOperand(frame), "", errFrameNotAuthorized)
+}
+
 func (sched *ssntpSchedulerServer) CommandNotify(uuid string, command ssntp.Command, frame *ssntp.Frame) {
-	// Currently all commands are handled by CommandForward, the SSNTP command forwader,
-	// or directly by role defined forwarding rules.
-	glog.V(2).Infof("COMMAND %v from %s\n", command, uuid)
+	// Apart from REPLAYEVENTS and TOPOLOGY, all commands are handled by
+	// CommandForward, the SSNTP command forwader, or directly by role
+	// defined forwarding rules.
+	clog.V(2).Infof("COMMAND %v from %s\n", command, uuid)
+
+	switch command {
+	case ssntp.REPLAYEVENTS:
+		sched.replayEvents(uuid, frame.Payload)
+	case ssntp.TOPOLOGY:
+		sched.sendTopology(uuid)
+	}
 }
 
 func (sched *ssntpSchedulerServer) EventForward(uuid string, event ssntp.Event, frame *ssntp.Frame) (dest ssntp.ForwardDestination) {
@@ -692,48 +1272,130 @@ func (sched *ssntpSchedulerServer) EventForward(uuid string, event ssntp.Event,
 	case ssntp.TenantAdded:
 		fallthrough
 	case ssntp.TenantRemoved:
-		fallthrough
+		sched.recordTenantEvent(uuid, event, payload)
+		dest = sched.fwdEventToCNCI(event, payload)
 	case ssntp.PublicIPAssigned:
+		if !sched.assignPublicIP(payload) {
+			dest.SetDecision(ssntp.Discard)
+			break
+		}
+		dest = sched.fwdEventToCNCI(event, payload)
+	case ssntp.PublicIPReleased:
+		sched.releasePublicIP(payload)
 		dest = sched.fwdEventToCNCI(event, payload)
+	case ssntp.InstanceDeleted:
+		fallthrough
+	case ssntp.InstanceReady:
+		fallthrough
+	case ssntp.InstanceStateChanged:
+		if sched.filterBackfillEvent(uuid, event, payload) {
+			dest.SetDecision(ssntp.Discard)
+			break
+		}
+		dest = sched.fwdEventToOwner(uuid, event, payload)
+	case ssntp.ImagePullProgress, ssntp.InstanceUnhealthy, ssntp.InstanceDiskFull:
+		dest = sched.fwdEventToOwner(uuid, event, payload)
 	}
 
 	elapsed := time.Since(start)
-	glog.V(2).Infof("%s event processed for instance %s in %s\n", event.String(), uuid, elapsed)
+	clog.V(2).WithFields(clog.Fields{
+		clog.Command:   event.String(),
+		clog.ElapsedMS: elapsed.Seconds() * 1000,
+	}).Infof("%s event processed for instance %s in %s\n", event.String(), uuid, elapsed)
 
 	return dest
 }
 
 func (sched *ssntpSchedulerServer) EventNotify(uuid string, event ssntp.Event, frame *ssntp.Frame) {
-	// Currently all events are handled by EventForward, the SSNTP command forwader,
-	// or directly by role defined forwarding rules.
-	glog.V(2).Infof("EVENT %v from %s\n", event, uuid)
+	// Apart from NodeCapabilities, WorkloadDefinition,
+	// PublicIPPoolRegistered and TenantNetworksReport, all events are
+	// handled by EventForward, the SSNTP command forwader, or directly by
+	// role defined forwarding rules.
+	clog.V(2).Infof("EVENT %v from %s\n", event, uuid)
+
+	switch event {
+	case ssntp.NodeCapabilities:
+		sched.updateNodeCapabilities(uuid, frame.Payload)
+		if sched.upgrade.active() {
+			sched.manageUpgrade()
+		}
+	case ssntp.WorkloadDefinition:
+		sched.registerFlavor(uuid, frame.Payload)
+	case ssntp.PublicIPPoolRegistered:
+		sched.registerPublicIPPool(uuid, frame.Payload)
+	case ssntp.TenantNetworksReport:
+		sched.checkTenantNetworks(uuid, frame.Payload)
+	}
+}
+
+// updateNodeCapabilities stores the capabilities a compute or network node
+// advertised when connecting, so that they can be matched against the
+// workloads to place.
+func (sched *ssntpSchedulerServer) updateNodeCapabilities(uuid string, payload []byte) {
+	var event payloads.EventNodeCapabilities
+	err := payloads.UnmarshalTolerant(payload, &event)
+	if err == nil {
+		err = payloads.Validate(&event)
+	}
+	if err != nil {
+		clog.Errorf("Bad NodeCapabilities yaml for node %s: %s\n", uuid, err)
+		sched.sendInvalidPayloadError(uuid, ssntp.EVENT, ssntp.NodeCapabilities, "", err)
+		return
+	}
+
+	sched.cnMutex.RLock()
+	defer sched.cnMutex.RUnlock()
+
+	sched.nnMutex.RLock()
+	defer sched.nnMutex.RUnlock()
+
+	node := sched.cnMap[uuid]
+	if node == nil {
+		node = sched.nnMap[uuid]
+	}
+	if node == nil {
+		clog.Warningf("NodeCapabilities error: no connected ssntp client with uuid=%s\n", uuid)
+		return
+	}
+
+	node.mutex.Lock()
+	node.capabilities = &event.Capabilities
+	node.mutex.Unlock()
 }
 
 func (sched *ssntpSchedulerServer) ErrorNotify(uuid string, error ssntp.Error, frame *ssntp.Frame) {
-	glog.V(2).Infof("ERROR %v from %s\n", error, uuid)
+	clog.V(2).Infof("ERROR %v from %s\n", error, uuid)
 }
 
-func setLimits() {
+// reservedFiles is the number of file descriptors not used for SSNTP
+// connections when deriving the maximum number of connections from the
+// open files limit.
+const reservedFiles = 256
+
+// setLimits raises the open files limit and returns it.
+func setLimits() uint64 {
 	var rlim syscall.Rlimit
 	err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlim)
 	if err != nil {
-		glog.Warningf("Getrlimit failed %v", err)
-		return
+		clog.Warningf("Getrlimit failed %v", err)
+		return 0
 	}
 
-	glog.Infof("Initial nofile limits: cur %d max %d", rlim.Cur, rlim.Max)
+	clog.Infof("Initial nofile limits: cur %d max %d", rlim.Cur, rlim.Max)
 
 	if rlim.Cur < rlim.Max {
 		oldCur := rlim.Cur
 		rlim.Cur = rlim.Max
 		err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlim)
 		if err != nil {
-			glog.Warningf("Setrlimit failed %v", err)
+			clog.Warningf("Setrlimit failed %v", err)
 			rlim.Cur = oldCur
 		}
 	}
 
-	glog.Infof("Updated nofile limits: cur %d max %d", rlim.Cur, rlim.Max)
+	clog.Infof("Updated nofile limits: cur %d max %d", rlim.Cur, rlim.Max)
+
+	return rlim.Cur
 }
 
 func heartBeatControllers(sched *ssntpSchedulerServer) (s string) {
@@ -808,6 +1470,20 @@ func heartBeatComputeNodes(sched *ssntpSchedulerServer) (s string) {
 	return s
 }
 
+// reloadCertificates reloads the scheduler certificates on SIGHUP, letting
+// operators rotate them without disconnecting the whole cluster.
+func reloadCertificates(sched *ssntpSchedulerServer) {
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGHUP)
+
+	for range signalCh {
+		clog.Info("Received SIGHUP, reloading certificates")
+		if err := sched.ssntp.ReloadCertificates(); err != nil {
+			clog.Errorf("Could not reload certificates: %s", err)
+		}
+	}
+}
+
 func heartBeat(sched *ssntpSchedulerServer) {
 	iter := 0
 	for {
@@ -836,52 +1512,51 @@ func heartBeat(sched *ssntpSchedulerServer) {
 	}
 }
 
-func main() {
-	var cert = flag.String("cert", "/etc/pki/ciao/cert-server-localhost.pem", "Server certificate")
-	var CAcert = flag.String("cacert", "/etc/pki/ciao/CAcert-server-localhost.pem", "CA certificate")
-	var cpuprofile = flag.String("cpuprofile", "", "Write cpu profile to file")
-	var heartbeat = flag.Bool("heartbeat", false, "Emit status heartbeat text")
-	var logDir = "/var/lib/ciao/logs/scheduler"
-
-	flag.Parse()
-
-	logDirFlag := flag.Lookup("log_dir")
-	if logDirFlag == nil {
-		glog.Errorf("log_dir does not exist")
-		return
-	}
-	if logDirFlag.Value.String() == "" {
-		logDirFlag.Value.Set(logDir)
-	}
-	if err := os.MkdirAll(logDirFlag.Value.String(), 0755); err != nil {
-		glog.Errorf("Unable to create log directory (%s) %v", logDir, err)
-		return
-	}
-
-	setLimits()
-
-	sched := newSsntpSchedulerServer()
-
-	if len(*cpuprofile) != 0 {
-		f, err := os.Create(*cpuprofile)
-		if err != nil {
-			log.Print(err)
-		}
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
-	}
-
-	//config.Trace = os.Stdout
-	//config.Error = os.Stdout
-	//config.DebugInterface = false
-
-	config := &ssntp.Config{
-		CAcert: *CAcert,
-		Cert:   *cert,
-		Role:   ssntp.SCHEDULER,
-	}
+// frameAuthorizations lists the frames each kind of node is expected to send
+// to the scheduler. Anything else is dropped when -authorize-frames is set.
+var frameAuthorizations = []ssntp.FrameAuthorization{
+	{
+		Role: ssntp.Controller,
+		Commands: []ssntp.Command{
+			ssntp.START, ssntp.STOP, ssntp.DELETE, ssntp.EVACUATE, ssntp.RESTART,
+			ssntp.AssignPublicIP, ssntp.ReleasePublicIP, ssntp.CONFIGURE, ssntp.PREFETCH,
+			ssntp.STOPGROUP, ssntp.DELETEGROUP, ssntp.COLLECTDIAGNOSTICS, ssntp.REPLAYEVENTS,
+			ssntp.SECURITYGROUP, ssntp.RESERVE, ssntp.TOPOLOGY,
+		},
+		Events: []ssntp.Event{ssntp.WorkloadDefinition, ssntp.PublicIPPoolRegistered},
+		Errors: []ssntp.Error{ssntp.InvalidFrameType, ssntp.InvalidConfiguration},
+	},
+	{
+		Role:     ssntp.AGENT | ssntp.NETAGENT,
+		Commands: []ssntp.Command{ssntp.STATS, ssntp.EVACUATE},
+		Statuses: []ssntp.Status{ssntp.READY, ssntp.FULL, ssntp.OFFLINE, ssntp.MAINTENANCE},
+		Events: []ssntp.Event{
+			ssntp.TenantAdded, ssntp.TenantRemoved, ssntp.InstanceDeleted, ssntp.TraceReport,
+			ssntp.InstanceReady, ssntp.DiagnosticsData, ssntp.AttestationQuote,
+			ssntp.NodeCapabilities, ssntp.InstanceStateChanged, ssntp.TenantNetworksReport,
+			ssntp.ImagePullProgress, ssntp.InstanceUnhealthy, ssntp.InstanceDiskFull,
+		},
+		Errors: []ssntp.Error{
+			ssntp.InvalidFrameType, ssntp.StartFailure, ssntp.StopFailure, ssntp.RestartFailure,
+			ssntp.DeleteFailure, ssntp.InvalidConfiguration,
+		},
+		Streams: true,
+	},
+	{
+		Role:     ssntp.CNCIAGENT,
+		Statuses: []ssntp.Status{ssntp.READY},
+		Events: []ssntp.Event{
+			ssntp.ConcentratorInstanceAdded, ssntp.PublicIPAssigned, ssntp.TraceReport,
+			ssntp.PublicIPPoolRegistered, ssntp.PublicIPReleased,
+		},
+		Errors: []ssntp.Error{ssntp.InvalidFrameType, ssntp.InvalidConfiguration},
+	},
+}
 
-	config.ForwardRules = []ssntp.FrameForwardRule{
+// forwardRules returns the SSNTP forwarding rules of the scheduler, routing
+// node reports to the controllers and controller commands through sched.
+func (sched *ssntpSchedulerServer) forwardRules() []ssntp.FrameForwardRule {
+	return []ssntp.FrameForwardRule{
 		{ // all STATS commands go to all Controllers
 			Operand: ssntp.STATS,
 			Dest:    ssntp.Controller,
@@ -890,25 +1565,53 @@ func main() {
 			Operand: ssntp.TraceReport,
 			Dest:    ssntp.Controller,
 		},
-		{ // all InstanceDeleted events go to all Controllers
-			Operand: ssntp.InstanceDeleted,
+		{ // all InstanceDeleted events are processed by the Event forwarder
+			Operand:      ssntp.InstanceDeleted,
+			EventForward: sched,
+		},
+		{ // all InstanceReady events are processed by the Event forwarder
+			Operand:      ssntp.InstanceReady,
+			EventForward: sched,
+		},
+		{ // all DiagnosticsData events go to all Controllers
+			Operand: ssntp.DiagnosticsData,
+			Dest:    ssntp.Controller,
+		},
+		{ // all AttestationQuote events go to all Controllers
+			Operand: ssntp.AttestationQuote,
 			Dest:    ssntp.Controller,
 		},
+		{ // all InstanceStateChanged events are processed by the Event forwarder
+			Operand:      ssntp.InstanceStateChanged,
+			EventForward: sched,
+		},
+		{ // all ImagePullProgress events are processed by the Event forwarder
+			Operand:      ssntp.ImagePullProgress,
+			EventForward: sched,
+		},
+		{ // all InstanceUnhealthy events are processed by the Event forwarder
+			Operand:      ssntp.InstanceUnhealthy,
+			EventForward: sched,
+		},
+		{ // all InstanceDiskFull events are processed by the Event forwarder
+			Operand:      ssntp.InstanceDiskFull,
+			EventForward: sched,
+		},
 		{ // all ConcentratorInstanceAdded events go to all Controllers
 			Operand: ssntp.ConcentratorInstanceAdded,
 			Dest:    ssntp.Controller,
 		},
-		{ // all StartFailure events go to all Controllers
-			Operand: ssntp.StartFailure,
-			Dest:    ssntp.Controller,
+		{ // all StartFailure events are processed by the Error forwarder
+			Operand:      ssntp.StartFailure,
+			ErrorForward: sched,
 		},
-		{ // all StopFailure events go to all Controllers
-			Operand: ssntp.StopFailure,
-			Dest:    ssntp.Controller,
+		{ // all StopFailure events are processed by the Error forwarder
+			Operand:      ssntp.StopFailure,
+			ErrorForward: sched,
 		},
-		{ // all RestartFailure events go to all Controllers
-			Operand: ssntp.RestartFailure,
-			Dest:    ssntp.Controller,
+		{ // all RestartFailure events are processed by the Error forwarder
+			Operand:      ssntp.RestartFailure,
+			ErrorForward: sched,
 		},
 		{ // all START command are processed by the Command forwarder
 			Operand:        ssntp.START,
@@ -930,6 +1633,34 @@ func main() {
 			Operand:        ssntp.EVACUATE,
 			CommandForward: sched,
 		},
+		{ // all PREFETCH command are processed by the Command forwarder
+			Operand:        ssntp.PREFETCH,
+			CommandForward: sched,
+		},
+		{ // all STOPGROUP command are processed by the Command forwarder
+			Operand:        ssntp.STOPGROUP,
+			CommandForward: sched,
+		},
+		{ // all DELETEGROUP command are processed by the Command forwarder
+			Operand:        ssntp.DELETEGROUP,
+			CommandForward: sched,
+		},
+		{ // all COLLECTDIAGNOSTICS command are processed by the Command forwarder
+			Operand:        ssntp.COLLECTDIAGNOSTICS,
+			CommandForward: sched,
+		},
+		{ // all SECURITYGROUP command are processed by the Command forwarder
+			Operand:        ssntp.SECURITYGROUP,
+			CommandForward: sched,
+		},
+		{ // all CONFIGURE command are processed by the Command forwarder
+			Operand:        ssntp.CONFIGURE,
+			CommandForward: sched,
+		},
+		{ // all RESERVE command are processed by the Command forwarder
+			Operand:        ssntp.RESERVE,
+			CommandForward: sched,
+		},
 		{ // all TenantAdded events are processed by the Event forwarder
 			Operand:      ssntp.TenantAdded,
 			EventForward: sched,
@@ -942,11 +1673,296 @@ func main() {
 			Operand:      ssntp.PublicIPAssigned,
 			EventForward: sched,
 		},
+		{ // all PublicIPReleased events are processed by the Event forwarder
+			Operand:      ssntp.PublicIPReleased,
+			EventForward: sched,
+		},
+	}
+}
+
+func main() {
+	var cert = flag.String("cert", "/etc/pki/ciao/cert-server-localhost.pem", "Server certificate")
+	var CAcert = flag.String("cacert", "/etc/pki/ciao/CAcert-server-localhost.pem", "CA certificate")
+	var crl = flag.String("crl", "", "Certificate revocation list to check node certificates against")
+	var checkOCSP = flag.Bool("ocsp", false, "Check node certificates with their OCSP responders")
+	var transport = flag.String("transport", "tcp", "SSNTP transport, tcp or websocket")
+	var port = flag.Uint("port", 0, "SSNTP port, 0 for the default 8888")
+	var metricsAddr = flag.String("metrics-addr", "", "Address to serve SSNTP metrics and command latencies, at /debug/vars, and capacity forecasts, at /capacity, on, empty to disable")
+	var record = flag.String("record", "", "File to record the SSNTP frames exchanged with nodes to, for replaying them with ciao-replay")
+	var authorizeFrames = flag.Bool("authorize-frames", true, "Drop the frames nodes are not expected to send given their role")
+	var cpuprofile = flag.String("cpuprofile", "", "Write cpu profile to file")
+	var heartbeat = flag.Bool("heartbeat", false, "Emit status heartbeat text")
+	var keepaliveInterval = flag.Duration("keepalive-interval", 10*time.Second, "Interval between SSNTP keepalives, 0 to disable")
+	var keepaliveTimeout = flag.Duration("keepalive-timeout", 0, "Time after which a silent node is disconnected, 0 for three keepalive intervals")
+	var sendQueue = flag.Int("send-queue", 1024, "Maximum number of frames queued for each node, 0 to send frames straight away")
+	var sendQueueOverflow = ssntp.DropTelemetry
+	flag.Var(&sendQueueOverflow, "send-queue-overflow", "What to do when a node send queue is full: drop-oldest, drop-telemetry or disconnect")
+	var sendTimeout = flag.Duration("send-timeout", 10*time.Second, "Time after which frames a slow node could not take are dropped, 0 for no limit")
+	var maxConnections = flag.Int("max-connections", 0, "Maximum number of SSNTP connections, 0 to derive it from the open files limit, -1 for no limit")
+	var maxAgentConnections = flag.Int("max-agent-connections", 0, "Maximum number of compute node connections, 0 for no limit")
+	var maxNetAgentConnections = flag.Int("max-netagent-connections", 0, "Maximum number of network node connections, 0 for no limit")
+	var acceptRate = flag.Float64("accept-rate", 0, "Maximum number of SSNTP connections accepted per second, 0 for no limit")
+	var acceptBurst = flag.Int("accept-burst", 32, "Number of SSNTP connections that can be accepted at once when -accept-rate is set")
+	var snapshotFile = flag.String("snapshot", "/var/lib/ciao/scheduler/snapshot.yaml", "File the cluster snapshot is written to on SIGUSR1")
+	var snapshotFormat = flag.String("snapshot-format", "yaml", "Cluster snapshot format, yaml or json")
+	var alertWebhook = flag.String("alert-webhook", "", "URL critical cluster alerts are posted to as JSON, empty to disable")
+	var alertCooldown = flag.Duration("alert-cooldown", 10*time.Minute, "Minimum time between two identical alerts")
+	var alertStartFailures = flag.Int("alert-start-failures", 5, "Number of start failures a node reports within -alert-start-failure-window that raises an alert, 0 to disable")
+	var alertStartFailureWindow = flag.Duration("alert-start-failure-window", 10*time.Minute, "Window in which start failures are counted")
+	var clockSkewThreshold = flag.Duration("clock-skew-threshold", time.Second, "Offset between the clocks of a node and the scheduler above which a warning is logged and alerted, 0 to disable the check")
+	var commandSLO = flag.Duration("command-slo", 0, "99th percentile of the controller command processing times above which a warning is logged and alerted, 0 to disable")
+	var gangTimeout = flag.Duration("gang-timeout", defaultGangTimeout, "Time to wait for the START commands of all the members of a gang before failing it")
+	var thermalLimit = flag.Int("thermal-limit", 0, "CPU temperature, in degrees Celsius, from which compute nodes only get instances that fit nowhere else, 0 to disable")
+	var powerLimit = flag.Int("power-limit", 0, "Power draw, in watts, from which compute nodes only get instances that fit nowhere else, 0 to disable")
+	var memPressureLimit = flag.Float64("mem-pressure-limit", 0, "Memory pressure, in percentage of time tasks stalled on memory, from which compute nodes only get instances that fit nowhere else, 0 to disable")
+	var standbyURL = flag.String("standby", "", "URL of the standby scheduler the placements and instance owners are replicated to, empty to disable")
+	var replicationInterval = flag.Duration("replication-interval", defaultReplicationInterval, "Interval between two shipments of placement log entries to the standby scheduler")
+	var replicationSnapshotInterval = flag.Duration("replication-snapshot-interval", defaultReplicationSnapshotInterval, "Interval between two full state snapshots shipped to the standby scheduler")
+	var replicationAddr = flag.String("replication-addr", "", "Address to receive the state of the active scheduler on, as a standby taking over when its first SSNTP client connects, empty to disable")
+	var replicationKey = flag.String("replication-key", "", "File containing the key replication messages are authenticated with, required with -standby and -replication-addr")
+	var backfillHeadroom = flag.Int("backfill-headroom", defaultBackfillHeadroom, "Percentage of the memory of a compute node that must stay free after placing a backfill instance on it")
+	var placement = placeSpread
+	flag.Var(&placement, "placement", "Compute node placement policy, spread, pack or domains")
+	var domainLevel = domainRack
+	flag.Var(&domainLevel, "failure-domain", "Failure domains the instances of a tenant are spread across in domains placement mode, rack, chassis or pdu")
+	var powerIdle = flag.Duration("power-idle", 0, "Time after which a compute node without instances is powered down, in pack mode, 0 to disable")
+	var powerWakeBacklog = flag.Int("power-wake-backlog", 1, "Number of START commands that could not be placed after which a powered down compute node is woken up")
+	var wolAddr = flag.String("wol-addr", defaultWakeOnLANAddr, "UDP address wake-on-LAN packets are broadcast to")
+	var journalSize = flag.Int("event-journal", defaultJournalSize, "Number of node and instance events kept for reconnecting controllers to replay, 0 to disable")
+	var tenantsFile = flag.String("controller-tenants", "", "YAML file of the tenants each controller may send commands for, empty for only the master controller to send commands")
+	var tenantTokenKey = flag.String("tenant-token-key", "", "File containing the key shared with the tenant token issuer, for HS256 tokens")
+	var tenantTokenJWKS = flag.String("tenant-token-jwks", "", "URL of the JSON Web Key Set of the tenant token issuer, for RS256 and ES256 tokens")
+	var tenantTokenJWKSRefresh = flag.Duration("tenant-token-jwks-refresh", defaultJWKSRefresh, "Interval between two downloads of the tenant token JWKS")
+	var auditSyslog = flag.String("audit-syslog", "", "Syslog the security audit records are sent to in CEF, local, udp://host:port or tcp://host:port, empty to disable")
+	var auditKafka = flag.String("audit-kafka", "", "URL of the Kafka REST proxy the security audit records are produced through, empty to disable")
+	var auditKafkaTopic = flag.String("audit-kafka-topic", "ciao-audit", "Kafka topic the security audit records are produced to")
+	var extenderURL = flag.String("extender", "", "URL the candidate compute nodes of each instance are posted to for filtering and reordering, empty to disable")
+	var extenderTimeout = flag.Duration("extender-timeout", defaultExtenderTimeout, "Time after which the placement extender is considered to have failed")
+	var extenderFailure = extenderFailOpen
+	flag.Var(&extenderFailure, "extender-failure", "What to do when the placement extender fails: open to place instances without it, closed to refuse them")
+	var logFormat clog.Format
+	flag.Var(&logFormat, "log-format", "Log format, glog or json, json writing one object per line to stderr (default glog)")
+	var logDir = "/var/lib/ciao/logs/scheduler"
+
+	flag.Parse()
+	clog.Init("ciao-scheduler", logFormat)
+
+	snapshotEncoding, err := payloads.ParseEncoding(*snapshotFormat)
+	if err != nil || snapshotEncoding == payloads.MsgPack {
+		clog.Errorf("Unsupported snapshot format %s", *snapshotFormat)
+		return
+	}
+
+	logDirFlag := flag.Lookup("log_dir")
+	if logDirFlag == nil {
+		clog.Errorf("log_dir does not exist")
+		return
+	}
+	if logDirFlag.Value.String() == "" {
+		logDirFlag.Value.Set(logDir)
+	}
+	if err := os.MkdirAll(logDirFlag.Value.String(), 0755); err != nil {
+		clog.Errorf("Unable to create log directory (%s) %v", logDir, err)
+		return
 	}
 
+	nofile := setLimits()
+	if *maxConnections == 0 && nofile > reservedFiles {
+		*maxConnections = int(nofile - reservedFiles)
+	}
+	clog.Infof("Accepting at most %d SSNTP connections", *maxConnections)
+
+	sched := newSsntpSchedulerServer()
+	sched.sendTimeout = *sendTimeout
+	sched.gangTimeout = *gangTimeout
+	if *backfillHeadroom < 0 || *backfillHeadroom > 100 {
+		clog.Errorf("Invalid backfill headroom %d%%", *backfillHeadroom)
+		return
+	}
+	sched.backfillHeadroom = *backfillHeadroom
+	if *thermalLimit > 0 || *powerLimit > 0 {
+		sched.thermal = newThermalScorer(*thermalLimit, *powerLimit)
+	}
+	if *memPressureLimit > 0 {
+		sched.pressure = newPressureScorer(*memPressureLimit)
+	}
+	sched.placement = placement
+	sched.domainLevel = domainLevel
+	if *powerIdle > 0 {
+		if placement != placePack {
+			clog.Errorf("Compute nodes can only be powered down with -placement pack")
+			return
+		}
+		sched.power = newPowerManager(*powerIdle, *powerWakeBacklog, *wolAddr)
+	}
+	if *extenderURL != "" {
+		sched.extender = newPlacementExtender(*extenderURL, *extenderTimeout, extenderFailure)
+	}
+	if *journalSize > 0 {
+		sched.journal = newEventJournal(*journalSize)
+	}
+	if *alertWebhook != "" {
+		sched.alerts = newAlertNotifier(*alertWebhook, *alertCooldown, *alertStartFailures, *alertStartFailureWindow)
+	}
+	sched.latency = newLatencyTracker(*commandSLO, sched.alerts)
+	if *clockSkewThreshold > 0 {
+		sched.clockSkew = newClockSkewTracker(*clockSkewThreshold, sched.alerts)
+	}
+	if v := flag.Lookup("v"); v != nil {
+		sched.logVerbosity = v.Value.String()
+	}
+	if *tenantsFile != "" {
+		sched.tenants, err = loadControllerTenants(*tenantsFile)
+		if err != nil {
+			clog.Errorf("Unable to load controller tenants: %v", err)
+			return
+		}
+	}
+	if *tenantTokenKey != "" || *tenantTokenJWKS != "" {
+		var key []byte
+		if *tenantTokenKey != "" {
+			key, err = ioutil.ReadFile(*tenantTokenKey)
+			if err != nil {
+				clog.Errorf("Unable to load tenant token key: %v", err)
+				return
+			}
+			key = bytes.TrimSpace(key)
+		}
+		sched.tenantTokens = newTenantTokenVerifier(key, *tenantTokenJWKS)
+		if *tenantTokenJWKS != "" {
+			go sched.tenantTokens.refreshKeysLoop(*tenantTokenJWKSRefresh)
+		}
+	}
+	if *standbyURL != "" || *replicationAddr != "" {
+		// Anyone who can reach the standby could otherwise replace
+		// the placements and instance owners it takes over with.
+		if *replicationKey == "" {
+			clog.Errorf("-replication-key is required with -standby and -replication-addr")
+			return
+		}
+		key, err := ioutil.ReadFile(*replicationKey)
+		if err != nil {
+			clog.Errorf("Unable to load replication key: %v", err)
+			return
+		}
+		key = bytes.TrimSpace(key)
+		if len(key) == 0 {
+			clog.Errorf("Replication key %s is empty", *replicationKey)
+			return
+		}
+		if *standbyURL != "" {
+			sched.replicator = newReplicator(*standbyURL, key)
+		}
+		if *replicationAddr != "" {
+			sched.replica = newReplica(sched, key)
+		}
+	}
+	var auditSinks []auditSink
+	if *auditSyslog != "" {
+		sink, err := newSyslogSink(*auditSyslog)
+		if err != nil {
+			clog.Errorf("Unable to connect to audit syslog: %v", err)
+			return
+		}
+		auditSinks = append(auditSinks, sink)
+	}
+	if *auditKafka != "" {
+		auditSinks = append(auditSinks, newKafkaSink(*auditKafka, *auditKafkaTopic))
+	}
+	if len(auditSinks) > 0 {
+		sched.audit = newAuditLogger(auditSinks...)
+	}
+
+	if len(*cpuprofile) != 0 {
+		f, err := os.Create(*cpuprofile)
+		if err != nil {
+			log.Print(err)
+		}
+		pprof.StartCPUProfile(f)
+		defer pprof.StopCPUProfile()
+	}
+
+	//config.Trace = os.Stdout
+	//config.Error = os.Stdout
+	//config.DebugInterface = false
+
+	config := &ssntp.Config{
+		CAcert:            *CAcert,
+		Cert:              *cert,
+		Role:              ssntp.SCHEDULER,
+		KeepaliveInterval: *keepaliveInterval,
+		KeepaliveTimeout:  *keepaliveTimeout,
+		ForwardTimeout:    *sendTimeout,
+		SendQueueLength:   *sendQueue,
+		SendQueueOverflow: sendQueueOverflow,
+		Encodings:         []payloads.Encoding{payloads.MsgPack, payloads.JSON},
+		AtLeastOnce:       true,
+		Transport:         *transport,
+		Port:              uint32(*port),
+		Recording:         *record,
+		CRL:               *crl,
+		OCSP:              *checkOCSP,
+		AcceptRate:        *acceptRate,
+		AcceptBurst:       *acceptBurst,
+	}
+
+	if *maxConnections > 0 {
+		config.MaxConnections = *maxConnections
+	}
+
+	config.MaxRoleConnections = make(map[uint32]int)
+	if *maxAgentConnections > 0 {
+		config.MaxRoleConnections[ssntp.AGENT] = *maxAgentConnections
+	}
+	if *maxNetAgentConnections > 0 {
+		config.MaxRoleConnections[ssntp.NETAGENT] = *maxNetAgentConnections
+	}
+
+	if *authorizeFrames {
+		config.Authorizations = frameAuthorizations
+	}
+
+	if *metricsAddr != "" {
+		config.Metrics = ssntp.NewExpvarMetrics("ssntp")
+		http.HandleFunc("/capacity", sched.capacityHandler)
+		expvar.Publish("command_latency", expvar.Func(func() interface{} {
+			return sched.latency.stats()
+		}))
+		expvar.Publish("clock_skew", expvar.Func(func() interface{} {
+			return sched.clockSkew.stats()
+		}))
+		go sampleCapacityLoop(sched, capacitySampleInterval)
+		go func() {
+			err := http.ListenAndServe(*metricsAddr, nil)
+			clog.Errorf("Metrics service exited: %v", err)
+		}()
+	}
+
+	config.ForwardRules = sched.forwardRules()
+
 	if *heartbeat {
 		go heartBeat(sched)
 	}
 
+	if sched.power != nil {
+		go managePowerLoop(sched)
+	}
+
+	go manageUpgradeLoop(sched)
+
+	if sched.replicator != nil {
+		go replicateLoop(sched, *replicationInterval, *replicationSnapshotInterval)
+	}
+
+	if sched.replica != nil {
+		go func() {
+			err := http.ListenAndServe(*replicationAddr, sched.replica)
+			clog.Errorf("Replication service exited: %v", err)
+		}()
+	}
+
+	go reloadCertificates(sched)
+	go dumpSnapshots(sched, *snapshotFile, snapshotEncoding)
+
 	sched.ssntp.Serve(config, sched)
 }
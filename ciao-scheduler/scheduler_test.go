@@ -0,0 +1,2205 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
+)
+
+// Checks that an instance is placed on the only node with enough memory
+// for it.
+//
+// Test is expected to pass.
+func TestPlacementMemoryFit(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	cluster.addComputeNode(testReady(512))
+	large := cluster.addComputeNode(testReady(4096))
+
+	instance := controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, large)
+}
+
+// Checks that consecutive instances are spread over the nodes that can
+// take them.
+//
+// Test is expected to pass.
+func TestPlacementSpread(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	first := cluster.addComputeNode(testReady(4096))
+	second := cluster.addComputeNode(testReady(4096))
+
+	instance := controller.start(testWorkload(256))
+	result := cluster.nextResult(instance)
+
+	other := second
+	if result.node == second.uuid {
+		other = first
+	}
+
+	instance = controller.start(testWorkload(256))
+	cluster.expectPlacement(instance, other)
+}
+
+// Checks that the memory of the instances sent to a node is deducted
+// from the memory it reported, until the cloud is full.
+//
+// Test is expected to pass.
+func TestPlacementFullCloud(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(2048))
+
+	for i := 0; i < 2; i++ {
+		instance := controller.start(testWorkload(1024))
+		cluster.expectPlacement(instance, node)
+	}
+
+	instance := controller.start(testWorkload(1024))
+	cluster.expectStartFailure(instance, payloads.FullCloud)
+
+	node.sendReady(testReady(2048))
+	instance = controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, node)
+}
+
+// Checks that instances are refused when no compute node is connected.
+//
+// Test is expected to pass.
+func TestPlacementNoComputeNodes(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	cluster.addNetworkNode(testReady(4096))
+
+	instance := controller.start(testWorkload(256))
+	cluster.expectStartFailure(instance, payloads.NoComputeNodes)
+}
+
+// Checks that instances requesting a network node are only placed on
+// network nodes.
+//
+// Test is expected to pass.
+func TestPlacementNetworkNode(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	cluster.addComputeNode(testReady(4096))
+
+	workload := testWorkload(256)
+	workload.Start.RequestedResources = append(workload.Start.RequestedResources,
+		payloads.RequestedResource{Type: payloads.NetworkNode, Value: 1})
+
+	instance := controller.start(workload)
+	cluster.expectStartFailure(instance, payloads.NoNetworkNodes)
+
+	networkNode := cluster.addNetworkNode(testReady(4096))
+
+	workload.Start.InstanceUUID = testWorkload(256).Start.InstanceUUID
+	instance = controller.start(workload)
+	cluster.expectPlacement(instance, networkNode)
+}
+
+// Checks that CNCIs are placed on the network nodes reporting the
+// resources their CNCIs consume according to these resources, rather than
+// to their memory.
+//
+// Test is expected to pass.
+func TestPlacementCNCIResources(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+
+	cnci := func(egressKbps int) string {
+		workload := testWorkload(256)
+		workload.Start.RequestedResources = append(workload.Start.RequestedResources,
+			payloads.RequestedResource{Type: payloads.NetworkNode, Value: 1},
+			payloads.RequestedResource{Type: payloads.NetEgressKbps, Value: egressKbps})
+		return controller.start(workload)
+	}
+
+	ready := testReady(128)
+	ready.CNCIsTotal, ready.CNCIsAvailable = 4, 4
+	ready.PublicIPsTotal, ready.PublicIPsAvailable = 8, 1
+	small := cluster.addNetworkNode(ready)
+
+	instance := cnci(1000)
+	cluster.expectPlacement(instance, small)
+
+	instance = cnci(1000)
+	cluster.expectStartFailure(instance, payloads.NoNetworkNodes)
+
+	ready = testReady(4096)
+	ready.CNCIBandwidthKbps, ready.CNCIBandwidthKbpsAvailable = 1000, 500
+	large := cluster.addNetworkNode(ready)
+
+	instance = cnci(1000)
+	cluster.expectStartFailure(instance, payloads.NoNetworkNodes)
+
+	instance = cnci(400)
+	cluster.expectPlacement(instance, large)
+
+	instance = cnci(400)
+	cluster.expectStartFailure(instance, payloads.NoNetworkNodes)
+}
+
+// Checks that instances are only placed on nodes whose advertised
+// capabilities satisfy them.
+//
+// Test is expected to pass.
+func TestPlacementCapabilities(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	qemu := cluster.addComputeNode(testReady(4096))
+	docker := cluster.addComputeNode(testReady(4096))
+
+	qemu.sendCapabilities(payloads.NodeCapabilities{
+		Hypervisors: []payloads.HypervisorCapability{{Type: payloads.QEMU}},
+	})
+	docker.sendCapabilities(payloads.NodeCapabilities{
+		Hypervisors: []payloads.HypervisorCapability{{Type: payloads.Docker}},
+	})
+
+	for i := 0; i < 2; i++ {
+		workload := testWorkload(256)
+		workload.Start.VMType = payloads.Docker
+		workload.Start.DockerImage = "ubuntu"
+
+		instance := controller.start(workload)
+		cluster.expectPlacement(instance, docker)
+	}
+}
+
+// Checks that instances are only placed on nodes of the architecture their
+// image was built for, and that nodes not reporting their architecture are
+// not filtered.
+//
+// Test is expected to pass.
+func TestPlacementArchitecture(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	x86 := cluster.addComputeNode(testReady(4096))
+	arm := cluster.addComputeNode(testReady(4096))
+
+	x86.sendCapabilities(payloads.NodeCapabilities{
+		Hypervisors:  []payloads.HypervisorCapability{{Type: payloads.QEMU}},
+		Architecture: payloads.X86_64,
+	})
+	arm.sendCapabilities(payloads.NodeCapabilities{
+		Hypervisors:  []payloads.HypervisorCapability{{Type: payloads.QEMU}},
+		Architecture: payloads.AArch64,
+	})
+
+	for i := 0; i < 2; i++ {
+		workload := testWorkload(256)
+		workload.Start.ImageArchitecture = payloads.AArch64
+
+		instance := controller.start(workload)
+		cluster.expectPlacement(instance, arm)
+	}
+
+	workload := testWorkload(256)
+	workload.Start.ImageArchitecture = "ppc64le"
+	instance := controller.start(workload)
+	cluster.expectStartFailure(instance, payloads.FullCloud)
+
+	unknown := cluster.addComputeNode(testReady(4096))
+	unknown.sendCapabilities(payloads.NodeCapabilities{
+		Hypervisors: []payloads.HypervisorCapability{{Type: payloads.QEMU}},
+	})
+
+	instance = controller.start(workload)
+	cluster.expectPlacement(instance, unknown)
+}
+
+// Checks that instances requiring minimum hypervisor or kernel versions are
+// only placed on nodes reporting recent enough versions.
+//
+// Test is expected to pass.
+func TestPlacementVersions(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	old := cluster.addComputeNode(testReady(4096))
+	recent := cluster.addComputeNode(testReady(4096))
+	unknown := cluster.addComputeNode(testReady(4096))
+
+	old.sendCapabilities(payloads.NodeCapabilities{
+		Hypervisors:   []payloads.HypervisorCapability{{Type: payloads.QEMU, Version: "2.5.0"}},
+		KernelVersion: "4.4.0-21-generic",
+	})
+	recent.sendCapabilities(payloads.NodeCapabilities{
+		Hypervisors:   []payloads.HypervisorCapability{{Type: payloads.QEMU, Version: "2.11.1"}},
+		KernelVersion: "4.15.0-112-generic",
+	})
+	unknown.sendCapabilities(payloads.NodeCapabilities{
+		Hypervisors: []payloads.HypervisorCapability{{Type: payloads.QEMU}},
+	})
+
+	for _, req := range []payloads.NodeRequirements{
+		{MinHypervisorVersion: "2.11"},
+		{MinKernelVersion: "4.14"},
+		{MinHypervisorVersion: "2.6", MinKernelVersion: "4.15.0"},
+	} {
+		workload := testWorkload(256)
+		workload.Start.Requirements = &req
+
+		instance := controller.start(workload)
+		cluster.expectPlacement(instance, recent)
+	}
+
+	workload := testWorkload(256)
+	workload.Start.Requirements = &payloads.NodeRequirements{MinKernelVersion: "5.4"}
+	instance := controller.start(workload)
+	cluster.expectStartFailure(instance, payloads.FullCloud)
+}
+
+// Checks that in domains mode the instances of a tenant are spread across
+// racks, that nodes not reporting their rack are racks of their own, and
+// that nodes of a rack already hosting the tenant are only used once the
+// other racks host as many instances.
+//
+// Test is expected to pass.
+func TestPlacementFailureDomains(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	cluster.sched.placement = placeDomains
+
+	controller := cluster.addController()
+	r1a := cluster.addComputeNode(testReady(4096))
+	r1b := cluster.addComputeNode(testReady(4096))
+	r2 := cluster.addComputeNode(testReady(4096))
+	unknown := cluster.addComputeNode(testReady(4096))
+
+	for _, n := range []struct {
+		node *testNode
+		rack string
+	}{{r1a, "r1"}, {r1b, "r1"}, {r2, "r2"}} {
+		n.node.sendCapabilities(payloads.NodeCapabilities{
+			Hypervisors:   []payloads.HypervisorCapability{{Type: payloads.QEMU}},
+			FailureDomain: &payloads.FailureDomain{Rack: n.rack},
+		})
+	}
+
+	tenant := uuid.Generate().String()
+	for _, node := range []*testNode{r1a, r2, unknown, r1b} {
+		workload := testWorkload(256)
+		workload.Start.TenantUUID = tenant
+
+		instance := controller.start(workload)
+		cluster.expectPlacement(instance, node)
+	}
+}
+
+// Checks that a reconnecting controller can replay the node events it
+// missed, and that a replay from another journal is reported as incomplete.
+//
+// Test is expected to pass.
+func TestEventReplay(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	cluster.sched.journal = newEventJournal(16)
+
+	controller := cluster.addController()
+	cluster.addComputeNode(testReady(4096))
+	if e := controller.nextEvent(); e.event != ssntp.NodeConnected {
+		t.Fatalf("Expected NodeConnected, got %s", e.event)
+	}
+
+	controller.ssntp.Close()
+	cluster.waitFor("controller disconnection", func() bool {
+		cluster.sched.controllerMutex.RLock()
+		defer cluster.sched.controllerMutex.RUnlock()
+		return cluster.sched.controllerMap[controller.uuid] == nil
+	})
+
+	missed := cluster.addComputeNode(testReady(4096))
+	missed.ssntp.Close()
+	cluster.waitFor("node disconnection", func() bool {
+		return cluster.nodeStat(missed) == nil
+	})
+
+	controller = cluster.connectController(controller.uuid)
+	controller.replayEvents(payloads.ReplayEventsCmd{})
+
+	// The controller handles frames concurrently, so the replayed events
+	// and EventsReplayed can arrive in any order.
+	var connected payloads.NodeConnected
+	var disconnected payloads.NodeDisconnected
+	var replayed payloads.EventsReplayed
+	for i := 0; i < 3; i++ {
+		var err error
+		switch e := controller.nextEvent(); e.event {
+		case ssntp.NodeConnected:
+			err = payloads.Unmarshal(e.payload, &connected)
+		case ssntp.NodeDisconnected:
+			err = payloads.Unmarshal(e.payload, &disconnected)
+		case ssntp.EventsReplayed:
+			err = payloads.Unmarshal(e.payload, &replayed)
+		default:
+			t.Fatalf("Unexpected %s event", e.event)
+		}
+		if err != nil {
+			t.Fatalf("Unable to unmarshal event: %v", err)
+		}
+	}
+
+	if connected.Connected.NodeUUID != missed.uuid || disconnected.Disconnected.NodeUUID != missed.uuid {
+		t.Fatalf("Wrong events replayed for node %s: %+v %+v", missed.uuid, connected, disconnected)
+	}
+	if r := replayed.Replayed; !r.Complete || r.Replayed != 2 || r.LastSequence != 3 {
+		t.Fatalf("Wrong replay %+v", r)
+	}
+
+	controller.replayEvents(payloads.ReplayEventsCmd{
+		JournalID:     replayed.Replayed.JournalID + 1,
+		AfterSequence: 1,
+	})
+	if r := controller.nextReplayed(); r.Complete || r.Replayed != 0 {
+		t.Fatalf("Replay from another journal reported as complete %+v", r)
+	}
+}
+
+// Checks that the processing time of the commands is tracked, and that a
+// warning alert is posted when the 99th percentile of a command type
+// exceeds the SLO.
+//
+// Test is expected to pass.
+func TestCommandLatency(t *testing.T) {
+	alerts := make(chan alert, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("Unable to decode alert: %v", err)
+		}
+		alerts <- a
+	}))
+	defer server.Close()
+
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	cluster.sched.latency = newLatencyTracker(0, nil)
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+	instance := controller.start(testWorkload(256))
+	cluster.expectPlacement(instance, node)
+
+	if s := cluster.sched.latency.stats()["START"]; s.Count != 1 || s.Samples != 1 {
+		t.Fatalf("START processing time not tracked %+v", s)
+	}
+
+	latency := newLatencyTracker(10*time.Millisecond, newAlertNotifier(server.URL, time.Hour, 0, 0))
+	for i := 0; i < latencyMinSamples; i++ {
+		latency.record(ssntp.STOP, time.Millisecond)
+	}
+
+	s := latency.stats()["STOP"]
+	if s.SLOBreached || s.P99MS != 1 || s.Buckets[0].Count != latencyMinSamples ||
+		s.Buckets[len(s.Buckets)-1].Count != latencyMinSamples {
+		t.Fatalf("Wrong STOP latency %+v", s)
+	}
+
+	for i := 0; i < latencyCheckInterval; i++ {
+		latency.record(ssntp.STOP, 50*time.Millisecond)
+	}
+
+	if s = latency.stats()["STOP"]; !s.SLOBreached || s.P99MS != 50 {
+		t.Fatalf("SLO breach not detected %+v", s)
+	}
+
+	select {
+	case a := <-alerts:
+		if a.Event != alertLatency || a.Severity != "warning" || a.Command != "STOP" {
+			t.Fatalf("Expected STOP %s alert, got %+v", alertLatency, a)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("Timed out waiting for %s alert", alertLatency)
+	}
+}
+
+// Checks that the scheduler tracks the utilization of the public IP pools
+// of the concentrators, and drops the PublicIPAssigned events of exhausted
+// pools with an alert.
+//
+// Test is expected to pass.
+func TestPublicIPPools(t *testing.T) {
+	alerts := make(chan alert, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("Unable to decode alert: %v", err)
+		}
+		alerts <- a
+	}))
+	defer server.Close()
+
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	cluster.sched.alerts = newAlertNotifier(server.URL, time.Hour, 0, 0)
+
+	controller := cluster.addController()
+	cnci := cluster.addConcentrator()
+
+	pool := payloads.EventPublicIPPoolRegistered{
+		Pool: payloads.PublicIPPool{ConcentratorUUID: cnci.uuid, Size: 2, Assigned: 1},
+	}
+	payload, err := payloads.MarshalVersion(controller.ssntp.Encoding(), &pool, controller.ssntp.PayloadVersion())
+	if err != nil {
+		t.Fatalf("Unable to marshal PublicIPPoolRegistered: %v", err)
+	}
+	if _, err = controller.ssntp.SendEvent(ssntp.PublicIPPoolRegistered, payload); err != nil {
+		t.Fatalf("Unable to send PublicIPPoolRegistered: %v", err)
+	}
+
+	cluster.waitFor("public IP pool registration", func() bool {
+		cluster.sched.ipPoolMutex.Lock()
+		defer cluster.sched.ipPoolMutex.Unlock()
+		return cluster.sched.ipPools[cnci.uuid] != nil
+	})
+
+	ip := payloads.PublicIPEvent{
+		ConcentratorUUID: cnci.uuid,
+		InstanceUUID:     uuid.Generate().String(),
+		PublicIP:         "10.1.2.3",
+		PrivateIP:        "192.168.0.2",
+	}
+
+	cnci.sendEvent(ssntp.PublicIPAssigned, &payloads.EventPublicIPAssigned{AssignedIP: ip})
+	if e := cnci.nextEvent(); e.event != ssntp.PublicIPAssigned {
+		t.Fatalf("Expected PublicIPAssigned, got %s", e.event)
+	}
+
+	cnci.sendEvent(ssntp.PublicIPAssigned, &payloads.EventPublicIPAssigned{AssignedIP: ip})
+	cnci.expectNoEvent()
+
+	select {
+	case a := <-alerts:
+		if a.Event != alertPublicIPPool || a.Concentrator != cnci.uuid || a.Count != 2 {
+			t.Fatalf("Expected %s alert, got %+v", alertPublicIPPool, a)
+		}
+	case <-time.After(testTimeout):
+		t.Fatalf("Timed out waiting for %s alert", alertPublicIPPool)
+	}
+
+	cnci.sendEvent(ssntp.PublicIPReleased, &payloads.EventPublicIPReleased{ReleasedIP: ip})
+	if e := cnci.nextEvent(); e.event != ssntp.PublicIPReleased {
+		t.Fatalf("Expected PublicIPReleased, got %s", e.event)
+	}
+
+	cnci.sendEvent(ssntp.PublicIPAssigned, &payloads.EventPublicIPAssigned{AssignedIP: ip})
+	if e := cnci.nextEvent(); e.event != ssntp.PublicIPAssigned {
+		t.Fatalf("Expected PublicIPAssigned once an address was released, got %s", e.event)
+	}
+
+	snap := cluster.sched.snapshot()
+	if len(snap.PublicIPPools) != 1 || snap.PublicIPPools[0].Size != 2 || snap.PublicIPPools[0].Assigned != 2 {
+		t.Errorf("Wrong public IP pools in snapshot %+v", snap.PublicIPPools)
+	}
+
+	untracked := cluster.addConcentrator()
+	ip.ConcentratorUUID = untracked.uuid
+	untracked.sendEvent(ssntp.PublicIPAssigned, &payloads.EventPublicIPAssigned{AssignedIP: ip})
+	if e := untracked.nextEvent(); e.event != ssntp.PublicIPAssigned {
+		t.Fatalf("Expected PublicIPAssigned for a concentrator without pool, got %s", e.event)
+	}
+}
+
+// Checks that the tenant networks a node reports are verified against its
+// TenantAdded and TenantRemoved events, and that the orphaned and missing
+// networks found in two consecutive reports are sent to the controllers.
+//
+// Test is expected to pass.
+func TestTenantNetworkDrift(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	node := cluster.addComputeNode(testReady(4096))
+	cnci := cluster.addConcentrator()
+	controller := cluster.addController()
+
+	network := func(tenant string) payloads.TenantNetwork {
+		return payloads.TenantNetwork{
+			TenantUUID:       tenant,
+			TenantSubnet:     "192.168.0.0/24",
+			ConcentratorUUID: cnci.uuid,
+			ConcentratorIP:   "10.0.0.1",
+			Tunnel:           true,
+		}
+	}
+	report := func(networks ...payloads.TenantNetwork) {
+		node.sendEvent(ssntp.TenantNetworksReport, &payloads.EventTenantNetworksReport{
+			Report: payloads.TenantNetworksReport{AgentUUID: node.uuid, Networks: networks},
+		})
+	}
+
+	existing := network(uuid.Generate().String())
+	report(existing)
+	cluster.waitFor("first tenant networks report", func() bool {
+		cluster.sched.tenantNetMutex.Lock()
+		defer cluster.sched.tenantNetMutex.Unlock()
+		return cluster.sched.tenantNets[node.uuid] != nil
+	})
+
+	added := network(uuid.Generate().String())
+	node.sendEvent(ssntp.TenantAdded, &payloads.EventTenantAdded{
+		TenantAdded: payloads.TenantAddedEvent{
+			AgentUUID:        node.uuid,
+			TenantUUID:       added.TenantUUID,
+			TenantSubnet:     added.TenantSubnet,
+			ConcentratorUUID: added.ConcentratorUUID,
+			ConcentratorIP:   added.ConcentratorIP,
+		},
+	})
+	if e := cnci.nextEvent(); e.event != ssntp.TenantAdded {
+		t.Fatalf("Expected TenantAdded, got %s", e.event)
+	}
+
+	orphaned := network(uuid.Generate().String())
+	report(existing, orphaned)
+	cluster.waitFor("tenant networks discrepancies", func() bool {
+		cluster.sched.tenantNetMutex.Lock()
+		defer cluster.sched.tenantNetMutex.Unlock()
+		n := cluster.sched.tenantNets[node.uuid]
+		return len(n.orphaned) == 1 && len(n.missing) == 1
+	})
+
+	report(existing, orphaned)
+
+	e := controller.nextEvent()
+	for e.event == ssntp.NodeConnected {
+		e = controller.nextEvent()
+	}
+	if e.event != ssntp.TenantNetworkDrift {
+		t.Fatalf("Expected TenantNetworkDrift, got %s", e.event)
+	}
+
+	var drift payloads.EventTenantNetworkDrift
+	if err := payloads.Unmarshal(e.payload, &drift); err != nil {
+		t.Fatalf("Unable to unmarshal TenantNetworkDrift: %v", err)
+	}
+
+	d := drift.Drift
+	if d.AgentUUID != node.uuid ||
+		len(d.Orphaned) != 1 || d.Orphaned[0].TenantUUID != orphaned.TenantUUID ||
+		len(d.Missing) != 1 || d.Missing[0].TenantUUID != added.TenantUUID || d.Missing[0].Tunnel {
+		t.Errorf("Wrong TenantNetworkDrift fields %+v", d)
+	}
+}
+
+// Checks that cluster snapshots reflect the connected controllers and
+// nodes and the placement decisions, and that they can be read back.
+//
+// Test is expected to pass.
+func TestClusterSnapshot(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+	networkNode := cluster.addNetworkNode(testReady(2048))
+
+	instance := controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, node)
+
+	path := filepath.Join(cluster.dir, "snapshot.json")
+	if err := cluster.sched.writeSnapshot(path, payloads.JSON); err != nil {
+		t.Fatalf("Unable to write snapshot: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unable to read snapshot: %v", err)
+	}
+
+	var snap clusterSnapshot
+	if err = payloads.Unmarshal(data, &snap); err != nil {
+		t.Fatalf("Unable to unmarshal snapshot: %v", err)
+	}
+
+	if snap.Version != snapshotVersion {
+		t.Fatalf("Wrong snapshot version %d", snap.Version)
+	}
+
+	if len(snap.Controllers) != 1 || snap.Controllers[0].UUID != controller.uuid ||
+		snap.Controllers[0].Status != controllerMaster.String() {
+		t.Fatalf("Wrong controllers %+v", snap.Controllers)
+	}
+
+	if len(snap.ComputeNodes) != 1 || snap.ComputeNodes[0].UUID != node.uuid ||
+		snap.ComputeNodes[0].MemAvailableMB != 3072 {
+		t.Fatalf("Wrong compute nodes %+v", snap.ComputeNodes)
+	}
+
+	if len(snap.NetworkNodes) != 1 || snap.NetworkNodes[0].UUID != networkNode.uuid {
+		t.Fatalf("Wrong network nodes %+v", snap.NetworkNodes)
+	}
+
+	if len(snap.Placements) != 1 || snap.Placements[0].InstanceUUID != instance ||
+		snap.Placements[0].NodeUUID != node.uuid || snap.Placements[0].MemMB != 1024 {
+		t.Fatalf("Wrong placements %+v", snap.Placements)
+	}
+
+	cluster.sched.forgetPlacement(instance)
+	if placements := cluster.sched.snapshot().Placements; len(placements) != 0 {
+		t.Fatalf("Deleted instance still placed %+v", placements)
+	}
+}
+
+// Checks that alerts are posted to the webhook when the cloud is full,
+// when a node repeatedly fails to start instances and when a node is
+// lost, and that identical alerts are not repeated.
+//
+// Test is expected to pass.
+func TestAlerts(t *testing.T) {
+	alerts := make(chan alert, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var a alert
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			t.Errorf("Unable to decode alert: %v", err)
+		}
+		alerts <- a
+	}))
+	defer server.Close()
+
+	nextAlert := func(event string) alert {
+		select {
+		case a := <-alerts:
+			if a.Event != event || a.Severity != "critical" {
+				t.Fatalf("Expected %s alert, got %+v", event, a)
+			}
+			return a
+		case <-time.After(testTimeout):
+			t.Fatalf("Timed out waiting for %s alert", event)
+		}
+		return alert{}
+	}
+
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	cluster.sched.alerts = newAlertNotifier(server.URL, time.Hour, 2, time.Minute)
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(1024))
+
+	instance := controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, node)
+
+	for i := 0; i < 2; i++ {
+		instance = controller.start(testWorkload(1024))
+		cluster.expectStartFailure(instance, payloads.FullCloud)
+	}
+
+	if a := nextAlert(alertClusterFull); a.InstanceUUID == "" {
+		t.Errorf("Missing instance in %+v", a)
+	}
+
+	for i := 0; i < 2; i++ {
+		instance = testWorkload(256).Start.InstanceUUID
+		node.sendStartFailure(instance, payloads.LaunchFailure)
+		cluster.expectStartFailure(instance, payloads.LaunchFailure)
+	}
+
+	if a := nextAlert(alertStartFailures); a.NodeUUID != node.uuid || a.Count != 2 {
+		t.Errorf("Wrong start failures alert %+v", a)
+	}
+
+	node.ssntp.Close()
+	if a := nextAlert(alertNodeLost); a.NodeUUID != node.uuid {
+		t.Errorf("Wrong node lost alert %+v", a)
+	}
+}
+
+// Checks that the start failures reported by a node reach only the
+// controller that started the instance, and all the controllers when the
+// instance is unknown to the scheduler.
+//
+// Test is expected to pass.
+func TestErrorRouting(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	master := cluster.addController()
+	backup := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+
+	instance := master.start(testWorkload(1024))
+	cluster.expectPlacement(instance, node)
+
+	node.sendStartFailure(instance, payloads.LaunchFailure)
+	if result := cluster.nextResult(instance); result.controller != master.uuid {
+		t.Fatalf("StartFailure of %s sent to %s instead of %s", instance, result.controller, master.uuid)
+	}
+
+	cluster.expectNoResult()
+
+	instance = testWorkload(1024).Start.InstanceUUID
+	node.sendStartFailure(instance, payloads.LaunchFailure)
+
+	controllers := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		controllers[cluster.nextResult(instance).controller] = true
+	}
+	if !controllers[master.uuid] || !controllers[backup.uuid] {
+		t.Errorf("StartFailure of unknown instance %s not broadcast: %v", instance, controllers)
+	}
+}
+
+// Checks that, with controller tenants, each controller may only send
+// commands for its own tenants while the commands that do not act on a
+// tenant are still only taken from the master controller.
+//
+// Test is expected to pass.
+func TestTenantFencing(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	master := cluster.addController()
+	backup := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+
+	masterTenant := testWorkload(0).Start.TenantUUID
+	backupTenant := testWorkload(0).Start.TenantUUID
+	cluster.sched.tenants = controllerTenants{
+		master.uuid: {masterTenant: true},
+		backup.uuid: {backupTenant: true},
+	}
+
+	workload := testWorkload(1024)
+	workload.Start.TenantUUID = backupTenant
+	instance := backup.start(workload)
+	cluster.expectPlacement(instance, node)
+
+	master.start(workload)
+	cluster.expectNoResult()
+
+	workload = testWorkload(1024)
+	workload.Start.TenantUUID = masterTenant
+	backup.start(workload)
+	cluster.expectNoResult()
+
+	cluster.expectPlacement(master.start(workload), node)
+
+	del := payloads.Delete{
+		Delete: payloads.StopCmd{
+			InstanceUUID:      instance,
+			WorkloadAgentUUID: node.uuid,
+		},
+	}
+	payload, err := payloads.Marshal(payloads.MsgPack, &del)
+	if err != nil {
+		t.Fatalf("Unable to marshal DELETE: %v", err)
+	}
+
+	if err = cluster.sched.mayCommand(backup.uuid, controllerBackup, ssntp.DELETE, payload); err != nil {
+		t.Errorf("DELETE of own instance refused: %v", err)
+	}
+	if err = cluster.sched.mayCommand(master.uuid, controllerMaster, ssntp.DELETE, payload); err == nil {
+		t.Errorf("DELETE of another tenant instance accepted")
+	}
+
+	evacuate := payloads.Evacuate{
+		Evacuate: payloads.EvacuateCmd{WorkloadAgentUUID: node.uuid},
+	}
+	if payload, err = payloads.Marshal(payloads.MsgPack, &evacuate); err != nil {
+		t.Fatalf("Unable to marshal EVACUATE: %v", err)
+	}
+
+	if err = cluster.sched.mayCommand(backup.uuid, controllerBackup, ssntp.EVACUATE, payload); err == nil {
+		t.Errorf("EVACUATE accepted from backup controller")
+	}
+	if err = cluster.sched.mayCommand(master.uuid, controllerMaster, ssntp.EVACUATE, payload); err != nil {
+		t.Errorf("EVACUATE refused from master controller: %v", err)
+	}
+}
+
+// Checks that a START command referencing a registered flavor is placed
+// according to the flavor resources and reaches the node with them, and
+// that one referencing an unknown flavor is dropped.
+//
+// Test is expected to pass.
+func TestFlavors(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	small := cluster.addComputeNode(testReady(1024))
+	large := cluster.addComputeNode(testReady(4096))
+
+	definition := payloads.EventWorkloadDefinition{
+		Definition: payloads.WorkloadDefinitionEvent{
+			FlavorUUID: testWorkload(0).Start.InstanceUUID,
+			RequestedResources: []payloads.RequestedResource{
+				{Type: payloads.VCPUs, Value: 2},
+				{Type: payloads.MemMB, Value: 2048},
+			},
+		},
+	}
+	payload, err := payloads.MarshalVersion(controller.ssntp.Encoding(), &definition,
+		controller.ssntp.PayloadVersion())
+	if err != nil {
+		t.Fatalf("Unable to marshal WorkloadDefinition: %v", err)
+	}
+
+	if _, err = controller.ssntp.SendEvent(ssntp.WorkloadDefinition, payload); err != nil {
+		t.Fatalf("Unable to send WorkloadDefinition: %v", err)
+	}
+	cluster.waitFor("flavor registration", func() bool {
+		return cluster.sched.getFlavor(definition.Definition.FlavorUUID) != nil
+	})
+
+	workload := testWorkload(0)
+	workload.Start.FlavorUUID = definition.Definition.FlavorUUID
+	workload.Start.RequestedResources = nil
+	instance := controller.start(workload)
+
+	result := cluster.nextResult(instance)
+	if result.node != large.uuid {
+		t.Fatalf("Instance %s placed on %s instead of %s", instance, result.node, large.uuid)
+	}
+
+	resources := result.start.RequestedResources
+	if len(resources) != 2 || resources[1].Type != payloads.MemMB || resources[1].Value != 2048 {
+		t.Errorf("Node got wrong requested resources %+v", resources)
+	}
+
+	cluster.waitFor("flavor memory to be claimed", func() bool {
+		stat := cluster.nodeStat(large)
+		stat.mutex.Lock()
+		defer stat.mutex.Unlock()
+		return stat.memAvailMB == 4096-2048
+	})
+
+	workload = testWorkload(0)
+	workload.Start.FlavorUUID = testWorkload(0).Start.InstanceUUID
+	workload.Start.RequestedResources = nil
+	controller.start(workload)
+	cluster.expectNoResult()
+
+	stat := cluster.nodeStat(small)
+	stat.mutex.Lock()
+	if stat.memAvailMB != 1024 {
+		t.Errorf("Unknown flavor claimed memory on %s", small.uuid)
+	}
+	stat.mutex.Unlock()
+}
+
+// Checks that the members of a gang are only placed once all of them have
+// been received, on distinct nodes with anti-affinity, and that a gang that
+// does not fit or is incomplete fails as a whole.
+//
+// Test is expected to pass.
+func TestGangPlacement(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	cluster.sched.gangTimeout = 500 * time.Millisecond
+
+	controller := cluster.addController()
+	node1 := cluster.addComputeNode(testReady(2048))
+	node2 := cluster.addComputeNode(testReady(2048))
+
+	startGang := func(size, members int) []string {
+		id := testWorkload(0).Start.InstanceUUID
+		instances := make([]string, members)
+		for i := range instances {
+			workload := testWorkload(1024)
+			workload.Start.Gang = &payloads.Gang{ID: id, Size: size, AntiAffinity: true}
+			instances[i] = controller.start(workload)
+		}
+		return instances
+	}
+
+	gangResults := func(instances []string) map[string]testResult {
+		results := make(map[string]testResult)
+		for range instances {
+			select {
+			case result := <-cluster.results:
+				results[result.instance] = result
+			case <-time.After(testTimeout):
+				t.Fatalf("Gang was neither placed nor refused")
+			}
+		}
+		for _, instance := range instances {
+			if _, ok := results[instance]; !ok {
+				t.Fatalf("No outcome for gang member %s", instance)
+			}
+		}
+		return results
+	}
+
+	instances := startGang(2, 2)
+	results := gangResults(instances)
+	if results[instances[0]].node == results[instances[1]].node {
+		t.Errorf("Gang members placed on the same node despite anti-affinity: %+v", results)
+	}
+	for _, result := range results {
+		if result.node != node1.uuid && result.node != node2.uuid {
+			t.Errorf("Gang member not placed: %+v", result)
+		}
+	}
+
+	for _, result := range gangResults(startGang(3, 3)) {
+		if result.failure != payloads.GangFailure {
+			t.Errorf("Gang that does not fit not refused: %+v", result)
+		}
+	}
+
+	instances = startGang(2, 1)
+	cluster.expectNoResult()
+	cluster.expectStartFailure(instances[0], payloads.GangFailure)
+
+	for _, node := range []*testNode{node1, node2} {
+		stat := cluster.nodeStat(node)
+		stat.mutex.Lock()
+		if stat.memAvailMB != 1024 {
+			t.Errorf("Node %s has %d MB available, expected 1024", node.uuid, stat.memAvailMB)
+		}
+		stat.mutex.Unlock()
+	}
+}
+
+// Checks that in pack mode an idle compute node is drained and powered
+// down, that the last node placing instances is kept up, and that a powered
+// down node is woken up when an instance cannot be placed.
+//
+// Test is expected to pass.
+func TestPowerManagement(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	wol, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Unable to listen for wake-on-LAN packets: %v", err)
+	}
+	defer wol.Close()
+
+	cluster.sched.placement = placePack
+	cluster.sched.power = newPowerManager(200*time.Millisecond, 1, wol.LocalAddr().String())
+
+	controller := cluster.addController()
+	nodes := make([]*testNode, 2)
+	macs := []string{"52:54:00:00:00:01", "52:54:00:00:00:02"}
+	for i := range nodes {
+		nodes[i] = cluster.addComputeNode(testReady(2048))
+		nodes[i].sendCapabilities(payloads.NodeCapabilities{
+			Hypervisors:  []payloads.HypervisorCapability{{Type: payloads.QEMU}},
+			WakeOnLANMAC: macs[i],
+		})
+	}
+
+	go managePowerLoop(cluster.sched)
+
+	result := cluster.nextResult("")
+	if !result.powerDown || result.node != nodes[1].uuid {
+		t.Fatalf("Expected node %s to be powered down, got %+v", nodes[1].uuid, result)
+	}
+	cluster.expectNoResult()
+
+	instance := controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, nodes[0])
+
+	nodes[1].ssntp.Close()
+	cluster.waitFor("node "+nodes[1].uuid+" to disconnect", func() bool {
+		return cluster.nodeStat(nodes[1]) == nil
+	})
+
+	instance = controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, nodes[0])
+	instance = controller.start(testWorkload(1024))
+	cluster.expectStartFailure(instance, payloads.FullCloud)
+
+	hw, _ := net.ParseMAC(macs[1])
+	expected := bytes.Repeat([]byte{0xff}, 6)
+	for i := 0; i < 16; i++ {
+		expected = append(expected, hw...)
+	}
+
+	packet := make([]byte, 256)
+	_ = wol.SetReadDeadline(time.Now().Add(testTimeout))
+	n, _, err := wol.ReadFrom(packet)
+	if err != nil {
+		t.Fatalf("No wake-on-LAN packet received: %v", err)
+	}
+	if !bytes.Equal(packet[:n], expected) {
+		t.Errorf("Wrong wake-on-LAN packet %x, expected %x", packet[:n], expected)
+	}
+}
+
+// Checks that the security group rules of an instance are forwarded to the
+// node running it, and that invalid rules are not.
+//
+// Test is expected to pass.
+func TestSecurityGroupForwarding(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	cluster.addComputeNode(testReady(4096))
+	node := cluster.addComputeNode(testReady(4096))
+
+	rules := payloads.SecurityGroupRulesCmd{
+		InstanceUUID:      uuid.Generate().String(),
+		WorkloadAgentUUID: node.uuid,
+		Version:           2,
+		Rules: []payloads.SecurityRule{
+			{Direction: payloads.IngressRule, Protocol: payloads.TCPProtocol, PortMin: 22},
+			{Direction: payloads.EgressRule, RemoteCIDR: "fd00::/64"},
+		},
+	}
+	controller.setSecurityGroup(rules)
+
+	result := cluster.nextResult(rules.InstanceUUID)
+	if result.node != node.uuid || result.securityGroup == nil {
+		t.Fatalf("Security group of %s not forwarded to %s: %+v", rules.InstanceUUID, node.uuid, result)
+	}
+	if result.securityGroup.Version != 2 || len(result.securityGroup.Rules) != 2 ||
+		result.securityGroup.Rules[1].RemoteCIDR != "fd00::/64" {
+		t.Errorf("Wrong security group forwarded: %+v", result.securityGroup)
+	}
+
+	rules.Version = 0
+	controller.setSecurityGroup(rules)
+	cluster.expectNoResult()
+}
+
+// Checks that the EVACUATE commands a compute node sends for itself are
+// forwarded to every controller, and that those it sends for another node
+// are dropped.
+//
+// Test is expected to pass.
+func TestEvacuateRequest(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	master := cluster.addController()
+	backup := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+	other := cluster.addComputeNode(testReady(4096))
+
+	node.sendEvacuate(other.uuid)
+	node.sendEvacuate(node.uuid)
+
+	for _, controller := range []*testController{master, backup} {
+		select {
+		case agent := <-controller.evacuations:
+			if agent != node.uuid {
+				t.Errorf("Controller %s asked to evacuate %s instead of %s",
+					controller.uuid, agent, node.uuid)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("Evacuation request of %s not forwarded to %s", node.uuid,
+				controller.uuid)
+		}
+	}
+
+	select {
+	case agent := <-master.evacuations:
+		t.Errorf("Unexpected evacuation request for %s", agent)
+	default:
+	}
+}
+
+// Checks that the clock offsets SSNTP estimates when compute and network
+// nodes connect are tracked until they disconnect, and that the nodes whose
+// clock is off by more than the threshold are reported first.
+//
+// Test is expected to pass.
+func TestClockSkew(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+	cluster.sched.clockSkew = newClockSkewTracker(time.Hour, nil)
+
+	cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+	cluster.addNetworkNode(testReady(4096))
+
+	if offset, _, ok := node.ssntp.ClockOffset(); !ok || offset > time.Hour || offset < -time.Hour {
+		t.Errorf("Unexpected clock offset of the scheduler %v, checked %v", offset, ok)
+	}
+
+	stats := cluster.sched.clockSkew.stats()
+	if len(stats.Nodes) != 2 || stats.Skewed != 0 {
+		t.Fatalf("Expected 2 nodes in sync, got %+v", stats)
+	}
+
+	node.ssntp.Close()
+	cluster.waitFor("node disconnection", func() bool {
+		return len(cluster.sched.clockSkew.stats().Nodes) == 1
+	})
+
+	cluster.sched.clockSkew.connected(node.uuid, -2*time.Hour, true)
+	stats = cluster.sched.clockSkew.stats()
+	if stats.Skewed != 1 || stats.Nodes[0].NodeUUID != node.uuid ||
+		!stats.Nodes[0].Skewed || stats.Nodes[0].OffsetMS != -7200000 {
+		t.Errorf("Expected %s to be reported skewed first, got %+v", node.uuid, stats)
+	}
+}
+
+// Checks that the capacity forecasts count the instances of a flavor each
+// node can still take and derive the time to full from the launch rate.
+//
+// Test is expected to pass.
+func TestCapacityForecast(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	cluster.addComputeNode(testReady(4096))
+	cluster.addComputeNode(testReady(2048))
+
+	now := time.Now()
+	cluster.sched.sampleCapacity(now.Add(-30 * time.Minute))
+
+	for i := 0; i < 2; i++ {
+		instance := controller.start(testWorkload(512))
+		cluster.nextResult(instance)
+	}
+	cluster.sched.sampleCapacity(now)
+
+	workload := &workResources{memReqMB: 1024}
+	f := cluster.sched.forecast(workload, time.Hour, now)
+
+	if f.Fits != 4 || len(f.Nodes) != 2 || f.Samples != 2 {
+		t.Fatalf("Wrong capacity %+v", f)
+	}
+
+	if f.LaunchesPerHour != 4 || f.MemConsumptionMBPerHour != 2048 {
+		t.Errorf("Wrong rates %+v", f)
+	}
+
+	if f.TimeToFullSeconds == nil || *f.TimeToFullSeconds != 3600 {
+		t.Errorf("Wrong time to full %v", f.TimeToFullSeconds)
+	}
+
+	f = cluster.sched.forecast(workload, time.Minute, now.Add(time.Hour))
+	if f.Samples != 0 || f.TimeToFullSeconds != nil {
+		t.Errorf("Forecast based on samples out of the window %+v", f)
+	}
+
+	tests := []struct {
+		method string
+		query  string
+		code   int
+	}{
+		{"GET", "mem_mb=1024&vcpus=2", http.StatusOK},
+		{"GET", "mem_mb=1024&window=24h", http.StatusOK},
+		{"GET", "vcpus=2", http.StatusBadRequest},
+		{"GET", "mem_mb=big", http.StatusBadRequest},
+		{"GET", "mem_mb=1024&window=-1h", http.StatusBadRequest},
+		{"POST", "mem_mb=1024", http.StatusMethodNotAllowed},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/capacity?"+test.query, nil)
+		rec := httptest.NewRecorder()
+		cluster.sched.capacityHandler(rec, req)
+		if rec.Code != test.code {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.query,
+				test.code, rec.Code)
+		}
+	}
+}
+
+// testTenantToken returns a JWT for tenant, expiring at exp, signed with
+// key: a shared HS256 key, an RS256 *rsa.PrivateKey or an ES256
+// *ecdsa.PrivateKey.
+func testTenantToken(t *testing.T, key interface{}, kid, tenant string, exp time.Time) string {
+	var alg string
+	switch key.(type) {
+	case []byte:
+		alg = "HS256"
+	case *rsa.PrivateKey:
+		alg = "RS256"
+	case *ecdsa.PrivateKey:
+		alg = "ES256"
+	}
+
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"}) + "." +
+		encode(map[string]interface{}{"sub": tenant, "exp": exp.Unix()})
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		_, _ = mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// Checks that tenant tokens signed with the shared key or with a key of
+// the JWKS are accepted for their tenant only and until they expire, and
+// that tokens signed with an unknown key trigger a JWKS download.
+//
+// Test is expected to pass.
+func TestTenantTokenVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	jwks := map[string][]map[string]string{
+		"keys": {
+			{"kty": "RSA", "kid": "rsa", "n": b64(rsaKey.N.Bytes()),
+				"e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kty": "EC", "kid": "ec", "crv": "P-256",
+				"x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+
+	shared := []byte("shared secret")
+	v := newTenantTokenVerifier(shared, server.URL)
+	if err = v.loadKeys(http.DefaultClient); err != nil {
+		t.Fatalf("Unable to load JWKS: %v", err)
+	}
+
+	tenant := uuid.Generate().String()
+	now := time.Now()
+	exp := now.Add(time.Hour)
+	otherRSAKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		token string
+		valid bool
+	}{
+		{testTenantToken(t, shared, "", tenant, exp), true},
+		{testTenantToken(t, rsaKey, "rsa", tenant, exp), true},
+		{testTenantToken(t, ecKey, "ec", tenant, exp), true},
+		{testTenantToken(t, shared, "", uuid.Generate().String(), exp), false},
+		{testTenantToken(t, shared, "", tenant, now.Add(-time.Minute)), false},
+		{testTenantToken(t, []byte("other secret"), "", tenant, exp), false},
+		{testTenantToken(t, otherRSAKey, "rsa", tenant, exp), false},
+		{testTenantToken(t, ecKey, "rsa", tenant, exp), false},
+		{"not a token", false},
+	}
+
+	for i, test := range tests {
+		if err := v.verify(test.token, tenant, now); (err == nil) != test.valid {
+			t.Errorf("Test %d: token validity should be %v: %v", i, test.valid, err)
+		}
+	}
+
+	if err = v.verify(testTenantToken(t, rsaKey, "rotated", tenant, exp), tenant, now); err == nil {
+		t.Errorf("Token signed with unknown key accepted")
+	}
+	select {
+	case <-v.refresh:
+	default:
+		t.Errorf("Unknown key did not trigger a JWKS download")
+	}
+
+	v = newTenantTokenVerifier(nil, "")
+	if err = v.verify(testTenantToken(t, shared, "", tenant, exp), tenant, now); err == nil {
+		t.Errorf("HS256 token accepted without shared key")
+	}
+
+	if d := refreshDelay(now, now.Add(10*time.Second)); d != minJWKSRefresh-10*time.Second {
+		t.Errorf("JWKS downloaded again after %v", d)
+	}
+	if d := refreshDelay(now, now.Add(2*minJWKSRefresh)); d != 0 {
+		t.Errorf("JWKS download delayed by %v", d)
+	}
+}
+
+// Checks that, with tenant tokens, the commands for a tenant are only
+// accepted with a valid token for the tenant, that the controller is told
+// about those that are not, and that the token is not forwarded to the
+// node.
+//
+// Test is expected to pass.
+func TestTenantTokens(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+
+	key := []byte("shared secret")
+	cluster.sched.tenantTokens = newTenantTokenVerifier(key, "")
+
+	workload := testWorkload(1024)
+	cluster.expectStartFailure(controller.start(workload), payloads.TenantNotAuthenticated)
+
+	exp := time.Now().Add(time.Hour)
+	workload.Start.TenantToken = testTenantToken(t, key, "", uuid.Generate().String(), exp)
+	cluster.expectStartFailure(controller.start(workload), payloads.TenantNotAuthenticated)
+
+	workload.Start.TenantToken = testTenantToken(t, key, "", workload.Start.TenantUUID, exp)
+	instance := controller.start(workload)
+	result := cluster.nextResult(instance)
+	if result.node != node.uuid || result.start == nil {
+		t.Fatalf("Instance %s with valid token not placed: %+v", instance, result)
+	}
+	if result.start.TenantToken != "" {
+		t.Errorf("Tenant token forwarded to node")
+	}
+
+	rules := payloads.SecurityGroupRulesCmd{
+		InstanceUUID:      instance,
+		WorkloadAgentUUID: node.uuid,
+		Version:           1,
+	}
+	controller.setSecurityGroup(rules)
+	cluster.expectNoResult()
+	select {
+	case invalid := <-controller.invalid:
+		if invalid.Operand != ssntp.SECURITYGROUP.String() || invalid.InstanceUUID != instance {
+			t.Errorf("Unexpected InvalidPayload error %+v", invalid)
+		}
+	case <-time.After(testTimeout):
+		t.Errorf("Security group without token not reported")
+	}
+
+	rules.TenantToken = workload.Start.TenantToken
+	controller.setSecurityGroup(rules)
+	result = cluster.nextResult(instance)
+	if result.securityGroup == nil || result.securityGroup.TenantToken != "" {
+		t.Errorf("Security group with valid token not forwarded without token: %+v", result.securityGroup)
+	}
+}
+
+// testAuditSink collects the audit records written by the scheduler.
+type testAuditSink chan *auditRecord
+
+func (s testAuditSink) write(records []*auditRecord) error {
+	for _, r := range records {
+		s <- r
+	}
+	return nil
+}
+
+// next returns the next audit record of the given action.
+func (s testAuditSink) next(t *testing.T, action string) *auditRecord {
+	for {
+		select {
+		case r := <-s:
+			if r.Action == action {
+				return r
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("Timed out waiting for %s audit record", action)
+			return nil
+		}
+	}
+}
+
+// Checks that audit records are formatted in CEF with their header and
+// extension values escaped.
+//
+// Test is expected to pass.
+func TestAuditCEF(t *testing.T) {
+	r := auditRecord{
+		Time:       time.Unix(1500000000, 0),
+		Scheduler:  "sched|1",
+		Action:     auditDenial,
+		ActorUUID:  "node",
+		ActorRole:  "CNAgent",
+		Command:    "COMMAND START",
+		TenantUUID: "tenant",
+		Reason:     "a=b\\c\nd",
+	}
+
+	expected := "CEF:0|Intel|ciao-scheduler|1|denial|denial|8|" +
+		"rt=1500000000000 dvchost=sched|1 suser=node spriv=CNAgent act=COMMAND START " +
+		"cs2Label=tenantUUID cs2=tenant reason=a\\=b\\\\c\\nd"
+	if cef := r.cef(); cef != expected {
+		t.Errorf("Wrong CEF record\n[%s]\n vs\n[%s]", cef, expected)
+	}
+}
+
+// Checks that audit records are produced to the Kafka topic through the
+// REST proxy, keyed by actor.
+//
+// Test is expected to pass.
+func TestAuditKafka(t *testing.T) {
+	type batch struct {
+		Records []struct {
+			Key   string      `json:"key"`
+			Value auditRecord `json:"value"`
+		} `json:"records"`
+	}
+	batches := make(chan batch, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/audit" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			t.Errorf("Unexpected request to %s of %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		var b batch
+		if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+			t.Errorf("Unable to decode records: %v", err)
+		}
+		batches <- b
+	}))
+	defer server.Close()
+
+	sink := newKafkaSink(server.URL+"/", "audit")
+	records := []*auditRecord{
+		{Action: auditConnect, ActorUUID: "controller"},
+		{Action: auditCommand, ActorUUID: "controller", Command: "START"},
+	}
+	if err := sink.write(records); err != nil {
+		t.Fatal(err)
+	}
+
+	b := <-batches
+	if len(b.Records) != 2 || b.Records[1].Key != "controller" || b.Records[1].Value.Command != "START" {
+		t.Errorf("Wrong records %+v", b.Records)
+	}
+}
+
+// Checks that the scheduler audits connections, controller commands,
+// placements and the frames clients are not authorized to send.
+//
+// Test is expected to pass.
+func TestAudit(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	sink := make(testAuditSink, 64)
+	cluster.sched.audit = newAuditLogger(sink)
+
+	controller := cluster.addController()
+	if r := sink.next(t, auditConnect); r.ActorUUID != controller.uuid || r.ActorRole != "Controller" {
+		t.Errorf("Wrong connect record %+v", r)
+	}
+
+	node := cluster.addComputeNode(testReady(1024))
+	if r := sink.next(t, auditConnect); r.ActorUUID != node.uuid || r.ActorRole != "CNAgent" {
+		t.Errorf("Wrong connect record %+v", r)
+	}
+
+	workload := testWorkload(512)
+	instance := controller.start(workload)
+	cluster.expectPlacement(instance, node)
+
+	r := sink.next(t, auditPlacement)
+	if r.ActorUUID != controller.uuid || r.InstanceUUID != instance ||
+		r.TenantUUID != workload.Start.TenantUUID || r.NodeUUID != node.uuid {
+		t.Errorf("Wrong placement record %+v", r)
+	}
+	r = sink.next(t, auditCommand)
+	if r.Command != "START" || r.InstanceUUID != instance || r.TenantUUID != workload.Start.TenantUUID {
+		t.Errorf("Wrong command record %+v", r)
+	}
+
+	payload, err := payloads.Marshal(payloads.YAML, &workload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := node.ssntp.SendCommand(ssntp.START, payload); err != nil {
+		t.Fatal(err)
+	}
+	r = sink.next(t, auditDenial)
+	if r.ActorUUID != node.uuid || r.Command != "COMMAND START" || r.Reason != errFrameNotAuthorized.Error() {
+		t.Errorf("Wrong denial record %+v", r)
+	}
+
+	node.ssntp.Close()
+	if r := sink.next(t, auditDisconnect); r.ActorUUID != node.uuid {
+		t.Errorf("Wrong disconnect record %+v", r)
+	}
+}
+
+// nextUpgradeProgress returns the next UpgradeProgress event the controller
+// received, skipping the other events.
+func (controller *testController) nextUpgradeProgress() payloads.UpgradeProgress {
+	t := controller.cluster.t
+
+	e := controller.nextEvent()
+	for e.event != ssntp.UpgradeProgress {
+		e = controller.nextEvent()
+	}
+
+	var progress payloads.EventUpgradeProgress
+	if err := payloads.Unmarshal(e.payload, &progress); err != nil {
+		t.Fatalf("Unable to unmarshal UpgradeProgress: %v", err)
+	}
+	return progress.Progress
+}
+
+// versionCapabilities returns the capabilities of a QEMU node running the
+// given software version.
+func versionCapabilities(version string) payloads.NodeCapabilities {
+	return payloads.NodeCapabilities{
+		Hypervisors:     []payloads.HypervisorCapability{{Type: payloads.QEMU}},
+		SoftwareVersion: version,
+	}
+}
+
+// Checks that a rolling upgrade drains one outdated node at a time,
+// starting with the least busy one, that instances are placed on the
+// upgraded nodes first, and that its progress is sent to the controllers.
+//
+// Test is expected to pass.
+func TestRollingUpgrade(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+
+	busy := cluster.addComputeNode(testReady(4096))
+	busy.sendCapabilities(versionCapabilities("1.0"))
+	instance := controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, busy)
+
+	idle := cluster.addComputeNode(testReady(4096))
+	idle.sendCapabilities(versionCapabilities("1.0"))
+	upgraded := cluster.addComputeNode(testReady(4096))
+	upgraded.sendCapabilities(versionCapabilities("2.0"))
+
+	cluster.sched.upgrade.configure(&payloads.RollingUpgrade{TargetVersion: "2.0"})
+	cluster.sched.manageUpgrade()
+
+	p := controller.nextUpgradeProgress()
+	if p.TargetVersion != "2.0" || len(p.Upgraded) != 1 || p.Upgraded[0] != upgraded.uuid ||
+		len(p.Drained) != 1 || p.Drained[0] != idle.uuid ||
+		len(p.Outdated) != 1 || p.Outdated[0] != busy.uuid || p.Done {
+		t.Fatalf("Wrong progress after the upgrade started %+v", p)
+	}
+
+	for i := 0; i < 2; i++ {
+		instance = controller.start(testWorkload(1024))
+		cluster.expectPlacement(instance, upgraded)
+	}
+
+	idle.sendCapabilities(versionCapabilities("2.0"))
+	p = controller.nextUpgradeProgress()
+	if len(p.Upgraded) != 2 || len(p.Draining) != 1 || p.Draining[0] != busy.uuid || len(p.Outdated) != 0 {
+		t.Fatalf("Wrong progress after a node was upgraded %+v", p)
+	}
+
+	busy.ssntp.Close()
+	cluster.waitFor("node "+busy.uuid+" disconnection", func() bool {
+		return cluster.nodeStat(busy) == nil
+	})
+	cluster.sched.manageUpgrade()
+	p = controller.nextUpgradeProgress()
+	if len(p.Upgrading) != 1 || p.Upgrading[0] != busy.uuid || len(p.Draining) != 0 || p.Done {
+		t.Fatalf("Wrong progress after a drained node disconnected %+v", p)
+	}
+
+	cluster.sched.upgrade.configure(nil)
+	if cluster.sched.upgrade.active() {
+		t.Errorf("Upgrade still active once ended")
+	}
+}
+
+// Checks that START commands are refused with a DeadlineExceeded
+// StartFailure once their deadline is past, including when a gang member
+// waits for the other members beyond its deadline.
+//
+// Test is expected to pass.
+func TestStartDeadline(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	cluster.sched.gangTimeout = time.Hour
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+
+	workload := testWorkload(1024)
+	workload.Start.Deadline = time.Now().Add(-time.Second).Format(time.RFC3339)
+	instance := controller.start(workload)
+	cluster.expectStartFailure(instance, payloads.DeadlineExceeded)
+
+	workload = testWorkload(1024)
+	workload.Start.Deadline = time.Now().Add(time.Hour).Format(time.RFC3339)
+	instance = controller.start(workload)
+	cluster.expectPlacement(instance, node)
+
+	gang := &payloads.Gang{ID: testWorkload(0).Start.InstanceUUID, Size: 3}
+	waiting := testWorkload(1024)
+	waiting.Start.Gang = gang
+	waitingInstance := controller.start(waiting)
+
+	late := testWorkload(1024)
+	late.Start.Gang = gang
+	late.Start.Deadline = time.Now().Add(time.Second).Format(time.RFC3339)
+	lateInstance := controller.start(late)
+
+	cluster.expectStartFailure(waitingInstance, payloads.GangFailure)
+	cluster.expectStartFailure(lateInstance, payloads.DeadlineExceeded)
+}
+
+// nextReservationStatus returns the next ReservationStatus event the
+// controller received, skipping the other events.
+func (controller *testController) nextReservationStatus() payloads.ReservationStatus {
+	t := controller.cluster.t
+
+	e := controller.nextEvent()
+	for e.event != ssntp.ReservationStatus {
+		e = controller.nextEvent()
+	}
+
+	var status payloads.EventReservationStatus
+	if err := payloads.Unmarshal(e.payload, &status); err != nil {
+		t.Fatalf("Unable to unmarshal ReservationStatus: %v", err)
+	}
+	return status.Status
+}
+
+// Checks that a reservation holds resources on its node until a START
+// command of its tenant uses it, and that unused reservations expire.
+//
+// Test is expected to pass.
+func TestReservation(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	node1 := cluster.addComputeNode(testReady(2048))
+	node2 := cluster.addComputeNode(testReady(2048))
+
+	workload := testWorkload(1536)
+	workload.Start.ReservationID = "prepared-volumes"
+	controller.reserve(payloads.ReserveCmd{
+		ReservationID:      workload.Start.ReservationID,
+		TenantUUID:         workload.Start.TenantUUID,
+		WorkloadAgentUUID:  node2.uuid,
+		RequestedResources: workload.Start.RequestedResources,
+		TTLSeconds:         3600,
+	})
+
+	result := cluster.nextResult(workload.Start.ReservationID)
+	if result.node != node2.uuid || result.reservation == nil ||
+		result.reservation.WorkloadAgentUUID != node2.uuid {
+		t.Fatalf("Reservation not sent to %s: %+v", node2.uuid, result)
+	}
+	if _, ok := result.reservation.ExpiryTime(); !ok {
+		t.Errorf("Reservation forwarded without expiry time")
+	}
+
+	status := controller.nextReservationStatus()
+	if status.State != payloads.ReservationHeld || status.NodeUUID != node2.uuid ||
+		status.Expires != result.reservation.Expires {
+		t.Fatalf("Unexpected reservation status %+v", status)
+	}
+
+	// Only node1 has room left for other instances
+	instance := controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, node1)
+
+	other := testWorkload(1024)
+	other.Start.ReservationID = workload.Start.ReservationID
+	instance = controller.start(other)
+	cluster.expectStartFailure(instance, payloads.InvalidReservation)
+
+	instance = controller.start(workload)
+	cluster.expectPlacement(instance, node2)
+
+	instance = controller.start(workload)
+	cluster.expectStartFailure(instance, payloads.InvalidReservation)
+
+	controller.reserve(payloads.ReserveCmd{
+		ReservationID:      "too-large",
+		TenantUUID:         workload.Start.TenantUUID,
+		RequestedResources: testWorkload(4096).Start.RequestedResources,
+		TTLSeconds:         1,
+	})
+	status = controller.nextReservationStatus()
+	if status.State != payloads.ReservationFailed || status.Reason == "" {
+		t.Fatalf("Unexpected reservation status %+v", status)
+	}
+
+	controller.reserve(payloads.ReserveCmd{
+		ReservationID:      "unused",
+		TenantUUID:         workload.Start.TenantUUID,
+		RequestedResources: testWorkload(512).Start.RequestedResources,
+		TTLSeconds:         1,
+	})
+	result = cluster.nextResult("unused")
+	if status = controller.nextReservationStatus(); status.State != payloads.ReservationHeld {
+		t.Fatalf("Unexpected reservation status %+v", status)
+	}
+
+	held := cluster.nodeStat(node1)
+	if result.node == node2.uuid {
+		held = cluster.nodeStat(node2)
+	}
+	held.mutex.Lock()
+	memAvailMB := held.memAvailMB
+	held.mutex.Unlock()
+
+	if status = controller.nextReservationStatus(); status.State != payloads.ReservationExpired {
+		t.Fatalf("Unexpected reservation status %+v", status)
+	}
+	held.mutex.Lock()
+	released := held.memAvailMB - memAvailMB
+	held.mutex.Unlock()
+	if released != 512 {
+		t.Errorf("Expired reservation released %d MB instead of 512", released)
+	}
+}
+
+// Checks that instances are placed on the nodes the placement extender
+// keeps, in its order, that they are refused when it keeps none, and that
+// an extender failure places them without it or refuses them depending on
+// the failure policy.
+//
+// Test is expected to pass.
+func TestPlacementExtender(t *testing.T) {
+	var mutex sync.Mutex
+	var keep func(nodes []extenderNode) []string
+	setKeep := func(f func(nodes []extenderNode) []string) {
+		mutex.Lock()
+		keep = f
+		mutex.Unlock()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req extenderRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Unable to decode extender request: %v", err)
+		}
+		if req.Workload.Resources[payloads.MemMB] != 1024 {
+			t.Errorf("Wrong workload resources %v", req.Workload.Resources)
+		}
+		mutex.Lock()
+		f := keep
+		mutex.Unlock()
+		if f == nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(extenderResponse{Nodes: f(req.Nodes)})
+	}))
+	defer server.Close()
+
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	cluster.sched.extender = newPlacementExtender(server.URL, testTimeout, extenderFailClosed)
+
+	controller := cluster.addController()
+	cluster.addComputeNode(testReady(512))
+	first := cluster.addComputeNode(testReady(4096))
+	second := cluster.addComputeNode(testReady(4096))
+
+	setKeep(func(nodes []extenderNode) []string {
+		if len(nodes) != 2 {
+			t.Errorf("Expected 2 candidate nodes, got %d", len(nodes))
+		}
+		return []string{"unknown", second.uuid, first.uuid}
+	})
+	for i := 0; i < 2; i++ {
+		instance := controller.start(testWorkload(1024))
+		cluster.expectPlacement(instance, second)
+	}
+
+	setKeep(func(nodes []extenderNode) []string { return nil })
+	instance := controller.start(testWorkload(1024))
+	cluster.expectStartFailure(instance, payloads.PlacementRefused)
+
+	setKeep(nil)
+	instance = controller.start(testWorkload(1024))
+	cluster.expectStartFailure(instance, payloads.PlacementRefused)
+
+	cluster.sched.extender = newPlacementExtender(server.URL, testTimeout, extenderFailOpen)
+	instance = controller.start(testWorkload(1024))
+	if result := cluster.nextResult(instance); result.node == "" {
+		t.Fatalf("Instance %s not placed without the extender: %s", instance, result.failure)
+	}
+}
+
+// nextTopology sends a TOPOLOGY command and returns the ClusterTopology
+// event the controller received in reply, skipping the other events.
+func (controller *testController) nextTopology() payloads.ClusterTopologyEvent {
+	t := controller.cluster.t
+
+	if _, err := controller.ssntp.SendCommand(ssntp.TOPOLOGY, nil); err != nil {
+		t.Fatalf("Unable to send TOPOLOGY: %v", err)
+	}
+
+	e := controller.nextEvent()
+	for e.event != ssntp.ClusterTopology {
+		e = controller.nextEvent()
+	}
+
+	var topology payloads.ClusterTopology
+	if err := payloads.Unmarshal(e.payload, &topology); err != nil {
+		t.Fatalf("Unable to unmarshal ClusterTopology: %v", err)
+	}
+	return topology.Topology
+}
+
+// Checks that the scheduler answers TOPOLOGY commands with the connected
+// controllers and nodes, their resources, zone and labels.
+//
+// Test is expected to pass.
+func TestClusterTopology(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+	netNode := cluster.addNetworkNode(testReady(2048))
+
+	capabilities := versionCapabilities("1.0")
+	capabilities.FailureDomain = &payloads.FailureDomain{Zone: "az1", Rack: "r1"}
+	capabilities.Labels = map[string]string{"pool": "batch"}
+	node.sendCapabilities(capabilities)
+
+	instance := controller.start(testWorkload(1024))
+	cluster.expectPlacement(instance, node)
+
+	topology := controller.nextTopology()
+	if len(topology.Controllers) != 1 || topology.Controllers[0].Status != "MASTER" {
+		t.Fatalf("Wrong controllers %+v", topology.Controllers)
+	}
+
+	if len(topology.ComputeNodes) != 1 || len(topology.NetworkNodes) != 1 {
+		t.Fatalf("Wrong nodes %+v", topology)
+	}
+
+	cn := topology.ComputeNodes[0]
+	if cn.NodeUUID != node.uuid || cn.NodeType != payloads.ComputeNode ||
+		cn.MemTotalMB != 4096 || cn.MemAvailableMB != 3072 || cn.GPUsAvailable != -1 ||
+		cn.Capabilities == nil || cn.Capabilities.FailureDomain.Zone != "az1" ||
+		cn.Capabilities.Labels["pool"] != "batch" {
+		t.Errorf("Wrong compute node %+v", cn)
+	}
+
+	nn := topology.NetworkNodes[0]
+	if nn.NodeUUID != netNode.uuid || nn.NodeType != payloads.NetworkNode || nn.Capabilities != nil {
+		t.Errorf("Wrong network node %+v", nn)
+	}
+}
+
+// Checks that backfill instances are only placed on nodes with ample
+// headroom, that they are preempted to make room for other instances, and
+// that they are placed again once their node deleted them, without the
+// controller seeing them deleted.
+//
+// Test is expected to pass.
+func TestBackfill(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+
+	work := testWorkload(1024)
+	work.Start.Backfill = true
+	backfill := controller.start(work)
+	cluster.expectPlacement(backfill, node)
+
+	// Less than half of the node would be left free
+	large := testWorkload(2048)
+	large.Start.Backfill = true
+	cluster.expectStartFailure(controller.start(large), payloads.FullCloud)
+
+	instance := controller.start(testWorkload(3584))
+	for deleted, placed := false, false; !deleted || !placed; {
+		select {
+		case r := <-cluster.results:
+			switch {
+			case r.deleted && r.instance == backfill && r.node == node.uuid:
+				deleted = true
+			case r.start != nil && r.instance == instance && r.node == node.uuid:
+				placed = true
+			default:
+				t.Fatalf("Unexpected outcome %+v", r)
+			}
+		case <-time.After(testTimeout):
+			t.Fatalf("Backfill instance %s not preempted for instance %s", backfill, instance)
+		}
+	}
+
+	e := controller.nextEvent()
+	for e.event == ssntp.NodeConnected {
+		e = controller.nextEvent()
+	}
+	var changed payloads.EventInstanceStateChanged
+	if err := payloads.Unmarshal(e.payload, &changed); err != nil || e.event != ssntp.InstanceStateChanged {
+		t.Fatalf("Expected InstanceStateChanged, got %s: %v", e.event, err)
+	}
+	if changed.StateChanged.InstanceUUID != backfill || changed.StateChanged.State != payloads.Pending {
+		t.Errorf("Wrong state change %+v", changed.StateChanged)
+	}
+
+	// The preempted instance waits for its node to delete it
+	other := cluster.addComputeNode(testReady(4096))
+	cluster.expectNoResult()
+
+	node.sendEvent(ssntp.InstanceDeleted, &payloads.EventInstanceDeleted{
+		InstanceDeleted: payloads.InstanceDeletedEvent{InstanceUUID: backfill},
+	})
+	cluster.expectPlacement(backfill, other)
+
+	other.sendEvent(ssntp.InstanceReady, &payloads.EventInstanceReady{
+		InstanceReady: payloads.InstanceReadyEvent{InstanceUUID: backfill},
+	})
+	e = controller.nextEvent()
+	for e.event == ssntp.NodeConnected {
+		e = controller.nextEvent()
+	}
+	if e.event != ssntp.InstanceReady {
+		t.Fatalf("Expected InstanceReady, got %s", e.event)
+	}
+}
+
+// Checks that, with thermal scoring, instances are steered away from the
+// compute nodes that are too hot or draw too much power, and placed on the
+// least stressed one when they fit on no other node.
+//
+// Test is expected to pass.
+func TestThermalScoring(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+	cluster.sched.thermal = newThermalScorer(80, 300)
+
+	controller := cluster.addController()
+
+	hot := testReady(4096)
+	hot.CPUTemperatureC = 85
+	hotNode := cluster.addComputeNode(hot)
+
+	busy := testReady(4096)
+	busy.PowerWatts = 450
+	busyNode := cluster.addComputeNode(busy)
+
+	cool := testReady(2048)
+	cool.CPUTemperatureC = 50
+	cool.PowerWatts = 120
+	coolNode := cluster.addComputeNode(cool)
+
+	for i := 0; i < 2; i++ {
+		cluster.expectPlacement(controller.start(testWorkload(512)), coolNode)
+	}
+
+	// 85/80 is less stressed than 450/300
+	cluster.expectPlacement(controller.start(testWorkload(3072)), hotNode)
+
+	busyNode.sendReady(testReady(4096))
+	cluster.expectPlacement(controller.start(testWorkload(3072)), busyNode)
+}
+
+// Checks that, with memory pressure scoring, instances are steered away from
+// the compute nodes under memory pressure before they are full, and placed on
+// the least pressured one when they fit on no other node.
+//
+// Test is expected to pass.
+func TestMemoryPressureScoring(t *testing.T) {
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+	cluster.sched.pressure = newPressureScorer(10)
+
+	controller := cluster.addController()
+
+	pressured := testReady(4096)
+	pressured.MemPressure = 25
+	pressuredNode := cluster.addComputeNode(pressured)
+
+	stalling := testReady(4096)
+	stalling.MemPressure = 12
+	stallingNode := cluster.addComputeNode(stalling)
+
+	calm := testReady(2048)
+	calm.MemPressure = 0.5
+	calmNode := cluster.addComputeNode(calm)
+
+	for i := 0; i < 2; i++ {
+		cluster.expectPlacement(controller.start(testWorkload(512)), calmNode)
+	}
+
+	cluster.expectPlacement(controller.start(testWorkload(3072)), stallingNode)
+
+	pressuredNode.sendReady(testReady(4096))
+	cluster.expectPlacement(controller.start(testWorkload(3072)), pressuredNode)
+}
+
+// Checks that a standby scheduler gets the placements and the instance
+// owners of the active one, resynchronizes from a snapshot when it misses
+// log entries, rejects tampered messages and stops taking the state of the
+// active scheduler once it took over.
+//
+// Test is expected to pass.
+func TestReplication(t *testing.T) {
+	key := []byte("replication key")
+	standby := newSsntpSchedulerServer()
+	standby.replica = newReplica(standby, key)
+	server := httptest.NewServer(standby.replica)
+	defer server.Close()
+
+	cluster := newTestCluster(t)
+	defer cluster.shutdown()
+	active := cluster.sched
+	active.replicator = newReplicator(server.URL, key)
+
+	synced := func() bool {
+		active.placementMutex.Lock()
+		active.ownerMutex.Lock()
+		digest := stateDigest(active.placements, active.owners)
+		active.ownerMutex.Unlock()
+		active.placementMutex.Unlock()
+
+		standby.placementMutex.Lock()
+		standby.ownerMutex.Lock()
+		defer standby.ownerMutex.Unlock()
+		defer standby.placementMutex.Unlock()
+		return len(standby.placements) > 0 && stateDigest(standby.placements, standby.owners) == digest
+	}
+
+	controller := cluster.addController()
+	node := cluster.addComputeNode(testReady(4096))
+	first := controller.start(testWorkload(512))
+	cluster.expectPlacement(first, node)
+
+	active.replicate(time.Hour)
+	if !synced() {
+		t.Fatalf("Standby not synchronized from the snapshot")
+	}
+
+	second := controller.start(testWorkload(512))
+	cluster.expectPlacement(second, node)
+	active.replicate(time.Hour)
+	if !synced() || len(active.replicator.backlog) != 0 {
+		t.Fatalf("Standby not synchronized from the log entries")
+	}
+
+	standby.ownerMutex.Lock()
+	owner := standby.owners[second]
+	standby.ownerMutex.Unlock()
+	if owner != controller.uuid {
+		t.Errorf("Standby owner of %s is %q, expected %q", second, owner, controller.uuid)
+	}
+
+	// Lose the log entries of the first deletion
+	active.forgetPlacement(first)
+	active.replicator.mutex.Lock()
+	active.replicator.backlog = nil
+	active.replicator.mutex.Unlock()
+	active.forgetOwner(first)
+
+	active.replicate(time.Hour)
+	if synced() || !active.replicator.resync {
+		t.Fatalf("Standby did not ask for a snapshot after missing log entries")
+	}
+	active.replicate(time.Hour)
+	if !synced() {
+		t.Fatalf("Standby not resynchronized")
+	}
+
+	body := []byte(`{"entries":[{"sequence":100,"op":"forget","instance_uuid":"` + second + `"}]}`)
+	sum := sha256.Sum256(body)
+	for _, checksum := range []string{
+		hex.EncodeToString(sum[:]),
+		replicationChecksum([]byte("another key"), body),
+	} {
+		req, _ := http.NewRequest("POST", server.URL, bytes.NewReader(body))
+		req.Header.Set(replicationChecksumHeader, checksum)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unable to post replication message: %v", err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Unauthenticated replication message answered %s", resp.Status)
+		}
+	}
+
+	standby.replica.takeOver()
+	active.forgetPlacement(second)
+	active.replicate(time.Hour)
+	standby.placementMutex.Lock()
+	_, kept := standby.placements[second]
+	standby.placementMutex.Unlock()
+	if !kept || len(active.replicator.backlog) != 1 {
+		t.Errorf("Standby applied log entries after taking over")
+	}
+}
@@ -0,0 +1,282 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+)
+
+// snapshotVersion is the version of the cluster snapshot format.  It is
+// bumped each time a field is removed or changes meaning, so that the tools
+// reading snapshots can tell which fields to expect.
+const snapshotVersion = 1
+
+// controllerSnapshot is the scheduler view of a connected controller.
+type controllerSnapshot struct {
+	UUID   string `yaml:"uuid"`
+	Status string `yaml:"status"`
+}
+
+// nodeSnapshot is the scheduler view of a connected compute or network
+// node.  The available resources account for the instances placed on the
+// node since its last READY.  Resources the node does not report are -1.
+type nodeSnapshot struct {
+	UUID                    string                     `yaml:"uuid"`
+	Status                  string                     `yaml:"status"`
+	MRU                     bool                       `yaml:"mru,omitempty"`
+	MemTotalMB              int                        `yaml:"mem_total_mb"`
+	MemAvailableMB          int                        `yaml:"mem_available_mb"`
+	Load                    int                        `yaml:"load"`
+	CpusOnline              int                        `yaml:"cpus_online"`
+	GPUsAvailable           int                        `yaml:"gpus_available"`
+	DedicatedCoresAvailable int                        `yaml:"dedicated_cores_available"`
+	DiskIOPSAvailable       int                        `yaml:"disk_iops_available"`
+	NetIngressKbpsAvailable int                        `yaml:"net_ingress_kbps_available"`
+	NetEgressKbpsAvailable  int                        `yaml:"net_egress_kbps_available"`
+	CNCIsAvailable          int                        `yaml:"cncis_available"`
+	CNCIKbpsAvailable       int                        `yaml:"cnci_bandwidth_kbps_available"`
+	PublicIPsAvailable      int                        `yaml:"public_ips_available"`
+	Capabilities            *payloads.NodeCapabilities `yaml:"capabilities,omitempty"`
+	Draining                bool                       `yaml:"draining,omitempty"`
+	Upgrading               bool                       `yaml:"upgrading,omitempty"`
+}
+
+// placementSnapshot records the node an instance was sent to.
+type placementSnapshot struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+	NodeUUID     string `yaml:"node_uuid"`
+	MemMB        int    `yaml:"mem_mb"`
+	Time         string `yaml:"time"`
+}
+
+// publicIPPoolSnapshot is the utilization of the public IP pool of a
+// concentrator.
+type publicIPPoolSnapshot struct {
+	ConcentratorUUID string `yaml:"concentrator_uuid"`
+	Size             int    `yaml:"size"`
+	Assigned         int    `yaml:"assigned"`
+}
+
+// clusterSnapshot is the complete view the scheduler has of the cluster.
+// The scheduler does not queue the START commands it cannot place, so a
+// snapshot has no pending commands.
+type clusterSnapshot struct {
+	Version       int                    `yaml:"version"`
+	Time          string                 `yaml:"time"`
+	Controllers   []controllerSnapshot   `yaml:"controllers"`
+	ComputeNodes  []nodeSnapshot         `yaml:"compute_nodes"`
+	NetworkNodes  []nodeSnapshot         `yaml:"network_nodes"`
+	Placements    []placementSnapshot    `yaml:"placements"`
+	PublicIPPools []publicIPPoolSnapshot `yaml:"public_ip_pools"`
+}
+
+// placement is an instance the scheduler sent to a node, until it is
+// deleted.
+type placement struct {
+	node   string
+	tenant string
+	memMB  int
+	time   time.Time
+}
+
+// recordPlacement remembers that instance was sent to node.
+func (sched *ssntpSchedulerServer) recordPlacement(instance, node string, workload *workResources) {
+	sched.placementMutex.Lock()
+	defer sched.placementMutex.Unlock()
+
+	p := placement{
+		node:   node,
+		tenant: workload.start.TenantUUID,
+		memMB:  workload.memReqMB,
+		time:   time.Now(),
+	}
+	sched.placements[instance] = p
+	sched.replicator.log(replicationEntry{
+		Op:           replicatePlace,
+		InstanceUUID: instance,
+		NodeUUID:     p.node,
+		TenantUUID:   p.tenant,
+		MemMB:        p.memMB,
+		Time:         p.time,
+	})
+}
+
+// forgetPlacement forgets a deleted instance.
+func (sched *ssntpSchedulerServer) forgetPlacement(instance string) {
+	sched.placementMutex.Lock()
+	defer sched.placementMutex.Unlock()
+
+	delete(sched.placements, instance)
+	sched.replicator.log(replicationEntry{Op: replicateForget, InstanceUUID: instance})
+}
+
+func snapshotNode(node *nodeStat, mru bool) nodeSnapshot {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+
+	return nodeSnapshot{
+		UUID:                    node.uuid,
+		Status:                  node.status.String(),
+		MRU:                     mru,
+		MemTotalMB:              node.memTotalMB,
+		MemAvailableMB:          node.memAvailMB,
+		Load:                    node.load,
+		CpusOnline:              node.cpus,
+		GPUsAvailable:           node.gpusAvail,
+		DedicatedCoresAvailable: node.coresAvail,
+		DiskIOPSAvailable:       node.diskIOPSAvail,
+		NetIngressKbpsAvailable: node.ingressKbpsAvail,
+		NetEgressKbpsAvailable:  node.egressKbpsAvail,
+		CNCIsAvailable:          node.cncisAvail,
+		CNCIKbpsAvailable:       node.cnciKbpsAvail,
+		PublicIPsAvailable:      node.publicIPsAvail,
+		Capabilities:            node.capabilities,
+		Draining:                node.draining,
+		Upgrading:               node.upgrading,
+	}
+}
+
+// snapshot returns the current view the scheduler has of the cluster,
+// sorted by UUID so that two snapshots of the same cluster can be diffed.
+func (sched *ssntpSchedulerServer) snapshot() *clusterSnapshot {
+	snap := &clusterSnapshot{
+		Version:       snapshotVersion,
+		Time:          time.Now().UTC().Format(time.RFC3339),
+		Controllers:   []controllerSnapshot{},
+		ComputeNodes:  []nodeSnapshot{},
+		NetworkNodes:  []nodeSnapshot{},
+		Placements:    []placementSnapshot{},
+		PublicIPPools: []publicIPPoolSnapshot{},
+	}
+
+	sched.controllerMutex.RLock()
+	for _, controller := range sched.controllerMap {
+		controller.mutex.Lock()
+		snap.Controllers = append(snap.Controllers, controllerSnapshot{
+			UUID:   controller.uuid,
+			Status: controller.status.String(),
+		})
+		controller.mutex.Unlock()
+	}
+	sched.controllerMutex.RUnlock()
+
+	sched.cnMutex.RLock()
+	for _, node := range sched.cnMap {
+		snap.ComputeNodes = append(snap.ComputeNodes, snapshotNode(node, node == sched.cnMRU))
+	}
+	sched.cnMutex.RUnlock()
+
+	sched.nnMutex.RLock()
+	for _, node := range sched.nnMap {
+		snap.NetworkNodes = append(snap.NetworkNodes, snapshotNode(node, node.uuid == sched.nnMRU))
+	}
+	sched.nnMutex.RUnlock()
+
+	sched.placementMutex.Lock()
+	for instance, p := range sched.placements {
+		snap.Placements = append(snap.Placements, placementSnapshot{
+			InstanceUUID: instance,
+			NodeUUID:     p.node,
+			MemMB:        p.memMB,
+			Time:         p.time.UTC().Format(time.RFC3339),
+		})
+	}
+	sched.placementMutex.Unlock()
+
+	sched.ipPoolMutex.Lock()
+	for concentrator, pool := range sched.ipPools {
+		snap.PublicIPPools = append(snap.PublicIPPools, publicIPPoolSnapshot{
+			ConcentratorUUID: concentrator,
+			Size:             pool.size,
+			Assigned:         pool.assigned,
+		})
+	}
+	sched.ipPoolMutex.Unlock()
+
+	sort.Slice(snap.Controllers, func(i, j int) bool {
+		return snap.Controllers[i].UUID < snap.Controllers[j].UUID
+	})
+	sort.Slice(snap.ComputeNodes, func(i, j int) bool {
+		return snap.ComputeNodes[i].UUID < snap.ComputeNodes[j].UUID
+	})
+	sort.Slice(snap.NetworkNodes, func(i, j int) bool {
+		return snap.NetworkNodes[i].UUID < snap.NetworkNodes[j].UUID
+	})
+	sort.Slice(snap.Placements, func(i, j int) bool {
+		return snap.Placements[i].InstanceUUID < snap.Placements[j].InstanceUUID
+	})
+	sort.Slice(snap.PublicIPPools, func(i, j int) bool {
+		return snap.PublicIPPools[i].ConcentratorUUID < snap.PublicIPPools[j].ConcentratorUUID
+	})
+
+	return snap
+}
+
+// writeSnapshot writes a snapshot of the cluster to path, marshalled with
+// the given encoding.  The file is replaced atomically so that readers
+// never see a partial snapshot.
+func (sched *ssntpSchedulerServer) writeSnapshot(path string, encoding payloads.Encoding) error {
+	data, err := payloads.Marshal(encoding, sched.snapshot())
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// dumpSnapshots writes a snapshot of the cluster to path on SIGUSR1.
+func dumpSnapshots(sched *ssntpSchedulerServer, path string, encoding payloads.Encoding) {
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGUSR1)
+
+	for range signalCh {
+		clog.Infof("Received SIGUSR1, writing cluster snapshot to %s", path)
+		if err := sched.writeSnapshot(path, encoding); err != nil {
+			clog.Errorf("Could not write cluster snapshot: %s", err)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"sort"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// tenantNetKey identifies a tenant network of a node: the bridge of a
+// tenant subnet, tunneled to a concentrator.
+type tenantNetKey struct {
+	tenant       string
+	subnet       string
+	concentrator string
+}
+
+func tenantNetKeyOf(n *payloads.TenantNetwork) tenantNetKey {
+	return tenantNetKey{n.TenantUUID, n.TenantSubnet, n.ConcentratorUUID}
+}
+
+// tenantNets are the tenant networks of a node, as announced by its
+// TenantAdded and TenantRemoved events, and the drift found in its last
+// TenantNetworksReport.
+type tenantNets struct {
+	// verified is false until the first report of the node, whose
+	// networks are taken as they are since the scheduler may not have
+	// seen the events announcing them.
+	verified bool
+	added    map[tenantNetKey]payloads.TenantNetwork
+	orphaned map[tenantNetKey]bool
+	missing  map[tenantNetKey]bool
+}
+
+func newTenantNets() *tenantNets {
+	return &tenantNets{
+		added:    make(map[tenantNetKey]payloads.TenantNetwork),
+		orphaned: make(map[tenantNetKey]bool),
+		missing:  make(map[tenantNetKey]bool),
+	}
+}
+
+// getTenantNets returns the tenant networks of a node, with
+// sched.tenantNetMutex held.
+func (sched *ssntpSchedulerServer) getTenantNets(uuid string) *tenantNets {
+	nets := sched.tenantNets[uuid]
+	if nets == nil {
+		nets = newTenantNets()
+		sched.tenantNets[uuid] = nets
+	}
+
+	return nets
+}
+
+// recordTenantEvent adds a tenant network announced by the TenantAdded
+// event of a node to its history, or removes the one a TenantRemoved event
+// announced.
+func (sched *ssntpSchedulerServer) recordTenantEvent(uuid string, event ssntp.Event, payload []byte) {
+	var tenant payloads.TenantAddedEvent
+	switch event {
+	case ssntp.TenantAdded:
+		var ev payloads.EventTenantAdded
+		if err := payloads.Unmarshal(payload, &ev); err != nil {
+			// left for fwdEventToCNCI to report
+			return
+		}
+		tenant = ev.TenantAdded
+	case ssntp.TenantRemoved:
+		var ev payloads.EventTenantRemoved
+		if err := payloads.Unmarshal(payload, &ev); err != nil {
+			return
+		}
+		tenant = ev.TenantRemoved
+	}
+
+	n := payloads.TenantNetwork{
+		TenantUUID:       tenant.TenantUUID,
+		TenantSubnet:     tenant.TenantSubnet,
+		ConcentratorUUID: tenant.ConcentratorUUID,
+		ConcentratorIP:   tenant.ConcentratorIP,
+		Tunnel:           true,
+	}
+
+	sched.tenantNetMutex.Lock()
+	defer sched.tenantNetMutex.Unlock()
+
+	nets := sched.getTenantNets(uuid)
+	if event == ssntp.TenantAdded {
+		nets.added[tenantNetKeyOf(&n)] = n
+	} else {
+		delete(nets.added, tenantNetKeyOf(&n))
+	}
+}
+
+// checkTenantNetworks compares the tenant networks a node reports with
+// the ones its events announced.  Discrepancies are only reported when the
+// previous report of the node had them too, so that networks whose events
+// are still in flight are not taken for drift.
+func (sched *ssntpSchedulerServer) checkTenantNetworks(uuid string, payload []byte) {
+	var event payloads.EventTenantNetworksReport
+	err := payloads.Unmarshal(payload, &event)
+	if err == nil {
+		err = payloads.Validate(&event)
+	}
+	if err != nil {
+		clog.Errorf("Bad TenantNetworksReport yaml from %s: %s\n", uuid, err)
+		sched.sendInvalidPayloadError(uuid, ssntp.EVENT, ssntp.TenantNetworksReport, "", err)
+		return
+	}
+
+	drift := payloads.TenantNetworkDrift{AgentUUID: uuid}
+
+	sched.tenantNetMutex.Lock()
+	nets := sched.getTenantNets(uuid)
+
+	reported := make(map[tenantNetKey]payloads.TenantNetwork)
+	for _, n := range event.Report.Networks {
+		reported[tenantNetKeyOf(&n)] = n
+	}
+
+	if !nets.verified {
+		for key, n := range reported {
+			n.Tunnel = true
+			nets.added[key] = n
+		}
+		nets.verified = true
+	}
+
+	orphaned := make(map[tenantNetKey]bool)
+	for key, n := range reported {
+		if _, ok := nets.added[key]; ok {
+			continue
+		}
+		orphaned[key] = true
+		if nets.orphaned[key] {
+			drift.Orphaned = append(drift.Orphaned, n)
+		}
+	}
+
+	missing := make(map[tenantNetKey]bool)
+	for key, n := range nets.added {
+		if r, ok := reported[key]; ok && r.Tunnel {
+			continue
+		}
+		missing[key] = true
+		if nets.missing[key] {
+			n.Tunnel = reported[key].Tunnel
+			drift.Missing = append(drift.Missing, n)
+		}
+	}
+
+	nets.orphaned = orphaned
+	nets.missing = missing
+	sched.tenantNetMutex.Unlock()
+
+	if len(drift.Orphaned) == 0 && len(drift.Missing) == 0 {
+		return
+	}
+
+	sortTenantNetworks(drift.Orphaned)
+	sortTenantNetworks(drift.Missing)
+
+	clog.Warningf("Tenant networks of node %s drifted: %d orphaned, %d missing\n",
+		uuid, len(drift.Orphaned), len(drift.Missing))
+	sched.sendTenantNetworkDrift(&drift)
+}
+
+func sortTenantNetworks(nets []payloads.TenantNetwork) {
+	sort.Slice(nets, func(i, j int) bool {
+		a, b := tenantNetKeyOf(&nets[i]), tenantNetKeyOf(&nets[j])
+		if a.tenant != b.tenant {
+			return a.tenant < b.tenant
+		}
+		if a.subnet != b.subnet {
+			return a.subnet < b.subnet
+		}
+		return a.concentrator < b.concentrator
+	})
+}
+
+// sendTenantNetworkDrift tells all the controllers about the drift of the
+// tenant networks of a node, and records the event in the journal.
+func (sched *ssntpSchedulerServer) sendTenantNetworkDrift(drift *payloads.TenantNetworkDrift) {
+	b, err := yaml.Marshal(&payloads.EventTenantNetworkDrift{Drift: *drift})
+	if err != nil {
+		clog.Errorf("Unable to marshal %s event: %v\n", ssntp.TenantNetworkDrift, err)
+		return
+	}
+
+	sched.controllerMutex.RLock()
+	defer sched.controllerMutex.RUnlock()
+
+	sched.journal.record(ssntp.TenantNetworkDrift, b, "")
+
+	for _, c := range sched.controllerMap {
+		ctx, cancel := sched.sendContext()
+		sched.ssntp.SendEventContext(ctx, c.uuid, ssntp.TenantNetworkDrift, b)
+		cancel()
+	}
+}
@@ -0,0 +1,127 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// controllerTenants maps the UUID of each controller to the set of tenants
+// it may send commands for.
+type controllerTenants map[string]map[string]bool
+
+// loadControllerTenants reads the tenants of each controller from a YAML
+// file mapping controller UUIDs to lists of tenant UUIDs, e.g.:
+//
+//	67d86208-b46a-4465-9018-fe14087d415f:
+//	  - 2491851d-dce9-48d6-b83a-a717417072ce
+//	  - 8b3c2c3b-c78f-4d95-a6e3-c1bc58a3b1a2
+//	a3b4f1f2-2b50-4a5c-8a4e-cd39a3c0bd0e:
+//	  - 5a5b8a8e-5a8c-4a8e-b24e-3c2b6f5d7d1c
+func loadControllerTenants(path string) (controllerTenants, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lists map[string][]string
+	if err = yaml.Unmarshal(data, &lists); err != nil {
+		return nil, fmt.Errorf("Invalid controller tenants file %s: %v", path, err)
+	}
+
+	tenants := make(controllerTenants)
+	for controller, list := range lists {
+		tenants[controller] = make(map[string]bool)
+		for _, tenant := range list {
+			tenants[controller][tenant] = true
+		}
+	}
+
+	return tenants, nil
+}
+
+// placementTenant returns the tenant of an instance the scheduler placed,
+// or "" if the instance is unknown.
+func (sched *ssntpSchedulerServer) placementTenant(instance string) string {
+	sched.placementMutex.Lock()
+	defer sched.placementMutex.Unlock()
+
+	return sched.placements[instance].tenant
+}
+
+// commandTenant returns the tenant a command acts on: the tenant carried
+// in the START, RESTART and RESERVE payloads or, for the other instance commands,
+// the tenant of the instance when it was started.  It returns "" for the
+// commands that concern the whole cluster or a node, and for instances the
+// scheduler did not place.  Invalid payloads are left for the command
+// handlers to report.
+func (sched *ssntpSchedulerServer) commandTenant(command ssntp.Command, payload []byte) string {
+	switch command {
+	case ssntp.START:
+		var cmd payloads.Start
+		if err := payloads.Unmarshal(payload, &cmd); err == nil {
+			return cmd.Start.TenantUUID
+		}
+	case ssntp.RESTART:
+		var cmd payloads.Restart
+		if err := payloads.Unmarshal(payload, &cmd); err == nil {
+			if cmd.Restart.TenantUUID != "" {
+				return cmd.Restart.TenantUUID
+			}
+			return sched.placementTenant(cmd.Restart.InstanceUUID)
+		}
+	case ssntp.RESERVE:
+		var cmd payloads.Reserve
+		if err := payloads.Unmarshal(payload, &cmd); err == nil {
+			return cmd.Reserve.TenantUUID
+		}
+	case ssntp.STOP, ssntp.DELETE, ssntp.COLLECTDIAGNOSTICS, ssntp.SECURITYGROUP:
+		instanceUUID, _, err := sched.getWorkloadAgentUUID(command, payload)
+		if err == nil && instanceUUID != "" {
+			return sched.placementTenant(instanceUUID)
+		}
+	}
+
+	return ""
+}
+
+// mayCommand returns nil if controller, whose status is given, may send
+// command.  Without controller tenants, only the master controller may
+// send commands.  With them, any controller may send commands for its own
+// tenants and none for the other tenants, and the commands that do not act
+// on a tenant are still only taken from the master controller.
+func (sched *ssntpSchedulerServer) mayCommand(controller string, status controllerStatus, command ssntp.Command, payload []byte) error {
+	if sched.tenants != nil {
+		if tenant := sched.commandTenant(command, payload); tenant != "" {
+			if !sched.tenants[controller][tenant] {
+				return fmt.Errorf("tenant %s is not registered for Controller %s", tenant, controller)
+			}
+			return nil
+		}
+	}
+
+	if status != controllerMaster {
+		return fmt.Errorf("Controller %s is not master", controller)
+	}
+
+	return nil
+}
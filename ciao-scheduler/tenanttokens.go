@@ -0,0 +1,451 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// defaultJWKSRefresh is the interval between two downloads of the JWKS
+// tenant tokens are verified against.
+const defaultJWKSRefresh = 15 * time.Minute
+
+// minJWKSRefresh is the minimum interval between two downloads of the JWKS
+// asked for by tokens signed with an unknown key.  As anyone sending
+// commands can make up key IDs, these downloads must be rate limited.
+const minJWKSRefresh = time.Minute
+
+// tenantTokenVerifier verifies the tenant tokens carried by the commands
+// acting on a tenant.  Tokens are JWTs whose sub claim is the tenant UUID,
+// signed with HS256 and a key shared with the token issuer, or with RS256
+// or ES256 and a key of the issuer's JSON Web Key Set.  Their exp and nbf
+// claims, if any, are checked.  A nil tenantTokenVerifier accepts all
+// commands.
+type tenantTokenVerifier struct {
+	sharedKey []byte
+	jwksURL   string
+	refresh   chan struct{}
+
+	mutex sync.RWMutex
+	// JWKS keys, by key ID
+	keys map[string]crypto.PublicKey
+}
+
+func newTenantTokenVerifier(sharedKey []byte, jwksURL string) *tenantTokenVerifier {
+	return &tenantTokenVerifier{
+		sharedKey: sharedKey,
+		jwksURL:   jwksURL,
+		refresh:   make(chan struct{}, 1),
+		keys:      make(map[string]crypto.PublicKey),
+	}
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Sub string `json:"sub"`
+	Exp int64  `json:"exp"`
+	Nbf int64  `json:"nbf"`
+}
+
+// verify returns nil if token is a valid tenant token for tenant at now.
+func (v *tenantTokenVerifier) verify(token, tenant string, now time.Time) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return fmt.Errorf("malformed token")
+	}
+
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return fmt.Errorf("invalid token header: %v", err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return fmt.Errorf("invalid token signature: %v", err)
+	}
+
+	if err = v.checkSignature(&header, parts[0]+"."+parts[1], signature); err != nil {
+		return err
+	}
+
+	var claims jwtClaims
+	if err = decodeJWTPart(parts[1], &claims); err != nil {
+		return fmt.Errorf("invalid token claims: %v", err)
+	}
+
+	switch {
+	case claims.Sub != tenant:
+		return fmt.Errorf("token issued for tenant %s", claims.Sub)
+	case claims.Exp != 0 && now.Unix() >= claims.Exp:
+		return fmt.Errorf("token expired at %v", time.Unix(claims.Exp, 0))
+	case claims.Nbf != 0 && now.Unix() < claims.Nbf:
+		return fmt.Errorf("token not valid before %v", time.Unix(claims.Nbf, 0))
+	}
+
+	return nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+// checkSignature checks the signature of signed, the header and claims of
+// a token.  The shared key is only used for HS256 tokens and the JWKS keys
+// for RS256 and ES256 tokens, so that a token can not be signed with a
+// public key taken for a shared one.
+func (v *tenantTokenVerifier) checkSignature(header *jwtHeader, signed string, signature []byte) error {
+	if header.Alg == "HS256" {
+		if v.sharedKey == nil {
+			return fmt.Errorf("HS256 tokens not accepted")
+		}
+		mac := hmac.New(sha256.New, v.sharedKey)
+		_, _ = mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return fmt.Errorf("unsupported token algorithm %q", header.Alg)
+	}
+
+	v.mutex.RLock()
+	key := v.keys[header.Kid]
+	v.mutex.RUnlock()
+
+	if key == nil {
+		v.refreshKeys()
+		return fmt.Errorf("unknown token key %q", header.Kid)
+	}
+
+	digest := sha256.Sum256([]byte(signed))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg == "RS256" &&
+			rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg == "ES256" && len(signature) == 64 {
+			r := new(big.Int).SetBytes(signature[:32])
+			s := new(big.Int).SetBytes(signature[32:])
+			if ecdsa.Verify(key, digest[:], r, s) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("invalid token signature")
+}
+
+// refreshKeys asks for the JWKS to be downloaded again, e.g., because the
+// issuer rotated its keys.
+func (v *tenantTokenVerifier) refreshKeys() {
+	if v.jwksURL == "" {
+		return
+	}
+
+	select {
+	case v.refresh <- struct{}{}:
+	default:
+	}
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// loadKeys downloads the JWKS and replaces the keys tokens are verified
+// against with its RSA and P-256 keys.
+func (v *tenantTokenVerifier) loadKeys(client *http.Client) error {
+	resp, err := client.Get(v.jwksURL)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS download failed: %s", resp.Status)
+	}
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("invalid JWKS: %v", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i := range set.Keys {
+		key, err := set.Keys[i].publicKey()
+		if err != nil {
+			clog.Warningf("Ignoring JWKS key %q: %v\n", set.Keys[i].Kid, err)
+			continue
+		}
+		keys[set.Keys[i].Kid] = key
+	}
+
+	v.mutex.Lock()
+	v.keys = keys
+	v.mutex.Unlock()
+
+	return nil
+}
+
+// refreshKeysLoop downloads the JWKS every period, and when a token signed
+// with an unknown key is received, at most once every minJWKSRefresh.
+func (v *tenantTokenVerifier) refreshKeysLoop(period time.Duration) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		if err := v.loadKeys(client); err != nil {
+			clog.Warningf("Unable to load tenant token keys from %s: %v\n", v.jwksURL, err)
+		}
+		loaded := time.Now()
+
+		select {
+		case <-ticker.C:
+		case <-v.refresh:
+			time.Sleep(refreshDelay(loaded, time.Now()))
+		}
+	}
+}
+
+// refreshDelay returns how long to wait, at now, before downloading again
+// a JWKS last downloaded at loaded because of an unknown key.
+func refreshDelay(loaded, now time.Time) time.Duration {
+	if wait := loaded.Add(minJWKSRefresh).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// tokenCommand returns an empty payload for command and the address of its
+// tenant token field, or nil if command does not carry a tenant token.
+func tokenCommand(command ssntp.Command) (interface{}, *string) {
+	switch command {
+	case ssntp.START:
+		var cmd payloads.Start
+		return &cmd, &cmd.Start.TenantToken
+	case ssntp.RESTART:
+		var cmd payloads.Restart
+		return &cmd, &cmd.Restart.TenantToken
+	case ssntp.STOP:
+		var cmd payloads.Stop
+		return &cmd, &cmd.Stop.TenantToken
+	case ssntp.DELETE:
+		var cmd payloads.Delete
+		return &cmd, &cmd.Delete.TenantToken
+	case ssntp.COLLECTDIAGNOSTICS:
+		var cmd payloads.CollectDiagnostics
+		return &cmd, &cmd.Collect.TenantToken
+	case ssntp.SECURITYGROUP:
+		var cmd payloads.SecurityGroupRules
+		return &cmd, &cmd.Group.TenantToken
+	case ssntp.RESERVE:
+		var cmd payloads.Reserve
+		return &cmd, &cmd.Reserve.TenantToken
+	}
+
+	return nil, nil
+}
+
+// withoutTenantToken returns payload without its tenant token, so that the
+// nodes never receive tenant tokens, or nil if payload has no token.
+func withoutTenantToken(command ssntp.Command, payload []byte) []byte {
+	cmd, token := tokenCommand(command)
+	if cmd == nil || payloads.Unmarshal(payload, cmd) != nil || *token == "" {
+		return nil
+	}
+
+	*token = ""
+	stripped, err := payloads.Marshal(payloads.PayloadEncoding(payload), cmd)
+	if err != nil {
+		clog.Errorf("Unable to marshal %s without tenant token: %v\n", command, err)
+		return nil
+	}
+
+	return stripped
+}
+
+// authenticateTenant returns nil if the tenant of command, when it acts on
+// a tenant the scheduler knows, is authenticated by the tenant token of
+// the command.  The commands for instances scheduler did not place are
+// left to the controller authorizations.
+func (sched *ssntpSchedulerServer) authenticateTenant(command ssntp.Command, payload []byte) error {
+	if sched.tenantTokens == nil {
+		return nil
+	}
+
+	tenant := sched.commandTenant(command, payload)
+	if tenant == "" {
+		return nil
+	}
+
+	cmd, token := tokenCommand(command)
+	if cmd == nil {
+		return nil
+	}
+	if err := payloads.Unmarshal(payload, cmd); err != nil {
+		return err
+	}
+	if *token == "" {
+		return fmt.Errorf("no tenant token for tenant %s", tenant)
+	}
+
+	if err := sched.tenantTokens.verify(*token, tenant, time.Now()); err != nil {
+		return fmt.Errorf("tenant %s not authenticated: %v", tenant, err)
+	}
+
+	return nil
+}
+
+// rejectUnauthenticated tells controllerUUID that command was dropped
+// because its tenant is not authenticated, so that the controller fails the
+// request rather than waiting for it to complete.  The commands that have no
+// failure error of their own are answered with an InvalidPayload error.
+func (sched *ssntpSchedulerServer) rejectUnauthenticated(controllerUUID string, command ssntp.Command, payload []byte, reason error) {
+	var errorType ssntp.Error
+	var failure interface{}
+
+	switch command {
+	case ssntp.START:
+		var cmd payloads.Start
+		_ = payloads.Unmarshal(payload, &cmd)
+		errorType = ssntp.StartFailure
+		failure = &payloads.ErrorStartFailure{
+			InstanceUUID: cmd.Start.InstanceUUID,
+			Reason:       payloads.TenantNotAuthenticated,
+		}
+	case ssntp.RESTART:
+		instanceUUID, _, _ := sched.getWorkloadAgentUUID(command, payload)
+		errorType = ssntp.RestartFailure
+		failure = &payloads.ErrorRestartFailure{
+			InstanceUUID: instanceUUID,
+			Reason:       payloads.RestartTenantNotAuthenticated,
+		}
+	case ssntp.STOP:
+		instanceUUID, _, _ := sched.getWorkloadAgentUUID(command, payload)
+		errorType = ssntp.StopFailure
+		failure = &payloads.ErrorStopFailure{
+			InstanceUUID: instanceUUID,
+			Reason:       payloads.StopTenantNotAuthenticated,
+		}
+	case ssntp.DELETE:
+		instanceUUID, _, _ := sched.getWorkloadAgentUUID(command, payload)
+		errorType = ssntp.DeleteFailure
+		failure = &payloads.ErrorDeleteFailure{
+			InstanceUUID: instanceUUID,
+			Reason:       payloads.DeleteTenantNotAuthenticated,
+		}
+	default:
+		instanceUUID, _, _ := sched.getWorkloadAgentUUID(command, payload)
+		sched.sendInvalidPayloadError(controllerUUID, ssntp.COMMAND, command, instanceUUID, reason)
+		return
+	}
+
+	data, err := yaml.Marshal(failure)
+	if err != nil {
+		clog.Errorf("Unable to Marshall %s %v", errorType, err)
+		return
+	}
+
+	ctx, cancel := sched.sendContext()
+	defer cancel()
+	sched.ssntp.SendErrorContext(ctx, controllerUUID, errorType, data)
+}
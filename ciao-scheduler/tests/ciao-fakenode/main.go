@@ -0,0 +1,183 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
+	"github.com/golang/glog"
+)
+
+var (
+	server             = flag.String("server", "localhost", "URI of the SSNTP server, e.g. the scheduler under test")
+	port               = flag.Uint("port", 0, "SSNTP port of the server, 0 for the default 8888")
+	caCert             = flag.String("cacert", "/etc/pki/ciao/CAcert-server-localhost.pem", "CA certificate")
+	agentCert          = flag.String("cert", "/etc/pki/ciao/cert-client-localhost.pem", "Certificate of the simulated agents")
+	netAgentCert       = flag.String("netagent-cert", "/etc/pki/ciao/cert-netagent-localhost.pem", "Certificate of the simulated network agents")
+	agents             = flag.Int("agents", 100, "Number of simulated AGENT clients")
+	netAgents          = flag.Int("netagents", 0, "Number of simulated NETAGENT clients")
+	connectInterval    = flag.Duration("connect-interval", 10*time.Millisecond, "Time to wait between two simulated nodes connections")
+	readyInterval      = flag.Duration("ready-interval", 6*time.Second, "Interval between two READY frames of a simulated node")
+	statsInterval      = flag.Duration("stats-interval", 6*time.Second, "Interval between two STATS frames of a simulated node")
+	reportInterval     = flag.Duration("report-interval", 10*time.Second, "Interval between two activity reports, 0 to only report on exit")
+	duration           = flag.Duration("duration", 0, "Time to run for, 0 to run until interrupted")
+	startDelay         = flag.Duration("start-delay", 0, "Simulated time to launch an instance")
+	failureProbability = flag.Float64("launch-failure", 0, "Probability, between 0 and 1, of a START failing with launch_failure")
+	fullProbability    = flag.Float64("full-failure", 0, "Probability, between 0 and 1, of a START failing with full_cn regardless of the node resources")
+	memMB              = flag.Int("mem-mb", 64*1024, "Memory of a simulated node, in MB")
+	diskMB             = flag.Int("disk-mb", 512*1024, "Disk space of a simulated node, in MB")
+	cpus               = flag.Int("cpus", 32, "Number of CPUs of a simulated node")
+	maxInstances       = flag.Int("max-instances", 200, "Maximum number of instances a simulated node runs")
+	seed               = flag.Int64("seed", 0, "Seed of the simulated nodes random number generators, 0 for a time based one")
+	snapshot           = flag.String("snapshot", "", "ciao-scheduler cluster snapshot to simulate the nodes of, instead of -agents and -netagents new nodes")
+)
+
+func report(start time.Time) {
+	glog.Infof("%s: %d connects, %d disconnects, %d READY, %d STATS, %d STARTs (%d failed), %d STOPs, %d DELETEs, %d send errors",
+		time.Since(start).Truncate(time.Second),
+		atomic.LoadUint64(&activity.connects), atomic.LoadUint64(&activity.disconnects),
+		atomic.LoadUint64(&activity.readySent), atomic.LoadUint64(&activity.statsSent),
+		atomic.LoadUint64(&activity.starts), atomic.LoadUint64(&activity.startsFailed),
+		atomic.LoadUint64(&activity.stops), atomic.LoadUint64(&activity.deletes),
+		atomic.LoadUint64(&activity.sendErrors))
+}
+
+func dial(node *fakeNode, cert string) error {
+	config := &ssntp.Config{
+		UUID:        node.uuid,
+		URI:         *server,
+		Port:        uint32(*port),
+		CAcert:      *caCert,
+		Cert:        cert,
+		Role:        uint32(node.role),
+		Encodings:   []payloads.Encoding{payloads.MsgPack},
+		AtLeastOnce: true,
+	}
+
+	return node.ssntp.Dial(config, node)
+}
+
+func main() {
+	flag.Parse()
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	done := make(chan struct{})
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+
+	var timeout <-chan time.Time
+	if *duration > 0 {
+		timeout = time.After(*duration)
+	}
+
+	var ticker <-chan time.Time
+	if *reportInterval > 0 {
+		t := time.NewTicker(*reportInterval)
+		defer t.Stop()
+		ticker = t.C
+	}
+
+	var simulated []*fakeNode
+	if *snapshot != "" {
+		snap, err := loadSnapshot(*snapshot)
+		if err != nil {
+			glog.Fatalf("Unable to load snapshot %s: %v", *snapshot, err)
+		}
+
+		simulated = snapshotNodes(snap, *seed)
+		*agents, *netAgents = len(snap.ComputeNodes), len(snap.NetworkNodes)
+	} else {
+		for i := 0; i < *agents+*netAgents; i++ {
+			role := ssntp.Role(ssntp.AGENT)
+			if i >= *agents {
+				role = ssntp.Role(ssntp.NETAGENT)
+			}
+
+			simulated = append(simulated, newFakeNode(uuid.Generate().String(), role, *seed+int64(i)))
+		}
+	}
+
+	start := time.Now()
+	var nodes []*fakeNode
+	var wg sync.WaitGroup
+	interrupted := false
+
+	glog.Infof("Simulating %d agents and %d network agents", *agents, *netAgents)
+
+DIAL:
+	for _, node := range simulated {
+		cert := *agentCert
+		if node.role == ssntp.Role(ssntp.NETAGENT) {
+			cert = *netAgentCert
+		}
+
+		if err := dial(node, cert); err != nil {
+			glog.Errorf("Unable to connect %s %s: %v", node.role.String(), node.uuid, err)
+			continue
+		}
+		nodes = append(nodes, node)
+
+		wg.Add(1)
+		go func(node *fakeNode) {
+			defer wg.Done()
+			node.run(done)
+		}(node)
+
+		select {
+		case <-signalCh:
+			interrupted = true
+			break DIAL
+		case <-time.After(*connectInterval):
+		}
+	}
+
+	glog.Infof("%d simulated nodes connected in %s", len(nodes), time.Since(start))
+
+DONE:
+	for !interrupted {
+		select {
+		case <-signalCh:
+			break DONE
+		case <-timeout:
+			break DONE
+		case <-ticker:
+			report(start)
+		}
+	}
+
+	close(done)
+	wg.Wait()
+
+	for _, node := range nodes {
+		node.ssntp.Close()
+	}
+
+	report(start)
+	glog.Flush()
+}
@@ -0,0 +1,518 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+)
+
+// counters gathers the activity of all the simulated nodes of the process.
+type counters struct {
+	connects     uint64
+	disconnects  uint64
+	readySent    uint64
+	statsSent    uint64
+	starts       uint64
+	startsFailed uint64
+	stops        uint64
+	deletes      uint64
+	sendErrors   uint64
+}
+
+var activity counters
+
+type fakeInstance struct {
+	memMB  int
+	diskMB int
+	vcpus  int
+	state  string
+}
+
+// fakeNode is a simulated ciao-launcher.  It owns an SSNTP client of its
+// own, with its own UUID, and keeps track of the resources consumed by the
+// instances it pretends to run.
+type fakeNode struct {
+	ssntp ssntp.Client
+	uuid  string
+	role  ssntp.Role
+
+	sync.Mutex
+	connected       bool
+	rand            *rand.Rand
+	instances       map[string]*fakeInstance
+	memTotalMB      int
+	cpus            int
+	memAvailableMB  int
+	diskAvailableMB int
+	vcpusAllocated  int
+}
+
+func newFakeNode(uuid string, role ssntp.Role, seed int64) *fakeNode {
+	return &fakeNode{
+		uuid:            uuid,
+		role:            role,
+		rand:            rand.New(rand.NewSource(seed)),
+		instances:       make(map[string]*fakeInstance),
+		memTotalMB:      *memMB,
+		cpus:            *cpus,
+		memAvailableMB:  *memMB,
+		diskAvailableMB: *diskMB,
+	}
+}
+
+func (node *fakeNode) ConnectNotify() {
+	atomic.AddUint64(&activity.connects, 1)
+
+	node.Lock()
+	node.connected = true
+	node.Unlock()
+
+	go func() {
+		node.sendCapabilities()
+		node.sendReady()
+	}()
+}
+
+func (node *fakeNode) DisconnectNotify() {
+	atomic.AddUint64(&activity.disconnects, 1)
+
+	node.Lock()
+	node.connected = false
+	node.Unlock()
+
+	glog.V(1).Infof("%s disconnected", node.uuid)
+}
+
+func (node *fakeNode) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+	glog.V(2).Infof("%s received %s", node.uuid, status)
+}
+
+func (node *fakeNode) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+	glog.V(2).Infof("%s received %s", node.uuid, command)
+
+	switch command {
+	case ssntp.START:
+		go node.start(frame.Payload)
+	case ssntp.STOP:
+		go node.stop(frame.Payload)
+	case ssntp.DELETE:
+		go node.delete(frame.Payload)
+	}
+}
+
+func (node *fakeNode) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+	glog.V(2).Infof("%s received %s", node.uuid, event)
+}
+
+func (node *fakeNode) ErrorNotify(error ssntp.Error, frame *ssntp.Frame) {
+	glog.V(2).Infof("%s received %s", node.uuid, error)
+}
+
+func (node *fakeNode) isConnected() bool {
+	node.Lock()
+	defer node.Unlock()
+	return node.connected
+}
+
+// jitter returns a random duration in [0, d), used to spread the frames
+// the simulated nodes send over time.
+func (node *fakeNode) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+
+	node.Lock()
+	defer node.Unlock()
+	return time.Duration(node.rand.Int63n(int64(d)))
+}
+
+// roll tells if an event of the given probability happens.
+func (node *fakeNode) roll(probability float64) bool {
+	if probability <= 0 {
+		return false
+	}
+
+	node.Lock()
+	defer node.Unlock()
+	return node.rand.Float64() < probability
+}
+
+// run sends READY and STATS frames at their configured rates until done is
+// closed.
+func (node *fakeNode) run(done chan struct{}) {
+	select {
+	case <-done:
+		return
+	case <-time.After(node.jitter(*readyInterval)):
+	}
+
+	readyTicker := time.NewTicker(*readyInterval)
+	defer readyTicker.Stop()
+
+	statsTicker := time.NewTicker(*statsInterval)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-readyTicker.C:
+			node.sendReady()
+		case <-statsTicker.C:
+			node.sendStats()
+		}
+	}
+}
+
+func (node *fakeNode) status() ssntp.Status {
+	if len(node.instances) >= *maxInstances || node.memAvailableMB <= 0 || node.diskAvailableMB <= 0 {
+		return ssntp.FULL
+	}
+
+	return ssntp.READY
+}
+
+func (node *fakeNode) marshal(v interface{}) ([]byte, error) {
+	return payloads.MarshalVersion(node.ssntp.Encoding(), v, node.ssntp.PayloadVersion())
+}
+
+func (node *fakeNode) sent(err error, counter *uint64) {
+	if err != nil {
+		atomic.AddUint64(&activity.sendErrors, 1)
+		glog.V(1).Infof("%s could not send frame: %v", node.uuid, err)
+		return
+	}
+
+	if counter != nil {
+		atomic.AddUint64(counter, 1)
+	}
+}
+
+func (node *fakeNode) sendCapabilities() {
+	if node.ssntp.PayloadVersion() < payloads.Version4 {
+		return
+	}
+
+	event := payloads.EventNodeCapabilities{
+		Capabilities: payloads.NodeCapabilities{
+			NodeUUID: node.uuid,
+			Hypervisors: []payloads.HypervisorCapability{
+				{Type: payloads.QEMU},
+				{Type: payloads.Docker},
+			},
+			StorageBackends: []payloads.StorageBackend{payloads.LocalStorage},
+		},
+	}
+
+	payload, err := node.marshal(&event)
+	if err != nil {
+		glog.Errorf("Unable to Marshall NodeCapabilities %v", err)
+		return
+	}
+
+	_, err = node.ssntp.SendEvent(ssntp.NodeCapabilities, payload)
+	node.sent(err, nil)
+}
+
+func (node *fakeNode) sendReady() {
+	if !node.isConnected() {
+		return
+	}
+
+	var s payloads.Ready
+
+	s.Init()
+
+	node.Lock()
+	s.NodeUUID = node.uuid
+	s.MemTotalMB, s.MemAvailableMB = node.memTotalMB, node.memAvailableMB
+	s.DiskTotalMB, s.DiskAvailableMB = *diskMB, node.diskAvailableMB
+	s.Load = 0
+	s.CpusOnline = node.cpus
+	status := node.status()
+	node.Unlock()
+
+	payload, err := node.marshal(&s)
+	if err != nil {
+		glog.Errorf("Unable to Marshall Status %v", err)
+		return
+	}
+
+	_, err = node.ssntp.SendStatus(status, payload)
+	node.sent(err, &activity.readySent)
+}
+
+func (node *fakeNode) sendStats() {
+	if !node.isConnected() {
+		return
+	}
+
+	var s payloads.Stat
+
+	s.Init()
+
+	node.Lock()
+	s.NodeUUID = node.uuid
+	s.Status = node.status().String()
+	s.MemTotalMB, s.MemAvailableMB = node.memTotalMB, node.memAvailableMB
+	s.DiskTotalMB, s.DiskAvailableMB = *diskMB, node.diskAvailableMB
+	s.Load = 0
+	s.CpusOnline = node.cpus
+	s.VCPUsAllocated = node.vcpusAllocated
+	s.NodeHostName = node.uuid
+	s.Instances = make([]payloads.InstanceStat, 0, len(node.instances))
+	for uuid, instance := range node.instances {
+		s.Instances = append(s.Instances, payloads.InstanceStat{
+			InstanceUUID:  uuid,
+			State:         instance.state,
+			MemoryUsageMB: instance.memMB,
+			DiskUsageMB:   instance.diskMB,
+			CPUUsage:      -1,
+		})
+	}
+	node.Unlock()
+
+	payload, err := node.marshal(&s)
+	if err != nil {
+		glog.Errorf("Unable to Marshall STATS %v", err)
+		return
+	}
+
+	_, err = node.ssntp.SendCommand(ssntp.STATS, payload)
+	node.sent(err, &activity.statsSent)
+}
+
+// sendStateChanged lets the controllers know that instance went from the
+// previous to the new state, as ciao-launcher does.
+func (node *fakeNode) sendStateChanged(instance, previous, state string) {
+	if node.ssntp.PayloadVersion() < payloads.Version5 {
+		return
+	}
+
+	payload, err := node.marshal(&payloads.EventInstanceStateChanged{
+		StateChanged: payloads.InstanceStateChangedEvent{
+			InstanceUUID:  instance,
+			NodeUUID:      node.uuid,
+			PreviousState: previous,
+			State:         state,
+		},
+	})
+	if err != nil {
+		glog.Errorf("Unable to Marshall InstanceStateChanged %v", err)
+		return
+	}
+
+	_, err = node.ssntp.SendEvent(ssntp.InstanceStateChanged, payload)
+	node.sent(err, nil)
+}
+
+func (node *fakeNode) sendStartFailure(instance string, reason payloads.StartFailureReason) {
+	atomic.AddUint64(&activity.startsFailed, 1)
+
+	payload, err := node.marshal(&payloads.ErrorStartFailure{
+		InstanceUUID: instance,
+		Reason:       reason,
+	})
+	if err != nil {
+		glog.Errorf("Unable to generate payload for start_failure: %v", err)
+		return
+	}
+
+	_, err = node.ssntp.SendError(ssntp.StartFailure, payload)
+	node.sent(err, nil)
+}
+
+// requested returns the value of the resource of type t requested by cmd,
+// or def if cmd does not request it.
+func requested(cmd *payloads.StartCmd, t payloads.Resource, def int) int {
+	for _, r := range cmd.RequestedResources {
+		if r.Type == t {
+			return r.Value
+		}
+	}
+
+	return def
+}
+
+func (node *fakeNode) start(payload []byte) {
+	atomic.AddUint64(&activity.starts, 1)
+
+	var start payloads.Start
+	if err := payloads.Unmarshal(payload, &start); err != nil {
+		glog.Warningf("%s could not parse START payload: %v", node.uuid, err)
+		node.sendStartFailure("", payloads.InvalidPayload)
+		return
+	}
+
+	cmd := &start.Start
+	instance := &fakeInstance{
+		memMB:  requested(cmd, payloads.MemMB, 0),
+		diskMB: requested(cmd, payloads.DiskMB, 0),
+		vcpus:  requested(cmd, payloads.VCPUs, 1),
+		state:  payloads.Pending,
+	}
+
+	if node.roll(*fullProbability) {
+		node.sendStartFailure(cmd.InstanceUUID, payloads.FullComputeNode)
+		return
+	}
+
+	node.Lock()
+	if _, ok := node.instances[cmd.InstanceUUID]; ok {
+		node.Unlock()
+		node.sendStartFailure(cmd.InstanceUUID, payloads.InstanceExists)
+		return
+	}
+
+	if len(node.instances) >= *maxInstances || instance.memMB > node.memAvailableMB ||
+		instance.diskMB > node.diskAvailableMB {
+		node.Unlock()
+		node.sendStartFailure(cmd.InstanceUUID, payloads.FullComputeNode)
+		return
+	}
+
+	node.instances[cmd.InstanceUUID] = instance
+	node.memAvailableMB -= instance.memMB
+	node.diskAvailableMB -= instance.diskMB
+	node.vcpusAllocated += instance.vcpus
+	node.Unlock()
+
+	node.sendStateChanged(cmd.InstanceUUID, "", payloads.Pending)
+
+	if *startDelay > 0 {
+		time.Sleep(*startDelay)
+	}
+
+	if node.roll(*failureProbability) {
+		node.remove(cmd.InstanceUUID)
+		node.sendStartFailure(cmd.InstanceUUID, payloads.LaunchFailure)
+		node.sendReady()
+		return
+	}
+
+	node.Lock()
+	instance.state = payloads.Running
+	node.Unlock()
+
+	node.sendStateChanged(cmd.InstanceUUID, payloads.Pending, payloads.Running)
+	node.sendReady()
+	node.sendStats()
+}
+
+// remove forgets about instance and releases its resources.  It returns
+// false if the node does not run instance.
+func (node *fakeNode) remove(uuid string) bool {
+	node.Lock()
+	defer node.Unlock()
+
+	instance, ok := node.instances[uuid]
+	if !ok {
+		return false
+	}
+
+	delete(node.instances, uuid)
+	node.memAvailableMB += instance.memMB
+	node.diskAvailableMB += instance.diskMB
+	node.vcpusAllocated -= instance.vcpus
+
+	return true
+}
+
+func (node *fakeNode) stop(payload []byte) {
+	atomic.AddUint64(&activity.stops, 1)
+
+	var stop payloads.Stop
+	if err := payloads.Unmarshal(payload, &stop); err != nil {
+		glog.Warningf("%s could not parse STOP payload: %v", node.uuid, err)
+		return
+	}
+
+	reason := payloads.StopFailureReason("")
+	node.Lock()
+	instance, ok := node.instances[stop.Stop.InstanceUUID]
+	if !ok {
+		reason = payloads.StopNoInstance
+	} else if instance.state == payloads.Exited {
+		reason = payloads.StopAlreadyStopped
+	} else {
+		instance.state = payloads.Exited
+	}
+	node.Unlock()
+
+	if reason == "" {
+		node.sendStateChanged(stop.Stop.InstanceUUID, payloads.Running, payloads.Exited)
+		node.sendStats()
+		return
+	}
+
+	payload, err := node.marshal(&payloads.ErrorStopFailure{
+		InstanceUUID: stop.Stop.InstanceUUID,
+		Reason:       reason,
+	})
+	if err != nil {
+		glog.Errorf("Unable to generate payload for stop_failure: %v", err)
+		return
+	}
+
+	_, err = node.ssntp.SendError(ssntp.StopFailure, payload)
+	node.sent(err, nil)
+}
+
+func (node *fakeNode) delete(payload []byte) {
+	atomic.AddUint64(&activity.deletes, 1)
+
+	var del payloads.Delete
+	if err := payloads.Unmarshal(payload, &del); err != nil {
+		glog.Warningf("%s could not parse DELETE payload: %v", node.uuid, err)
+		return
+	}
+
+	uuid := del.Delete.InstanceUUID
+	if !node.remove(uuid) {
+		payload, err := node.marshal(&payloads.ErrorDeleteFailure{
+			InstanceUUID: uuid,
+			Reason:       payloads.DeleteNoInstance,
+		})
+		if err != nil {
+			glog.Errorf("Unable to generate payload for delete_failure: %v", err)
+			return
+		}
+
+		_, err = node.ssntp.SendError(ssntp.DeleteFailure, payload)
+		node.sent(err, nil)
+		return
+	}
+
+	payload, err := node.marshal(&payloads.EventInstanceDeleted{
+		InstanceDeleted: payloads.InstanceDeletedEvent{InstanceUUID: uuid},
+	})
+	if err != nil {
+		glog.Errorf("Unable to Marshall InstanceDeleted %v", err)
+		return
+	}
+
+	_, err = node.ssntp.SendEvent(ssntp.InstanceDeleted, payload)
+	node.sent(err, nil)
+	node.sendReady()
+}
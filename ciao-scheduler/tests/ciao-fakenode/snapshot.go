@@ -0,0 +1,116 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+)
+
+// snapshotVersion is the version of the ciao-scheduler cluster snapshots
+// ciao-fakenode can be seeded with.
+const snapshotVersion = 1
+
+// snapshotNode holds the fields of a ciao-scheduler snapshot node the
+// simulated nodes are seeded with.  Resources the node did not report
+// are -1.
+type snapshotNode struct {
+	UUID       string `yaml:"uuid"`
+	MemTotalMB int    `yaml:"mem_total_mb"`
+	CpusOnline int    `yaml:"cpus_online"`
+}
+
+type snapshotPlacement struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+	NodeUUID     string `yaml:"node_uuid"`
+	MemMB        int    `yaml:"mem_mb"`
+}
+
+// clusterSnapshot is the subset of a ciao-scheduler cluster snapshot, as
+// written on SIGUSR1, ciao-fakenode needs to simulate the same nodes.
+type clusterSnapshot struct {
+	Version      int                 `yaml:"version"`
+	ComputeNodes []snapshotNode      `yaml:"compute_nodes"`
+	NetworkNodes []snapshotNode      `yaml:"network_nodes"`
+	Placements   []snapshotPlacement `yaml:"placements"`
+}
+
+// loadSnapshot reads a YAML or JSON cluster snapshot.
+func loadSnapshot(path string) (*clusterSnapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var snap clusterSnapshot
+	if err = payloads.Unmarshal(data, &snap); err != nil {
+		return nil, err
+	}
+
+	if snap.Version != snapshotVersion {
+		return nil, fmt.Errorf("Unsupported snapshot version %d", snap.Version)
+	}
+
+	return &snap, nil
+}
+
+// snapshotNodes returns simulated nodes with the UUIDs and resources of the
+// nodes of snap, already running the instances placed on them.  The
+// resources a node did not report are taken from the command line.
+func snapshotNodes(snap *clusterSnapshot, seed int64) []*fakeNode {
+	var nodes []*fakeNode
+
+	byUUID := make(map[string]*fakeNode)
+	for i, n := range append(snap.ComputeNodes, snap.NetworkNodes...) {
+		role := ssntp.Role(ssntp.AGENT)
+		if i >= len(snap.ComputeNodes) {
+			role = ssntp.Role(ssntp.NETAGENT)
+		}
+
+		node := newFakeNode(n.UUID, role, seed+int64(i))
+		if n.MemTotalMB >= 0 {
+			node.memTotalMB = n.MemTotalMB
+			node.memAvailableMB = n.MemTotalMB
+		}
+		if n.CpusOnline >= 0 {
+			node.cpus = n.CpusOnline
+		}
+
+		nodes = append(nodes, node)
+		byUUID[n.UUID] = node
+	}
+
+	for _, p := range snap.Placements {
+		node := byUUID[p.NodeUUID]
+		if node == nil {
+			continue
+		}
+
+		node.instances[p.InstanceUUID] = &fakeInstance{
+			memMB: p.MemMB,
+			vcpus: 1,
+			state: payloads.Running,
+		}
+		node.memAvailableMB -= p.MemMB
+		node.vcpusAllocated++
+	}
+
+	return nodes
+}
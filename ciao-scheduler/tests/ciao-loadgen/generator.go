@@ -0,0 +1,321 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
+	"github.com/golang/glog"
+)
+
+// pendingCommand is a command the load generator has not yet seen the
+// outcome of.
+type pendingCommand struct {
+	command ssntp.Command
+	sent    time.Time
+}
+
+// loadGenerator is a simulated ciao-controller.  It keeps track of the
+// instances it started, of the node each of them runs on and of the commands
+// that are still waiting for a reply.
+type loadGenerator struct {
+	ssntp ssntp.Client
+
+	sync.Mutex
+	rand    *rand.Rand
+	pending map[string]pendingCommand
+	running map[string]string
+	exited  map[string]string
+	stats   map[ssntp.Command]*commandStats
+}
+
+func newLoadGenerator(seed int64) *loadGenerator {
+	return &loadGenerator{
+		rand:    rand.New(rand.NewSource(seed)),
+		pending: make(map[string]pendingCommand),
+		running: make(map[string]string),
+		exited:  make(map[string]string),
+		stats: map[ssntp.Command]*commandStats{
+			ssntp.START:  newCommandStats(),
+			ssntp.STOP:   newCommandStats(),
+			ssntp.DELETE: newCommandStats(),
+		},
+	}
+}
+
+func (gen *loadGenerator) ConnectNotify() {
+	glog.Info("Connected")
+}
+
+func (gen *loadGenerator) DisconnectNotify() {
+	glog.Warning("Disconnected")
+}
+
+func (gen *loadGenerator) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+	glog.V(2).Infof("Received %s", status)
+}
+
+func (gen *loadGenerator) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+	if command != ssntp.STATS {
+		glog.V(2).Infof("Received %s", command)
+		return
+	}
+
+	var stats payloads.Stat
+	if err := payloads.Unmarshal(frame.Payload, &stats); err != nil {
+		glog.Warningf("Error unmarshalling STATS: %v", err)
+		return
+	}
+
+	for _, instance := range stats.Instances {
+		switch instance.State {
+		case payloads.Running:
+			gen.completed(instance.InstanceUUID, ssntp.START, stats.NodeUUID, "")
+		case payloads.Exited:
+			gen.completed(instance.InstanceUUID, ssntp.STOP, stats.NodeUUID, "")
+		}
+	}
+}
+
+func (gen *loadGenerator) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+	switch event {
+	case ssntp.InstanceStateChanged:
+		var changed payloads.EventInstanceStateChanged
+		if err := payloads.Unmarshal(frame.Payload, &changed); err != nil {
+			glog.Warningf("Error unmarshalling InstanceStateChanged: %v", err)
+			return
+		}
+
+		ev := &changed.StateChanged
+		switch ev.State {
+		case payloads.Running:
+			gen.completed(ev.InstanceUUID, ssntp.START, ev.NodeUUID, "")
+		case payloads.Exited:
+			gen.completed(ev.InstanceUUID, ssntp.STOP, ev.NodeUUID, "")
+		}
+	case ssntp.InstanceDeleted:
+		var deleted payloads.EventInstanceDeleted
+		if err := payloads.Unmarshal(frame.Payload, &deleted); err != nil {
+			glog.Warningf("Error unmarshalling InstanceDeleted: %v", err)
+			return
+		}
+
+		gen.completed(deleted.InstanceDeleted.InstanceUUID, ssntp.DELETE, "", "")
+	default:
+		glog.V(2).Infof("Received %s", event)
+	}
+}
+
+func (gen *loadGenerator) ErrorNotify(error ssntp.Error, frame *ssntp.Frame) {
+	switch error {
+	case ssntp.StartFailure:
+		var failure payloads.ErrorStartFailure
+		if err := payloads.Unmarshal(frame.Payload, &failure); err != nil {
+			glog.Warningf("Error unmarshalling StartFailure: %v", err)
+			return
+		}
+
+		gen.completed(failure.InstanceUUID, ssntp.START, "", string(failure.Reason))
+	case ssntp.StopFailure:
+		var failure payloads.ErrorStopFailure
+		if err := payloads.Unmarshal(frame.Payload, &failure); err != nil {
+			glog.Warningf("Error unmarshalling StopFailure: %v", err)
+			return
+		}
+
+		gen.completed(failure.InstanceUUID, ssntp.STOP, "", string(failure.Reason))
+	case ssntp.DeleteFailure:
+		var failure payloads.ErrorDeleteFailure
+		if err := payloads.Unmarshal(frame.Payload, &failure); err != nil {
+			glog.Warningf("Error unmarshalling DeleteFailure: %v", err)
+			return
+		}
+
+		gen.completed(failure.InstanceUUID, ssntp.DELETE, "", string(failure.Reason))
+	default:
+		glog.V(2).Infof("Received %s", error)
+	}
+}
+
+// completed records the outcome of the command pending for instance, if
+// it is of the given type.  reason is empty if the command succeeded, and
+// node is the node instance runs on, if known.
+func (gen *loadGenerator) completed(instance string, command ssntp.Command, node, reason string) {
+	gen.Lock()
+	defer gen.Unlock()
+
+	p, ok := gen.pending[instance]
+	if !ok || p.command != command {
+		return
+	}
+	delete(gen.pending, instance)
+
+	s := gen.stats[command]
+	if reason != "" {
+		s.failures[reason]++
+		return
+	}
+	s.latencies = append(s.latencies, time.Since(p.sent))
+
+	switch command {
+	case ssntp.START:
+		gen.running[instance] = node
+	case ssntp.STOP:
+		if node == "" {
+			node = gen.running[instance]
+		}
+		delete(gen.running, instance)
+		gen.exited[instance] = node
+	case ssntp.DELETE:
+		delete(gen.running, instance)
+		delete(gen.exited, instance)
+	}
+}
+
+// expire gives up on the commands that have been pending for longer than
+// timeout.
+func (gen *loadGenerator) expire(timeout time.Duration) {
+	gen.Lock()
+	defer gen.Unlock()
+
+	for instance, p := range gen.pending {
+		if time.Since(p.sent) < timeout {
+			continue
+		}
+
+		delete(gen.pending, instance)
+		gen.stats[p.command].timedOut++
+	}
+}
+
+func (gen *loadGenerator) pendingCount() int {
+	gen.Lock()
+	defer gen.Unlock()
+	return len(gen.pending)
+}
+
+// pick returns a random instance of instances that has no pending command,
+// and the node it runs on.  It returns an empty instance if there is none.
+func (gen *loadGenerator) pick(instances map[string]string) (string, string) {
+	candidates := make([]string, 0, len(instances))
+	for instance := range instances {
+		if _, ok := gen.pending[instance]; !ok {
+			candidates = append(candidates, instance)
+		}
+	}
+
+	if len(candidates) == 0 {
+		return "", ""
+	}
+
+	instance := candidates[gen.rand.Intn(len(candidates))]
+	return instance, instances[instance]
+}
+
+// next chooses the next command to send according to the mix, and the
+// instance it applies to.  STOP and DELETE commands are replaced with
+// START ones when there is no instance to stop or delete.
+func (gen *loadGenerator) next(m mix) (ssntp.Command, string, string) {
+	gen.Lock()
+	defer gen.Unlock()
+
+	command := m.pick(gen.rand)
+
+	var instance, node string
+	switch command {
+	case ssntp.STOP:
+		instance, node = gen.pick(gen.running)
+	case ssntp.DELETE:
+		if gen.rand.Intn(len(gen.running)+len(gen.exited)+1) < len(gen.exited) {
+			instance, node = gen.pick(gen.exited)
+		}
+		if instance == "" {
+			instance, node = gen.pick(gen.running)
+		}
+		if instance == "" {
+			instance, node = gen.pick(gen.exited)
+		}
+	}
+
+	if instance == "" {
+		command = ssntp.START
+		instance = uuid.Generate().String()
+	}
+
+	gen.pending[instance] = pendingCommand{command: command, sent: time.Now()}
+	gen.stats[command].sent++
+
+	return command, instance, node
+}
+
+func (gen *loadGenerator) payload(command ssntp.Command, instance, node string) interface{} {
+	switch command {
+	case ssntp.START:
+		return &payloads.Start{
+			Start: payloads.StartCmd{
+				TenantUUID:          *tenant,
+				InstanceUUID:        instance,
+				ImageUUID:           *image,
+				FWType:              payloads.Legacy,
+				InstancePersistence: payloads.Host,
+				VMType:              payloads.QEMU,
+				RequestedResources: []payloads.RequestedResource{
+					{Type: payloads.VCPUs, Value: *vcpus},
+					{Type: payloads.MemMB, Value: *memMB},
+					{Type: payloads.DiskMB, Value: *diskMB},
+				},
+			},
+		}
+	case ssntp.STOP:
+		return &payloads.Stop{
+			Stop: payloads.StopCmd{InstanceUUID: instance, WorkloadAgentUUID: node},
+		}
+	default:
+		return &payloads.Delete{
+			Delete: payloads.StopCmd{InstanceUUID: instance, WorkloadAgentUUID: node},
+		}
+	}
+}
+
+// send sends the next command of the mix to the scheduler.
+func (gen *loadGenerator) send(m mix) error {
+	command, instance, node := gen.next(m)
+
+	payload, err := payloads.MarshalVersion(gen.ssntp.Encoding(), gen.payload(command, instance, node),
+		gen.ssntp.PayloadVersion())
+	if err == nil {
+		_, err = gen.ssntp.SendCommand(command, payload)
+	}
+
+	if err != nil {
+		gen.Lock()
+		delete(gen.pending, instance)
+		gen.stats[command].failures["send_error"]++
+		gen.Unlock()
+		return fmt.Errorf("Unable to send %s for instance %s: %v", command, instance, err)
+	}
+
+	glog.V(1).Infof("Sent %s for instance %s", command, instance)
+
+	return nil
+}
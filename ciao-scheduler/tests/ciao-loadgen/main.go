@@ -0,0 +1,218 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/docker/distribution/uuid"
+	"github.com/golang/glog"
+)
+
+var (
+	server   = flag.String("server", "localhost", "URI of the SSNTP server, e.g. the scheduler under test")
+	port     = flag.Uint("port", 0, "SSNTP port of the server, 0 for the default 8888")
+	caCert   = flag.String("cacert", "/etc/pki/ciao/CAcert-server-localhost.pem", "CA certificate")
+	cert     = flag.String("cert", "/etc/pki/ciao/cert-client-localhost.pem", "Certificate of the simulated controller")
+	rate     = flag.Float64("rate", 10, "Number of commands sent per second")
+	commands = flag.Int("commands", 0, "Number of commands to send, 0 to send commands until -duration elapses or until interrupted")
+	duration = flag.Duration("duration", 0, "Time to send commands for, 0 to send -commands commands or to send commands until interrupted")
+	timeout  = flag.Duration("timeout", 30*time.Second, "Time after which a command that got no reply is considered lost")
+	tenant   = flag.String("tenant", uuid.Generate().String(), "UUID of the tenant owning the started instances")
+	image    = flag.String("image", uuid.Generate().String(), "UUID of the image of the started instances")
+	vcpus    = flag.Int("vcpus", 1, "Number of vCPUs of the started instances")
+	memMB    = flag.Int("mem-mb", 256, "Memory of the started instances, in MB")
+	diskMB   = flag.Int("disk-mb", 1024, "Disk space of the started instances, in MB")
+	seed     = flag.Int64("seed", 0, "Seed of the random number generator, 0 for a time based one")
+	workload mix
+)
+
+// mix is the proportion of START, STOP and DELETE commands to send, as
+// given by the -mix option, e.g. start=6,stop=1,delete=3.
+type mix struct {
+	weights map[ssntp.Command]int
+	total   int
+}
+
+func (m *mix) String() string {
+	var parts []string
+	for _, command := range []ssntp.Command{ssntp.START, ssntp.STOP, ssntp.DELETE} {
+		if w := m.weights[command]; w > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%d", strings.ToLower(command.String()), w))
+		}
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (m *mix) Set(value string) error {
+	commands := map[string]ssntp.Command{
+		"start":  ssntp.START,
+		"stop":   ssntp.STOP,
+		"delete": ssntp.DELETE,
+	}
+
+	m.weights = make(map[ssntp.Command]int)
+	m.total = 0
+
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("Invalid mix entry %q, expected <command>=<weight>", part)
+		}
+
+		command, ok := commands[strings.TrimSpace(kv[0])]
+		if !ok {
+			return fmt.Errorf("Unsupported command %q", kv[0])
+		}
+
+		w, err := strconv.Atoi(strings.TrimSpace(kv[1]))
+		if err != nil || w < 0 {
+			return fmt.Errorf("Invalid %s weight %q", command, kv[1])
+		}
+
+		m.weights[command] = w
+		m.total += w
+	}
+
+	if m.total == 0 {
+		return fmt.Errorf("At least one command must have a weight > 0")
+	}
+
+	return nil
+}
+
+// pick returns a random command, with the mix proportions.
+func (m *mix) pick(r *rand.Rand) ssntp.Command {
+	n := r.Intn(m.total)
+	for _, command := range []ssntp.Command{ssntp.START, ssntp.STOP, ssntp.DELETE} {
+		if n < m.weights[command] {
+			return command
+		}
+		n -= m.weights[command]
+	}
+
+	return ssntp.START
+}
+
+// generate sends commands at the configured rate until enough of them are
+// sent, until the configured duration elapses or until interrupted.
+func generate(gen *loadGenerator, signalCh chan os.Signal) {
+	var end <-chan time.Time
+	if *duration > 0 {
+		end = time.After(*duration)
+	}
+
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+	defer ticker.Stop()
+
+	expireTicker := time.NewTicker(time.Second)
+	defer expireTicker.Stop()
+
+	sent := 0
+	for *commands == 0 || sent < *commands {
+		select {
+		case <-signalCh:
+			return
+		case <-end:
+			return
+		case <-expireTicker.C:
+			gen.expire(*timeout)
+		case <-ticker.C:
+			if err := gen.send(workload); err != nil {
+				glog.Warning(err)
+			}
+			sent++
+		}
+	}
+}
+
+// drain waits for the replies to the commands that are still pending, until
+// they all time out or until interrupted.
+func drain(gen *loadGenerator, signalCh chan os.Signal) {
+	deadline := time.After(*timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for gen.pendingCount() > 0 {
+		select {
+		case <-signalCh:
+			return
+		case <-deadline:
+			gen.expire(0)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func main() {
+	workload.Set("start=6,stop=1,delete=3")
+	flag.Var(&workload, "mix", "Proportion of START, STOP and DELETE commands")
+	flag.Parse()
+
+	if *rate <= 0 {
+		glog.Fatalf("Invalid rate %f", *rate)
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	gen := newLoadGenerator(*seed)
+
+	config := &ssntp.Config{
+		URI:         *server,
+		Port:        uint32(*port),
+		CAcert:      *caCert,
+		Cert:        *cert,
+		Role:        ssntp.Controller,
+		Log:         ssntp.Log,
+		Encodings:   []payloads.Encoding{payloads.MsgPack},
+		AtLeastOnce: true,
+	}
+
+	if err := gen.ssntp.Dial(config, gen); err != nil {
+		glog.Fatalf("Unable to connect to %s: %v", *server, err)
+	}
+	defer gen.ssntp.Close()
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+
+	glog.Infof("Sending %.1f commands per second, %s", *rate, workload.String())
+
+	start := time.Now()
+	generate(gen, signalCh)
+	drain(gen, signalCh)
+
+	gen.Lock()
+	writeReport(os.Stdout, gen.stats, time.Since(start))
+	gen.Unlock()
+
+	glog.Flush()
+}
@@ -0,0 +1,129 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/01org/ciao/ssntp"
+)
+
+// commandStats gathers the outcome of all the commands of a given type the
+// load generator sent.
+type commandStats struct {
+	sent      int
+	timedOut  int
+	latencies []time.Duration
+	failures  map[string]int
+}
+
+func newCommandStats() *commandStats {
+	return &commandStats{failures: make(map[string]int)}
+}
+
+func (s *commandStats) failed() int {
+	failed := 0
+	for _, n := range s.failures {
+		failed += n
+	}
+
+	return failed
+}
+
+// percentile returns the latency below which p percent of the successful
+// commands completed.  latencies must be sorted.
+func percentile(latencies []time.Duration, p int) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	i := (len(latencies)*p + 99) / 100
+	if i > 0 {
+		i--
+	}
+
+	return latencies[i]
+}
+
+func mean(latencies []time.Duration) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+
+	var total time.Duration
+	for _, l := range latencies {
+		total += l
+	}
+
+	return total / time.Duration(len(latencies))
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(100 * time.Microsecond)
+}
+
+// writeReport writes a summary of the commands sent during elapsed and of
+// their latencies to w.
+func writeReport(w io.Writer, stats map[ssntp.Command]*commandStats, elapsed time.Duration) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+
+	fmt.Fprintf(w, "Load generated for %s\n\n", elapsed.Truncate(time.Millisecond))
+	fmt.Fprintln(tw, "Command\tSent\tSucceeded\tFailed\tTimed out\tMin\tMean\tp50\tp90\tp99\tMax\t")
+
+	for _, command := range []ssntp.Command{ssntp.START, ssntp.STOP, ssntp.DELETE} {
+		s, ok := stats[command]
+		if !ok || s.sent == 0 {
+			continue
+		}
+
+		l := s.latencies
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+
+		var min, max time.Duration
+		if len(l) > 0 {
+			min, max = l[0], l[len(l)-1]
+		}
+
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t\n",
+			command, s.sent, len(l), s.failed(), s.timedOut,
+			round(min), round(mean(l)), round(percentile(l, 50)),
+			round(percentile(l, 90)), round(percentile(l, 99)), round(max))
+	}
+	tw.Flush()
+
+	for _, command := range []ssntp.Command{ssntp.START, ssntp.STOP, ssntp.DELETE} {
+		s, ok := stats[command]
+		if !ok || len(s.failures) == 0 {
+			continue
+		}
+
+		reasons := make([]string, 0, len(s.failures))
+		for reason := range s.failures {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+
+		fmt.Fprintf(w, "\n%s failures:\n", command)
+		for _, reason := range reasons {
+			fmt.Fprintf(w, "  %s: %d\n", reason, s.failures[reason])
+		}
+	}
+}
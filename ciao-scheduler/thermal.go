@@ -0,0 +1,103 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+// thermalScorer scores the compute nodes on the power they draw and the
+// temperature of their CPUs, relative to limits above which nodes are
+// considered thermally stressed.
+type thermalScorer struct {
+	// CPU temperature in degrees Celsius, 0 when not scored
+	temperatureLimit int
+	// Power draw in watts, 0 when not scored
+	powerLimit int
+}
+
+func newThermalScorer(temperatureLimit, powerLimit int) *thermalScorer {
+	return &thermalScorer{
+		temperatureLimit: temperatureLimit,
+		powerLimit:       powerLimit,
+	}
+}
+
+// score returns how stressed the referenced, locked nodeStat object is, 1
+// being the limit.  Telemetry the node does not report is not scored.
+func (t *thermalScorer) score(node *nodeStat) float64 {
+	var score float64
+
+	if t.temperatureLimit > 0 && node.cpuTemperature >= 0 {
+		score = float64(node.cpuTemperature) / float64(t.temperatureLimit)
+	}
+
+	if t.powerLimit > 0 && node.powerWatts >= 0 {
+		if s := float64(node.powerWatts) / float64(t.powerLimit); s > score {
+			score = s
+		}
+	}
+
+	return score
+}
+
+// stressed returns true if the referenced, locked nodeStat object reached
+// one of the limits.
+func (t *thermalScorer) stressed(node *nodeStat) bool {
+	return t != nil && t.score(node) >= 1
+}
+
+// stress returns the highest of the thermal and memory pressure scores of
+// the referenced, locked nodeStat object.
+func (sched *ssntpSchedulerServer) stress(node *nodeStat) float64 {
+	var score float64
+
+	if sched.thermal != nil {
+		score = sched.thermal.score(node)
+	}
+
+	if s := sched.pressure.score(node); s > score {
+		score = s
+	}
+
+	return score
+}
+
+// pickCoolestNode returns a referenced, locked nodeStat object of the
+// least stressed compute node the workload fits on, or nil if there is
+// none.  The caller must hold cnMutex.
+func (sched *ssntpSchedulerServer) pickCoolestNode(workload *workResources) *nodeStat {
+	var coolest *nodeStat
+	var coolestScore float64
+
+	for _, node := range sched.cnList {
+		node.mutex.Lock()
+		if !sched.workloadFits(node, workload) {
+			node.mutex.Unlock()
+			continue
+		}
+
+		score := sched.stress(node)
+		if coolest != nil && score >= coolestScore {
+			node.mutex.Unlock()
+			continue
+		}
+
+		if coolest != nil {
+			coolest.mutex.Unlock()
+		}
+		coolest, coolestScore = node, score
+	}
+
+	return coolest
+}
@@ -0,0 +1,88 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+func topologyNode(node *nodeSnapshot, nodeType payloads.Resource) payloads.TopologyNode {
+	return payloads.TopologyNode{
+		NodeUUID:                node.UUID,
+		NodeType:                nodeType,
+		Status:                  node.Status,
+		MemTotalMB:              node.MemTotalMB,
+		MemAvailableMB:          node.MemAvailableMB,
+		Load:                    node.Load,
+		CpusOnline:              node.CpusOnline,
+		GPUsAvailable:           node.GPUsAvailable,
+		DedicatedCoresAvailable: node.DedicatedCoresAvailable,
+		DiskIOPSAvailable:       node.DiskIOPSAvailable,
+		NetIngressKbpsAvailable: node.NetIngressKbpsAvailable,
+		NetEgressKbpsAvailable:  node.NetEgressKbpsAvailable,
+		CNCIsAvailable:          node.CNCIsAvailable,
+		PublicIPsAvailable:      node.PublicIPsAvailable,
+		Capabilities:            node.Capabilities,
+		Draining:                node.Draining,
+	}
+}
+
+// topology returns the controllers and nodes connected to the scheduler,
+// sorted by UUID.
+func (sched *ssntpSchedulerServer) topology() *payloads.ClusterTopologyEvent {
+	snap := sched.snapshot()
+
+	topology := &payloads.ClusterTopologyEvent{
+		Controllers:  []payloads.TopologyController{},
+		ComputeNodes: []payloads.TopologyNode{},
+		NetworkNodes: []payloads.TopologyNode{},
+	}
+
+	for _, c := range snap.Controllers {
+		topology.Controllers = append(topology.Controllers, payloads.TopologyController{
+			UUID:   c.UUID,
+			Status: c.Status,
+		})
+	}
+	for i := range snap.ComputeNodes {
+		topology.ComputeNodes = append(topology.ComputeNodes, topologyNode(&snap.ComputeNodes[i], payloads.ComputeNode))
+	}
+	for i := range snap.NetworkNodes {
+		topology.NetworkNodes = append(topology.NetworkNodes, topologyNode(&snap.NetworkNodes[i], payloads.NetworkNode))
+	}
+
+	return topology
+}
+
+// sendTopology answers the TOPOLOGY command of a controller with a
+// ClusterTopology event.
+func (sched *ssntpSchedulerServer) sendTopology(controllerUUID string) {
+	b, err := yaml.Marshal(&payloads.ClusterTopology{Topology: *sched.topology()})
+	if err != nil {
+		clog.Errorf("Unable to marshal %s event: %v\n", ssntp.ClusterTopology, err)
+		return
+	}
+
+	ctx, cancel := sched.sendContext()
+	defer cancel()
+	if _, err = sched.ssntp.SendEventContext(ctx, controllerUUID, ssntp.ClusterTopology, b); err != nil {
+		clog.Errorf("Unable to send %s to controller %s: %v\n", ssntp.ClusterTopology, controllerUUID, err)
+	}
+}
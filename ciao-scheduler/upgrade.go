@@ -0,0 +1,254 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/clog"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"gopkg.in/yaml.v2"
+)
+
+// upgradeCheckInterval is the interval between two checks of the nodes
+// drained for a rolling upgrade.
+const upgradeCheckInterval = 10 * time.Second
+
+// upgradeManager orchestrates the rolling upgrade of the compute nodes to
+// a target software version, set by the CONFIGURE commands.  Instances are
+// preferably placed on the nodes running the target version, and at most
+// maxDraining of the other nodes are drained at once.  A drained node can
+// be upgraded once it has no instance left, and is no longer drained once
+// it reconnects with the target version.
+type upgradeManager struct {
+	mutex       sync.Mutex
+	target      string
+	maxDraining int
+	// nodes drained for the upgrade, by UUID, including those that
+	// disconnected to be upgraded
+	draining map[string]bool
+	// progress last sent to the controllers
+	progress *payloads.UpgradeProgress
+}
+
+func newUpgradeManager() *upgradeManager {
+	return &upgradeManager{
+		draining: make(map[string]bool),
+	}
+}
+
+// configure starts, changes or, if upgrade is nil, ends the rolling upgrade.
+// It returns true if the upgrade changed.
+func (u *upgradeManager) configure(upgrade *payloads.RollingUpgrade) bool {
+	target, maxDraining := "", 0
+	if upgrade != nil {
+		target, maxDraining = upgrade.TargetVersion, upgrade.MaxDraining
+		if maxDraining == 0 {
+			maxDraining = 1
+		}
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if target == u.target && maxDraining == u.maxDraining {
+		return false
+	}
+
+	if target != u.target {
+		u.draining = make(map[string]bool)
+		u.progress = nil
+		if target != "" {
+			clog.Infof("Upgrading compute nodes to version %s, %d at a time\n", target, maxDraining)
+		} else {
+			clog.Infof("Rolling upgrade to version %s ended\n", u.target)
+		}
+	}
+	u.target = target
+	u.maxDraining = maxDraining
+
+	return true
+}
+
+// active returns true from the start to the end of a rolling upgrade.
+func (u *upgradeManager) active() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.target != ""
+}
+
+// inProgress returns true while compute nodes are being upgraded.
+func (u *upgradeManager) inProgress() bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.target != "" && (u.progress == nil || !u.progress.Done)
+}
+
+// isDraining returns true if the node is drained for its upgrade.
+func (u *upgradeManager) isDraining(uuid string) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.draining[uuid]
+}
+
+// nodeVersion returns the software version of the referenced, locked
+// nodeStat object, and false if the node did not advertise its
+// capabilities yet.
+func nodeVersion(node *nodeStat) (string, bool) {
+	if node.capabilities == nil {
+		return "", false
+	}
+
+	return node.capabilities.SoftwareVersion, true
+}
+
+// manageUpgrade marks the compute nodes not running the target version as
+// outdated, drains more of them if fewer than maxDraining are, starting
+// with those running the fewest instances, and sends the progress of the
+// upgrade to the controllers if it changed.  The last node that is not
+// drained is never drained.
+func (sched *ssntpSchedulerServer) manageUpgrade() {
+	u := sched.upgrade
+	busy := sched.busyNodes()
+
+	sched.cnMutex.RLock()
+	u.mutex.Lock()
+
+	var candidates []*nodeStat
+	active := 0
+	for _, node := range sched.cnList {
+		node.mutex.Lock()
+		version, known := nodeVersion(node)
+		switch {
+		case u.target == "" || version == u.target:
+			node.outdated, node.upgrading = false, false
+			delete(u.draining, node.uuid)
+		case u.draining[node.uuid]:
+			node.outdated, node.upgrading = true, true
+		default:
+			node.outdated, node.upgrading = true, false
+			if known {
+				candidates = append(candidates, node)
+			}
+		}
+		if !node.upgrading {
+			active++
+		}
+		node.mutex.Unlock()
+	}
+
+	if u.target == "" {
+		u.mutex.Unlock()
+		sched.cnMutex.RUnlock()
+		return
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return busy[candidates[i].uuid] < busy[candidates[j].uuid]
+	})
+	for _, node := range candidates {
+		if len(u.draining) >= u.maxDraining || active <= 1 {
+			break
+		}
+
+		clog.Infof("Draining node %s for its upgrade to version %s\n", node.uuid, u.target)
+		node.mutex.Lock()
+		node.upgrading = true
+		node.mutex.Unlock()
+		u.draining[node.uuid] = true
+		active--
+	}
+
+	progress := payloads.UpgradeProgress{TargetVersion: u.target}
+	connected := make(map[string]bool)
+	for _, node := range sched.cnList {
+		connected[node.uuid] = true
+		node.mutex.Lock()
+		switch {
+		case !node.outdated:
+			progress.Upgraded = append(progress.Upgraded, node.uuid)
+		case !node.upgrading:
+			progress.Outdated = append(progress.Outdated, node.uuid)
+		case busy[node.uuid] > 0:
+			progress.Draining = append(progress.Draining, node.uuid)
+		default:
+			progress.Drained = append(progress.Drained, node.uuid)
+		}
+		node.mutex.Unlock()
+	}
+	for uuid := range u.draining {
+		if !connected[uuid] {
+			progress.Upgrading = append(progress.Upgrading, uuid)
+		}
+	}
+	sort.Strings(progress.Upgrading)
+	progress.Done = len(progress.Upgraded) > 0 && len(progress.Outdated) == 0 && len(u.draining) == 0
+
+	changed := u.progress == nil || !reflect.DeepEqual(*u.progress, progress)
+	u.progress = &progress
+
+	u.mutex.Unlock()
+	sched.cnMutex.RUnlock()
+
+	if changed {
+		if progress.Done {
+			clog.Infof("All compute nodes upgraded to version %s\n", progress.TargetVersion)
+		}
+		sched.sendUpgradeProgress(&progress)
+	}
+}
+
+// sendUpgradeProgress tells all the controllers about the progress of the
+// rolling upgrade, and records the event in the journal.
+func (sched *ssntpSchedulerServer) sendUpgradeProgress(progress *payloads.UpgradeProgress) {
+	b, err := yaml.Marshal(&payloads.EventUpgradeProgress{Progress: *progress})
+	if err != nil {
+		clog.Errorf("Unable to marshal %s event: %v\n", ssntp.UpgradeProgress, err)
+		return
+	}
+
+	sched.controllerMutex.RLock()
+	defer sched.controllerMutex.RUnlock()
+
+	sched.journal.record(ssntp.UpgradeProgress, b, "")
+
+	for _, c := range sched.controllerMap {
+		ctx, cancel := sched.sendContext()
+		sched.ssntp.SendEventContext(ctx, c.uuid, ssntp.UpgradeProgress, b)
+		cancel()
+	}
+}
+
+// manageUpgradeLoop checks the rolling upgrade every upgradeCheckInterval,
+// so that drained nodes are reported once their last instance is gone.
+func manageUpgradeLoop(sched *ssntpSchedulerServer) {
+	ticker := time.NewTicker(upgradeCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if sched.upgrade.active() {
+			sched.manageUpgrade()
+		}
+	}
+}
@@ -90,7 +90,9 @@ var repos = map[string]repoInfo{
 	"github.com/opencontainers/runc":    {"https://github.com/opencontainers/runc.git", "v0.1.0", "Apache v2.0"},
 	"github.com/rackspace/gophercloud":  {"https://github.com/rackspace/gophercloud.git", "c54bbac", "Apache v2.0"},
 	"github.com/tylerb/graceful":        {"https://github.com/tylerb/graceful.git", "9a3d423", "MIT"},
+	"github.com/ugorji/go":              {"https://github.com/ugorji/go.git", "v1.1.7", "MIT"},
 	"github.com/vishvananda/netlink":    {"https://github.com/vishvananda/netlink.git", "a632d6d", "Apache v2.0"},
+	"golang.org/x/crypto":               {"https://go.googlesource.com/crypto", "ab89591", "BSD (3 clause)"},
 	"golang.org/x/net":                  {"https://go.googlesource.com/net", "origin/release-branch.go1.6", "BSD (3 clause)"},
 }
 
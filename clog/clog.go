@@ -0,0 +1,347 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+// Package clog is the logging layer of the ciao components.  It provides
+// the glog API, plus structured fields, and writes either glog formatted
+// lines, the default, or one JSON object per line that can be indexed by
+// log collectors.
+package clog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Field names shared by the ciao components, so that the same information
+// can be searched for in the logs of all of them.
+const (
+	// InstanceUUID is the UUID of the instance a message refers to.
+	InstanceUUID = "instance_uuid"
+
+	// NodeUUID is the UUID of the node a message refers to.
+	NodeUUID = "node_uuid"
+
+	// Command is the SSNTP command or event a message refers to.
+	Command = "command"
+
+	// ElapsedMS is the time taken by an operation, in milliseconds.
+	ElapsedMS = "elapsed_ms"
+)
+
+// Format is the format of the log output.  It implements flag.Value.
+type Format int
+
+const (
+	// GlogFormat hands the messages over to glog, which writes them to its
+	// log files or to stderr depending on its flags.  Fields are appended
+	// to the messages as key=value pairs.
+	GlogFormat Format = iota
+
+	// JSONFormat writes one JSON object per message to stderr.  The
+	// object holds the time, level, component, source location and text
+	// of the message, as well as its fields.
+	JSONFormat
+)
+
+func (f *Format) String() string {
+	switch *f {
+	case GlogFormat:
+		return "glog"
+	case JSONFormat:
+		return "json"
+	}
+	return ""
+}
+
+// Set parses the name of a log format.
+func (f *Format) Set(value string) error {
+	switch value {
+	case "glog":
+		*f = GlogFormat
+	case "json":
+		*f = JSONFormat
+	default:
+		return fmt.Errorf("Unknown log format %s, can be glog or json", value)
+	}
+	return nil
+}
+
+// Fields are the key value pairs attached to a message.
+type Fields map[string]interface{}
+
+type severity int
+
+const (
+	infoLog severity = iota
+	warningLog
+	errorLog
+	fatalLog
+)
+
+var severityNames = []string{"info", "warning", "error", "fatal"}
+
+var state = struct {
+	sync.Mutex
+	format    Format
+	component string
+	output    io.Writer
+}{output: os.Stderr}
+
+// Init selects the log format of the component, e.g., ciao-launcher.  It
+// should be called once the command line has been parsed, before any
+// message is logged.
+func Init(component string, format Format) {
+	state.Lock()
+	state.component = component
+	state.format = format
+	state.Unlock()
+}
+
+func currentFormat() Format {
+	state.Lock()
+	defer state.Unlock()
+	return state.format
+}
+
+func glogMessage(fields Fields, msg string) string {
+	if len(fields) == 0 {
+		return msg
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	msg = strings.TrimSuffix(msg, "\n")
+	for _, k := range keys {
+		v := fmt.Sprint(fields[k])
+		if v == "" || strings.ContainsAny(v, " =\"\n") {
+			v = strconv.Quote(v)
+		}
+		msg += " " + k + "=" + v
+	}
+	return msg
+}
+
+// writeJSON writes a message as a JSON object.  depth is the number of
+// stack frames between writeJSON and the code that logged the message.
+func writeJSON(s severity, depth int, fields Fields, msg string) {
+	entry := make(map[string]interface{}, len(fields)+5)
+	for k, v := range fields {
+		switch v := v.(type) {
+		case error:
+			entry[k] = v.Error()
+		case fmt.Stringer:
+			entry[k] = v.String()
+		default:
+			entry[k] = v
+		}
+	}
+
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = severityNames[s]
+	entry["msg"] = strings.TrimSuffix(msg, "\n")
+	if _, file, line, ok := runtime.Caller(depth + 1); ok {
+		entry["file"] = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	state.Lock()
+	defer state.Unlock()
+
+	if state.component != "" {
+		entry["component"] = state.component
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		for k, v := range fields {
+			entry[k] = fmt.Sprint(v)
+		}
+		data, _ = json.Marshal(entry)
+	}
+	_, _ = state.output.Write(append(data, '\n'))
+}
+
+// logDepth logs a message.  depth is the number of stack frames between
+// logDepth and the code that logged the message.
+func logDepth(s severity, depth int, fields Fields, msg string) {
+	if currentFormat() == JSONFormat {
+		writeJSON(s, depth+1, fields, msg)
+		if s == fatalLog {
+			os.Exit(255)
+		}
+		return
+	}
+
+	msg = glogMessage(fields, msg)
+	switch s {
+	case infoLog:
+		glog.InfoDepth(depth+1, msg)
+	case warningLog:
+		glog.WarningDepth(depth+1, msg)
+	case errorLog:
+		glog.ErrorDepth(depth+1, msg)
+	case fatalLog:
+		glog.FatalDepth(depth+1, msg)
+	}
+}
+
+// Info logs an informational message, formatted as fmt.Sprint would.
+func Info(args ...interface{}) {
+	logDepth(infoLog, 1, nil, fmt.Sprint(args...))
+}
+
+// Infoln logs an informational message, formatted as fmt.Sprintln would.
+func Infoln(args ...interface{}) {
+	logDepth(infoLog, 1, nil, fmt.Sprintln(args...))
+}
+
+// Infof logs an informational message, formatted as fmt.Sprintf would.
+func Infof(format string, args ...interface{}) {
+	logDepth(infoLog, 1, nil, fmt.Sprintf(format, args...))
+}
+
+// Warning logs a warning, formatted as fmt.Sprint would.
+func Warning(args ...interface{}) {
+	logDepth(warningLog, 1, nil, fmt.Sprint(args...))
+}
+
+// Warningf logs a warning, formatted as fmt.Sprintf would.
+func Warningf(format string, args ...interface{}) {
+	logDepth(warningLog, 1, nil, fmt.Sprintf(format, args...))
+}
+
+// Error logs an error, formatted as fmt.Sprint would.
+func Error(args ...interface{}) {
+	logDepth(errorLog, 1, nil, fmt.Sprint(args...))
+}
+
+// Errorf logs an error, formatted as fmt.Sprintf would.
+func Errorf(format string, args ...interface{}) {
+	logDepth(errorLog, 1, nil, fmt.Sprintf(format, args...))
+}
+
+// Fatalf logs an error, formatted as fmt.Sprintf would, and exits with
+// status 255.
+func Fatalf(format string, args ...interface{}) {
+	logDepth(fatalLog, 1, nil, fmt.Sprintf(format, args...))
+}
+
+// Flush flushes the pending glog output.  JSON output is not buffered.
+func Flush() {
+	glog.Flush()
+}
+
+// Entry is a message being built with fields.
+type Entry struct {
+	fields Fields
+}
+
+// WithFields returns an entry to log a message with the given fields.
+func WithFields(fields Fields) *Entry {
+	return &Entry{fields: fields}
+}
+
+// Infof logs an informational message with the fields of e.  Nothing is
+// logged if e is nil.
+func (e *Entry) Infof(format string, args ...interface{}) {
+	if e != nil {
+		logDepth(infoLog, 1, e.fields, fmt.Sprintf(format, args...))
+	}
+}
+
+// Warningf logs a warning with the fields of e.
+func (e *Entry) Warningf(format string, args ...interface{}) {
+	if e != nil {
+		logDepth(warningLog, 1, e.fields, fmt.Sprintf(format, args...))
+	}
+}
+
+// Errorf logs an error with the fields of e.
+func (e *Entry) Errorf(format string, args ...interface{}) {
+	if e != nil {
+		logDepth(errorLog, 1, e.fields, fmt.Sprintf(format, args...))
+	}
+}
+
+// Verbose is true if messages at the requested verbosity are logged, see V.
+type Verbose bool
+
+// V reports whether glog's -v flag is at least level.  The -vmodule flag
+// is matched against the clog source files rather than the callers, so it
+// should not be used.
+func V(level glog.Level) Verbose {
+	return Verbose(glog.V(level))
+}
+
+// Info logs an informational message if v is true.
+func (v Verbose) Info(args ...interface{}) {
+	if v {
+		logDepth(infoLog, 1, nil, fmt.Sprint(args...))
+	}
+}
+
+// Infof logs an informational message if v is true.
+func (v Verbose) Infof(format string, args ...interface{}) {
+	if v {
+		logDepth(infoLog, 1, nil, fmt.Sprintf(format, args...))
+	}
+}
+
+// WithFields returns an entry to log a message with the given fields if v
+// is true, and nil otherwise.
+func (v Verbose) WithFields(fields Fields) *Entry {
+	if !v {
+		return nil
+	}
+	return WithFields(fields)
+}
+
+// SSNTPLog implements the ssntp.Logger interface on top of clog, with the
+// same verbosity levels as ssntp.Log.
+type SSNTPLog struct{}
+
+// Infof logs SSNTP informational messages if glog's V >= 2.
+func (SSNTPLog) Infof(format string, args ...interface{}) {
+	if V(2) {
+		logDepth(infoLog, 1, nil, fmt.Sprintf("SSNTP Info: "+format, args...))
+	}
+}
+
+// Warningf logs SSNTP warnings if glog's V >= 1.
+func (SSNTPLog) Warningf(format string, args ...interface{}) {
+	if V(1) {
+		logDepth(warningLog, 1, nil, fmt.Sprintf("SSNTP Warning: "+format, args...))
+	}
+}
+
+// Errorf logs SSNTP errors.
+func (SSNTPLog) Errorf(format string, args ...interface{}) {
+	logDepth(errorLog, 1, nil, fmt.Sprintf("SSNTP Error: "+format, args...))
+}
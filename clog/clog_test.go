@@ -0,0 +1,117 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package clog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	var f Format
+	if f.String() != "glog" {
+		t.Errorf("Unexpected default format %s", f.String())
+	}
+
+	if err := f.Set("json"); err != nil || f != JSONFormat {
+		t.Errorf("Unable to set json format: %v", err)
+	}
+
+	if err := f.Set("xml"); err == nil {
+		t.Errorf("Unknown format accepted")
+	}
+}
+
+func TestGlogMessage(t *testing.T) {
+	msg := glogMessage(Fields{
+		NodeUUID:     "node-1",
+		InstanceUUID: "instance-1",
+		"reason":     "no space left",
+		"empty":      "",
+	}, "Unable to start instance\n")
+
+	expected := `Unable to start instance empty="" instance_uuid=instance-1 node_uuid=node-1 reason="no space left"`
+	if msg != expected {
+		t.Errorf("Expected %q, got %q", expected, msg)
+	}
+
+	if msg = glogMessage(nil, "Starting Launcher"); msg != "Starting Launcher" {
+		t.Errorf("Unexpected message without fields %q", msg)
+	}
+}
+
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+
+	state.output = &buf
+	Init("ciao-test", JSONFormat)
+	defer func() {
+		state.output = os.Stderr
+		Init("", GlogFormat)
+	}()
+
+	WithFields(Fields{
+		InstanceUUID: "instance-1",
+		ElapsedMS:    12.5,
+		"error":      errors.New("gone"),
+	}).Warningf("Unable to delete instance %s\n", "instance-1")
+	Infof("Launcher will allow a maximum of %d instances", 10)
+	V(10).WithFields(Fields{Command: "START"}).Infof("Not logged")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %d:\n%s", len(lines), buf.String())
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", lines[0], err)
+	}
+
+	for k, v := range map[string]interface{}{
+		"level":      "warning",
+		"component":  "ciao-test",
+		"msg":        "Unable to delete instance instance-1",
+		InstanceUUID: "instance-1",
+		ElapsedMS:    12.5,
+		"error":      "gone",
+	} {
+		if entry[k] != v {
+			t.Errorf("Expected %s %v, got %v", k, v, entry[k])
+		}
+	}
+
+	if file, _ := entry["file"].(string); !strings.HasPrefix(file, "clog_test.go:") {
+		t.Errorf("Wrong source location %v", entry["file"])
+	}
+
+	if _, ok := entry["time"]; !ok {
+		t.Errorf("Missing time")
+	}
+
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("Invalid JSON %s: %v", lines[1], err)
+	}
+
+	if entry["level"] != "info" || entry["msg"] != "Launcher will allow a maximum of 10 instances" {
+		t.Errorf("Unexpected entry %v", entry)
+	}
+}
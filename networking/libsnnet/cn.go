@@ -65,6 +65,9 @@ type VnicConfig struct {
 	TenantID   string // UUID
 	SubnetID   string // UUID
 	ConcID     string // UUID
+	// Optional: IPv6 address and subnet of dual-stack tenant VNICs
+	VnicIPv6   net.IP
+	SubnetIPv6 *net.IPNet
 }
 
 // CNSsntpEvent to be generated in response to a VNIC creation
@@ -121,6 +124,9 @@ type ContainerInfo struct {
 	Subnet   net.IPNet
 	Gateway  net.IP
 	Bridge   string
+	// Optional: IPv6 subnet and gateway of dual-stack tenant networks
+	SubnetIPv6  *net.IPNet
+	GatewayIPv6 net.IP
 }
 
 type linkInfo struct {
@@ -434,6 +440,61 @@ func (cn *ComputeNode) DbRebuild(links []netlink.Link) error {
 	return nil
 }
 
+// TenantBridge describes a tenant bridge present on the CN, as named by
+// its alias
+type TenantBridge struct {
+	TenantID string // Tenant UUID
+	SubnetID string // Tenant Subnet UUID
+	ConcID   string // CNCI UUID
+	ConcIP   string // IP Address of the concentrator
+	Tunnel   bool   // The GRE tunnel to the concentrator is present
+}
+
+//parseTenantBridge extracts the tenant information from a bridge alias
+func parseTenantBridge(alias string) (TenantBridge, bool) {
+	if !strings.HasPrefix(alias, bridgePrefix) {
+		return TenantBridge{}, false
+	}
+
+	fields := strings.Split(strings.TrimPrefix(alias, bridgePrefix), "_")
+	if len(fields) != 4 {
+		return TenantBridge{}, false
+	}
+
+	return TenantBridge{
+		TenantID: fields[0],
+		SubnetID: fields[1],
+		ConcID:   fields[2],
+		ConcIP:   fields[3],
+	}, true
+}
+
+//TenantBridges returns the tenant bridges currently known to the CN
+//network database, and whether their GRE tunnel is present.
+//It lets the agent report its tenant networks so that drift between
+//the node and the rest of the cluster can be detected.
+func (cn *ComputeNode) TenantBridges() []TenantBridge {
+	if cn.cnTopology == nil {
+		return nil
+	}
+
+	cn.cnTopology.Lock()
+	defer cn.cnTopology.Unlock()
+
+	bridges := make([]TenantBridge, 0, len(cn.bridgeMap))
+	for alias := range cn.bridgeMap {
+		bridge, ok := parseTenantBridge(alias)
+		if !ok {
+			continue
+		}
+		gre := grePrefix + strings.TrimPrefix(alias, bridgePrefix)
+		_, bridge.Tunnel = cn.linkMap[gre]
+		bridges = append(bridges, bridge)
+	}
+
+	return bridges
+}
+
 func (cn *ComputeNode) dbUpdate(bridge string, vnic string, op dbOp) (int, error) {
 
 	switch {
@@ -831,13 +892,23 @@ func getContainerInfo(cfg *VnicConfig, vnic *Vnic, bridge *Bridge) *ContainerInf
 	//if we ever change our gateway algorithm it will propagate everywhere
 	gateway := cfg.Subnet.IP.To4().Mask(cfg.Subnet.Mask)
 	gateway[3]++
-	return &ContainerInfo{
+	info := &ContainerInfo{
 		CNContainerEvent: ContainerNetworkInfo, //Default. Caller to override
 		SubnetID:         bridge.LinkName,
 		Bridge:           bridge.GlobalID,
 		Subnet:           cfg.Subnet,
 		Gateway:          gateway,
 	}
+
+	//The IPv6 gateway follows the same algorithm, first address of the subnet
+	if cfg.SubnetIPv6 != nil {
+		gateway6 := cfg.SubnetIPv6.IP.To16().Mask(cfg.SubnetIPv6.Mask)
+		gateway6[15]++
+		info.SubnetIPv6 = cfg.SubnetIPv6
+		info.GatewayIPv6 = gateway6
+	}
+
+	return info
 }
 
 //TODO: Use interfaces here to perform the name and index assignment
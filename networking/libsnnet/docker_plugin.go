@@ -166,8 +166,9 @@ type DockerEpVal struct {
 
 //DockerNwVal stores ciao CN tenant bridge mapping
 type DockerNwVal struct {
-	Bridge  string
-	Gateway net.IPNet
+	Bridge      string
+	Gateway     net.IPNet
+	GatewayIPv6 *net.IPNet //Only set on dual-stack networks
 }
 
 const (
@@ -275,6 +276,9 @@ func handlerCreateNetwork(d *DockerPlugin, w http.ResponseWriter, r *http.Reques
 		Bridge:  bridge,
 		Gateway: *req.IPv4Data[0].Gateway,
 	}
+	if len(req.IPv6Data) > 0 {
+		d.DockerNwMap.m[req.NetworkID].GatewayIPv6 = req.IPv6Data[0].Gateway
+	}
 
 	if err := d.DbAdd(tableNetworkMap, req.NetworkID, d.DockerNwMap.m[req.NetworkID]); err != nil {
 		glog.Errorf("Unable to update db %v", err)
@@ -487,6 +491,9 @@ func handlerJoin(d *DockerPlugin, w http.ResponseWriter, r *http.Request) {
 	d.DockerEpMap.Unlock()
 
 	resp.Gateway = nm.Gateway.IP.String()
+	if nm.GatewayIPv6 != nil {
+		resp.GatewayIPv6 = nm.GatewayIPv6.IP.String()
+	}
 	resp.InterfaceName = &api.InterfaceName{
 		SrcName:   em.Cveth,
 		DstPrefix: "eth",
@@ -669,7 +676,9 @@ func ipamRequestAddress(d *DockerPlugin, w http.ResponseWriter, r *http.Request)
 	}
 
 	//TODO: Should come from the subnet mask for the subnet
-	if req.Address != "" {
+	if ip := net.ParseIP(req.Address); ip != nil && ip.To4() == nil {
+		resp.Address = req.Address + "/64"
+	} else if req.Address != "" {
 		resp.Address = req.Address + "/24"
 	} else {
 		//DOCKER BUG: The preferred address supplied in --ip does not show up.
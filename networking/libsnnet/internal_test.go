@@ -147,3 +147,44 @@ func TestCN_dbRebuild(t *testing.T) {
 	_, err = cn.dbUpdate(alias.bridge, "", dbInsBr)
 	assert.NotNil(err)
 }
+
+//Tests the tenant bridges reported from the CN network database
+//
+//This test only uses the in memory topology and checks that
+//the tenant information is extracted from the bridge aliases
+//
+//The test is expected to pass
+func TestCN_TenantBridges(t *testing.T) {
+	assert := assert.New(t)
+
+	vnicCfg := &VnicConfig{
+		ConcIP:   net.IPv4(192, 168, 1, 1),
+		TenantID: "tuuid",
+		SubnetID: "suuid",
+		ConcID:   "cnciuuid",
+	}
+	alias := genCnVnicAliases(vnicCfg)
+
+	cn := &ComputeNode{}
+	assert.Nil(cn.TenantBridges())
+
+	cn.cnTopology = newCnTopology()
+	cn.bridgeMap[alias.bridge] = make(map[string]bool)
+	cn.bridgeMap["br_malformed"] = make(map[string]bool)
+
+	bridges := cn.TenantBridges()
+	if assert.Len(bridges, 1) {
+		assert.Equal(TenantBridge{
+			TenantID: "tuuid",
+			SubnetID: "suuid",
+			ConcID:   "cnciuuid",
+			ConcIP:   "192.168.1.1",
+		}, bridges[0])
+	}
+
+	cn.linkMap[alias.gre] = &linkInfo{}
+	bridges = cn.TenantBridges()
+	if assert.Len(bridges, 1) {
+		assert.True(bridges[0].Tunnel)
+	}
+}
@@ -0,0 +1,44 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// AttestationQuoteEvent contains a TPM quote generated inside an instance
+// that has a virtual TPM.
+type AttestationQuoteEvent struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// Nonce is the hex encoded random value, chosen by launcher, over
+	// which the quote was generated.  It allows a verifier to check that
+	// the quote is fresh.
+	Nonce string `yaml:"nonce"`
+
+	// Quote is the base64 encoded output of the attestation command run
+	// inside the instance, typically the quoted PCR values and their
+	// signature.
+	Quote string `yaml:"quote,omitempty"`
+
+	// Error describes why a quote could not be obtained.  It is empty if
+	// Quote is valid.
+	Error string `yaml:"error,omitempty"`
+}
+
+// EventAttestationQuote represents the unmarshalled version of the contents
+// of an SSNTP ssntp.AttestationQuote event.  This event is sent by
+// ciao-launcher once an instance with a virtual TPM has become ready.
+type EventAttestationQuote struct {
+	Quote AttestationQuoteEvent `yaml:"attestation_quote"`
+}
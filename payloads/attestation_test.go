@@ -0,0 +1,62 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const attestationQuoteYaml = "" +
+	"attestation_quote:\n" +
+	"  instance_uuid: " + insDelUUID + "\n" +
+	"  nonce: 0badc0de\n" +
+	"  quote: cXVvdGU=\n"
+
+func TestAttestationQuoteUnmarshal(t *testing.T) {
+	var event EventAttestationQuote
+	err := yaml.Unmarshal([]byte(attestationQuoteYaml), &event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if event.Quote.InstanceUUID != insDelUUID {
+		t.Errorf("Wrong instance UUID field [%s]", event.Quote.InstanceUUID)
+	}
+
+	if event.Quote.Nonce != "0badc0de" || event.Quote.Quote != "cXVvdGU=" ||
+		event.Quote.Error != "" {
+		t.Errorf("Wrong quote fields %+v", event.Quote)
+	}
+}
+
+func TestAttestationQuoteMarshal(t *testing.T) {
+	var event EventAttestationQuote
+
+	event.Quote.InstanceUUID = insDelUUID
+	event.Quote.Nonce = "0badc0de"
+	event.Quote.Quote = "cXVvdGU="
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != attestationQuoteYaml {
+		t.Errorf("AttestationQuote marshalling failed\n[%s]\n vs\n[%s]", string(y), attestationQuoteYaml)
+	}
+}
@@ -0,0 +1,365 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// StorageBackend identifies a type of storage on which a node can create
+// the disks or filesystems of its instances.
+type StorageBackend string
+
+const (
+	// LocalStorage indicates that instance disks are files stored on the
+	// node's local filesystem.
+	LocalStorage StorageBackend = "local"
+
+	// EncryptedStorage indicates that the node can encrypt the rootfs of
+	// qemu instances.
+	EncryptedStorage = "encrypted"
+)
+
+// Architecture identifies a CPU architecture, as named by uname -m.
+type Architecture string
+
+const (
+	// X86_64 is the 64 bit Intel and AMD architecture.
+	X86_64 Architecture = "x86_64"
+
+	// AArch64 is the 64 bit ARM architecture.
+	AArch64 = "aarch64"
+)
+
+// HypervisorCapability describes a hypervisor available on a node.
+type HypervisorCapability struct {
+	// Type is the type of instances the hypervisor runs.
+	Type Hypervisor `yaml:"type"`
+
+	// Version is the version reported by the hypervisor, if known.
+	Version string `yaml:"version,omitempty"`
+}
+
+// FailureDomain locates a node in the datacenter.  Nodes sharing a rack, a
+// chassis or a power distribution unit are likely to fail together.
+type FailureDomain struct {
+	// Zone is the name of the availability zone the node is in.
+	Zone string `yaml:"zone,omitempty" since:"24"`
+
+	// Rack is the name of the rack the node is in.
+	Rack string `yaml:"rack,omitempty"`
+
+	// Chassis is the name of the chassis the node is in.
+	Chassis string `yaml:"chassis,omitempty"`
+
+	// PDU is the name of the power distribution unit the node is fed by.
+	PDU string `yaml:"pdu,omitempty"`
+}
+
+// NodeCapabilities describes the hardware and software features of a
+// compute node that do not change while its agent is connected.
+type NodeCapabilities struct {
+	// NodeUUID is the UUID of the agent that sent the capabilities.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// Hypervisors lists the types of instances the node can launch.
+	Hypervisors []HypervisorCapability `yaml:"hypervisors"`
+
+	// CPUFlags lists the features of the node's CPUs, as named in the
+	// flags line of /proc/cpuinfo, e.g., avx2 or aes.
+	CPUFlags []string `yaml:"cpu_flags,omitempty"`
+
+	// Architecture is the architecture of the node's CPUs.  It is empty
+	// for nodes that do not report it.
+	Architecture Architecture `yaml:"architecture,omitempty" since:"10"`
+
+	// CPUModel is the model of the node's CPUs, as named in the model
+	// name line of /proc/cpuinfo.
+	CPUModel string `yaml:"cpu_model,omitempty" since:"10"`
+
+	// KernelVersion is the release of the node's kernel, as reported by
+	// uname -r, e.g., 4.15.0-112-generic.
+	KernelVersion string `yaml:"kernel_version,omitempty" since:"11"`
+
+	// HugepageSizesKB lists the sizes of the hugepages supported by the
+	// node.
+	HugepageSizesKB []int `yaml:"hugepage_sizes_kb,omitempty"`
+
+	// SRIOVVFs lists the PCI addresses of the node's SR-IOV virtual
+	// functions.
+	SRIOVVFs []string `yaml:"sriov_vfs,omitempty"`
+
+	// GPUs lists the PCI addresses of the node's GPUs that can be passed
+	// through to instances.
+	GPUs []string `yaml:"gpus,omitempty"`
+
+	// StorageBackends lists the types of storage the node can create
+	// instance disks on.
+	StorageBackends []StorageBackend `yaml:"storage_backends,omitempty"`
+
+	// WakeOnLANMAC is the MAC address of the interface the node can be
+	// woken up through once powered down.  It is empty if the node does
+	// not accept POWERDOWN commands.
+	WakeOnLANMAC string `yaml:"wol_mac,omitempty" since:"9"`
+
+	// FailureDomain locates the node, if its administrator configured
+	// where it is.
+	FailureDomain *FailureDomain `yaml:"failure_domain,omitempty" since:"12"`
+
+	// SoftwareVersion is the version of the ciao software the node runs,
+	// which rolling upgrades bring every node to.
+	SoftwareVersion string `yaml:"software_version,omitempty" since:"20"`
+
+	// Labels are the key value pairs the node's administrator tagged it
+	// with, e.g., to tell controllers what the node is dedicated to.
+	Labels map[string]string `yaml:"labels,omitempty" since:"24"`
+}
+
+// EventNodeCapabilities represents the unmarshalled version of the contents
+// of an SSNTP ssntp.NodeCapabilities event.  This event is sent by
+// ciao-launcher each time it connects to the scheduler.
+type EventNodeCapabilities struct {
+	Capabilities NodeCapabilities `yaml:"node_capabilities"`
+}
+
+// NodeRequirements lists the capabilities an instance needs from the node
+// it is launched on, besides those implied by its type and its requested
+// resources.
+type NodeRequirements struct {
+	// CPUFlags lists the CPU features the instance needs.
+	CPUFlags []string `yaml:"cpu_flags,omitempty"`
+
+	// HugepageSizeKB is the size of the hugepages the instance memory
+	// must be backed by.  0 means any size.
+	HugepageSizeKB int `yaml:"hugepage_size_kb,omitempty"`
+
+	// StorageBackend is the type of storage the instance disks must be
+	// created on.  Empty means any type.
+	StorageBackend StorageBackend `yaml:"storage_backend,omitempty"`
+
+	// MinHypervisorVersion is the oldest version of the instance's
+	// hypervisor the instance can run on, e.g., 2.11 for a qemu
+	// instance.  Empty means any version.
+	MinHypervisorVersion string `yaml:"min_hypervisor_version,omitempty" since:"11"`
+
+	// MinKernelVersion is the oldest node kernel the instance can run
+	// on, e.g., 4.14 for nested virtualization.  Empty means any version.
+	MinKernelVersion string `yaml:"min_kernel_version,omitempty" since:"11"`
+}
+
+// Validate checks that the node is identified and that its capabilities
+// are well formed.
+func (e *EventNodeCapabilities) Validate() error {
+	var errs ValidationError
+	c := &e.Capabilities
+
+	errs.required("node_capabilities.node_uuid", c.NodeUUID)
+	for i, h := range c.Hypervisors {
+		errs.required(fmt.Sprintf("node_capabilities.hypervisors[%d].type", i), string(h.Type))
+	}
+	for i, size := range c.HugepageSizesKB {
+		if size <= 0 {
+			errs.add(fmt.Sprintf("node_capabilities.hugepage_sizes_kb[%d]", i),
+				"hugepage size (%d) must be > 0", size)
+		}
+	}
+	if c.WakeOnLANMAC != "" {
+		if _, err := net.ParseMAC(c.WakeOnLANMAC); err != nil {
+			errs.add("node_capabilities.wol_mac", "invalid MAC address %s", c.WakeOnLANMAC)
+		}
+	}
+
+	return errs.err()
+}
+
+// Missing returns a description of the first capability required by an
+// instance of type hypervisor, whose image was built for architecture, with
+// the given requested resources and requirements, that the node lacks, or
+// an empty string if the node has all of them.  An empty architecture
+// matches any node, as does a node that does not report its architecture.
+// requirements may be nil.
+func (c *NodeCapabilities) Missing(hypervisor Hypervisor, architecture Architecture,
+	resources []RequestedResource, requirements *NodeRequirements) string {
+	if hypervisor == "" {
+		hypervisor = QEMU
+	}
+	if !c.hasHypervisor(hypervisor) {
+		return fmt.Sprintf("hypervisor %s", hypervisor)
+	}
+
+	if missing := c.MissingPlatform(hypervisor, architecture, requirements); missing != "" {
+		return missing
+	}
+
+	for _, r := range resources {
+		switch {
+		case r.Type == Hugepages && r.Value == 1 && len(c.HugepageSizesKB) == 0:
+			return "hugepages"
+		case r.Type == SRIOVVFs && r.Value > len(c.SRIOVVFs):
+			return fmt.Sprintf("%d SR-IOV VFs", r.Value)
+		case r.Type == GPUs && r.Value > len(c.GPUs):
+			return fmt.Sprintf("%d GPUs", r.Value)
+		}
+	}
+
+	if requirements == nil {
+		return ""
+	}
+
+	for _, flag := range requirements.CPUFlags {
+		if !containsString(c.CPUFlags, flag) {
+			return fmt.Sprintf("CPU flag %s", flag)
+		}
+	}
+
+	if requirements.HugepageSizeKB != 0 && !c.hasHugepageSize(requirements.HugepageSizeKB) {
+		return fmt.Sprintf("%dkB hugepages", requirements.HugepageSizeKB)
+	}
+
+	if requirements.StorageBackend != "" && !c.hasStorageBackend(requirements.StorageBackend) {
+		return fmt.Sprintf("%s storage", requirements.StorageBackend)
+	}
+
+	return ""
+}
+
+// MissingPlatform returns a description of the architecture or of the
+// minimum hypervisor or kernel version required by an instance of type
+// hypervisor that the node lacks, or an empty string if the node meets them.
+// A node that does not report the version of its kernel or hypervisor does
+// not meet a minimum version.  requirements may be nil.
+func (c *NodeCapabilities) MissingPlatform(hypervisor Hypervisor, architecture Architecture,
+	requirements *NodeRequirements) string {
+	if hypervisor == "" {
+		hypervisor = QEMU
+	}
+
+	if architecture != "" && c.Architecture != "" && architecture != c.Architecture {
+		return fmt.Sprintf("%s architecture", architecture)
+	}
+
+	if requirements == nil {
+		return ""
+	}
+
+	if min := requirements.MinHypervisorVersion; min != "" &&
+		!versionAtLeast(c.hypervisorVersion(hypervisor), min) {
+		return fmt.Sprintf("hypervisor %s %s or later", hypervisor, min)
+	}
+
+	if min := requirements.MinKernelVersion; min != "" && !versionAtLeast(c.KernelVersion, min) {
+		return fmt.Sprintf("kernel %s or later", min)
+	}
+
+	return ""
+}
+
+func (c *NodeCapabilities) hypervisorVersion(hypervisor Hypervisor) string {
+	for _, h := range c.Hypervisors {
+		if h.Type == hypervisor {
+			return h.Version
+		}
+	}
+	return ""
+}
+
+// parseVersion returns the numeric components of a dotted version, up to
+// the first one that does not start with a digit.  Anything following the
+// digits of a component, e.g., the -112-generic of 4.15.0-112-generic, ends
+// the version.
+func parseVersion(version string) []int {
+	var components []int
+	for _, field := range strings.Split(version, ".") {
+		end := 0
+		for end < len(field) && field[end] >= '0' && field[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(field[:end])
+		if err != nil {
+			break
+		}
+		components = append(components, n)
+		if end < len(field) {
+			break
+		}
+	}
+	return components
+}
+
+// versionAtLeast returns true if version is min or a later one.  Missing
+// components count as 0, so 4.15 is at least 4.15.0.  An empty or
+// unparsable version is never at least min.
+func versionAtLeast(version, min string) bool {
+	v := parseVersion(version)
+	if len(v) == 0 {
+		return false
+	}
+
+	m := parseVersion(min)
+	for i := 0; i < len(v) || i < len(m); i++ {
+		var a, b int
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(m) {
+			b = m[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
+
+func (c *NodeCapabilities) hasHypervisor(hypervisor Hypervisor) bool {
+	for _, h := range c.Hypervisors {
+		if h.Type == hypervisor {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *NodeCapabilities) hasHugepageSize(sizeKB int) bool {
+	for _, size := range c.HugepageSizesKB {
+		if size == sizeKB {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *NodeCapabilities) hasStorageBackend(backend StorageBackend) bool {
+	for _, b := range c.StorageBackends {
+		if b == backend {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
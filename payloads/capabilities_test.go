@@ -0,0 +1,204 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const nodeCapabilitiesYaml = "" +
+	"node_capabilities:\n" +
+	"  node_uuid: " + agentUUID + "\n" +
+	"  hypervisors:\n" +
+	"  - type: qemu\n" +
+	"    version: 2.7.0\n" +
+	"  - type: docker\n" +
+	"  cpu_flags:\n" +
+	"  - avx2\n" +
+	"  - aes\n" +
+	"  architecture: x86_64\n" +
+	"  cpu_model: Intel(R) Xeon(R) CPU E5-2699 v4 @ 2.20GHz\n" +
+	"  kernel_version: 4.15.0-112-generic\n" +
+	"  hugepage_sizes_kb:\n" +
+	"  - 2048\n" +
+	"  gpus:\n" +
+	"  - \"0000:03:00.0\"\n" +
+	"  storage_backends:\n" +
+	"  - local\n" +
+	"  failure_domain:\n" +
+	"    zone: az1\n" +
+	"    rack: r1\n" +
+	"    pdu: pdu-a\n" +
+	"  labels:\n" +
+	"    pool: batch\n"
+
+func testNodeCapabilities() EventNodeCapabilities {
+	return EventNodeCapabilities{
+		Capabilities: NodeCapabilities{
+			NodeUUID: agentUUID,
+			Hypervisors: []HypervisorCapability{
+				{Type: QEMU, Version: "2.7.0"},
+				{Type: Docker},
+			},
+			CPUFlags:        []string{"avx2", "aes"},
+			Architecture:    X86_64,
+			CPUModel:        "Intel(R) Xeon(R) CPU E5-2699 v4 @ 2.20GHz",
+			KernelVersion:   "4.15.0-112-generic",
+			HugepageSizesKB: []int{2048},
+			GPUs:            []string{"0000:03:00.0"},
+			StorageBackends: []StorageBackend{LocalStorage},
+			FailureDomain:   &FailureDomain{Zone: "az1", Rack: "r1", PDU: "pdu-a"},
+			Labels:          map[string]string{"pool": "batch"},
+		},
+	}
+}
+
+func TestNodeCapabilitiesMarshal(t *testing.T) {
+	event := testNodeCapabilities()
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != nodeCapabilitiesYaml {
+		t.Errorf("NodeCapabilities marshalling failed\n[%s]\n vs\n[%s]", string(y), nodeCapabilitiesYaml)
+	}
+}
+
+func TestNodeCapabilitiesUnmarshal(t *testing.T) {
+	var event EventNodeCapabilities
+	err := yaml.Unmarshal([]byte(nodeCapabilitiesYaml), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(&event); err != nil {
+		t.Errorf("Valid NodeCapabilities payload rejected: %v", err)
+	}
+
+	c := event.Capabilities
+	if c.NodeUUID != agentUUID || len(c.Hypervisors) != 2 ||
+		c.Hypervisors[0].Version != "2.7.0" || len(c.CPUFlags) != 2 ||
+		len(c.SRIOVVFs) != 0 || len(c.GPUs) != 1 ||
+		c.FailureDomain == nil || c.FailureDomain.Rack != "r1" ||
+		c.FailureDomain.Zone != "az1" || c.Labels["pool"] != "batch" {
+		t.Errorf("Wrong NodeCapabilities fields %+v", c)
+	}
+}
+
+func TestValidateNodeCapabilities(t *testing.T) {
+	event := testNodeCapabilities()
+	event.Capabilities.NodeUUID = ""
+	event.Capabilities.Hypervisors[1].Type = ""
+	event.Capabilities.HugepageSizesKB = []int{0}
+	event.Capabilities.WakeOnLANMAC = "not a MAC"
+
+	fields := testFields(Validate(&event))
+	for _, f := range []string{
+		"node_capabilities.node_uuid",
+		"node_capabilities.hypervisors[1].type",
+		"node_capabilities.hugepage_sizes_kb[0]",
+		"node_capabilities.wol_mac",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+}
+
+func TestNodeCapabilitiesMissing(t *testing.T) {
+	c := testNodeCapabilities().Capabilities
+
+	tests := []struct {
+		hypervisor   Hypervisor
+		architecture Architecture
+		resources    []RequestedResource
+		requirements *NodeRequirements
+		missing      bool
+	}{
+		{"", "", nil, nil, false},
+		{Docker, "", []RequestedResource{{Type: GPUs, Value: 1}}, nil, false},
+		{CloudHypervisor, "", nil, nil, true},
+		{QEMU, "", []RequestedResource{{Type: GPUs, Value: 2}}, nil, true},
+		{QEMU, "", []RequestedResource{{Type: SRIOVVFs, Value: 1}}, nil, true},
+		{QEMU, "", []RequestedResource{{Type: Hugepages, Value: 1}}, nil, false},
+		{QEMU, "", nil, &NodeRequirements{CPUFlags: []string{"aes", "avx2"}}, false},
+		{QEMU, "", nil, &NodeRequirements{CPUFlags: []string{"avx512f"}}, true},
+		{QEMU, "", nil, &NodeRequirements{HugepageSizeKB: 2048}, false},
+		{QEMU, "", nil, &NodeRequirements{HugepageSizeKB: 1048576}, true},
+		{QEMU, "", nil, &NodeRequirements{StorageBackend: LocalStorage}, false},
+		{QEMU, "", nil, &NodeRequirements{StorageBackend: EncryptedStorage}, true},
+		{QEMU, X86_64, nil, nil, false},
+		{QEMU, AArch64, nil, nil, true},
+		{Docker, AArch64, nil, nil, true},
+		{QEMU, "", nil, &NodeRequirements{MinHypervisorVersion: "2.7"}, false},
+		{QEMU, "", nil, &NodeRequirements{MinHypervisorVersion: "2.11"}, true},
+		{Docker, "", nil, &NodeRequirements{MinHypervisorVersion: "1.12"}, true},
+		{QEMU, "", nil, &NodeRequirements{MinKernelVersion: "4.15"}, false},
+		{QEMU, "", nil, &NodeRequirements{MinKernelVersion: "4.15.1"}, true},
+		{QEMU, "", nil, &NodeRequirements{MinKernelVersion: "3.10.0"}, false},
+	}
+
+	for i, test := range tests {
+		missing := c.Missing(test.hypervisor, test.architecture, test.resources, test.requirements)
+		if (missing != "") != test.missing {
+			t.Errorf("Test %d: unexpected missing capability [%s]", i, missing)
+		}
+	}
+
+	c.HugepageSizesKB = nil
+	if c.Missing(QEMU, "", []RequestedResource{{Type: Hugepages, Value: 1}}, nil) == "" {
+		t.Errorf("Hugepages available on a node without hugepages")
+	}
+
+	c.Architecture = ""
+	if missing := c.Missing(QEMU, AArch64, nil, nil); missing != "" {
+		t.Errorf("Node not reporting its architecture rejected for %s", missing)
+	}
+
+	c.KernelVersion = ""
+	if c.MissingPlatform(QEMU, "", &NodeRequirements{MinKernelVersion: "3.10"}) == "" {
+		t.Errorf("Node not reporting its kernel version meets a minimum kernel version")
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+	tests := []struct {
+		version string
+		min     string
+		atLeast bool
+	}{
+		{"2.7.0", "2.7", true},
+		{"2.7", "2.7.0", true},
+		{"2.10.1", "2.9", true},
+		{"2.9", "2.10", false},
+		{"4.15.0-112-generic", "4.15", true},
+		{"4.14.200-rt", "4.15", false},
+		{"17.03.1-ce", "17.3", true},
+		{"", "1", false},
+		{"unknown", "1", false},
+	}
+
+	for _, test := range tests {
+		if versionAtLeast(test.version, test.min) != test.atLeast {
+			t.Errorf("Version %s at least %s should be %v", test.version, test.min, test.atLeast)
+		}
+	}
+}
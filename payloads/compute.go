@@ -216,6 +216,16 @@ type CiaoTenantResources struct {
 	MemUsage      int       `json:"ram_usage"`
 	DiskLimit     int       `json:"disk_limit"`
 	DiskUsage     int       `json:"disk_usage"`
+	IOPSLimit     int       `json:"disk_iops_limit"`
+	IOPSUsage     int       `json:"disk_iops_usage"`
+	GPULimit      int       `json:"gpus_limit"`
+	GPUUsage      int       `json:"gpus_usage"`
+	CoresLimit    int       `json:"dedicated_cores_limit"`
+	CoresUsage    int       `json:"dedicated_cores_usage"`
+	IngressLimit  int       `json:"net_ingress_kbps_limit"`
+	IngressUsage  int       `json:"net_ingress_kbps_usage"`
+	EgressLimit   int       `json:"net_egress_kbps_limit"`
+	EgressUsage   int       `json:"net_egress_kbps_usage"`
 }
 
 // CiaoUsage contains a snapshot of resource consumption for a tenant.
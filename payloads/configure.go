@@ -75,12 +75,99 @@ type ConfigureController struct {
 	IdentityPassword string `yaml:"identity_password"`
 }
 
-// ConfigureLauncher is reserved for future use.
+// TenantLimit specifies the maximum resources that the instances of a single
+// tenant may consume on any one node.
+type TenantLimit struct {
+	// TenantUUID is the UUID of the tenant to which the limits apply.
+	TenantUUID string `yaml:"tenant_uuid"`
+
+	// MaxInstances is the maximum number of instances belonging to the
+	// tenant that may exist on a node.  0 means no limit.
+	MaxInstances int `yaml:"max_instances"`
+
+	// MaxMemMB is the maximum amount of memory, in MB, that may be
+	// allocated to the instances of the tenant on a node.  0 means no
+	// limit.
+	MaxMemMB int `yaml:"max_mem_mb"`
+}
+
+// ConfigureLauncher contains the configuration for ciao-launcher.
 type ConfigureLauncher struct {
 	ComputeNetwork    string `yaml:"compute_net"`
 	ManagementNetwork string `yaml:"mgmt_net"`
 	DiskLimit         bool   `yaml:"disk_limit"`
 	MemoryLimit       bool   `yaml:"mem_limit"`
+
+	// TenantLimits contains the per-tenant limits enforced by
+	// ciao-launcher.  Tenants that do not appear in this list are
+	// not limited.
+	TenantLimits []TenantLimit `yaml:"tenant_limits,omitempty"`
+}
+
+// Feature flags that can be set in the cluster configuration.
+const (
+	// DiskLimitFeature stops agents from launching instances when their
+	// node is running low on disk space.
+	DiskLimitFeature = "disk_limit"
+
+	// MemLimitFeature stops agents from launching instances when their
+	// node is running low on memory.
+	MemLimitFeature = "mem_limit"
+
+	// GuestFSStatsFeature makes agents report the filesystem usage of
+	// VM instances running the qemu guest agent.
+	GuestFSStatsFeature = "guest_fs_stats"
+)
+
+// Watermarks contains the amounts of free disk space and memory, in MB, below
+// which agents stop launching instances.  Agents report that their node is
+// FULL when the free space falls below the high watermark and refuse START
+// commands when it falls below the low watermark.  0 means the agent's own
+// default.
+type Watermarks struct {
+	DiskHighMB int `yaml:"disk_high_mb,omitempty"`
+	DiskLowMB  int `yaml:"disk_low_mb,omitempty"`
+	MemHighMB  int `yaml:"mem_high_mb,omitempty"`
+	MemLowMB   int `yaml:"mem_low_mb,omitempty"`
+}
+
+// ConfigureCluster contains the settings of a running cluster that agents
+// apply as soon as they receive them, without being restarted.  Settings
+// that are left out take the values given on the command line of each agent.
+type ConfigureCluster struct {
+	// StatsPeriod is the interval, in seconds, at which agents report
+	// their node and instance statistics.
+	StatsPeriod int `yaml:"stats_period,omitempty"`
+
+	// Watermarks contains the free disk space and memory thresholds used
+	// by agents to decide whether their node can take more instances.
+	Watermarks Watermarks `yaml:"watermarks,omitempty"`
+
+	// LogVerbosity is the level of the verbose logs written by the
+	// scheduler and the agents.
+	LogVerbosity *int `yaml:"log_verbosity,omitempty"`
+
+	// Features enables or disables optional agent features, such as
+	// DiskLimitFeature.  Agents ignore the features they do not know.
+	Features map[string]bool `yaml:"features,omitempty"`
+
+	// Upgrade starts a rolling upgrade of the compute nodes, which the
+	// scheduler orchestrates.  Leaving it out ends the upgrade.
+	Upgrade *RollingUpgrade `yaml:"upgrade,omitempty" since:"20"`
+}
+
+// RollingUpgrade describes a rolling upgrade of the compute nodes to a
+// software version.  The scheduler prefers placing instances on the nodes
+// already running the target version, and drains the others a few at a
+// time so that they can be upgraded once their instances are gone.
+type RollingUpgrade struct {
+	// TargetVersion is the software version, as advertised in the
+	// NodeCapabilities events, the nodes are upgraded to.
+	TargetVersion string `yaml:"target_version"`
+
+	// MaxDraining is the maximum number of nodes drained for their
+	// upgrade at once, 1 if 0.
+	MaxDraining int `yaml:"max_draining,omitempty"`
 }
 
 // ConfigureService is reserved for future use.
@@ -89,16 +176,19 @@ type ConfigureService struct {
 	URL  string      `yaml:"url"`
 }
 
-// ConfigurePayload is reserved for future use.
+// ConfigurePayload contains the cluster configuration.
 type ConfigurePayload struct {
 	Scheduler       ConfigureScheduler  `yaml:"scheduler"`
 	Controller      ConfigureController `yaml:"controller"`
 	Launcher        ConfigureLauncher   `yaml:"launcher"`
 	ImageService    ConfigureService    `yaml:"image_service"`
 	IdentityService ConfigureService    `yaml:"identity_service"`
+	Cluster         ConfigureCluster    `yaml:"cluster,omitempty"`
 }
 
-// Configure is reserved for future use.
+// Configure represents the unmarshalled version of the contents of a SSNTP
+// CONFIGURE payload.  The scheduler sends it to all the agents, both when
+// a controller pushes a new configuration and when agents connect.
 type Configure struct {
 	Configure ConfigurePayload `yaml:"configure"`
 }
@@ -122,3 +122,70 @@ func TestConfigureMarshal(t *testing.T) {
 		t.Errorf("CONFIGURE marshalling failed\n[%s]\n vs\n[%s]", string(y), configureYaml)
 	}
 }
+
+func TestConfigureTenantLimits(t *testing.T) {
+	limitsYaml := "configure:\n" +
+		"  launcher:\n" +
+		"    compute_net: " + computeNet + "\n" +
+		"    tenant_limits:\n" +
+		"    - tenant_uuid: 67d86208-b46c-4465-9018-fe14087d415f\n" +
+		"      max_instances: 4\n" +
+		"      max_mem_mb: 2048\n"
+
+	var cfg Configure
+	err := yaml.Unmarshal([]byte(limitsYaml), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limits := cfg.Configure.Launcher.TenantLimits
+	if len(limits) != 1 {
+		t.Fatalf("Expected 1 tenant limit, found %d", len(limits))
+	}
+
+	if limits[0].TenantUUID != "67d86208-b46c-4465-9018-fe14087d415f" ||
+		limits[0].MaxInstances != 4 || limits[0].MaxMemMB != 2048 {
+		t.Errorf("Wrong tenant limit %+v", limits[0])
+	}
+}
+
+func TestConfigureCluster(t *testing.T) {
+	clusterYaml := "configure:\n" +
+		"  cluster:\n" +
+		"    stats_period: 10\n" +
+		"    watermarks:\n" +
+		"      disk_high_mb: 20000\n" +
+		"      mem_low_mb: 256\n" +
+		"    log_verbosity: 2\n" +
+		"    features:\n" +
+		"      " + DiskLimitFeature + ": false\n" +
+		"      " + GuestFSStatsFeature + ": true\n" +
+		"    upgrade:\n" +
+		"      target_version: 1.2.0\n" +
+		"      max_draining: 2\n"
+
+	var cfg Configure
+	err := yaml.Unmarshal([]byte(clusterYaml), &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := cfg.Configure.Cluster
+	if cluster.StatsPeriod != 10 || cluster.Watermarks.DiskHighMB != 20000 ||
+		cluster.Watermarks.MemLowMB != 256 || cluster.Watermarks.DiskLowMB != 0 {
+		t.Errorf("Wrong cluster settings %+v", cluster)
+	}
+
+	if cluster.LogVerbosity == nil || *cluster.LogVerbosity != 2 {
+		t.Errorf("Wrong log verbosity %v", cluster.LogVerbosity)
+	}
+
+	if len(cluster.Features) != 2 || cluster.Features[DiskLimitFeature] ||
+		!cluster.Features[GuestFSStatsFeature] {
+		t.Errorf("Wrong features %v", cluster.Features)
+	}
+
+	if cluster.Upgrade == nil || cluster.Upgrade.TargetVersion != "1.2.0" || cluster.Upgrade.MaxDraining != 2 {
+		t.Errorf("Wrong upgrade %+v", cluster.Upgrade)
+	}
+}
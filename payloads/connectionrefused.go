@@ -0,0 +1,52 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ConnectionRefusedReason denotes the limit that prevented an SSNTP server
+// from accepting a client connection.
+type ConnectionRefusedReason string
+
+const (
+	// TooManyConnections is returned when the server already has as
+	// many client connections as it accepts.
+	TooManyConnections ConnectionRefusedReason = "too_many_connections"
+
+	// TooManyRoleConnections is returned when the server already has as
+	// many connections from clients with the same role as it accepts.
+	TooManyRoleConnections = "too_many_role_connections"
+)
+
+// ErrorConnectionRefused represents the unmarshalled version of the contents
+// of a SSNTP ERROR frame whose type is set to ssntp.ConnectionRefused.
+type ErrorConnectionRefused struct {
+	// Reason is the limit that was reached, e.g., TooManyConnections.
+	Reason ConnectionRefusedReason `yaml:"reason"`
+
+	// Limit is the value of the limit that was reached.
+	Limit int `yaml:"limit"`
+}
+
+func (r ConnectionRefusedReason) String() string {
+	switch r {
+	case TooManyConnections:
+		return "Too many connections"
+	case TooManyRoleConnections:
+		return "Too many connections for this role"
+	}
+
+	return ""
+}
@@ -0,0 +1,58 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestConnectionRefusedUnmarshal(t *testing.T) {
+	refusedYaml := `reason: too_many_role_connections
+limit: 64
+`
+	var error ErrorConnectionRefused
+	err := yaml.Unmarshal([]byte(refusedYaml), &error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if error.Reason != TooManyRoleConnections {
+		t.Error("Wrong Reason field")
+	}
+
+	if error.Limit != 64 {
+		t.Error("Wrong Limit field")
+	}
+}
+
+func TestConnectionRefusedMarshal(t *testing.T) {
+	error := ErrorConnectionRefused{
+		Reason: TooManyConnections,
+		Limit:  1024,
+	}
+
+	y, err := yaml.Marshal(&error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != "reason: too_many_connections\nlimit: 1024\n" {
+		t.Errorf("Wrong ConnectionRefused payload %s", y)
+	}
+}
@@ -34,6 +34,11 @@ const (
 	// of the DELETE payload are incorrect, e.g., the instance_uuid
 	// is missing.
 	DeleteInvalidData = "invalid_data"
+
+	// DeleteTenantNotAuthenticated is returned by the scheduler when the
+	// DELETE command does not carry a valid token for the tenant of the
+	// instance.
+	DeleteTenantNotAuthenticated = "tenant_not_authenticated"
 )
 
 // ErrorDeleteFailure represents the unmarshalled version of the contents of a
@@ -55,6 +60,8 @@ func (r DeleteFailureReason) String() string {
 		return "YAML payload is corrupt"
 	case DeleteInvalidData:
 		return "Command section of YAML payload is corrupt or missing required information"
+	case DeleteTenantNotAuthenticated:
+		return "Tenant not authenticated"
 	}
 
 	return ""
@@ -0,0 +1,81 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// CollectDiagnosticsCmd contains the information needed by a CN Agent to
+// gather debugging information about one of its instances.
+type CollectDiagnosticsCmd struct {
+	// InstanceUUID identifies the instance to be examined.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// WorkloadAgentUUID identifies the node on which the instance is
+	// running.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// UploadURL is the URL to which the resulting bundle is uploaded
+	// via an HTTP PUT request.  If empty, the bundle is returned to
+	// the sender of the command in a series of DiagnosticsData events.
+	UploadURL string `yaml:"upload_url,omitempty"`
+
+	// StatsSamples is the maximum number of the most recent statistics
+	// samples collected for the instance to include in the bundle.
+	StatsSamples int `yaml:"stats_samples,omitempty"`
+
+	// MemoryDump indicates whether a dump of the guest's memory should
+	// be included in the bundle.  It is ignored for containers.
+	MemoryDump bool `yaml:"memory_dump,omitempty"`
+
+	// TenantToken authenticates the tenant of the instance, see
+	// StartCmd.TenantToken.
+	TenantToken string `yaml:"tenant_token,omitempty" since:"19"`
+}
+
+// CollectDiagnostics represents the unmarshalled version of the contents of
+// a SSNTP COLLECTDIAGNOSTICS payload.
+type CollectDiagnostics struct {
+	Collect CollectDiagnosticsCmd `yaml:"collect_diagnostics"`
+}
+
+// DiagnosticsChunk contains a single piece of a diagnostics bundle.
+type DiagnosticsChunk struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// Sequence is the index of the chunk within the bundle, starting
+	// at 0.
+	Sequence int `yaml:"sequence"`
+
+	// Last is true for the final chunk of the bundle.
+	Last bool `yaml:"last"`
+
+	// Data is a base64 encoded piece of a gzipped tarball.  The
+	// tarball is obtained by decoding and concatenating the Data fields
+	// of all the chunks in sequence order.
+	Data string `yaml:"data,omitempty"`
+
+	// Error is set if the bundle could not be collected or uploaded.
+	// The chunk containing the error is always the last chunk sent.
+	Error string `yaml:"error,omitempty"`
+}
+
+// EventDiagnosticsData represents the unmarshalled version of the contents
+// of an SSNTP ssntp.DiagnosticsData event.  This event is sent by
+// ciao-launcher in response to a COLLECTDIAGNOSTICS command.  If the command
+// specified an upload URL, a single event with Last set to true is sent once
+// the upload has completed or failed.
+type EventDiagnosticsData struct {
+	Chunk DiagnosticsChunk `yaml:"diagnostics_data"`
+}
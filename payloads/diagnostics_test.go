@@ -0,0 +1,100 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const diagInstanceUUID = "3390740c-dce9-48d6-b83a-a717417072ce"
+const diagAgentUUID = "59460b8a-5f53-4e3e-b5ce-b71fed8c7e64"
+const diagUploadURL = "https://diagnostics.example.com/bundles/1"
+const collectDiagnosticsYaml = "" +
+	"collect_diagnostics:\n" +
+	"  instance_uuid: " + diagInstanceUUID + "\n" +
+	"  workload_agent_uuid: " + diagAgentUUID + "\n" +
+	"  upload_url: " + diagUploadURL + "\n" +
+	"  stats_samples: 10\n" +
+	"  memory_dump: true\n"
+const diagnosticsDataYaml = "" +
+	"diagnostics_data:\n" +
+	"  instance_uuid: " + diagInstanceUUID + "\n" +
+	"  sequence: 3\n" +
+	"  last: true\n" +
+	"  data: aGVsbG8=\n"
+
+func TestCollectDiagnosticsUnmarshal(t *testing.T) {
+	var cmd CollectDiagnostics
+	err := yaml.Unmarshal([]byte(collectDiagnosticsYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cmd.Collect.InstanceUUID != diagInstanceUUID {
+		t.Errorf("Wrong instance UUID field [%s]", cmd.Collect.InstanceUUID)
+	}
+
+	if cmd.Collect.WorkloadAgentUUID != diagAgentUUID {
+		t.Errorf("Wrong Agent UUID field [%s]", cmd.Collect.WorkloadAgentUUID)
+	}
+
+	if cmd.Collect.UploadURL != diagUploadURL {
+		t.Errorf("Wrong upload URL field [%s]", cmd.Collect.UploadURL)
+	}
+
+	if cmd.Collect.StatsSamples != 10 || !cmd.Collect.MemoryDump {
+		t.Errorf("Wrong stats samples or memory dump fields %+v", cmd.Collect)
+	}
+}
+
+func TestCollectDiagnosticsMarshal(t *testing.T) {
+	var cmd CollectDiagnostics
+	cmd.Collect.InstanceUUID = diagInstanceUUID
+	cmd.Collect.WorkloadAgentUUID = diagAgentUUID
+	cmd.Collect.UploadURL = diagUploadURL
+	cmd.Collect.StatsSamples = 10
+	cmd.Collect.MemoryDump = true
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != collectDiagnosticsYaml {
+		t.Errorf("COLLECTDIAGNOSTICS marshalling failed\n[%s]\n vs\n[%s]", string(y),
+			collectDiagnosticsYaml)
+	}
+}
+
+func TestDiagnosticsDataMarshal(t *testing.T) {
+	var event EventDiagnosticsData
+	event.Chunk.InstanceUUID = diagInstanceUUID
+	event.Chunk.Sequence = 3
+	event.Chunk.Last = true
+	event.Chunk.Data = "aGVsbG8="
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != diagnosticsDataYaml {
+		t.Errorf("DiagnosticsData marshalling failed\n[%s]\n vs\n[%s]", string(y),
+			diagnosticsDataYaml)
+	}
+}
@@ -0,0 +1,172 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/ugorji/go/codec"
+	"gopkg.in/yaml.v2"
+)
+
+// Encoding identifies the format in which a payload is marshalled.
+type Encoding uint8
+
+const (
+	// YAML is the default payload encoding, understood by all SSNTP peers.
+	YAML Encoding = iota
+
+	// MsgPack is a binary payload encoding, smaller and faster to
+	// marshal than YAML.  It is only used between peers that have
+	// agreed on it when connecting.
+	MsgPack
+
+	// JSON is a text payload encoding using the same field names as
+	// YAML, for peers and tools that already deal with JSON documents.
+	// It is only used between peers that have agreed on it when
+	// connecting.
+	JSON
+)
+
+// msgPackMagic prefixes all MsgPack payloads so that they can be told apart
+// from YAML ones.  A NUL byte never appears in a YAML document.
+var msgPackMagic = []byte{0x00, 'M', 'P', 0x01}
+
+var msgPackHandle = newMsgPackHandle()
+
+func newMsgPackHandle() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+
+	// Use the yaml field names so that MsgPack payloads can be
+	// transcoded to YAML ones.
+	h.TypeInfos = codec.NewTypeInfos([]string{"yaml"})
+	h.RawToString = true
+	h.WriteExt = true
+
+	return h
+}
+
+var jsonHandle = newJSONHandle()
+
+func newJSONHandle() *codec.JsonHandle {
+	h := &codec.JsonHandle{}
+
+	// Use the yaml field names, as for MsgPack, and decode JSON objects
+	// into maps that can be marshalled with any encoding.
+	h.TypeInfos = codec.NewTypeInfos([]string{"yaml"})
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+
+	return h
+}
+
+func (e Encoding) String() string {
+	switch e {
+	case YAML:
+		return "yaml"
+	case MsgPack:
+		return "msgpack"
+	case JSON:
+		return "json"
+	}
+
+	return fmt.Sprintf("unknown encoding %d", uint8(e))
+}
+
+// ParseEncoding returns the Encoding whose name is name.
+func ParseEncoding(name string) (Encoding, error) {
+	switch name {
+	case "yaml":
+		return YAML, nil
+	case "msgpack":
+		return MsgPack, nil
+	case "json":
+		return JSON, nil
+	}
+
+	return YAML, fmt.Errorf("Unknown payload encoding %s", name)
+}
+
+// PayloadEncoding returns the Encoding used to marshal payload.  JSON
+// payloads are objects or arrays, and YAML ones are never marshalled in
+// the flow style that would make them start like a JSON document.
+func PayloadEncoding(payload []byte) Encoding {
+	if bytes.HasPrefix(payload, msgPackMagic) {
+		return MsgPack
+	}
+
+	if len(payload) > 0 && (payload[0] == '{' || payload[0] == '[') {
+		return JSON
+	}
+
+	return YAML
+}
+
+// Marshal marshals v using the encoding e.
+func Marshal(e Encoding, v interface{}) ([]byte, error) {
+	switch e {
+	case YAML:
+		return yaml.Marshal(v)
+	case MsgPack:
+		buf := bytes.NewBuffer(append([]byte{}, msgPackMagic...))
+		err := codec.NewEncoder(buf, msgPackHandle).Encode(v)
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case JSON:
+		var payload []byte
+		err := codec.NewEncoderBytes(&payload, jsonHandle).Encode(v)
+		if err != nil {
+			return nil, err
+		}
+		return payload, nil
+	}
+
+	return nil, fmt.Errorf("Cannot marshal payload: %v", e)
+}
+
+// Unmarshal unmarshals payload into v.  The encoding of payload is
+// detected automatically, so that SSNTP peers can unmarshal any payload
+// they receive with Unmarshal, whatever the encoding used by the sender.
+func Unmarshal(payload []byte, v interface{}) error {
+	switch PayloadEncoding(payload) {
+	case MsgPack:
+		return codec.NewDecoderBytes(payload[len(msgPackMagic):], msgPackHandle).Decode(v)
+	case JSON:
+		return codec.NewDecoderBytes(payload, jsonHandle).Decode(v)
+	}
+
+	return yaml.Unmarshal(payload, v)
+}
+
+// Transcode converts payload to the encoding e.  Payloads that are
+// already encoded with e are returned as is.
+func Transcode(payload []byte, e Encoding) ([]byte, error) {
+	if PayloadEncoding(payload) == e {
+		return payload, nil
+	}
+
+	var v interface{}
+	err := Unmarshal(payload, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	return Marshal(e, stringKeys(v))
+}
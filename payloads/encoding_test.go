@@ -0,0 +1,160 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func testEncodingStats() Stat {
+	return Stat{
+		NodeUUID:        "2400bce6-ccc8-4a45-b2aa-b5cc3790077b",
+		Status:          "READY",
+		MemTotalMB:      3896,
+		MemAvailableMB:  3896,
+		DiskTotalMB:     500000,
+		DiskAvailableMB: 256000,
+		CpusOnline:      4,
+		NodeHostName:    "test",
+		Networks: []NetworkStat{
+			{NodeIP: "192.168.1.1", NodeMAC: "02:00:15:03:6f:49"},
+		},
+		Instances: []InstanceStat{
+			{
+				InstanceUUID:  "fe2970fa-7b36-460b-8b79-9eb4745e62f2",
+				State:         Running,
+				MemoryUsageMB: 40,
+				DiskUsageMB:   2,
+				CPUUsage:      90,
+			},
+			{
+				InstanceUUID:  "1f5b2fe6-4493-4561-904a-8f4e956218d9",
+				State:         Exited,
+				MemoryUsageMB: -1,
+				CPUUsage:      -1,
+			},
+		},
+	}
+}
+
+func TestEncodingMarshal(t *testing.T) {
+	stats := testEncodingStats()
+
+	for _, e := range []Encoding{YAML, MsgPack, JSON} {
+		payload, err := Marshal(e, &stats)
+		if err != nil {
+			t.Fatalf("Unable to marshal stats with %s: %v", e, err)
+		}
+
+		if PayloadEncoding(payload) != e {
+			t.Errorf("%s payload detected as %s", e, PayloadEncoding(payload))
+		}
+
+		var s Stat
+		err = Unmarshal(payload, &s)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal %s stats: %v", e, err)
+		}
+
+		if !reflect.DeepEqual(stats, s) {
+			t.Errorf("%s stats do not match: %+v != %+v", e, stats, s)
+		}
+	}
+}
+
+func TestEncodingTranscode(t *testing.T) {
+	stats := testEncodingStats()
+
+	payload, err := Marshal(MsgPack, &stats)
+	if err != nil {
+		t.Fatalf("Unable to marshal stats: %v", err)
+	}
+
+	payload, err = Transcode(payload, YAML)
+	if err != nil {
+		t.Fatalf("Unable to transcode stats: %v", err)
+	}
+
+	var s Stat
+	err = yaml.Unmarshal(payload, &s)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal transcoded stats: %v", err)
+	}
+
+	if !reflect.DeepEqual(stats, s) {
+		t.Errorf("Transcoded stats do not match: %+v != %+v", stats, s)
+	}
+}
+
+func TestEncodingJSON(t *testing.T) {
+	stats := testEncodingStats()
+
+	payload, err := Marshal(JSON, &stats)
+	if err != nil {
+		t.Fatalf("Unable to marshal stats: %v", err)
+	}
+
+	var generic map[string]interface{}
+	err = json.Unmarshal(payload, &generic)
+	if err != nil {
+		t.Fatalf("Invalid JSON stats %s: %v", payload, err)
+	}
+
+	if generic["node_uuid"] != stats.NodeUUID {
+		t.Errorf("JSON stats do not use the YAML field names: %s", payload)
+	}
+
+	for _, e := range []Encoding{YAML, MsgPack} {
+		transcoded, err := Transcode(payload, e)
+		if err != nil {
+			t.Fatalf("Unable to transcode JSON stats to %s: %v", e, err)
+		}
+
+		var s Stat
+		err = Unmarshal(transcoded, &s)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal transcoded %s stats: %v", e, err)
+		}
+
+		if !reflect.DeepEqual(stats, s) {
+			t.Errorf("Transcoded %s stats do not match: %+v != %+v", e, stats, s)
+		}
+
+		payload, err = Transcode(transcoded, JSON)
+		if err != nil {
+			t.Fatalf("Unable to transcode %s stats to JSON: %v", e, err)
+		}
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	for _, e := range []Encoding{YAML, MsgPack, JSON} {
+		p, err := ParseEncoding(e.String())
+		if err != nil || p != e {
+			t.Errorf("Unable to parse %s", e)
+		}
+	}
+
+	_, err := ParseEncoding("protobuf")
+	if err == nil {
+		t.Errorf("protobuf encoding should not be supported")
+	}
+}
@@ -0,0 +1,41 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// GroupCmd identifies a group of instances on a single node.  It is the
+// payload of both the STOPGROUP and DELETEGROUP commands.
+type GroupCmd struct {
+	// WorkloadAgentUUID identifies the node on which the instances of
+	// the group are running.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// GroupID identifies the group.  It matches the group_id field of
+	// the START payloads of the instances that belong to the group.
+	GroupID string `yaml:"group_id"`
+}
+
+// StopGroup represents the unmarshalled version of the contents of a SSNTP
+// STOPGROUP payload.
+type StopGroup struct {
+	StopGroup GroupCmd `yaml:"stop_group"`
+}
+
+// DeleteGroup represents the unmarshalled version of the contents of a SSNTP
+// DELETEGROUP payload.
+type DeleteGroup struct {
+	DeleteGroup GroupCmd `yaml:"delete_group"`
+}
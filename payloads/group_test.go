@@ -0,0 +1,64 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const groupAgentUUID = "64803ffa-fb47-49fa-8191-15d2c34e4dd3"
+const groupID = "web-frontend"
+const stopGroupYaml = "" +
+	"stop_group:\n" +
+	"  workload_agent_uuid: " + groupAgentUUID + "\n" +
+	"  group_id: " + groupID + "\n"
+const deleteGroupYaml = "" +
+	"delete_group:\n" +
+	"  workload_agent_uuid: " + groupAgentUUID + "\n" +
+	"  group_id: " + groupID + "\n"
+
+func TestStopGroupMarshal(t *testing.T) {
+	var cmd StopGroup
+	cmd.StopGroup.WorkloadAgentUUID = groupAgentUUID
+	cmd.StopGroup.GroupID = groupID
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != stopGroupYaml {
+		t.Errorf("STOPGROUP marshalling failed\n[%s]\n vs\n[%s]", string(y), stopGroupYaml)
+	}
+}
+
+func TestDeleteGroupUnmarshal(t *testing.T) {
+	var cmd DeleteGroup
+	err := yaml.Unmarshal([]byte(deleteGroupYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.DeleteGroup.WorkloadAgentUUID != groupAgentUUID {
+		t.Errorf("Wrong Agent UUID field [%s]", cmd.DeleteGroup.WorkloadAgentUUID)
+	}
+
+	if cmd.DeleteGroup.GroupID != groupID {
+		t.Errorf("Wrong Group ID field [%s]", cmd.DeleteGroup.GroupID)
+	}
+}
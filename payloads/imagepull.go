@@ -0,0 +1,62 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ImagePullProgressEvent reports how far a node got in pulling the docker
+// image of an instance it is starting.
+type ImagePullProgressEvent struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// Image is the name of the docker image being pulled.
+	Image string `yaml:"image"`
+
+	// Number of layers of the image known so far, and number of them
+	// already pulled or present on the node.
+	Layers     int `yaml:"layers"`
+	LayersDone int `yaml:"layers_done"`
+
+	// Bytes downloaded so far, and total size of the layers being
+	// downloaded, 0 until the registry reports it.
+	DownloadedBytes int64 `yaml:"downloaded_bytes"`
+	TotalBytes      int64 `yaml:"total_bytes"`
+
+	// Done is set in the last event of a pull, whether it succeeded or
+	// not.
+	Done bool `yaml:"done,omitempty"`
+}
+
+// EventImagePullProgress represents the unmarshalled version of the contents
+// of an SSNTP ssntp.ImagePullProgress event.  This event is sent periodically
+// by ciao-launcher while it pulls the docker image of an instance, so that a
+// slow pull is not mistaken for a hung START command.
+type EventImagePullProgress struct {
+	PullProgress ImagePullProgressEvent `yaml:"image_pull_progress"`
+}
+
+// Validate checks that the instance and its image are identified.
+func (e *EventImagePullProgress) Validate() error {
+	var errs ValidationError
+	ev := &e.PullProgress
+
+	errs.required("image_pull_progress.instance_uuid", ev.InstanceUUID)
+	errs.required("image_pull_progress.image", ev.Image)
+	if ev.LayersDone > ev.Layers {
+		errs.add("image_pull_progress.layers_done", "%d layers out of %d done", ev.LayersDone, ev.Layers)
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,98 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const imagePullYaml = "" +
+	"image_pull_progress:\n" +
+	"  instance_uuid: " + insDelUUID + "\n" +
+	"  image: registry.example.com/app:1.0\n" +
+	"  layers: 4\n" +
+	"  layers_done: 1\n" +
+	"  downloaded_bytes: 1048576\n" +
+	"  total_bytes: 4194304\n"
+
+func TestImagePullProgressUnmarshal(t *testing.T) {
+	var pull EventImagePullProgress
+	err := yaml.Unmarshal([]byte(imagePullYaml), &pull)
+	if err != nil {
+		t.Error(err)
+	}
+
+	p := &pull.PullProgress
+	if p.InstanceUUID != insDelUUID || p.Image != "registry.example.com/app:1.0" {
+		t.Errorf("Wrong instance or image [%s] [%s]", p.InstanceUUID, p.Image)
+	}
+
+	if p.Layers != 4 || p.LayersDone != 1 || p.DownloadedBytes != 1048576 ||
+		p.TotalBytes != 4194304 || p.Done {
+		t.Errorf("Wrong progress fields %+v", *p)
+	}
+
+	if err = pull.Validate(); err != nil {
+		t.Errorf("Valid event rejected: %v", err)
+	}
+}
+
+func TestImagePullProgressMarshal(t *testing.T) {
+	var pull EventImagePullProgress
+
+	pull.PullProgress = ImagePullProgressEvent{
+		InstanceUUID:    insDelUUID,
+		Image:           "registry.example.com/app:1.0",
+		Layers:          4,
+		LayersDone:      1,
+		DownloadedBytes: 1048576,
+		TotalBytes:      4194304,
+	}
+
+	y, err := yaml.Marshal(&pull)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != imagePullYaml {
+		t.Errorf("ImagePullProgress marshalling failed\n[%s]\n vs\n[%s]", string(y), imagePullYaml)
+	}
+}
+
+func TestImagePullProgressValidate(t *testing.T) {
+	pull := EventImagePullProgress{
+		PullProgress: ImagePullProgressEvent{
+			InstanceUUID: insDelUUID,
+			Layers:       1,
+			LayersDone:   2,
+		},
+	}
+
+	err := pull.Validate()
+	if err == nil {
+		t.Fatal("Invalid event accepted")
+	}
+
+	for _, field := range []string{"image_pull_progress.image", "image_pull_progress.layers_done"} {
+		if !strings.Contains(err.Error(), field) {
+			t.Errorf("%s not reported in %v", field, err)
+		}
+	}
+}
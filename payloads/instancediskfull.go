@@ -0,0 +1,55 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// InstanceDiskFullEvent reports that the rootfs of an instance uses all the
+// node disk space allocated to it.  The instance keeps running, but its
+// writes fail until it frees some space.
+type InstanceDiskFullEvent struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// UsageMB is the node disk space used by the rootfs of the instance.
+	UsageMB int `yaml:"usage_mb"`
+
+	// LimitMB is the node disk space allocated to the rootfs of the
+	// instance.
+	LimitMB int `yaml:"limit_mb"`
+}
+
+// EventInstanceDiskFull represents the unmarshalled version of the contents
+// of an SSNTP ssntp.InstanceDiskFull event.  This event is sent by
+// ciao-launcher when one of its instances hits its disk limit.
+type EventInstanceDiskFull struct {
+	InstanceDiskFull InstanceDiskFullEvent `yaml:"instance_disk_full"`
+}
+
+// Validate checks that the instance is identified and that it has a disk
+// limit.
+func (e *EventInstanceDiskFull) Validate() error {
+	var errs ValidationError
+	ev := &e.InstanceDiskFull
+
+	errs.required("instance_disk_full.instance_uuid", ev.InstanceUUID)
+	if ev.LimitMB < 1 {
+		errs.add("instance_disk_full.limit_mb", "%d MB", ev.LimitMB)
+	}
+	if ev.UsageMB < 0 {
+		errs.add("instance_disk_full.usage_mb", "%d MB", ev.UsageMB)
+	}
+
+	return errs.err()
+}
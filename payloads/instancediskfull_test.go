@@ -0,0 +1,74 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const insDiskFullYaml = "" +
+	"instance_disk_full:\n" +
+	"  instance_uuid: " + insDelUUID + "\n" +
+	"  usage_mb: 2050\n" +
+	"  limit_mb: 2048\n"
+
+func TestInstanceDiskFullUnmarshal(t *testing.T) {
+	var full EventInstanceDiskFull
+	err := yaml.Unmarshal([]byte(insDiskFullYaml), &full)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ev := &full.InstanceDiskFull
+	if ev.InstanceUUID != insDelUUID {
+		t.Errorf("Wrong instance UUID field [%s]", ev.InstanceUUID)
+	}
+
+	if ev.UsageMB != 2050 || ev.LimitMB != 2048 {
+		t.Errorf("Wrong disk fields %+v", *ev)
+	}
+
+	if err = full.Validate(); err != nil {
+		t.Errorf("Valid event rejected: %v", err)
+	}
+}
+
+func TestInstanceDiskFullMarshal(t *testing.T) {
+	var full EventInstanceDiskFull
+
+	full.InstanceDiskFull = InstanceDiskFullEvent{
+		InstanceUUID: insDelUUID,
+		UsageMB:      2050,
+		LimitMB:      2048,
+	}
+
+	y, err := yaml.Marshal(&full)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != insDiskFullYaml {
+		t.Errorf("InstanceDiskFull marshalling failed\n[%s]\n vs\n[%s]", string(y), insDiskFullYaml)
+	}
+
+	full.InstanceDiskFull.LimitMB = 0
+	if full.Validate() == nil {
+		t.Errorf("Event without disk limit accepted")
+	}
+}
@@ -0,0 +1,38 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// InstanceReadyEvent contains the UUID of an instance that has just become
+// usable, together with the time it took to boot.
+type InstanceReadyEvent struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// Time in milliseconds between the instance being started, by a
+	// START or a RESTART command, and it being detected as ready.  Will
+	// be -1 if launcher does not know when the instance was started,
+	// e.g., because launcher was itself restarted while the instance
+	// was booting.
+	BootDurationMS int `yaml:"boot_duration_ms"`
+}
+
+// EventInstanceReady represents the unmarshalled version of the contents of
+// an SSNTP ssntp.InstanceReady event. This event is sent by ciao-launcher
+// when it detects that a running instance's guest agent or SSH server is
+// answering, i.e., that the instance is not only running but usable.
+type EventInstanceReady struct {
+	InstanceReady InstanceReadyEvent `yaml:"instance_ready"`
+}
@@ -0,0 +1,59 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const insReadyYaml = "" +
+	"instance_ready:\n" +
+	"  instance_uuid: " + insDelUUID + "\n" +
+	"  boot_duration_ms: 12345\n"
+
+func TestInstanceReadyUnmarshal(t *testing.T) {
+	var insReady EventInstanceReady
+	err := yaml.Unmarshal([]byte(insReadyYaml), &insReady)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if insReady.InstanceReady.InstanceUUID != insDelUUID {
+		t.Errorf("Wrong instance UUID field [%s]", insReady.InstanceReady.InstanceUUID)
+	}
+
+	if insReady.InstanceReady.BootDurationMS != 12345 {
+		t.Errorf("Wrong boot duration field [%d]", insReady.InstanceReady.BootDurationMS)
+	}
+}
+
+func TestInstanceReadyMarshal(t *testing.T) {
+	var insReady EventInstanceReady
+
+	insReady.InstanceReady.InstanceUUID = insDelUUID
+	insReady.InstanceReady.BootDurationMS = 12345
+
+	y, err := yaml.Marshal(&insReady)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != insReadyYaml {
+		t.Errorf("InstanceReady marshalling failed\n[%s]\n vs\n[%s]", string(y), insReadyYaml)
+	}
+}
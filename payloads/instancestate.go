@@ -0,0 +1,85 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+const (
+	// Crashed indicates that an instance stopped running although it
+	// was not asked to, e.g., because its VM or container process died.
+	// It is only reported in InstanceStateChanged events.
+	Crashed = "crashed"
+
+	// Paused indicates that the execution of a running instance has been
+	// suspended.  It is only reported in InstanceStateChanged events and
+	// is not currently used by ciao-launcher.
+	Paused = "paused"
+
+	// Unhealthy indicates that an instance is running but that its health
+	// check is failing.  It is reported in STATS commands and
+	// InstanceStateChanged events from payload version 33.
+	Unhealthy = "unhealthy"
+)
+
+// InstanceStateChangedEvent describes the transition of an instance from one
+// state to another.  States are Pending, Running, Unhealthy, Exited, Paused
+// or Crashed.
+type InstanceStateChangedEvent struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// NodeUUID is the UUID of the agent running the instance.
+	NodeUUID string `yaml:"node_uuid"`
+
+	// PreviousState is the state previously reported for the instance.
+	// It is empty when the instance has just been created.
+	PreviousState string `yaml:"previous_state,omitempty"`
+
+	// State is the new state of the instance.
+	State string `yaml:"state"`
+}
+
+// EventInstanceStateChanged represents the unmarshalled version of the
+// contents of an SSNTP ssntp.InstanceStateChanged event.  This event is sent
+// by ciao-launcher each time the state of one of its instances changes, so
+// that controllers do not have to wait for the next STATS command to notice.
+type EventInstanceStateChanged struct {
+	StateChanged InstanceStateChangedEvent `yaml:"instance_state_changed"`
+}
+
+func validInstanceState(state string) bool {
+	switch state {
+	case Pending, Running, Unhealthy, Exited, Paused, Crashed:
+		return true
+	}
+	return false
+}
+
+// Validate checks that the instance and its node are identified and that
+// the states are known.
+func (e *EventInstanceStateChanged) Validate() error {
+	var errs ValidationError
+	ev := &e.StateChanged
+
+	errs.required("instance_state_changed.instance_uuid", ev.InstanceUUID)
+	errs.required("instance_state_changed.node_uuid", ev.NodeUUID)
+	if !validInstanceState(ev.State) {
+		errs.add("instance_state_changed.state", "unknown state %q", ev.State)
+	}
+	if ev.PreviousState != "" && !validInstanceState(ev.PreviousState) {
+		errs.add("instance_state_changed.previous_state", "unknown state %q", ev.PreviousState)
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,85 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const insStateChangedYaml = "" +
+	"instance_state_changed:\n" +
+	"  instance_uuid: " + insDelUUID + "\n" +
+	"  node_uuid: " + agentUUID + "\n" +
+	"  previous_state: running\n" +
+	"  state: crashed\n"
+
+func TestInstanceStateChangedUnmarshal(t *testing.T) {
+	var event EventInstanceStateChanged
+	err := yaml.Unmarshal([]byte(insStateChangedYaml), &event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ev := event.StateChanged
+	if ev.InstanceUUID != insDelUUID || ev.NodeUUID != agentUUID {
+		t.Errorf("Wrong UUID fields %+v", ev)
+	}
+
+	if ev.PreviousState != Running || ev.State != Crashed {
+		t.Errorf("Wrong state fields %+v", ev)
+	}
+
+	if err := Validate(&event); err != nil {
+		t.Errorf("Valid InstanceStateChanged payload rejected: %v", err)
+	}
+}
+
+func TestInstanceStateChangedMarshal(t *testing.T) {
+	var event EventInstanceStateChanged
+
+	event.StateChanged.InstanceUUID = insDelUUID
+	event.StateChanged.NodeUUID = agentUUID
+	event.StateChanged.PreviousState = Running
+	event.StateChanged.State = Crashed
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != insStateChangedYaml {
+		t.Errorf("InstanceStateChanged marshalling failed\n[%s]\n vs\n[%s]", string(y), insStateChangedYaml)
+	}
+}
+
+func TestValidateInstanceStateChanged(t *testing.T) {
+	var event EventInstanceStateChanged
+	event.StateChanged.PreviousState = "wibble"
+
+	fields := testFields(Validate(&event))
+	for _, f := range []string{
+		"instance_state_changed.instance_uuid",
+		"instance_state_changed.node_uuid",
+		"instance_state_changed.state",
+		"instance_state_changed.previous_state",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// InstanceUnhealthyEvent reports that the health check of a running instance
+// failed enough times in a row for the instance to be unhealthy.
+type InstanceUnhealthyEvent struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// FailingStreak is the number of consecutive health checks that
+	// failed.
+	FailingStreak int `yaml:"failing_streak"`
+
+	// Output is the output of the last failed check, truncated to a few
+	// hundred bytes.
+	Output string `yaml:"output,omitempty"`
+
+	// Restarting is set if the agent restarts the instance, as requested
+	// by its restart policy.
+	Restarting bool `yaml:"restarting,omitempty"`
+}
+
+// EventInstanceUnhealthy represents the unmarshalled version of the contents
+// of an SSNTP ssntp.InstanceUnhealthy event.  This event is sent by
+// ciao-launcher when the health check of one of its instances starts
+// failing.
+type EventInstanceUnhealthy struct {
+	InstanceUnhealthy InstanceUnhealthyEvent `yaml:"instance_unhealthy"`
+}
+
+// Validate checks that the instance is identified and that at least one
+// health check failed.
+func (e *EventInstanceUnhealthy) Validate() error {
+	var errs ValidationError
+	ev := &e.InstanceUnhealthy
+
+	errs.required("instance_unhealthy.instance_uuid", ev.InstanceUUID)
+	if ev.FailingStreak < 1 {
+		errs.add("instance_unhealthy.failing_streak", "%d failed checks", ev.FailingStreak)
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,76 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const insUnhealthyYaml = "" +
+	"instance_unhealthy:\n" +
+	"  instance_uuid: " + insDelUUID + "\n" +
+	"  failing_streak: 3\n" +
+	"  output: connection refused\n" +
+	"  restarting: true\n"
+
+func TestInstanceUnhealthyUnmarshal(t *testing.T) {
+	var unhealthy EventInstanceUnhealthy
+	err := yaml.Unmarshal([]byte(insUnhealthyYaml), &unhealthy)
+	if err != nil {
+		t.Error(err)
+	}
+
+	ev := &unhealthy.InstanceUnhealthy
+	if ev.InstanceUUID != insDelUUID {
+		t.Errorf("Wrong instance UUID field [%s]", ev.InstanceUUID)
+	}
+
+	if ev.FailingStreak != 3 || ev.Output != "connection refused" || !ev.Restarting {
+		t.Errorf("Wrong health fields %+v", *ev)
+	}
+
+	if err = unhealthy.Validate(); err != nil {
+		t.Errorf("Valid event rejected: %v", err)
+	}
+}
+
+func TestInstanceUnhealthyMarshal(t *testing.T) {
+	var unhealthy EventInstanceUnhealthy
+
+	unhealthy.InstanceUnhealthy = InstanceUnhealthyEvent{
+		InstanceUUID:  insDelUUID,
+		FailingStreak: 3,
+		Output:        "connection refused",
+		Restarting:    true,
+	}
+
+	y, err := yaml.Marshal(&unhealthy)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != insUnhealthyYaml {
+		t.Errorf("InstanceUnhealthy marshalling failed\n[%s]\n vs\n[%s]", string(y), insUnhealthyYaml)
+	}
+
+	unhealthy.InstanceUnhealthy.FailingStreak = 0
+	if unhealthy.Validate() == nil {
+		t.Errorf("Event without failed checks accepted")
+	}
+}
@@ -0,0 +1,36 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ErrorInvalidPayload represents the unmarshalled version of the contents
+// of a SSNTP ERROR frame whose type is set to ssntp.InvalidPayload.
+// It describes the frame whose payload could not be unmarshalled or was
+// found invalid, and why.
+type ErrorInvalidPayload struct {
+	// Type is the SSNTP type of the rejected frame, e.g., COMMAND.
+	Type string `yaml:"type"`
+
+	// Operand is the SSNTP operand of the rejected frame, e.g., START.
+	Operand string `yaml:"operand"`
+
+	// InstanceUUID is the UUID of the instance the rejected frame
+	// applies to, if it could be determined.
+	InstanceUUID string `yaml:"instance_uuid,omitempty"`
+
+	// Errors lists the invalid payload fields.
+	Errors []FieldError `yaml:"errors"`
+}
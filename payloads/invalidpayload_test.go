@@ -0,0 +1,72 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestInvalidPayloadUnmarshal(t *testing.T) {
+	invalidYaml := `type: COMMAND
+operand: START
+instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+errors:
+- field: start.requested_resources
+  reason: no mem_mb resource
+- reason: bad yaml
+`
+	var error ErrorInvalidPayload
+	err := yaml.Unmarshal([]byte(invalidYaml), &error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if error.Type != "COMMAND" || error.Operand != "START" {
+		t.Error("Wrong Type or Operand field")
+	}
+
+	if error.InstanceUUID != "3390740c-dce9-48d6-b83a-a717417072ce" {
+		t.Error("Wrong InstanceUUID field")
+	}
+
+	if len(error.Errors) != 2 {
+		t.Fatalf("Wrong Errors field %v", error.Errors)
+	}
+
+	if error.Errors[0].Field != "start.requested_resources" || error.Errors[1].Field != "" {
+		t.Errorf("Wrong Errors field %v", error.Errors)
+	}
+}
+
+func TestInvalidPayloadMarshal(t *testing.T) {
+	error := ErrorInvalidPayload{
+		Type:    "STATUS",
+		Operand: "READY",
+		Errors:  []FieldError{{Field: "node_uuid", Reason: "is required"}},
+	}
+
+	y, err := yaml.Marshal(&error)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != "type: STATUS\noperand: READY\nerrors:\n- field: node_uuid\n  reason: is required\n" {
+		t.Errorf("Wrong InvalidPayload payload %s", y)
+	}
+}
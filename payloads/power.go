@@ -0,0 +1,40 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// PowerDownCmd contains the information needed by a CN Agent to power its
+// node down.
+type PowerDownCmd struct {
+	// WorkloadAgentUUID identifies the node to power down.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+}
+
+// PowerDown represents the unmarshalled version of the contents of a SSNTP
+// POWERDOWN payload.  The scheduler sends it to the compute nodes that
+// have been idle for long enough.
+type PowerDown struct {
+	PowerDown PowerDownCmd `yaml:"power_down"`
+}
+
+// Validate checks that the node to power down is identified.
+func (p *PowerDown) Validate() error {
+	var errs ValidationError
+
+	errs.required("power_down.workload_agent_uuid", p.PowerDown.WorkloadAgentUUID)
+
+	return errs.err()
+}
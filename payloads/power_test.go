@@ -0,0 +1,63 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const powerDownYaml = "" +
+	"power_down:\n" +
+	"  workload_agent_uuid: " + agentUUID + "\n"
+
+func TestPowerDownUnmarshal(t *testing.T) {
+	var cmd PowerDown
+	err := yaml.Unmarshal([]byte(powerDownYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.PowerDown.WorkloadAgentUUID != agentUUID {
+		t.Errorf("Wrong agent UUID %s", cmd.PowerDown.WorkloadAgentUUID)
+	}
+
+	if err := Validate(&cmd); err != nil {
+		t.Errorf("Valid POWERDOWN payload rejected: %v", err)
+	}
+}
+
+func TestPowerDownMarshal(t *testing.T) {
+	var cmd PowerDown
+	cmd.PowerDown.WorkloadAgentUUID = agentUUID
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != powerDownYaml {
+		t.Errorf("POWERDOWN marshalling failed\n[%s]\n vs\n[%s]", string(y), powerDownYaml)
+	}
+}
+
+func TestValidatePowerDown(t *testing.T) {
+	fields := testFields(Validate(&PowerDown{}))
+	if !fields["power_down.workload_agent_uuid"] {
+		t.Errorf("power_down.workload_agent_uuid not reported as invalid")
+	}
+}
@@ -0,0 +1,39 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// PrefetchCmd contains the information needed by a launcher to download a
+// backing image into its local image cache.
+type PrefetchCmd struct {
+	// WorkloadAgentUUID identifies the node that should download the
+	// image.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// ImageUUID is the UUID of the backing image to download.
+	ImageUUID string `yaml:"image_uuid"`
+
+	// Checksum is the hex encoded SHA256 checksum of the image.  If
+	// specified, the launcher will discard the downloaded image if its
+	// checksum does not match.
+	Checksum string `yaml:"checksum,omitempty"`
+}
+
+// Prefetch represents the unmarshalled version of the contents of a SSNTP
+// PREFETCH payload.
+type Prefetch struct {
+	Prefetch PrefetchCmd `yaml:"prefetch"`
+}
@@ -0,0 +1,67 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const prefetchAgentUUID = "64803ffa-fb47-49fa-8191-15d2c34e4dd3"
+const prefetchImageUUID = "b286cd45-7d0c-4525-a140-4db6c95e41fa"
+const prefetchChecksum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+const prefetchYaml = "" +
+	"prefetch:\n" +
+	"  workload_agent_uuid: " + prefetchAgentUUID + "\n" +
+	"  image_uuid: " + prefetchImageUUID + "\n" +
+	"  checksum: " + prefetchChecksum + "\n"
+
+func TestPrefetchMarshal(t *testing.T) {
+	var cmd Prefetch
+	cmd.Prefetch.WorkloadAgentUUID = prefetchAgentUUID
+	cmd.Prefetch.ImageUUID = prefetchImageUUID
+	cmd.Prefetch.Checksum = prefetchChecksum
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != prefetchYaml {
+		t.Errorf("PREFETCH marshalling failed\n[%s]\n vs\n[%s]", string(y), prefetchYaml)
+	}
+}
+
+func TestPrefetchUnmarshal(t *testing.T) {
+	var cmd Prefetch
+	err := yaml.Unmarshal([]byte(prefetchYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.Prefetch.WorkloadAgentUUID != prefetchAgentUUID {
+		t.Errorf("Wrong Agent UUID field [%s]", cmd.Prefetch.WorkloadAgentUUID)
+	}
+
+	if cmd.Prefetch.ImageUUID != prefetchImageUUID {
+		t.Errorf("Wrong Image UUID field [%s]", cmd.Prefetch.ImageUUID)
+	}
+
+	if cmd.Prefetch.Checksum != prefetchChecksum {
+		t.Errorf("Wrong Checksum field [%s]", cmd.Prefetch.Checksum)
+	}
+}
@@ -22,6 +22,12 @@ type PublicIPEvent struct {
 	InstanceUUID     string `yaml:"instance_uuid"`
 	PublicIP         string `yaml:"public_ip"`
 	PrivateIP        string `yaml:"private_ip"`
+
+	// PublicIPv6 and PrivateIPv6 are the IPv6 addresses of the
+	// instance on dual-stack networks.  Either IPv6 address may be given
+	// without its IPv4 counterpart.
+	PublicIPv6  string `yaml:"public_ipv6,omitempty" since:"17"`
+	PrivateIPv6 string `yaml:"private_ipv6,omitempty" since:"17"`
 }
 
 // EventPublicIPAssigned is reserved for future use.
@@ -0,0 +1,78 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// PublicIPPool describes the pool of public IP addresses a concentrator
+// assigns to the instances of its tenant.
+type PublicIPPool struct {
+	// ConcentratorUUID identifies the CNCI the pool belongs to.
+	ConcentratorUUID string `yaml:"concentrator_uuid"`
+
+	// Size is the number of addresses in the pool.  A pool of size 0
+	// is no longer tracked.
+	Size int `yaml:"size"`
+
+	// Assigned is the number of addresses of the pool currently
+	// assigned to instances.
+	Assigned int `yaml:"assigned"`
+}
+
+// EventPublicIPPoolRegistered represents the unmarshalled version of the
+// contents of a SSNTP PublicIPPoolRegistered event.  Controllers or CNCIs
+// send it to the scheduler to register, resize or resync the pool of public
+// IP addresses of a concentrator.
+type EventPublicIPPoolRegistered struct {
+	Pool PublicIPPool `yaml:"public_ip_pool_registered"`
+}
+
+// Validate checks that the pool is identified and that no more addresses
+// than it holds are assigned.
+func (e *EventPublicIPPoolRegistered) Validate() error {
+	var errs ValidationError
+
+	p := &e.Pool
+	errs.required("public_ip_pool_registered.concentrator_uuid", p.ConcentratorUUID)
+
+	if p.Size < 0 {
+		errs.add("public_ip_pool_registered.size", "%d must be >= 0", p.Size)
+	}
+
+	if p.Assigned < 0 || p.Assigned > p.Size {
+		errs.add("public_ip_pool_registered.assigned", "%d must be between 0 and size (%d)", p.Assigned, p.Size)
+	}
+
+	return errs.err()
+}
+
+// EventPublicIPReleased represents the unmarshalled version of the contents
+// of a SSNTP PublicIPReleased event.  CNCIs send it when they release a
+// public IP address, returning it to the pool of their concentrator.
+type EventPublicIPReleased struct {
+	ReleasedIP PublicIPEvent `yaml:"public_ip_released"`
+}
+
+// Validate checks that the concentrator the address returns to is
+// identified, and that the IPv6 addresses, if any, are IPv6 ones.
+func (e *EventPublicIPReleased) Validate() error {
+	var errs ValidationError
+
+	errs.required("public_ip_released.concentrator_uuid", e.ReleasedIP.ConcentratorUUID)
+	errs.ipv6("public_ip_released.public_ipv6", e.ReleasedIP.PublicIPv6)
+	errs.ipv6("public_ip_released.private_ipv6", e.ReleasedIP.PrivateIPv6)
+
+	return errs.err()
+}
@@ -0,0 +1,107 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const publicIPPoolYaml = "" +
+	"public_ip_pool_registered:\n" +
+	"  concentrator_uuid: " + cnciUUID + "\n" +
+	"  size: 16\n" +
+	"  assigned: 3\n"
+
+const releasedIPYaml = "" +
+	"public_ip_released:\n" +
+	"  concentrator_uuid: " + cnciUUID + "\n" +
+	"  instance_uuid: " + instanceUUID + "\n" +
+	"  public_ip: " + instancePublicIP + "\n" +
+	"  private_ip: " + instancePrivateIP + "\n"
+
+func TestPublicIPPoolRegisteredUnmarshal(t *testing.T) {
+	var event EventPublicIPPoolRegistered
+	err := yaml.Unmarshal([]byte(publicIPPoolYaml), &event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if event.Pool.ConcentratorUUID != cnciUUID || event.Pool.Size != 16 || event.Pool.Assigned != 3 {
+		t.Errorf("Wrong PublicIPPoolRegistered fields %+v", event.Pool)
+	}
+
+	if err := Validate(&event); err != nil {
+		t.Errorf("Valid PublicIPPoolRegistered payload rejected: %v", err)
+	}
+}
+
+func TestPublicIPPoolRegisteredMarshal(t *testing.T) {
+	event := EventPublicIPPoolRegistered{
+		Pool: PublicIPPool{
+			ConcentratorUUID: cnciUUID,
+			Size:             16,
+			Assigned:         3,
+		},
+	}
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != publicIPPoolYaml {
+		t.Errorf("PublicIPPoolRegistered marshalling failed\n[%s]\n vs\n[%s]", string(y), publicIPPoolYaml)
+	}
+}
+
+func TestValidatePublicIPPoolRegistered(t *testing.T) {
+	event := EventPublicIPPoolRegistered{Pool: PublicIPPool{Size: 4, Assigned: 5}}
+
+	fields := testFields(Validate(&event))
+	for _, f := range []string{
+		"public_ip_pool_registered.concentrator_uuid",
+		"public_ip_pool_registered.assigned",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+}
+
+func TestPublicIPReleasedUnmarshal(t *testing.T) {
+	var event EventPublicIPReleased
+	err := yaml.Unmarshal([]byte(releasedIPYaml), &event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if event.ReleasedIP.ConcentratorUUID != cnciUUID || event.ReleasedIP.PublicIP != instancePublicIP {
+		t.Errorf("Wrong PublicIPReleased fields %+v", event.ReleasedIP)
+	}
+
+	if err := Validate(&EventPublicIPReleased{}); err == nil {
+		t.Errorf("PublicIPReleased payload without concentrator accepted")
+	}
+
+	event.ReleasedIP.PublicIPv6 = "2001:db8::10"
+	event.ReleasedIP.PrivateIPv6 = instancePrivateIP
+	fields := testFields(Validate(&event))
+	if fields["public_ip_released.public_ipv6"] || !fields["public_ip_released.private_ipv6"] {
+		t.Errorf("PublicIPReleased IPv6 addresses not validated: %v", fields)
+	}
+}
@@ -16,6 +16,19 @@
 
 package payloads
 
+// HugepageStat contains information about the pool of hugepages of a given
+// size on a CN or NN.
+type HugepageStat struct {
+	// SizeKB is the size of the hugepages in this pool in KB
+	SizeKB int `yaml:"size_kb"`
+
+	// Total number of hugepages of this size configured on the node
+	Total int `yaml:"total"`
+
+	// Number of hugepages of this size that are currently free
+	Free int `yaml:"free"`
+}
+
 // Ready represents the unmarshalled version of the contents of an SSNTP READY
 // payload.  The structure contains information about the state of an NN or a CN
 // on which ciao-launcher is running.
@@ -44,6 +57,86 @@ type Ready struct {
 	// Number of CPUs present in the CN/NN.  Derived from the number of
 	// cpu[0-9]+ entries in /proc/stat.
 	CpusOnline int `yaml:"cpus_online"`
+
+	// Hugepages contains one entry for each hugepage size supported by
+	// the CN/NN.  Derived from /sys/kernel/mm/hugepages.
+	Hugepages []HugepageStat `yaml:"hugepages,omitempty" since:"2"`
+
+	// Number of SR-IOV virtual functions present on the CN/NN.
+	SRIOVVFsTotal int `yaml:"sriov_vfs_total" since:"2"`
+
+	// Number of SR-IOV virtual functions not currently assigned to an
+	// instance.
+	SRIOVVFsAvailable int `yaml:"sriov_vfs_available" since:"2"`
+
+	// Number of GPUs present on the CN/NN that can be passed through to
+	// an instance.
+	GPUsTotal int `yaml:"gpus_total" since:"2"`
+
+	// Number of GPUs not currently assigned to an instance.
+	GPUsAvailable int `yaml:"gpus_available" since:"2"`
+
+	// Number of host CPU cores the CN/NN can dedicate to instances.
+	DedicatedCoresTotal int `yaml:"dedicated_cores_total" since:"3"`
+
+	// Number of dedicated CPU cores not currently assigned to an
+	// instance.
+	DedicatedCoresAvailable int `yaml:"dedicated_cores_available" since:"3"`
+
+	// Disk IOPS the CN/NN can guarantee to its instances.  Will be -1 if
+	// the capacity of the node disks is not known.
+	DiskIOPSTotal int `yaml:"disk_iops_total" since:"3"`
+
+	// Disk IOPS not currently reserved by an instance.
+	DiskIOPSAvailable int `yaml:"disk_iops_available" since:"3"`
+
+	// Network bandwidth of the CN/NN in kbps, in each direction.  Will
+	// be -1 if the bandwidth of the node is not known.
+	NetBandwidthKbps int `yaml:"net_bandwidth_kbps" since:"3"`
+
+	// Ingress bandwidth, in kbps, not currently reserved by an instance.
+	NetIngressKbpsAvailable int `yaml:"net_ingress_kbps_available" since:"3"`
+
+	// Egress bandwidth, in kbps, not currently reserved by an instance.
+	NetEgressKbpsAvailable int `yaml:"net_egress_kbps_available" since:"3"`
+
+	// Maximum number of CNCIs an NN can run.  Will be -1 on CNs and on
+	// NNs that do not limit their number of CNCIs.
+	CNCIsTotal int `yaml:"cncis_total" since:"14"`
+
+	// Number of CNCIs the NN can still start.
+	CNCIsAvailable int `yaml:"cncis_available" since:"14"`
+
+	// Bandwidth, in kbps, an NN can route for its CNCIs.  Will be -1 on
+	// CNs and on NNs that do not know their CNCI bandwidth.
+	CNCIBandwidthKbps int `yaml:"cnci_bandwidth_kbps" since:"14"`
+
+	// CNCI bandwidth, in kbps, not currently reserved by a CNCI.
+	CNCIBandwidthKbpsAvailable int `yaml:"cnci_bandwidth_kbps_available" since:"14"`
+
+	// Size of the pool of public IP addresses an NN assigns to its
+	// CNCIs.  Will be -1 on CNs and on NNs that do not manage a pool.
+	PublicIPsTotal int `yaml:"public_ips_total" since:"14"`
+
+	// Number of public IP addresses not currently assigned to a CNCI.
+	PublicIPsAvailable int `yaml:"public_ips_available" since:"14"`
+
+	// Power drawn by the CPU packages of the CN/NN in watts, averaged
+	// since the previous sample.  Derived from the RAPL energy counters
+	// in /sys/class/powercap.  Will be -1 if the node does not report it.
+	PowerWatts int `yaml:"power_watts" since:"27"`
+
+	// Temperature of the hottest CPU sensor of the CN/NN in degrees
+	// Celsius.  Derived from /sys/class/hwmon.  Will be -1 if the node
+	// does not report it.
+	CPUTemperatureC int `yaml:"cpu_temperature_c" since:"27"`
+
+	// Memory pressure of the CN/NN, i.e., the percentage of time over the
+	// last 60 seconds some tasks were stalled reclaiming memory or waiting
+	// for it to be swapped in, as reported by /proc/pressure/memory.
+	// Rises before the node runs out of memory.  Will be -1 if the kernel
+	// does not provide pressure stall information.
+	MemPressure float64 `yaml:"mem_pressure" since:"29"`
 }
 
 // Init initialises the Ready structure.
@@ -55,4 +148,25 @@ func (s *Ready) Init() {
 	s.DiskAvailableMB = -1
 	s.Load = -1
 	s.CpusOnline = -1
+	s.Hugepages = nil
+	s.SRIOVVFsTotal = -1
+	s.SRIOVVFsAvailable = -1
+	s.GPUsTotal = -1
+	s.GPUsAvailable = -1
+	s.DedicatedCoresTotal = -1
+	s.DedicatedCoresAvailable = -1
+	s.DiskIOPSTotal = -1
+	s.DiskIOPSAvailable = -1
+	s.NetBandwidthKbps = -1
+	s.NetIngressKbpsAvailable = -1
+	s.NetEgressKbpsAvailable = -1
+	s.CNCIsTotal = -1
+	s.CNCIsAvailable = -1
+	s.CNCIBandwidthKbps = -1
+	s.CNCIBandwidthKbpsAvailable = -1
+	s.PublicIPsTotal = -1
+	s.PublicIPsAvailable = -1
+	s.PowerWatts = -1
+	s.CPUTemperatureC = -1
+	s.MemPressure = -1
 }
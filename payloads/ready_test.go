@@ -72,13 +72,17 @@ load: 1
 	}
 
 	expectedCmd := Ready{
-		NodeUUID:        "2400bce6-ccc8-4a45-b2aa-b5cc3790077b",
-		MemTotalMB:      -1,
-		MemAvailableMB:  -1,
-		DiskTotalMB:     -1,
-		DiskAvailableMB: -1,
-		Load:            1,
-		CpusOnline:      -1,
+		NodeUUID:          "2400bce6-ccc8-4a45-b2aa-b5cc3790077b",
+		MemTotalMB:        -1,
+		MemAvailableMB:    -1,
+		DiskTotalMB:       -1,
+		DiskAvailableMB:   -1,
+		Load:              1,
+		CpusOnline:        -1,
+		SRIOVVFsTotal:     -1,
+		SRIOVVFsAvailable: -1,
+		GPUsTotal:         -1,
+		GPUsAvailable:     -1,
 	}
 	if cmd.NodeUUID != expectedCmd.NodeUUID ||
 		cmd.MemTotalMB != expectedCmd.MemTotalMB ||
@@ -86,9 +90,110 @@ load: 1
 		cmd.DiskTotalMB != expectedCmd.DiskTotalMB ||
 		cmd.DiskAvailableMB != expectedCmd.DiskAvailableMB ||
 		cmd.Load != expectedCmd.Load ||
-		cmd.CpusOnline != expectedCmd.CpusOnline {
+		cmd.CpusOnline != expectedCmd.CpusOnline ||
+		cmd.SRIOVVFsTotal != expectedCmd.SRIOVVFsTotal ||
+		cmd.SRIOVVFsAvailable != expectedCmd.SRIOVVFsAvailable ||
+		cmd.GPUsTotal != expectedCmd.GPUsTotal ||
+		cmd.GPUsAvailable != expectedCmd.GPUsAvailable {
 		t.Error("Unexpected values in Ready")
 	}
 
+	if cmd.DedicatedCoresTotal != -1 || cmd.DedicatedCoresAvailable != -1 ||
+		cmd.DiskIOPSTotal != -1 || cmd.DiskIOPSAvailable != -1 ||
+		cmd.NetBandwidthKbps != -1 || cmd.NetIngressKbpsAvailable != -1 ||
+		cmd.NetEgressKbpsAvailable != -1 {
+		t.Error("Unexpected resource capacities in Ready")
+	}
+
+	if cmd.CNCIsTotal != -1 || cmd.CNCIsAvailable != -1 ||
+		cmd.CNCIBandwidthKbps != -1 || cmd.CNCIBandwidthKbpsAvailable != -1 ||
+		cmd.PublicIPsTotal != -1 || cmd.PublicIPsAvailable != -1 {
+		t.Error("Unexpected network node resources in Ready")
+	}
+
+	if cmd.PowerWatts != -1 || cmd.CPUTemperatureC != -1 {
+		t.Error("Unexpected thermal telemetry in Ready")
+	}
+
+	if cmd.MemPressure != -1 {
+		t.Error("Unexpected memory pressure in Ready")
+	}
+
 	fmt.Println(cmd)
 }
+
+func TestReadyHugepagesUnmarshal(t *testing.T) {
+	readyYaml := `node_uuid: 2400bce6-ccc8-4a45-b2aa-b5cc3790077b
+mem_total_mb: 3896
+mem_available_mb: 3896
+hugepages:
+- size_kb: 2048
+  total: 512
+  free: 256
+- size_kb: 1048576
+  total: 2
+  free: 2
+`
+	var cmd Ready
+	cmd.Init()
+
+	err := yaml.Unmarshal([]byte(readyYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	expectedHugepages := []HugepageStat{
+		{SizeKB: 2048, Total: 512, Free: 256},
+		{SizeKB: 1048576, Total: 2, Free: 2},
+	}
+
+	if len(cmd.Hugepages) != len(expectedHugepages) {
+		t.Fatalf("Expected %d hugepage pools, found %d",
+			len(expectedHugepages), len(cmd.Hugepages))
+	}
+
+	for i := range expectedHugepages {
+		if cmd.Hugepages[i] != expectedHugepages[i] {
+			t.Errorf("Unexpected hugepage pool %v", cmd.Hugepages[i])
+		}
+	}
+}
+
+func TestReadyThermalUnmarshal(t *testing.T) {
+	readyYaml := `node_uuid: 2400bce6-ccc8-4a45-b2aa-b5cc3790077b
+mem_total_mb: 3896
+mem_available_mb: 3896
+power_watts: 182
+cpu_temperature_c: 71
+`
+	var cmd Ready
+	cmd.Init()
+
+	err := yaml.Unmarshal([]byte(readyYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.PowerWatts != 182 || cmd.CPUTemperatureC != 71 {
+		t.Errorf("Unexpected thermal telemetry in Ready %+v", cmd)
+	}
+}
+
+func TestReadyMemPressureUnmarshal(t *testing.T) {
+	readyYaml := `node_uuid: 2400bce6-ccc8-4a45-b2aa-b5cc3790077b
+mem_total_mb: 3896
+mem_available_mb: 512
+mem_pressure: 12.5
+`
+	var cmd Ready
+	cmd.Init()
+
+	err := yaml.Unmarshal([]byte(readyYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.MemPressure != 12.5 {
+		t.Errorf("Unexpected memory pressure in Ready %+v", cmd)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// ReplayEventsCmd tells the scheduler which of the events of its journal a
+// Controller wants to replay.
+type ReplayEventsCmd struct {
+	// JournalID identifies the journal AfterSequence refers to, as
+	// reported by the last EventsReplayed event the controller got.
+	JournalID int64 `yaml:"journal_id,omitempty"`
+
+	// AfterSequence is the sequence number of the last event the
+	// controller knows about.  0 replays the events sent while the
+	// controller was disconnected.
+	AfterSequence uint64 `yaml:"after_sequence,omitempty"`
+}
+
+// ReplayEvents represents the unmarshalled version of the contents of a
+// SSNTP REPLAYEVENTS payload.  Controllers send it to the scheduler when
+// they reconnect, to catch up with the events they missed.
+type ReplayEvents struct {
+	ReplayEvents ReplayEventsCmd `yaml:"replay_events"`
+}
+
+// Validate checks that the journal a sequence number refers to is
+// identified.
+func (r *ReplayEvents) Validate() error {
+	var errs ValidationError
+
+	if r.ReplayEvents.AfterSequence != 0 && r.ReplayEvents.JournalID == 0 {
+		errs.add("replay_events.journal_id", "is required with an after_sequence")
+	}
+
+	return errs.err()
+}
+
+// EventsReplayedEvent describes a replay of the scheduler's event journal.
+type EventsReplayedEvent struct {
+	// JournalID identifies the scheduler's journal.  It changes each
+	// time the scheduler restarts.
+	JournalID int64 `yaml:"journal_id"`
+
+	// LastSequence is the sequence number of the last event of the
+	// journal, to replay from the next time the controller reconnects.
+	LastSequence uint64 `yaml:"last_sequence"`
+
+	// Replayed is the number of events replayed.
+	Replayed int `yaml:"replayed"`
+
+	// Complete is false when some of the events the controller missed
+	// are no longer in the journal, or when the journal is not the one
+	// the controller asked about.  The controller must then resync
+	// entirely.
+	Complete bool `yaml:"complete"`
+}
+
+// EventsReplayed represents the unmarshalled version of the contents of a
+// SSNTP EventsReplayed event.  The scheduler sends it to a Controller after
+// the events it asked to replay.
+type EventsReplayed struct {
+	Replayed EventsReplayedEvent `yaml:"events_replayed"`
+}
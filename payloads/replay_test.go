@@ -0,0 +1,82 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const replayEventsYaml = "" +
+	"replay_events:\n" +
+	"  journal_id: 1500000000\n" +
+	"  after_sequence: 42\n"
+
+const eventsReplayedYaml = "" +
+	"events_replayed:\n" +
+	"  journal_id: 1500000000\n" +
+	"  last_sequence: 45\n" +
+	"  replayed: 3\n" +
+	"  complete: true\n"
+
+func TestReplayEventsUnmarshal(t *testing.T) {
+	var cmd ReplayEvents
+	err := yaml.Unmarshal([]byte(replayEventsYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.ReplayEvents.JournalID != 1500000000 || cmd.ReplayEvents.AfterSequence != 42 {
+		t.Errorf("Wrong REPLAYEVENTS fields %+v", cmd.ReplayEvents)
+	}
+
+	if err := Validate(&cmd); err != nil {
+		t.Errorf("Valid REPLAYEVENTS payload rejected: %v", err)
+	}
+}
+
+func TestValidateReplayEvents(t *testing.T) {
+	if err := Validate(&ReplayEvents{}); err != nil {
+		t.Errorf("REPLAYEVENTS payload without sequence rejected: %v", err)
+	}
+
+	cmd := ReplayEvents{ReplayEvents: ReplayEventsCmd{AfterSequence: 42}}
+	fields := testFields(Validate(&cmd))
+	if !fields["replay_events.journal_id"] {
+		t.Errorf("replay_events.journal_id not reported as invalid")
+	}
+}
+
+func TestEventsReplayedMarshal(t *testing.T) {
+	event := EventsReplayed{
+		Replayed: EventsReplayedEvent{
+			JournalID:    1500000000,
+			LastSequence: 45,
+			Replayed:     3,
+			Complete:     true,
+		},
+	}
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != eventsReplayedYaml {
+		t.Errorf("EventsReplayed marshalling failed\n[%s]\n vs\n[%s]", string(y), eventsReplayedYaml)
+	}
+}
@@ -0,0 +1,123 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import "time"
+
+// ReserveCmd contains the information needed to hold resources on a compute
+// node for an instance that will be started later, e.g., once its volumes
+// and networks have been prepared.  The instance is started with a START
+// command whose ReservationID is the ID of the reservation.
+type ReserveCmd struct {
+	// ReservationID identifies the reservation.  It is chosen by the
+	// controller.
+	ReservationID string `yaml:"reservation_id"`
+
+	// TenantUUID is the UUID of the tenant the resources are held for.
+	// Only the START commands of this tenant may use the reservation.
+	TenantUUID string `yaml:"tenant_uuid"`
+
+	// WorkloadAgentUUID optionally identifies the node the resources
+	// must be held on.  The scheduler fills it in with the node it
+	// picked when the controller leaves it empty.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid,omitempty"`
+
+	// RequestedResources is the list of resources held, typically the
+	// mem_mb, vcpus and disk_mb resources of the instance.
+	RequestedResources []RequestedResource `yaml:"requested_resources"`
+
+	// TTLSeconds is the number of seconds the resources are held for
+	// if no START command uses the reservation.
+	TTLSeconds int `yaml:"ttl_seconds"`
+
+	// Expires is the time, in RFC 3339 format, at which the reservation
+	// expires.  It is set by the scheduler from TTLSeconds before the
+	// command is forwarded to the node.
+	Expires string `yaml:"expires,omitempty"`
+
+	// TenantToken is a signed token authenticating TenantUUID.  See
+	// StartCmd.TenantToken.
+	TenantToken string `yaml:"tenant_token,omitempty"`
+}
+
+// ExpiryTime returns the time at which the reservation expires, and false
+// if Expires is not set or is not a valid RFC 3339 time.
+func (r *ReserveCmd) ExpiryTime() (time.Time, bool) {
+	if r.Expires == "" {
+		return time.Time{}, false
+	}
+
+	expires, err := time.Parse(time.RFC3339, r.Expires)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return expires, true
+}
+
+// Reserve represents the unmarshalled version of the contents of a SSNTP
+// RESERVE payload.
+type Reserve struct {
+	Reserve ReserveCmd `yaml:"reserve"`
+}
+
+// ReservationState is the state of a reservation reported in
+// ReservationStatus events.
+type ReservationState string
+
+const (
+	// ReservationHeld indicates that the resources are held on the node
+	// identified in the event.
+	ReservationHeld ReservationState = "held"
+
+	// ReservationFailed indicates that the resources could not be held,
+	// e.g., because no node has room for them.
+	ReservationFailed = "failed"
+
+	// ReservationExpired indicates that no START command used the
+	// reservation before it expired, and that its resources have been
+	// released.
+	ReservationExpired = "expired"
+)
+
+// ReservationStatus reports the state of a reservation.
+type ReservationStatus struct {
+	// ReservationID identifies the reservation.
+	ReservationID string `yaml:"reservation_id"`
+
+	// State is the state of the reservation.
+	State ReservationState `yaml:"state"`
+
+	// NodeUUID is the UUID of the node the resources are held on.  It is
+	// empty for failed reservations.
+	NodeUUID string `yaml:"node_uuid,omitempty"`
+
+	// Expires is the time, in RFC 3339 format, at which a held
+	// reservation expires.
+	Expires string `yaml:"expires,omitempty"`
+
+	// Reason explains why the reservation failed.
+	Reason string `yaml:"reason,omitempty"`
+}
+
+// EventReservationStatus represents the unmarshalled version of the contents
+// of a SSNTP ReservationStatus event.  The scheduler sends it to the
+// controller that sent a RESERVE command once the resources are held, or
+// could not be, and when the reservation expires.
+type EventReservationStatus struct {
+	Status ReservationStatus `yaml:"reservation_status"`
+}
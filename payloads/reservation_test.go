@@ -0,0 +1,159 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const reservationID = "volume-prep-42"
+
+const reserveYaml = "" +
+	"reserve:\n" +
+	"  reservation_id: " + reservationID + "\n" +
+	"  tenant_uuid: " + tenantUUID + "\n" +
+	"  workload_agent_uuid: " + agentUUID + "\n" +
+	"  requested_resources:\n" +
+	"  - type: mem_mb\n" +
+	"    value: 1024\n" +
+	"    mandatory: true\n" +
+	"  - type: vcpus\n" +
+	"    value: 2\n" +
+	"    mandatory: true\n" +
+	"  ttl_seconds: 300\n" +
+	"  expires: 2017-07-14T02:40:00Z\n"
+
+const reservationStatusYaml = "" +
+	"reservation_status:\n" +
+	"  reservation_id: " + reservationID + "\n" +
+	"  state: held\n" +
+	"  node_uuid: " + agentUUID + "\n" +
+	"  expires: 2017-07-14T02:40:00Z\n"
+
+func testReserve() Reserve {
+	return Reserve{
+		Reserve: ReserveCmd{
+			ReservationID:     reservationID,
+			TenantUUID:        tenantUUID,
+			WorkloadAgentUUID: agentUUID,
+			RequestedResources: []RequestedResource{
+				{Type: MemMB, Value: 1024, Mandatory: true},
+				{Type: VCPUs, Value: 2, Mandatory: true},
+			},
+			TTLSeconds: 300,
+			Expires:    "2017-07-14T02:40:00Z",
+		},
+	}
+}
+
+func TestReserveMarshal(t *testing.T) {
+	cmd := testReserve()
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != reserveYaml {
+		t.Errorf("RESERVE marshalling failed\n[%s]\n vs\n[%s]", string(y), reserveYaml)
+	}
+}
+
+func TestReserveUnmarshal(t *testing.T) {
+	var cmd Reserve
+	err := yaml.Unmarshal([]byte(reserveYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(&cmd); err != nil {
+		t.Errorf("Valid RESERVE payload rejected: %v", err)
+	}
+
+	r := cmd.Reserve
+	if r.ReservationID != reservationID || r.TenantUUID != tenantUUID ||
+		r.WorkloadAgentUUID != agentUUID || len(r.RequestedResources) != 2 ||
+		r.TTLSeconds != 300 {
+		t.Errorf("Wrong RESERVE fields %+v", r)
+	}
+
+	expires, ok := r.ExpiryTime()
+	if !ok || expires.Unix() != 1500000000 {
+		t.Errorf("Wrong expiry time %v", expires)
+	}
+}
+
+func TestValidateReserve(t *testing.T) {
+	cmd := testReserve()
+	cmd.Reserve.ReservationID = ""
+	cmd.Reserve.RequestedResources[1].Value = -1
+	cmd.Reserve.TTLSeconds = 0
+	cmd.Reserve.Expires = "in 5 minutes"
+
+	fields := testFields(Validate(&cmd))
+	for _, f := range []string{
+		"reserve.reservation_id",
+		"reserve.requested_resources[1].value",
+		"reserve.ttl_seconds",
+		"reserve.expires",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+
+	cmd = testReserve()
+	cmd.Reserve.RequestedResources = []RequestedResource{{Type: NetworkNode, Value: 1}}
+	if fields := testFields(Validate(&cmd)); !fields["reserve.requested_resources"] {
+		t.Errorf("Network node reservation not reported as invalid")
+	}
+}
+
+func TestReservationStatusMarshal(t *testing.T) {
+	event := EventReservationStatus{
+		Status: ReservationStatus{
+			ReservationID: reservationID,
+			State:         ReservationHeld,
+			NodeUUID:      agentUUID,
+			Expires:       "2017-07-14T02:40:00Z",
+		},
+	}
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != reservationStatusYaml {
+		t.Errorf("ReservationStatus marshalling failed\n[%s]\n vs\n[%s]", string(y), reservationStatusYaml)
+	}
+}
+
+func TestValidateStartReservation(t *testing.T) {
+	start := testValidStart()
+	start.Start.ReservationID = reservationID
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START reservation rejected: %v", err)
+	}
+
+	start.Start.Gang = &Gang{ID: "mpi-job", Size: 2}
+	if fields := testFields(Validate(&start)); !fields["start.reservation_id"] {
+		t.Errorf("Reservation of a gang member not reported as invalid")
+	}
+}
@@ -52,6 +52,11 @@ const (
 	// RestartNetworkFailure indicates that it was not possible to
 	// initialise networking for the instance before restarting it.
 	RestartNetworkFailure = "network_failure"
+
+	// RestartTenantNotAuthenticated is returned by the scheduler when the
+	// RESTART command does not carry a valid token for the tenant of the
+	// instance.
+	RestartTenantNotAuthenticated = "tenant_not_authenticated"
 )
 
 // ErrorRestartFailure represents the unmarshalled version of the contents of a
@@ -81,6 +86,8 @@ func (r RestartFailureReason) String() string {
 		return "Failed to launch instance"
 	case RestartNetworkFailure:
 		return "Failed to locate VNIC for instance"
+	case RestartTenantNotAuthenticated:
+		return "Tenant not authenticated"
 	}
 
 	return ""
@@ -0,0 +1,154 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"fmt"
+	"net"
+)
+
+// SecurityRuleDirection is the direction of the traffic a security rule
+// applies to, as seen from the instance.
+type SecurityRuleDirection string
+
+const (
+	// IngressRule rules allow traffic received by the instance.
+	IngressRule SecurityRuleDirection = "ingress"
+
+	// EgressRule rules allow traffic sent by the instance.
+	EgressRule SecurityRuleDirection = "egress"
+)
+
+// SecurityRuleProtocol is the protocol of the traffic a security rule
+// applies to.
+type SecurityRuleProtocol string
+
+const (
+	// AnyProtocol rules apply to all the traffic.
+	AnyProtocol SecurityRuleProtocol = ""
+
+	// TCPProtocol rules apply to TCP traffic.
+	TCPProtocol SecurityRuleProtocol = "tcp"
+
+	// UDPProtocol rules apply to UDP traffic.
+	UDPProtocol SecurityRuleProtocol = "udp"
+
+	// ICMPProtocol rules apply to ICMP traffic.
+	ICMPProtocol SecurityRuleProtocol = "icmp"
+
+	// ICMPv6Protocol rules apply to ICMPv6 traffic.
+	ICMPv6Protocol SecurityRuleProtocol = "icmpv6"
+)
+
+// SecurityRule allows some of the traffic of an instance.
+type SecurityRule struct {
+	Direction SecurityRuleDirection `yaml:"direction"`
+
+	// Protocol restricts the rule to a protocol, all protocols if "".
+	Protocol SecurityRuleProtocol `yaml:"protocol,omitempty"`
+
+	// PortMin and PortMax restrict TCP and UDP rules to a range of
+	// destination ports.  Both are 0 for all the ports, and PortMax is
+	// 0 for a single port.
+	PortMin int `yaml:"port_min,omitempty"`
+	PortMax int `yaml:"port_max,omitempty"`
+
+	// RemoteCIDR restricts the rule to the traffic coming from, for
+	// ingress rules, or going to, for egress rules, an IPv4 or IPv6
+	// subnet.  All addresses if "".
+	RemoteCIDR string `yaml:"remote_cidr,omitempty"`
+}
+
+// SecurityGroupRulesCmd contains the security rules of an instance.  The rules
+// replace those previously applied to the instance.  The traffic received
+// by the instance is dropped unless an ingress rule allows it.  The
+// traffic it sends is allowed, unless the group has egress rules, in which
+// case only the traffic they allow is.
+type SecurityGroupRulesCmd struct {
+	// InstanceUUID identifies the instance the rules apply to.
+	InstanceUUID string `yaml:"instance_uuid"`
+
+	// WorkloadAgentUUID identifies the node on which the instance is
+	// running.
+	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// Version of the rules, increased by the controller each time they
+	// change.  Agents ignore rules older than the ones they applied, and
+	// report the version of the applied rules in their STATS payloads.
+	Version uint64 `yaml:"version"`
+
+	Rules []SecurityRule `yaml:"rules,omitempty"`
+
+	// TenantToken authenticates the tenant of the instance, see
+	// StartCmd.TenantToken.
+	TenantToken string `yaml:"tenant_token,omitempty" since:"19"`
+}
+
+// SecurityGroupRules represents the unmarshalled version of the contents of a
+// SSNTP SECURITYGROUP payload.  The controller sends it to the scheduler,
+// which forwards it to the agent running the instance.
+type SecurityGroupRules struct {
+	Group SecurityGroupRulesCmd `yaml:"security_group"`
+}
+
+// Validate checks that the instance and its node are identified, that the
+// rules are versioned, and that their directions, protocols, ports and
+// subnets are valid.
+func (s *SecurityGroupRules) Validate() error {
+	var errs ValidationError
+
+	errs.required("security_group.instance_uuid", s.Group.InstanceUUID)
+	errs.required("security_group.workload_agent_uuid", s.Group.WorkloadAgentUUID)
+
+	if s.Group.Version == 0 {
+		errs.add("security_group.version", "is required")
+	}
+
+	for i, r := range s.Group.Rules {
+		field := fmt.Sprintf("security_group.rules[%d]", i)
+
+		switch r.Direction {
+		case IngressRule, EgressRule:
+		default:
+			errs.add(field+".direction", "unknown direction %s", r.Direction)
+		}
+
+		switch r.Protocol {
+		case AnyProtocol, TCPProtocol, UDPProtocol, ICMPProtocol, ICMPv6Protocol:
+		default:
+			errs.add(field+".protocol", "unknown protocol %s", r.Protocol)
+		}
+
+		if r.PortMin != 0 || r.PortMax != 0 {
+			if r.Protocol != TCPProtocol && r.Protocol != UDPProtocol {
+				errs.add(field+".port_min", "ports are only valid for tcp and udp rules")
+			} else if r.PortMin < 1 || r.PortMin > 65535 {
+				errs.add(field+".port_min", "%d is not a port", r.PortMin)
+			} else if r.PortMax != 0 && (r.PortMax < r.PortMin || r.PortMax > 65535) {
+				errs.add(field+".port_max", "%d is not a port above port_min (%d)", r.PortMax, r.PortMin)
+			}
+		}
+
+		if r.RemoteCIDR != "" {
+			if _, _, err := net.ParseCIDR(r.RemoteCIDR); err != nil {
+				errs.add(field+".remote_cidr", "%s is not a subnet", r.RemoteCIDR)
+			}
+		}
+	}
+
+	return errs.err()
+}
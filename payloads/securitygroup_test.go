@@ -0,0 +1,122 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const securityGroupYaml = "" +
+	"security_group:\n" +
+	"  instance_uuid: " + instanceUUID + "\n" +
+	"  workload_agent_uuid: " + agentUUID + "\n" +
+	"  version: 3\n" +
+	"  rules:\n" +
+	"  - direction: ingress\n" +
+	"    protocol: tcp\n" +
+	"    port_min: 22\n" +
+	"    remote_cidr: 10.0.0.0/8\n" +
+	"  - direction: ingress\n" +
+	"    protocol: icmpv6\n" +
+	"  - direction: egress\n" +
+	"    protocol: udp\n" +
+	"    port_min: 5000\n" +
+	"    port_max: 5010\n" +
+	"    remote_cidr: fd00::/64\n"
+
+func testSecurityGroupRules() SecurityGroupRules {
+	return SecurityGroupRules{
+		Group: SecurityGroupRulesCmd{
+			InstanceUUID:      instanceUUID,
+			WorkloadAgentUUID: agentUUID,
+			Version:           3,
+			Rules: []SecurityRule{
+				{Direction: IngressRule, Protocol: TCPProtocol, PortMin: 22, RemoteCIDR: "10.0.0.0/8"},
+				{Direction: IngressRule, Protocol: ICMPv6Protocol},
+				{Direction: EgressRule, Protocol: UDPProtocol, PortMin: 5000, PortMax: 5010, RemoteCIDR: "fd00::/64"},
+			},
+		},
+	}
+}
+
+func TestSecurityGroupMarshal(t *testing.T) {
+	cmd := testSecurityGroupRules()
+
+	y, err := yaml.Marshal(&cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != securityGroupYaml {
+		t.Errorf("SECURITYGROUP marshalling failed\n[%s]\n vs\n[%s]", string(y), securityGroupYaml)
+	}
+}
+
+func TestSecurityGroupUnmarshal(t *testing.T) {
+	var cmd SecurityGroupRules
+	err := yaml.Unmarshal([]byte(securityGroupYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(&cmd); err != nil {
+		t.Errorf("Valid SECURITYGROUP payload rejected: %v", err)
+	}
+
+	g := cmd.Group
+	if g.InstanceUUID != instanceUUID || g.WorkloadAgentUUID != agentUUID ||
+		g.Version != 3 || len(g.Rules) != 3 || g.Rules[2].PortMax != 5010 ||
+		g.Rules[1].Protocol != ICMPv6Protocol {
+		t.Errorf("Wrong SECURITYGROUP fields %+v", g)
+	}
+}
+
+func TestValidateSecurityGroup(t *testing.T) {
+	cmd := testSecurityGroupRules()
+	cmd.Group.WorkloadAgentUUID = ""
+	cmd.Group.Version = 0
+	cmd.Group.Rules = append(cmd.Group.Rules,
+		SecurityRule{Direction: "inbound"},
+		SecurityRule{Direction: IngressRule, Protocol: "sctp"},
+		SecurityRule{Direction: IngressRule, Protocol: ICMPProtocol, PortMin: 8},
+		SecurityRule{Direction: EgressRule, Protocol: TCPProtocol, PortMin: 70000},
+		SecurityRule{Direction: EgressRule, Protocol: UDPProtocol, PortMin: 53, PortMax: 52},
+		SecurityRule{Direction: EgressRule, RemoteCIDR: "10.0.0.1"},
+	)
+
+	fields := testFields(Validate(&cmd))
+	for _, f := range []string{
+		"security_group.workload_agent_uuid",
+		"security_group.version",
+		"security_group.rules[3].direction",
+		"security_group.rules[4].protocol",
+		"security_group.rules[5].port_min",
+		"security_group.rules[6].port_min",
+		"security_group.rules[7].port_max",
+		"security_group.rules[8].remote_cidr",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+
+	if len(fields) != 8 {
+		t.Errorf("Valid fields reported as invalid: %v", fields)
+	}
+}
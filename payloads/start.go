@@ -16,6 +16,8 @@
 
 package payloads
 
+import "time"
+
 // Persistence represents the persistency of an instance, i.e., whether that
 // instance should be restarted after certain events have occurred, e.g., the
 // node on which the instance runs is rebooted. It's not currently implemented
@@ -31,6 +33,9 @@ type Resource string
 // Hypervisor indicates the type of hypervisor used to run a given instance
 type Hypervisor string
 
+// RestartPolicy indicates when launcher restarts an instance by itself
+type RestartPolicy string
+
 const (
 	// All is reserved for future usage.
 	All Persistence = "all"
@@ -42,6 +47,16 @@ const (
 	Host = "host"
 )
 
+const (
+	// RestartNever indicates that launcher never restarts an instance by
+	// itself.  This is the default.
+	RestartNever RestartPolicy = "never"
+
+	// RestartUnhealthy indicates that launcher restarts an instance as
+	// soon as its health check reports that it is unhealthy.
+	RestartUnhealthy = "unhealthy"
+)
+
 const (
 	// EFI indicates that EFI firmware, e.g., OVMF.fd, should be used to
 	// boot a VM
@@ -50,6 +65,10 @@ const (
 	// Legacy indicates that legacy firmware, e.g., BIOS should be used
 	// to boot a VM
 	Legacy = "legacy"
+
+	// SecureBoot indicates that EFI firmware with secure boot enabled
+	// should be used to boot a VM
+	SecureBoot = "secure_boot"
 )
 
 const (
@@ -72,6 +91,49 @@ const (
 	// ComputeNode indicates that a resource struct specifies whether the
 	// command in which it is embedded applies to a compute node.
 	ComputeNode = "compute_node"
+
+	// Hugepages indicates that a resource struct specifies whether the
+	// memory of the instance should be backed by hugepages.
+	Hugepages = "hugepages"
+
+	// SRIOVVFs indicates that a resource struct specifies the number of
+	// SR-IOV virtual functions to be passed through to the instance.
+	SRIOVVFs = "sriov_vfs"
+
+	// GPUs indicates that a resource struct specifies the number of GPUs
+	// to be passed through to the instance.
+	GPUs = "gpus"
+
+	// NetIngressKbps indicates that a resource struct specifies the
+	// maximum rate, in kbps, at which the instance may receive network
+	// traffic.
+	NetIngressKbps = "net_ingress_kbps"
+
+	// NetEgressKbps indicates that a resource struct specifies the
+	// maximum rate, in kbps, at which the instance may send network
+	// traffic.
+	NetEgressKbps = "net_egress_kbps"
+
+	// DiskIOPS indicates that a resource struct specifies the maximum
+	// number of I/O operations per second the instance may perform on
+	// its disk.
+	DiskIOPS = "disk_iops"
+
+	// DedicatedCores indicates that a resource struct specifies the
+	// number of host CPU cores to be dedicated to the instance, i.e.,
+	// not shared with any other instance.
+	DedicatedCores = "dedicated_cores"
+
+	// BalloonMinMB indicates that a resource struct specifies the amount
+	// of memory, in MB, below which the memory balloon of the instance
+	// may not shrink its guest when the node reclaims memory from idle
+	// instances.  Instances that do not specify it are not ballooned.
+	BalloonMinMB = "balloon_min_mb"
+
+	// SwapMaxMB indicates that a resource struct specifies the maximum
+	// amount of host swap, in MB, the instance may use.  Instances that
+	// do not specify it may use as much swap as the node has.
+	SwapMaxMB = "swap_max_mb"
 )
 
 const (
@@ -81,6 +143,14 @@ const (
 	// Docker specifies that an instance is to be launched inside a Docker
 	// container.
 	Docker = "docker"
+
+	// CloudHypervisor specifies that an instance is to be booted on a
+	// Cloud Hypervisor microVM.
+	CloudHypervisor = "cloud-hypervisor"
+
+	// KataContainer specifies that an instance is to be launched from a
+	// Docker image inside a lightweight VM.
+	KataContainer = "kata"
 )
 
 // RequestedResource is used to specify an individual resource contained within
@@ -139,6 +209,114 @@ type NetworkResources struct {
 
 	// PublicIP is  reserved for future usage.
 	PublicIP bool `yaml:"public_ip"`
+
+	// SubnetIPv6 is the IPv6 subnet to which the instance is assigned,
+	// in addition to Subnet, on dual-stack tenant networks.  Only
+	// specified when creating CN instances.
+	SubnetIPv6 string `yaml:"subnet_ipv6,omitempty" since:"17"`
+
+	// PrivateIPv6 represents the private IPv6 address of an instance,
+	// which belongs to SubnetIPv6.  Only specified when creating CN
+	// instances on dual-stack tenant networks.
+	PrivateIPv6 string `yaml:"private_ipv6,omitempty" since:"17"`
+
+	// ConcentratorIPv6 is the IPv6 address of the CNCI, through which
+	// the instance can be reached in addition to ConcentratorIP.
+	ConcentratorIPv6 string `yaml:"concentrator_ipv6,omitempty" since:"17"`
+}
+
+// ContainerIsolation contains the security settings to apply to a docker
+// instance.  All fields are optional.  The settings of the docker daemon are
+// used for any fields that are not specified.
+type ContainerIsolation struct {
+	// SeccompProfile is the name of the seccomp profile to apply to the
+	// container.  It must either be "unconfined" or the name of a profile
+	// installed on the node in /etc/ciao/seccomp.
+	SeccompProfile string `yaml:"seccomp_profile,omitempty"`
+
+	// AppArmorProfile is the name of an AppArmor profile, already loaded
+	// on the node, to apply to the container, or "unconfined".
+	AppArmorProfile string `yaml:"apparmor_profile,omitempty"`
+
+	// SELinuxLabel is a list of SELinux label options, i.e., user:, role:,
+	// type: or level: followed by a value, e.g., type:svirt_lxc_net_t, to
+	// apply to the container, or "disable".
+	SELinuxLabel []string `yaml:"selinux_label,omitempty"`
+
+	// UsernsMode indicates whether the container should run in a
+	// remapped user namespace.  It can be "remap", in which case
+	// the instance will only be started if the docker daemon is
+	// configured with user namespace remapping, or "host" in which
+	// case remapping is disabled for the container.
+	//
+	// Launchers refuse the settings that disable a form of isolation,
+	// i.e., unconfined profiles, disable and host, unless they are
+	// started with the -allow-weak-isolation option.
+	UsernsMode string `yaml:"userns_mode,omitempty"`
+}
+
+// ContainerVolume describes a volume mounted into a docker instance.  It is
+// either a named volume, managed by docker on the node, or a bind mount of a
+// host directory.
+type ContainerVolume struct {
+	// Name of a named volume.  Named volumes are private to the tenant of
+	// the instance.  Must be "" for bind mounts.
+	Name string `yaml:"name,omitempty"`
+
+	// HostPath is the absolute path of the host directory to bind mount.
+	// Nodes only allow bind mounts of the directories they are configured
+	// with.  Must be "" for named volumes.
+	HostPath string `yaml:"host_path,omitempty"`
+
+	// MountPoint is the absolute path at which the volume is mounted
+	// inside the container.
+	MountPoint string `yaml:"mount_point"`
+
+	// ReadOnly mounts the volume read only.
+	ReadOnly bool `yaml:"read_only,omitempty"`
+
+	// SizeMB is the disk space, in MB, a named volume is expected to use.
+	// It is accounted for, with the disk_mb resource of the instance, in
+	// the disk space allocated on the node.
+	SizeMB int `yaml:"size_mb,omitempty"`
+
+	// Persistent named volumes are kept when the instance is deleted, so
+	// that a later instance of the tenant can mount them.  Other named
+	// volumes are removed with the instance.
+	Persistent bool `yaml:"persistent,omitempty"`
+}
+
+// RegistryAuth contains the credentials a node uses to pull the docker image
+// of an instance from a private registry.  Nodes never store them.
+type RegistryAuth struct {
+	// Registry is the host, and optional port, of the registry the
+	// credentials are for, e.g., registry.example.com:5000.  The
+	// credentials are only used for images of that registry, or for
+	// images of any registry if it is "".
+	Registry string `yaml:"registry,omitempty"`
+
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// HealthCheck describes how launcher checks the health of a running docker
+// instance.
+type HealthCheck struct {
+	// Command is run inside the container, which is healthy if it exits
+	// with 0.  If empty, the HEALTHCHECK of the docker image is used.
+	Command []string `yaml:"command,omitempty"`
+
+	// IntervalS is the interval, in seconds, between two checks, 30 by
+	// default.
+	IntervalS int `yaml:"interval_s,omitempty"`
+
+	// TimeoutS is the time, in seconds, after which a check is
+	// considered to have failed, 10 by default.
+	TimeoutS int `yaml:"timeout_s,omitempty"`
+
+	// Retries is the number of consecutive checks that must fail for
+	// the instance to be unhealthy, 3 by default.
+	Retries int `yaml:"retries,omitempty"`
 }
 
 // StartCmd contains the information needed to start a new instance.
@@ -160,6 +338,11 @@ type StartCmd struct {
 	// instances.
 	DockerImage string `yaml:"docker_image"`
 
+	// ImageArchitecture is the CPU architecture the image or docker
+	// image was built for.  The scheduler does not place the instance on
+	// nodes of another architecture.  Empty means any architecture.
+	ImageArchitecture Architecture `yaml:"image_architecture,omitempty" since:"10"`
+
 	// FWType indicates the type of firmware needed to boot the instance.
 	// Only used for qemu instances.
 	FWType Firmware `yaml:"fw_type"`
@@ -171,15 +354,160 @@ type StartCmd struct {
 	VMType Hypervisor `yaml:"vm_type"`
 
 	// RequestedResources contains a list of the resources that are to be
-	// assigned to the new instance.
+	// assigned to the new instance.  It can be left empty when FlavorUUID
+	// is given, in which case the scheduler fills it in.
 	RequestedResources []RequestedResource `yaml:"requested_resources"`
 
+	// FlavorUUID optionally references a flavor whose requested resources
+	// were registered with the scheduler in a WorkloadDefinition event.
+	FlavorUUID string `yaml:"flavor_uuid,omitempty" since:"7"`
+
 	// EstimatedResources is reserved for future usage.
 	EstimatedResources []EstimatedResource `yaml:"estimated_resources"`
 
 	// Networking contains all the information required to set up networking
 	// for the new instance.
 	Networking NetworkResources `yaml:"networking"`
+
+	// Hostname is the hostname to assign to the instance.  If not
+	// specified the instance UUID is used.
+	Hostname string `yaml:"hostname,omitempty"`
+
+	// SSHKeys is a list of public SSH keys to be installed in the
+	// instance by cloud-init.
+	SSHKeys []string `yaml:"ssh_keys,omitempty"`
+
+	// Isolation contains the security settings for docker instances.  It
+	// must not be specified for qemu instances.
+	Isolation *ContainerIsolation `yaml:"isolation,omitempty"`
+
+	// GroupID optionally assigns the instance to a group, e.g., a
+	// deployment, so that all the instances of the group running on a
+	// node can be stopped or deleted with a single STOPGROUP or
+	// DELETEGROUP command.
+	GroupID string `yaml:"group_id,omitempty"`
+
+	// Encryption requests that the rootfs of a qemu instance be
+	// encrypted.  It must not be specified for other types of instance.
+	Encryption *DiskEncryption `yaml:"encryption,omitempty"`
+
+	// Hooks contains scripts to be executed by launcher at various points
+	// in the lifecycle of the instance.
+	Hooks *InstanceHooks `yaml:"hooks,omitempty"`
+
+	// TPM requests that a virtual TPM 2.0 be attached to a qemu instance
+	// so that its boot can be measured.
+	TPM bool `yaml:"tpm,omitempty"`
+
+	// Requirements lists the capabilities the instance needs from the
+	// node it is launched on.  The scheduler only considers the nodes
+	// that advertised these capabilities.
+	Requirements *NodeRequirements `yaml:"requirements,omitempty"`
+
+	// Gang optionally makes the instance a member of a gang, a set of
+	// instances that the scheduler places all at once or not at all.
+	Gang *Gang `yaml:"gang,omitempty" since:"8"`
+
+	// TenantToken is a signed token, a JWT, authenticating the tenant on
+	// whose behalf the instance is started.  Schedulers configured to
+	// verify tenant tokens reject START commands without a valid token
+	// for TenantUUID, and remove the token before forwarding the command
+	// to the node.
+	TenantToken string `yaml:"tenant_token,omitempty" since:"19"`
+
+	// Deadline is the time, in RFC 3339 format, by which the instance
+	// must be placed.  Schedulers fail the START commands they could not
+	// place before their deadline, including the time spent waiting for
+	// the other members of a gang, with a DeadlineExceeded StartFailure.
+	Deadline string `yaml:"deadline,omitempty" since:"21"`
+
+	// ReservationID optionally identifies resources held on a node by a
+	// RESERVE command.  The instance is then started on that node, in
+	// place of the reservation, and must be of the reservation's tenant.
+	ReservationID string `yaml:"reservation_id,omitempty" since:"22"`
+
+	// Backfill makes the instance low-priority batch work soaking idle
+	// capacity.  Schedulers only place backfill instances on nodes with
+	// ample free headroom, preempt them first when another instance does
+	// not fit, and start them again elsewhere once preempted.
+	Backfill bool `yaml:"backfill,omitempty" since:"26"`
+
+	// Volumes are the named volumes and bind mounts of docker instances.
+	Volumes []ContainerVolume `yaml:"volumes,omitempty" since:"31"`
+
+	// RegistryAuth contains the credentials needed to pull the image of
+	// a docker instance from a private registry.  Nodes may also be
+	// configured with per-tenant credentials.
+	RegistryAuth *RegistryAuth `yaml:"registry_auth,omitempty" since:"32"`
+
+	// HealthCheck overrides the HEALTHCHECK of the image of a docker
+	// instance.  Docker instances whose image has no HEALTHCHECK are
+	// only health checked if it is specified.
+	HealthCheck *HealthCheck `yaml:"health_check,omitempty" since:"33"`
+
+	// RestartPolicy indicates whether launcher restarts the instance by
+	// itself when it becomes unhealthy.  Never by default.
+	RestartPolicy RestartPolicy `yaml:"restart_policy,omitempty" since:"33"`
+}
+
+// DeadlineTime returns the deadline of the START command, and false if it
+// has none or if it is not a valid RFC 3339 time.
+func (s *StartCmd) DeadlineTime() (time.Time, bool) {
+	if s.Deadline == "" {
+		return time.Time{}, false
+	}
+
+	deadline, err := time.Parse(time.RFC3339, s.Deadline)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return deadline, true
+}
+
+// Gang identifies the gang an instance belongs to.  The START commands of
+// all the members of a gang carry the same Gang.
+type Gang struct {
+	// ID identifies the gang.
+	ID string `yaml:"id"`
+
+	// Size is the number of members of the gang.  The scheduler waits
+	// for the START commands of all of them before placing any.
+	Size int `yaml:"size"`
+
+	// AntiAffinity requests that no two members of the gang be placed
+	// on the same node.
+	AntiAffinity bool `yaml:"anti_affinity,omitempty"`
+}
+
+// InstanceHooks contains the scripts that launcher executes on the host
+// before and after an instance is booted and before it is shutdown.  Each
+// script must begin with a #! line.  Empty scripts are ignored.  As they are
+// run as root, launchers refuse them unless explicitly configured to accept
+// them.
+type InstanceHooks struct {
+	// PreStart is executed each time the instance is about to be booted.
+	// The boot is aborted if the script fails.
+	PreStart string `yaml:"pre_start,omitempty"`
+
+	// PostStart is executed each time the instance has been booted.
+	PostStart string `yaml:"post_start,omitempty"`
+
+	// PreStop is executed before the instance is shutdown by a STOP or
+	// a DELETE command.
+	PreStop string `yaml:"pre_stop,omitempty"`
+}
+
+// DiskEncryption contains the key material used to encrypt the rootfs of an
+// instance.  Exactly one of Key or KeyURL must be specified.
+type DiskEncryption struct {
+	// Key is the base64 encoded passphrase used to encrypt the rootfs.
+	Key string `yaml:"key,omitempty"`
+
+	// KeyURL is an HTTPS URL, typically pointing to a key management
+	// service, from which the passphrase is retrieved each time the
+	// instance is created or booted.
+	KeyURL string `yaml:"key_url,omitempty"`
 }
 
 // Start represents the unmarshalled version of the contents of a SSNTP START
@@ -220,6 +548,10 @@ type RestartCmd struct {
 
 	// Networking is reserved for future usage.
 	Networking NetworkResources `yaml:"networking"`
+
+	// TenantToken authenticates the tenant of the instance, see
+	// StartCmd.TenantToken.
+	TenantToken string `yaml:"tenant_token,omitempty" since:"19"`
 }
 
 // Restart represents the unmarshalled version of the contents of a SSNTP
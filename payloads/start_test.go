@@ -157,3 +157,118 @@ func TestStartUnmarshalPartial(t *testing.T) {
 
 	fmt.Println(cmd)
 }
+
+func TestStartUnmarshalCloudInit(t *testing.T) {
+	startYaml := `start:
+  instance_uuid: 923d1f2b-aabe-4a9b-9982-8664b0e52f93
+  image_uuid: 53cdd9ef-228f-4ce1-911d-706c2b41454a
+  vm_type: qemu
+  hostname: ciao-test
+  ssh_keys:
+    - ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC0 ciao@ciao
+    - ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC1 ciao@ciao
+`
+	var cmd Start
+	err := yaml.Unmarshal([]byte(startYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if cmd.Start.Hostname != "ciao-test" {
+		t.Errorf("Unexpected hostname %s", cmd.Start.Hostname)
+	}
+
+	if len(cmd.Start.SSHKeys) != 2 ||
+		cmd.Start.SSHKeys[0] != "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC0 ciao@ciao" ||
+		cmd.Start.SSHKeys[1] != "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAABAQC1 ciao@ciao" {
+		t.Errorf("Unexpected ssh keys %v", cmd.Start.SSHKeys)
+	}
+}
+
+func TestStartUnmarshalIsolation(t *testing.T) {
+	startYaml := `start:
+  instance_uuid: 923d1f2b-aabe-4a9b-9982-8664b0e52f93
+  docker_image: ubuntu/latest
+  vm_type: docker
+  isolation:
+    seccomp_profile: default
+    apparmor_profile: docker-default
+    selinux_label:
+      - type:svirt_lxc_net_t
+      - level:s0:c100,c200
+    userns_mode: remap
+`
+	var cmd Start
+	err := yaml.Unmarshal([]byte(startYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iso := cmd.Start.Isolation
+	if iso == nil {
+		t.Fatal("Isolation section not unmarshalled")
+	}
+
+	if iso.SeccompProfile != "default" ||
+		iso.AppArmorProfile != "docker-default" ||
+		len(iso.SELinuxLabel) != 2 ||
+		iso.SELinuxLabel[0] != "type:svirt_lxc_net_t" ||
+		iso.SELinuxLabel[1] != "level:s0:c100,c200" ||
+		iso.UsernsMode != "remap" {
+		t.Errorf("Unexpected values in Isolation %v", *iso)
+	}
+}
+
+func TestStartUnmarshalEncryption(t *testing.T) {
+	startYaml := `start:
+  instance_uuid: 923d1f2b-aabe-4a9b-9982-8664b0e52f93
+  image_uuid: b286cd45-7d0c-4525-a140-4db6c95e41fa
+  encryption:
+    key_url: https://kms.example.com/keys/923d1f2b-aabe-4a9b-9982-8664b0e52f93
+`
+	var cmd Start
+	err := yaml.Unmarshal([]byte(startYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	enc := cmd.Start.Encryption
+	if enc == nil {
+		t.Fatal("Encryption section not unmarshalled")
+	}
+
+	if enc.Key != "" ||
+		enc.KeyURL != "https://kms.example.com/keys/923d1f2b-aabe-4a9b-9982-8664b0e52f93" {
+		t.Errorf("Unexpected values in Encryption %v", *enc)
+	}
+}
+
+func TestStartUnmarshalHooks(t *testing.T) {
+	startYaml := `start:
+  instance_uuid: 923d1f2b-aabe-4a9b-9982-8664b0e52f93
+  image_uuid: b286cd45-7d0c-4525-a140-4db6c95e41fa
+  hooks:
+    pre_start: |
+      #!/bin/sh
+      ipam-register $CIAO_INSTANCE_UUID
+    pre_stop: |
+      #!/bin/sh
+      ipam-release $CIAO_INSTANCE_UUID
+`
+	var cmd Start
+	err := yaml.Unmarshal([]byte(startYaml), &cmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hooks := cmd.Start.Hooks
+	if hooks == nil {
+		t.Fatal("Hooks section not unmarshalled")
+	}
+
+	if hooks.PreStart != "#!/bin/sh\nipam-register $CIAO_INSTANCE_UUID\n" ||
+		hooks.PostStart != "" ||
+		hooks.PreStop != "#!/bin/sh\nipam-release $CIAO_INSTANCE_UUID\n" {
+		t.Errorf("Unexpected values in Hooks %v", *hooks)
+	}
+}
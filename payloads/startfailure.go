@@ -72,6 +72,42 @@ const (
 	// NetworkFailure indicates that it was not possible to initialise
 	// networking for the instance.
 	NetworkFailure = "network_failure"
+
+	// TenantLimitExceeded indicates that starting the instance would
+	// exceed the limits imposed on the instance's tenant by the node,
+	// even though the node itself has sufficient resources.
+	TenantLimitExceeded = "tenant_limit"
+
+	// GangFailure is returned by the scheduler for every member of a gang
+	// when the gang cannot be placed as a whole, or when the START
+	// commands of some of its members did not arrive in time.
+	GangFailure = "gang_failure"
+
+	// UnmetRequirements is returned by ciao-launcher when the node lacks
+	// the architecture or the hypervisor or kernel version the instance
+	// requires, e.g., because the scheduler placed the instance before
+	// the node advertised its capabilities.
+	UnmetRequirements = "unmet_requirements"
+
+	// DeadlineExceeded is returned by the scheduler when it could not
+	// place the instance before the deadline of its START command.
+	DeadlineExceeded = "deadline_exceeded"
+
+	// InvalidReservation is returned by the scheduler when the START
+	// command references a reservation that does not exist, has expired,
+	// belongs to another tenant or was held on a node that disconnected.
+	InvalidReservation = "invalid_reservation"
+
+	// PlacementRefused is returned by the scheduler when its placement
+	// extender kept none of the nodes the instance fits on, or failed
+	// while the scheduler is configured not to place instances without
+	// it.
+	PlacementRefused = "placement_refused"
+
+	// TenantNotAuthenticated is returned by the scheduler when the START
+	// command does not carry a valid token for the tenant of the
+	// instance.
+	TenantNotAuthenticated = "tenant_not_authenticated"
 )
 
 // ErrorStartFailure represents the unmarshalled version of the contents of a
@@ -109,6 +145,20 @@ func (r StartFailureReason) String() string {
 		return "Failed to launch instance"
 	case NetworkFailure:
 		return "Failed to create VNIC for instance"
+	case TenantLimitExceeded:
+		return "Tenant limit exceeded on node"
+	case GangFailure:
+		return "Gang could not be placed"
+	case UnmetRequirements:
+		return "Node does not meet the instance requirements"
+	case DeadlineExceeded:
+		return "Instance could not be placed before its deadline"
+	case InvalidReservation:
+		return "Reservation is unknown or expired"
+	case PlacementRefused:
+		return "Placement refused by site policy"
+	case TenantNotAuthenticated:
+		return "Tenant not authenticated"
 	}
 
 	return ""
@@ -23,7 +23,7 @@ type InstanceStat struct {
 	// UUID of the instance to which this stats structure pertains
 	InstanceUUID string `yaml:"instance_uuid"`
 
-	// State of the instance, e.g., running, pending, exited
+	// State of the instance, e.g., running, unhealthy, pending, exited
 	State string `yaml:"state"`
 
 	// IP address to use to connect to instance via SSH.  This
@@ -36,6 +36,11 @@ type InstanceStat struct {
 	// Will be 0 if the instance is itself a CNCI VM.
 	SSHPort int `yaml:"ssh_port"`
 
+	// IPv6 address of the CNCI VM to use to connect to the instance
+	// via SSH, on SSHPort.  Will be "" if the CNCI has no IPv6
+	// address or if the instance is itself a CNCI VM.
+	SSHIPv6 string `yaml:"ssh_ipv6,omitempty" since:"17"`
+
 	// Memory usage in MB.  May be -1 if State != Running.
 	MemoryUsageMB int `yaml:"memory_usage_mb"`
 
@@ -49,6 +54,65 @@ type InstanceStat struct {
 	// between 0 and 100% regardless of the number of VPCUs.
 	// 100% means all your VCPUs are maxed out.
 	CPUUsage int `yaml:"cpu_usage"`
+
+	// Boot phase of the instance, e.g., scheduled, launching, booting or
+	// ready.  Will be "" if State != Running and the instance is not in
+	// the process of being started.
+	BootPhase string `yaml:"boot_phase,omitempty" since:"2"`
+
+	// Usage of the filesystems mounted inside the instance, as reported
+	// by the qemu guest agent.  Only present for VM instances running the
+	// guest agent, and only if guest filesystem statistics have been
+	// enabled on the CN.
+	GuestFilesystems []GuestFilesystemStat `yaml:"guest_filesystems,omitempty" since:"2"`
+
+	// Network traffic statistics of the instance.  Only present if
+	// networking is enabled on the CN and the instance has a vnic.
+	Network *InstanceNetworkStat `yaml:"network,omitempty" since:"2"`
+
+	// Version of the security group rules applied to the instance's
+	// vnic.  0 if no rules were applied.
+	SecurityGroupVersion uint64 `yaml:"security_group_version,omitempty" since:"18"`
+
+	// Memory, in MB, reclaimed from the instance by inflating its memory
+	// balloon.  0 if the instance is not ballooned.
+	BalloonMB int `yaml:"balloon_mb,omitempty" since:"28"`
+
+	// Time at which MemoryUsageMB, DiskUsageMB and CPUUsage were sampled,
+	// in RFC 3339 format.  Busy instances are sampled more often than idle
+	// ones, so the samples of the instances of a node may be of different
+	// ages.  Will be "" if the instance has not been sampled yet.
+	SampledAt string `yaml:"sampled_at,omitempty" since:"30"`
+}
+
+// InstanceNetworkStat contains information about the network traffic sent
+// and received by an instance through its vnic.
+type InstanceNetworkStat struct {
+	// Bandwidth caps, in kbps, applied to the traffic received and sent
+	// by the instance.  0 if the traffic is not capped.
+	IngressLimitKbps int `yaml:"ingress_limit_kbps"`
+	EgressLimitKbps  int `yaml:"egress_limit_kbps"`
+
+	// Average rates, in kbps, at which the instance received and sent
+	// traffic over the last stats period.  -1 if not yet known.
+	IngressKbps int `yaml:"ingress_kbps"`
+	EgressKbps  int `yaml:"egress_kbps"`
+}
+
+// GuestFilesystemStat contains usage information about a single filesystem
+// mounted inside an instance.
+type GuestFilesystemStat struct {
+	// Mount point of the filesystem inside the instance, e.g., /
+	Mountpoint string `yaml:"mountpoint"`
+
+	// Type of the filesystem, e.g., ext4
+	Type string `yaml:"type"`
+
+	// Space used on the filesystem in MB
+	UsedMB int `yaml:"used_mb"`
+
+	// Total size of the filesystem in MB
+	TotalMB int `yaml:"total_mb"`
 }
 
 // NetworkStat contains information about a single network interface present on
@@ -56,6 +120,9 @@ type InstanceStat struct {
 type NetworkStat struct {
 	NodeIP  string `yaml:"ip"`
 	NodeMAC string `yaml:"mac"`
+
+	// Global IPv6 address of the interface, "" if it has none.
+	NodeIPv6 string `yaml:"ipv6,omitempty" since:"17"`
 }
 
 // Stat represents a snapshot of the state of a compute or a network node.  This
@@ -81,6 +148,19 @@ type Stat struct {
 	// MBs available in the RootFS of the CN/NN
 	DiskAvailableMB int `yaml:"disk_available_mb"`
 
+	// Sum of the maximum disk sizes, in MB, of all the instances on
+	// the CN/NN
+	DiskAllocatedMB int `yaml:"disk_allocated_mb" since:"2"`
+
+	// Sum of the disk space, in MB, actually consumed by the rootfs of all
+	// the instances on the CN/NN, excluding their backing images
+	DiskUsedMB int `yaml:"disk_used_mb" since:"2"`
+
+	// Size in MB of the backing images used by the instances on the
+	// CN/NN.  Each image is counted once regardless of the number of
+	// instances that share it.
+	BackingImagesMB int `yaml:"backing_images_mb" since:"2"`
+
 	// Load of CN/NN, taken from /proc/loadavg (Average over last minute
 	// reported
 	Load int `yaml:"load"`
@@ -89,16 +169,73 @@ type Stat struct {
 	// cpu[0-9]+ entries in /proc/stat
 	CpusOnline int `yaml:"cpus_online"`
 
+	// Sum of the vCPUs allocated to the instances on the CN/NN.  This
+	// may exceed CpusOnline if the node overcommits its CPUs.
+	VCPUsAllocated int `yaml:"vcpus_allocated" since:"2"`
+
+	// CPU pressure of the CN/NN, i.e., the percentage of time over the
+	// last minute during which at least one runnable task was stalled
+	// waiting for a CPU.  Taken from the "some" avg60 entry of
+	// /proc/pressure/cpu.  Will be -1 if the kernel does not provide
+	// pressure stall information.
+	CPUPressure float64 `yaml:"cpu_pressure" since:"2"`
+
+	// Number of GPUs present on the CN/NN that can be passed through to
+	// an instance.
+	GPUsTotal int `yaml:"gpus_total" since:"2"`
+
+	// Number of GPUs not currently assigned to an instance.
+	GPUsAvailable int `yaml:"gpus_available" since:"2"`
+
+	// Number of host CPU cores the CN/NN can dedicate to instances.
+	DedicatedCoresTotal int `yaml:"dedicated_cores_total" since:"3"`
+
+	// Number of dedicated CPU cores not currently assigned to an
+	// instance.
+	DedicatedCoresAvailable int `yaml:"dedicated_cores_available" since:"3"`
+
+	// Disk IOPS the CN/NN can guarantee to its instances.  Will be -1 if
+	// the capacity of the node disks is not known.
+	DiskIOPSTotal int `yaml:"disk_iops_total" since:"3"`
+
+	// Disk IOPS not currently reserved by an instance.
+	DiskIOPSAvailable int `yaml:"disk_iops_available" since:"3"`
+
+	// Network bandwidth of the CN/NN in kbps, in each direction.  Will
+	// be -1 if the bandwidth of the node is not known.
+	NetBandwidthKbps int `yaml:"net_bandwidth_kbps" since:"3"`
+
+	// Ingress bandwidth, in kbps, not currently reserved by an instance.
+	NetIngressKbpsAvailable int `yaml:"net_ingress_kbps_available" since:"3"`
+
+	// Egress bandwidth, in kbps, not currently reserved by an instance.
+	NetEgressKbpsAvailable int `yaml:"net_egress_kbps_available" since:"3"`
+
+	// Power drawn by the CPU packages of the CN/NN in watts, averaged
+	// since the previous sample.  Will be -1 if it is not known.
+	PowerWatts int `yaml:"power_watts" since:"27"`
+
+	// Temperature of the hottest CPU sensor of the CN/NN in degrees
+	// Celsius.  Will be -1 if it is not known.
+	CPUTemperatureC int `yaml:"cpu_temperature_c" since:"27"`
+
+	// Memory pressure of the CN/NN, as reported in READY payloads.  Will
+	// be -1 if the kernel does not provide pressure stall information.
+	MemPressure float64 `yaml:"mem_pressure" since:"29"`
+
 	// Hostname of the CN/NN
 	NodeHostName string `yaml:"hostname"`
 
 	// Array containing one entry for each network interface present on the
 	// CN/NN
-	Networks []NetworkStat
+	Networks []NetworkStat `yaml:"networks"`
 
 	// Array containing statistics information for each instance hosted by
 	// the CN/NN
-	Instances []InstanceStat
+	Instances []InstanceStat `yaml:"instances"`
+
+	// UUIDs of the backing images present in the image cache of the CN/NN
+	CachedImages []string `yaml:"cached_images,omitempty" since:"2"`
 }
 
 const (
@@ -122,6 +259,24 @@ const (
 	ExitPaused = "exit_paused"
 )
 
+const (
+	// BootScheduled indicates that ciao-launcher has accepted a START
+	// command for an instance but has not yet started to process it.
+	BootScheduled = "scheduled"
+
+	// BootLaunching indicates that ciao-launcher is creating the
+	// instance's images and launching the VM or container.
+	BootLaunching = "launching"
+
+	// BootBooting indicates that the VM or container is running but that
+	// ciao-launcher has not yet been able to contact its guest agent or
+	// SSH server.
+	BootBooting = "booting"
+
+	// BootReady indicates that the instance is running and usable.
+	BootReady = "ready"
+)
+
 // Init initialises instances of the Stat structure.
 func (s *Stat) Init() {
 	s.NodeUUID = ""
@@ -129,6 +284,23 @@ func (s *Stat) Init() {
 	s.MemAvailableMB = -1
 	s.DiskTotalMB = -1
 	s.DiskAvailableMB = -1
+	s.DiskAllocatedMB = -1
+	s.DiskUsedMB = -1
+	s.BackingImagesMB = -1
 	s.Load = -1
 	s.CpusOnline = -1
+	s.VCPUsAllocated = -1
+	s.CPUPressure = -1
+	s.GPUsTotal = -1
+	s.GPUsAvailable = -1
+	s.DedicatedCoresTotal = -1
+	s.DedicatedCoresAvailable = -1
+	s.DiskIOPSTotal = -1
+	s.DiskIOPSAvailable = -1
+	s.NetBandwidthKbps = -1
+	s.NetIngressKbpsAvailable = -1
+	s.NetEgressKbpsAvailable = -1
+	s.PowerWatts = -1
+	s.CPUTemperatureC = -1
+	s.MemPressure = -1
 }
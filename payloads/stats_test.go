@@ -112,6 +112,8 @@ disk_total_mb: 500000
 disk_available_mb: 256000
 load: 0
 cpus_online: 4
+vcpus_allocated: 6
+cpu_pressure: 1.5
 hostname: test
 networks:
   - ip: 192.168.1.1
@@ -131,6 +133,8 @@ networks:
 		DiskAvailableMB: 256000,
 		Load:            0,
 		CpusOnline:      4,
+		VCPUsAllocated:  6,
+		CPUPressure:     1.5,
 		NodeHostName:    "test",
 		Networks: []NetworkStat{
 			{
@@ -146,6 +150,8 @@ networks:
 		cmd.DiskAvailableMB != expectedCmd.DiskAvailableMB ||
 		cmd.Load != expectedCmd.Load ||
 		cmd.CpusOnline != expectedCmd.CpusOnline ||
+		cmd.VCPUsAllocated != expectedCmd.VCPUsAllocated ||
+		cmd.CPUPressure != expectedCmd.CPUPressure ||
 		cmd.NodeHostName != expectedCmd.NodeHostName ||
 		len(cmd.Networks) != 1 ||
 		cmd.Networks[0] != expectedCmd.Networks[0] ||
@@ -176,8 +182,15 @@ load: 1
 		MemAvailableMB:  -1,
 		DiskTotalMB:     -1,
 		DiskAvailableMB: -1,
+		DiskAllocatedMB: -1,
+		DiskUsedMB:      -1,
+		BackingImagesMB: -1,
 		Load:            1,
 		CpusOnline:      -1,
+		VCPUsAllocated:  -1,
+		CPUPressure:     -1,
+		GPUsTotal:       -1,
+		GPUsAvailable:   -1,
 	}
 	if cmd.NodeUUID != expectedCmd.NodeUUID ||
 		cmd.MemTotalMB != expectedCmd.MemTotalMB ||
@@ -185,8 +198,16 @@ load: 1
 		cmd.DiskTotalMB != expectedCmd.DiskTotalMB ||
 		cmd.DiskAvailableMB != expectedCmd.DiskAvailableMB ||
 		cmd.Load != expectedCmd.Load ||
+		cmd.DiskAllocatedMB != expectedCmd.DiskAllocatedMB ||
+		cmd.DiskUsedMB != expectedCmd.DiskUsedMB ||
+		cmd.BackingImagesMB != expectedCmd.BackingImagesMB ||
 		cmd.CpusOnline != expectedCmd.CpusOnline ||
+		cmd.VCPUsAllocated != expectedCmd.VCPUsAllocated ||
+		cmd.CPUPressure != expectedCmd.CPUPressure ||
+		cmd.GPUsTotal != expectedCmd.GPUsTotal ||
+		cmd.GPUsAvailable != expectedCmd.GPUsAvailable ||
 		cmd.NodeHostName != expectedCmd.NodeHostName ||
+		cmd.PowerWatts != -1 || cmd.CPUTemperatureC != -1 ||
 		cmd.Networks != nil ||
 		cmd.Instances != nil {
 		t.Error("Unexpected values in Stat")
@@ -194,3 +215,89 @@ load: 1
 
 	fmt.Println(cmd)
 }
+
+func TestStatsCachedImages(t *testing.T) {
+	statsYaml := `node_uuid: 2400bce6-ccc8-4a45-b2aa-b5cc3790077b
+cached_images:
+  - b286cd45-7d0c-4525-a140-4db6c95e41fa
+  - 59460b8a-5f53-4e3e-b5ce-b71fed8c7e64
+`
+	var cmd Stat
+	cmd.Init()
+
+	err := yaml.Unmarshal([]byte(statsYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(cmd.CachedImages) != 2 ||
+		cmd.CachedImages[0] != "b286cd45-7d0c-4525-a140-4db6c95e41fa" ||
+		cmd.CachedImages[1] != "59460b8a-5f53-4e3e-b5ce-b71fed8c7e64" {
+		t.Errorf("Unexpected cached images %v", cmd.CachedImages)
+	}
+}
+
+func TestStatsGuestFilesystems(t *testing.T) {
+	statsYaml := `node_uuid: 2400bce6-ccc8-4a45-b2aa-b5cc3790077b
+instances:
+  - instance_uuid: fe2970fa-7b36-460b-8b79-9eb4745e62f2
+    state: running
+    guest_filesystems:
+      - mountpoint: /
+        type: ext4
+        used_mb: 1024
+        total_mb: 4096
+`
+	var cmd Stat
+	cmd.Init()
+
+	err := yaml.Unmarshal([]byte(statsYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(cmd.Instances) != 1 || len(cmd.Instances[0].GuestFilesystems) != 1 {
+		t.Fatalf("Unexpected instances %v", cmd.Instances)
+	}
+
+	fs := cmd.Instances[0].GuestFilesystems[0]
+	if fs.Mountpoint != "/" || fs.Type != "ext4" || fs.UsedMB != 1024 || fs.TotalMB != 4096 {
+		t.Errorf("Unexpected guest filesystem %+v", fs)
+	}
+}
+
+func TestStatsInstanceNetwork(t *testing.T) {
+	statsYaml := `node_uuid: 2400bce6-ccc8-4a45-b2aa-b5cc3790077b
+instances:
+  - instance_uuid: fe2970fa-7b36-460b-8b79-9eb4745e62f2
+    state: running
+    network:
+      ingress_limit_kbps: 10000
+      egress_limit_kbps: 0
+      ingress_kbps: 512
+      egress_kbps: 128
+  - instance_uuid: 3390740c-dce9-48d6-b83a-a717417072ce
+    state: running
+`
+	var cmd Stat
+	cmd.Init()
+
+	err := yaml.Unmarshal([]byte(statsYaml), &cmd)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(cmd.Instances) != 2 || cmd.Instances[0].Network == nil {
+		t.Fatalf("Unexpected instances %v", cmd.Instances)
+	}
+
+	net := cmd.Instances[0].Network
+	if net.IngressLimitKbps != 10000 || net.EgressLimitKbps != 0 ||
+		net.IngressKbps != 512 || net.EgressKbps != 128 {
+		t.Errorf("Unexpected network stats %+v", net)
+	}
+
+	if cmd.Instances[1].Network != nil {
+		t.Errorf("Network stats not expected %+v", cmd.Instances[1].Network)
+	}
+}
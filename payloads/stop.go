@@ -25,6 +25,10 @@ type StopCmd struct {
 	// running.  This information is needed by the scheduler to route
 	// the command to the correct CN/NN.
 	WorkloadAgentUUID string `yaml:"workload_agent_uuid"`
+
+	// TenantToken authenticates the tenant of the instance, see
+	// StartCmd.TenantToken.
+	TenantToken string `yaml:"tenant_token,omitempty" since:"19"`
 }
 
 // Stop represents the unmarshalled version of the contents of a SSNTP STOP
@@ -40,6 +40,11 @@ const (
 	// is not currently running, e.g., it's status is either exited or
 	// pending.
 	StopAlreadyStopped = "already_stopped"
+
+	// StopTenantNotAuthenticated is returned by the scheduler when the
+	// STOP command does not carry a valid token for the tenant of the
+	// instance.
+	StopTenantNotAuthenticated = "tenant_not_authenticated"
 )
 
 // ErrorStopFailure represents the unmarshalled version of the contents of a
@@ -63,6 +68,8 @@ func (r StopFailureReason) String() string {
 		return "Command section of YAML payload is corrupt or missing required information"
 	case StopAlreadyStopped:
 		return "Instance has already shut down"
+	case StopTenantNotAuthenticated:
+		return "Tenant not authenticated"
 	}
 
 	return ""
@@ -0,0 +1,93 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import "fmt"
+
+// TenantNetwork describes the network of a tenant on a node: the bridge
+// its instances are attached to and the tunnel to its concentrator.
+type TenantNetwork struct {
+	// The UUID of the tenant.
+	TenantUUID string `yaml:"tenant_uuid"`
+
+	// The subnet of the tenant.
+	TenantSubnet string `yaml:"tenant_subnet"`
+
+	// The UUID of the concentrator.
+	ConcentratorUUID string `yaml:"concentrator_uuid"`
+
+	// The IP address of the concentrator.
+	ConcentratorIP string `yaml:"concentrator_ip"`
+
+	// Tunnel is true if the tunnel to the concentrator is present.
+	Tunnel bool `yaml:"tunnel"`
+}
+
+// TenantNetworksReport lists the tenant networks active on a node.
+type TenantNetworksReport struct {
+	// The UUID of the ciao-launcher that generated the report.
+	AgentUUID string `yaml:"agent_uuid"`
+
+	// Networks lists the tenant networks present on the node.
+	Networks []TenantNetwork `yaml:"networks"`
+}
+
+// EventTenantNetworksReport represents the unmarshalled version of the
+// contents of a SSNTP TenantNetworksReport event.  Launchers periodically
+// send it to the scheduler, which checks it against the TenantAdded and
+// TenantRemoved events the node sent.
+type EventTenantNetworksReport struct {
+	Report TenantNetworksReport `yaml:"tenant_networks_report"`
+}
+
+// Validate checks that the report and each of its networks are
+// identified.
+func (e *EventTenantNetworksReport) Validate() error {
+	var errs ValidationError
+
+	errs.required("tenant_networks_report.agent_uuid", e.Report.AgentUUID)
+	for i, n := range e.Report.Networks {
+		errs.required(fmt.Sprintf("tenant_networks_report.networks[%d].tenant_uuid", i), n.TenantUUID)
+		errs.required(fmt.Sprintf("tenant_networks_report.networks[%d].concentrator_uuid", i), n.ConcentratorUUID)
+	}
+
+	return errs.err()
+}
+
+// TenantNetworkDrift lists the differences between the tenant networks
+// a node reports and those its TenantAdded and TenantRemoved events
+// announced.
+type TenantNetworkDrift struct {
+	// The UUID of the ciao-launcher whose networks drifted.
+	AgentUUID string `yaml:"agent_uuid"`
+
+	// Orphaned lists the tenant networks present on the node that
+	// were never announced, or that were announced as removed.
+	Orphaned []TenantNetwork `yaml:"orphaned,omitempty"`
+
+	// Missing lists the tenant networks announced as added that the
+	// node does not report, or reports without their tunnel.
+	Missing []TenantNetwork `yaml:"missing,omitempty"`
+}
+
+// EventTenantNetworkDrift represents the unmarshalled version of the
+// contents of a SSNTP TenantNetworkDrift event.  The scheduler sends it to
+// the controllers when the tenant networks of a node drift from what the
+// node announced in two consecutive reports.
+type EventTenantNetworkDrift struct {
+	Drift TenantNetworkDrift `yaml:"tenant_network_drift"`
+}
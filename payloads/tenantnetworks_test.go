@@ -0,0 +1,128 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const tenantNetworksReportYaml = "" +
+	"tenant_networks_report:\n" +
+	"  agent_uuid: " + agentUUID + "\n" +
+	"  networks:\n" +
+	"  - tenant_uuid: " + tenantUUID + "\n" +
+	"    tenant_subnet: " + tenantSubnet + "\n" +
+	"    concentrator_uuid: " + cnciUUID + "\n" +
+	"    concentrator_ip: " + cnciIP + "\n" +
+	"    tunnel: true\n"
+
+const tenantNetworkDriftYaml = "" +
+	"tenant_network_drift:\n" +
+	"  agent_uuid: " + agentUUID + "\n" +
+	"  missing:\n" +
+	"  - tenant_uuid: " + tenantUUID + "\n" +
+	"    tenant_subnet: " + tenantSubnet + "\n" +
+	"    concentrator_uuid: " + cnciUUID + "\n" +
+	"    concentrator_ip: " + cnciIP + "\n" +
+	"    tunnel: false\n"
+
+func testTenantNetwork(tunnel bool) TenantNetwork {
+	return TenantNetwork{
+		TenantUUID:       tenantUUID,
+		TenantSubnet:     tenantSubnet,
+		ConcentratorUUID: cnciUUID,
+		ConcentratorIP:   cnciIP,
+		Tunnel:           tunnel,
+	}
+}
+
+func TestTenantNetworksReportUnmarshal(t *testing.T) {
+	var event EventTenantNetworksReport
+	err := yaml.Unmarshal([]byte(tenantNetworksReportYaml), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Validate(&event); err != nil {
+		t.Errorf("Valid TenantNetworksReport payload rejected: %v", err)
+	}
+
+	r := event.Report
+	if r.AgentUUID != agentUUID || len(r.Networks) != 1 || r.Networks[0] != testTenantNetwork(true) {
+		t.Errorf("Wrong TenantNetworksReport fields %+v", r)
+	}
+}
+
+func TestTenantNetworksReportMarshal(t *testing.T) {
+	event := EventTenantNetworksReport{
+		Report: TenantNetworksReport{
+			AgentUUID: agentUUID,
+			Networks:  []TenantNetwork{testTenantNetwork(true)},
+		},
+	}
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != tenantNetworksReportYaml {
+		t.Errorf("TenantNetworksReport marshalling failed\n[%s]\n vs\n[%s]", string(y), tenantNetworksReportYaml)
+	}
+}
+
+func TestValidateTenantNetworksReport(t *testing.T) {
+	event := EventTenantNetworksReport{
+		Report: TenantNetworksReport{
+			Networks: []TenantNetwork{testTenantNetwork(true), {TenantUUID: tenantUUID}},
+		},
+	}
+
+	fields := testFields(Validate(&event))
+	for _, f := range []string{
+		"tenant_networks_report.agent_uuid",
+		"tenant_networks_report.networks[1].concentrator_uuid",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+
+	if fields["tenant_networks_report.networks[0].concentrator_uuid"] {
+		t.Errorf("Valid network reported as invalid")
+	}
+}
+
+func TestTenantNetworkDriftMarshal(t *testing.T) {
+	event := EventTenantNetworkDrift{
+		Drift: TenantNetworkDrift{
+			AgentUUID: agentUUID,
+			Missing:   []TenantNetwork{testTenantNetwork(false)},
+		},
+	}
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != tenantNetworkDriftYaml {
+		t.Errorf("TenantNetworkDrift marshalling failed\n[%s]\n vs\n[%s]", string(y), tenantNetworkDriftYaml)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// TopologyController is a controller connected to the scheduler.
+type TopologyController struct {
+	UUID string `yaml:"uuid"`
+
+	// Status is MASTER for the controller the scheduler takes commands
+	// from, and BACKUP for the others.
+	Status string `yaml:"status"`
+}
+
+// TopologyNode is a compute or network node connected to the scheduler,
+// with the resources it has left.  The available resources account for
+// the instances placed on the node since its last READY.  Resources the
+// node does not report are -1.
+type TopologyNode struct {
+	NodeUUID string `yaml:"node_uuid"`
+
+	// NodeType is ComputeNode or NetworkNode.
+	NodeType Resource `yaml:"node_type"`
+
+	// Status is the last SSNTP status the node reported.
+	Status string `yaml:"status"`
+
+	MemTotalMB              int `yaml:"mem_total_mb"`
+	MemAvailableMB          int `yaml:"mem_available_mb"`
+	Load                    int `yaml:"load"`
+	CpusOnline              int `yaml:"cpus_online"`
+	GPUsAvailable           int `yaml:"gpus_available"`
+	DedicatedCoresAvailable int `yaml:"dedicated_cores_available"`
+	DiskIOPSAvailable       int `yaml:"disk_iops_available"`
+	NetIngressKbpsAvailable int `yaml:"net_ingress_kbps_available"`
+	NetEgressKbpsAvailable  int `yaml:"net_egress_kbps_available"`
+	CNCIsAvailable          int `yaml:"cncis_available"`
+	PublicIPsAvailable      int `yaml:"public_ips_available"`
+
+	// Capabilities are the capabilities the node advertised, with its
+	// availability zone, failure domain and labels.  They are nil until
+	// the node sends its NodeCapabilities event.
+	Capabilities *NodeCapabilities `yaml:"capabilities,omitempty"`
+
+	// Draining is true when the scheduler no longer places instances on
+	// the node, e.g., before powering it down or upgrading it.
+	Draining bool `yaml:"draining,omitempty"`
+}
+
+// ClusterTopologyEvent is the view the scheduler has of the cluster, sorted
+// by UUID.
+type ClusterTopologyEvent struct {
+	Controllers  []TopologyController `yaml:"controllers"`
+	ComputeNodes []TopologyNode       `yaml:"compute_nodes"`
+	NetworkNodes []TopologyNode       `yaml:"network_nodes"`
+}
+
+// ClusterTopology represents the unmarshalled version of the contents of a
+// SSNTP ClusterTopology event.  The scheduler sends it to a Controller in
+// reply to a TOPOLOGY command.
+type ClusterTopology struct {
+	Topology ClusterTopologyEvent `yaml:"cluster_topology"`
+}
@@ -0,0 +1,117 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const clusterTopologyYaml = "" +
+	"cluster_topology:\n" +
+	"  controllers:\n" +
+	"  - uuid: " + tenantUUID + "\n" +
+	"    status: MASTER\n" +
+	"  compute_nodes:\n" +
+	"  - node_uuid: " + agentUUID + "\n" +
+	"    node_type: compute_node\n" +
+	"    status: READY\n" +
+	"    mem_total_mb: 4096\n" +
+	"    mem_available_mb: 3072\n" +
+	"    load: 1\n" +
+	"    cpus_online: 8\n" +
+	"    gpus_available: -1\n" +
+	"    dedicated_cores_available: -1\n" +
+	"    disk_iops_available: -1\n" +
+	"    net_ingress_kbps_available: -1\n" +
+	"    net_egress_kbps_available: -1\n" +
+	"    cncis_available: -1\n" +
+	"    public_ips_available: -1\n" +
+	"    capabilities:\n" +
+	"      node_uuid: " + agentUUID + "\n" +
+	"      hypervisors:\n" +
+	"      - type: qemu\n" +
+	"      failure_domain:\n" +
+	"        zone: az1\n" +
+	"      labels:\n" +
+	"        pool: batch\n" +
+	"  network_nodes: []\n"
+
+func TestClusterTopologyMarshal(t *testing.T) {
+	event := ClusterTopology{
+		Topology: ClusterTopologyEvent{
+			Controllers: []TopologyController{{UUID: tenantUUID, Status: "MASTER"}},
+			ComputeNodes: []TopologyNode{
+				{
+					NodeUUID:                agentUUID,
+					NodeType:                ComputeNode,
+					Status:                  "READY",
+					MemTotalMB:              4096,
+					MemAvailableMB:          3072,
+					Load:                    1,
+					CpusOnline:              8,
+					GPUsAvailable:           -1,
+					DedicatedCoresAvailable: -1,
+					DiskIOPSAvailable:       -1,
+					NetIngressKbpsAvailable: -1,
+					NetEgressKbpsAvailable:  -1,
+					CNCIsAvailable:          -1,
+					PublicIPsAvailable:      -1,
+					Capabilities: &NodeCapabilities{
+						NodeUUID:      agentUUID,
+						Hypervisors:   []HypervisorCapability{{Type: QEMU}},
+						FailureDomain: &FailureDomain{Zone: "az1"},
+						Labels:        map[string]string{"pool": "batch"},
+					},
+				},
+			},
+			NetworkNodes: []TopologyNode{},
+		},
+	}
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != clusterTopologyYaml {
+		t.Errorf("ClusterTopology marshalling failed\n[%s]\n vs\n[%s]", string(y), clusterTopologyYaml)
+	}
+}
+
+func TestClusterTopologyUnmarshal(t *testing.T) {
+	var event ClusterTopology
+	err := yaml.Unmarshal([]byte(clusterTopologyYaml), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topology := event.Topology
+	if len(topology.Controllers) != 1 || len(topology.ComputeNodes) != 1 ||
+		len(topology.NetworkNodes) != 0 {
+		t.Fatalf("Wrong ClusterTopology fields %+v", topology)
+	}
+
+	node := topology.ComputeNodes[0]
+	if node.NodeType != ComputeNode || node.MemAvailableMB != 3072 ||
+		node.GPUsAvailable != -1 || node.Capabilities == nil ||
+		node.Capabilities.FailureDomain.Zone != "az1" ||
+		node.Capabilities.Labels["pool"] != "batch" {
+		t.Errorf("Wrong ClusterTopology node %+v", node)
+	}
+}
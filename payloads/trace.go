@@ -28,17 +28,60 @@ type SSNTPNode struct {
 // FrameTrace captures trace information for an SSNTP frame
 // as it makes its way through a SSNTP cluster.
 type FrameTrace struct {
-	Label          string `yaml:"label"`
-	Type           string `yaml:"type"`
-	Operand        string `yaml:"operand"`
-	StartTimestamp string `yaml:"start_timestamp"`
-	EndTimestamp   string `yaml:"end_timestamp"`
-	Nodes          []SSNTPNode
+	Label          string      `yaml:"label"`
+	TraceID        string      `yaml:"trace_id,omitempty" since:"6"`
+	SpanID         string      `yaml:"span_id,omitempty" since:"6"`
+	Type           string      `yaml:"type"`
+	Operand        string      `yaml:"operand"`
+	StartTimestamp string      `yaml:"start_timestamp"`
+	EndTimestamp   string      `yaml:"end_timestamp"`
+	Nodes          []SSNTPNode `yaml:"nodes"`
+}
+
+// LaunchTrace breaks the launch of a traced instance down into its
+// phases, from the controller receiving the request to the guest being
+// ready.  All durations are in milliseconds.
+type LaunchTrace struct {
+	InstanceUUID string `yaml:"instance_uuid"`
+	TraceID      string `yaml:"trace_id,omitempty"`
+
+	// ControllerQueueMS is the time between the controller receiving the
+	// request and sending the START command.
+	ControllerQueueMS int `yaml:"controller_queue_ms"`
+
+	// SchedulerMS is the time the scheduler took to pick a node and
+	// forward the START command to it.
+	SchedulerMS int `yaml:"scheduler_ms"`
+
+	// TransitMS is the time the START command spent on the wire.
+	TransitMS int `yaml:"transit_ms"`
+
+	// LauncherQueueMS is the time the START command waited in the
+	// launcher, e.g. for a launch slot.
+	LauncherQueueMS int `yaml:"launcher_queue_ms"`
+
+	// ImagePrepMS is the time taken to prepare the instance image, its
+	// network and its VM or container.
+	ImagePrepMS int `yaml:"image_prep_ms"`
+
+	// BootMS is the time between starting the VM or container and the
+	// launcher connecting to it.
+	BootMS int `yaml:"boot_ms"`
+
+	// GuestReadyMS is the time between the launcher connecting to the
+	// instance and its readiness probe succeeding.
+	GuestReadyMS int `yaml:"guest_ready_ms"`
+
+	// TotalMS is the time between the controller receiving the request
+	// and the guest being ready.
+	TotalMS int `yaml:"total_ms"`
 }
 
 // Trace represents the unmarshalled version of the contents of an SSNTP
 // ssntp.TraceReport event.  The structure contains tracing information
-// for an SSNTP frame.
+// for an SSNTP frame, and the phase breakdowns of the traced instance
+// launches that completed since the last report.
 type Trace struct {
-	Frames []FrameTrace
+	Frames   []FrameTrace  `yaml:"frames"`
+	Launches []LaunchTrace `yaml:"launches,omitempty" since:"25"`
 }
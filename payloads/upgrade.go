@@ -0,0 +1,54 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// UpgradeProgress reports the state of the compute nodes during a rolling
+// upgrade.  Each list contains node UUIDs.
+type UpgradeProgress struct {
+	// The software version the nodes are upgraded to.
+	TargetVersion string `yaml:"target_version"`
+
+	// Upgraded lists the nodes running the target version.
+	Upgraded []string `yaml:"upgraded,omitempty"`
+
+	// Outdated lists the nodes waiting to be drained, or whose software
+	// version is not known yet.
+	Outdated []string `yaml:"outdated,omitempty"`
+
+	// Draining lists the nodes drained for their upgrade that still run
+	// instances.
+	Draining []string `yaml:"draining,omitempty"`
+
+	// Drained lists the nodes drained for their upgrade without any
+	// instance left, which can be upgraded.
+	Drained []string `yaml:"drained,omitempty"`
+
+	// Upgrading lists the drained nodes that disconnected, presumably to
+	// be upgraded, and did not reconnect yet.
+	Upgrading []string `yaml:"upgrading,omitempty"`
+
+	// Done is true once all the nodes run the target version.
+	Done bool `yaml:"done"`
+}
+
+// EventUpgradeProgress represents the unmarshalled version of the contents
+// of a SSNTP UpgradeProgress event.  The scheduler sends it to the
+// controllers each time the state of a node changes during a rolling
+// upgrade.
+type EventUpgradeProgress struct {
+	Progress UpgradeProgress `yaml:"upgrade_progress"`
+}
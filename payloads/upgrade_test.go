@@ -0,0 +1,65 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+const upgradeProgressYaml = "" +
+	"upgrade_progress:\n" +
+	"  target_version: 1.2.0\n" +
+	"  upgraded:\n" +
+	"  - " + agentUUID + "\n" +
+	"  drained:\n" +
+	"  - " + evacAgentUUID + "\n" +
+	"  done: false\n"
+
+func TestUpgradeProgressMarshal(t *testing.T) {
+	event := EventUpgradeProgress{
+		Progress: UpgradeProgress{
+			TargetVersion: "1.2.0",
+			Upgraded:      []string{agentUUID},
+			Drained:       []string{evacAgentUUID},
+		},
+	}
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(y) != upgradeProgressYaml {
+		t.Errorf("UpgradeProgress marshalling failed\n[%s]\n vs\n[%s]", string(y), upgradeProgressYaml)
+	}
+}
+
+func TestUpgradeProgressUnmarshal(t *testing.T) {
+	var event EventUpgradeProgress
+	err := yaml.Unmarshal([]byte(upgradeProgressYaml), &event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := event.Progress
+	if p.TargetVersion != "1.2.0" || len(p.Upgraded) != 1 || len(p.Drained) != 1 ||
+		len(p.Outdated) != 0 || p.Done {
+		t.Errorf("Wrong UpgradeProgress fields %+v", p)
+	}
+}
@@ -0,0 +1,545 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// FieldError describes why the value of a payload field is invalid.
+type FieldError struct {
+	// Field is the path of the invalid field, made of the YAML names of
+	// the field and of the structures and lists that contain it, e.g.,
+	// start.requested_resources[0].value.  It is empty when the
+	// payload as a whole is invalid, e.g., when it cannot be unmarshalled.
+	Field string `yaml:"field,omitempty"`
+
+	// Reason explains why the field value is invalid.
+	Reason string `yaml:"reason"`
+}
+
+func (e FieldError) Error() string {
+	if e.Field == "" {
+		return e.Reason
+	}
+
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// ValidationError is returned by the payload Validate methods.  It lists
+// all the invalid fields of the payload.
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	errors := make([]string, len(e))
+	for i := range e {
+		errors[i] = e[i].Error()
+	}
+
+	return strings.Join(errors, "; ")
+}
+
+// Validator is implemented by the payloads that can check their own
+// field values once unmarshalled.
+type Validator interface {
+	// Validate returns a ValidationError describing all the invalid
+	// fields of the payload, or nil if the payload is valid.
+	Validate() error
+}
+
+// Validate checks the field values of the unmarshalled payload v.  It
+// returns nil for valid payloads and for payloads that do not implement
+// Validator, and a ValidationError otherwise.
+func Validate(v interface{}) error {
+	validator, ok := v.(Validator)
+	if !ok {
+		return nil
+	}
+
+	return validator.Validate()
+}
+
+// FieldErrors returns the invalid fields described by err.  Errors that are
+// not ValidationErrors, e.g., unmarshalling errors, are returned as a
+// single FieldError applying to the whole payload.
+func FieldErrors(err error) []FieldError {
+	if err == nil {
+		return nil
+	}
+
+	if errs, ok := err.(ValidationError); ok {
+		return errs
+	}
+
+	return []FieldError{{Reason: err.Error()}}
+}
+
+func (e *ValidationError) add(field string, format string, args ...interface{}) {
+	*e = append(*e, FieldError{
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+func (e *ValidationError) required(field string, value string) {
+	if value == "" {
+		e.add(field, "is required")
+	}
+}
+
+// ipv6 checks that value, if given, is an IPv6 address.
+func (e *ValidationError) ipv6(field string, value string) {
+	if value == "" {
+		return
+	}
+
+	if ip := net.ParseIP(value); ip == nil || ip.To4() != nil {
+		e.add(field, "%s is not an IPv6 address", value)
+	}
+}
+
+func (e ValidationError) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+func validateResources(errs *ValidationError, field string, resources []RequestedResource) {
+	for i, r := range resources {
+		path := fmt.Sprintf("%s[%d].value", field, i)
+
+		switch r.Type {
+		case MemMB:
+			if r.Value <= 0 {
+				errs.add(path, "mem_mb (%d) must be > 0", r.Value)
+			}
+		case NetworkNode, ComputeNode, Hugepages:
+			if r.Value != 0 && r.Value != 1 {
+				errs.add(path, "%s (%d) is not 0 or 1", r.Type, r.Value)
+			}
+		default:
+			if r.Value < 0 {
+				errs.add(path, "%s (%d) must be >= 0", r.Type, r.Value)
+			}
+		}
+	}
+}
+
+func hasResource(resources []RequestedResource, resource Resource) bool {
+	for _, r := range resources {
+		if r.Type == resource {
+			return true
+		}
+	}
+
+	return false
+}
+
+func hasResourceValue(resources []RequestedResource, resource Resource, value int) bool {
+	for _, r := range resources {
+		if r.Type == resource && r.Value == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Validate checks that the instance and tenant are identified, that the
+// instance has an image to boot from and that the requested resources
+// values are in range.  A mem_mb resource is required, unless the resources
+// are left to the flavor the instance references.  The IPv6 networking
+// resources, if any, must be IPv6 addresses and subnets.
+func (s *Start) Validate() error {
+	var errs ValidationError
+
+	errs.required("start.instance_uuid", s.Start.InstanceUUID)
+	errs.required("start.tenant_uuid", s.Start.TenantUUID)
+
+	switch s.Start.VMType {
+	case Docker:
+		errs.required("start.docker_image", s.Start.DockerImage)
+	case KataContainer:
+		errs.required("start.docker_image", s.Start.DockerImage)
+	case "", QEMU, CloudHypervisor:
+		errs.required("start.image_uuid", s.Start.ImageUUID)
+	default:
+		errs.add("start.vm_type", "unknown hypervisor %s", s.Start.VMType)
+	}
+
+	flavored := s.Start.FlavorUUID != "" && len(s.Start.RequestedResources) == 0
+	if !flavored && !hasResource(s.Start.RequestedResources, MemMB) {
+		errs.add("start.requested_resources", "no %s resource", MemMB)
+	}
+	validateResources(&errs, "start.requested_resources", s.Start.RequestedResources)
+
+	if gang := s.Start.Gang; gang != nil {
+		errs.required("start.gang.id", gang.ID)
+		if gang.Size < 1 {
+			errs.add("start.gang.size", "gang size (%d) must be >= 1", gang.Size)
+		}
+		if hasResourceValue(s.Start.RequestedResources, NetworkNode, 1) {
+			errs.add("start.gang", "network node instances can not be gang members")
+		}
+	}
+
+	if req := s.Start.Requirements; req != nil {
+		for i, flag := range req.CPUFlags {
+			errs.required(fmt.Sprintf("start.requirements.cpu_flags[%d]", i), flag)
+		}
+		if req.HugepageSizeKB < 0 {
+			errs.add("start.requirements.hugepage_size_kb",
+				"hugepage size (%d) must be >= 0", req.HugepageSizeKB)
+		}
+		switch req.StorageBackend {
+		case "", LocalStorage, EncryptedStorage:
+		default:
+			errs.add("start.requirements.storage_backend",
+				"unknown storage backend %s", req.StorageBackend)
+		}
+		for _, v := range []struct {
+			field   string
+			version string
+		}{
+			{"start.requirements.min_hypervisor_version", req.MinHypervisorVersion},
+			{"start.requirements.min_kernel_version", req.MinKernelVersion},
+		} {
+			if v.version != "" && len(parseVersion(v.version)) == 0 {
+				errs.add(v.field, "invalid version %s", v.version)
+			}
+		}
+	}
+
+	validateIPv6Networking(&errs, "start.networking", &s.Start.Networking)
+
+	if _, ok := s.Start.DeadlineTime(); s.Start.Deadline != "" && !ok {
+		errs.add("start.deadline", "invalid RFC 3339 time %s", s.Start.Deadline)
+	}
+
+	if s.Start.ReservationID != "" && s.Start.Gang != nil {
+		errs.add("start.reservation_id", "gang members can not use reservations")
+	}
+
+	if s.Start.Backfill && (s.Start.Gang != nil || s.Start.ReservationID != "") {
+		errs.add("start.backfill", "gang members and reserved instances can not be backfill instances")
+	}
+
+	if len(s.Start.Volumes) > 0 && s.Start.VMType != Docker {
+		errs.add("start.volumes", "volumes are only supported for docker instances")
+	}
+	for i := range s.Start.Volumes {
+		validateVolume(&errs, fmt.Sprintf("start.volumes[%d]", i), &s.Start.Volumes[i])
+	}
+
+	if auth := s.Start.RegistryAuth; auth != nil {
+		if s.Start.VMType != Docker && s.Start.VMType != KataContainer {
+			errs.add("start.registry_auth", "registry credentials are only supported for container instances")
+		}
+		errs.required("start.registry_auth.username", auth.Username)
+		errs.required("start.registry_auth.password", auth.Password)
+	}
+
+	if hc := s.Start.HealthCheck; hc != nil {
+		if s.Start.VMType != Docker {
+			errs.add("start.health_check", "health checks are only supported for docker instances")
+		}
+		for _, f := range []struct {
+			field string
+			value int
+		}{
+			{"interval_s", hc.IntervalS},
+			{"timeout_s", hc.TimeoutS},
+			{"retries", hc.Retries},
+		} {
+			if f.value < 0 {
+				errs.add("start.health_check."+f.field, "%d must be >= 0", f.value)
+			}
+		}
+	}
+
+	switch s.Start.RestartPolicy {
+	case "", RestartNever:
+	case RestartUnhealthy:
+		if s.Start.VMType != Docker {
+			errs.add("start.restart_policy", "only docker instances can be restarted when unhealthy")
+		}
+	default:
+		errs.add("start.restart_policy", "unknown restart policy %q", s.Start.RestartPolicy)
+	}
+
+	return errs.err()
+}
+
+// validateVolume checks that a volume is either a named volume or a bind
+// mount, and that its paths are absolute.
+func validateVolume(errs *ValidationError, field string, v *ContainerVolume) {
+	if (v.Name == "") == (v.HostPath == "") {
+		errs.add(field, "exactly one of name and host_path must be set")
+	}
+
+	if v.HostPath != "" {
+		if !path.IsAbs(v.HostPath) {
+			errs.add(field+".host_path", "%s is not an absolute path", v.HostPath)
+		}
+		if v.SizeMB != 0 || v.Persistent {
+			errs.add(field, "bind mounts can not have a size or be persistent")
+		}
+	}
+
+	if !path.IsAbs(v.MountPoint) {
+		errs.add(field+".mount_point", "%s is not an absolute path", v.MountPoint)
+	}
+
+	if v.SizeMB < 0 {
+		errs.add(field+".size_mb", "volume size (%d) must be >= 0", v.SizeMB)
+	}
+}
+
+// validateIPv6Networking checks that the IPv6 addresses of the networking
+// resources of an instance are IPv6 ones, and that its private IPv6 address
+// belongs to its IPv6 subnet.
+func validateIPv6Networking(errs *ValidationError, field string, n *NetworkResources) {
+	errs.ipv6(field+".private_ipv6", n.PrivateIPv6)
+	errs.ipv6(field+".concentrator_ipv6", n.ConcentratorIPv6)
+
+	if n.SubnetIPv6 == "" {
+		if n.PrivateIPv6 != "" {
+			errs.add(field+".subnet_ipv6", "is required with a private IPv6 address")
+		}
+		return
+	}
+
+	ip, subnet, err := net.ParseCIDR(n.SubnetIPv6)
+	if err != nil || ip.To4() != nil {
+		errs.add(field+".subnet_ipv6", "%s is not an IPv6 subnet", n.SubnetIPv6)
+		return
+	}
+
+	if private := net.ParseIP(n.PrivateIPv6); private != nil && !subnet.Contains(private) {
+		errs.add(field+".private_ipv6", "%s is not in subnet %s", n.PrivateIPv6, n.SubnetIPv6)
+	}
+}
+
+// Validate checks that the instance to restart and its node are identified,
+// and that the requested resources values are in range.
+func (r *Restart) Validate() error {
+	var errs ValidationError
+
+	errs.required("restart.instance_uuid", r.Restart.InstanceUUID)
+	errs.required("restart.workload_agent_uuid", r.Restart.WorkloadAgentUUID)
+	validateResources(&errs, "restart.requested_resources", r.Restart.RequestedResources)
+
+	return errs.err()
+}
+
+func (cmd *StopCmd) validate(name string) error {
+	var errs ValidationError
+
+	errs.required(name+".instance_uuid", cmd.InstanceUUID)
+	errs.required(name+".workload_agent_uuid", cmd.WorkloadAgentUUID)
+
+	return errs.err()
+}
+
+// Validate checks that the instance to stop and its node are identified.
+func (s *Stop) Validate() error {
+	return s.Stop.validate("stop")
+}
+
+// Validate checks that the instance to delete and its node are identified.
+func (d *Delete) Validate() error {
+	return d.Delete.validate("delete")
+}
+
+// Validate checks that the node to evacuate is identified.
+func (e *Evacuate) Validate() error {
+	var errs ValidationError
+
+	errs.required("evacuate.workload_agent_uuid", e.Evacuate.WorkloadAgentUUID)
+
+	return errs.err()
+}
+
+// Validate checks that the image to download and the node that should
+// download it are identified.
+func (p *Prefetch) Validate() error {
+	var errs ValidationError
+
+	errs.required("prefetch.workload_agent_uuid", p.Prefetch.WorkloadAgentUUID)
+	errs.required("prefetch.image_uuid", p.Prefetch.ImageUUID)
+
+	return errs.err()
+}
+
+// Validate checks that the reservation and its tenant are identified, that
+// it holds compute node resources whose values are in range and that its
+// TTL and expiry time, if set, are valid.
+func (r *Reserve) Validate() error {
+	var errs ValidationError
+
+	errs.required("reserve.reservation_id", r.Reserve.ReservationID)
+	errs.required("reserve.tenant_uuid", r.Reserve.TenantUUID)
+
+	if len(r.Reserve.RequestedResources) == 0 {
+		errs.add("reserve.requested_resources", "no resources")
+	}
+	if hasResourceValue(r.Reserve.RequestedResources, NetworkNode, 1) {
+		errs.add("reserve.requested_resources", "network node resources can not be reserved")
+	}
+	validateResources(&errs, "reserve.requested_resources", r.Reserve.RequestedResources)
+
+	if r.Reserve.TTLSeconds < 1 {
+		errs.add("reserve.ttl_seconds", "TTL (%d) must be >= 1", r.Reserve.TTLSeconds)
+	}
+	if _, ok := r.Reserve.ExpiryTime(); r.Reserve.Expires != "" && !ok {
+		errs.add("reserve.expires", "invalid RFC 3339 time %s", r.Reserve.Expires)
+	}
+
+	return errs.err()
+}
+
+func (cmd *GroupCmd) validate(name string) error {
+	var errs ValidationError
+
+	errs.required(name+".workload_agent_uuid", cmd.WorkloadAgentUUID)
+	errs.required(name+".group_id", cmd.GroupID)
+
+	return errs.err()
+}
+
+// Validate checks that the group to stop and its node are identified.
+func (g *StopGroup) Validate() error {
+	return g.StopGroup.validate("stop_group")
+}
+
+// Validate checks that the group to delete and its node are identified.
+func (g *DeleteGroup) Validate() error {
+	return g.DeleteGroup.validate("delete_group")
+}
+
+// Validate checks that the instance to examine and its node are identified.
+func (c *CollectDiagnostics) Validate() error {
+	var errs ValidationError
+
+	errs.required("collect_diagnostics.instance_uuid", c.Collect.InstanceUUID)
+	errs.required("collect_diagnostics.workload_agent_uuid", c.Collect.WorkloadAgentUUID)
+
+	return errs.err()
+}
+
+// Validate checks that the tenant limits and the cluster settings are in
+// range, and that the low watermarks do not exceed the high ones.
+func (c *Configure) Validate() error {
+	var errs ValidationError
+
+	for i, l := range c.Configure.Launcher.TenantLimits {
+		path := fmt.Sprintf("configure.launcher.tenant_limits[%d]", i)
+		errs.required(path+".tenant_uuid", l.TenantUUID)
+		if l.MaxInstances < 0 {
+			errs.add(path+".max_instances", "%d must be >= 0", l.MaxInstances)
+		}
+		if l.MaxMemMB < 0 {
+			errs.add(path+".max_mem_mb", "%d must be >= 0", l.MaxMemMB)
+		}
+	}
+
+	cluster := &c.Configure.Cluster
+	w := &cluster.Watermarks
+	for _, f := range []struct {
+		field string
+		value int
+	}{
+		{"stats_period", cluster.StatsPeriod},
+		{"watermarks.disk_high_mb", w.DiskHighMB},
+		{"watermarks.disk_low_mb", w.DiskLowMB},
+		{"watermarks.mem_high_mb", w.MemHighMB},
+		{"watermarks.mem_low_mb", w.MemLowMB},
+	} {
+		if f.value < 0 {
+			errs.add("configure.cluster."+f.field, "%d must be >= 0", f.value)
+		}
+	}
+
+	if w.DiskHighMB > 0 && w.DiskLowMB > w.DiskHighMB {
+		errs.add("configure.cluster.watermarks.disk_low_mb", "%d exceeds disk_high_mb (%d)",
+			w.DiskLowMB, w.DiskHighMB)
+	}
+	if w.MemHighMB > 0 && w.MemLowMB > w.MemHighMB {
+		errs.add("configure.cluster.watermarks.mem_low_mb", "%d exceeds mem_high_mb (%d)",
+			w.MemLowMB, w.MemHighMB)
+	}
+
+	if cluster.LogVerbosity != nil && *cluster.LogVerbosity < 0 {
+		errs.add("configure.cluster.log_verbosity", "%d must be >= 0", *cluster.LogVerbosity)
+	}
+
+	if u := cluster.Upgrade; u != nil {
+		errs.required("configure.cluster.upgrade.target_version", u.TargetVersion)
+		if u.MaxDraining < 0 {
+			errs.add("configure.cluster.upgrade.max_draining", "%d must be >= 0", u.MaxDraining)
+		}
+	}
+
+	return errs.err()
+}
+
+// Validate checks that the node is identified and that its resources
+// statistics are consistent.  Statistics that are unknown to the node are
+// set to -1, as done by Init.
+func (s *Ready) Validate() error {
+	var errs ValidationError
+
+	errs.required("node_uuid", s.NodeUUID)
+
+	for _, f := range []struct {
+		field string
+		value int
+	}{
+		{"mem_total_mb", s.MemTotalMB},
+		{"mem_available_mb", s.MemAvailableMB},
+		{"cpus_online", s.CpusOnline},
+	} {
+		if f.value < -1 {
+			errs.add(f.field, "%d must be >= 0, or -1 if unknown", f.value)
+		}
+	}
+
+	if s.MemTotalMB >= 0 && s.MemAvailableMB > s.MemTotalMB {
+		errs.add("mem_available_mb", "%d exceeds mem_total_mb (%d)", s.MemAvailableMB, s.MemTotalMB)
+	}
+
+	for _, f := range []struct {
+		field     string
+		total     int
+		available int
+	}{
+		{"cncis_available", s.CNCIsTotal, s.CNCIsAvailable},
+		{"cnci_bandwidth_kbps_available", s.CNCIBandwidthKbps, s.CNCIBandwidthKbpsAvailable},
+		{"public_ips_available", s.PublicIPsTotal, s.PublicIPsAvailable},
+	} {
+		if f.total >= 0 && f.available > f.total {
+			errs.add(f.field, "%d exceeds the node total (%d)", f.available, f.total)
+		}
+	}
+
+	return errs.err()
+}
@@ -0,0 +1,439 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"errors"
+	"testing"
+)
+
+func testValidStart() Start {
+	return Start{
+		Start: StartCmd{
+			TenantUUID:   "67d86208-000-4465-9018-fe14087d415f",
+			InstanceUUID: "3390740c-dce9-48d6-b83a-a717417072ce",
+			ImageUUID:    "59460b8a-5f53-4e3e-b5ce-b71fed8c7e64",
+			VMType:       QEMU,
+			RequestedResources: []RequestedResource{
+				{Type: VCPUs, Value: 2},
+				{Type: MemMB, Value: 370},
+			},
+		},
+	}
+}
+
+func testFields(err error) map[string]bool {
+	fields := make(map[string]bool)
+	for _, e := range FieldErrors(err) {
+		fields[e.Field] = true
+	}
+
+	return fields
+}
+
+func TestValidateStart(t *testing.T) {
+	start := testValidStart()
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START payload rejected: %v", err)
+	}
+
+	start.Start.InstanceUUID = ""
+	start.Start.VMType = Docker
+	start.Start.RequestedResources = []RequestedResource{
+		{Type: VCPUs, Value: -1},
+		{Type: NetworkNode, Value: 2},
+	}
+
+	err := Validate(&start)
+	if _, ok := err.(ValidationError); !ok {
+		t.Fatalf("Invalid START payload not rejected with a ValidationError: %v", err)
+	}
+
+	fields := testFields(err)
+	for _, f := range []string{
+		"start.instance_uuid",
+		"start.docker_image",
+		"start.requested_resources",
+		"start.requested_resources[0].value",
+		"start.requested_resources[1].value",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid: %v", f, err)
+		}
+	}
+
+	if len(fields) != 5 {
+		t.Errorf("Unexpected invalid fields: %v", err)
+	}
+}
+
+func TestValidateStartFlavor(t *testing.T) {
+	start := testValidStart()
+	start.Start.FlavorUUID = "b286cd45-7d0c-4525-a140-4db6c95e41fa"
+	start.Start.RequestedResources = nil
+	if err := Validate(&start); err != nil {
+		t.Fatalf("START payload referencing a flavor rejected: %v", err)
+	}
+
+	start.Start.RequestedResources = []RequestedResource{{Type: VCPUs, Value: 2}}
+	if fields := testFields(Validate(&start)); !fields["start.requested_resources"] {
+		t.Errorf("START payload overriding flavor resources without mem_mb accepted")
+	}
+}
+
+func TestValidateStartGang(t *testing.T) {
+	start := testValidStart()
+	start.Start.Gang = &Gang{ID: "mpi-job", Size: 4, AntiAffinity: true}
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START gang rejected: %v", err)
+	}
+
+	start.Start.Gang = &Gang{}
+	start.Start.RequestedResources = append(start.Start.RequestedResources,
+		RequestedResource{Type: NetworkNode, Value: 1})
+
+	fields := testFields(Validate(&start))
+	for _, f := range []string{
+		"start.gang.id",
+		"start.gang.size",
+		"start.gang",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+}
+
+func TestValidateStartRequirements(t *testing.T) {
+	start := testValidStart()
+	start.Start.Requirements = &NodeRequirements{
+		CPUFlags:             []string{"avx2"},
+		HugepageSizeKB:       2048,
+		StorageBackend:       EncryptedStorage,
+		MinHypervisorVersion: "2.11",
+		MinKernelVersion:     "4.14.0",
+	}
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START requirements rejected: %v", err)
+	}
+
+	start.Start.Requirements = &NodeRequirements{
+		CPUFlags:             []string{""},
+		HugepageSizeKB:       -1,
+		StorageBackend:       "nfs",
+		MinHypervisorVersion: "latest",
+		MinKernelVersion:     "v4.14",
+	}
+
+	fields := testFields(Validate(&start))
+	for _, f := range []string{
+		"start.requirements.cpu_flags[0]",
+		"start.requirements.hugepage_size_kb",
+		"start.requirements.storage_backend",
+		"start.requirements.min_hypervisor_version",
+		"start.requirements.min_kernel_version",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+}
+
+func TestValidateStartIPv6(t *testing.T) {
+	start := testValidStart()
+	start.Start.Networking.SubnetIPv6 = "fd00:1::/64"
+	start.Start.Networking.PrivateIPv6 = "fd00:1::2"
+	start.Start.Networking.ConcentratorIPv6 = "fd00::1"
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START IPv6 networking rejected: %v", err)
+	}
+
+	start.Start.Networking.PrivateIPv6 = "fd00:2::2"
+	start.Start.Networking.ConcentratorIPv6 = "10.0.0.1"
+	fields := testFields(Validate(&start))
+	for _, f := range []string{
+		"start.networking.private_ipv6",
+		"start.networking.concentrator_ipv6",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+
+	start.Start.Networking.SubnetIPv6 = "10.0.0.0/24"
+	if fields := testFields(Validate(&start)); !fields["start.networking.subnet_ipv6"] {
+		t.Errorf("IPv4 subnet accepted as start.networking.subnet_ipv6")
+	}
+
+	start.Start.Networking.SubnetIPv6 = ""
+	if fields := testFields(Validate(&start)); !fields["start.networking.subnet_ipv6"] {
+		t.Errorf("Private IPv6 address accepted without its subnet")
+	}
+}
+
+func TestValidateStartDeadline(t *testing.T) {
+	start := testValidStart()
+	start.Start.Deadline = "2017-07-14T02:40:00Z"
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START deadline rejected: %v", err)
+	}
+
+	deadline, ok := start.Start.DeadlineTime()
+	if !ok || deadline.Unix() != 1500000000 {
+		t.Errorf("Wrong deadline %v", deadline)
+	}
+
+	start.Start.Deadline = "in 5 minutes"
+	if fields := testFields(Validate(&start)); !fields["start.deadline"] {
+		t.Errorf("start.deadline not reported as invalid")
+	}
+	if _, ok := start.Start.DeadlineTime(); ok {
+		t.Errorf("Invalid deadline parsed")
+	}
+}
+
+func TestValidateStartBackfill(t *testing.T) {
+	start := testValidStart()
+	start.Start.Backfill = true
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid backfill START rejected: %v", err)
+	}
+
+	start.Start.Gang = &Gang{ID: "ci-job", Size: 2}
+	if fields := testFields(Validate(&start)); !fields["start.backfill"] {
+		t.Errorf("Backfill gang member not reported as invalid")
+	}
+
+	start.Start.Gang = nil
+	start.Start.ReservationID = reservationID
+	if fields := testFields(Validate(&start)); !fields["start.backfill"] {
+		t.Errorf("Reserved backfill instance not reported as invalid")
+	}
+}
+
+func TestValidateStartVolumes(t *testing.T) {
+	start := testValidStart()
+	start.Start.VMType = Docker
+	start.Start.DockerImage = "ubuntu:latest"
+	start.Start.Volumes = []ContainerVolume{
+		{Name: "data", MountPoint: "/var/lib/data", SizeMB: 1024, Persistent: true},
+		{HostPath: "/srv/shared", MountPoint: "/shared", ReadOnly: true},
+	}
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START with volumes rejected: %v", err)
+	}
+
+	start.Start.Volumes = []ContainerVolume{
+		{Name: "data", HostPath: "/srv/data", MountPoint: "/data"},
+		{HostPath: "srv/shared", MountPoint: "shared", SizeMB: 10},
+		{Name: "cache", MountPoint: "/cache", SizeMB: -1},
+	}
+	fields := testFields(Validate(&start))
+	for _, f := range []string{
+		"start.volumes[0]",
+		"start.volumes[1]",
+		"start.volumes[1].host_path",
+		"start.volumes[1].mount_point",
+		"start.volumes[2].size_mb",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+
+	start = testValidStart()
+	start.Start.Volumes = []ContainerVolume{{Name: "data", MountPoint: "/data"}}
+	if fields := testFields(Validate(&start)); !fields["start.volumes"] {
+		t.Errorf("Volumes of a qemu instance not reported as invalid")
+	}
+}
+
+func TestValidateStartRegistryAuth(t *testing.T) {
+	start := testValidStart()
+	start.Start.VMType = Docker
+	start.Start.DockerImage = "registry.example.com/app:1.0"
+	start.Start.RegistryAuth = &RegistryAuth{
+		Registry: "registry.example.com",
+		Username: "ciao",
+		Password: "secret",
+	}
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START with registry credentials rejected: %v", err)
+	}
+
+	start.Start.RegistryAuth = &RegistryAuth{}
+	fields := testFields(Validate(&start))
+	for _, f := range []string{
+		"start.registry_auth.username",
+		"start.registry_auth.password",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+
+	start = testValidStart()
+	start.Start.RegistryAuth = &RegistryAuth{Username: "ciao", Password: "secret"}
+	if fields := testFields(Validate(&start)); !fields["start.registry_auth"] {
+		t.Errorf("Registry credentials of a qemu instance not reported as invalid")
+	}
+}
+
+func TestValidateStartHealthCheck(t *testing.T) {
+	start := testValidStart()
+	start.Start.VMType = Docker
+	start.Start.DockerImage = "nginx:latest"
+	start.Start.HealthCheck = &HealthCheck{
+		Command:   []string{"curl", "-f", "http://localhost/"},
+		IntervalS: 10,
+	}
+	start.Start.RestartPolicy = RestartUnhealthy
+	if err := Validate(&start); err != nil {
+		t.Fatalf("Valid START with a health check rejected: %v", err)
+	}
+
+	start.Start.HealthCheck = &HealthCheck{IntervalS: -1, TimeoutS: -1, Retries: -1}
+	start.Start.RestartPolicy = "always"
+	fields := testFields(Validate(&start))
+	for _, f := range []string{
+		"start.health_check.interval_s",
+		"start.health_check.timeout_s",
+		"start.health_check.retries",
+		"start.restart_policy",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+
+	start = testValidStart()
+	start.Start.HealthCheck = &HealthCheck{}
+	start.Start.RestartPolicy = RestartUnhealthy
+	fields = testFields(Validate(&start))
+	if !fields["start.health_check"] || !fields["start.restart_policy"] {
+		t.Errorf("Health check of a qemu instance not reported as invalid")
+	}
+}
+
+func TestValidateConfigure(t *testing.T) {
+	var cfg Configure
+	verbosity := 3
+	cfg.Configure.Launcher.TenantLimits = []TenantLimit{
+		{TenantUUID: "67d86208-b46c-4465-9018-fe14087d415f", MaxInstances: 4},
+	}
+	cfg.Configure.Cluster = ConfigureCluster{
+		StatsPeriod:  10,
+		Watermarks:   Watermarks{DiskHighMB: 20000, DiskLowMB: 10000},
+		LogVerbosity: &verbosity,
+		Upgrade:      &RollingUpgrade{TargetVersion: "1.2.0"},
+	}
+	if err := Validate(&cfg); err != nil {
+		t.Fatalf("Valid CONFIGURE payload rejected: %v", err)
+	}
+
+	verbosity = -1
+	cfg.Configure.Launcher.TenantLimits[0] = TenantLimit{MaxMemMB: -1}
+	cfg.Configure.Cluster.StatsPeriod = -10
+	cfg.Configure.Cluster.Watermarks = Watermarks{MemHighMB: 512, MemLowMB: 1024}
+	cfg.Configure.Cluster.Upgrade = &RollingUpgrade{MaxDraining: -1}
+
+	fields := testFields(Validate(&cfg))
+	for _, f := range []string{
+		"configure.launcher.tenant_limits[0].tenant_uuid",
+		"configure.launcher.tenant_limits[0].max_mem_mb",
+		"configure.cluster.stats_period",
+		"configure.cluster.watermarks.mem_low_mb",
+		"configure.cluster.log_verbosity",
+		"configure.cluster.upgrade.target_version",
+		"configure.cluster.upgrade.max_draining",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+
+	if len(fields) != 7 {
+		t.Errorf("Unexpected invalid fields: %v", fields)
+	}
+}
+
+func TestValidateCommands(t *testing.T) {
+	valid := StopCmd{
+		InstanceUUID:      "3390740c-dce9-48d6-b83a-a717417072ce",
+		WorkloadAgentUUID: "59460b8a-5f53-4e3e-b5ce-b71fed8c7e64",
+	}
+
+	if err := Validate(&Stop{Stop: valid}); err != nil {
+		t.Errorf("Valid STOP payload rejected: %v", err)
+	}
+
+	err := Validate(&Delete{Delete: StopCmd{InstanceUUID: valid.InstanceUUID}})
+	if fields := testFields(err); len(fields) != 1 || !fields["delete.workload_agent_uuid"] {
+		t.Errorf("Wrong DELETE payload errors: %v", err)
+	}
+
+	err = Validate(&StopGroup{})
+	if fields := testFields(err); len(fields) != 2 {
+		t.Errorf("Wrong STOPGROUP payload errors: %v", err)
+	}
+}
+
+func TestValidateReady(t *testing.T) {
+	var ready Ready
+	ready.Init()
+	ready.NodeUUID = "59460b8a-5f53-4e3e-b5ce-b71fed8c7e64"
+
+	if err := Validate(&ready); err != nil {
+		t.Errorf("READY payload with unknown statistics rejected: %v", err)
+	}
+
+	ready.MemTotalMB = 1024
+	ready.MemAvailableMB = 2048
+	ready.CpusOnline = -4
+
+	err := Validate(&ready)
+	if fields := testFields(err); len(fields) != 2 || !fields["mem_available_mb"] || !fields["cpus_online"] {
+		t.Errorf("Wrong READY payload errors: %v", err)
+	}
+
+	ready.MemAvailableMB = 512
+	ready.CpusOnline = 4
+	ready.CNCIsTotal, ready.CNCIsAvailable = 8, 9
+	ready.PublicIPsAvailable = 16
+
+	err = Validate(&ready)
+	if fields := testFields(err); len(fields) != 1 || !fields["cncis_available"] {
+		t.Errorf("Wrong network node READY payload errors: %v", err)
+	}
+}
+
+func TestValidateUnsupported(t *testing.T) {
+	if err := Validate(&ErrorUnauthorizedFrame{}); err != nil {
+		t.Errorf("Payloads without validation should be valid: %v", err)
+	}
+}
+
+func TestFieldErrors(t *testing.T) {
+	if FieldErrors(nil) != nil {
+		t.Errorf("No error should have no invalid field")
+	}
+
+	errs := FieldErrors(errors.New("bad yaml"))
+	if len(errs) != 1 || errs[0].Field != "" || errs[0].Reason != "bad yaml" {
+		t.Errorf("Wrong field errors %v", errs)
+	}
+}
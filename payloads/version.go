@@ -0,0 +1,360 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Version identifies a version of the payload schemas.  SSNTP peers agree
+// on the highest version they both support when connecting, so that the
+// payloads they exchange during rolling upgrades only contain fields the
+// receiver knows about.
+//
+// The struct fields added to a payload in a given version are tagged with
+// that version, e.g.
+//
+//	CPUPressure float64 `yaml:"cpu_pressure" since:"2"`
+//
+// and are left out by MarshalVersion for peers supporting an older version.
+// Only fields that older peers can do without may be tagged this way, i.e.
+// fields whose absence does not change the meaning of the payload.
+type Version uint32
+
+const (
+	// Version1 is the version of the payload schemas supported by the
+	// peers that predate payload versioning.
+	Version1 Version = iota + 1
+
+	// Version2 adds the hugepage, SR-IOV VF and GPU statistics to READY
+	// payloads, and the disk and vCPU accounting, CPU pressure, GPU,
+	// image cache and per instance boot phase, guest filesystem and
+	// network statistics to STATS payloads.
+	Version2
+
+	// Version3 adds the dedicated CPU core, disk IOPS and network
+	// bandwidth statistics to READY and STATS payloads.
+	Version3
+
+	// Version4 adds the NodeCapabilities event, which agents must not
+	// send to peers supporting an older version.
+	Version4
+
+	// Version5 adds the InstanceStateChanged event, which agents must not
+	// send to peers supporting an older version.
+	Version5
+
+	// Version6 adds the trace and span identifiers to the frames of
+	// TraceReport payloads.
+	Version6
+
+	// Version7 adds the WorkloadDefinition event and the flavor UUID of
+	// START payloads, which controllers must not send to peers supporting
+	// an older version.
+	Version7
+
+	// Version8 adds the gang of START payloads.
+	Version8
+
+	// Version9 adds the POWERDOWN command, which schedulers must not send
+	// to peers supporting an older version, and the wake-on-LAN MAC
+	// address of NodeCapabilities payloads.
+	Version9
+
+	// Version10 adds the CPU architecture and model of NodeCapabilities
+	// payloads and the image architecture of START payloads.
+	Version10
+
+	// Version11 adds the kernel version of NodeCapabilities payloads and
+	// the minimum hypervisor and kernel versions of NodeRequirements.
+	Version11
+
+	// Version12 adds the failure domain of NodeCapabilities payloads.
+	Version12
+
+	// Version13 adds the REPLAYEVENTS command and the EventsReplayed
+	// event, which schedulers only send in reply to REPLAYEVENTS.
+	Version13
+
+	// Version14 adds the CNCI, CNCI bandwidth and public IP pool
+	// resources of network nodes to READY payloads.
+	Version14
+
+	// Version15 adds the PublicIPPoolRegistered and PublicIPReleased
+	// events.
+	Version15
+
+	// Version16 adds the TenantNetworksReport and TenantNetworkDrift
+	// events.
+	Version16
+
+	// Version17 adds the IPv6 addresses of the networking resources of
+	// START payloads, of PublicIPAssigned and PublicIPReleased events,
+	// of the node interfaces and of the instance SSH information of
+	// STATS payloads.
+	Version17
+
+	// Version18 adds the SECURITYGROUP command, which schedulers must not
+	// send to peers supporting an older version, and the security group
+	// version of the instances of STATS payloads.
+	Version18
+
+	// Version19 adds the tenant tokens of the START, RESTART, STOP,
+	// DELETE, COLLECTDIAGNOSTICS and SECURITYGROUP payloads.
+	Version19
+
+	// Version20 adds the software version of NodeCapabilities payloads,
+	// the rolling upgrade of CONFIGURE payloads and the UpgradeProgress
+	// event.
+	Version20
+
+	// Version21 adds the deadline of START payloads and the
+	// DeadlineExceeded StartFailure reason.
+	Version21
+
+	// Version22 adds the RESERVE command and the ReservationStatus
+	// event, which schedulers must not send to peers supporting an older
+	// version, the reservation ID of START payloads and the
+	// InvalidReservation StartFailure reason.
+	Version22
+
+	// Version23 adds the PlacementRefused StartFailure reason.
+	Version23
+
+	// Version24 adds the TOPOLOGY command, the ClusterTopology event, and
+	// the availability zone and labels of NodeCapabilities payloads.
+	Version24
+
+	// Version25 adds the per-instance launch phase breakdowns of
+	// TraceReport payloads.
+	Version25
+
+	// Version26 adds the backfill class of START payloads.
+	Version26
+
+	// Version27 adds the power draw and CPU temperature of READY and
+	// STATS payloads.
+	Version27
+
+	// Version28 adds the balloon size of the instances of STATS
+	// payloads.
+	Version28
+
+	// Version29 adds the memory pressure of READY and STATS payloads.
+	Version29
+
+	// Version30 adds the sampling times of the instances of STATS
+	// payloads.
+	Version30
+
+	// Version31 adds the volumes of START payloads.
+	Version31
+
+	// Version32 adds the registry credentials of START payloads and the
+	// ImagePullProgress event, which agents must not send to peers
+	// supporting an older version.
+	Version32
+
+	// Version33 adds the health checks and restart policies of START
+	// payloads, the unhealthy instance state and the InstanceUnhealthy
+	// event.  Agents must report unhealthy instances as running, and
+	// must not send the event, to peers supporting an older version.
+	Version33
+
+	// Version34 adds the InstanceDiskFull event, which agents must not
+	// send to peers supporting an older version.
+	Version34
+
+	// Version35 lets agents send EVACUATE commands asking for their own
+	// evacuation, which the scheduler forwards to the controllers.  Agents
+	// must not send them to peers supporting an older version.
+	Version35
+
+	// Version36 adds the TenantNotAuthenticated StartFailure,
+	// RestartFailure, StopFailure and DeleteFailure reasons.
+	Version36
+
+	// CurrentVersion is the latest version of the payload schemas.
+	CurrentVersion = Version36
+)
+
+func (v Version) String() string {
+	return fmt.Sprintf("v%d", uint32(v))
+}
+
+// sinceVersion returns the version in which field was added to its payload.
+func sinceVersion(field reflect.StructField) Version {
+	since, err := strconv.ParseUint(field.Tag.Get("since"), 10, 32)
+	if err != nil {
+		return Version1
+	}
+
+	return Version(since)
+}
+
+// yamlName returns the name of the YAML key field is marshalled as, and
+// whether its fields are inlined in the enclosing mapping.
+func yamlName(field reflect.StructField) (string, bool) {
+	tag := strings.Split(field.Tag.Get("yaml"), ",")
+	for _, flag := range tag[1:] {
+		if flag == "inline" {
+			return "", true
+		}
+	}
+
+	if tag[0] == "" {
+		return strings.ToLower(field.Name), false
+	}
+
+	return tag[0], false
+}
+
+// downgrade removes from value, a generic unmarshalled payload of type t,
+// the fields that were added after version.
+func downgrade(t reflect.Type, value interface{}, version Version) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			name, inline := yamlName(field)
+			if inline {
+				downgrade(field.Type, m, version)
+				continue
+			}
+
+			if name == "-" {
+				continue
+			}
+
+			if sinceVersion(field) > version {
+				delete(m, name)
+				continue
+			}
+
+			if v, ok := m[name]; ok {
+				downgrade(field.Type, v, version)
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		s, ok := value.([]interface{})
+		if !ok {
+			return
+		}
+
+		for _, v := range s {
+			downgrade(t.Elem(), v, version)
+		}
+	case reflect.Map:
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		for _, v := range m {
+			downgrade(t.Elem(), v, version)
+		}
+	}
+}
+
+// stringKeys converts the mappings of a generic unmarshalled YAML value to
+// string keyed maps, which is what the payload structures marshal as.
+func stringKeys(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			m[fmt.Sprint(key)] = stringKeys(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = stringKeys(v[i])
+		}
+	}
+
+	return value
+}
+
+// MarshalVersion marshals v using the encoding e for a peer that supports
+// the version payload schemas: the fields of v that were added in later
+// versions are left out.  v is marshalled exactly as with Marshal for peers
+// that support CurrentVersion.
+func MarshalVersion(e Encoding, v interface{}, version Version) ([]byte, error) {
+	if version >= CurrentVersion {
+		return Marshal(e, v)
+	}
+
+	payload, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var generic interface{}
+	err = yaml.Unmarshal(payload, &generic)
+	if err != nil {
+		return nil, err
+	}
+
+	generic = stringKeys(generic)
+	downgrade(reflect.TypeOf(v), generic, version)
+
+	return Marshal(e, generic)
+}
+
+// UnmarshalTolerant unmarshals payload into v like Unmarshal, but skips
+// the fields whose values do not fit their type in v rather than failing,
+// e.g. fields whose type was changed by a newer version of the payload
+// schemas.  Fields unknown to v are ignored, as with Unmarshal.
+func UnmarshalTolerant(payload []byte, v interface{}) error {
+	if PayloadEncoding(payload) != YAML {
+		if err := Unmarshal(payload, v); err == nil {
+			return nil
+		}
+
+		var err error
+		/* The YAML payload sets all the fields the original one did */
+		payload, err = Transcode(payload, YAML)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := yaml.Unmarshal(payload, v)
+	if _, ok := err.(*yaml.TypeError); ok {
+		return nil
+	}
+
+	return err
+}
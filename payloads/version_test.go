@@ -0,0 +1,392 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestMarshalVersion(t *testing.T) {
+	stats := testEncodingStats()
+	stats.CPUPressure = 12.5
+	stats.Instances[0].BootPhase = BootReady
+
+	for _, e := range []Encoding{YAML, MsgPack} {
+		current, err := Marshal(e, &stats)
+		if err != nil {
+			t.Fatalf("Unable to marshal stats with %s: %v", e, err)
+		}
+
+		payload, err := MarshalVersion(e, &stats, CurrentVersion)
+		if err != nil {
+			t.Fatalf("Unable to marshal %s stats: %v", CurrentVersion, err)
+		}
+
+		if !bytes.Equal(payload, current) {
+			t.Errorf("%s %s stats do not match the current ones", e, CurrentVersion)
+		}
+
+		payload, err = MarshalVersion(e, &stats, Version1)
+		if err != nil {
+			t.Fatalf("Unable to marshal %s stats: %v", Version1, err)
+		}
+
+		if PayloadEncoding(payload) != e {
+			t.Errorf("%s payload detected as %s", e, PayloadEncoding(payload))
+		}
+
+		var generic map[string]interface{}
+		err = Unmarshal(payload, &generic)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal %s %s stats: %v", e, Version1, err)
+		}
+
+		if _, ok := generic["cpu_pressure"]; ok {
+			t.Errorf("%s %s stats contain a %s field", e, Version1, Version2)
+		}
+
+		if generic["hostname"] != stats.NodeHostName {
+			t.Errorf("%s %s stats lack their %s fields", e, Version1, Version1)
+		}
+
+		var s Stat
+		err = Unmarshal(payload, &s)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal %s %s stats: %v", e, Version1, err)
+		}
+
+		if s.CPUPressure != 0 || s.Instances[0].BootPhase != "" {
+			t.Errorf("%s %s stats contain %s fields: %+v", e, Version1, Version2, s)
+		}
+
+		if s.NodeUUID != stats.NodeUUID || len(s.Instances) != len(stats.Instances) ||
+			s.Instances[0].InstanceUUID != stats.Instances[0].InstanceUUID {
+			t.Errorf("%s %s stats do not match: %+v", e, Version1, s)
+		}
+	}
+}
+
+func TestMarshalVersion2(t *testing.T) {
+	stats := testEncodingStats()
+	stats.CPUPressure = 12.5
+	stats.DiskIOPSTotal = 10000
+
+	payload, err := MarshalVersion(YAML, &stats, Version2)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s stats: %v", Version2, err)
+	}
+
+	var generic map[string]interface{}
+	err = Unmarshal(payload, &generic)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s stats: %v", Version2, err)
+	}
+
+	if _, ok := generic["disk_iops_total"]; ok {
+		t.Errorf("%s stats contain a %s field", Version2, Version3)
+	}
+
+	if generic["cpu_pressure"] != stats.CPUPressure {
+		t.Errorf("%s stats lack their %s fields", Version2, Version2)
+	}
+}
+
+func TestMarshalVersion5(t *testing.T) {
+	trace := Trace{
+		Frames: []FrameTrace{
+			{
+				Label:   "launch",
+				TraceID: "7a2f4b5c-2d1e-4c3b-8a9f-0e1d2c3b4a59",
+				SpanID:  "0f3e2d1c-4b5a-4697-8877-665544332211",
+				Type:    "COMMAND",
+				Operand: "START",
+			},
+		},
+	}
+
+	payload, err := MarshalVersion(YAML, &trace, Version5)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s trace: %v", Version5, err)
+	}
+
+	var t5 Trace
+	err = Unmarshal(payload, &t5)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s trace: %v", Version5, err)
+	}
+
+	if len(t5.Frames) != 1 || t5.Frames[0].TraceID != "" || t5.Frames[0].SpanID != "" {
+		t.Errorf("%s trace contains %s fields: %+v", Version5, Version6, t5)
+	}
+
+	if t5.Frames[0].Label != trace.Frames[0].Label {
+		t.Errorf("%s trace lacks its %s fields", Version5, Version1)
+	}
+
+	payload, err = MarshalVersion(YAML, &trace, Version6)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s trace: %v", Version6, err)
+	}
+
+	var t6 Trace
+	err = Unmarshal(payload, &t6)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s trace: %v", Version6, err)
+	}
+
+	if len(t6.Frames) != 1 || t6.Frames[0].TraceID != trace.Frames[0].TraceID ||
+		t6.Frames[0].SpanID != trace.Frames[0].SpanID {
+		t.Errorf("%s trace does not match: %+v", Version6, t6)
+	}
+}
+
+func TestMarshalVersion16(t *testing.T) {
+	stats := testEncodingStats()
+	stats.Networks[0].NodeIPv6 = "fd00::15"
+	stats.Instances[0].SSHIP = "192.168.1.2"
+	stats.Instances[0].SSHIPv6 = "fd00::2"
+
+	payload, err := MarshalVersion(YAML, &stats, Version16)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s stats: %v", Version16, err)
+	}
+
+	var s Stat
+	err = Unmarshal(payload, &s)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s stats: %v", Version16, err)
+	}
+
+	if s.Networks[0].NodeIPv6 != "" || s.Instances[0].SSHIPv6 != "" {
+		t.Errorf("%s stats contain %s fields: %+v", Version16, Version17, s)
+	}
+
+	if s.Networks[0].NodeIP != stats.Networks[0].NodeIP || s.Instances[0].SSHIP != stats.Instances[0].SSHIP {
+		t.Errorf("%s stats lack their IPv4 addresses: %+v", Version16, s)
+	}
+}
+
+func TestMarshalVersion18(t *testing.T) {
+	del := Delete{
+		Delete: StopCmd{
+			InstanceUUID:      instanceUUID,
+			WorkloadAgentUUID: agentUUID,
+			TenantToken:       "eyJhbGciOiJIUzI1NiJ9.e30.c2ln",
+		},
+	}
+
+	payload, err := MarshalVersion(YAML, &del, Version18)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s delete: %v", Version18, err)
+	}
+
+	var d Delete
+	err = Unmarshal(payload, &d)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s delete: %v", Version18, err)
+	}
+
+	if d.Delete.TenantToken != "" || d.Delete.InstanceUUID != instanceUUID {
+		t.Errorf("Unexpected %s delete: %+v", Version18, d)
+	}
+}
+
+func TestMarshalVersion19(t *testing.T) {
+	event := testNodeCapabilities()
+	event.Capabilities.SoftwareVersion = "1.2.0"
+
+	payload, err := MarshalVersion(YAML, &event, Version19)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s capabilities: %v", Version19, err)
+	}
+
+	var e EventNodeCapabilities
+	err = Unmarshal(payload, &e)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s capabilities: %v", Version19, err)
+	}
+
+	if e.Capabilities.SoftwareVersion != "" || e.Capabilities.KernelVersion == "" {
+		t.Errorf("Unexpected %s capabilities: %+v", Version19, e.Capabilities)
+	}
+}
+
+func TestMarshalVersion24(t *testing.T) {
+	trace := Trace{
+		Frames: []FrameTrace{{Label: "launch", Type: "COMMAND", Operand: "START"}},
+		Launches: []LaunchTrace{
+			{
+				InstanceUUID: instanceUUID,
+				ImagePrepMS:  1200,
+				BootMS:       3400,
+				TotalMS:      5000,
+			},
+		},
+	}
+
+	payload, err := MarshalVersion(YAML, &trace, Version24)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s trace: %v", Version24, err)
+	}
+
+	var t24 Trace
+	err = Unmarshal(payload, &t24)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s trace: %v", Version24, err)
+	}
+
+	if len(t24.Launches) != 0 || len(t24.Frames) != 1 {
+		t.Errorf("Unexpected %s trace: %+v", Version24, t24)
+	}
+
+	payload, err = MarshalVersion(YAML, &trace, Version25)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s trace: %v", Version25, err)
+	}
+
+	var t25 Trace
+	err = Unmarshal(payload, &t25)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s trace: %v", Version25, err)
+	}
+
+	if len(t25.Launches) != 1 || t25.Launches[0] != trace.Launches[0] {
+		t.Errorf("%s trace does not match: %+v", Version25, t25)
+	}
+}
+
+func TestUnmarshalTolerant(t *testing.T) {
+	stats := map[string]interface{}{
+		"node_uuid":    "2400bce6-ccc8-4a45-b2aa-b5cc3790077b",
+		"mem_total_mb": "plenty",
+		"load":         3,
+		"new_field":    1,
+	}
+
+	for _, e := range []Encoding{YAML, MsgPack} {
+		p, err := Marshal(e, stats)
+		if err != nil {
+			t.Fatalf("Unable to marshal %s payload: %v", e, err)
+		}
+
+		var s Stat
+		if err := Unmarshal(p, &s); err == nil {
+			t.Errorf("Mistyped %s field accepted by Unmarshal", e)
+		}
+
+		s = Stat{}
+		err = UnmarshalTolerant(p, &s)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal %s payload: %v", e, err)
+		}
+
+		if s.NodeUUID != "2400bce6-ccc8-4a45-b2aa-b5cc3790077b" || s.Load != 3 || s.MemTotalMB != 0 {
+			t.Errorf("Unexpected %s stats %+v", e, s)
+		}
+	}
+}
+
+func TestMarshalVersion27(t *testing.T) {
+	stat := Stat{
+		NodeUUID: agentUUID,
+		Instances: []InstanceStat{
+			{
+				InstanceUUID: instanceUUID,
+				State:        Running,
+				BalloonMB:    512,
+			},
+		},
+	}
+
+	payload, err := MarshalVersion(YAML, &stat, Version27)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s stats: %v", Version27, err)
+	}
+
+	var s27 Stat
+	err = Unmarshal(payload, &s27)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s stats: %v", Version27, err)
+	}
+
+	if len(s27.Instances) != 1 || s27.Instances[0].BalloonMB != 0 {
+		t.Errorf("Unexpected %s stats: %+v", Version27, s27)
+	}
+
+	payload, err = MarshalVersion(YAML, &stat, Version28)
+	if err != nil {
+		t.Fatalf("Unable to marshal %s stats: %v", Version28, err)
+	}
+
+	var s28 Stat
+	err = Unmarshal(payload, &s28)
+	if err != nil {
+		t.Fatalf("Unable to unmarshal %s stats: %v", Version28, err)
+	}
+
+	if len(s28.Instances) != 1 || s28.Instances[0].BalloonMB != 512 {
+		t.Errorf("%s stats do not match: %+v", Version28, s28)
+	}
+}
+
+func TestMarshalVersion29(t *testing.T) {
+	sampled := time.Date(2016, 9, 1, 12, 30, 0, 0, time.UTC).Format(time.RFC3339Nano)
+	stat := Stat{
+		NodeUUID: agentUUID,
+		Instances: []InstanceStat{
+			{
+				InstanceUUID: instanceUUID,
+				State:        Running,
+				SampledAt:    sampled,
+			},
+		},
+	}
+
+	for _, e := range []Encoding{YAML, JSON} {
+		payload, err := MarshalVersion(e, &stat, Version29)
+		if err != nil {
+			t.Fatalf("Unable to marshal %s stats: %v", Version29, err)
+		}
+
+		var s29 Stat
+		err = Unmarshal(payload, &s29)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal %s stats: %v", Version29, err)
+		}
+
+		if len(s29.Instances) != 1 || s29.Instances[0].SampledAt != "" {
+			t.Errorf("Unexpected %s stats: %+v", Version29, s29)
+		}
+
+		payload, err = MarshalVersion(e, &stat, Version30)
+		if err != nil {
+			t.Fatalf("Unable to marshal %s stats: %v", Version30, err)
+		}
+
+		var s30 Stat
+		err = Unmarshal(payload, &s30)
+		if err != nil {
+			t.Fatalf("Unable to unmarshal %s stats: %v", Version30, err)
+		}
+
+		if len(s30.Instances) != 1 || s30.Instances[0].SampledAt != sampled {
+			t.Errorf("%s stats do not match: %+v", Version30, s30)
+		}
+	}
+}
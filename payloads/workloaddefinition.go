@@ -0,0 +1,51 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+// WorkloadDefinitionEvent describes the resources requested by the
+// instances of a flavor.
+type WorkloadDefinitionEvent struct {
+	// FlavorUUID identifies the flavor in the START payloads.
+	FlavorUUID string `yaml:"flavor_uuid"`
+
+	// RequestedResources contains the resources to assign to each
+	// instance of the flavor, as in the START payloads.
+	RequestedResources []RequestedResource `yaml:"requested_resources"`
+}
+
+// EventWorkloadDefinition represents the unmarshalled version of the
+// contents of an SSNTP ssntp.WorkloadDefinition event.  This event is sent
+// by controllers to the scheduler, once per flavor, so that the START
+// payloads of the flavor instances do not have to list their resources.
+type EventWorkloadDefinition struct {
+	Definition WorkloadDefinitionEvent `yaml:"workload_definition"`
+}
+
+// Validate checks that the flavor is identified and that its requested
+// resources values are in range.  A mem_mb resource is required.
+func (e *EventWorkloadDefinition) Validate() error {
+	var errs ValidationError
+	def := &e.Definition
+
+	errs.required("workload_definition.flavor_uuid", def.FlavorUUID)
+	if !hasResource(def.RequestedResources, MemMB) {
+		errs.add("workload_definition.requested_resources", "no %s resource", MemMB)
+	}
+	validateResources(&errs, "workload_definition.requested_resources", def.RequestedResources)
+
+	return errs.err()
+}
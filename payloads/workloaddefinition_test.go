@@ -0,0 +1,92 @@
+/*
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+*/
+
+package payloads
+
+import (
+	"gopkg.in/yaml.v2"
+	"testing"
+)
+
+const flavorUUID = "b286cd45-7d0c-4525-a140-4db6c95e41fa"
+
+const workloadDefinitionYaml = "" +
+	"workload_definition:\n" +
+	"  flavor_uuid: " + flavorUUID + "\n" +
+	"  requested_resources:\n" +
+	"  - type: vcpus\n" +
+	"    value: 2\n" +
+	"    mandatory: false\n" +
+	"  - type: mem_mb\n" +
+	"    value: 2048\n" +
+	"    mandatory: false\n"
+
+func TestWorkloadDefinitionUnmarshal(t *testing.T) {
+	var event EventWorkloadDefinition
+	err := yaml.Unmarshal([]byte(workloadDefinitionYaml), &event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	def := event.Definition
+	if def.FlavorUUID != flavorUUID {
+		t.Errorf("Wrong flavor UUID %s", def.FlavorUUID)
+	}
+
+	if len(def.RequestedResources) != 2 || def.RequestedResources[1].Type != MemMB ||
+		def.RequestedResources[1].Value != 2048 {
+		t.Errorf("Wrong requested resources %+v", def.RequestedResources)
+	}
+
+	if err := Validate(&event); err != nil {
+		t.Errorf("Valid WorkloadDefinition payload rejected: %v", err)
+	}
+}
+
+func TestWorkloadDefinitionMarshal(t *testing.T) {
+	var event EventWorkloadDefinition
+
+	event.Definition.FlavorUUID = flavorUUID
+	event.Definition.RequestedResources = []RequestedResource{
+		{Type: VCPUs, Value: 2},
+		{Type: MemMB, Value: 2048},
+	}
+
+	y, err := yaml.Marshal(&event)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(y) != workloadDefinitionYaml {
+		t.Errorf("WorkloadDefinition marshalling failed\n[%s]\n vs\n[%s]", string(y), workloadDefinitionYaml)
+	}
+}
+
+func TestValidateWorkloadDefinition(t *testing.T) {
+	var event EventWorkloadDefinition
+	event.Definition.RequestedResources = []RequestedResource{{Type: VCPUs, Value: -1}}
+
+	fields := testFields(Validate(&event))
+	for _, f := range []string{
+		"workload_definition.flavor_uuid",
+		"workload_definition.requested_resources",
+		"workload_definition.requested_resources[0].value",
+	} {
+		if !fields[f] {
+			t.Errorf("%s not reported as invalid", f)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"fmt"
+)
+
+// RejectNotifier is an optional interface that ServerNotifier
+// implementations can implement to be told about the frames rejected by
+// the frame authorizations, e.g. to audit them.
+type RejectNotifier interface {
+	// RejectNotify notifies of a frame that the uuid SSNTP client, whose
+	// role is given, was not authorized to send.
+	RejectNotify(uuid string, role uint32, frame *Frame)
+}
+
+// FrameAuthorization lists the frames that SSNTP clients with a given
+// role are allowed to send to the server. Frames that are not listed
+// are rejected with an UnauthorizedFrame error.
+type FrameAuthorization struct {
+	// Role is the bitmask of client roles the authorization applies to.
+	Role uint32
+
+	// Commands lists the COMMAND frames the clients can send.
+	Commands []Command
+
+	// Statuses lists the STATUS frames the clients can send.
+	Statuses []Status
+
+	// Events lists the EVENT frames the clients can send.
+	Events []Event
+
+	// Errors lists the ERROR frames the clients can send.
+	Errors []Error
+
+	// Streams allows the clients to send STREAM frames.
+	Streams bool
+}
+
+type frameKey struct {
+	frameType Type
+	operand   uint8
+}
+
+// frameAuthorizer is the role by frame authorization matrix built from
+// the server FrameAuthorization rules. A nil frameAuthorizer authorizes
+// every frame.
+type frameAuthorizer struct {
+	allowed map[uint32]map[frameKey]bool
+}
+
+func newFrameAuthorizer(rules []FrameAuthorization) *frameAuthorizer {
+	if len(rules) == 0 {
+		return nil
+	}
+
+	a := &frameAuthorizer{
+		allowed: make(map[uint32]map[frameKey]bool),
+	}
+
+	for _, rule := range rules {
+		var keys []frameKey
+		for _, c := range rule.Commands {
+			keys = append(keys, frameKey{COMMAND, (uint8)(c)})
+		}
+		for _, s := range rule.Statuses {
+			keys = append(keys, frameKey{STATUS, (uint8)(s)})
+		}
+		for _, e := range rule.Events {
+			keys = append(keys, frameKey{EVENT, (uint8)(e)})
+		}
+		for _, e := range rule.Errors {
+			keys = append(keys, frameKey{ERROR, (uint8)(e)})
+		}
+		if rule.Streams {
+			keys = append(keys, frameKey{STREAM, 0})
+		}
+
+		for role := uint32(1); role != 0; role <<= 1 {
+			if rule.Role&role == 0 {
+				continue
+			}
+
+			if a.allowed[role] == nil {
+				a.allowed[role] = make(map[frameKey]bool)
+			}
+
+			for _, key := range keys {
+				a.allowed[role][key] = true
+			}
+		}
+	}
+
+	return a
+}
+
+// authorized returns true if any of the role bits is allowed to send frame.
+func (a *frameAuthorizer) authorized(role uint32, frame *Frame) bool {
+	if a == nil {
+		return true
+	}
+
+	key := frameKey{frame.Type, frame.Operand}
+	if frame.Type == STREAM {
+		key.operand = 0
+	}
+
+	for r := uint32(1); r != 0; r <<= 1 {
+		if role&r != 0 && a.allowed[r][key] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func operandString(frame *Frame) string {
+	var op string
+
+	switch frame.Type {
+	case COMMAND:
+		op = (Command)(frame.Operand).String()
+	case STATUS:
+		op = (Status)(frame.Operand).String()
+	case EVENT:
+		op = (Event)(frame.Operand).String()
+	case ERROR:
+		op = (Error)(frame.Operand).String()
+	}
+
+	if op == "" {
+		op = fmt.Sprintf("%d", frame.Operand)
+	}
+
+	return op
+}
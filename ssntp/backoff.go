@@ -0,0 +1,119 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffInitial    = 1 * time.Second
+	defaultBackoffMax        = 60 * time.Second
+	defaultBackoffMultiplier = 2.0
+	defaultBackoffJitter     = 0.5
+)
+
+// Backoff describes how an SSNTP client spaces out its attempts to
+// connect, or reconnect, to an SSNTP server.
+// The delay between two attempts starts at Initial and is multiplied by
+// Multiplier after each failed attempt, up to Max. A random fraction,
+// up to Jitter, of each delay is then removed so that clients that lost
+// their server at the same time do not all reconnect at the same time.
+// Fields that are left to 0 take their default values.
+type Backoff struct {
+	// Initial is the delay before the first attempt. The default is 1 second.
+	Initial time.Duration
+
+	// Max is the maximum delay between two attempts. The default is 60 seconds.
+	Max time.Duration
+
+	// Multiplier is the factor applied to the delay after each failed
+	// attempt. It must be greater than 1, the default is 2.
+	Multiplier float64
+
+	// Jitter is the fraction of each delay that is randomized, between
+	// 0 and 1. The default is 0.5.
+	Jitter float64
+}
+
+type backoff struct {
+	Backoff
+	attempt uint
+	rand    *rand.Rand
+}
+
+func newBackoff(config *Backoff) *backoff {
+	b := &backoff{
+		Backoff: Backoff{
+			Initial:    defaultBackoffInitial,
+			Max:        defaultBackoffMax,
+			Multiplier: defaultBackoffMultiplier,
+			Jitter:     defaultBackoffJitter,
+		},
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if config == nil {
+		return b
+	}
+
+	if config.Initial > 0 {
+		b.Initial = config.Initial
+	}
+
+	if config.Max > 0 {
+		b.Max = config.Max
+	}
+
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+
+	if config.Multiplier > 1 {
+		b.Multiplier = config.Multiplier
+	}
+
+	if config.Jitter > 0 && config.Jitter <= 1 {
+		b.Jitter = config.Jitter
+	}
+
+	return b
+}
+
+// next returns the delay to wait for before the next connection attempt.
+func (b *backoff) next() time.Duration {
+	delay := float64(b.Initial)
+	for i := uint(0); i < b.attempt && delay < float64(b.Max); i++ {
+		delay *= b.Multiplier
+	}
+
+	if delay > float64(b.Max) {
+		delay = float64(b.Max)
+	} else {
+		b.attempt++
+	}
+
+	delay -= delay * b.Jitter * b.rand.Float64()
+
+	return time.Duration(delay)
+}
+
+// reset is called once a connection succeeds.
+func (b *backoff) reset() {
+	b.attempt = 0
+}
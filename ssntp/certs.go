@@ -0,0 +1,78 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// tlsConfig holds the TLS configuration built from the CA and
+// certificate files, and rebuilds it when they are rotated.
+// Established connections keep the configuration they were
+// set up with, only new ones use the reloaded certificates.
+type tlsConfig struct {
+	sync.RWMutex
+	caPath   string
+	certPath string
+	server   bool
+	config   *tls.Config
+}
+
+func newTLSConfig(config *Config, server bool) *tlsConfig {
+	return &tlsConfig{
+		caPath:   config.CAcert,
+		certPath: config.Cert,
+		server:   server,
+		config:   prepareTLSConfig(config, server),
+	}
+}
+
+func (t *tlsConfig) get() *tls.Config {
+	t.RLock()
+	defer t.RUnlock()
+
+	return t.config
+}
+
+// reload reads the CA and certificate files again. The current
+// configuration is kept if they can not be loaded, so that a
+// botched rotation does not prevent anyone from connecting.
+func (t *tlsConfig) reload() error {
+	caPEM, err := ioutil.ReadFile(t.caPath)
+	if err != nil {
+		return fmt.Errorf("Could not load CA certificate: %s", err)
+	}
+
+	certPEM, err := ioutil.ReadFile(t.certPath)
+	if err != nil {
+		return fmt.Errorf("Could not load certificate: %s", err)
+	}
+
+	config := prepareTLS(caPEM, certPEM, t.server)
+	if config == nil {
+		return fmt.Errorf("Invalid certificates %s and %s", t.caPath, t.certPath)
+	}
+
+	t.Lock()
+	t.config = config
+	t.Unlock()
+
+	return nil
+}
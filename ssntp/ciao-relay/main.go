@@ -0,0 +1,85 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"github.com/01org/ciao/payloads"
+	"github.com/01org/ciao/ssntp"
+	"github.com/golang/glog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	server            = flag.String("server", "localhost", "URI of the upstream SSNTP server, e.g. the scheduler")
+	port              = flag.Uint("port", 0, "SSNTP port of the upstream server, 0 for the default 8888")
+	listen            = flag.String("listen", "", "Address to accept SSNTP clients on, empty for all addresses")
+	listenPort        = flag.Uint("listen-port", 0, "Port to accept SSNTP clients on, 0 for the default 8888")
+	caCert            = flag.String("cacert", "/etc/pki/ciao/CAcert-server-localhost.pem", "CA certificate")
+	cert              = flag.String("cert", "/etc/pki/ciao/cert-server-localhost.pem", "Relay certificate, with the server role")
+	keepaliveInterval = flag.Duration("keepalive-interval", 10*time.Second, "Interval between SSNTP keepalives, 0 to disable")
+)
+
+func main() {
+	flag.Parse()
+
+	upstream := &ssntp.Config{
+		URI:               *server,
+		Port:              uint32(*port),
+		CAcert:            *caCert,
+		Cert:              *cert,
+		Log:               ssntp.Log,
+		KeepaliveInterval: *keepaliveInterval,
+		Encodings:         []payloads.Encoding{payloads.MsgPack, payloads.JSON},
+		AtLeastOnce:       true,
+	}
+
+	// The upstream server can not check the certificates of the relayed
+	// clients, it relies on the relay to verify their roles.
+	downstream := &ssntp.Config{
+		URI:               *listen,
+		Port:              uint32(*listenPort),
+		CAcert:            *caCert,
+		Cert:              *cert,
+		Log:               ssntp.Log,
+		RoleVerification:  true,
+		KeepaliveInterval: *keepaliveInterval,
+		Encodings:         []payloads.Encoding{payloads.MsgPack, payloads.JSON},
+		AtLeastOnce:       true,
+	}
+
+	var relay ssntp.Relay
+
+	signalCh := make(chan os.Signal, 1)
+	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signalCh
+		glog.Info("Stopping relay")
+		relay.Stop()
+	}()
+
+	if err := relay.Serve(downstream, upstream); err != nil {
+		glog.Errorf("Relay failed: %s", err)
+		glog.Flush()
+		os.Exit(1)
+	}
+
+	glog.Flush()
+}
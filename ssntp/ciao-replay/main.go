@@ -0,0 +1,277 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/01org/ciao/ssntp"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+var (
+	recording = flag.String("recording", "", "SSNTP recording to replay")
+	server    = flag.String("server", "", "Server to replay a client recording to, or address to listen on when replaying a server recording")
+	port      = flag.Uint("port", 0, "Server port, defaults to the SSNTP one")
+	caCert    = flag.String("cacert", "", "CA certificate")
+	cert      = flag.String("cert", "", "Client or server certificate")
+	speed     = flag.Float64("speed", 1, "Replay speed factor, 0 replays all frames without delay")
+	wait      = flag.Duration("wait", time.Second, "Time to wait for replies once all frames are replayed")
+	peer      = flag.String("peer", "", "UUID of the recorded peer whose frames are replayed, defaults to the first one")
+	role      ssntp.Role
+)
+
+type replayer struct {
+	send func(frame *ssntp.Frame) error
+}
+
+// replayable tells if frame is one the replayed client or server would
+// have sent itself. KEEPALIVE, ACK and STREAM frames are generated by the
+// SSNTP package and are not replayed.
+func replayable(frame *ssntp.Frame) bool {
+	switch frame.Type {
+	case ssntp.STATUS:
+		status := (ssntp.Status)(frame.Operand)
+		return status != ssntp.KEEPALIVE && status != ssntp.ACK
+	case ssntp.STREAM:
+		return false
+	}
+
+	return true
+}
+
+func (r *replayer) replay(reader *ssntp.RecordingReader, peer string) error {
+	var last time.Time
+
+	for {
+		recorded, err := reader.Next()
+		if err == io.EOF {
+			time.Sleep(*wait)
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if !recorded.Sent || !replayable(&recorded.Frame) {
+			continue
+		}
+
+		if peer == "" {
+			peer = recorded.Peer
+		} else if recorded.Peer != peer {
+			continue
+		}
+
+		if *speed > 0 && !last.IsZero() {
+			time.Sleep(time.Duration(float64(recorded.Time.Sub(last)) / *speed))
+		}
+		last = recorded.Time
+
+		log.Printf("Replaying %s", recorded.Frame)
+		if err := r.send(&recorded.Frame); err != nil {
+			log.Printf("Could not replay %s: %s", recorded.Frame, err)
+		}
+	}
+}
+
+type replayClient struct {
+	ssntp ssntp.Client
+}
+
+func (client *replayClient) ConnectNotify() {
+	log.Printf("Connected")
+}
+
+func (client *replayClient) DisconnectNotify() {
+	log.Printf("Disconnected")
+}
+
+func (client *replayClient) StatusNotify(status ssntp.Status, frame *ssntp.Frame) {
+	log.Printf("Received %s", frame)
+}
+
+func (client *replayClient) CommandNotify(command ssntp.Command, frame *ssntp.Frame) {
+	log.Printf("Received %s", frame)
+}
+
+func (client *replayClient) EventNotify(event ssntp.Event, frame *ssntp.Frame) {
+	log.Printf("Received %s", frame)
+}
+
+func (client *replayClient) ErrorNotify(error ssntp.Error, frame *ssntp.Frame) {
+	log.Printf("Received %s", frame)
+}
+
+func (client *replayClient) send(frame *ssntp.Frame) error {
+	var err error
+
+	switch frame.Type {
+	case ssntp.COMMAND:
+		_, err = client.ssntp.SendCommand((ssntp.Command)(frame.Operand), frame.Payload)
+	case ssntp.STATUS:
+		_, err = client.ssntp.SendStatus((ssntp.Status)(frame.Operand), frame.Payload)
+	case ssntp.EVENT:
+		_, err = client.ssntp.SendEvent((ssntp.Event)(frame.Operand), frame.Payload)
+	case ssntp.ERROR:
+		_, err = client.ssntp.SendError((ssntp.Error)(frame.Operand), frame.Payload)
+	default:
+		err = fmt.Errorf("Unsupported frame type %s", frame.Type)
+	}
+
+	return err
+}
+
+type replayServer struct {
+	ssntp     ssntp.Server
+	connected chan string
+}
+
+func (server *replayServer) ConnectNotify(uuid string, role uint32) {
+	log.Printf("%s connected", uuid)
+
+	select {
+	case server.connected <- uuid:
+	default:
+	}
+}
+
+func (server *replayServer) DisconnectNotify(uuid string, role uint32) {
+	log.Printf("%s disconnected", uuid)
+}
+
+func (server *replayServer) StatusNotify(uuid string, status ssntp.Status, frame *ssntp.Frame) {
+	log.Printf("Received %s from %s", frame, uuid)
+}
+
+func (server *replayServer) CommandNotify(uuid string, command ssntp.Command, frame *ssntp.Frame) {
+	log.Printf("Received %s from %s", frame, uuid)
+}
+
+func (server *replayServer) EventNotify(uuid string, event ssntp.Event, frame *ssntp.Frame) {
+	log.Printf("Received %s from %s", frame, uuid)
+}
+
+func (server *replayServer) ErrorNotify(uuid string, error ssntp.Error, frame *ssntp.Frame) {
+	log.Printf("Received %s from %s", frame, uuid)
+}
+
+func (server *replayServer) sender(uuid string) func(frame *ssntp.Frame) error {
+	return func(frame *ssntp.Frame) error {
+		var err error
+
+		switch frame.Type {
+		case ssntp.COMMAND:
+			_, err = server.ssntp.SendCommand(uuid, (ssntp.Command)(frame.Operand), frame.Payload)
+		case ssntp.STATUS:
+			_, err = server.ssntp.SendStatus(uuid, (ssntp.Status)(frame.Operand), frame.Payload)
+		case ssntp.EVENT:
+			_, err = server.ssntp.SendEvent(uuid, (ssntp.Event)(frame.Operand), frame.Payload)
+		case ssntp.ERROR:
+			_, err = server.ssntp.SendError(uuid, (ssntp.Error)(frame.Operand), frame.Payload)
+		default:
+			err = fmt.Errorf("Unsupported frame type %s", frame.Type)
+		}
+
+		return err
+	}
+}
+
+// replayToServer replays a client recording: it connects to a server, e.g.
+// a scheduler under test, and sends it the frames the recorded client sent.
+func replayToServer(reader *ssntp.RecordingReader, config *ssntp.Config) error {
+	client := &replayClient{}
+
+	config.URI = *server
+	if err := client.ssntp.Dial(config, client); err != nil {
+		return err
+	}
+	defer client.ssntp.Close()
+
+	r := replayer{send: client.send}
+	return r.replay(reader, *peer)
+}
+
+// replayToClient replays a server recording: it waits for a client, e.g. a
+// launcher under test, to connect and sends it the frames the recorded
+// server sent to one of its recorded peers.
+func replayToClient(reader *ssntp.RecordingReader, config *ssntp.Config) error {
+	s := &replayServer{connected: make(chan string, 1)}
+
+	config.URI = *server
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ssntp.Serve(config, s)
+	}()
+	defer s.ssntp.Stop()
+
+	var uuid string
+	select {
+	case uuid = <-s.connected:
+	case err := <-served:
+		return err
+	}
+
+	r := replayer{send: s.sender(uuid)}
+	return r.replay(reader, *peer)
+}
+
+func main() {
+	flag.Var(&role, "role", "SSNTP role [agent, scheduler, controller, netagent, server, cnciagent], defaults to the recorded one")
+	flag.Parse()
+
+	if *recording == "" {
+		log.Fatalf("Missing recording")
+	}
+
+	file, err := os.Open(*recording)
+	if err != nil {
+		log.Fatalf("Could not open recording: %s", err)
+	}
+	defer file.Close()
+
+	reader, err := ssntp.NewRecordingReader(file)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+
+	header := reader.Header()
+	if role == ssntp.UNKNOWN {
+		role = (ssntp.Role)(header.Role)
+	}
+
+	config := &ssntp.Config{
+		CAcert: *caCert,
+		Cert:   *cert,
+		Role:   (uint32)(role),
+		Port:   (uint32)(*port),
+	}
+
+	log.Printf("Replaying %s recorded by %s (%s) on %s", *recording, header.UUID, role.String(), header.Start)
+
+	if header.Server {
+		err = replayToClient(reader, config)
+	} else {
+		err = replayToServer(reader, config)
+	}
+
+	if err != nil {
+		log.Fatalf("Replay failed: %s", err)
+	}
+}
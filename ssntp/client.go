@@ -17,12 +17,15 @@
 package ssntp
 
 import (
-	"crypto/tls"
 	"fmt"
 	"github.com/docker/distribution/uuid"
-	"math/rand"
+	"io"
 	"sync"
 	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/01org/ciao/payloads"
 )
 
 // ClientNotifier is the SSNTP client notification interface.
@@ -63,12 +66,13 @@ type ClientNotifier interface {
 type Client struct {
 	uuid       uuid.UUID
 	lUUID      lockedUUID
-	uris       []string
+	servers    *serverList
+	server     string
 	role       uint32
 	roleVerify bool
-	tls        *tls.Config
+	tls        *tlsConfig
 	ntf        ClientNotifier
-	transport  string
+	transport  netTransport
 	port       uint32
 	session    *session
 	status     connectionStatus
@@ -81,12 +85,34 @@ type Client struct {
 
 	trace *TraceConfig
 
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	backoff *backoff
+
+	encodings      []payloads.Encoding
+	payloadVersion payloads.Version
+
+	atLeastOnce bool
+	retry       *retryQueue
+	lastFrameID uint64
+
+	metrics Metrics
+
+	replies replyWaiters
+
+	recorder *frameRecorder
+
+	faults *faultInjector
+
 	configuration clusterConfiguration
 }
 
 func (client *Client) processSSNTPFrame(frame *Frame) {
 	defer client.frameWg.Done()
 
+	client.replies.deliver(frame)
+
 	switch (Type)(frame.Type) {
 	case COMMAND:
 		if (Command)(frame.Operand) == CONFIGURE {
@@ -102,6 +128,20 @@ func (client *Client) processSSNTPFrame(frame *Frame) {
 	default:
 		client.SendError(InvalidFrameType, nil)
 	}
+
+	if frame.ID != 0 {
+		client.session.Write(client.session.ackFrame(frame.ID))
+	}
+}
+
+func (client *Client) streamNotify(stream *Stream) {
+	ntf, ok := client.ntf.(ClientStreamNotifier)
+	if !ok {
+		discardStream(stream)
+		return
+	}
+
+	ntf.StreamNotify(stream)
 }
 
 func (client *Client) handleSSNTPServer() {
@@ -109,6 +149,19 @@ func (client *Client) handleSSNTPServer() {
 
 	for {
 		client.ntf.ConnectNotify()
+		if client.metrics != nil {
+			client.metrics.Connected(client.session.destRole)
+		}
+
+		stopCh := make(chan struct{})
+		if client.keepaliveInterval > 0 {
+			go client.session.keepalive(client.keepaliveInterval, stopCh)
+		}
+
+		if client.session.atLeastOnce {
+			client.retry.resend(client.session, 0)
+			go client.retry.resendLoop(client.session, stopCh)
+		}
 
 		for {
 			client.log.Infof("Waiting for next frame\n")
@@ -116,23 +169,63 @@ func (client *Client) handleSSNTPServer() {
 			var frame Frame
 			err := client.session.Read(&frame)
 			if err != nil {
+				client.session.endStreams()
+				if client.metrics != nil {
+					client.metrics.Disconnected(client.session.destRole)
+				}
+
 				client.status.Lock()
 				if client.status.status == ssntpClosed {
 					client.status.Unlock()
+					close(stopCh)
 					return
 				}
 				client.status.Unlock()
 
+				if isTimeout(err) {
+					client.log.Errorf("No frame received from server for %v, assuming it is dead\n",
+						client.session.keepaliveTimeout)
+					client.session.conn.Close()
+				}
 				client.log.Errorf("Read error: %s\n", err)
 				client.ntf.DisconnectNotify()
 				break
 			}
 
+			if client.session.isKeepalive(&frame) {
+				continue
+			}
+
+			if isAck(&frame) {
+				client.retry.ack(frame.ID)
+				continue
+			}
+
+			if frame.ID != 0 {
+				if frame.ID <= client.lastFrameID {
+					client.log.Infof("Duplicate frame %d\n", frame.ID)
+					client.session.Write(client.session.ackFrame(frame.ID))
+					continue
+				}
+				client.lastFrameID = frame.ID
+			}
+
+			// Stream chunks must be processed in order
+			if frame.Type == STREAM {
+				err := client.session.receiveStream(&frame, client.streamNotify)
+				if err != nil {
+					client.log.Errorf("Invalid STREAM frame: %s\n", err)
+				}
+				continue
+			}
+
 			client.frameWg.Add(1)
 			go client.processSSNTPFrame(&frame)
 		}
 
-		err := client.attemptDial()
+		close(stopCh)
+
+		err := client.attemptDial(true)
 		if err != nil {
 			client.log.Errorf("%s", err)
 			return
@@ -144,7 +237,9 @@ func (client *Client) sendConnect() (bool, error) {
 	var connected ConnectedFrame
 	client.log.Infof("Sending CONNECT\n")
 
-	connect := client.session.connectFrame()
+	connect := client.session.connectFrame(client.encodings, client.atLeastOnce)
+	connect.PayloadVersion = client.payloadVersion
+	connect.Timestamp = time.Now().UnixNano()
 	_, err := client.session.Write(connect)
 	if err != nil {
 		return true, err
@@ -155,6 +250,7 @@ func (client *Client) sendConnect() (bool, error) {
 	if err != nil {
 		return true, err
 	}
+	received := time.Now().UnixNano()
 
 	client.log.Infof("Received CONNECTED frame:\n%s\n", connected)
 
@@ -164,6 +260,12 @@ func (client *Client) sendConnect() (bool, error) {
 			return true, fmt.Errorf("SSNTP Client: Invalid Connected frame")
 		}
 	case ERROR:
+		if connected.Operand == (uint8)(ConnectionRefused) {
+			var refused payloads.ErrorConnectionRefused
+			_ = payloads.Unmarshal(connected.Payload, &refused)
+			return true, fmt.Errorf("SSNTP Client: Connection refused: %s (%d)", refused.Reason, refused.Limit)
+		}
+
 		if connected.Operand != (uint8)(ConnectionFailure) {
 			return false, fmt.Errorf("SSNTP Client: Connection failure")
 		}
@@ -175,6 +277,7 @@ func (client *Client) sendConnect() (bool, error) {
 	}
 
 	client.session.setDest(connected.Source[:16])
+	client.session.destRole = connected.Role
 	if client.roleVerify == true {
 		oidFound, err := verifyRole(client.session.conn, connected.Role)
 		if oidFound == false {
@@ -184,6 +287,19 @@ func (client *Client) sendConnect() (bool, error) {
 		}
 	}
 
+	if connected.Encoding != negotiateEncoding(client.encodings, []payloads.Encoding{connected.Encoding}) {
+		client.log.Errorf("SSNTP Client: Unsupported payload encoding %s, using YAML\n", connected.Encoding)
+		connected.Encoding = payloads.YAML
+	}
+	client.session.encoding = connected.Encoding
+	client.session.payloadVersion = negotiatePayloadVersion(client.payloadVersion, connected.PayloadVersion)
+	client.session.atLeastOnce = client.atLeastOnce && connected.AtLeastOnce
+	if connected.ConnectTimestamp == connect.Timestamp && connected.ReceiveTimestamp != 0 {
+		client.session.clockOffset, client.session.clockRTT = estimateClockOffset(connect.Timestamp,
+			connected.ReceiveTimestamp, connected.TransmitTimestamp, received)
+		client.session.clockChecked = true
+	}
+
 	client.status.Lock()
 	client.status.status = ssntpConnected
 	client.status.Unlock()
@@ -195,26 +311,40 @@ func (client *Client) sendConnect() (bool, error) {
 	return true, nil
 }
 
-func (client *Client) attemptDial() error {
-	delays := []int64{5, 10, 20, 40}
+// waitBackoff waits for the next backoff delay to expire. It returns an error
+// if the client is closed in the meantime.
+func (client *Client) waitBackoff(reason string) error {
+	delay := client.backoff.next()
+	client.log.Errorf("%s - retrying in %v\n", reason, delay)
 
-	if len(client.uris) == 0 {
-		return fmt.Errorf("No servers to connect to")
+	select {
+	case <-client.closed:
+		return fmt.Errorf("Connection closed")
+	case <-time.After(delay):
+		return nil
 	}
+}
 
+func (client *Client) attemptDial(reconnecting bool) error {
 	client.status.Lock()
 	client.closed = make(chan struct{})
 	client.status.Unlock()
 
-	source := rand.NewSource(time.Now().UnixNano())
-	r := rand.New(source)
+	// Do not immediately reconnect when losing the server, all of its
+	// other clients are most likely about to do the same.
+	if reconnecting {
+		client.servers.failed(client.server)
+		if err := client.waitBackoff("Lost connection to server"); err != nil {
+			return err
+		}
+	}
 
 	for {
 	URILoop:
-		for d := 0; ; d++ {
-			for _, uri := range client.uris {
+		for {
+			for _, uri := range client.servers.addresses() {
 				client.log.Infof("%s connecting to %s\n", client.uuid, uri)
-				conn, err := tls.Dial(client.transport, uri, client.tls)
+				conn, err := client.transport.dial(uri, client.tls.get())
 
 				client.status.Lock()
 				if client.status.status == ssntpClosed {
@@ -226,27 +356,24 @@ func (client *Client) attemptDial() error {
 				if err == nil {
 					client.log.Infof("Connected\n")
 					session := newSession(&client.uuid, client.role, 0, conn)
+					session.keepaliveTimeout = client.keepaliveTimeout
+					session.metrics = client.metrics
+					session.recorder = client.recorder
+					session.faults = client.faults
+					client.faults.armDisconnect(session)
 					client.session = session
+					client.server = uri
 
 					break URILoop
 				}
 
 				client.log.Errorf("Could not connect to %s (%s)\n", uri, err)
+				client.servers.failed(uri)
 			}
 
-			delay := r.Int63n(delays[d%len(delays)])
-			delay++ // Avoid waiting for 0 seconds
-			client.log.Errorf("All server URIs failed - retrying in %d seconds\n", delay)
-
-			// Wait for delay before reconnecting or return if the client is closed
-			select {
-			case <-client.closed:
-				return fmt.Errorf("Connection closed")
-			case <-time.After(time.Duration(delay) * time.Second):
-				break
+			if err := client.waitBackoff("All server URIs failed"); err != nil {
+				return err
 			}
-
-			continue
 		}
 
 		if client.session == nil {
@@ -257,10 +384,15 @@ func (client *Client) attemptDial() error {
 		if err != nil {
 			// Dialed but could not connect, try again
 			client.log.Errorf("%s", err)
-			client.Close()
 			if reconnect == true {
+				client.session.conn.Close()
+				client.servers.failed(client.server)
+				if err := client.waitBackoff("Could not connect"); err != nil {
+					return err
+				}
 				continue
 			} else {
+				client.Close()
 				client.ntf.DisconnectNotify()
 				return err
 			}
@@ -270,12 +402,20 @@ func (client *Client) attemptDial() error {
 		break
 	}
 
+	client.backoff.reset()
+	client.servers.succeeded(client.server)
+
 	return nil
 }
 
 // Dial attempts to connect to a SSNTP server, as specified by the config argument.
 // Dial will try and retry to connect to this server and will wait for it to show
-// up if it's temporarily unavailable. A client can be closed while it's still
+// up if it's temporarily unavailable, spacing out its attempts as described by
+// the config Reconnect backoff. The same backoff is used to reconnect to the
+// server if the connection is lost, and ConnectNotify is called again once
+// reconnected. When several servers are configured, through URIs or SRV,
+// the client fails over to the next healthy one when it can not connect to
+// or loses its current server. A client can be closed while it's still
 // trying to connect to the SSNTP server, so that one can properly kill a client if
 // e.g. no server will ever come alive.
 // Once connected a separate routine will listen for server commands, statuses or
@@ -321,15 +461,7 @@ func (client *Client) Dial(config *Config, ntf ClientNotifier) error {
 		client.port = port
 	}
 
-	if len(config.Transport) == 0 {
-		client.transport = "tcp"
-	} else {
-		if config.Transport != "tcp" && config.Transport != "unix" {
-			client.transport = "tcp"
-		} else {
-			client.transport = config.Transport
-		}
-	}
+	client.transport = newTransport(config.Transport)
 
 	client.role = config.Role
 	client.roleVerify = config.RoleVerification
@@ -349,35 +481,37 @@ func (client *Client) Dial(config *Config, ntf ClientNotifier) error {
 	}
 
 	client.trace = config.Trace
+	client.retry = newRetryQueue(client.log)
+	client.keepaliveInterval, client.keepaliveTimeout = config.keepaliveSettings()
+	client.backoff = newBackoff(config.Reconnect)
+	client.encodings = config.Encodings
+	client.payloadVersion = config.payloadVersion()
+	client.atLeastOnce = config.AtLeastOnce
+	client.metrics = config.Metrics
 	client.ntf = ntf
-	client.tls = prepareTLSConfig(config, false)
+	client.tls = newTLSConfig(config, false)
 
-	/* First we add the configured server URI */
-	if len(config.URI) != 0 {
-		client.uris = append(client.uris, fmt.Sprintf("%s:%d", config.URI, client.port))
-	}
+	client.servers = newServerList(config, client.port, client.log)
 
-	/* Then we parse the CA certificate to find FQDNs and/or IPs to connect to */
-	ips, fqdns, err := parseCertificate(config)
+	var err error
+	client.faults, err = newFaultInjector(config, client.log)
 	if err != nil {
-		client.log.Warningf("%s", err)
-	} else {
-		/* We prefer IPs over FQDNs */
-		for _, ip := range ips {
-			client.uris = append(client.uris, fmt.Sprintf("%s:%d", ip, client.port))
-		}
+		client.log.Errorf("%s\n", err)
+		return err
+	}
 
-		for _, fqdn := range fqdns {
-			client.uris = append(client.uris, fmt.Sprintf("%s:%d", fqdn, client.port))
+	if config.Recording != "" {
+		client.recorder, err = newFrameRecorder(config.Recording, client.uuid.String(), client.role, false, client.log)
+		if err != nil {
+			client.log.Errorf("%s\n", err)
+			return err
 		}
 	}
 
-	/* Last resort: localhost */
-	client.uris = append(client.uris, fmt.Sprintf("%s:%d", defaultURL, client.port))
-
-	err = client.attemptDial()
+	err = client.attemptDial(false)
 	if err != nil {
 		client.log.Errorf("%s", err)
+		client.recorder.close()
 		return err
 	}
 
@@ -416,10 +550,66 @@ func (client *Client) Close() {
 		break
 	}
 
+	client.recorder.close()
+
 	freeUUID(client.lUUID)
 }
 
-func (client *Client) sendCommand(cmd Command, payload []byte, trace *TraceConfig) (int, error) {
+// Encoding returns the payload encoding agreed on with the SSNTP server.
+// Payloads sent by the client can be marshalled with this encoding, and
+// will be transcoded by the server for peers that do not support it.
+func (client *Client) Encoding() payloads.Encoding {
+	client.status.Lock()
+	defer client.status.Unlock()
+
+	if client.status.status != ssntpConnected || client.session == nil {
+		return payloads.YAML
+	}
+
+	return client.session.encoding
+}
+
+// PayloadVersion returns the payload version agreed on with the SSNTP
+// server. Payloads sent by the client can be marshalled for this version
+// with payloads.MarshalVersion.
+func (client *Client) PayloadVersion() payloads.Version {
+	client.status.Lock()
+	defer client.status.Unlock()
+
+	if client.status.status != ssntpConnected || client.session == nil {
+		return payloads.Version1
+	}
+
+	return client.session.payloadVersion
+}
+
+// ClockOffset returns how far the clock of the server was ahead of the
+// client one when the client last connected, and the round trip time of
+// the check, which bounds the error of the estimate.  ok is false if the
+// client is not connected or the server predates the clock check.
+func (client *Client) ClockOffset() (offset, rtt time.Duration, ok bool) {
+	client.status.Lock()
+	defer client.status.Unlock()
+
+	if client.status.status != ssntpConnected || client.session == nil ||
+		!client.session.clockChecked {
+		return 0, 0, false
+	}
+
+	return client.session.clockOffset, client.session.clockRTT, true
+}
+
+// write sends frame to the server, keeping it until it is acknowledged
+// if the at-least-once mode is on.
+func (client *Client) write(ctx context.Context, session *session, frame *Frame) (int, error) {
+	if session.atLeastOnce && reliable(frame) {
+		return client.retry.send(ctx, session, frame)
+	}
+
+	return session.writeContext(ctx, frame)
+}
+
+func (client *Client) sendCommand(ctx context.Context, cmd Command, payload []byte, trace *TraceConfig) (int, error) {
 	client.status.Lock()
 	if client.status.status == ssntpClosed {
 		client.status.Unlock()
@@ -430,10 +620,10 @@ func (client *Client) sendCommand(cmd Command, payload []byte, trace *TraceConfi
 	session := client.session
 	frame := session.commandFrame(cmd, payload, trace)
 
-	return session.Write(frame)
+	return client.write(ctx, session, frame)
 }
 
-func (client *Client) sendStatus(status Status, payload []byte, trace *TraceConfig) (int, error) {
+func (client *Client) sendStatus(ctx context.Context, status Status, payload []byte, trace *TraceConfig) (int, error) {
 	client.status.Lock()
 	if client.status.status == ssntpClosed {
 		client.status.Unlock()
@@ -444,10 +634,10 @@ func (client *Client) sendStatus(status Status, payload []byte, trace *TraceConf
 	session := client.session
 	frame := session.statusFrame(status, payload, trace)
 
-	return session.Write(frame)
+	return client.write(ctx, session, frame)
 }
 
-func (client *Client) sendEvent(event Event, payload []byte, trace *TraceConfig) (int, error) {
+func (client *Client) sendEvent(ctx context.Context, event Event, payload []byte, trace *TraceConfig) (int, error) {
 	client.status.Lock()
 	if client.status.status == ssntpClosed {
 		client.status.Unlock()
@@ -458,10 +648,10 @@ func (client *Client) sendEvent(event Event, payload []byte, trace *TraceConfig)
 	session := client.session
 	frame := session.eventFrame(event, payload, trace)
 
-	return session.Write(frame)
+	return client.write(ctx, session, frame)
 }
 
-func (client *Client) sendError(error Error, payload []byte, trace *TraceConfig) (int, error) {
+func (client *Client) sendError(ctx context.Context, error Error, payload []byte, trace *TraceConfig) (int, error) {
 	client.status.Lock()
 	if client.status.status == ssntpClosed {
 		client.status.Unlock()
@@ -472,47 +662,47 @@ func (client *Client) sendError(error Error, payload []byte, trace *TraceConfig)
 	session := client.session
 	frame := session.errorFrame(error, payload, trace)
 
-	return session.Write(frame)
+	return client.write(ctx, session, frame)
 }
 
 // SendCommand sends a specific command and its payload to the SSNTP server.
 func (client *Client) SendCommand(cmd Command, payload []byte) (int, error) {
-	return client.sendCommand(cmd, payload, client.trace)
+	return client.sendCommand(context.Background(), cmd, payload, client.trace)
 }
 
 // SendStatus sends a specific status and its payload to the SSNTP server.
 func (client *Client) SendStatus(status Status, payload []byte) (int, error) {
-	return client.sendStatus(status, payload, client.trace)
+	return client.sendStatus(context.Background(), status, payload, client.trace)
 }
 
 // SendEvent sends a specific status and its payload to the SSNTP server.
 func (client *Client) SendEvent(event Event, payload []byte) (int, error) {
-	return client.sendEvent(event, payload, client.trace)
+	return client.sendEvent(context.Background(), event, payload, client.trace)
 }
 
 // SendError sends an error back to the SSNTP server.
 // This is just for notification purposes, to let e.g. the server know that
 // it sent an unexpected frame.
 func (client *Client) SendError(error Error, payload []byte) (int, error) {
-	return client.sendError(error, payload, client.trace)
+	return client.sendError(context.Background(), error, payload, client.trace)
 }
 
 // SendTracedCommand sends a specific command and its payload to the SSNTP server.
 // The SSNTP command frame will be traced according to the trace argument.
 func (client *Client) SendTracedCommand(cmd Command, payload []byte, trace *TraceConfig) (int, error) {
-	return client.sendCommand(cmd, payload, trace)
+	return client.sendCommand(context.Background(), cmd, payload, trace)
 }
 
 // SendTracedStatus sends a specific status and its payload to the SSNTP server.
 // The SSNTP status frame will be traced according to the trace argument.
 func (client *Client) SendTracedStatus(status Status, payload []byte, trace *TraceConfig) (int, error) {
-	return client.sendStatus(status, payload, trace)
+	return client.sendStatus(context.Background(), status, payload, trace)
 }
 
 // SendTracedEvent sends a specific status and its payload to the SSNTP server.
 // The SSNTP event frame will be traced according to the trace argument.
 func (client *Client) SendTracedEvent(event Event, payload []byte, trace *TraceConfig) (int, error) {
-	return client.sendEvent(event, payload, trace)
+	return client.sendEvent(context.Background(), event, payload, trace)
 }
 
 // SendTracedError sends an error back to the SSNTP server.
@@ -520,7 +710,66 @@ func (client *Client) SendTracedEvent(event Event, payload []byte, trace *TraceC
 // it sent an unexpected frame.
 // The SSNTP error frame will be traced according to the trace argument.
 func (client *Client) SendTracedError(error Error, payload []byte, trace *TraceConfig) (int, error) {
-	return client.sendError(error, payload, trace)
+	return client.sendError(context.Background(), error, payload, trace)
+}
+
+// SendCommandContext sends a specific command and its payload to the SSNTP
+// server, giving up when ctx is done. Frames that are given up on before
+// being written are never sent, the ctx error is then returned. When the
+// ctx deadline expires while the frame is being written, the write fails
+// and the connection to the server is lost.
+func (client *Client) SendCommandContext(ctx context.Context, cmd Command, payload []byte) (int, error) {
+	return client.sendCommand(ctx, cmd, payload, client.trace)
+}
+
+// SendStatusContext sends a specific status and its payload to the SSNTP
+// server, giving up when ctx is done, see SendCommandContext.
+func (client *Client) SendStatusContext(ctx context.Context, status Status, payload []byte) (int, error) {
+	return client.sendStatus(ctx, status, payload, client.trace)
+}
+
+// SendEventContext sends a specific event and its payload to the SSNTP
+// server, giving up when ctx is done, see SendCommandContext.
+func (client *Client) SendEventContext(ctx context.Context, event Event, payload []byte) (int, error) {
+	return client.sendEvent(ctx, event, payload, client.trace)
+}
+
+// SendErrorContext sends an error back to the SSNTP server, giving up when
+// ctx is done, see SendCommandContext.
+func (client *Client) SendErrorContext(ctx context.Context, error Error, payload []byte) (int, error) {
+	return client.sendError(ctx, error, payload, client.trace)
+}
+
+// OpenStream opens a stream to the SSNTP server. Everything written to the
+// returned stream is sent to the server as STREAM frames, and the stream
+// must be closed once done. The stream fails if the connection to the
+// server is lost before it is closed.
+func (client *Client) OpenStream(name string) (io.WriteCloser, error) {
+	client.status.Lock()
+	defer client.status.Unlock()
+
+	if client.status.status != ssntpConnected {
+		return nil, fmt.Errorf("Client not connected")
+	}
+
+	return client.session.openStream(name), nil
+}
+
+// ReloadCertificates reads the client CA and certificate files again.
+// The current connection is kept, the new certificates are used the next
+// time the client connects to the server.
+func (client *Client) ReloadCertificates() error {
+	if client.tls == nil {
+		return fmt.Errorf("SSNTP client not started")
+	}
+
+	if err := client.tls.reload(); err != nil {
+		client.log.Errorf("Could not reload certificates: %s\n", err)
+		return err
+	}
+
+	client.log.Infof("Reloaded certificates\n")
+	return nil
 }
 
 // UUID exports the SSNTP client Universally Unique ID.
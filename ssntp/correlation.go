@@ -0,0 +1,196 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// newCorrelationID returns a random, non zero, correlation ID. IDs are
+// random rather than sequential as replies may be forwarded to all clients
+// playing a role, e.g. all controllers, and must only match one request.
+func newCorrelationID() (uint64, error) {
+	var b [8]byte
+
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+
+		if id := binary.BigEndian.Uint64(b[:]); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// correlatedFrame builds a frame of type frameType carrying correlationID.
+func (session *session) correlatedFrame(frameType Type, operand uint8, payload []byte,
+	trace *TraceConfig, correlationID uint64) (f *Frame) {
+	switch frameType {
+	case COMMAND:
+		f = session.commandFrame((Command)(operand), payload, trace)
+	case STATUS:
+		f = session.statusFrame((Status)(operand), payload, trace)
+	case EVENT:
+		f = session.eventFrame((Event)(operand), payload, trace)
+	default:
+		f = session.errorFrame((Error)(operand), payload, trace)
+	}
+
+	f.CorrelationID = correlationID
+
+	return
+}
+
+// replyWaiters tracks the requests a client is waiting for a reply to.
+type replyWaiters struct {
+	sync.Mutex
+	waiters map[uint64]chan *Frame
+}
+
+func (r *replyWaiters) add(correlationID uint64) chan *Frame {
+	reply := make(chan *Frame, 1)
+
+	r.Lock()
+	if r.waiters == nil {
+		r.waiters = make(map[uint64]chan *Frame)
+	}
+	r.waiters[correlationID] = reply
+	r.Unlock()
+
+	return reply
+}
+
+func (r *replyWaiters) remove(correlationID uint64) {
+	r.Lock()
+	delete(r.waiters, correlationID)
+	r.Unlock()
+}
+
+// deliver hands frame over to the request it replies to, if any is
+// waiting. Only the first reply to a request is delivered.
+func (r *replyWaiters) deliver(frame *Frame) {
+	if frame.CorrelationID == 0 {
+		return
+	}
+
+	r.Lock()
+	reply := r.waiters[frame.CorrelationID]
+	delete(r.waiters, frame.CorrelationID)
+	r.Unlock()
+
+	if reply != nil {
+		reply <- frame
+	}
+}
+
+func (client *Client) sendCorrelated(ctx context.Context, frameType Type, operand uint8, payload []byte, correlationID uint64) (int, error) {
+	client.status.Lock()
+	if client.status.status == ssntpClosed {
+		client.status.Unlock()
+		return -1, fmt.Errorf("Client not connected")
+	}
+	client.status.Unlock()
+
+	session := client.session
+	frame := session.correlatedFrame(frameType, operand, payload, client.trace, correlationID)
+
+	return client.write(ctx, session, frame)
+}
+
+// SendCommandWithReply sends a command and its payload to the SSNTP server
+// and waits for the first STATUS, EVENT, ERROR or COMMAND frame sent in
+// reply to it, e.g. a StartFailure error for a START command. The command
+// carries a new correlation ID and replies are the frames that carry the
+// same ID, see the Reply methods. Replies are still passed to the client
+// notifier.
+// SendCommandWithReply gives up when ctx is done, e.g. when its deadline
+// expires, and then returns the ctx error.
+func (client *Client) SendCommandWithReply(ctx context.Context, cmd Command, payload []byte) (*Frame, error) {
+	correlationID, err := newCorrelationID()
+	if err != nil {
+		return nil, err
+	}
+
+	reply := client.replies.add(correlationID)
+	defer client.replies.remove(correlationID)
+
+	if _, err := client.sendCorrelated(ctx, COMMAND, (uint8)(cmd), payload, correlationID); err != nil {
+		return nil, err
+	}
+
+	select {
+	case frame := <-reply:
+		return frame, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ReplyStatus sends a status and its payload to the SSNTP server in reply
+// to the request frame, so that it can be matched to the request.
+func (client *Client) ReplyStatus(request *Frame, status Status, payload []byte) (int, error) {
+	return client.sendCorrelated(context.Background(), STATUS, (uint8)(status), payload, request.CorrelationID)
+}
+
+// ReplyEvent sends an event and its payload to the SSNTP server in reply
+// to the request frame, so that it can be matched to the request.
+func (client *Client) ReplyEvent(request *Frame, event Event, payload []byte) (int, error) {
+	return client.sendCorrelated(context.Background(), EVENT, (uint8)(event), payload, request.CorrelationID)
+}
+
+// ReplyError sends an error and its payload to the SSNTP server in reply
+// to the request frame, so that it can be matched to the request.
+func (client *Client) ReplyError(request *Frame, error Error, payload []byte) (int, error) {
+	return client.sendCorrelated(context.Background(), ERROR, (uint8)(error), payload, request.CorrelationID)
+}
+
+func (server *Server) sendCorrelated(ctx context.Context, uuid string, frameType Type, operand uint8, payload []byte, correlationID uint64) (int, error) {
+	session := server.getSession(uuid)
+	if session == nil {
+		return -1, fmt.Errorf("Unknown UUID %s", uuid)
+	}
+
+	frame := session.correlatedFrame(frameType, operand, payload, server.trace, correlationID)
+	return server.write(ctx, uuid, session, frame)
+}
+
+// ReplyStatus sends a status and its payload to a client in reply to the
+// request frame, so that the client can match it to its request.
+// The client is specified by its uuid
+func (server *Server) ReplyStatus(uuid string, request *Frame, status Status, payload []byte) (int, error) {
+	return server.sendCorrelated(context.Background(), uuid, STATUS, (uint8)(status), payload, request.CorrelationID)
+}
+
+// ReplyEvent sends an event and its payload to a client in reply to the
+// request frame, so that the client can match it to its request.
+// The client is specified by its uuid
+func (server *Server) ReplyEvent(uuid string, request *Frame, event Event, payload []byte) (int, error) {
+	return server.sendCorrelated(context.Background(), uuid, EVENT, (uint8)(event), payload, request.CorrelationID)
+}
+
+// ReplyError sends an error and its payload to a client in reply to the
+// request frame, so that the client can match it to its request.
+// The client is specified by its uuid
+func (server *Server) ReplyError(uuid string, request *Frame, error Error, payload []byte) (int, error) {
+	return server.sendCorrelated(context.Background(), uuid, ERROR, (uint8)(error), payload, request.CorrelationID)
+}
@@ -0,0 +1,188 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// srvService and srvProto name the DNS SRV records SSNTP servers are
+// advertised with, e.g. _ssntp._tcp.example.com.
+const (
+	srvService = "ssntp"
+	srvProto   = "tcp"
+)
+
+// lookupSRV is overridden by tests.
+var lookupSRV = net.LookupSRV
+
+// serverList is the ordered list of SSNTP servers a client connects to.
+// Servers that are up come first, in their configured order, followed by
+// the ones the client recently failed to connect to or lost, from the least
+// to the most failing. A client thus fails over to a standby server when its
+// primary dies, and stays on it until the standby fails in turn.
+type serverList struct {
+	sync.Mutex
+
+	// configured are the servers set in the client configuration and
+	// fallback the ones found in the CA certificate, followed by
+	// localhost. They all carry their port.
+	configured []string
+	fallback   []string
+
+	// srv is the domain SRV records are looked up in, if any.
+	srv string
+
+	failures map[string]int
+
+	log Logger
+}
+
+// hostPort joins host and port into an address.  host may be a bare or
+// bracketed IPv6 address, which is bracketed in the address.
+func hostPort(host string, port uint32) string {
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+}
+
+// serverAddress appends the default port to uri if it does not carry one.
+func serverAddress(uri string, port uint32) string {
+	if _, _, err := net.SplitHostPort(uri); err == nil {
+		return uri
+	}
+
+	return hostPort(uri, port)
+}
+
+func newServerList(config *Config, port uint32, log Logger) *serverList {
+	list := &serverList{
+		srv:      config.SRV,
+		failures: make(map[string]int),
+		log:      log,
+	}
+
+	/* First we add the configured server URIs */
+	if len(config.URI) != 0 {
+		list.configured = append(list.configured, serverAddress(config.URI, port))
+	}
+
+	for _, uri := range config.URIs {
+		list.configured = append(list.configured, serverAddress(uri, port))
+	}
+
+	/* Then we parse the CA certificate to find FQDNs and/or IPs to connect to */
+	ips, fqdns, err := parseCertificate(config)
+	if err != nil {
+		log.Warningf("%s", err)
+	} else {
+		/* We prefer IPs over FQDNs */
+		for _, ip := range ips {
+			list.fallback = append(list.fallback, hostPort(ip, port))
+		}
+
+		for _, fqdn := range fqdns {
+			list.fallback = append(list.fallback, hostPort(fqdn, port))
+		}
+	}
+
+	/* Last resort: localhost */
+	list.fallback = append(list.fallback, hostPort(defaultURL, port))
+
+	return list
+}
+
+// lookup returns the servers advertised in the SRV records of list.srv,
+// ordered by priority and weight.
+func (list *serverList) lookup() []string {
+	if list.srv == "" {
+		return nil
+	}
+
+	_, records, err := lookupSRV(srvService, srvProto, list.srv)
+	if err != nil {
+		list.log.Errorf("Could not look up SSNTP servers in %s (%s)\n", list.srv, err)
+		return nil
+	}
+
+	var servers []string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+		servers = append(servers, hostPort(target, uint32(record.Port)))
+	}
+
+	return servers
+}
+
+type byFailures struct {
+	servers  []string
+	failures map[string]int
+}
+
+func (s byFailures) Len() int      { return len(s.servers) }
+func (s byFailures) Swap(i, j int) { s.servers[i], s.servers[j] = s.servers[j], s.servers[i] }
+func (s byFailures) Less(i, j int) bool {
+	return s.failures[s.servers[i]] < s.failures[s.servers[j]]
+}
+
+// addresses returns the addresses of the servers to try, in order.
+// SRV records are looked up again every time, right after the configured
+// URIs, so that servers can be added to or removed from the DNS while
+// clients are running.
+func (list *serverList) addresses() []string {
+	srvServers := list.lookup()
+
+	list.Lock()
+	defer list.Unlock()
+
+	var candidates []string
+	candidates = append(candidates, list.configured...)
+	candidates = append(candidates, srvServers...)
+	candidates = append(candidates, list.fallback...)
+
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, address := range candidates {
+		if seen[address] {
+			continue
+		}
+		seen[address] = true
+		addresses = append(addresses, address)
+	}
+
+	sort.Stable(byFailures{addresses, list.failures})
+
+	return addresses
+}
+
+// failed records a failure to connect to, or the loss of, the server at
+// address.
+func (list *serverList) failed(address string) {
+	list.Lock()
+	list.failures[address]++
+	list.Unlock()
+}
+
+// succeeded records a successful connection to the server at address.
+func (list *serverList) succeeded(address string) {
+	list.Lock()
+	delete(list.failures, address)
+	list.Unlock()
+}
@@ -0,0 +1,213 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FaultsEnv is the environment variable SSNTP clients and servers read their
+// fault injection settings from when their Config does not set any, e.g.
+//
+//	SSNTP_FAULTS="drop=0.05,delay=100ms,jitter=50ms,disconnect=5m"
+//
+// See ParseFaultInjection for the settings syntax.
+const FaultsEnv = "SSNTP_FAULTS"
+
+// FaultInjection describes the faults an SSNTP client or server injects in
+// its connections, so that its users can be tested against lossy, slow or
+// unreliable networks. Faults only apply to the frames an SSNTP entity
+// sends once connected, STREAM frames excepted, and to the connections it
+// establishes or accepts. Fault injection is meant for testing clusters and
+// must not be enabled in production.
+type FaultInjection struct {
+	// DropRate is the probability, between 0 and 1, that a frame is
+	// silently dropped instead of being sent.
+	DropRate float64
+
+	// Delay is the time frames are held for before being sent.
+	Delay time.Duration
+
+	// DelayJitter is the maximum random time added to Delay for each
+	// frame.
+	DelayJitter time.Duration
+
+	// DisconnectInterval is the mean time after which connections are
+	// closed. Each connection is closed after a random time between 0
+	// and twice DisconnectInterval. 0 means connections are never closed.
+	DisconnectInterval time.Duration
+
+	// Seed seeds the random number generator deciding which frames are
+	// dropped and how long they and the connections are delayed and kept.
+	// 0 means a time based seed.
+	Seed int64
+}
+
+// ParseFaultInjection parses fault injection settings given as a comma
+// separated list of key=value pairs, where the keys are drop, delay, jitter,
+// disconnect and seed, e.g. "drop=0.05,delay=100ms". drop is a DropRate
+// probability, delay, jitter and disconnect are durations as parsed by
+// time.ParseDuration. An empty string yields nil settings.
+func ParseFaultInjection(s string) (*FaultInjection, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+
+	var faults FaultInjection
+	var err error
+
+	for _, setting := range strings.Split(s, ",") {
+		kv := strings.SplitN(setting, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("Invalid fault injection setting %q", setting)
+		}
+
+		key, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		switch key {
+		case "drop":
+			faults.DropRate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (faults.DropRate < 0 || faults.DropRate > 1) {
+				err = fmt.Errorf("drop rate must be between 0 and 1")
+			}
+		case "delay":
+			faults.Delay, err = time.ParseDuration(value)
+		case "jitter":
+			faults.DelayJitter, err = time.ParseDuration(value)
+		case "disconnect":
+			faults.DisconnectInterval, err = time.ParseDuration(value)
+		case "seed":
+			faults.Seed, err = strconv.ParseInt(value, 10, 64)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Invalid fault injection setting %q: %v", setting, err)
+		}
+	}
+
+	return &faults, nil
+}
+
+// faultInjector injects the configured faults in the sessions of an SSNTP
+// client or server.
+type faultInjector struct {
+	FaultInjection
+
+	sync.Mutex
+	rand *rand.Rand
+	log  Logger
+}
+
+// newFaultInjector returns the fault injector for config, or nil if no
+// fault is to be injected. The FaultsEnv environment variable is used when
+// config does not set any fault.
+func newFaultInjector(config *Config, log Logger) (*faultInjector, error) {
+	faults := config.Faults
+	if faults == nil {
+		var err error
+		faults, err = ParseFaultInjection(os.Getenv(FaultsEnv))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if faults == nil || (faults.DropRate <= 0 && faults.Delay <= 0 &&
+		faults.DelayJitter <= 0 && faults.DisconnectInterval <= 0) {
+		return nil, nil
+	}
+
+	seed := faults.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+
+	log.Infof("Injecting faults: drop rate %.3f, delay %s, jitter %s, disconnect interval %s\n",
+		faults.DropRate, faults.Delay, faults.DelayJitter, faults.DisconnectInterval)
+
+	return &faultInjector{
+		FaultInjection: *faults,
+		rand:           rand.New(rand.NewSource(seed)),
+		log:            log,
+	}, nil
+}
+
+// drop tells if frame is to be dropped.
+func (f *faultInjector) drop(frame *Frame) bool {
+	if f == nil || f.DropRate <= 0 || frame.Type == STREAM {
+		return false
+	}
+
+	f.Lock()
+	drop := f.rand.Float64() < f.DropRate
+	f.Unlock()
+
+	if drop {
+		f.log.Infof("Fault injection: dropping %s frame\n", frame)
+	}
+
+	return drop
+}
+
+// delay holds frame for the configured delay, or until ctx is done.
+func (f *faultInjector) delay(ctx context.Context, frame *Frame) error {
+	if f == nil || frame.Type == STREAM || (f.Delay <= 0 && f.DelayJitter <= 0) {
+		return nil
+	}
+
+	d := f.Delay
+	if f.DelayJitter > 0 {
+		f.Lock()
+		d += time.Duration(f.rand.Int63n(int64(f.DelayJitter)))
+		f.Unlock()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// armDisconnect schedules the closing of the session connection after a
+// random time, if connections are to be closed.
+func (f *faultInjector) armDisconnect(session *session) {
+	if f == nil || f.DisconnectInterval <= 0 {
+		return
+	}
+
+	f.Lock()
+	d := time.Duration(f.rand.Int63n(2 * int64(f.DisconnectInterval)))
+	f.Unlock()
+
+	conn := session.conn
+	time.AfterFunc(d, func() {
+		f.log.Infof("Fault injection: closing connection to %s\n", conn.RemoteAddr())
+		conn.Close()
+	})
+}
@@ -18,6 +18,10 @@ package ssntp
 
 import (
 	"sync"
+
+	"golang.org/x/net/context"
+
+	"github.com/01org/ciao/payloads"
 )
 
 // ForwardDecision tells SSNTP how it should forward a frame.
@@ -36,6 +40,15 @@ const (
 	// Queue the frame. SSNTP will queue the frame and the caller will have to call
 	// into the SSNTP Server queueing API to fetch it back.
 	Queue
+
+	// Broadcast the frame to all clients playing at least one of the
+	// roles given to the ForwardDestination Broadcast method, except
+	// the frame sender.
+	Broadcast
+
+	// Multicast the frame to the set of clients given to the
+	// ForwardDestination Multicast method.
+	Multicast
 )
 
 // ForwardDestination is returned by the forwading interfaces
@@ -44,10 +57,13 @@ const (
 // The interface implementer needs to specify if the frame
 // should be forwarded, discarded or queued (Decision).
 // If the implementer decision is to forward the frame, it
-// should also provide a list of recipients to forward it to (UUIDs)
+// should also provide a list of recipients to forward it to (UUIDs),
+// or the roles of the clients to broadcast it to.
 type ForwardDestination struct {
 	decision       ForwardDecision
 	recipientUUIDs []string
+	role           Role
+	payload        []byte
 }
 
 // AddRecipient adds a recipient to a ForwardDestination structure.
@@ -58,6 +74,42 @@ func (d *ForwardDestination) AddRecipient(uuid string) {
 	d.recipientUUIDs = append(d.recipientUUIDs, uuid)
 }
 
+// Broadcast sets the forwarding decision to Broadcast, for the frame to be
+// forwarded to all connected clients playing at least one of the role
+// roles, e.g. AGENT|NETAGENT for all compute and network nodes.
+func (d *ForwardDestination) Broadcast(role Role) {
+	d.decision = Broadcast
+	d.role = role
+}
+
+// Multicast sets the forwarding decision to Multicast and adds uuids to
+// the set of recipients. Each recipient gets the frame once, even if it
+// is added several times.
+func (d *ForwardDestination) Multicast(uuids ...string) {
+	d.decision = Multicast
+
+	for _, uuid := range uuids {
+		duplicate := false
+		for _, recipient := range d.recipientUUIDs {
+			if recipient == uuid {
+				duplicate = true
+				break
+			}
+		}
+
+		if !duplicate {
+			d.recipientUUIDs = append(d.recipientUUIDs, uuid)
+		}
+	}
+}
+
+// SetPayload replaces the payload of the forwarded frame with payload,
+// e.g. for the forwarder to complete the payload it received before it
+// reaches its recipients.  payload can use any encoding.
+func (d *ForwardDestination) SetPayload(payload []byte) {
+	d.payload = payload
+}
+
 // SetDecision is a helper for setting the ForwardDestination Decision field.
 func (d *ForwardDestination) SetDecision(decision ForwardDecision) {
 	d.decision = decision
@@ -250,7 +302,53 @@ func (f *frameForward) deleteForwardDestination(dest *session) {
 	f.forwardMutex.Unlock()
 }
 
-func forwardDestination(destination ForwardDestination, server *Server, frame *Frame) {
+// forwardTo forwards frame to session, transcoding its payload to YAML if the
+// session peer does not support the payload encoding.
+// The frame ID, if any, was given by the frame sender and the forwarded frame
+// gets a new one if the at-least-once mode is on with the session peer.
+// Forwarding gives up after the server forward timeout, if any.
+func forwardTo(server *Server, session *session, frame *Frame) {
+	f := *frame
+	f.ID = 0
+	f.Relay = nil
+
+	encoding := payloads.PayloadEncoding(frame.Payload)
+	if encoding != payloads.YAML && encoding != session.encoding {
+		payload, err := payloads.Transcode(frame.Payload, payloads.YAML)
+		if err != nil {
+			server.log.Errorf("Could not transcode %s payload for %s: %s\n", encoding, session.dest, err)
+			return
+		}
+
+		f.Payload = payload
+		f.PayloadLength = (uint32)(len(payload))
+	}
+
+	ctx := context.Background()
+	if server.forwardTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, server.forwardTimeout)
+		defer cancel()
+	}
+
+	if _, err := server.write(ctx, session.dest.String(), session, &f); err == context.DeadlineExceeded {
+		server.log.Errorf("Timed out forwarding %s frame to %s\n", f.Type, session.dest)
+	}
+}
+
+func forwardDestination(destination ForwardDestination, server *Server, source string, frame *Frame) {
+	if destination.payload != nil {
+		f := *frame
+		f.Payload = destination.payload
+		f.PayloadLength = (uint32)(len(destination.payload))
+		frame = &f
+	}
+
+	if destination.decision == Broadcast {
+		broadcast(server, destination.role, source, frame)
+		return
+	}
+
 	/* TODO Handle queueing */
 	if destination.decision == Discard || destination.recipientUUIDs == nil {
 		return
@@ -263,7 +361,21 @@ func forwardDestination(destination ForwardDestination, server *Server, frame *F
 			continue
 		}
 
-		session.Write(frame)
+		forwardTo(server, session, frame)
+	}
+	server.sessionMutex.RUnlock()
+}
+
+// broadcast forwards frame to all sessions with a peer playing one of the
+// role roles, except source.
+func broadcast(server *Server, role Role, source string, frame *Frame) {
+	server.sessionMutex.RLock()
+	for uuid, session := range server.sessions {
+		if uuid == source || session.destRole&(uint32)(role) == 0 {
+			continue
+		}
+
+		forwardTo(server, session, frame)
 	}
 	server.sessionMutex.RUnlock()
 }
@@ -271,25 +383,25 @@ func forwardDestination(destination ForwardDestination, server *Server, frame *F
 func commandForward(uuid string, f CommandForwarder, cmd Command, server *Server, frame *Frame) {
 	dest := f.CommandForward(uuid, cmd, frame)
 
-	forwardDestination(dest, server, frame)
+	forwardDestination(dest, server, uuid, frame)
 }
 
 func statusForward(uuid string, f StatusForwarder, status Status, server *Server, frame *Frame) {
 	dest := f.StatusForward(uuid, status, frame)
 
-	forwardDestination(dest, server, frame)
+	forwardDestination(dest, server, uuid, frame)
 }
 
 func errorForward(uuid string, f ErrorForwarder, error Error, server *Server, frame *Frame) {
 	dest := f.ErrorForward(uuid, error, frame)
 
-	forwardDestination(dest, server, frame)
+	forwardDestination(dest, server, uuid, frame)
 }
 
 func eventForward(uuid string, f EventForwarder, event Event, server *Server, frame *Frame) {
 	dest := f.EventForward(uuid, event, frame)
 
-	forwardDestination(dest, server, frame)
+	forwardDestination(dest, server, uuid, frame)
 }
 
 func (f *frameForward) forwardFrame(server *Server, source *session, operand interface{}, frame *Frame) {
@@ -344,6 +456,6 @@ func (f *frameForward) forwardFrame(server *Server, source *session, operand int
 		if s == source {
 			continue
 		}
-		s.Write(frame)
+		forwardTo(server, s, frame)
 	}
 }
@@ -39,6 +39,14 @@ type TraceConfig struct {
 
 	// PathTrace turns frame timestamping on or off.
 	PathTrace bool
+
+	// TraceID identifies the operation, e.g. an instance launch, that
+	// the frame is part of. It is kept when the frame is forwarded and
+	// reported back in TraceReport events.
+	TraceID []byte
+
+	// SpanID identifies the step of that operation the frame carries.
+	SpanID []byte
 }
 
 // Node represent an SSNTP networking node.
@@ -54,6 +62,8 @@ type Node struct {
 // start and end timestamps as provided by the frame API callers.
 type FrameTrace struct {
 	Label          []byte
+	TraceID        []byte
+	SpanID         []byte
 	StartTimestamp time.Time
 	EndTimestamp   time.Time
 	PathLength     uint8
@@ -69,6 +79,17 @@ type Frame struct {
 	PayloadLength uint32
 	Trace         *FrameTrace
 	Payload       []byte
+	Stream        *StreamHeader
+	ID            uint64
+
+	// CorrelationID, when not 0, ties a request frame to the frames
+	// sent in reply to it. It is kept when frames are forwarded.
+	CorrelationID uint64
+
+	// Relay, when not nil, identifies the client that a frame exchanged
+	// between an SSNTP relay and its upstream server comes from or is
+	// sent to. It is dropped when frames are forwarded.
+	Relay *RelayHeader
 }
 
 // ConnectFrame is the SSNTP connection frame structure.
@@ -80,6 +101,16 @@ type ConnectFrame struct {
 	Role        uint32
 	Source      []byte
 	Destination []byte
+	Encodings   []payloads.Encoding
+	AtLeastOnce bool
+
+	// PayloadVersion is the latest payload version the client supports.
+	PayloadVersion payloads.Version
+
+	// Timestamp is the time at which the client sent the frame, in
+	// nanoseconds since the epoch, according to its clock.  It is 0 for
+	// clients that predate the clock check.
+	Timestamp int64
 }
 
 // ConnectedFrame is the SSNTP connected frame structure.
@@ -93,6 +124,19 @@ type ConnectedFrame struct {
 	Destination   []byte
 	PayloadLength uint32
 	Payload       []byte
+	Encoding      payloads.Encoding
+	AtLeastOnce   bool
+
+	// PayloadVersion is the payload version the server agreed on.
+	PayloadVersion payloads.Version
+
+	// ConnectTimestamp echoes the Timestamp of the CONNECT frame, and
+	// ReceiveTimestamp and TransmitTimestamp are the times at which the
+	// server received it and sent this frame, according to its clock, so
+	// that the client can estimate the offset between their clocks.
+	ConnectTimestamp  int64
+	ReceiveTimestamp  int64
+	TransmitTimestamp int64
 }
 
 const majorMask = 0x7f
@@ -108,12 +152,16 @@ func (f Frame) PathTrace() bool {
 }
 
 func (f *Frame) setTrace(trace *TraceConfig) {
-	if trace == nil || (len(trace.Label) == 0 && trace.PathTrace == false) {
+	if trace == nil || (len(trace.Label) == 0 && len(trace.TraceID) == 0 && trace.PathTrace == false) {
 		f.Major = f.Major &^ pathTraceEnabled
 		return
 	}
 
-	f.Trace = &FrameTrace{Label: trace.Label}
+	f.Trace = &FrameTrace{
+		Label:   trace.Label,
+		TraceID: trace.TraceID,
+		SpanID:  trace.SpanID,
+	}
 
 	if trace.PathTrace == true {
 		f.Major |= pathTraceEnabled
@@ -121,6 +169,16 @@ func (f *Frame) setTrace(trace *TraceConfig) {
 	}
 }
 
+// TraceID returns the identifier of the operation a frame is part of,
+// or an empty string if the frame does not carry one.
+func (f Frame) TraceID() string {
+	if f.Trace == nil {
+		return ""
+	}
+
+	return string(f.Trace.TraceID)
+}
+
 func (f Frame) major() uint8 {
 	return f.Major & majorMask
 }
@@ -139,6 +197,10 @@ func (f Frame) String() string {
 		op = (Event)(f.Operand).String()
 	case ERROR:
 		op = fmt.Sprintf("%d", f.Operand)
+	case STREAM:
+		if f.Stream != nil {
+			op = fmt.Sprintf("Stream %d chunk %d", f.Stream.ID, f.Stream.Sequence)
+		}
 	}
 
 	if f.PathTrace() == true {
@@ -232,6 +294,31 @@ func (f Frame) Duration() (time.Duration, error) {
 	return f.Trace.Path[f.Trace.PathLength-1].RxTimestamp.Sub(f.Trace.Path[0].TxTimestamp), nil
 }
 
+// PathTimes breaks the Duration of a frame down into the time it spent
+// in transit between the nodes of its path, and the time it spent being
+// processed by the nodes that forwarded it, e.g. for the scheduler to pick
+// a node for a START command.  queued is the time between the trace Start
+// and the first frame transmission, 0 when the sender did not set Start.
+func (f Frame) PathTimes() (queued, transit, forwarding time.Duration, err error) {
+	if f.PathTrace() != true || len(f.Trace.Path) == 0 {
+		return 0, 0, 0, fmt.Errorf("Timestamps not available")
+	}
+
+	path := f.Trace.Path
+	if !f.Trace.StartTimestamp.IsZero() {
+		queued = path[0].TxTimestamp.Sub(f.Trace.StartTimestamp)
+	}
+
+	for i := 1; i < len(path); i++ {
+		transit += path[i].RxTimestamp.Sub(path[i-1].TxTimestamp)
+		if i < len(path)-1 {
+			forwarding += path[i].TxTimestamp.Sub(path[i].RxTimestamp)
+		}
+	}
+
+	return queued, transit, forwarding, nil
+}
+
 // SetEndStamp adds the final timestamp to an SSNTP frame.
 // This is called by the SSNTP node that believes it's the
 // last frame receiver. It provides information to build the
@@ -256,6 +343,8 @@ func (f Frame) DumpTrace() (*payloads.FrameTrace, error) {
 	}
 
 	s.Label = string(f.Trace.Label)
+	s.TraceID = string(f.Trace.TraceID)
+	s.SpanID = string(f.Trace.SpanID)
 	s.StartTimestamp = f.Trace.StartTimestamp.Format(time.RFC3339Nano)
 	s.EndTimestamp = f.Trace.EndTimestamp.Format(time.RFC3339Nano)
 	s.Type = f.Type.String()
@@ -0,0 +1,150 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"encoding/gob"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/01org/ciao/payloads"
+)
+
+// connectionLimits tracks the server client connections against the
+// configured limits.
+type connectionLimits struct {
+	sync.Mutex
+	max     int
+	maxRole map[uint32]int
+	total   int
+	perRole map[uint32]int
+}
+
+func newConnectionLimits(config *Config) *connectionLimits {
+	return &connectionLimits{
+		max:     config.MaxConnections,
+		maxRole: config.MaxRoleConnections,
+		perRole: make(map[uint32]int),
+	}
+}
+
+// acquire accounts for a new connection, or returns false if the server
+// already has as many connections as it accepts.
+func (l *connectionLimits) acquire() bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.max > 0 && l.total >= l.max {
+		return false
+	}
+	l.total++
+
+	return true
+}
+
+func (l *connectionLimits) release() {
+	l.Lock()
+	l.total--
+	l.Unlock()
+}
+
+// acquireRole accounts for a new connection from a client with the given
+// role, or returns false if the server already has as many connections
+// for that role as it accepts.
+func (l *connectionLimits) acquireRole(role uint32) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	max, ok := l.maxRole[role]
+	if ok && l.perRole[role] >= max {
+		return false
+	}
+	l.perRole[role]++
+
+	return true
+}
+
+func (l *connectionLimits) releaseRole(role uint32) {
+	l.Lock()
+	l.perRole[role]--
+	l.Unlock()
+}
+
+// acceptThrottle is a token bucket limiting the rate at which a server
+// accepts new connections.
+type acceptThrottle struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newAcceptThrottle(config *Config) *acceptThrottle {
+	if config.AcceptRate <= 0 {
+		return nil
+	}
+
+	burst := float64(config.AcceptBurst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &acceptThrottle{
+		rate:   config.AcceptRate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// delay takes a token from the bucket and returns how long to wait for
+// before accepting the next connection.
+func (t *acceptThrottle) delay(now time.Time) time.Duration {
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+	t.last = now
+
+	t.tokens--
+	if t.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-t.tokens / t.rate * float64(time.Second))
+}
+
+// sendConnectionRefused tells a client why its connection is refused
+// before closing it.
+func sendConnectionRefused(conn net.Conn, reason payloads.ConnectionRefusedReason, limit int) *session {
+	var session session
+
+	payload, err := payloads.Marshal(payloads.YAML, &payloads.ErrorConnectionRefused{
+		Reason: reason,
+		Limit:  limit,
+	})
+	if err != nil {
+		payload = nil
+	}
+
+	frame := session.errorFrame(ConnectionRefused, payload, nil)
+	setWriteTimeout(conn)
+	gob.NewEncoder(conn).Encode(frame)
+
+	return nil
+}
@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Metrics is the SSNTP instrumentation interface. SSNTP clients and
+// servers call it, when set through their configuration, as connections
+// come and go and frames flow. Roles are the peer ones, i.e., the client
+// roles for servers and the server role for clients.
+// Implementations must be safe for concurrent use.
+type Metrics interface {
+	// Connected is called when a connection with a peer is established.
+	Connected(role uint32)
+
+	// Disconnected is called when a connection with a peer is lost.
+	Disconnected(role uint32)
+
+	// FrameSent is called once a frame has been sent to a peer, with
+	// the number of bytes written and the time it took to marshal and
+	// write it.
+	FrameSent(role uint32, frame *Frame, bytes int, latency time.Duration)
+
+	// FrameReceived is called once a frame has been received from a
+	// peer, with the number of bytes read to decode it.
+	FrameReceived(role uint32, frame *Frame, bytes int)
+
+	// Error is called when a frame could not be sent to or received
+	// from a peer.
+	Error(role uint32, err error)
+}
+
+// byteCounter counts the bytes going through a reader or a writer.
+type byteCounter struct {
+	r     io.Reader
+	w     io.Writer
+	count uint64
+}
+
+func (c *byteCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.count += (uint64)(n)
+	return n, err
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.count += (uint64)(n)
+	return n, err
+}
+
+// frameName returns the name metrics use for frame, e.g., "COMMAND START".
+func frameName(frame *Frame) string {
+	return fmt.Sprintf("%s %s", frame.Type, operandString(frame))
+}
+
+type expvarMetrics struct {
+	connections    *expvar.Map
+	framesSent     *expvar.Map
+	framesReceived *expvar.Map
+	bytesSent      *expvar.Int
+	bytesReceived  *expvar.Int
+	sendTime       *expvar.Int
+	errors         *expvar.Map
+	queuedFrames   *expvar.Map
+	droppedFrames  *expvar.Map
+}
+
+// NewExpvarMetrics returns an SSNTP Metrics implementation that exports
+// its counters as the name expvar variable, and thus through the
+// /debug/vars HTTP handler. It can only be called once for a given name.
+// The exported variable contains:
+//
+//	connections: the current number of connections, by peer role
+//	frames_sent, frames_received: the number of frames, by type and operand
+//	bytes_sent, bytes_received: the number of frame bytes
+//	send_time_ns: the total time spent marshalling and writing frames
+//	errors: the number of read and write errors
+//	queued_frames: the number of frames in server send queues, by peer role
+//	dropped_frames: the number of frames dropped from full send queues,
+//	by type and operand
+func NewExpvarMetrics(name string) Metrics {
+	m := &expvarMetrics{
+		connections:    new(expvar.Map).Init(),
+		framesSent:     new(expvar.Map).Init(),
+		framesReceived: new(expvar.Map).Init(),
+		bytesSent:      new(expvar.Int),
+		bytesReceived:  new(expvar.Int),
+		sendTime:       new(expvar.Int),
+		errors:         new(expvar.Map).Init(),
+		queuedFrames:   new(expvar.Map).Init(),
+		droppedFrames:  new(expvar.Map).Init(),
+	}
+
+	vars := expvar.NewMap(name)
+	vars.Set("connections", m.connections)
+	vars.Set("frames_sent", m.framesSent)
+	vars.Set("frames_received", m.framesReceived)
+	vars.Set("bytes_sent", m.bytesSent)
+	vars.Set("bytes_received", m.bytesReceived)
+	vars.Set("send_time_ns", m.sendTime)
+	vars.Set("errors", m.errors)
+	vars.Set("queued_frames", m.queuedFrames)
+	vars.Set("dropped_frames", m.droppedFrames)
+
+	return m
+}
+
+func roleName(role uint32) string {
+	r := (Role)(role)
+	if name := r.String(); name != "" {
+		return name
+	}
+
+	return fmt.Sprintf("0x%x", role)
+}
+
+func (m *expvarMetrics) Connected(role uint32) {
+	m.connections.Add(roleName(role), 1)
+}
+
+func (m *expvarMetrics) Disconnected(role uint32) {
+	m.connections.Add(roleName(role), -1)
+}
+
+func (m *expvarMetrics) FrameSent(role uint32, frame *Frame, bytes int, latency time.Duration) {
+	m.framesSent.Add(frameName(frame), 1)
+	m.bytesSent.Add((int64)(bytes))
+	m.sendTime.Add((int64)(latency))
+}
+
+func (m *expvarMetrics) FrameReceived(role uint32, frame *Frame, bytes int) {
+	m.framesReceived.Add(frameName(frame), 1)
+	m.bytesReceived.Add((int64)(bytes))
+}
+
+func (m *expvarMetrics) Error(role uint32, err error) {
+	m.errors.Add(roleName(role), 1)
+}
+
+func (m *expvarMetrics) FrameQueued(role uint32, frame *Frame) {
+	m.queuedFrames.Add(roleName(role), 1)
+}
+
+func (m *expvarMetrics) FrameDequeued(role uint32, frame *Frame) {
+	m.queuedFrames.Add(roleName(role), -1)
+}
+
+func (m *expvarMetrics) FrameDropped(role uint32, frame *Frame) {
+	m.queuedFrames.Add(roleName(role), -1)
+	m.droppedFrames.Add(frameName(frame), 1)
+}
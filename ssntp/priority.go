@@ -0,0 +1,159 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Priority is the priority class of an SSNTP frame. When several frames
+// are waiting to be sent on the same connection, the frames with the
+// highest priority are sent first.
+type Priority uint8
+
+const (
+	// HighPriority frames are the control plane commands that must
+	// not be delayed by telemetry, e.g. DELETE or EVACUATE, together with
+	// the KEEPALIVE and ACK frames.
+	HighPriority Priority = iota
+
+	// NormalPriority is the priority of most frames.
+	NormalPriority
+
+	// LowPriority frames carry telemetry, like STATS commands and
+	// TraceReport events, or bulk data, like STREAM frames.
+	LowPriority
+
+	numPriorities
+)
+
+func (p Priority) String() string {
+	switch p {
+	case HighPriority:
+		return "high"
+	case NormalPriority:
+		return "normal"
+	case LowPriority:
+		return "low"
+	}
+
+	return ""
+}
+
+// Priority returns the priority class of the frame.
+func (f Frame) Priority() Priority {
+	switch f.Type {
+	case COMMAND:
+		switch (Command)(f.Operand) {
+		case STOP, DELETE, EVACUATE, RESTART, STOPGROUP, DELETEGROUP:
+			return HighPriority
+		case STATS:
+			return LowPriority
+		}
+	case STATUS:
+		switch (Status)(f.Operand) {
+		case KEEPALIVE, ACK:
+			return HighPriority
+		}
+	case EVENT:
+		if (Event)(f.Operand) == TraceReport {
+			return LowPriority
+		}
+	case STREAM:
+		return LowPriority
+	}
+
+	return NormalPriority
+}
+
+// priorityLock serializes the writers of a session. Waiting writers are
+// queued per priority class, and the lock is always handed over to the
+// oldest writer of the highest priority class.
+type priorityLock struct {
+	sync.Mutex
+	busy    bool
+	waiting [numPriorities][]chan struct{}
+}
+
+func (l *priorityLock) lock(p Priority) {
+	_ = l.lockContext(context.Background(), p)
+}
+
+// lockContext waits for the lock until ctx is done, and returns the ctx
+// error if it did not get it by then.
+func (l *priorityLock) lockContext(ctx context.Context, p Priority) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	l.Lock()
+	if !l.busy {
+		l.busy = true
+		l.Unlock()
+		return nil
+	}
+
+	ch := make(chan struct{})
+	l.waiting[p] = append(l.waiting[p], ch)
+	l.Unlock()
+
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for i, waiting := range l.waiting[p] {
+		if waiting == ch {
+			l.waiting[p] = append(l.waiting[p][:i], l.waiting[p][i+1:]...)
+			return ctx.Err()
+		}
+	}
+
+	// The lock was handed over to us in the meantime, pass it on
+	l.handOver()
+	return ctx.Err()
+}
+
+func (l *priorityLock) unlock() {
+	l.Lock()
+	defer l.Unlock()
+
+	l.handOver()
+}
+
+// handOver gives the lock to the next waiting writer, if any. It is
+// called with l locked.
+func (l *priorityLock) handOver() {
+	for p := range l.waiting {
+		if len(l.waiting[p]) == 0 {
+			continue
+		}
+
+		ch := l.waiting[p][0]
+		l.waiting[p] = l.waiting[p][1:]
+		close(ch)
+		return
+	}
+
+	l.busy = false
+}
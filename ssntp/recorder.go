@@ -0,0 +1,165 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordingHeader starts an SSNTP recording and describes the client or
+// server that recorded it.
+type RecordingHeader struct {
+	UUID   string
+	Role   uint32
+	Server bool
+	Start  time.Time
+}
+
+// RecordedFrame is a frame sent or received by the client or server that
+// recorded it, with its payload.
+type RecordedFrame struct {
+	Time time.Time
+
+	// Sent is true for the frames sent to Peer, false for the ones
+	// received from it.
+	Sent bool
+
+	// Peer is the UUID of the peer the frame was exchanged with, and
+	// PeerRole its role.
+	Peer     string
+	PeerRole uint32
+
+	Frame Frame
+}
+
+// frameRecorder writes the frames a client or server sends and receives
+// to a recording file. A recording is a gob stream made of a
+// RecordingHeader followed by RecordedFrames.
+type frameRecorder struct {
+	sync.Mutex
+	file    *os.File
+	encoder *gob.Encoder
+	log     Logger
+}
+
+func newFrameRecorder(path string, uuid string, role uint32, server bool, log Logger) (*frameRecorder, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Could not create recording: %s", err)
+	}
+
+	r := &frameRecorder{
+		file:    file,
+		encoder: gob.NewEncoder(file),
+		log:     log,
+	}
+
+	header := RecordingHeader{
+		UUID:   uuid,
+		Role:   role,
+		Server: server,
+		Start:  time.Now(),
+	}
+
+	if err := r.encoder.Encode(&header); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Could not write recording header: %s", err)
+	}
+
+	return r, nil
+}
+
+// record appends frame to the recording. Recording errors are logged
+// and never fail the frame exchange.
+func (r *frameRecorder) record(sent bool, session *session, frame *Frame) {
+	if r == nil {
+		return
+	}
+
+	recorded := RecordedFrame{
+		Time:     time.Now(),
+		Sent:     sent,
+		Peer:     session.dest.String(),
+		PeerRole: session.destRole,
+		Frame:    *frame,
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.encoder == nil {
+		return
+	}
+
+	if err := r.encoder.Encode(&recorded); err != nil {
+		r.log.Errorf("Could not record %s frame: %s\n", frameName(frame), err)
+	}
+}
+
+func (r *frameRecorder) close() {
+	if r == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.encoder != nil {
+		r.file.Close()
+		r.encoder = nil
+	}
+}
+
+// RecordingReader reads back the frames of an SSNTP recording.
+type RecordingReader struct {
+	decoder *gob.Decoder
+	header  RecordingHeader
+}
+
+// NewRecordingReader returns a reader for the recording r, as written by
+// a client or a server configured with Config.Recording.
+func NewRecordingReader(r io.Reader) (*RecordingReader, error) {
+	reader := &RecordingReader{decoder: gob.NewDecoder(r)}
+
+	if err := reader.decoder.Decode(&reader.header); err != nil {
+		return nil, fmt.Errorf("Invalid SSNTP recording: %s", err)
+	}
+
+	return reader, nil
+}
+
+// Header returns the recording header.
+func (reader *RecordingReader) Header() RecordingHeader {
+	return reader.header
+}
+
+// Next returns the next recorded frame. It returns io.EOF at the end of
+// the recording.
+func (reader *RecordingReader) Next() (*RecordedFrame, error) {
+	var recorded RecordedFrame
+
+	if err := reader.decoder.Decode(&recorded); err != nil {
+		return nil, err
+	}
+
+	return &recorded, nil
+}
@@ -0,0 +1,450 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/01org/ciao/payloads"
+	"github.com/docker/distribution/uuid"
+	"golang.org/x/net/context"
+)
+
+// RelayHeader identifies the client on behalf of which an SSNTP relay
+// exchanges a frame with its upstream server.
+type RelayHeader struct {
+	UUID []byte
+	Role uint32
+
+	// Encoding and PayloadVersion are the payload encoding and version
+	// the relay agreed on with the client, only set in RELAYCONNECTED
+	// frames.
+	Encoding       payloads.Encoding
+	PayloadVersion payloads.Version
+}
+
+// relayedFrame returns a copy of frame for the relay of a relayed client
+// session, carrying the client UUID and role.
+func (session *session) relayedFrame(frame *Frame) *Frame {
+	f := *frame
+	f.ID = 0
+	f.Relay = &RelayHeader{
+		UUID: append([]byte(nil), session.dest[:]...),
+		Role: session.destRole,
+	}
+
+	return &f
+}
+
+// handleRelayedFrame handles a frame that the relay session relayed on
+// behalf of one of its clients.
+func (server *Server) handleRelayedFrame(relay *session, frame *Frame) {
+	header := frame.Relay
+	frame.Relay = nil
+
+	if len(header.UUID) != len(uuid.UUID{}) {
+		server.log.Errorf("Invalid relay header from %s\n", relay.dest)
+		return
+	}
+
+	var clientUUID uuid.UUID
+	copy(clientUUID[:], header.UUID)
+	uuidString := clientUUID.String()
+
+	if frame.Type == STATUS {
+		switch (Status)(frame.Operand) {
+		case RELAYCONNECTED:
+			server.connectRelayed(relay, uuidString, header)
+			return
+		case RELAYDISCONNECTED:
+			server.disconnectRelayed(relay, uuidString)
+			return
+		}
+	}
+
+	session := relay.relayed[uuidString]
+	if session == nil {
+		server.log.Errorf("%s frame from unknown client %s relayed by %s\n", frame.Type, uuidString, relay.dest)
+		return
+	}
+
+	if !server.authorizer.authorized(session.destRole, frame) {
+		server.rejectFrame(uuidString, session, frame)
+		return
+	}
+
+	server.handleFrame(uuidString, session, frame)
+}
+
+// defaultRelayedRoles are the roles servers accept for relayed clients by
+// default, those of the agents a relay typically serves.
+const defaultRelayedRoles = AGENT | NETAGENT | CNCIAGENT
+
+// isRelay tells if the session peer is an SSNTP relay. Relays connect
+// with the SERVER role.
+func (session *session) isRelay() bool {
+	return session.destRole == (uint32)(SERVER)
+}
+
+// relayedRoleAllowed tells if a relay may announce a client with role,
+// which must be a single one of the server relayed roles.
+func (server *Server) relayedRoleAllowed(role uint32) bool {
+	return role != 0 && role&(role-1) == 0 && role&server.relayedRoles == role
+}
+
+// connectRelayed adds a session for a client connected to the relay
+// session. Relayed client sessions have no connection of their own, the
+// frames sent to them go through their relay. Relays can only announce
+// clients with one of the server relayed roles, that are not already
+// connected, and within the server connection limits.
+func (server *Server) connectRelayed(relay *session, uuid string, header *RelayHeader) {
+	if relay.relayed == nil {
+		relay.relayed = make(map[string]*session)
+	} else if relay.relayed[uuid] != nil {
+		return
+	}
+
+	role := (Role)(header.Role)
+	if !server.relayedRoleAllowed(header.Role) {
+		server.log.Errorf("Relay %s announced client %s with the %s role, not accepted for relayed clients\n",
+			relay.dest, uuid, role.String())
+		return
+	}
+
+	if !server.limits.acquire() {
+		server.log.Errorf("Too many connections, refusing client %s relayed by %s\n", uuid, relay.dest)
+		return
+	}
+
+	if !server.limits.acquireRole(header.Role) {
+		server.limits.release()
+		server.log.Errorf("Too many %s connections, refusing client %s relayed by %s\n",
+			role.String(), uuid, relay.dest)
+		return
+	}
+
+	session := newSession(&server.uuid, server.role, header.Role, nil)
+	session.setDest(header.UUID)
+	session.encoding = negotiateEncoding(server.encodings, []payloads.Encoding{header.Encoding})
+	session.payloadVersion = negotiatePayloadVersion(server.payloadVersion, header.PayloadVersion)
+	session.metrics = server.metrics
+	session.relay = relay
+
+	if !server.addNewSession(session, uuid) {
+		server.limits.releaseRole(header.Role)
+		server.limits.release()
+		server.log.Errorf("Client %s relayed by %s is already connected\n", uuid, relay.dest)
+		return
+	}
+	relay.relayed[uuid] = session
+
+	server.log.Infof("Client %s connected through relay %s\n", uuid, relay.dest)
+
+	server.forwardRules.addForwardDestination(session)
+	server.ntf.ConnectNotify(uuid, session.destRole)
+	if server.metrics != nil {
+		server.metrics.Connected(session.destRole)
+	}
+}
+
+// disconnectRelayed removes the session of a client that disconnected
+// from the relay session.
+func (server *Server) disconnectRelayed(relay *session, uuid string) {
+	session := relay.relayed[uuid]
+	if session == nil {
+		return
+	}
+	delete(relay.relayed, uuid)
+
+	server.log.Infof("Client %s disconnected from relay %s\n", uuid, relay.dest)
+
+	server.ntf.DisconnectNotify(uuid, session.destRole)
+	if server.metrics != nil {
+		server.metrics.Disconnected(session.destRole)
+	}
+	server.forwardRules.deleteForwardDestination(session)
+	server.limits.releaseRole(session.destRole)
+	server.limits.release()
+
+	/* The client may have connected again, directly or through another relay */
+	server.sessionMutex.Lock()
+	if server.sessions[uuid] == session {
+		delete(server.sessions, uuid)
+	}
+	server.sessionMutex.Unlock()
+}
+
+// disconnectRelay removes the sessions of all the clients connected to the
+// relay session, when the relay disconnects.
+func (server *Server) disconnectRelay(relay *session) {
+	for uuid := range relay.relayed {
+		server.disconnectRelayed(relay, uuid)
+	}
+}
+
+// Relay is an SSNTP relay. It terminates the connections of SSNTP clients,
+// e.g. the agents of a rack, and multiplexes them to an upstream SSNTP
+// server, e.g. the scheduler, over a single connection on which it plays
+// the SERVER role. The frames relayed upstream carry the UUID and role of
+// the client they come from, and the upstream server handles them, applies
+// its forwarding rules and notifies them as if the client was directly
+// connected to it. The frames the upstream server sends to relayed
+// clients are routed back through their relay.
+//
+// Relays do not forward STREAM frames, nor apply any forwarding rule of
+// their own.
+type Relay struct {
+	server Server
+	client Client
+
+	clientsMutex sync.RWMutex
+	clients      map[string]*RelayHeader
+
+	log Logger
+}
+
+type relayServerNotifier struct {
+	relay *Relay
+}
+
+type relayClientNotifier struct {
+	relay *Relay
+}
+
+// Serve connects the relay to its upstream server, as described by the
+// upstream configuration, and serves SSNTP clients as described by the
+// downstream one. Both configurations default to the SERVER role. Like
+// Server.Serve, it only returns when the relay is stopped or fails to
+// start.
+func (relay *Relay) Serve(downstream *Config, upstream *Config) error {
+	if downstream == nil || upstream == nil {
+		return fmt.Errorf("SSNTP relay config missing")
+	}
+
+	if downstream.Role == (uint32)(UNKNOWN) {
+		downstream.Role = SERVER
+	}
+
+	if upstream.Role == (uint32)(UNKNOWN) {
+		upstream.Role = SERVER
+	}
+
+	if upstream.Log == nil {
+		relay.log = errLog
+	} else {
+		relay.log = upstream.Log
+	}
+
+	relay.clients = make(map[string]*RelayHeader)
+
+	if err := relay.client.Dial(upstream, relayClientNotifier{relay}); err != nil {
+		return err
+	}
+
+	err := relay.server.Serve(downstream, relayServerNotifier{relay})
+	relay.client.Close()
+
+	return err
+}
+
+// Stop disconnects the relay clients and closes its upstream connection.
+func (relay *Relay) Stop() {
+	relay.server.Stop()
+	relay.client.Close()
+}
+
+// sendUpstream relays frame to the upstream server, on behalf of the
+// client identified by header.
+func (relay *Relay) sendUpstream(frame *Frame, header *RelayHeader) {
+	client := &relay.client
+
+	client.status.Lock()
+	if client.status.status == ssntpClosed {
+		client.status.Unlock()
+		return
+	}
+	client.status.Unlock()
+
+	f := *frame
+	f.ID = 0
+	f.Relay = header
+
+	if _, err := client.write(context.Background(), client.session, &f); err != nil {
+		relay.log.Errorf("Could not relay %s frame upstream: %s\n", f.Type, err)
+	}
+}
+
+// announce tells the upstream server that the client identified by header
+// connected to or disconnected from the relay.
+func (relay *Relay) announce(status Status, header *RelayHeader) {
+	relay.sendUpstream(relay.client.session.statusFrame(status, nil, nil), header)
+}
+
+// relayUpstream relays a frame received from the uuid client.
+func (relay *Relay) relayUpstream(uuid string, frame *Frame) {
+	relay.clientsMutex.RLock()
+	header := relay.clients[uuid]
+	relay.clientsMutex.RUnlock()
+
+	if header == nil {
+		relay.log.Errorf("Dropping %s frame from unknown client %s\n", frame.Type, uuid)
+		return
+	}
+
+	relay.sendUpstream(frame, &RelayHeader{UUID: header.UUID, Role: header.Role})
+}
+
+// relayDownstream relays a frame received from the upstream server to the
+// client it is sent to.
+func (relay *Relay) relayDownstream(frame *Frame) {
+	if frame.Relay == nil || len(frame.Relay.UUID) != len(uuid.UUID{}) {
+		relay.log.Errorf("Dropping %s frame not sent to a relayed client\n", frame.Type)
+		return
+	}
+
+	var clientUUID uuid.UUID
+	copy(clientUUID[:], frame.Relay.UUID)
+	uuidString := clientUUID.String()
+
+	session := relay.server.getSession(uuidString)
+	if session == nil {
+		relay.log.Errorf("Dropping %s frame for unknown client %s\n", frame.Type, uuidString)
+		return
+	}
+
+	if frame.Type == COMMAND && (Command)(frame.Operand) == CONFIGURE {
+		relay.setConfiguration(frame.Payload)
+	}
+
+	f := *frame
+	f.ID = 0
+	f.Relay = nil
+
+	if _, err := relay.server.write(context.Background(), uuidString, session, &f); err != nil {
+		relay.log.Errorf("Could not relay %s frame to %s: %s\n", f.Type, uuidString, err)
+	}
+}
+
+// setConfiguration sets the cluster configuration the relay sends to its
+// connecting clients, which may only understand YAML.
+func (relay *Relay) setConfiguration(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	configuration, err := payloads.Transcode(payload, payloads.YAML)
+	if err != nil {
+		relay.log.Errorf("Invalid CONFIGURE payload: %s\n", err)
+		return
+	}
+
+	relay.server.configuration.setConfiguration(configuration)
+}
+
+func (ntf relayServerNotifier) ConnectNotify(uuid string, role uint32) {
+	relay := ntf.relay
+
+	session := relay.server.getSession(uuid)
+	if session == nil {
+		return
+	}
+
+	header := &RelayHeader{
+		UUID:           append([]byte(nil), session.dest[:]...),
+		Role:           role,
+		Encoding:       session.encoding,
+		PayloadVersion: session.payloadVersion,
+	}
+
+	relay.clientsMutex.Lock()
+	relay.clients[uuid] = header
+	relay.clientsMutex.Unlock()
+
+	relay.announce(RELAYCONNECTED, header)
+}
+
+func (ntf relayServerNotifier) DisconnectNotify(uuid string, role uint32) {
+	relay := ntf.relay
+
+	relay.clientsMutex.Lock()
+	header := relay.clients[uuid]
+	delete(relay.clients, uuid)
+	relay.clientsMutex.Unlock()
+
+	if header == nil {
+		return
+	}
+
+	relay.announce(RELAYDISCONNECTED, header)
+}
+
+func (ntf relayServerNotifier) StatusNotify(uuid string, status Status, frame *Frame) {
+	ntf.relay.relayUpstream(uuid, frame)
+}
+
+func (ntf relayServerNotifier) CommandNotify(uuid string, command Command, frame *Frame) {
+	ntf.relay.relayUpstream(uuid, frame)
+}
+
+func (ntf relayServerNotifier) EventNotify(uuid string, event Event, frame *Frame) {
+	ntf.relay.relayUpstream(uuid, frame)
+}
+
+func (ntf relayServerNotifier) ErrorNotify(uuid string, error Error, frame *Frame) {
+	ntf.relay.relayUpstream(uuid, frame)
+}
+
+// ConnectNotify announces the connected clients again when the relay
+// (re)connects to its upstream server, which dropped them when the relay
+// connection was lost.
+func (ntf relayClientNotifier) ConnectNotify() {
+	relay := ntf.relay
+
+	relay.setConfiguration(relay.client.ClusterConfiguration())
+
+	relay.clientsMutex.RLock()
+	headers := make([]*RelayHeader, 0, len(relay.clients))
+	for _, header := range relay.clients {
+		headers = append(headers, header)
+	}
+	relay.clientsMutex.RUnlock()
+
+	for _, header := range headers {
+		relay.announce(RELAYCONNECTED, header)
+	}
+}
+
+func (ntf relayClientNotifier) DisconnectNotify() {
+	ntf.relay.log.Errorf("Relay lost its upstream connection\n")
+}
+
+func (ntf relayClientNotifier) StatusNotify(status Status, frame *Frame) {
+	ntf.relay.relayDownstream(frame)
+}
+
+func (ntf relayClientNotifier) CommandNotify(command Command, frame *Frame) {
+	ntf.relay.relayDownstream(frame)
+}
+
+func (ntf relayClientNotifier) EventNotify(event Event, frame *Frame) {
+	ntf.relay.relayDownstream(frame)
+}
+
+func (ntf relayClientNotifier) ErrorNotify(error Error, frame *Frame) {
+	ntf.relay.relayDownstream(frame)
+}
@@ -0,0 +1,174 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// maxPendingFrames is the maximum number of unacknowledged frames kept for
+// a peer.  The oldest ones are dropped when more frames are sent.
+const maxPendingFrames = 1024
+
+// resendInterval is the time after which a frame that has not been
+// acknowledged is sent again.
+const resendInterval = 30 * time.Second
+
+type pendingFrame struct {
+	frame *Frame
+	sent  time.Time
+}
+
+// retryQueue holds the frames sent to a peer in at-least-once mode that
+// it has not acknowledged yet.
+type retryQueue struct {
+	sync.Mutex
+	log     Logger
+	nextID  uint64
+	pending []pendingFrame
+}
+
+func newRetryQueue(log Logger) *retryQueue {
+	// Frame IDs must keep on growing when we restart, otherwise our
+	// peers would take our frames for duplicates.
+	return &retryQueue{
+		log:    log,
+		nextID: uint64(time.Now().UnixNano()),
+	}
+}
+
+// send assigns an ID to frame and writes it to session, keeping it
+// until the peer acknowledges it.  The ID is assigned under the session
+// write lock so that the peer receives frames in ID order, and only once
+// the lock is taken so that a frame given up on because ctx is done is
+// never sent.
+func (q *retryQueue) send(ctx context.Context, session *session, frame *Frame) (int, error) {
+	if err := session.lock(ctx, frame); err != nil {
+		return -1, err
+	}
+	defer session.writeLock.unlock()
+
+	q.queue(frame)
+
+	return session.writeLocked(ctx, frame)
+}
+
+// queue assigns an ID to frame and keeps it until the peer acknowledges
+// it, without sending it.
+func (q *retryQueue) queue(frame *Frame) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.nextID++
+	frame.ID = q.nextID
+
+	if len(q.pending) == maxPendingFrames {
+		q.log.Errorf("Too many unacknowledged frames, dropping frame %d\n", q.pending[0].frame.ID)
+		q.pending = q.pending[1:]
+	}
+	q.pending = append(q.pending, pendingFrame{frame: frame, sent: time.Now()})
+}
+
+// ack removes the frame whose ID is id from the queue.
+func (q *retryQueue) ack(id uint64) {
+	q.Lock()
+	defer q.Unlock()
+
+	for i, p := range q.pending {
+		if p.frame.ID == id {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// resend writes again to session the frames that were sent at least age
+// ago and that have not been acknowledged yet, in the order they were
+// first sent.
+func (q *retryQueue) resend(session *session, age time.Duration) {
+	var frames []*Frame
+
+	// The queue lock is not held while writing, senders take it with
+	// the session write lock held.
+	q.Lock()
+	now := time.Now()
+	for _, p := range q.pending {
+		if now.Sub(p.sent) >= age {
+			frames = append(frames, p.frame)
+		}
+	}
+	q.Unlock()
+
+	for _, frame := range frames {
+		if _, err := session.Write(frame); err != nil {
+			return
+		}
+		q.resent(frame.ID, now)
+	}
+}
+
+// resent records that the frame whose ID is id was sent again at time sent.
+func (q *retryQueue) resent(id uint64, sent time.Time) {
+	q.Lock()
+	defer q.Unlock()
+
+	for i, p := range q.pending {
+		if p.frame.ID == id {
+			q.pending[i].sent = sent
+			return
+		}
+	}
+}
+
+// resendLoop periodically resends the frames that session has not
+// acknowledged, until stopCh is closed.
+func (q *retryQueue) resendLoop(session *session, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(resendInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		q.resend(session, resendInterval)
+	}
+}
+
+// isAck returns true if frame is an ACK frame.
+func isAck(frame *Frame) bool {
+	return frame.Type == STATUS && (Status)(frame.Operand) == ACK
+}
+
+// reliable returns true if frame must be acknowledged.  Only COMMAND,
+// EVENT and ERROR frames are sent in at-least-once mode, STATUS frames
+// being superseded by the next ones.
+func reliable(frame *Frame) bool {
+	return frame.Type == COMMAND || frame.Type == EVENT || frame.Type == ERROR
+}
+
+func (session *session) ackFrame(id uint64) *Frame {
+	frame := session.statusFrame(ACK, nil, nil)
+	frame.ID = id
+
+	return frame
+}
@@ -0,0 +1,313 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// crlCheckInterval is how often servers look for an updated CRL file.
+const crlCheckInterval = 10 * time.Second
+
+// ocspCheckInterval is how often servers check the certificates of
+// their connected clients against their OCSP responders.
+const ocspCheckInterval = 10 * time.Minute
+
+// ocspTimeout bounds the time spent waiting for an OCSP responder.
+const ocspTimeout = 5 * time.Second
+
+// revocationClockSkew is how far the clocks of the CA and OCSP responders
+// may be from ours when checking the validity period of their CRLs and
+// responses.
+const revocationClockSkew = 5 * time.Minute
+
+// checkValidity returns an error if the validity period of a CRL or OCSP
+// response, from thisUpdate to nextUpdate, does not contain now.  A zero
+// nextUpdate means that newer information may be available at any time.
+func checkValidity(thisUpdate, nextUpdate, now time.Time) error {
+	if thisUpdate.After(now.Add(revocationClockSkew)) {
+		return fmt.Errorf("not valid before %s", thisUpdate)
+	}
+
+	if !nextUpdate.IsZero() && nextUpdate.Before(now.Add(-revocationClockSkew)) {
+		return fmt.Errorf("expired on %s", nextUpdate)
+	}
+
+	return nil
+}
+
+// revocationChecker rejects client certificates that have been revoked,
+// either because they are listed in a CRL file or because their OCSP
+// responder says so.
+type revocationChecker struct {
+	sync.RWMutex
+	crlPath string
+	caPath  string
+	modTime time.Time
+	revoked map[string]struct{}
+
+	ocsp       bool
+	httpClient *http.Client
+
+	log Logger
+}
+
+// newRevocationChecker returns nil if revocation checking is not configured.
+func newRevocationChecker(config *Config, log Logger) (*revocationChecker, error) {
+	if config.CRL == "" && !config.OCSP {
+		return nil, nil
+	}
+
+	r := &revocationChecker{
+		crlPath:    config.CRL,
+		caPath:     config.CAcert,
+		revoked:    make(map[string]struct{}),
+		ocsp:       config.OCSP,
+		httpClient: &http.Client{Timeout: ocspTimeout},
+		log:        log,
+	}
+
+	if r.crlPath != "" {
+		if err := r.loadCRL(); err != nil {
+			return nil, err
+		}
+	}
+
+	return r, nil
+}
+
+func loadCAs(caPath string) ([]*x509.Certificate, error) {
+	caPEM, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var cas []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, caPEM = pem.Decode(caPEM)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
+	}
+
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("No CA certificate in %s", caPath)
+	}
+
+	return cas, nil
+}
+
+// loadCRL reads the CRL file, and only accepts it if it has been
+// signed by our CA and has not expired.
+func (r *revocationChecker) loadCRL() error {
+	info, err := os.Stat(r.crlPath)
+	if err != nil {
+		return fmt.Errorf("Could not load CRL: %s", err)
+	}
+
+	crlBytes, err := ioutil.ReadFile(r.crlPath)
+	if err != nil {
+		return fmt.Errorf("Could not load CRL: %s", err)
+	}
+
+	crl, err := x509.ParseCRL(crlBytes)
+	if err != nil {
+		return fmt.Errorf("Invalid CRL %s: %s", r.crlPath, err)
+	}
+
+	cas, err := loadCAs(r.caPath)
+	if err != nil {
+		return fmt.Errorf("Could not load CA certificate: %s", err)
+	}
+
+	signed := false
+	for _, ca := range cas {
+		if ca.CheckCRLSignature(crl) == nil {
+			signed = true
+			break
+		}
+	}
+
+	if !signed {
+		return fmt.Errorf("CRL %s is not signed by %s", r.crlPath, r.caPath)
+	}
+
+	tbs := &crl.TBSCertList
+	if err := checkValidity(tbs.ThisUpdate, tbs.NextUpdate, time.Now()); err != nil {
+		return fmt.Errorf("CRL %s is %s", r.crlPath, err)
+	}
+
+	revoked := make(map[string]struct{})
+	for _, cert := range crl.TBSCertList.RevokedCertificates {
+		revoked[cert.SerialNumber.String()] = struct{}{}
+	}
+
+	r.Lock()
+	r.revoked = revoked
+	r.modTime = info.ModTime()
+	r.Unlock()
+
+	return nil
+}
+
+// crlChanged returns true if the CRL file has been modified since
+// we last loaded it.
+func (r *revocationChecker) crlChanged() bool {
+	if r.crlPath == "" {
+		return false
+	}
+
+	info, err := os.Stat(r.crlPath)
+	if err != nil {
+		return false
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	return !info.ModTime().Equal(r.modTime)
+}
+
+func (r *revocationChecker) inCRL(cert *x509.Certificate) bool {
+	r.RLock()
+	defer r.RUnlock()
+
+	_, revoked := r.revoked[cert.SerialNumber.String()]
+	return revoked
+}
+
+// revokedByOCSP asks the certificate OCSP responders about its status.
+// Responders that can not be reached, that do not know the certificate or
+// whose responses are outside of their validity period are ignored, only
+// an explicit revocation rejects it.
+func (r *revocationChecker) revokedByOCSP(cert, issuer *x509.Certificate) (bool, error) {
+	if len(cert.OCSPServer) == 0 {
+		return false, nil
+	}
+
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return false, err
+	}
+
+	var lastErr error
+	for _, server := range cert.OCSPServer {
+		resp, err := r.httpClient.Post(server, "application/ocsp-request", bytes.NewReader(request))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		response, err := ocsp.ParseResponse(body, issuer)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if response.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+			lastErr = fmt.Errorf("OCSP response from %s is for another certificate", server)
+			continue
+		}
+
+		if err := checkValidity(response.ThisUpdate, response.NextUpdate, time.Now()); err != nil {
+			lastErr = fmt.Errorf("OCSP response from %s for %s is %s", server, cert.SerialNumber, err)
+			r.log.Warningf("Ignoring %s\n", lastErr)
+			continue
+		}
+
+		return response.Status == ocsp.Revoked, nil
+	}
+
+	return false, lastErr
+}
+
+// peerCertificate returns the verified certificate of the TLS peer
+// together with the certificate of its issuer.
+func peerCertificate(conn net.Conn) (*x509.Certificate, *x509.Certificate) {
+	tlsConn, ok := conn.(connectionStater)
+	if !ok {
+		return nil, nil
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, nil
+	}
+
+	chain := state.VerifiedChains[0]
+	if len(chain) == 1 {
+		return chain[0], chain[0]
+	}
+
+	return chain[0], chain[1]
+}
+
+// check returns an error if the certificate of the peer at the other end
+// of conn has been revoked. OCSP responders are only queried if useOCSP
+// is true, and failing to reach them does not reject the certificate.
+func (r *revocationChecker) check(conn net.Conn, useOCSP bool) error {
+	cert, issuer := peerCertificate(conn)
+	if cert == nil {
+		return nil
+	}
+
+	if r.inCRL(cert) {
+		return fmt.Errorf("Certificate %s has been revoked", cert.SerialNumber)
+	}
+
+	if useOCSP && r.ocsp {
+		revoked, err := r.revokedByOCSP(cert, issuer)
+		if err != nil {
+			r.log.Errorf("Could not check certificate %s status: %s\n", cert.SerialNumber, err)
+		}
+
+		if revoked {
+			return fmt.Errorf("Certificate %s has been revoked by its OCSP responder", cert.SerialNumber)
+		}
+	}
+
+	return nil
+}
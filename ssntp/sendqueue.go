@@ -0,0 +1,306 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// OverflowPolicy tells an SSNTP server what to do when the send queue of
+// one of its clients is full.
+type OverflowPolicy uint8
+
+const (
+	// DropOldest drops the oldest queued frame to make room for the
+	// new one.
+	DropOldest OverflowPolicy = iota
+
+	// DropTelemetry drops the oldest queued frame of the lowest
+	// priority class, e.g. a STATS command, so that control plane frames
+	// are only dropped when there is nothing else to drop.
+	DropTelemetry
+
+	// Disconnect drops the new frame and disconnects the client, which
+	// is assumed to be stuck.
+	Disconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case DropTelemetry:
+		return "drop-telemetry"
+	case Disconnect:
+		return "disconnect"
+	}
+
+	return ""
+}
+
+// Set parses the name of an overflow policy, so that OverflowPolicy
+// can be used as a flag.Value.
+func (p *OverflowPolicy) Set(name string) error {
+	for _, policy := range []OverflowPolicy{DropOldest, DropTelemetry, Disconnect} {
+		if policy.String() == name {
+			*p = policy
+			return nil
+		}
+	}
+
+	return fmt.Errorf("drop-oldest, drop-telemetry or disconnect expected")
+}
+
+// QueueMetrics can be implemented by Metrics to also track the frames
+// queued by SSNTP servers for their clients, when send queues are
+// enabled.
+type QueueMetrics interface {
+	// FrameQueued is called when a frame is queued for a peer.
+	FrameQueued(role uint32, frame *Frame)
+
+	// FrameDequeued is called when a queued frame is taken out of the
+	// queue to be sent to the peer.
+	FrameDequeued(role uint32, frame *Frame)
+
+	// FrameDropped is called when a queued frame is dropped because
+	// the queue is full.
+	FrameDropped(role uint32, frame *Frame)
+}
+
+type queuedFrame struct {
+	frame    *Frame
+	sequence uint64
+}
+
+type bySequence []queuedFrame
+
+func (s bySequence) Len() int           { return len(s) }
+func (s bySequence) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySequence) Less(i, j int) bool { return s[i].sequence < s[j].sequence }
+
+// sendQueue is the bounded queue of the frames waiting to be sent to a
+// client. Frames are sent by priority and, within a priority class, in
+// order.
+type sendQueue struct {
+	sync.Mutex
+	frames   [numPriorities][]queuedFrame
+	length   int
+	max      int
+	sequence uint64
+	policy   OverflowPolicy
+	closed   bool
+
+	// ready is signalled when frames are queued.
+	ready chan struct{}
+
+	role    uint32
+	metrics QueueMetrics
+}
+
+func newSendQueue(max int, policy OverflowPolicy, role uint32, metrics Metrics) *sendQueue {
+	q := &sendQueue{
+		max:    max,
+		policy: policy,
+		ready:  make(chan struct{}, 1),
+		role:   role,
+	}
+
+	q.metrics, _ = metrics.(QueueMetrics)
+
+	return q
+}
+
+// remove takes the first frame of the p priority class out of the queue.
+// It is called with q locked.
+func (q *sendQueue) remove(p Priority) *Frame {
+	frame := q.frames[p][0].frame
+	q.frames[p] = q.frames[p][1:]
+	q.length--
+
+	return frame
+}
+
+// victim returns the priority class of the frame to drop when q is
+// full, according to the overflow policy. It is called with q locked.
+func (q *sendQueue) victim() Priority {
+	victim := Priority(0)
+
+	for p := range q.frames {
+		if len(q.frames[p]) == 0 {
+			continue
+		}
+
+		switch q.policy {
+		case DropOldest:
+			if len(q.frames[victim]) == 0 || q.frames[p][0].sequence < q.frames[victim][0].sequence {
+				victim = (Priority)(p)
+			}
+		default:
+			victim = (Priority)(p)
+		}
+	}
+
+	return victim
+}
+
+// push queues frame. It returns an error when frame is dropped, because
+// the queue is closed or overflowing, and whether the client must be
+// disconnected.
+func (q *sendQueue) push(frame *Frame) (bool, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return false, fmt.Errorf("Connection closed")
+	}
+
+	p := frame.Priority()
+	q.sequence++
+	q.frames[p] = append(q.frames[p], queuedFrame{frame: frame, sequence: q.sequence})
+	q.length++
+	if q.metrics != nil {
+		q.metrics.FrameQueued(q.role, frame)
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	if q.length <= q.max {
+		return false, nil
+	}
+
+	disconnect := q.policy == Disconnect
+
+	var dropped *Frame
+	if disconnect {
+		dropped = frame
+		q.frames[p] = q.frames[p][:len(q.frames[p])-1]
+		q.length--
+	} else {
+		dropped = q.remove(q.victim())
+	}
+
+	if q.metrics != nil {
+		q.metrics.FrameDropped(q.role, dropped)
+	}
+
+	if dropped == frame {
+		return disconnect, fmt.Errorf("Send queue full, %s frame dropped", frameName(frame))
+	}
+
+	return false, nil
+}
+
+// pop takes the oldest frame of the highest priority class out of the
+// queue. It returns nil if the queue is empty.
+func (q *sendQueue) pop() *Frame {
+	q.Lock()
+	defer q.Unlock()
+
+	for p := range q.frames {
+		if len(q.frames[p]) == 0 {
+			continue
+		}
+
+		frame := q.remove((Priority)(p))
+		if q.metrics != nil {
+			q.metrics.FrameDequeued(q.role, frame)
+		}
+
+		return frame
+	}
+
+	return nil
+}
+
+// close empties and closes the queue, returning the frames that were
+// still queued, in the order they were queued.
+func (q *sendQueue) close() []*Frame {
+	q.Lock()
+	defer q.Unlock()
+
+	var queued []queuedFrame
+	for p := range q.frames {
+		queued = append(queued, q.frames[p]...)
+		q.frames[p] = nil
+	}
+	q.length = 0
+	q.closed = true
+
+	sort.Sort(bySequence(queued))
+
+	frames := make([]*Frame, len(queued))
+	for i := range queued {
+		frames[i] = queued[i].frame
+		if q.metrics != nil {
+			q.metrics.FrameDequeued(q.role, frames[i])
+		}
+	}
+
+	return frames
+}
+
+// drainQueue sends the frames queued for the uuid client until stopCh
+// is closed. Frames that are still queued by then are lost, except for
+// the ones that must be delivered at least once, which are sent again
+// when the client reconnects.
+func (server *Server) drainQueue(uuid string, session *session, stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			for _, frame := range session.queue.close() {
+				if session.atLeastOnce && reliable(frame) {
+					server.retryQueue(uuid).queue(frame)
+				}
+			}
+			return
+		case <-session.queue.ready:
+		}
+
+		for frame := session.queue.pop(); frame != nil; frame = session.queue.pop() {
+			if _, err := server.writeSession(context.Background(), uuid, session, frame); err != nil {
+				server.log.Errorf("Could not send %s frame to %s: %s\n", frameName(frame), uuid, err)
+			}
+		}
+	}
+}
+
+// enqueue queues frame for the uuid client, disconnecting it if its
+// queue overflows and the overflow policy says so.
+func (server *Server) enqueue(uuid string, session *session, frame *Frame) (int, error) {
+	disconnect, err := session.queue.push(frame)
+	if err != nil {
+		server.log.Errorf("%s: %s\n", uuid, err)
+	}
+
+	if disconnect {
+		server.log.Errorf("Send queue of %s overflowing, disconnecting it\n", uuid)
+		session.conn.Close()
+	}
+
+	if err != nil {
+		return -1, err
+	}
+
+	return 0, nil
+}
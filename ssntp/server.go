@@ -17,13 +17,17 @@
 package ssntp
 
 import (
-	"crypto/tls"
 	"encoding/gob"
 	"fmt"
 	"github.com/docker/distribution/uuid"
+	"io"
 	"net"
 	"sync"
 	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/01org/ciao/payloads"
 )
 
 // ServerNotifier is the SSNTP server notification interface.
@@ -61,7 +65,7 @@ type ServerNotifier interface {
 type Server struct {
 	uuid         uuid.UUID
 	lUUID        lockedUUID
-	tls          *tls.Config
+	tls          *tlsConfig
 	ntf          ServerNotifier
 	sessionMutex sync.RWMutex
 	sessions     map[string]*session
@@ -70,14 +74,43 @@ type Server struct {
 	stoppedChan  chan struct{}
 	role         uint32
 	roleVerify   bool
+	relayedRoles uint32
 	clientWg     sync.WaitGroup
 
-	forwardRules frameForward
+	forwardRules   frameForward
+	forwardTimeout time.Duration
+
+	sendQueueLength   int
+	sendQueueOverflow OverflowPolicy
 
 	log Logger
 
 	trace *TraceConfig
 
+	keepaliveInterval time.Duration
+	keepaliveTimeout  time.Duration
+
+	encodings      []payloads.Encoding
+	payloadVersion payloads.Version
+
+	atLeastOnce   bool
+	reliableMutex sync.Mutex
+	retryQueues   map[string]*retryQueue
+	lastFrameIDs  map[string]uint64
+
+	limits   *connectionLimits
+	throttle *acceptThrottle
+
+	revocation *revocationChecker
+
+	authorizer *frameAuthorizer
+
+	metrics Metrics
+
+	recorder *frameRecorder
+
+	faults *faultInjector
+
 	configuration clusterConfiguration
 }
 
@@ -109,6 +142,7 @@ func handleClientConnect(server *Server, conn net.Conn) *session {
 	server.log.Infof("Waiting for CONNECT\n")
 	setReadTimeout(conn)
 	readErr := decoder.Decode(&connect)
+	received := time.Now()
 	clearReadTimeout(conn)
 	if readErr != nil {
 		server.log.Errorf("Connect error: %s\n", readErr)
@@ -118,7 +152,7 @@ func handleClientConnect(server *Server, conn net.Conn) *session {
 	server.log.Infof("Received CONNECT frame:\n%s\n", connect)
 
 	if server.roleVerify == true {
-		tlscon, ok := conn.(*tls.Conn)
+		tlscon, ok := conn.(connectionStater)
 		if ok {
 			oidFound, err := verifyRole(tlscon, connect.Role)
 			if oidFound == false {
@@ -133,17 +167,47 @@ func handleClientConnect(server *Server, conn net.Conn) *session {
 		return sendConnectionFailure(conn)
 	}
 
+	if server.revocation != nil {
+		if err := server.revocation.check(conn, true); err != nil {
+			server.log.Errorf("Rejecting %s: %s\n", conn.RemoteAddr(), err)
+			return sendConnectionAborted(conn)
+		}
+	}
+
+	if !server.limits.acquireRole(connect.Role) {
+		role := (Role)(connect.Role)
+		server.log.Errorf("Too many %s connections, refusing %s\n", role.String(), conn.RemoteAddr())
+		return sendConnectionRefused(conn, payloads.TooManyRoleConnections, server.limits.maxRole[connect.Role])
+	}
+
 	session := newSession(&server.uuid, server.role, connect.Role, conn)
 	session.setDest(connect.Source[:16])
+	session.encoding = negotiateEncoding(server.encodings, connect.Encodings)
+	session.payloadVersion = negotiatePayloadVersion(server.payloadVersion, connect.PayloadVersion)
+	session.atLeastOnce = server.atLeastOnce && connect.AtLeastOnce
+	if connect.Timestamp != 0 {
+		session.clockOffset = time.Duration(connect.Timestamp - received.UnixNano())
+		session.clockChecked = true
+	}
+	session.metrics = server.metrics
+	session.recorder = server.recorder
+	session.faults = server.faults
+	server.faults.armDisconnect(session)
 
 	/* TODO Get the CONFIGURE payload from the config package */
 	server.configuration.RLock()
 	connected := session.connectedFrame(server.role, server.configuration.configuration)
 	server.configuration.RUnlock()
+	if connect.Timestamp != 0 {
+		connected.ConnectTimestamp = connect.Timestamp
+		connected.ReceiveTimestamp = received.UnixNano()
+		connected.TransmitTimestamp = time.Now().UnixNano()
+	}
 
 	server.log.Infof("Sending CONNECTED\n")
 	_, writeErr := session.Write(connected)
 	if writeErr != nil {
+		server.limits.releaseRole(connect.Role)
 		server.log.Errorf("Connected error: %s\n", writeErr)
 		return sendConnectionFailure(conn)
 	}
@@ -153,6 +217,7 @@ func handleClientConnect(server *Server, conn net.Conn) *session {
 
 func handleSSNTPClient(server *Server, conn net.Conn) {
 	defer server.clientWg.Done()
+	defer server.limits.release()
 	defer conn.Close()
 
 	server.log.Infof("New client connection\n")
@@ -160,55 +225,239 @@ func handleSSNTPClient(server *Server, conn net.Conn) {
 	if session == nil {
 		return
 	}
+	defer server.limits.releaseRole(session.destRole)
 
 	uuidString := session.dest.String()
+	session.keepaliveTimeout = server.keepaliveTimeout
+	if server.sendQueueLength > 0 {
+		session.queue = newSendQueue(server.sendQueueLength, server.sendQueueOverflow,
+			session.destRole, server.metrics)
+	}
 	server.addSession(session, uuidString)
 	server.forwardRules.addForwardDestination(session)
 	server.ntf.ConnectNotify(uuidString, session.destRole)
+	if server.metrics != nil {
+		server.metrics.Connected(session.destRole)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	if server.keepaliveInterval > 0 {
+		go session.keepalive(server.keepaliveInterval, stopCh)
+	}
+
+	if session.queue != nil {
+		go server.drainQueue(uuidString, session, stopCh)
+	}
+
+	if session.atLeastOnce {
+		retry := server.retryQueue(uuidString)
+		retry.resend(session, 0)
+		go retry.resendLoop(session, stopCh)
+	}
 
 	for {
 		var frame Frame
 		err := session.Read(&frame)
 		if err != nil {
+			if isTimeout(err) {
+				server.log.Errorf("No frame received from %s for %v, assuming it is dead\n",
+					uuidString, session.keepaliveTimeout)
+			}
+			session.endStreams()
+			server.disconnectRelay(session)
 			server.log.Infof("Client disconnection: %s %d\n", err)
 			server.ntf.DisconnectNotify(uuidString, session.destRole)
+			if server.metrics != nil {
+				server.metrics.Disconnected(session.destRole)
+			}
 			server.forwardRules.deleteForwardDestination(session)
 			server.removeSession(uuidString)
 			break
 		}
 
-		switch frame.Type {
-		case COMMAND:
-			if (Command)(frame.Operand) == CONFIGURE && session.destRole == Controller {
-				/* TODO Send the CONFIGURE payload to the config package */
-				server.configuration.setConfiguration(frame.Payload)
+		if session.isKeepalive(&frame) {
+			continue
+		}
+
+		if isAck(&frame) {
+			server.retryQueue(uuidString).ack(frame.ID)
+			continue
+		}
+
+		if frame.ID != 0 && server.isDuplicate(uuidString, frame.ID) {
+			server.log.Infof("Duplicate frame %d from %s\n", frame.ID, uuidString)
+			session.Write(session.ackFrame(frame.ID))
+			continue
+		}
+
+		if frame.Relay != nil && session.isRelay() {
+			server.handleRelayedFrame(session, &frame)
+		} else if !server.authorizer.authorized(session.destRole, &frame) {
+			server.rejectFrame(uuidString, session, &frame)
+		} else {
+			server.handleFrame(uuidString, session, &frame)
+		}
+
+		if frame.ID != 0 {
+			session.Write(session.ackFrame(frame.ID))
+		}
+	}
+}
+
+// handleFrame forwards and notifies a frame received from the uuid client.
+func (server *Server) handleFrame(uuidString string, session *session, frame *Frame) {
+	switch frame.Type {
+	case COMMAND:
+		if (Command)(frame.Operand) == CONFIGURE && session.destRole == Controller {
+			/* TODO Send the CONFIGURE payload to the config package */
+			/* The configuration is sent as is to connecting clients, which may only understand YAML */
+			configuration, err := payloads.Transcode(frame.Payload, payloads.YAML)
+			if err != nil {
+				server.log.Errorf("Invalid CONFIGURE payload: %s\n", err)
+			} else {
+				server.configuration.setConfiguration(configuration)
 			}
-			server.forwardRules.forwardFrame(server, session, (Command)(frame.Operand), &frame)
-			server.ntf.CommandNotify(uuidString, (Command)(frame.Operand), &frame)
-		case STATUS:
-			server.forwardRules.forwardFrame(server, session, (Status)(frame.Operand), &frame)
-			server.ntf.StatusNotify(uuidString, (Status)(frame.Operand), &frame)
-		case EVENT:
-			server.forwardRules.forwardFrame(server, session, (Event)(frame.Operand), &frame)
-			server.ntf.EventNotify(uuidString, (Event)(frame.Operand), &frame)
-		case ERROR:
-			server.forwardRules.forwardFrame(server, session, (Error)(frame.Operand), &frame)
-			server.ntf.ErrorNotify(uuidString, (Error)(frame.Operand), &frame)
-		default:
-			server.SendError(uuidString, InvalidFrameType, nil)
 		}
+		server.forwardRules.forwardFrame(server, session, (Command)(frame.Operand), frame)
+		server.ntf.CommandNotify(uuidString, (Command)(frame.Operand), frame)
+	case STATUS:
+		server.forwardRules.forwardFrame(server, session, (Status)(frame.Operand), frame)
+		server.ntf.StatusNotify(uuidString, (Status)(frame.Operand), frame)
+	case EVENT:
+		server.forwardRules.forwardFrame(server, session, (Event)(frame.Operand), frame)
+		server.ntf.EventNotify(uuidString, (Event)(frame.Operand), frame)
+	case ERROR:
+		server.forwardRules.forwardFrame(server, session, (Error)(frame.Operand), frame)
+		server.ntf.ErrorNotify(uuidString, (Error)(frame.Operand), frame)
+	case STREAM:
+		err := session.receiveStream(frame, func(s *Stream) {
+			server.streamNotify(uuidString, s)
+		})
+		if err != nil {
+			server.log.Errorf("Invalid STREAM frame from %s: %s\n", uuidString, err)
+		}
+	default:
+		server.SendError(uuidString, InvalidFrameType, nil)
 	}
 }
 
 /*
  * SSNTP Server methods
  */
+// retryQueue returns the queue of the frames sent to the uuid client in
+// at-least-once mode.  Queues outlive sessions so that unacknowledged
+// frames are sent again when the client reconnects.
+func (server *Server) retryQueue(uuid string) *retryQueue {
+	server.reliableMutex.Lock()
+	defer server.reliableMutex.Unlock()
+
+	retry := server.retryQueues[uuid]
+	if retry == nil {
+		retry = newRetryQueue(server.log)
+		server.retryQueues[uuid] = retry
+	}
+
+	return retry
+}
+
+// isDuplicate returns true if the uuid client has already sent us the
+// frame whose ID is id, and records it as received otherwise.  Clients
+// send their frames with growing IDs.
+func (server *Server) isDuplicate(uuid string, id uint64) bool {
+	server.reliableMutex.Lock()
+	defer server.reliableMutex.Unlock()
+
+	if id <= server.lastFrameIDs[uuid] {
+		return true
+	}
+	server.lastFrameIDs[uuid] = id
+
+	return false
+}
+
+// write sends frame to the uuid client, or queues it if send queues are
+// enabled. Frames for relayed clients are sent to their relay.
+func (server *Server) write(ctx context.Context, uuid string, session *session, frame *Frame) (int, error) {
+	if session.relay != nil {
+		return server.write(ctx, session.relay.dest.String(), session.relay, session.relayedFrame(frame))
+	}
+
+	if session.queue == nil {
+		return server.writeSession(ctx, uuid, session, frame)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	return server.enqueue(uuid, session, frame)
+}
+
+// writeSession writes frame to the uuid client session, keeping it until it
+// is acknowledged if the at-least-once mode is on.
+func (server *Server) writeSession(ctx context.Context, uuid string, session *session, frame *Frame) (int, error) {
+	if session.atLeastOnce && reliable(frame) {
+		return server.retryQueue(uuid).send(ctx, session, frame)
+	}
+
+	return session.writeContext(ctx, frame)
+}
+
+// rejectFrame reports a frame that the uuid client is not authorized
+// to send back to it.
+func (server *Server) rejectFrame(uuid string, session *session, frame *Frame) {
+	role := (Role)(session.destRole)
+	server.log.Errorf("%s %s frame from %s %s is not authorized\n",
+		frame.Type, operandString(frame), role.String(), uuid)
+
+	if ntf, ok := server.ntf.(RejectNotifier); ok {
+		ntf.RejectNotify(uuid, session.destRole, frame)
+	}
+
+	payload, err := payloads.Marshal(session.encoding, &payloads.ErrorUnauthorizedFrame{
+		Type:    frame.Type.String(),
+		Operand: operandString(frame),
+	})
+	if err != nil {
+		server.log.Errorf("Could not marshal UnauthorizedFrame payload: %s\n", err)
+		return
+	}
+
+	server.SendError(uuid, UnauthorizedFrame, payload)
+}
+
+func (server *Server) streamNotify(uuid string, stream *Stream) {
+	ntf, ok := server.ntf.(ServerStreamNotifier)
+	if !ok {
+		discardStream(stream)
+		return
+	}
+
+	ntf.StreamNotify(uuid, stream)
+}
+
 func (server *Server) addSession(session *session, uuid string) {
 	server.sessionMutex.Lock()
 	server.sessions[uuid] = session
 	server.sessionMutex.Unlock()
 }
 
+// addNewSession adds session unless the server already has a session for
+// uuid, and returns whether it did.
+func (server *Server) addNewSession(session *session, uuid string) bool {
+	server.sessionMutex.Lock()
+	defer server.sessionMutex.Unlock()
+
+	if server.sessions[uuid] != nil {
+		return false
+	}
+	server.sessions[uuid] = session
+
+	return true
+}
+
 func (server *Server) removeSession(uuid string) {
 	server.sessionMutex.Lock()
 	delete(server.sessions, uuid)
@@ -268,17 +517,7 @@ func (server *Server) Serve(config *Config, ntf ServerNotifier) error {
 		uri = config.URI
 	}
 
-	var transport string
-
-	if len(config.Transport) == 0 {
-		transport = "tcp"
-	} else {
-		if config.Transport != "tcp" && config.Transport != "unix" {
-			transport = "tcp"
-		} else {
-			transport = config.Transport
-		}
-	}
+	transport := newTransport(config.Transport)
 
 	if config.Log == nil {
 		server.log = errLog
@@ -289,15 +528,50 @@ func (server *Server) Serve(config *Config, ntf ServerNotifier) error {
 	server.ntf = ntf
 	server.sessions = make(map[string]*session)
 	server.forwardRules.init(config.ForwardRules)
-	server.tls = prepareTLSConfig(config, true)
+	server.tls = newTLSConfig(config, true)
 	server.forwardRules.forwardRules = config.ForwardRules
+	server.forwardTimeout = config.ForwardTimeout
+	server.sendQueueLength = config.SendQueueLength
+	server.sendQueueOverflow = config.SendQueueOverflow
 	server.role = config.Role
 	server.roleVerify = config.RoleVerification
+	server.relayedRoles = config.RelayedRoles
+	if server.relayedRoles == 0 {
+		server.relayedRoles = defaultRelayedRoles
+	}
 	server.trace = config.Trace
+	server.keepaliveInterval, server.keepaliveTimeout = config.keepaliveSettings()
+	server.encodings = config.Encodings
+	server.payloadVersion = config.payloadVersion()
+	server.atLeastOnce = config.AtLeastOnce
+	server.retryQueues = make(map[string]*retryQueue)
+	server.lastFrameIDs = make(map[string]uint64)
+	server.limits = newConnectionLimits(config)
+	server.throttle = newAcceptThrottle(config)
+	server.authorizer = newFrameAuthorizer(config.Authorizations)
+	server.metrics = config.Metrics
 	server.stoppedChan = make(chan struct{})
 
-	service := fmt.Sprintf("%s:%d", uri, serverPort)
-	listener, err := tls.Listen(transport, service, server.tls)
+	var err error
+	server.revocation, err = newRevocationChecker(config, server.log)
+	if err != nil {
+		server.log.Errorf("%s\n", err)
+		return err
+	}
+
+	server.faults, err = newFaultInjector(config, server.log)
+	if err != nil {
+		server.log.Errorf("%s\n", err)
+		return err
+	}
+
+	if server.tls.get() == nil {
+		return fmt.Errorf("Invalid SSNTP certificates")
+	}
+
+	service := hostPort(uri, serverPort)
+	/* Each connection picks the certificates up at accept time, so that they can be rotated */
+	listener, err := transport.listen(service, server.tls.get)
 	if err != nil {
 		server.log.Errorf("Failed to start listener (err=%s) on %s\n", err, service)
 		return err
@@ -307,7 +581,23 @@ func (server *Server) Serve(config *Config, ntf ServerNotifier) error {
 	server.listener = listener
 	defer listener.Close()
 
+	if config.Recording != "" {
+		server.recorder, err = newFrameRecorder(config.Recording, server.uuid.String(), server.role, true, server.log)
+		if err != nil {
+			server.log.Errorf("%s\n", err)
+			return err
+		}
+	}
+
+	if server.revocation != nil {
+		go server.watchRevocations()
+	}
+
 	for {
+		if server.throttle != nil {
+			time.Sleep(server.throttle.delay(time.Now()))
+		}
+
 		conn, err := listener.Accept()
 		if err != nil {
 			server.stopped.Lock()
@@ -320,6 +610,16 @@ func (server *Server) Serve(config *Config, ntf ServerNotifier) error {
 		}
 
 		server.clientWg.Add(1)
+		if !server.limits.acquire() {
+			server.log.Errorf("Too many connections, refusing %s\n", conn.RemoteAddr())
+			go func() {
+				defer server.clientWg.Done()
+				defer conn.Close()
+				sendConnectionRefused(conn, payloads.TooManyConnections, server.limits.max)
+			}()
+			continue
+		}
+
 		go handleSSNTPClient(server, conn)
 	}
 
@@ -342,6 +642,9 @@ func (server *Server) Stop() {
 
 	server.sessionMutex.RLock()
 	for uuid, session := range server.sessions {
+		if session.relay != nil {
+			continue
+		}
 		server.log.Infof("Closing connection for %s\n", uuid)
 		session.conn.Close()
 	}
@@ -356,99 +659,254 @@ func (server *Server) Stop() {
 		server.log.Errorf("Timeout waiting for main server thread\n")
 	}
 
+	server.recorder.close()
+
 	freeUUID(server.lUUID)
 }
 
-func (server *Server) sendCommand(uuid string, cmd Command, payload []byte, trace *TraceConfig) (int, error) {
+func (server *Server) sendCommand(ctx context.Context, uuid string, cmd Command, payload []byte, trace *TraceConfig) (int, error) {
 	session := server.getSession(uuid)
 	if session == nil {
 		return -1, fmt.Errorf("Unknown UUID %s", uuid)
 	}
 
 	frame := session.commandFrame(cmd, payload, trace)
-	return session.Write(frame)
+	return server.write(ctx, uuid, session, frame)
 }
 
-func (server *Server) sendStatus(uuid string, status Status, payload []byte, trace *TraceConfig) (int, error) {
+func (server *Server) sendStatus(ctx context.Context, uuid string, status Status, payload []byte, trace *TraceConfig) (int, error) {
 	session := server.getSession(uuid)
 	if session == nil {
 		return -1, fmt.Errorf("Unknown UUID %s", uuid)
 	}
 
 	frame := session.statusFrame(status, payload, trace)
-	return session.Write(frame)
+	return server.write(ctx, uuid, session, frame)
 }
 
-func (server *Server) sendEvent(uuid string, event Event, payload []byte, trace *TraceConfig) (int, error) {
+func (server *Server) sendEvent(ctx context.Context, uuid string, event Event, payload []byte, trace *TraceConfig) (int, error) {
 	session := server.getSession(uuid)
 	if session == nil {
 		return -1, fmt.Errorf("Unknown UUID %s", uuid)
 	}
 
 	frame := session.eventFrame(event, payload, trace)
-	return session.Write(frame)
+	return server.write(ctx, uuid, session, frame)
 }
 
-func (server *Server) sendError(uuid string, error Error, payload []byte, trace *TraceConfig) (int, error) {
+func (server *Server) sendError(ctx context.Context, uuid string, error Error, payload []byte, trace *TraceConfig) (int, error) {
 	session := server.getSession(uuid)
 	if session == nil {
 		return -1, fmt.Errorf("Unknown UUID %s", uuid)
 	}
 
 	frame := session.errorFrame(error, payload, trace)
-	return session.Write(frame)
+	return server.write(ctx, uuid, session, frame)
 }
 
 // SendCommand sends a specific command and its payload to a client.
 // The client is specified by its uuid
 func (server *Server) SendCommand(uuid string, cmd Command, payload []byte) (int, error) {
-	return server.sendCommand(uuid, cmd, payload, server.trace)
+	return server.sendCommand(context.Background(), uuid, cmd, payload, server.trace)
 }
 
 // SendStatus sends a specific status and its payload to a client.
 // The client is specified by its uuid
 func (server *Server) SendStatus(uuid string, status Status, payload []byte) (int, error) {
-	return server.sendStatus(uuid, status, payload, server.trace)
+	return server.sendStatus(context.Background(), uuid, status, payload, server.trace)
 }
 
 // SendEvent sends a specific status and its payload to a client.
 // The client is specified by its uuid
 func (server *Server) SendEvent(uuid string, event Event, payload []byte) (int, error) {
-	return server.sendEvent(uuid, event, payload, server.trace)
+	return server.sendEvent(context.Background(), uuid, event, payload, server.trace)
 }
 
 // SendError sends an error back to a client.
 // The client is specified by its uuid
 func (server *Server) SendError(uuid string, error Error, payload []byte) (int, error) {
-	return server.sendError(uuid, error, payload, server.trace)
+	return server.sendError(context.Background(), uuid, error, payload, server.trace)
 }
 
 // SendTracedCommand sends a specific command and its payload to a client.
 // The SSNTP command frame will be traced according to the trace argument.
 // The client is specified by its uuid
 func (server *Server) SendTracedCommand(uuid string, cmd Command, payload []byte, trace *TraceConfig) (int, error) {
-	return server.sendCommand(uuid, cmd, payload, trace)
+	return server.sendCommand(context.Background(), uuid, cmd, payload, trace)
 }
 
 // SendTracedStatus sends a specific status and its payload to a client.
 // The SSNTP status frame will be traced according to the trace argument.
 // The client is specified by its uuid
 func (server *Server) SendTracedStatus(uuid string, status Status, payload []byte, trace *TraceConfig) (int, error) {
-	return server.sendStatus(uuid, status, payload, trace)
+	return server.sendStatus(context.Background(), uuid, status, payload, trace)
 }
 
 // SendTracedEvent sends a specific event and its payload to a client.
 // The SSNTP event frame will be traced according to the trace argument.
 // The client is specified by its uuid
 func (server *Server) SendTracedEvent(uuid string, event Event, payload []byte, trace *TraceConfig) (int, error) {
-	return server.sendEvent(uuid, event, payload, trace)
+	return server.sendEvent(context.Background(), uuid, event, payload, trace)
 }
 
 // SendTracedError sends an error back to a client.
 // The SSNTP error frame will be traced according to the trace argument.
 // The client is specified by its uuid
 func (server *Server) SendTracedError(uuid string, error Error, payload []byte, trace *TraceConfig) (int, error) {
-	return server.sendError(uuid, error, payload, trace)
+	return server.sendError(context.Background(), uuid, error, payload, trace)
+}
+
+// SendCommandContext sends a specific command and its payload to a client,
+// giving up when ctx is done. Frames that are given up on before being
+// written are never sent, the ctx error is then returned. When the ctx
+// deadline expires while the frame is being written, the write fails and
+// the client connection is lost.
+// The client is specified by its uuid
+func (server *Server) SendCommandContext(ctx context.Context, uuid string, cmd Command, payload []byte) (int, error) {
+	return server.sendCommand(ctx, uuid, cmd, payload, server.trace)
+}
+
+// SendStatusContext sends a specific status and its payload to a client,
+// giving up when ctx is done, see SendCommandContext.
+// The client is specified by its uuid
+func (server *Server) SendStatusContext(ctx context.Context, uuid string, status Status, payload []byte) (int, error) {
+	return server.sendStatus(ctx, uuid, status, payload, server.trace)
+}
+
+// SendEventContext sends a specific event and its payload to a client,
+// giving up when ctx is done, see SendCommandContext.
+// The client is specified by its uuid
+func (server *Server) SendEventContext(ctx context.Context, uuid string, event Event, payload []byte) (int, error) {
+	return server.sendEvent(ctx, uuid, event, payload, server.trace)
+}
+
+// SendErrorContext sends an error back to a client, giving up when ctx is
+// done, see SendCommandContext.
+// The client is specified by its uuid
+func (server *Server) SendErrorContext(ctx context.Context, uuid string, error Error, payload []byte) (int, error) {
+	return server.sendError(ctx, uuid, error, payload, server.trace)
+}
+
+// OpenStream opens a stream to the uuid SSNTP client. Everything written to
+// the returned stream is sent to the client as STREAM frames, and the
+// stream must be closed once done.
+func (server *Server) OpenStream(uuid string, name string) (io.WriteCloser, error) {
+	session := server.getSession(uuid)
+	if session == nil {
+		return nil, fmt.Errorf("Unknown UUID %s", uuid)
+	}
+
+	if session.relay != nil {
+		return nil, fmt.Errorf("Streams can not be sent to relayed client %s", uuid)
+	}
+
+	return session.openStream(name), nil
+}
+
+// ReloadCertificates reads the server CA and certificate files again.
+// Connected clients are not affected, only the ones connecting from now on
+// are authenticated with the new certificates. The current certificates are
+// kept if the new ones can not be loaded. The CRL, if any, is reloaded as
+// well and clients whose certificates it revokes are disconnected.
+func (server *Server) ReloadCertificates() error {
+	if server.tls == nil {
+		return fmt.Errorf("SSNTP server not started")
+	}
+
+	if err := server.tls.reload(); err != nil {
+		server.log.Errorf("Could not reload certificates: %s\n", err)
+		return err
+	}
+
+	server.log.Infof("Reloaded certificates\n")
+
+	if server.revocation != nil && server.revocation.crlPath != "" {
+		if err := server.revocation.loadCRL(); err != nil {
+			server.log.Errorf("Could not reload CRL: %s\n", err)
+			return err
+		}
+		server.disconnectRevoked(false)
+	}
+
+	return nil
+}
+
+// disconnectRevoked closes the connections of the clients whose
+// certificates have been revoked.
+func (server *Server) disconnectRevoked(useOCSP bool) {
+	server.sessionMutex.RLock()
+	sessions := make(map[string]*session, len(server.sessions))
+	for uuid, session := range server.sessions {
+		if session.relay == nil {
+			sessions[uuid] = session
+		}
+	}
+	server.sessionMutex.RUnlock()
+
+	for uuid, session := range sessions {
+		if err := server.revocation.check(session.conn, useOCSP); err != nil {
+			server.log.Errorf("Disconnecting %s: %s\n", uuid, err)
+			session.conn.Close()
+		}
+	}
+}
+
+// watchRevocations reloads the CRL when it changes, and periodically
+// checks the connected clients with their OCSP responders.
+func (server *Server) watchRevocations() {
+	crlTicker := time.NewTicker(crlCheckInterval)
+	defer crlTicker.Stop()
+	ocspTicker := time.NewTicker(ocspCheckInterval)
+	defer ocspTicker.Stop()
+
+	for {
+		select {
+		case <-server.stoppedChan:
+			return
+		case <-crlTicker.C:
+			if !server.revocation.crlChanged() {
+				continue
+			}
+
+			if err := server.revocation.loadCRL(); err != nil {
+				server.log.Errorf("Could not reload CRL: %s\n", err)
+				continue
+			}
+
+			server.log.Infof("Reloaded CRL\n")
+			server.disconnectRevoked(false)
+		case <-ocspTicker.C:
+			if server.revocation.ocsp {
+				server.disconnectRevoked(true)
+			}
+		}
+	}
+}
+
+// PayloadVersion returns the payload version agreed on with a client.
+// Payloads sent to the client can be marshalled for this version with
+// payloads.MarshalVersion. The client is specified by its uuid.
+func (server *Server) PayloadVersion(uuid string) payloads.Version {
+	session := server.getSession(uuid)
+	if session == nil {
+		return payloads.Version1
+	}
+
+	return session.payloadVersion
+}
+
+// ClockOffset returns how far the clock of the client uuid was ahead of the
+// server one when it connected.  The estimate is short by the time the
+// CONNECT frame took to reach the server, which is negligible next to the
+// skews that matter to SSNTP users.  ok is false if the client is not
+// connected or predates the clock check.
+func (server *Server) ClockOffset(uuid string) (offset time.Duration, ok bool) {
+	session := server.getSession(uuid)
+	if session == nil || !session.clockChecked {
+		return 0, false
+	}
+
+	return session.clockOffset, true
 }
 
 // UUID exports the SSNTP server Universally Unique ID.
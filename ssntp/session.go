@@ -19,8 +19,13 @@ package ssntp
 import (
 	"encoding/gob"
 	"github.com/docker/distribution/uuid"
+	"io"
 	"net"
 	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/01org/ciao/payloads"
 )
 
 func setReadTimeout(conn net.Conn) {
@@ -46,8 +51,62 @@ type session struct {
 	destRole uint32
 	conn     net.Conn
 
-	encoder *gob.Encoder
-	decoder *gob.Decoder
+	encoder   *gob.Encoder
+	decoder   *gob.Decoder
+	writeLock priorityLock
+
+	// tx and rx count the bytes written to and read from conn.
+	tx      *byteCounter
+	rx      *byteCounter
+	metrics Metrics
+
+	// keepaliveTimeout is only armed once the peer has sent us a
+	// KEEPALIVE frame, i.e., once we know it sends them.
+	keepaliveTimeout time.Duration
+	peerKeepalive    bool
+
+	// encoding is the payload encoding agreed on with the peer when
+	// connecting.
+	encoding payloads.Encoding
+
+	// payloadVersion is the payload version agreed on with the peer when
+	// connecting.
+	payloadVersion payloads.Version
+
+	// atLeastOnce is true when both ends turned the at-least-once
+	// delivery mode on.
+	atLeastOnce bool
+
+	// clockOffset is how far the clock of the peer was found to be ahead
+	// of ours when connecting, and clockRTT the round trip time of that
+	// check, 0 when it is only known to servers.  clockChecked is false
+	// when the peer predates the clock check.
+	clockOffset  time.Duration
+	clockRTT     time.Duration
+	clockChecked bool
+
+	// streams are the streams being received from the peer, only
+	// accessed from the session reading routine.
+	streams      map[uint32]*Stream
+	lastStreamID uint32
+
+	// queue holds the frames waiting to be sent to the peer, when
+	// servers send queues are enabled.
+	queue *sendQueue
+
+	// recorder, if any, records the frames exchanged with the peer.
+	recorder *frameRecorder
+
+	// faults, if any, injects faults in the frames sent to the peer.
+	faults *faultInjector
+
+	// relay is the session of the SSNTP relay a relayed client is
+	// reached through, nil for the peers connected to us.
+	relay *session
+
+	// relayed are the sessions of the clients connected to the peer when
+	// it is an SSNTP relay, only accessed from the session reading routine.
+	relayed map[string]*session
 }
 
 /*
@@ -64,8 +123,11 @@ func newSession(src *uuid.UUID, srcRole uint32, destRole uint32, netConn net.Con
 	session.destRole = destRole
 
 	session.conn = netConn
-	session.encoder = gob.NewEncoder(netConn)
-	session.decoder = gob.NewDecoder(netConn)
+	session.streams = make(map[uint32]*Stream)
+	session.tx = &byteCounter{w: netConn}
+	session.rx = &byteCounter{r: netConn}
+	session.encoder = gob.NewEncoder(session.tx)
+	session.decoder = gob.NewDecoder(session.rx)
 
 	return &session
 }
@@ -76,21 +138,24 @@ func (session *session) setDest(uuid []byte) {
 
 func (session *session) connectedFrame(serverRole uint32, payload []byte) (f *ConnectedFrame) {
 	f = &ConnectedFrame{
-		Major:         major,
-		Minor:         minor,
-		Type:          STATUS,
-		Operand:       byte(CONNECTED),
-		Role:          serverRole,
-		Source:        session.src[:],
-		Destination:   session.dest[:],
-		PayloadLength: (uint32)(len(payload)),
-		Payload:       payload,
+		Major:          major,
+		Minor:          minor,
+		Type:           STATUS,
+		Operand:        byte(CONNECTED),
+		Role:           serverRole,
+		Source:         session.src[:],
+		Destination:    session.dest[:],
+		PayloadLength:  (uint32)(len(payload)),
+		Payload:        payload,
+		Encoding:       session.encoding,
+		AtLeastOnce:    session.atLeastOnce,
+		PayloadVersion: session.payloadVersion,
 	}
 
 	return
 }
 
-func (session *session) connectFrame() (f *ConnectFrame) {
+func (session *session) connectFrame(encodings []payloads.Encoding, atLeastOnce bool) (f *ConnectFrame) {
 	f = &ConnectFrame{
 		Major:       major,
 		Minor:       minor,
@@ -99,6 +164,8 @@ func (session *session) connectFrame() (f *ConnectFrame) {
 		Role:        session.srcRole,
 		Source:      session.src[:],
 		Destination: session.dest[:],
+		Encodings:   encodings,
+		AtLeastOnce: atLeastOnce,
 	}
 
 	return
@@ -168,26 +235,117 @@ func (session *session) errorFrame(error Error, payload []byte, trace *TraceConf
 	return
 }
 
+func (session *session) streamFrame(header *StreamHeader, payload []byte) (f *Frame) {
+	f = &Frame{
+		Major:         major,
+		Minor:         minor,
+		Type:          STREAM,
+		PayloadLength: (uint32)(len(payload)),
+		Payload:       payload,
+		Stream:        header,
+	}
+
+	return
+}
+
+// Write sends frame to the peer. Concurrent writers are served by frame
+// priority, so that e.g. a DELETE command does not have to wait for all
+// the pending STATS commands to be sent.
 func (session *session) Write(frame interface{}) (int, error) {
+	return session.writeContext(context.Background(), frame)
+}
+
+// writeContext sends frame to the peer, giving up if ctx is done before
+// the frame could be written. The frame write itself is interrupted when
+// the ctx deadline expires, which breaks the connection.
+func (session *session) writeContext(ctx context.Context, frame interface{}) (int, error) {
+	if err := session.lock(ctx, frame); err != nil {
+		return -1, err
+	}
+	defer session.writeLock.unlock()
+
+	return session.writeLocked(ctx, frame)
+}
+
+// lock takes the session write lock for frame, until ctx is done.
+func (session *session) lock(ctx context.Context, frame interface{}) error {
+	priority := NormalPriority
+	if f, ok := frame.(*Frame); ok {
+		priority = f.Priority()
+	}
+
+	return session.writeLock.lockContext(ctx, priority)
+}
+
+// writeLocked sends frame to the peer, with the session write lock held.
+func (session *session) writeLocked(ctx context.Context, frame interface{}) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return -1, err
+	}
+
+	if f, ok := frame.(*Frame); ok && session.faults != nil {
+		if session.faults.drop(f) {
+			return 0, nil
+		}
+
+		if err := session.faults.delay(ctx, f); err != nil {
+			return -1, err
+		}
+	}
+
+	start := time.Now()
+
 	switch f := frame.(type) {
 	case *Frame:
 		if f.PathTrace() == false {
 			break
 		}
 
-		f.Trace.Path[f.Trace.PathLength-1].TxTimestamp = time.Now()
+		f.Trace.Path[f.Trace.PathLength-1].TxTimestamp = start
 	}
 
+	written := session.tx.count
 	setWriteTimeout(session.conn)
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(start.Add(readTimeout*time.Second)) {
+		session.conn.SetWriteDeadline(deadline)
+	}
 	err := session.encoder.Encode(frame)
 	clearWriteTimeout(session.conn)
+	n := (int)(session.tx.count - written)
+
+	if session.metrics != nil {
+		if err != nil {
+			session.metrics.Error(session.destRole, err)
+		} else if f, ok := frame.(*Frame); ok {
+			session.metrics.FrameSent(session.destRole, f, n, time.Since(start))
+		}
+	}
 
-	return 0, err
+	if f, ok := frame.(*Frame); ok && err == nil {
+		session.recorder.record(true, session, f)
+	}
+
+	return n, err
 }
 
 func (session *session) Read(frame interface{}) error {
+	if session.peerKeepalive && session.keepaliveTimeout > 0 {
+		session.conn.SetReadDeadline(time.Now().Add(session.keepaliveTimeout))
+	}
+
+	read := session.rx.count
 	err := session.decoder.Decode(frame)
 
+	if session.metrics != nil {
+		if err != nil {
+			if err != io.EOF {
+				session.metrics.Error(session.destRole, err)
+			}
+		} else if f, ok := frame.(*Frame); ok {
+			session.metrics.FrameReceived(session.destRole, f, (int)(session.rx.count-read))
+		}
+	}
+
 	switch f := frame.(type) {
 	case *Frame:
 		if f.PathTrace() == false {
@@ -204,6 +362,48 @@ func (session *session) Read(frame interface{}) error {
 		f.Trace.PathLength++
 	}
 
+	if f, ok := frame.(*Frame); ok && err == nil {
+		session.recorder.record(false, session, f)
+	}
+
 	return err
 
 }
+
+// isKeepalive returns true if frame is a KEEPALIVE frame, noting that the
+// peer sends keepalives so that subsequent reads are timed out.
+func (session *session) isKeepalive(frame *Frame) bool {
+	if frame.Type != STATUS || (Status)(frame.Operand) != KEEPALIVE {
+		return false
+	}
+
+	session.peerKeepalive = true
+
+	return true
+}
+
+// keepalive sends a KEEPALIVE frame to the peer every interval, until stopCh
+// is closed or the frame cannot be written.
+func (session *session) keepalive(interval time.Duration, stopCh <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		frame := session.statusFrame(KEEPALIVE, nil, nil)
+		if _, err := session.Write(frame); err != nil {
+			return
+		}
+	}
+}
+
+// isTimeout returns true if err was caused by a read deadline expiring.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
@@ -30,18 +30,22 @@ import (
 	"strings"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/docker/distribution/uuid"
 	"github.com/golang/glog"
+
+	"github.com/01org/ciao/payloads"
 )
 
 // Type is the SSNTP frame type.
-// It can be COMMAND, STATUS, ERROR or EVENT.
+// It can be COMMAND, STATUS, ERROR, EVENT or STREAM.
 type Type uint8
 
 // Command is the SSNTP Command operand.
 // It can be CONNECT, START, STOP, STATS, EVACUATE, DELETE, RESTART,
-// AssignPublicIP, ReleasePublicIP or CONFIGURE.
+// AssignPublicIP, ReleasePublicIP, CONFIGURE, PREFETCH, STOPGROUP or
+// DELETEGROUP.
 type Command uint8
 
 // Status is the SSNTP Status operand.
@@ -55,13 +59,14 @@ type Role uint32
 // Error is the SSNTP Error operand.
 // It can be InvalidFrameType Error, StartFailure,
 // StopFailure, ConnectionFailure, RestartFailure,
-// DeleteFailure, ConnectionAborted or InvalidConfiguration.
+// DeleteFailure, ConnectionAborted, InvalidConfiguration,
+// ConnectionRefused, UnauthorizedFrame or InvalidPayload.
 type Error uint8
 
 // Event is the SSNTP Event operand.
 // It can be TenantAdded, TenantRemoval, InstanceDeleted,
 // ConcentratorInstanceAdded, PublicIPAssigned, TraceReport,
-// NodeConnected or NodeDisconnected
+// NodeConnected, NodeDisconnected or InstanceReady
 type Event uint8
 
 const (
@@ -87,6 +92,20 @@ const (
 	// broadcast or not.
 	// EVENT frames describe a general, non erratic cluster event.
 	EVENT
+
+	// STREAM frames carry the chunks of a payload that is too large to
+	// be sent as a single frame, e.g. a diagnostics bundle or an image.
+	// Each STREAM frame payload is a chunk of at most 64KB, and the frame
+	// StreamHeader identifies the stream and the chunk sequence number.
+	// STREAM frames are not forwarded, and are exposed through the
+	// Client and Server OpenStream methods and the ClientStreamNotifier
+	// and ServerStreamNotifier interfaces.
+	//
+	//	+------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | Stream  | Chunk    |
+	//	|       |       | (0x4) |  (0x0)  |                 | header  |          |
+	//	+------------------------------------------------------------------------+
+	STREAM
 )
 
 const (
@@ -140,7 +159,9 @@ const (
 	// this node. The payload for this command is a YAML formatted description of the
 	// next state to reach after evacuation is done. It could be 'shutdown' for shutting
 	// the node down, 'update' for having it run a software update, 'reboot' for rebooting
-	// the node or 'maintenance' for putting the node in maintenance mode:
+	// the node or 'maintenance' for putting the node in maintenance mode.  Agents
+	// may also send it to the Scheduler to ask for the evacuation of their own
+	// node, which is then forwarded to the Controllers:
 	//	+---------------------------------------------------------------------------------+
 	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted compute      |
 	//	|       |       | (0x0) |  (0x4)  |                 | node next state description |
@@ -228,6 +249,145 @@ const (
 	//	|       |       | (0x0) |  (0x9)  |                 |                         |
 	//	+-----------------------------------------------------------------------------+
 	CONFIGURE
+
+	// PREFETCH is a command sent by the Controller to ask a CIAO agent to
+	// download a backing image into its local image cache before any
+	// instance based on that image is started on the agent's node.
+	// It is sent to the Scheduler which forwards it to the agent identified
+	// by the payload's agent UUID.
+	//
+	// The PREFETCH YAML payload schema is made of the agent and image UUIDs
+	// and an optional SHA256 checksum of the image.
+	//
+	//                                       SSNTP PREFETCH Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xa)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	PREFETCH
+
+	// STOPGROUP is a command sent by the Controller to stop all the
+	// running instances of a group on a single CN.  Groups are defined
+	// by the group_id field of the START payload.  It is sent to the
+	// Scheduler which forwards it to the agent identified by the
+	// payload's agent UUID.
+	//
+	// The STOPGROUP YAML payload schema is made of the agent UUID and
+	// the group identifier.
+	//
+	//                                       SSNTP STOPGROUP Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xb)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	STOPGROUP
+
+	// DELETEGROUP is a command sent by the Controller to delete all the
+	// instances of a group on a single CN.  It is otherwise identical to
+	// STOPGROUP.
+	//
+	//                                       SSNTP DELETEGROUP Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xc)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	DELETEGROUP
+
+	// COLLECTDIAGNOSTICS is a command sent by the Controller to ask a CN
+	// agent to gather the logs, recent statistics and, optionally, a
+	// memory dump of one of its instances into a single bundle.  It is
+	// sent to the Scheduler which forwards it to the agent identified by
+	// the payload's agent UUID.  The bundle is either uploaded to the URL
+	// given in the payload or returned in DiagnosticsData events.
+	//
+	// The COLLECTDIAGNOSTICS YAML payload schema is made of the instance
+	// and agent UUIDs, an optional upload URL, the number of statistics
+	// samples to include and whether to dump the guest's memory.
+	//
+	//                                    SSNTP COLLECTDIAGNOSTICS Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xd)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	COLLECTDIAGNOSTICS
+
+	// POWERDOWN is a command sent by the Scheduler to ask a CN agent to
+	// power its node down, once the Scheduler has stopped placing
+	// instances on it because it has been idle for too long.  Agents
+	// with running instances ignore it.  The Scheduler wakes the node
+	// up later with a wake-on-LAN packet.
+	//
+	// The POWERDOWN YAML payload schema is made of the agent UUID.
+	//
+	//                                       SSNTP POWERDOWN Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xe)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	POWERDOWN
+
+	// REPLAYEVENTS is a command sent by a Controller to the Scheduler when
+	// it reconnects, to replay the NodeConnected, NodeDisconnected and
+	// InstanceDeleted events it missed from the Scheduler's event journal.
+	// The Scheduler sends the events again, followed by an EventsReplayed
+	// event.
+	//
+	// The REPLAYEVENTS YAML payload schema is made of the journal ID and
+	// the sequence number of the last event the Controller knows about.
+	//
+	//                                       SSNTP REPLAYEVENTS Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0xf)  |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	REPLAYEVENTS
+
+	// SECURITYGROUP is a command sent by the Controller to set the security
+	// group rules of an instance.  It is sent to the Scheduler which
+	// forwards it to the agent identified by the payload's agent UUID.
+	// The agent filters the traffic of the instance's vnic accordingly.
+	//
+	// The SECURITYGROUP YAML payload schema is made of the instance and
+	// agent UUIDs, the version of the rules and the rules themselves.
+	//
+	//                                       SSNTP SECURITYGROUP Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0x10) |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	SECURITYGROUP
+
+	// RESERVE is a command sent by the Controller to hold resources on a
+	// CN for an instance it will start later, once its volumes and
+	// networks are ready.  The Scheduler picks the node, unless the
+	// payload names one, claims the resources and forwards the command
+	// to the node's agent, which keeps the resources aside until a START
+	// command references the reservation or the reservation expires.
+	//
+	// The RESERVE YAML payload schema is made of the reservation ID, the
+	// tenant UUID, an optional agent UUID, the requested resources and
+	// the time to live of the reservation.
+	//
+	//                                       SSNTP RESERVE Command frame
+	//	+-----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload  |
+	//	|       |       | (0x0) |  (0x11) |                 |                         |
+	//	+-----------------------------------------------------------------------------+
+	RESERVE
+
+	// TOPOLOGY is a command sent by a Controller to the Scheduler to get
+	// the current topology of the cluster, rather than rebuilding it from
+	// the NodeConnected and NodeDisconnected events.  The Scheduler
+	// replies with a ClusterTopology event.
+	//
+	// The TOPOLOGY command has no payload.
+	//
+	//                                       SSNTP TOPOLOGY Command frame
+	//	+---------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length |
+	//	|       |       | (0x0) |  (0x12) |       (0x0)     |
+	//	+---------------------------------------------------+
+	TOPOLOGY
 )
 
 const (
@@ -292,6 +452,62 @@ const (
 	//	|       |       | (0x1) |  (0x4)  |       (0x0)     |
 	//	+---------------------------------------------------+
 	MAINTENANCE
+
+	// KEEPALIVE is periodically sent by SSNTP clients and servers that have
+	// been configured with a keepalive interval.  It lets the peer detect
+	// that the connection is dead when it has not received any frame for
+	// longer than its keepalive timeout.  KEEPALIVE frames are consumed by
+	// the SSNTP package and are never passed to notifiers or forwarded.
+	//
+	//					 SSNTP KEEPALIVE Status frame
+	//
+	//	+---------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length |
+	//	|       |       | (0x1) |  (0x5)  |       (0x0)     |
+	//	+---------------------------------------------------+
+	KEEPALIVE
+
+	// ACK acknowledges a COMMAND, EVENT or ERROR frame received in
+	// at-least-once mode.  The ACK frame ID is the ID of the acknowledged
+	// frame.  ACK frames are consumed by the SSNTP package and are never
+	// passed to notifiers or forwarded.
+	//
+	//					 SSNTP ACK Status frame
+	//
+	//	+---------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length |
+	//	|       |       | (0x1) |  (0x6)  |       (0x0)     |
+	//	+---------------------------------------------------+
+	ACK
+
+	// RELAYCONNECTED is sent by SSNTP relays to their upstream server when
+	// a client connects to them.  The frame Relay header carries the
+	// client UUID and role, and the payload encoding the relay agreed on
+	// with it.  The server then handles the frames relayed on behalf of
+	// that client as if it was directly connected.  RELAYCONNECTED frames
+	// are consumed by the SSNTP package and are never passed to notifiers
+	// or forwarded.
+	//
+	//					 SSNTP RELAYCONNECTED Status frame
+	//
+	//	+------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | Relay  |
+	//	|       |       | (0x1) |  (0x7)  |       (0x0)     | header |
+	//	+------------------------------------------------------------+
+	RELAYCONNECTED
+
+	// RELAYDISCONNECTED is sent by SSNTP relays to their upstream server
+	// when the client identified by the frame Relay header disconnects
+	// from them.  RELAYDISCONNECTED frames are consumed by the SSNTP
+	// package and are never passed to notifiers or forwarded.
+	//
+	//					 SSNTP RELAYDISCONNECTED Status frame
+	//
+	//	+------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | Relay  |
+	//	|       |       | (0x1) |  (0x8)  |       (0x0)     | header |
+	//	+------------------------------------------------------------+
+	RELAYDISCONNECTED
 )
 
 const (
@@ -413,6 +629,225 @@ const (
 	//	|       |       | (0x3) |  (0x7)  |                 |                        |
 	//	+----------------------------------------------------------------------------+
 	NodeDisconnected
+
+	// InstanceReady is sent by workload agents to notify the scheduler and the Controller
+	// that a running instance has become usable, i.e., that its guest agent or SSH server
+	// is answering.  The payload contains the instance UUID and the time the instance
+	// took to boot.
+	//
+	//					 SSNTP InstanceReady Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x8)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	InstanceReady
+
+	// DiagnosticsData is sent by workload agents in response to a
+	// COLLECTDIAGNOSTICS command.  The payload contains the instance UUID
+	// and either a chunk of the diagnostics bundle or, if the bundle was
+	// uploaded, an indication of whether the upload succeeded.
+	//
+	//					 SSNTP DiagnosticsData Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x9)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	DiagnosticsData
+
+	// AttestationQuote is sent by workload agents once an instance with
+	// a virtual TPM has become ready.  The payload contains the instance
+	// UUID, the nonce chosen by the agent and the TPM quote generated
+	// inside the instance over that nonce.
+	//
+	//					 SSNTP AttestationQuote Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0xa)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	AttestationQuote
+
+	// NodeCapabilities is sent by workload agents to the scheduler when
+	// they connect to it.  The payload describes the hypervisors, CPU
+	// features, hugepage sizes, PCI devices and storage backends of the
+	// compute node, which the scheduler uses to place instances.
+	//
+	//					 SSNTP NodeCapabilities Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0xb)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	NodeCapabilities
+
+	// InstanceStateChanged is sent by workload agents each time one of
+	// their instances changes state, e.g., from running to crashed.  The
+	// payload contains the instance UUID and its previous and new states.
+	//
+	//					 SSNTP InstanceStateChanged Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0xc)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	InstanceStateChanged
+
+	// WorkloadDefinition is sent by Controllers to the scheduler to
+	// register the resources requested by the instances of a flavor.
+	// The START commands of these instances can then reference the
+	// flavor UUID rather than list the resources.
+	//
+	//					 SSNTP WorkloadDefinition Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0xd)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	WorkloadDefinition
+
+	// EventsReplayed is sent by the scheduler to a Controller after the
+	// events it asked to replay with a REPLAYEVENTS command.  The payload
+	// contains the journal ID, the sequence number of the last event of
+	// the journal and whether all the events the Controller missed could
+	// be replayed.
+	//
+	//					 SSNTP EventsReplayed Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0xe)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	EventsReplayed
+
+	// PublicIPPoolRegistered is sent by Controllers or Networking
+	// concentrator instances (CNCI) to the Scheduler to register the
+	// size of the pool of public IPs a CNCI assigns from, and the number
+	// of them already assigned.  The Scheduler does not forward
+	// PublicIPAssigned events for a CNCI whose pool is exhausted.
+	//
+	//					 SSNTP PublicIPPoolRegistered Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0xf)  |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	PublicIPPoolRegistered
+
+	// PublicIPReleased events are sent by Networking concentrator
+	// instances (CNCI) to the Scheduler when they released the public
+	// IP of a given instance, returning it to their pool.
+	//
+	// The PublicIPReleased event payload is the same as the
+	// PublicIPAssigned one.
+	//
+	//					 SSNTP PublicIPReleased Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x10) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	PublicIPReleased
+
+	// TenantNetworksReport is periodically sent by networking compute
+	// node Agents to the Scheduler to report the tenant bridges and
+	// tunnels active on their node.  The Scheduler checks it against the
+	// TenantAdded and TenantRemoved events the Agent sent.
+	//
+	//					 SSNTP TenantNetworksReport Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x11) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	TenantNetworksReport
+
+	// TenantNetworkDrift is sent by the Scheduler to all Controllers
+	// when the tenant networks an Agent reports differ from the ones
+	// its TenantAdded and TenantRemoved events announced, listing the
+	// orphaned and missing tenant networks of the node.
+	//
+	//					 SSNTP TenantNetworkDrift Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x12) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	TenantNetworkDrift
+
+	// UpgradeProgress is sent by the Scheduler to all Controllers
+	// during a rolling upgrade of the compute nodes, each time a node is
+	// drained, upgraded or runs out of instances.
+	//
+	//					 SSNTP UpgradeProgress Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x13) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	UpgradeProgress
+
+	// ReservationStatus is sent by the Scheduler to the Controller that
+	// sent a RESERVE command, once the resources are held on a node or
+	// could not be, and when the reservation expires unused.
+	//
+	//					 SSNTP ReservationStatus Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x14) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	ReservationStatus
+
+	// ClusterTopology is sent by the Scheduler to a Controller in reply
+	// to a TOPOLOGY command.  The payload lists the connected Controllers
+	// and nodes, with the nodes' roles, available resources and
+	// capabilities, including their availability zone and labels.
+	//
+	//					 SSNTP ClusterTopology Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x15) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	ClusterTopology
+
+	// ImagePullProgress is periodically sent by workload agents while
+	// they pull the docker image of an instance they are starting.  The
+	// Scheduler forwards it to the Controller that started the instance.
+	//
+	//					 SSNTP ImagePullProgress Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x16) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	ImagePullProgress
+
+	// InstanceUnhealthy is sent by workload agents when the health check
+	// of one of their running instances starts failing.  The Scheduler
+	// forwards it to the Controller that started the instance.
+	//
+	//					 SSNTP InstanceUnhealthy Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x17) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	InstanceUnhealthy
+
+	// InstanceDiskFull is sent by workload agents when the rootfs of one
+	// of their instances uses all the disk space allocated to it.  The
+	// Scheduler forwards it to the Controller that started the instance.
+	//
+	//					 SSNTP InstanceDiskFull Event frame
+	//
+	//	+----------------------------------------------------------------------------+
+	//	| Major | Minor | Type  | Operand |  Payload Length | YAML formatted payload |
+	//	|       |       | (0x3) |  (0x18) |                 |                        |
+	//	+----------------------------------------------------------------------------+
+	InstanceDiskFull
 )
 
 // SSNTP clients and servers can have one or several roles and are expected to declare their
@@ -492,6 +927,22 @@ const (
 	// When the scheduler receives such error back from any client it should revert
 	// back to the previous valid configuration.
 	InvalidConfiguration
+
+	// ConnectionRefused is sent by SSNTP servers to clients whose connection
+	// would exceed one of the server connection limits. The payload tells
+	// which limit was reached. Unlike ConnectionAborted, clients should try
+	// to connect again later.
+	ConnectionRefused
+
+	// UnauthorizedFrame is sent by SSNTP servers to clients that sent
+	// a frame their role is not allowed to send. The frame is dropped
+	// and the payload describes it.
+	UnauthorizedFrame
+
+	// InvalidPayload is sent back to the sender of a frame whose payload
+	// could not be unmarshalled or failed validation. The frame is dropped
+	// and the payload lists the invalid fields.
+	InvalidPayload
 )
 
 const major = 0
@@ -517,6 +968,8 @@ func (t Type) String() string {
 		return "EVENT"
 	case ERROR:
 		return "ERROR"
+	case STREAM:
+		return "STREAM"
 	}
 
 	return ""
@@ -544,6 +997,24 @@ func (command Command) String() string {
 		return "Release public IP"
 	case CONFIGURE:
 		return "CONFIGURE"
+	case PREFETCH:
+		return "PREFETCH"
+	case STOPGROUP:
+		return "STOPGROUP"
+	case DELETEGROUP:
+		return "DELETEGROUP"
+	case COLLECTDIAGNOSTICS:
+		return "COLLECTDIAGNOSTICS"
+	case POWERDOWN:
+		return "POWERDOWN"
+	case REPLAYEVENTS:
+		return "REPLAYEVENTS"
+	case SECURITYGROUP:
+		return "SECURITYGROUP"
+	case RESERVE:
+		return "RESERVE"
+	case TOPOLOGY:
+		return "TOPOLOGY"
 	}
 
 	return ""
@@ -561,6 +1032,14 @@ func (status Status) String() string {
 		return "OFFLINE"
 	case MAINTENANCE:
 		return "MAINTENANCE"
+	case KEEPALIVE:
+		return "KEEPALIVE"
+	case ACK:
+		return "ACK"
+	case RELAYCONNECTED:
+		return "RELAYCONNECTED"
+	case RELAYDISCONNECTED:
+		return "RELAYDISCONNECTED"
 	}
 
 	return ""
@@ -584,6 +1063,40 @@ func (status Event) String() string {
 		return "Node Connected"
 	case NodeDisconnected:
 		return "Node Disconnected"
+	case InstanceReady:
+		return "Instance Ready"
+	case DiagnosticsData:
+		return "Diagnostics Data"
+	case AttestationQuote:
+		return "Attestation Quote"
+	case NodeCapabilities:
+		return "Node Capabilities"
+	case InstanceStateChanged:
+		return "Instance State Changed"
+	case WorkloadDefinition:
+		return "Workload Definition"
+	case EventsReplayed:
+		return "Events Replayed"
+	case PublicIPPoolRegistered:
+		return "Public IP Pool Registered"
+	case PublicIPReleased:
+		return "Public IP Released"
+	case TenantNetworksReport:
+		return "Tenant Networks Report"
+	case TenantNetworkDrift:
+		return "Tenant Network Drift"
+	case UpgradeProgress:
+		return "Upgrade Progress"
+	case ReservationStatus:
+		return "Reservation Status"
+	case ClusterTopology:
+		return "Cluster Topology"
+	case ImagePullProgress:
+		return "Image Pull Progress"
+	case InstanceUnhealthy:
+		return "Instance Unhealthy"
+	case InstanceDiskFull:
+		return "Instance Disk Full"
 	}
 
 	return ""
@@ -607,6 +1120,12 @@ func (error Error) String() string {
 		return "SSNTP Connection aborted"
 	case InvalidConfiguration:
 		return "Cluster configuration is invalid"
+	case ConnectionRefused:
+		return "SSNTP Connection refused"
+	case UnauthorizedFrame:
+		return "Unauthorized SSNTP frame"
+	case InvalidPayload:
+		return "Invalid SSNTP frame payload"
 	}
 
 	return ""
@@ -682,6 +1201,18 @@ type Config struct {
 	// and IPs on the running host.
 	URI string
 
+	// URIs lists the standby SSNTP servers clients fail over to when
+	// they can not reach URI, in order of preference. Each of them
+	// may carry its own port, e.g. "scheduler2:8888".
+	// Servers ignore URIs.
+	URIs []string
+
+	// SRV is a DNS domain that clients look SSNTP servers up in, through
+	// its _ssntp._tcp SRV records. They are tried after URI and URIs,
+	// and looked up again every time the client connects.
+	// Servers ignore SRV.
+	SRV string
+
 	// Role is a bitmask of SSNTP roles the client or server intends
 	// to run.
 	Role uint32
@@ -694,15 +1225,32 @@ type Config struct {
 	// Cert is the client or server x509 signed certificate path.
 	// If set to "", /etc/pki/ciao/client.pem and /etc/pki/ciao/ciao.pem
 	// will be used for SSNTP clients and server, respectively.
+	// Both CAcert and Cert can be rotated at runtime through the
+	// client and server ReloadCertificates methods.
 	Cert string
 
-	// Transport is the underlying transport protocol. Only "tcp" and "unix"
-	// transports are supported. The default is "tcp".
+	// Transport is the underlying transport protocol. "tcp", "unix" and
+	// "websocket" transports are supported. The default is "tcp".
+	// The "websocket" transport carries SSNTP over WebSocket on top of
+	// TLS, which lets clients reach servers through HTTPS proxies, as
+	// set by the HTTPS_PROXY environment variable. Clients and servers
+	// must use the same transport.
 	Transport string
 
 	// ForwardRules is optional and contains a list of frame forwarding rules.
 	ForwardRules []FrameForwardRule
 
+	// Authorizations is optional and lists the frames that SSNTP servers
+	// accept from each client role. When set, frames from clients whose
+	// roles are not authorized to send them are neither forwarded nor
+	// notified, and an UnauthorizedFrame error is sent back instead.
+	// By default clients can send any frame.
+	Authorizations []FrameAuthorization
+
+	// Metrics is optional and is called to report SSNTP connections,
+	// frames, bytes, send latencies and errors.
+	Metrics Metrics
+
 	// Log is the SSNTP logging interface.
 	// If not set, only error messages will be logged.
 	// The SSNTP Log implementation provides a default logger.
@@ -719,6 +1267,197 @@ type Config struct {
 
 	// Trace configures the desired level of SSNTP frame tracing.
 	Trace *TraceConfig
+
+	// KeepaliveInterval is the interval at which KEEPALIVE frames are
+	// sent to the peer.  This is optional, keepalives are disabled by
+	// default.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout is the time after which a peer that has sent at
+	// least one KEEPALIVE frame, but from which no frame has since been
+	// received, is considered dead and disconnected.  Peers that have
+	// never sent a KEEPALIVE frame are not timed out, so that older
+	// peers are not disconnected.  This is optional, the default is three
+	// times KeepaliveInterval.
+	KeepaliveTimeout time.Duration
+
+	// ForwardTimeout bounds the time an SSNTP server spends forwarding
+	// a frame to each of its recipients. Frames that a slow recipient
+	// could not take in time are dropped. This is optional and only
+	// used by servers, forwarding is not bounded by default.
+	ForwardTimeout time.Duration
+
+	// SendQueueLength enables bounded send queues on SSNTP servers: the
+	// frames sent or forwarded to each client are queued, up to
+	// SendQueueLength of them, and written to the client by a dedicated
+	// routine, so that a stuck client does not block its senders. Send
+	// contexts are then only checked before queueing frames. This is
+	// optional and only used by servers, frames are written straight
+	// away by default.
+	SendQueueLength int
+
+	// SendQueueOverflow tells servers what to do when a client send queue
+	// is full. Frames are dropped, oldest first, by default.
+	SendQueueOverflow OverflowPolicy
+
+	// Recording is the path of a file where the SSNTP client or server
+	// records the frames, with their payloads, that it sends and
+	// receives. Recordings can be read back with a RecordingReader, or
+	// replayed with the ciao-replay tool. The file is truncated when
+	// the client dials or the server starts serving. This is optional,
+	// frames are not recorded by default.
+	Recording string
+
+	// Reconnect configures how an SSNTP client spaces out its connection
+	// attempts when dialing a server or when the connection to the server
+	// is lost. This is optional and only used by clients, the Backoff
+	// defaults are used when it is not set.
+	Reconnect *Backoff
+
+	// Encodings lists, in order of preference, the payload encodings
+	// besides YAML this SSNTP entity can marshal and unmarshal. When
+	// connecting, the client and the server agree on the first client
+	// encoding that the server also supports, and fall back to YAML
+	// otherwise. Entities that set Encodings must unmarshal the payloads
+	// they receive with payloads.Unmarshal. This is optional, only YAML
+	// payloads are exchanged by default.
+	Encodings []payloads.Encoding
+
+	// PayloadVersion is the latest version of the payload schemas this
+	// SSNTP entity supports. When connecting, the client and the server
+	// agree on the lowest of their versions, peers that predate payload
+	// versioning supporting payloads.Version1, so that payloads can be
+	// marshalled for the peer with payloads.MarshalVersion. This is
+	// optional and defaults to payloads.CurrentVersion, older versions
+	// being mostly useful to test rolling upgrades.
+	PayloadVersion payloads.Version
+
+	// AtLeastOnce turns the at-least-once delivery mode on.  When both
+	// the client and the server turn it on, the COMMAND, EVENT and ERROR
+	// frames they send to each other carry an ID and are acknowledged by
+	// their receiver once notified.  Frames that are not acknowledged are
+	// sent again, including after a reconnection, and duplicate frames
+	// are acknowledged but not notified again.  This is optional and
+	// disabled by default.
+	AtLeastOnce bool
+
+	// MaxConnections is the maximum number of client connections a
+	// server accepts at the same time. Clients connecting over that limit
+	// are sent a ConnectionRefused error. This is optional, there is no
+	// limit by default.
+	MaxConnections int
+
+	// MaxRoleConnections is the maximum number of client connections a
+	// server accepts at the same time for each of the given client roles.
+	// Clients connecting over that limit are sent a ConnectionRefused
+	// error. This is optional, there is no limit by default.
+	MaxRoleConnections map[uint32]int
+
+	// AcceptRate is the maximum number of connections per second a server
+	// accepts, after an initial burst of AcceptBurst connections. Pending
+	// connections wait in the listen backlog to be accepted. This is
+	// optional, connections are accepted as soon as possible by default.
+	AcceptRate float64
+
+	// AcceptBurst is the number of connections a server can accept
+	// at once when AcceptRate is set. It defaults to 1.
+	AcceptBurst int
+
+	// CRL is the path to a PEM or DER certificate revocation list,
+	// signed by CAcert, that SSNTP servers check client certificates
+	// against. The file is reloaded when it changes, and connected
+	// clients whose certificates get revoked are disconnected.
+	// This is optional, client certificates are not checked for
+	// revocation by default.
+	CRL string
+
+	// OCSP enables SSNTP servers to check client certificates against
+	// the OCSP responders they advertise, when clients connect and
+	// periodically afterwards. Clients are only rejected when a
+	// responder reports their certificate as revoked, unreachable
+	// responders are ignored.
+	OCSP bool
+
+	// RelayedRoles is the set of roles, OR'ed together, that SSNTP
+	// servers accept for the clients of SSNTP relays. Relays can not
+	// prove the roles of their clients with certificates, so servers
+	// rely on relays to verify them. This is optional and defaults to
+	// AGENT | NETAGENT | CNCIAGENT.
+	RelayedRoles uint32
+
+	// Faults configures the faults an SSNTP client or server injects in
+	// its connections, to test how a cluster copes with dropped or delayed
+	// frames and lost connections. When not set, the settings are read
+	// from the SSNTP_FAULTS environment variable. This is optional and
+	// meant for testing only, no fault is injected by default.
+	Faults *FaultInjection
+}
+
+// negotiateEncoding returns the first of the client encodings that is also
+// supported by the server.
+func negotiateEncoding(server, client []payloads.Encoding) payloads.Encoding {
+	for _, c := range client {
+		for _, s := range server {
+			if c == s {
+				return c
+			}
+		}
+	}
+
+	return payloads.YAML
+}
+
+// payloadVersion returns the latest payload version the configured entity
+// supports.
+func (config *Config) payloadVersion() payloads.Version {
+	if config.PayloadVersion == 0 || config.PayloadVersion > payloads.CurrentVersion {
+		return payloads.CurrentVersion
+	}
+
+	return config.PayloadVersion
+}
+
+// negotiatePayloadVersion returns the payload version to use with a peer
+// that supports up to the peer version, 0 for peers that predate payload
+// versioning.
+func negotiatePayloadVersion(local, peer payloads.Version) payloads.Version {
+	if peer < payloads.Version1 {
+		peer = payloads.Version1
+	}
+
+	if peer < local {
+		return peer
+	}
+
+	return local
+}
+
+// estimateClockOffset estimates, as NTP does, how far the server clock is
+// ahead of the client one, from the times t0 and t3 at which the client
+// sent CONNECT and received CONNECTED, according to its clock, and the times
+// t1 and t2 at which the server received CONNECT and sent CONNECTED,
+// according to its own.  rtt is the time the frames spent on the network.
+func estimateClockOffset(t0, t1, t2, t3 int64) (offset, rtt time.Duration) {
+	offset = time.Duration(((t1 - t0) + (t2 - t3)) / 2)
+	rtt = time.Duration((t3 - t0) - (t2 - t1))
+	if rtt < 0 {
+		rtt = 0
+	}
+	return offset, rtt
+}
+
+// keepaliveSettings returns the keepalive interval and timeout to use for the
+// given configuration.
+func (config *Config) keepaliveSettings() (time.Duration, time.Duration) {
+	if config.KeepaliveInterval <= 0 {
+		return 0, config.KeepaliveTimeout
+	}
+
+	if config.KeepaliveTimeout <= 0 {
+		return config.KeepaliveInterval, 3 * config.KeepaliveInterval
+	}
+
+	return config.KeepaliveInterval, config.KeepaliveTimeout
 }
 
 // Logger is an interface for SSNTP users to define their own
@@ -895,7 +1634,7 @@ func getOIDFromRole(role uint32) (asn1.ObjectIdentifier, error) {
 func verifyRole(conn interface{}, role uint32) (bool, error) {
 	var oidError = fmt.Errorf("**** TEMPORARY WARNING ****\n*** Wrong certificate or missing/mismatched role OID ***\nIn order to fix this, use the -role option when generating your certificates with the ciao-cert tool.\n")
 	switch tlsConn := conn.(type) {
-	case *tls.Conn:
+	case connectionStater:
 		state := tlsConn.ConnectionState()
 		roleOID, err := getOIDFromRole(role)
 		if err != nil {
@@ -18,15 +18,36 @@ package ssntp
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/pem"
+	"expvar"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path"
+	"reflect"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/docker/distribution/uuid"
+	"golang.org/x/crypto/ocsp"
+	"golang.org/x/net/context"
+
+	"github.com/01org/ciao/payloads"
 )
 
 type ssntpEchoServer struct {
@@ -183,6 +204,7 @@ type ssntpClient struct {
 	cmdTracedChannel   chan string
 	cmdDurationChannel chan time.Duration
 	cmdDumpChannel     chan struct{}
+	cmdTraceIDChannel  chan string
 	staTracedChannel   chan string
 	evtTracedChannel   chan string
 	errTracedChannel   chan string
@@ -226,6 +248,10 @@ func (client *ssntpClient) CommandNotify(command Command, frame *Frame) {
 		}
 	}
 
+	if client.cmdTraceIDChannel != nil {
+		client.cmdTraceIDChannel <- frame.TraceID()
+	}
+
 	if client.cmdTracedChannel != nil {
 		if frame.Trace.Label != nil {
 			client.cmdTracedChannel <- string(frame.Trace.Label)
@@ -1104,6 +1130,57 @@ func TestTracedLabelCommand(t *testing.T) {
 	}
 }
 
+// Test SSNTP Command trace ID propagation
+//
+// Test that an SSNTP client can send a Command frame carrying a trace ID
+// to an echo server and then receives it back with the same trace ID.
+//
+// Test is expected to pass.
+func TestTracedIDCommand(t *testing.T) {
+	var serverConfig Config
+	var clientConfig Config
+	var server ssntpEchoFwderServer
+	var client ssntpClient
+
+	server.t = t
+	client.t = t
+	client.cmdTraceIDChannel = make(chan string)
+	serverConfig.Transport = *transport
+	clientConfig.Transport = *transport
+
+	serverConfig.ForwardRules = []FrameForwardRule{
+		{
+			Operand:        START,
+			CommandForward: &server,
+		},
+	}
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(500 * time.Millisecond)
+	err := client.ssntp.Dial(&clientConfig, &client)
+	if err != nil {
+		t.Fatalf("Failed to connect")
+	}
+
+	traceID := "TraceClient"
+	client.payload = []byte{'Y', 'A', 'M', 'L'}
+	client.ssntp.SendTracedCommand(START, client.payload,
+		&TraceConfig{
+			TraceID: []byte(traceID),
+			SpanID:  []byte("SpanClient"),
+		},
+	)
+
+	check := <-client.cmdTraceIDChannel
+
+	client.ssntp.Close()
+	server.ssntp.Stop()
+
+	if check != traceID {
+		t.Fatalf("Did not receive the right trace ID %s", check)
+	}
+}
+
 // Test SSNTP Command traced frame networking path
 //
 // Test that an SSNTP client can send a traced Command frame to an echo
@@ -2021,6 +2098,1730 @@ var (
 	payloadSize = flag.Int("payload", 1<<11, "Frames payload size")
 )
 
+// Test SSNTP keepalive settings
+//
+// Test that the keepalive timeout defaults to three keepalive intervals
+// and that keepalives are disabled by default.
+//
+// Test is expected to pass.
+func TestKeepaliveSettings(t *testing.T) {
+	var config Config
+
+	interval, timeout := config.keepaliveSettings()
+	if interval != 0 || timeout != 0 {
+		t.Fatalf("Keepalives should be disabled by default")
+	}
+
+	config.KeepaliveInterval = 10 * time.Second
+	interval, timeout = config.keepaliveSettings()
+	if interval != 10*time.Second || timeout != 30*time.Second {
+		t.Fatalf("Wrong default keepalive timeout %v", timeout)
+	}
+
+	config.KeepaliveTimeout = time.Minute
+	interval, timeout = config.keepaliveSettings()
+	if interval != 10*time.Second || timeout != time.Minute {
+		t.Fatalf("Wrong keepalive settings %v %v", interval, timeout)
+	}
+}
+
+// Test SSNTP reconnection backoff
+//
+// Test that the delay between two connection attempts grows
+// exponentially up to the maximum delay, that it is jittered and
+// that it goes back to the initial delay once reset.
+//
+// Test is expected to pass.
+func TestBackoff(t *testing.T) {
+	b := newBackoff(&Backoff{
+		Initial:    time.Second,
+		Max:        10 * time.Second,
+		Multiplier: 2,
+		Jitter:     0.5,
+	})
+
+	expected := []time.Duration{1, 2, 4, 8, 10, 10}
+	for i, e := range expected {
+		max := e * time.Second
+		delay := b.next()
+		if delay > max || delay < max/2 {
+			t.Fatalf("Delay %d is %v, expected between %v and %v", i, delay, max/2, max)
+		}
+	}
+
+	b.reset()
+	if delay := b.next(); delay > time.Second {
+		t.Fatalf("Delay %v not reset", delay)
+	}
+
+	b = newBackoff(nil)
+	if b.Initial != defaultBackoffInitial || b.Max != defaultBackoffMax ||
+		b.Multiplier != defaultBackoffMultiplier || b.Jitter != defaultBackoffJitter {
+		t.Fatalf("Wrong default backoff %+v", b.Backoff)
+	}
+}
+
+// Test SSNTP payload encoding negotiation
+//
+// Test that the first client encoding supported by the server is
+// picked, and that YAML is used when there is none.
+//
+// Test is expected to pass.
+func TestNegotiateEncoding(t *testing.T) {
+	msgpack := []payloads.Encoding{payloads.MsgPack}
+
+	if e := negotiateEncoding(msgpack, msgpack); e != payloads.MsgPack {
+		t.Fatalf("Wrong negotiated encoding %s", e)
+	}
+
+	server := []payloads.Encoding{payloads.MsgPack, payloads.JSON}
+	if e := negotiateEncoding(server, []payloads.Encoding{payloads.JSON, payloads.MsgPack}); e != payloads.JSON {
+		t.Fatalf("The client preferred encoding should be picked, not %s", e)
+	}
+
+	if e := negotiateEncoding(msgpack, []payloads.Encoding{payloads.JSON}); e != payloads.YAML {
+		t.Fatalf("Unsupported encodings should fall back to YAML, not %s", e)
+	}
+
+	if e := negotiateEncoding(nil, msgpack); e != payloads.YAML {
+		t.Fatalf("Old servers should get YAML payloads, not %s", e)
+	}
+
+	if e := negotiateEncoding(msgpack, nil); e != payloads.YAML {
+		t.Fatalf("Old clients should get YAML payloads, not %s", e)
+	}
+}
+
+// Test SSNTP payload version negotiation
+//
+// Test that the lowest of the client and server payload versions
+// is picked, and that peers not advertising any get the first one.
+//
+// Test is expected to pass.
+func TestNegotiatePayloadVersion(t *testing.T) {
+	if v := negotiatePayloadVersion(payloads.Version2, payloads.Version1); v != payloads.Version1 {
+		t.Fatalf("Wrong negotiated payload version %s", v)
+	}
+
+	if v := negotiatePayloadVersion(payloads.Version2, payloads.Version2); v != payloads.Version2 {
+		t.Fatalf("Wrong negotiated payload version %s", v)
+	}
+
+	if v := negotiatePayloadVersion(payloads.CurrentVersion, 0); v != payloads.Version1 {
+		t.Fatalf("Old peers should get %s payloads, not %s", payloads.Version1, v)
+	}
+}
+
+// Test SSNTP clock offset estimation
+//
+// Test that the offset between the client and server clocks is estimated
+// from the CONNECT and CONNECTED times, net of the network delays.
+//
+// Test is expected to pass.
+func TestEstimateClockOffset(t *testing.T) {
+	second := int64(time.Second)
+
+	offset, rtt := estimateClockOffset(10*second, 15*second+second/10, 15*second+2*second/10, 10*second+3*second/10)
+	if offset != 5*time.Second || rtt != 200*time.Millisecond {
+		t.Fatalf("Wrong clock offset %s or round trip time %s", offset, rtt)
+	}
+
+	offset, rtt = estimateClockOffset(10*second, 7*second, 7*second, 10*second)
+	if offset != -3*time.Second || rtt != 0 {
+		t.Fatalf("Wrong clock offset %s or round trip time %s", offset, rtt)
+	}
+}
+
+// Test SSNTP streams
+//
+// Test that a large payload written to a stream is split into
+// STREAM frames and reassembled by the receiving session.
+//
+// Test is expected to pass.
+func TestStream(t *testing.T) {
+	srcConn, destConn := net.Pipe()
+	defer srcConn.Close()
+	defer destConn.Close()
+
+	src := newSession(nil, 0, 0, srcConn)
+	dest := newSession(nil, 0, 0, destConn)
+
+	data := make([]byte, 3*streamChunkSize+1234)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	go func() {
+		w := src.openStream("test")
+		for d := data; len(d) > 0; {
+			n := 1000
+			if n > len(d) {
+				n = len(d)
+			}
+			w.Write(d[:n])
+			d = d[n:]
+		}
+		w.Close()
+	}()
+
+	streamCh := make(chan *Stream, 1)
+	var chunks int
+	for last := false; !last; chunks++ {
+		var frame Frame
+		err := dest.Read(&frame)
+		if err != nil {
+			t.Fatalf("Could not read STREAM frame: %s", err)
+		}
+
+		if frame.Type != STREAM || frame.Stream == nil {
+			t.Fatalf("Expected a STREAM frame, got %s", frame.Type)
+		}
+		last = frame.Stream.Last
+
+		err = dest.receiveStream(&frame, func(s *Stream) { streamCh <- s })
+		if err != nil {
+			t.Fatalf("Could not receive STREAM frame: %s", err)
+		}
+	}
+
+	if chunks != 4 {
+		t.Errorf("Expected 4 chunks, got %d", chunks)
+	}
+
+	s := <-streamCh
+	if s.Name != "test" {
+		t.Errorf("Wrong stream name %s", s.Name)
+	}
+
+	received, err := ioutil.ReadAll(s)
+	if err != nil {
+		t.Fatalf("Could not read stream: %s", err)
+	}
+
+	if !bytes.Equal(data, received) {
+		t.Fatalf("Received stream does not match")
+	}
+}
+
+// Test SSNTP stream interruption
+//
+// Test that a stream whose chunks are not received in sequence
+// is interrupted.
+//
+// Test is expected to pass.
+func TestStreamInterrupted(t *testing.T) {
+	session := newSession(nil, 0, 0, nil)
+	streamCh := make(chan *Stream, 1)
+	notify := func(s *Stream) { streamCh <- s }
+
+	header := &StreamHeader{ID: 1, Name: "test"}
+	err := session.receiveStream(session.streamFrame(header, []byte("chunk")), notify)
+	if err != nil {
+		t.Fatalf("Could not receive first STREAM frame: %s", err)
+	}
+
+	header = &StreamHeader{ID: 1, Sequence: 2}
+	err = session.receiveStream(session.streamFrame(header, []byte("chunk")), notify)
+	if err == nil {
+		t.Fatalf("Out of sequence STREAM frame should be rejected")
+	}
+
+	_, err = ioutil.ReadAll(<-streamCh)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("Interrupted stream should fail, got %v", err)
+	}
+}
+
+// Test SSNTP at-least-once retry queue
+//
+// Test that frames sent in at-least-once mode get growing IDs, and
+// that only the unacknowledged ones are sent again, in order.
+//
+// Test is expected to pass.
+func TestRetryQueue(t *testing.T) {
+	srcConn, destConn := net.Pipe()
+	defer srcConn.Close()
+	defer destConn.Close()
+
+	src := newSession(nil, 0, 0, srcConn)
+	dest := newSession(nil, 0, 0, destConn)
+	q := newRetryQueue(errLog)
+
+	frameCh := make(chan Frame)
+	go func() {
+		for {
+			var frame Frame
+			if dest.Read(&frame) != nil {
+				close(frameCh)
+				return
+			}
+			frameCh <- frame
+		}
+	}()
+
+	var ids []uint64
+	for i := 0; i < 3; i++ {
+		go q.send(context.Background(), src, src.eventFrame(InstanceDeleted, nil, nil))
+		frame := <-frameCh
+		if len(ids) > 0 && frame.ID <= ids[len(ids)-1] {
+			t.Fatalf("Frame IDs are not growing: %d after %d", frame.ID, ids[len(ids)-1])
+		}
+		ids = append(ids, frame.ID)
+	}
+
+	q.ack(ids[1])
+
+	go q.resend(src, 0)
+	for _, id := range []uint64{ids[0], ids[2]} {
+		frame := <-frameCh
+		if frame.ID != id {
+			t.Fatalf("Expected frame %d to be sent again, got %d", id, frame.ID)
+		}
+	}
+
+	q.ack(ids[0])
+	q.ack(ids[2])
+	if len(q.pending) != 0 {
+		t.Fatalf("All frames have been acknowledged, %d still pending", len(q.pending))
+	}
+}
+
+// Test SSNTP frame priorities
+//
+// Test that control plane commands have a higher priority than
+// telemetry frames.
+//
+// Test is expected to pass.
+func TestFramePriority(t *testing.T) {
+	var session session
+
+	tests := []struct {
+		frame    *Frame
+		priority Priority
+	}{
+		{session.commandFrame(DELETE, nil, nil), HighPriority},
+		{session.commandFrame(EVACUATE, nil, nil), HighPriority},
+		{session.statusFrame(KEEPALIVE, nil, nil), HighPriority},
+		{session.commandFrame(START, nil, nil), NormalPriority},
+		{session.eventFrame(InstanceDeleted, nil, nil), NormalPriority},
+		{session.commandFrame(STATS, nil, nil), LowPriority},
+		{session.eventFrame(TraceReport, nil, nil), LowPriority},
+		{session.streamFrame(&StreamHeader{}, nil), LowPriority},
+	}
+
+	for _, test := range tests {
+		if p := test.frame.Priority(); p != test.priority {
+			t.Errorf("Wrong priority for %s: %s instead of %s", test.frame, p, test.priority)
+		}
+	}
+}
+
+// Test SSNTP frame path times
+//
+// Test that the duration of a traced frame is broken down into the time
+// it waited before being sent, the time it spent on the wire and the time
+// the forwarding node held it.
+//
+// Test is expected to pass.
+func TestFramePathTimes(t *testing.T) {
+	var session session
+
+	start := time.Now()
+	frame := session.commandFrame(START, nil, &TraceConfig{PathTrace: true, Start: start})
+	frame.Trace.Path[0].TxTimestamp = start.Add(10 * time.Millisecond)
+	frame.Trace.Path = append(frame.Trace.Path,
+		Node{
+			RxTimestamp: start.Add(12 * time.Millisecond),
+			TxTimestamp: start.Add(42 * time.Millisecond),
+		},
+		Node{RxTimestamp: start.Add(45 * time.Millisecond)})
+	frame.Trace.PathLength = 3
+
+	queued, transit, forwarding, err := frame.PathTimes()
+	if err != nil {
+		t.Fatalf("Unable to get path times: %v", err)
+	}
+
+	if queued != 10*time.Millisecond || transit != 5*time.Millisecond ||
+		forwarding != 30*time.Millisecond {
+		t.Errorf("Wrong path times: %s %s %s", queued, transit, forwarding)
+	}
+
+	if _, _, _, err = session.commandFrame(START, nil, nil).PathTimes(); err == nil {
+		t.Errorf("Untraced frame has path times")
+	}
+}
+
+// Test SSNTP write priority lanes
+//
+// Test that writers waiting for a session are served by priority
+// and, within a priority class, in order.
+//
+// Test is expected to pass.
+func TestPriorityLock(t *testing.T) {
+	var l priorityLock
+	var wg sync.WaitGroup
+	order := make(chan string, 4)
+
+	l.lock(NormalPriority)
+
+	waiters := []struct {
+		name     string
+		priority Priority
+	}{
+		{"low", LowPriority},
+		{"normal", NormalPriority},
+		{"high1", HighPriority},
+		{"high2", HighPriority},
+	}
+
+	for i, w := range waiters {
+		wg.Add(1)
+		go func(name string, p Priority) {
+			defer wg.Done()
+			l.lock(p)
+			order <- name
+			l.unlock()
+		}(w.name, w.priority)
+
+		// Wait for the writer to be queued
+		for queued := 0; queued <= i; {
+			l.Lock()
+			queued = 0
+			for p := range l.waiting {
+				queued += len(l.waiting[p])
+			}
+			l.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	l.unlock()
+	wg.Wait()
+	close(order)
+
+	expected := []string{"high1", "high2", "normal", "low"}
+	i := 0
+	for name := range order {
+		if name != expected[i] {
+			t.Fatalf("Writer %d is %s, expected %s", i, name, expected[i])
+		}
+		i++
+	}
+}
+
+// Test SSNTP cancellable writes
+//
+// Test that a writer waiting for a session gives up when its context
+// is done, that the lock is still handed over to the other writers,
+// and that a reliable frame given up on is not queued for resending.
+//
+// Test is expected to pass.
+func TestWriteContext(t *testing.T) {
+	srcConn, destConn := net.Pipe()
+	defer srcConn.Close()
+	defer destConn.Close()
+
+	src := newSession(nil, 0, 0, srcConn)
+	q := newRetryQueue(errLog)
+
+	src.writeLock.lock(NormalPriority)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := src.writeContext(ctx, src.statusFrame(READY, nil, nil)); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the write to time out, got %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	errCh := make(chan error)
+	go func() {
+		_, err := q.send(ctx, src, src.eventFrame(InstanceDeleted, nil, nil))
+		errCh <- err
+	}()
+	cancel()
+	if err := <-errCh; err != context.Canceled {
+		t.Fatalf("Expected the write to be cancelled, got %v", err)
+	}
+
+	if len(q.pending) != 0 {
+		t.Fatalf("Cancelled frame queued for resending")
+	}
+
+	src.writeLock.unlock()
+
+	go src.Write(src.statusFrame(READY, nil, nil))
+
+	var frame Frame
+	dest := newSession(nil, 0, 0, destConn)
+	if err := dest.Read(&frame); err != nil || (Status)(frame.Operand) != READY {
+		t.Fatalf("Could not write after cancelled writes: %v", err)
+	}
+}
+
+// Test SSNTP server send queues
+//
+// Test that queued frames are sent by priority, and that full queues
+// drop or refuse frames according to their overflow policy.
+//
+// Test is expected to pass.
+func TestSendQueue(t *testing.T) {
+	var s session
+
+	stats := s.commandFrame(STATS, nil, nil)
+	start := s.commandFrame(START, nil, nil)
+	del := s.commandFrame(DELETE, nil, nil)
+	ready := s.statusFrame(READY, nil, nil)
+
+	tests := []struct {
+		policy     OverflowPolicy
+		frames     []*Frame
+		dropped    bool
+		disconnect bool
+		expected   []*Frame
+	}{
+		{DropOldest, []*Frame{stats, start, ready}, false, false, []*Frame{start, ready}},
+		{DropOldest, []*Frame{start, del, stats}, false, false, []*Frame{del, stats}},
+		{DropTelemetry, []*Frame{stats, start, ready}, false, false, []*Frame{start, ready}},
+		{DropTelemetry, []*Frame{start, del, stats}, true, false, []*Frame{del, start}},
+		{Disconnect, []*Frame{start, stats, del}, true, true, []*Frame{start, stats}},
+	}
+
+	for i, test := range tests {
+		q := newSendQueue(2, test.policy, uint32(AGENT), nil)
+
+		var disconnect bool
+		var err error
+		for _, frame := range test.frames {
+			disconnect, err = q.push(frame)
+		}
+
+		if (err != nil) != test.dropped || disconnect != test.disconnect {
+			t.Fatalf("Test %d: unexpected push result %v %v", i, disconnect, err)
+		}
+
+		var frames []*Frame
+		for frame := q.pop(); frame != nil; frame = q.pop() {
+			frames = append(frames, frame)
+		}
+
+		if !reflect.DeepEqual(frames, test.expected) {
+			t.Fatalf("Test %d: wrong frames sent %v, expected %v", i, frames, test.expected)
+		}
+	}
+
+	q := newSendQueue(4, DropOldest, uint32(AGENT), nil)
+	for _, frame := range []*Frame{stats, start, del} {
+		q.push(frame)
+	}
+
+	if frames := q.close(); !reflect.DeepEqual(frames, []*Frame{stats, start, del}) {
+		t.Fatalf("Closed queue frames are not in order: %v", frames)
+	}
+
+	if _, err := q.push(start); err == nil {
+		t.Fatalf("Closed queue accepted a frame")
+	}
+
+	var policy OverflowPolicy
+	if err := policy.Set("drop-telemetry"); err != nil || policy != DropTelemetry {
+		t.Fatalf("Could not parse overflow policy: %v", err)
+	}
+}
+
+// Test SSNTP frame recordings
+//
+// Test that the frames a recorder records are read back, in order and
+// with their payloads, by a RecordingReader.
+//
+// Test is expected to pass.
+func TestFrameRecorder(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ssntp-test-recording")
+	if err != nil {
+		t.Fatalf("Unable to create temporary Dir %v", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	recording := path.Join(tmpDir, "recording")
+	src := uuid.Generate()
+	dest := uuid.Generate()
+
+	recorder, err := newFrameRecorder(recording, src.String(), SCHEDULER, true, errLog)
+	if err != nil {
+		t.Fatalf("Could not create recorder: %s", err)
+	}
+
+	session := &session{src: src, srcRole: SCHEDULER, dest: dest, destRole: AGENT}
+	sent := session.commandFrame(START, []byte("start"), nil)
+	received := session.statusFrame(READY, []byte("ready"), nil)
+
+	recorder.record(true, session, sent)
+	recorder.record(false, session, received)
+	recorder.close()
+	recorder.record(true, session, sent)
+
+	file, err := os.Open(recording)
+	if err != nil {
+		t.Fatalf("Could not open recording: %s", err)
+	}
+	defer file.Close()
+
+	reader, err := NewRecordingReader(file)
+	if err != nil {
+		t.Fatalf("Could not read recording: %s", err)
+	}
+
+	header := reader.Header()
+	if header.UUID != src.String() || header.Role != SCHEDULER || !header.Server {
+		t.Fatalf("Invalid recording header %v", header)
+	}
+
+	for _, expected := range []struct {
+		sent  bool
+		frame *Frame
+	}{{true, sent}, {false, received}} {
+		recorded, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Could not read recorded frame: %s", err)
+		}
+
+		if recorded.Sent != expected.sent || recorded.Peer != dest.String() || recorded.PeerRole != AGENT {
+			t.Fatalf("Invalid recorded frame %v", recorded)
+		}
+
+		if recorded.Frame.Type != expected.frame.Type || recorded.Frame.Operand != expected.frame.Operand ||
+			!bytes.Equal(recorded.Frame.Payload, expected.frame.Payload) {
+			t.Fatalf("Recorded %s, expected %s", recorded.Frame, *expected.frame)
+		}
+	}
+
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("Frames recorded after close: %v", err)
+	}
+}
+
+type relayTestServer struct {
+	notifications []string
+}
+
+func (server *relayTestServer) ConnectNotify(uuid string, role uint32) {
+	server.notifications = append(server.notifications, fmt.Sprintf("connect %s %d", uuid, role))
+}
+
+func (server *relayTestServer) DisconnectNotify(uuid string, role uint32) {
+	server.notifications = append(server.notifications, fmt.Sprintf("disconnect %s %d", uuid, role))
+}
+
+func (server *relayTestServer) StatusNotify(uuid string, status Status, frame *Frame) {
+	server.notifications = append(server.notifications, fmt.Sprintf("status %s %s", uuid, status))
+}
+
+func (server *relayTestServer) CommandNotify(uuid string, command Command, frame *Frame) {
+}
+
+func (server *relayTestServer) EventNotify(uuid string, event Event, frame *Frame) {
+}
+
+func (server *relayTestServer) ErrorNotify(uuid string, error Error, frame *Frame) {
+}
+
+// Test SSNTP relayed clients
+//
+// Test that a server handles the frames a relay sends on behalf of its
+// clients as if they came from directly connected clients, and that the
+// frames sent to relayed clients carry their UUID and role.
+//
+// Test is expected to pass.
+func TestRelayedClients(t *testing.T) {
+	var server Server
+	ntf := &relayTestServer{}
+
+	server.uuid = uuid.Generate()
+	server.role = SCHEDULER
+	server.log = errLog
+	server.ntf = ntf
+	server.sessions = make(map[string]*session)
+	server.forwardRules.init(nil)
+	server.limits = newConnectionLimits(&Config{MaxRoleConnections: map[uint32]int{NETAGENT: 0}})
+	server.relayedRoles = defaultRelayedRoles
+
+	relayUUID := uuid.Generate()
+	relay := newSession(&server.uuid, server.role, SERVER, nil)
+	relay.setDest(relayUUID[:])
+	if !relay.isRelay() {
+		t.Fatalf("SERVER session is not a relay")
+	}
+	server.addSession(relay, relayUUID.String())
+
+	agentUUID := uuid.Generate()
+	agent := agentUUID.String()
+	header := &RelayHeader{UUID: agentUUID[:], Role: AGENT}
+	netUUID := uuid.Generate()
+	controllerUUID := uuid.Generate()
+
+	connect := relay.statusFrame(RELAYCONNECTED, nil, nil)
+	connect.Relay = header
+	server.handleRelayedFrame(relay, connect)
+
+	session := server.getSession(agent)
+	if session == nil || session.relay != relay || session.destRole != AGENT {
+		t.Fatalf("Relayed client session not added")
+	}
+
+	ready := relay.statusFrame(READY, nil, nil)
+	ready.Relay = header
+	server.handleRelayedFrame(relay, ready)
+	if ready.Relay != nil {
+		t.Fatalf("Relay header passed to notifiers")
+	}
+
+	start := session.commandFrame(START, nil, nil)
+	relayed := session.relayedFrame(start)
+	if relayed.Relay == nil || !bytes.Equal(relayed.Relay.UUID, agentUUID[:]) || relayed.Relay.Role != AGENT {
+		t.Fatalf("Invalid relay header %v", relayed.Relay)
+	}
+	if start.Relay != nil {
+		t.Fatalf("Relayed frame not copied")
+	}
+
+	for _, h := range []*RelayHeader{
+		{UUID: agentUUID[:], Role: AGENT},
+		{UUID: relayUUID[:], Role: AGENT},
+		{UUID: netUUID[:], Role: NETAGENT},
+		{UUID: controllerUUID[:], Role: Controller},
+		{UUID: controllerUUID[:], Role: AGENT | Controller},
+	} {
+		other := newSession(&server.uuid, server.role, SERVER, nil)
+		other.setDest(relayUUID[:])
+		connect := other.statusFrame(RELAYCONNECTED, nil, nil)
+		connect.Relay = h
+		server.handleRelayedFrame(other, connect)
+	}
+	if server.getSession(agent) != session || server.getSession(relayUUID.String()) != relay ||
+		server.getSession(netUUID.String()) != nil || server.getSession(controllerUUID.String()) != nil {
+		t.Fatalf("Relayed client with a duplicate UUID, a refused role or over the limits accepted")
+	}
+
+	server.disconnectRelay(relay)
+	if server.getSession(agent) != nil {
+		t.Fatalf("Relayed client session not removed")
+	}
+	if server.limits.total != 0 || server.limits.perRole[AGENT] != 0 {
+		t.Fatalf("Relayed client connections not released")
+	}
+
+	expected := []string{
+		fmt.Sprintf("connect %s %d", agent, AGENT),
+		fmt.Sprintf("status %s %s", agent, READY),
+		fmt.Sprintf("disconnect %s %d", agent, AGENT),
+	}
+	if !reflect.DeepEqual(ntf.notifications, expected) {
+		t.Fatalf("Got notifications %v, expected %v", ntf.notifications, expected)
+	}
+}
+
+// Test SSNTP server connection limits
+//
+// Test that the server connection limits, global and per role,
+// are enforced and that released connections can be reused.
+//
+// Test is expected to pass.
+func TestConnectionLimits(t *testing.T) {
+	l := newConnectionLimits(&Config{
+		MaxConnections:     2,
+		MaxRoleConnections: map[uint32]int{AGENT: 1},
+	})
+
+	if !l.acquire() || !l.acquire() {
+		t.Fatalf("Could not acquire connections below the limit")
+	}
+
+	if l.acquire() {
+		t.Fatalf("Acquired a connection over the limit")
+	}
+
+	l.release()
+	if !l.acquire() {
+		t.Fatalf("Could not acquire a released connection")
+	}
+
+	if !l.acquireRole(AGENT) {
+		t.Fatalf("Could not acquire an agent connection")
+	}
+
+	if l.acquireRole(AGENT) {
+		t.Fatalf("Acquired an agent connection over the limit")
+	}
+
+	if !l.acquireRole(Controller) || !l.acquireRole(Controller) {
+		t.Fatalf("Controller connections are not limited")
+	}
+
+	l.releaseRole(AGENT)
+	if !l.acquireRole(AGENT) {
+		t.Fatalf("Could not acquire a released agent connection")
+	}
+}
+
+// Test SSNTP server accept throttling
+//
+// Test that the server accepts a burst of connections at once and
+// then spaces out the following ones according to the accept rate.
+//
+// Test is expected to pass.
+func TestAcceptThrottle(t *testing.T) {
+	if newAcceptThrottle(&Config{}) != nil {
+		t.Fatalf("Connections should not be throttled by default")
+	}
+
+	throttle := newAcceptThrottle(&Config{AcceptRate: 10, AcceptBurst: 3})
+	now := throttle.last
+
+	for i := 0; i < 3; i++ {
+		if d := throttle.delay(now); d != 0 {
+			t.Fatalf("Connection %d of the burst delayed by %v", i, d)
+		}
+	}
+
+	if d := throttle.delay(now); d != 100*time.Millisecond {
+		t.Fatalf("Wrong delay after the burst %v", d)
+	}
+
+	if d := throttle.delay(now.Add(time.Second)); d != 0 {
+		t.Fatalf("Connection delayed by %v after the bucket refilled", d)
+	}
+}
+
+// Test SSNTP certificate reload
+//
+// Test that reloading the certificates picks the new certificate
+// file up, and that a failed reload keeps the current certificates.
+//
+// Test is expected to pass.
+func TestReloadCertificates(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ssntp-test-certs")
+	if err != nil {
+		t.Fatalf("Unable to create temporary Dir %v", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	CACert, serverCert, _ := getCertPaths(tmpDir, testCACertScheduler, testCertScheduler, testCertAgent)
+
+	certs := newTLSConfig(&Config{CAcert: CACert, Cert: serverCert}, true)
+	initial := certs.get()
+	if initial == nil {
+		t.Fatalf("Could not load the certificates")
+	}
+
+	err = ioutil.WriteFile(serverCert, []byte(testCertAgent), 0755)
+	if err != nil {
+		t.Fatalf("Unable to rotate certificate %v", err)
+	}
+
+	if err := certs.reload(); err != nil {
+		t.Fatalf("Could not reload the certificates: %s", err)
+	}
+
+	reloaded := certs.get()
+	if bytes.Equal(initial.Certificates[0].Certificate[0], reloaded.Certificates[0].Certificate[0]) {
+		t.Fatalf("Certificate was not reloaded")
+	}
+
+	err = ioutil.WriteFile(serverCert, []byte("Not a certificate"), 0755)
+	if err != nil {
+		t.Fatalf("Unable to rotate certificate %v", err)
+	}
+
+	if err := certs.reload(); err == nil {
+		t.Fatalf("Invalid certificate should not be reloaded")
+	}
+
+	if certs.get() != reloaded {
+		t.Fatalf("Failed reload should keep the current certificates")
+	}
+}
+
+func generateTestCertificate(t *testing.T, serial int64, issuer *x509.Certificate,
+	issuerKey *ecdsa.PrivateKey, ocspServer string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Could not generate key: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("ssntp-test-%d", serial)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+	}
+
+	if ocspServer != "" {
+		template.OCSPServer = []string{ocspServer}
+	}
+
+	if issuer == nil {
+		template.IsCA = true
+		issuer = template
+		issuerKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, &key.PublicKey, issuerKey)
+	if err != nil {
+		t.Fatalf("Could not create certificate: %s", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Could not parse certificate: %s", err)
+	}
+
+	return cert, key
+}
+
+func writeTestCRL(t *testing.T, crlPath string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, serials ...int64) {
+	writeTestCRLValidity(t, crlPath, ca, caKey, time.Now(), time.Now().Add(time.Hour), serials...)
+}
+
+func writeTestCRLValidity(t *testing.T, crlPath string, ca *x509.Certificate, caKey *ecdsa.PrivateKey,
+	thisUpdate, nextUpdate time.Time, serials ...int64) {
+	var revoked []pkix.RevokedCertificate
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+
+	crl, err := ca.CreateCRL(rand.Reader, caKey, revoked, thisUpdate, nextUpdate)
+	if err != nil {
+		t.Fatalf("Could not create CRL: %s", err)
+	}
+
+	err = ioutil.WriteFile(crlPath, pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl}), 0644)
+	if err != nil {
+		t.Fatalf("Could not write CRL: %s", err)
+	}
+}
+
+// Test SSNTP CRL checks
+//
+// Test that certificates listed in the CRL are reported as revoked,
+// that CRL changes are detected and reloaded, and that a CRL that is
+// not signed by the CA, that has expired or that is not valid yet is
+// rejected.
+//
+// Test is expected to pass.
+func TestCRL(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "ssntp-test-crl")
+	if err != nil {
+		t.Fatalf("Unable to create temporary Dir %v", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	ca, caKey := generateTestCertificate(t, 1, nil, nil, "")
+	other, otherKey := generateTestCertificate(t, 1, nil, nil, "")
+	cert2, _ := generateTestCertificate(t, 2, ca, caKey, "")
+	cert3, _ := generateTestCertificate(t, 3, ca, caKey, "")
+
+	caPath := path.Join(tmpDir, "CACert")
+	crlPath := path.Join(tmpDir, "CRL")
+	err = ioutil.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0644)
+	if err != nil {
+		t.Fatalf("Could not write CA certificate: %s", err)
+	}
+	writeTestCRL(t, crlPath, ca, caKey, 2)
+
+	r, err := newRevocationChecker(&Config{CAcert: caPath, CRL: crlPath}, errLog)
+	if err != nil {
+		t.Fatalf("Could not load CRL: %s", err)
+	}
+
+	if !r.inCRL(cert2) || r.inCRL(cert3) {
+		t.Fatalf("Wrong CRL check results")
+	}
+
+	if r.crlChanged() {
+		t.Fatalf("CRL should not have changed")
+	}
+
+	writeTestCRL(t, crlPath, ca, caKey, 2, 3)
+	err = os.Chtimes(crlPath, time.Now(), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Could not update CRL modification time: %s", err)
+	}
+
+	if !r.crlChanged() {
+		t.Fatalf("CRL change not detected")
+	}
+
+	if err := r.loadCRL(); err != nil {
+		t.Fatalf("Could not reload CRL: %s", err)
+	}
+
+	if !r.inCRL(cert3) {
+		t.Fatalf("Reloaded CRL not used")
+	}
+
+	writeTestCRL(t, crlPath, other, otherKey)
+	if err := r.loadCRL(); err == nil {
+		t.Fatalf("CRL from another CA should be rejected")
+	}
+
+	if !r.inCRL(cert3) {
+		t.Fatalf("Rejected CRL should not be used")
+	}
+
+	writeTestCRLValidity(t, crlPath, ca, caKey, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))
+	if err := r.loadCRL(); err == nil {
+		t.Fatalf("Expired CRL should be rejected")
+	}
+
+	writeTestCRLValidity(t, crlPath, ca, caKey, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+	if err := r.loadCRL(); err == nil {
+		t.Fatalf("CRL that is not valid yet should be rejected")
+	}
+
+	if !r.inCRL(cert3) {
+		t.Fatalf("Rejected CRL should not be used")
+	}
+
+	if _, err := newRevocationChecker(&Config{CAcert: caPath, CRL: crlPath}, errLog); err == nil {
+		t.Fatalf("Servers should not start with an invalid CRL")
+	}
+}
+
+// Test SSNTP OCSP checks
+//
+// Test that certificates are reported as revoked only when their
+// OCSP responder says so in a response that has not expired.
+//
+// Test is expected to pass.
+func TestOCSP(t *testing.T) {
+	var ca *x509.Certificate
+	var caKey *ecdsa.PrivateKey
+
+	responder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("Could not read OCSP request: %s", err)
+			return
+		}
+
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			t.Errorf("Invalid OCSP request: %s", err)
+			return
+		}
+
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now(),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+
+		switch request.SerialNumber.Int64() {
+		case 2:
+			template.Status = ocsp.Revoked
+			template.RevokedAt = time.Now()
+		case 5:
+			template.Status = ocsp.Revoked
+			template.RevokedAt = time.Now().Add(-2 * time.Hour)
+			template.ThisUpdate = time.Now().Add(-2 * time.Hour)
+			template.NextUpdate = time.Now().Add(-time.Hour)
+		}
+
+		response, err := ocsp.CreateResponse(ca, ca, template, caKey)
+		if err != nil {
+			t.Errorf("Could not create OCSP response: %s", err)
+			return
+		}
+
+		w.Write(response)
+	}))
+	defer responder.Close()
+
+	ca, caKey = generateTestCertificate(t, 1, nil, nil, "")
+	cert2, _ := generateTestCertificate(t, 2, ca, caKey, responder.URL)
+	cert3, _ := generateTestCertificate(t, 3, ca, caKey, responder.URL)
+	cert4, _ := generateTestCertificate(t, 4, ca, caKey, "")
+
+	r, err := newRevocationChecker(&Config{OCSP: true}, errLog)
+	if err != nil {
+		t.Fatalf("Could not create revocation checker: %s", err)
+	}
+
+	for _, c := range []struct {
+		cert    *x509.Certificate
+		revoked bool
+	}{{cert2, true}, {cert3, false}, {cert4, false}} {
+		revoked, err := r.revokedByOCSP(c.cert, ca)
+		if err != nil {
+			t.Fatalf("OCSP check failed for %s: %s", c.cert.SerialNumber, err)
+		}
+
+		if revoked != c.revoked {
+			t.Fatalf("Wrong OCSP status for %s", c.cert.SerialNumber)
+		}
+	}
+
+	cert5, _ := generateTestCertificate(t, 5, ca, caKey, responder.URL)
+	revoked, err := r.revokedByOCSP(cert5, ca)
+	if err == nil || revoked {
+		t.Fatalf("Expired OCSP response should be ignored")
+	}
+}
+
+// Test SSNTP frame authorization
+//
+// Test that without authorization rules any frame is authorized, and
+// that with rules clients can only send the frames listed for any of
+// their roles.
+//
+// Test is expected to pass.
+func TestFrameAuthorization(t *testing.T) {
+	start := Frame{Type: COMMAND, Operand: (uint8)(START)}
+	stats := Frame{Type: COMMAND, Operand: (uint8)(STATS)}
+	ready := Frame{Type: STATUS, Operand: (uint8)(READY)}
+	tenantAdded := Frame{Type: EVENT, Operand: (uint8)(TenantAdded)}
+	startFailure := Frame{Type: ERROR, Operand: (uint8)(StartFailure)}
+	stream := Frame{Type: STREAM, Stream: &StreamHeader{ID: 1}}
+
+	var a *frameAuthorizer
+	if newFrameAuthorizer(nil) != nil || !a.authorized(AGENT, &start) {
+		t.Fatalf("Frames should be authorized by default")
+	}
+
+	a = newFrameAuthorizer([]FrameAuthorization{
+		{
+			Role:     Controller,
+			Commands: []Command{START},
+		},
+		{
+			Role:     AGENT,
+			Commands: []Command{STATS},
+			Statuses: []Status{READY},
+			Errors:   []Error{StartFailure},
+			Streams:  true,
+		},
+		{
+			Role:   NETAGENT | CNCIAGENT,
+			Events: []Event{TenantAdded},
+		},
+	})
+
+	for _, c := range []struct {
+		role       uint32
+		frame      *Frame
+		authorized bool
+	}{
+		{Controller, &start, true},
+		{Controller, &stats, false},
+		{AGENT, &start, false},
+		{AGENT, &stats, true},
+		{AGENT, &ready, true},
+		{AGENT, &startFailure, true},
+		{AGENT, &stream, true},
+		{AGENT, &tenantAdded, false},
+		{NETAGENT, &tenantAdded, true},
+		{CNCIAGENT, &tenantAdded, true},
+		{NETAGENT, &ready, false},
+		{AGENT | NETAGENT, &tenantAdded, true},
+		{AGENT | NETAGENT, &ready, true},
+		{SCHEDULER, &ready, false},
+	} {
+		if a.authorized(c.role, c.frame) != c.authorized {
+			t.Fatalf("Wrong authorization for %s %s from role 0x%x",
+				c.frame.Type, operandString(c.frame), c.role)
+		}
+	}
+}
+
+func metricsVar(t *testing.T, m *expvar.Map, names ...string) string {
+	for _, name := range names[:len(names)-1] {
+		m = m.Get(name).(*expvar.Map)
+	}
+
+	v := m.Get(names[len(names)-1])
+	if v == nil {
+		t.Fatalf("Missing %v metric", names)
+	}
+
+	return v.String()
+}
+
+// Test SSNTP expvar metrics
+//
+// Test that connections, frames, bytes and errors are accounted for
+// in the exported expvar variable.
+//
+// Test is expected to pass.
+func TestExpvarMetrics(t *testing.T) {
+	srcConn, destConn := net.Pipe()
+	defer srcConn.Close()
+
+	metrics := NewExpvarMetrics("ssntp-test-metrics")
+	src := newSession(nil, Controller, AGENT, srcConn)
+	src.metrics = metrics
+	dest := newSession(nil, AGENT, Controller, destConn)
+	dest.metrics = metrics
+
+	metrics.Connected(AGENT)
+	metrics.Connected(AGENT)
+	metrics.Disconnected(AGENT)
+
+	sentCh := make(chan int)
+	go func() {
+		n, err := src.Write(src.commandFrame(START, []byte("payload"), nil))
+		if err != nil {
+			t.Errorf("Could not write frame: %s", err)
+		}
+		sentCh <- n
+	}()
+
+	var frame Frame
+	if err := dest.Read(&frame); err != nil {
+		t.Fatalf("Could not read frame: %s", err)
+	}
+	sent := <-sentCh
+
+	destConn.Close()
+	if _, err := src.Write(src.commandFrame(STOP, nil, nil)); err == nil {
+		t.Fatalf("Write to closed connection should fail")
+	}
+
+	vars := expvar.Get("ssntp-test-metrics").(*expvar.Map)
+	sentBytes := fmt.Sprintf("%d", sent)
+	for _, c := range []struct {
+		names []string
+		value string
+	}{
+		{[]string{"connections", "CNAgent"}, "1"},
+		{[]string{"frames_sent", "COMMAND START"}, "1"},
+		{[]string{"frames_received", "COMMAND START"}, "1"},
+		{[]string{"bytes_sent"}, sentBytes},
+		{[]string{"bytes_received"}, sentBytes},
+		{[]string{"errors", "CNAgent"}, "1"},
+	} {
+		if v := metricsVar(t, vars, c.names...); v != c.value {
+			t.Fatalf("Wrong %v metric %s, expected %s", c.names, v, c.value)
+		}
+	}
+
+	if sent == 0 {
+		t.Fatalf("Sent bytes not accounted for")
+	}
+}
+
+func testTLSConfig(t *testing.T, ca *x509.Certificate, cert *x509.Certificate,
+	key *ecdsa.PrivateKey, server bool) *tls.Config {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Could not marshal key: %s", err)
+	}
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	certPEM := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})...)
+
+	config := prepareTLS(caPEM, certPEM, server)
+	if config == nil {
+		t.Fatalf("Could not build TLS configuration")
+	}
+
+	return config
+}
+
+func testTransport(t *testing.T, listener net.Listener, dial func() (net.Conn, error)) {
+	acceptCh := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Errorf("Could not accept connection: %s", err)
+		}
+		acceptCh <- conn
+	}()
+
+	clientConn, err := dial()
+	if err != nil {
+		t.Fatalf("Could not dial: %s", err)
+	}
+	defer clientConn.Close()
+
+	serverConn := <-acceptCh
+	if serverConn == nil {
+		t.FailNow()
+	}
+	defer serverConn.Close()
+
+	go clientConn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(serverConn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Server read %q: %v", buf, err)
+	}
+
+	go serverConn.Write([]byte("pong"))
+	if _, err := io.ReadFull(clientConn, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("Client read %q: %v", buf, err)
+	}
+
+	cert, _ := peerCertificate(serverConn)
+	if cert == nil || cert.SerialNumber.Int64() != 3 {
+		t.Fatalf("Client certificate not available to the server")
+	}
+}
+
+// Test SSNTP WebSocket transport
+//
+// Test that an SSNTP client and server can exchange data over the
+// WebSocket transport, and that the server can get the client
+// certificate.
+//
+// Test is expected to pass.
+func TestWebsocketTransport(t *testing.T) {
+	ca, caKey := generateTestCertificate(t, 1, nil, nil, "")
+	serverCert, serverKey := generateTestCertificate(t, 2, ca, caKey, "")
+	clientCert, clientKey := generateTestCertificate(t, 3, ca, caKey, "")
+	serverConfig := testTLSConfig(t, ca, serverCert, serverKey, true)
+	clientConfig := testTLSConfig(t, ca, clientCert, clientKey, false)
+
+	transport := newTransport("websocket")
+	listener, err := transport.listen("127.0.0.1:0", func() *tls.Config { return serverConfig })
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+
+	testTransport(t, listener, func() (net.Conn, error) {
+		return transport.dial(listener.Addr().String(), clientConfig)
+	})
+}
+
+// Test SSNTP WebSocket transport through a proxy
+//
+// Test that an SSNTP client can reach an SSNTP server through an
+// HTTP proxy.
+//
+// Test is expected to pass.
+func TestWebsocketProxy(t *testing.T) {
+	ca, caKey := generateTestCertificate(t, 1, nil, nil, "")
+	serverCert, serverKey := generateTestCertificate(t, 2, ca, caKey, "")
+	clientCert, clientKey := generateTestCertificate(t, 3, ca, caKey, "")
+	serverConfig := testTLSConfig(t, ca, serverCert, serverKey, true)
+	clientConfig := testTLSConfig(t, ca, clientCert, clientKey, false)
+
+	transport := newTransport("websocket")
+	listener, err := transport.listen("127.0.0.1:0", func() *tls.Config { return serverConfig })
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+
+	proxied := make(chan struct{}, 1)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "CONNECT" || req.Host != listener.Addr().String() {
+			http.Error(w, "Unexpected request", http.StatusBadRequest)
+			return
+		}
+
+		dest, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dest.Close()
+			return
+		}
+
+		proxied <- struct{}{}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(dest, conn)
+			dest.Close()
+		}()
+		io.Copy(conn, dest)
+		conn.Close()
+	}))
+	defer proxy.Close()
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	testTransport(t, listener, func() (net.Conn, error) {
+		rawConn, err := dialProxy(proxyURL, listener.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+
+		return websocketClient(rawConn, listener.Addr().String(), clientConfig)
+	})
+
+	select {
+	case <-proxied:
+	default:
+		t.Fatalf("Connection did not go through the proxy")
+	}
+}
+
+// Test SSNTP client server list
+//
+// Test that clients try the configured servers, then the ones found
+// in the SRV records, and that the servers they failed to connect to
+// are moved to the end of the list until they are reached again.
+//
+// Test is expected to pass.
+func TestServerList(t *testing.T) {
+	defer func(lookup func(string, string, string) (string, []*net.SRV, error)) {
+		lookupSRV = lookup
+	}(lookupSRV)
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if service != "ssntp" || proto != "tcp" || name != "example.com" {
+			return "", nil, fmt.Errorf("Unexpected SRV lookup %s %s %s", service, proto, name)
+		}
+
+		return "_ssntp._tcp.example.com.", []*net.SRV{
+			{Target: "sched3.example.com.", Port: 9999},
+			{Target: "sched1", Port: 8888},
+		}, nil
+	}
+
+	ca, _ := generateTestCertificate(t, 1, nil, nil, "")
+	caFile, err := ioutil.TempFile("", "ssntp-ca")
+	if err != nil {
+		t.Fatalf("Could not create CA file: %s", err)
+	}
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	caFile.Close()
+
+	config := &Config{
+		URI:    "sched1",
+		URIs:   []string{"sched2:443"},
+		SRV:    "example.com",
+		CAcert: caFile.Name(),
+	}
+	list := newServerList(config, 8888, errLog)
+
+	checkServers := func(expected []string) {
+		servers := list.addresses()
+		if !reflect.DeepEqual(servers, expected) {
+			t.Fatalf("Wrong servers %v, expected %v", servers, expected)
+		}
+	}
+
+	checkServers([]string{"sched1:8888", "sched2:443", "sched3.example.com:9999",
+		"127.0.0.1:8888", "localhost:8888"})
+
+	list.failed("sched1:8888")
+	checkServers([]string{"sched2:443", "sched3.example.com:9999", "127.0.0.1:8888",
+		"localhost:8888", "sched1:8888"})
+
+	list.failed("sched2:443")
+	list.failed("sched2:443")
+	checkServers([]string{"sched3.example.com:9999", "127.0.0.1:8888", "localhost:8888",
+		"sched1:8888", "sched2:443"})
+
+	list.succeeded("sched1:8888")
+	checkServers([]string{"sched1:8888", "sched3.example.com:9999", "127.0.0.1:8888",
+		"localhost:8888", "sched2:443"})
+}
+
+// Test SSNTP server addresses
+//
+// Test that the default port is appended to the server URIs that
+// do not carry one, including bare and bracketed IPv6 addresses.
+//
+// Test is expected to pass.
+func TestServerAddress(t *testing.T) {
+	for _, test := range []struct {
+		uri     string
+		address string
+	}{
+		{"sched1", "sched1:8888"},
+		{"sched2:443", "sched2:443"},
+		{"10.0.0.1", "10.0.0.1:8888"},
+		{"fd00::1", "[fd00::1]:8888"},
+		{"[fd00::1]", "[fd00::1]:8888"},
+		{"[fd00::1]:443", "[fd00::1]:443"},
+	} {
+		if address := serverAddress(test.uri, 8888); address != test.address {
+			t.Errorf("Wrong address %s for %s, expected %s", address, test.uri, test.address)
+		}
+	}
+}
+
+// Test SSNTP broadcast and multicast forwarding decisions
+//
+// Test that Broadcast records the destination roles, that
+// Multicast builds a set of recipients and that SetPayload
+// records the payload to forward.
+//
+// Test is expected to pass.
+func TestForwardDestination(t *testing.T) {
+	var broadcast ForwardDestination
+	broadcast.Broadcast(AGENT | NETAGENT)
+	if broadcast.decision != Broadcast || broadcast.role != AGENT|NETAGENT {
+		t.Fatalf("Wrong broadcast destination %+v", broadcast)
+	}
+
+	var multicast ForwardDestination
+	multicast.Multicast("uuid1", "uuid2", "uuid1")
+	multicast.Multicast("uuid2", "uuid3")
+	if multicast.decision != Multicast {
+		t.Fatalf("Wrong multicast decision %d", multicast.decision)
+	}
+
+	expected := []string{"uuid1", "uuid2", "uuid3"}
+	if !reflect.DeepEqual(multicast.recipientUUIDs, expected) {
+		t.Fatalf("Wrong multicast recipients %v, expected %v", multicast.recipientUUIDs, expected)
+	}
+
+	multicast.SetPayload([]byte("payload"))
+	if multicast.decision != Multicast || string(multicast.payload) != "payload" {
+		t.Fatalf("Wrong rewritten destination %+v", multicast)
+	}
+}
+
+// Test SSNTP reply matching
+//
+// Test that only the first frame carrying the correlation ID of a
+// pending request is delivered to it.
+//
+// Test is expected to pass.
+func TestReplyWaiters(t *testing.T) {
+	var r replyWaiters
+
+	id, err := newCorrelationID()
+	if err != nil || id == 0 {
+		t.Fatalf("Could not get a correlation ID: %d %v", id, err)
+	}
+
+	reply := r.add(id)
+
+	r.deliver(&Frame{Operand: 1})
+	r.deliver(&Frame{Operand: 2, CorrelationID: id + 1})
+	r.deliver(&Frame{Operand: 3, CorrelationID: id})
+	r.deliver(&Frame{Operand: 4, CorrelationID: id})
+
+	select {
+	case frame := <-reply:
+		if frame.Operand != 3 {
+			t.Fatalf("Wrong reply delivered %d", frame.Operand)
+		}
+	default:
+		t.Fatalf("Reply not delivered")
+	}
+
+	select {
+	case frame := <-reply:
+		t.Fatalf("Unexpected reply %d", frame.Operand)
+	default:
+	}
+
+	r.remove(id)
+	if len(r.waiters) != 0 {
+		t.Fatalf("Request still waiting for a reply")
+	}
+}
+
+// Test SSNTP keepalives
+//
+// Test that a client and a server that exchange KEEPALIVE frames
+// stay connected and that the frames are not passed to their notifiers.
+//
+// Test is expected to pass.
+func TestKeepalive(t *testing.T) {
+	var serverConfig Config
+	var clientConfig Config
+	var server ssntpEchoServer
+	var client ssntpClient
+
+	server.t = t
+	client.t = t
+	client.typeChannel = make(chan string, 1)
+	serverConfig.Transport = *transport
+	serverConfig.KeepaliveInterval = 100 * time.Millisecond
+	clientConfig.Transport = *transport
+	clientConfig.KeepaliveInterval = 100 * time.Millisecond
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(500 * time.Millisecond)
+	client.disconnected = make(chan struct{})
+	err := client.ssntp.Dial(&clientConfig, &client)
+	if err != nil {
+		t.Fatalf("Failed to connect")
+	}
+
+	select {
+	case <-client.disconnected:
+		t.Fatalf("Client disconnected despite keepalives")
+	case frameType := <-client.typeChannel:
+		t.Fatalf("Received unexpected %s frame", frameType)
+	case <-time.After(time.Second):
+	}
+
+	client.ssntp.Close()
+	server.ssntp.Stop()
+}
+
+// Test SSNTP dead peer detection
+//
+// Test that a server disconnects a client that has sent a KEEPALIVE
+// frame but then goes silent without closing its connection.
+//
+// Test is expected to pass.
+func TestKeepaliveDeadPeer(t *testing.T) {
+	var serverConfig Config
+	var server ssntpEchoServer
+
+	server.t = t
+	server.roleDisconnectChannel = make(chan string)
+	serverConfig.Transport = *transport
+	serverConfig.KeepaliveTimeout = 300 * time.Millisecond
+
+	go server.ssntp.Serve(&serverConfig, &server)
+	time.Sleep(500 * time.Millisecond)
+
+	clientConfig := Config{
+		Transport: *transport,
+		CAcert:    defaultCA,
+		Cert:      defaultClientCert,
+	}
+	conn, err := tls.Dial(*transport, fmt.Sprintf("%s:%d", defaultURL, port),
+		prepareTLSConfig(&clientConfig, false))
+	if err != nil {
+		t.Fatalf("Failed to dial: %s", err)
+	}
+	defer conn.Close()
+
+	clientUUID := uuid.Generate()
+	session := newSession(&clientUUID, AGENT, 0, conn)
+	if _, err = session.Write(session.connectFrame(nil, false)); err != nil {
+		t.Fatalf("Failed to send CONNECT: %s", err)
+	}
+
+	var connected ConnectedFrame
+	if err = session.Read(&connected); err != nil {
+		t.Fatalf("Failed to receive CONNECTED: %s", err)
+	}
+
+	if _, err = session.Write(session.statusFrame(KEEPALIVE, nil, nil)); err != nil {
+		t.Fatalf("Failed to send KEEPALIVE: %s", err)
+	}
+
+	select {
+	case <-server.roleDisconnectChannel:
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Silent client was not disconnected")
+	}
+
+	server.ssntp.Stop()
+}
+
+// Test SSNTP fault injection settings parsing
+//
+// Test that valid fault injection settings are parsed and that
+// invalid ones are rejected.
+//
+// Test is expected to pass.
+func TestParseFaultInjection(t *testing.T) {
+	faults, err := ParseFaultInjection("drop=0.25, delay=100ms,jitter=10ms,disconnect=1m,seed=42")
+	if err != nil {
+		t.Fatalf("Could not parse fault injection settings: %v", err)
+	}
+
+	expected := FaultInjection{
+		DropRate:           0.25,
+		Delay:              100 * time.Millisecond,
+		DelayJitter:        10 * time.Millisecond,
+		DisconnectInterval: time.Minute,
+		Seed:               42,
+	}
+	if *faults != expected {
+		t.Fatalf("Wrong fault injection settings %+v, expected %+v", *faults, expected)
+	}
+
+	if faults, err = ParseFaultInjection(""); err != nil || faults != nil {
+		t.Fatalf("Empty settings should not inject faults")
+	}
+
+	for _, invalid := range []string{"drop", "drop=2", "delay=soon", "crash=1"} {
+		if _, err = ParseFaultInjection(invalid); err == nil {
+			t.Fatalf("Invalid setting %q accepted", invalid)
+		}
+	}
+}
+
+// Test SSNTP fault injection
+//
+// Test that frames are dropped according to the drop rate, that
+// STREAM frames are never dropped and that connections are closed
+// when a disconnect interval is set.
+//
+// Test is expected to pass.
+func TestFaultInjection(t *testing.T) {
+	if err := os.Unsetenv(FaultsEnv); err != nil {
+		t.Fatalf("Could not unset %s: %v", FaultsEnv, err)
+	}
+
+	faults, err := newFaultInjector(&Config{}, Log)
+	if err != nil || faults != nil {
+		t.Fatalf("Faults should not be injected by default")
+	}
+
+	faults, err = newFaultInjector(&Config{
+		Faults: &FaultInjection{DropRate: 1, DisconnectInterval: 50 * time.Millisecond},
+	}, Log)
+	if err != nil || faults == nil {
+		t.Fatalf("Could not create fault injector: %v", err)
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	clientUUID := uuid.Generate()
+	session := newSession(&clientUUID, AGENT, 0, local)
+	session.faults = faults
+
+	/* A dropped frame never reaches the unread end of the pipe */
+	if n, err := session.Write(session.commandFrame(START, nil, nil)); err != nil || n != 0 {
+		t.Fatalf("Frame was not dropped: %d %v", n, err)
+	}
+
+	if faults.drop(session.streamFrame(&StreamHeader{}, nil)) {
+		t.Fatalf("STREAM frame dropped")
+	}
+
+	faults.armDisconnect(session)
+
+	result := make(chan error)
+	go func() {
+		_, err := remote.Read(make([]byte, 1))
+		result <- err
+	}()
+
+	select {
+	case err = <-result:
+		if err != io.EOF {
+			t.Fatalf("Unexpected read result %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Connection was not closed")
+	}
+}
+
 func TestMain(m *testing.M) {
 	flag.Parse()
 
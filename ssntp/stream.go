@@ -0,0 +1,237 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// streamChunkSize is the maximum payload size of a STREAM frame.
+const streamChunkSize = 64 * 1024
+
+// streamWindow is the number of chunks that can be queued on a Stream before
+// the connection it comes from stops being read.
+const streamWindow = 16
+
+// StreamHeader identifies the chunk of a stream carried by a STREAM frame.
+type StreamHeader struct {
+	// ID identifies the stream among all the streams opened by the
+	// sender on the connection.
+	ID uint32
+
+	// Sequence is the chunk sequence number, starting at 0.
+	Sequence uint32
+
+	// Name is the stream name, only set on its first chunk.
+	Name string
+
+	// Last is true for the last chunk of the stream.
+	Last bool
+}
+
+// ClientStreamNotifier is an optional interface that ClientNotifier
+// implementations can implement to receive streams from the SSNTP server.
+// Streams received by other clients are discarded.
+type ClientStreamNotifier interface {
+	// StreamNotify notifies of a new stream from the SSNTP server.
+	// It is called from a dedicated go routine, which may read the
+	// stream until it returns io.EOF.
+	StreamNotify(stream *Stream)
+}
+
+// ServerStreamNotifier is an optional interface that ServerNotifier
+// implementations can implement to receive streams from SSNTP clients.
+// Streams received by other servers are discarded.
+type ServerStreamNotifier interface {
+	// StreamNotify notifies of a new stream from the uuid SSNTP client.
+	// It is called from a dedicated go routine, which may read the
+	// stream until it returns io.EOF.
+	StreamNotify(uuid string, stream *Stream)
+}
+
+// Stream is an incoming SSNTP stream, i.e. a payload too large to be sent
+// as a single frame and that is received as a sequence of STREAM frames.
+// Streams must be read promptly, as the connection they come from is not
+// read while a stream has too many chunks waiting to be read.
+type Stream struct {
+	// Name is the stream name given by the sender.
+	Name string
+
+	id       uint32
+	sequence uint32
+	chunks   chan []byte
+	chunk    []byte
+	err      error
+}
+
+func newStream(header *StreamHeader) *Stream {
+	return &Stream{
+		Name:   header.Name,
+		id:     header.ID,
+		chunks: make(chan []byte, streamWindow),
+		err:    io.EOF,
+	}
+}
+
+// Read reads the next bytes of the stream. It returns io.EOF once the whole
+// stream has been read, and io.ErrUnexpectedEOF if the stream has been
+// interrupted.
+func (s *Stream) Read(p []byte) (int, error) {
+	for len(s.chunk) == 0 {
+		chunk, ok := <-s.chunks
+		if !ok {
+			return 0, s.err
+		}
+		s.chunk = chunk
+	}
+
+	n := copy(p, s.chunk)
+	s.chunk = s.chunk[n:]
+
+	return n, nil
+}
+
+func (s *Stream) end(err error) {
+	s.err = err
+	close(s.chunks)
+}
+
+// receiveStream processes a STREAM frame, calling notify from a new go
+// routine when the frame opens a new stream.
+func (session *session) receiveStream(frame *Frame, notify func(*Stream)) error {
+	header := frame.Stream
+	if header == nil {
+		return fmt.Errorf("STREAM frame without a stream header")
+	}
+
+	s := session.streams[header.ID]
+	if header.Sequence == 0 {
+		if s != nil {
+			return fmt.Errorf("Stream %d already opened", header.ID)
+		}
+
+		s = newStream(header)
+		session.streams[header.ID] = s
+		go notify(s)
+	} else {
+		if s == nil {
+			return fmt.Errorf("Unknown stream %d", header.ID)
+		}
+
+		if header.Sequence != s.sequence+1 {
+			delete(session.streams, header.ID)
+			s.end(io.ErrUnexpectedEOF)
+			return fmt.Errorf("Stream %d chunk %d received after chunk %d",
+				header.ID, header.Sequence, s.sequence)
+		}
+
+		s.sequence = header.Sequence
+	}
+
+	if len(frame.Payload) > 0 {
+		s.chunks <- frame.Payload
+	}
+
+	if header.Last {
+		delete(session.streams, header.ID)
+		s.end(io.EOF)
+	}
+
+	return nil
+}
+
+// endStreams interrupts all the streams being received on the session.
+func (session *session) endStreams() {
+	for id, s := range session.streams {
+		delete(session.streams, id)
+		s.end(io.ErrUnexpectedEOF)
+	}
+}
+
+func discardStream(s *Stream) {
+	_, _ = io.Copy(ioutil.Discard, s)
+}
+
+// streamWriter splits what is written to it into STREAM frames.
+type streamWriter struct {
+	session *session
+	header  StreamHeader
+	buf     []byte
+	closed  bool
+}
+
+func (session *session) openStream(name string) *streamWriter {
+	return &streamWriter{
+		session: session,
+		header: StreamHeader{
+			ID:   atomic.AddUint32(&session.lastStreamID, 1),
+			Name: name,
+		},
+	}
+}
+
+func (w *streamWriter) send(chunk []byte, last bool) error {
+	header := w.header
+	if header.Sequence > 0 {
+		header.Name = ""
+	}
+	header.Last = last
+
+	_, err := w.session.Write(w.session.streamFrame(&header, chunk))
+	if err != nil {
+		return err
+	}
+
+	w.header.Sequence++
+
+	return nil
+}
+
+// Write sends p, STREAM frames being sent as soon as enough data has
+// been written to fill them.
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, fmt.Errorf("Stream %d closed", w.header.ID)
+	}
+
+	w.buf = append(w.buf, p...)
+	for len(w.buf) > streamChunkSize {
+		err := w.send(w.buf[:streamChunkSize], false)
+		if err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[streamChunkSize:]
+	}
+
+	return len(p), nil
+}
+
+// Close sends the last chunk of the stream.
+func (w *streamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.send(w.buf, true)
+	w.buf = nil
+
+	return err
+}
@@ -0,0 +1,314 @@
+//
+// Copyright (c) 2016 Intel Corporation
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//
+
+package ssntp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// websocketPath is the HTTP path SSNTP servers accept WebSocket
+// connections on.
+const websocketPath = "/ssntp"
+
+// dialTimeout bounds the time spent connecting to a server, so that clients
+// quickly move on to the next one when a server host is down.
+const dialTimeout = 10 * time.Second
+
+// netTransport establishes the TLS authenticated connections SSNTP
+// frames are exchanged over.
+type netTransport interface {
+	// listen returns a listener accepting SSNTP connections on address.
+	// Connections are authenticated with the TLS configuration config
+	// returns when they are accepted.
+	listen(address string, config func() *tls.Config) (net.Listener, error)
+
+	// dial connects to the SSNTP server at address.
+	dial(address string, config *tls.Config) (net.Conn, error)
+}
+
+// connectionStater is implemented by the connections of all transports,
+// to give access to the peer certificates.
+type connectionStater interface {
+	ConnectionState() tls.ConnectionState
+}
+
+// newTransport returns the transport named name, "tcp", "unix" or
+// "websocket". Unknown names fall back to "tcp".
+func newTransport(name string) netTransport {
+	switch name {
+	case "unix":
+		return tlsTransport{"unix"}
+	case "websocket":
+		return websocketTransport{}
+	}
+
+	return tlsTransport{"tcp"}
+}
+
+// tlsTransport runs TLS directly on top of a TCP or unix socket.
+type tlsTransport struct {
+	network string
+}
+
+type tlsListener struct {
+	net.Listener
+	config func() *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.Server(conn, l.config()), nil
+}
+
+func (t tlsTransport) listen(address string, config func() *tls.Config) (net.Listener, error) {
+	listener, err := net.Listen(t.network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tlsListener{listener, config}, nil
+}
+
+func (t tlsTransport) dial(address string, config *tls.Config) (net.Conn, error) {
+	return tls.DialWithDialer(&net.Dialer{Timeout: dialTimeout}, t.network, address, config)
+}
+
+// websocketTransport carries SSNTP over binary WebSocket messages on top of
+// TLS, so that it goes through HTTP proxies and firewalls that only let
+// HTTPS out. Both ends are still authenticated with their certificates.
+type websocketTransport struct{}
+
+// websocketConn is an SSNTP connection over WebSocket.
+type websocketConn struct {
+	*websocket.Conn
+	state      tls.ConnectionState
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newWebsocketConn(ws *websocket.Conn, state tls.ConnectionState, local, remote net.Addr) *websocketConn {
+	ws.PayloadType = websocket.BinaryFrame
+
+	return &websocketConn{
+		Conn:       ws,
+		state:      state,
+		localAddr:  local,
+		remoteAddr: remote,
+		closed:     make(chan struct{}),
+	}
+}
+
+func (c *websocketConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+func (c *websocketConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *websocketConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *websocketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.Conn.Close()
+		close(c.closed)
+	})
+
+	return err
+}
+
+// websocketListener hands the WebSocket connections upgraded by its HTTP
+// server over to Accept.
+type websocketListener struct {
+	tls       net.Listener
+	conns     chan net.Conn
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (l *websocketListener) serve(ws *websocket.Conn) {
+	req := ws.Request()
+	if req.TLS == nil {
+		return
+	}
+
+	remote, _ := net.ResolveTCPAddr("tcp", req.RemoteAddr)
+	conn := newWebsocketConn(ws, *req.TLS, l.tls.Addr(), remote)
+
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		return
+	}
+
+	// The connection is closed as soon as we return
+	<-conn.closed
+}
+
+func (l *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, fmt.Errorf("WebSocket listener closed")
+	}
+}
+
+func (l *websocketListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		err = l.tls.Close()
+		close(l.closed)
+	})
+
+	return err
+}
+
+func (l *websocketListener) Addr() net.Addr {
+	return l.tls.Addr()
+}
+
+func (t websocketTransport) listen(address string, config func() *tls.Config) (net.Listener, error) {
+	listener, err := tlsTransport{"tcp"}.listen(address, config)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &websocketListener{
+		tls:    listener,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(websocketPath, websocket.Server{Handler: l.serve})
+	go http.Serve(listener, mux)
+
+	return l, nil
+}
+
+// dialProxy connects to address through the HTTP proxy at proxyURL.
+func dialProxy(proxyURL *url.URL, address string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxyURL.Host, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	connect := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		connect.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// The response body is the tunnel itself, only the header is read
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s refused to connect to %s: %s", proxyURL.Host, address, resp.Status)
+	}
+
+	return conn, nil
+}
+
+// websocketClient sets up an SSNTP WebSocket connection to the server at
+// address over rawConn.
+func websocketClient(rawConn net.Conn, address string, config *tls.Config) (net.Conn, error) {
+	location := &url.URL{Scheme: "wss", Host: address, Path: websocketPath}
+
+	tlsConfig := config.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+	}
+
+	tlsConn := tls.Client(rawConn, tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	wsConfig, err := websocket.NewConfig(location.String(), "https://"+address)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	ws, err := websocket.NewClient(wsConfig, tlsConn)
+	if err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+
+	return newWebsocketConn(ws, tlsConn.ConnectionState(), tlsConn.LocalAddr(), tlsConn.RemoteAddr()), nil
+}
+
+func (t websocketTransport) dial(address string, config *tls.Config) (net.Conn, error) {
+	// Go through the HTTPS proxy, if any
+	proxyURL, err := http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: address}})
+	if err != nil {
+		return nil, err
+	}
+
+	var rawConn net.Conn
+	if proxyURL != nil {
+		rawConn, err = dialProxy(proxyURL, address)
+	} else {
+		rawConn, err = net.DialTimeout("tcp", address, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return websocketClient(rawConn, address, config)
+}